@@ -7,3 +7,7 @@ require (
 	github.com/gorilla/mux v1.8.1
 	github.com/lib/pq v1.10.9
 )
+
+require github.com/holm/secretsdk v0.0.0
+
+replace github.com/holm/secretsdk => ../infrastructure/secretsdk
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -15,17 +16,20 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/holm/secretsdk"
 	_ "github.com/lib/pq"
 )
 
 type Config struct {
 	DB               *sql.DB
 	EncryptionKey    []byte
+	KeySource        string // secret-store, environment or temporary
 	VaultIntegration bool
 	BackupDir        string
 	mu               sync.RWMutex
@@ -189,12 +193,41 @@ func main() {
 	// Ensure backup directory exists
 	os.MkdirAll(config.BackupDir, 0755)
 
+	// Settings may name secret-store secrets as secret://<path>. Without
+	// secret-store those settings are treated as unset, as they were
+	// before it existed.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	resolved, err := secretsdk.ResolveEnv(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("Warning: secret-store unavailable, using local settings: %v", err)
+	}
+	if len(resolved) > 0 {
+		log.Printf("Read %v from secret-store", resolved)
+	}
+
 	keyStr := getEnv("ENCRYPTION_KEY", "")
+	if strings.HasPrefix(keyStr, secretsdk.RefPrefix) {
+		keyStr = ""
+	}
 	if keyStr != "" {
-		config.EncryptionKey, _ = base64.StdEncoding.DecodeString(keyStr)
+		// Any AES key size works, as it did before keys were checked
+		config.EncryptionKey, err = base64.StdEncoding.DecodeString(keyStr)
+		if n := len(config.EncryptionKey); err != nil || n != 16 && n != 24 && n != 32 {
+			log.Fatalf("ENCRYPTION_KEY must be a base64 encoded 16, 24 or 32 byte AES key")
+		}
+		config.KeySource = "environment"
+		for _, name := range resolved {
+			if name == "ENCRYPTION_KEY" {
+				config.KeySource = "secret-store"
+			}
+		}
 	} else {
+		// Backups encrypted with this key cannot be read after a restart
+		log.Printf("Warning: ENCRYPTION_KEY not set, using a temporary key")
 		config.EncryptionKey = make([]byte, 32)
 		rand.Read(config.EncryptionKey)
+		config.KeySource = "temporary"
 	}
 
 	dbHost := getEnv("DB_HOST", "backup-scheduler-postgres.holm.svc.cluster.local")
@@ -206,7 +239,6 @@ func main() {
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		dbHost, dbPort, dbUser, dbPass, dbName)
 
-	var err error
 	for i := 0; i < 30; i++ {
 		config.DB, err = sql.Open("postgres", connStr)
 		if err == nil {
@@ -1739,7 +1771,8 @@ func vaultStatusHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"available":   true,
 		"integration": config.VaultIntegration,
-		"message":     "Using local AES-256-GCM encryption",
+		"key_source":  config.KeySource,
+		"message":     "Using AES-256-GCM encryption, key from " + config.KeySource,
 	})
 }
 
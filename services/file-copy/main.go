@@ -8,6 +8,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/holm/filesdk"
 )
 
 type CopyRequest struct {
@@ -16,14 +18,19 @@ type CopyRequest struct {
 }
 
 type CopyResponse struct {
-	Success bool   `json:"success"`
-	Source  string `json:"source"`
-	Dest    string `json:"dest"`
-	Size    int64  `json:"size,omitempty"`
-	Error   string `json:"error,omitempty"`
+	Success bool                `json:"success"`
+	Source  string              `json:"source"`
+	Dest    string              `json:"dest"`
+	Size    int64               `json:"size,omitempty"`
+	Error   string              `json:"error,omitempty"`
+	Quota   *filesdk.QuotaCheck `json:"quota,omitempty"`
 }
 
-var storageRoot string
+var (
+	storageRoot string
+	acl         *filesdk.ACL
+	quota       *filesdk.Quota
+)
 
 func main() {
 	storageRoot = os.Getenv("STORAGE_ROOT")
@@ -31,6 +38,9 @@ func main() {
 		storageRoot = "/storage"
 	}
 
+	acl = filesdk.NewACL()
+	quota = filesdk.NewQuota()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -103,6 +113,28 @@ func copyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, check := range []struct{ path, right string }{
+		{req.Source, filesdk.RightRead},
+		{req.Dest, filesdk.RightWrite},
+	} {
+		if status, msg := acl.Authorize(r, check.path, check.right); status != 0 {
+			respondJSON(w, status, CopyResponse{
+				Success: false,
+				Error:   msg,
+			})
+			return
+		}
+	}
+
+	if status, qc := quota.Check(r, req.Dest, srcInfo.Size()); status != 0 {
+		respondJSON(w, status, CopyResponse{
+			Success: false,
+			Error:   qc.Error,
+			Quota:   qc,
+		})
+		return
+	}
+
 	// Create destination parent directory if needed
 	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
 		respondJSON(w, http.StatusInternalServerError, CopyResponse{
@@ -123,6 +155,10 @@ func copyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer src.Close()
 
+	// Only a new file belongs to whoever copied it
+	_, statErr := os.Stat(dstPath)
+	created := os.IsNotExist(statErr)
+
 	dst, err := os.Create(dstPath)
 	if err != nil {
 		respondJSON(w, http.StatusInternalServerError, CopyResponse{
@@ -142,6 +178,11 @@ func copyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if created {
+		acl.Claimed(r, req.Dest)
+	}
+	quota.Record(r, filesdk.UsageChange{Op: "write", Path: req.Dest, Size: written})
+
 	respondJSON(w, http.StatusCreated, CopyResponse{
 		Success: true,
 		Source:  req.Source,
@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/holm/filesdk"
 )
 
 type DeleteResponse struct {
@@ -15,7 +17,12 @@ type DeleteResponse struct {
 	Error   string `json:"error,omitempty"`
 }
 
-var storageRoot string
+var (
+	storageRoot string
+	acl         *filesdk.ACL
+	quota       *filesdk.Quota
+	meta        *filesdk.Meta
+)
 
 func main() {
 	storageRoot = os.Getenv("STORAGE_ROOT")
@@ -23,6 +30,10 @@ func main() {
 		storageRoot = "/storage"
 	}
 
+	acl = filesdk.NewACL()
+	quota = filesdk.NewQuota()
+	meta = filesdk.NewMeta()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -89,6 +100,14 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if status, msg := acl.Authorize(r, reqPath, filesdk.RightDelete); status != 0 {
+		respondJSON(w, status, DeleteResponse{
+			Success: false,
+			Error:   msg,
+		})
+		return
+	}
+
 	// Delete file or directory
 	recursive := r.URL.Query().Get("recursive") == "true"
 	var err error
@@ -106,6 +125,10 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	acl.Deleted(r, reqPath)
+	quota.Record(r, filesdk.UsageChange{Op: "delete", Path: reqPath})
+	meta.Deleted(reqPath)
+
 	respondJSON(w, http.StatusOK, DeleteResponse{
 		Success: true,
 		Path:    reqPath,
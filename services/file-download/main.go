@@ -6,9 +6,14 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/holm/filesdk"
 )
 
-var storageRoot string
+var (
+	storageRoot string
+	acl         *filesdk.ACL
+)
 
 func main() {
 	storageRoot = os.Getenv("STORAGE_ROOT")
@@ -16,6 +21,8 @@ func main() {
 		storageRoot = "/storage"
 	}
 
+	acl = filesdk.NewACL()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -59,6 +66,12 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Authorize before looking, so that refusals do not say what exists
+	if status, msg := acl.Authorize(r, reqPath, filesdk.RightRead); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+
 	// Check if file exists
 	info, err := os.Stat(fullPath)
 	if err != nil {
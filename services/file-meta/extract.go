@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An extractor reads format-specific metadata from an open file. Fields
+// use flat, lower_snake keys so they can be queried the same way as user
+// attributes.
+type extractor func(f *os.File, size int64) (map[string]string, error)
+
+var extractors = map[string]extractor{
+	".jpg":  extractImage,
+	".jpeg": extractImage,
+	".png":  extractImage,
+	".gif":  extractImage,
+	".mp3":  extractMP3,
+	".m4a":  extractMP4Audio,
+	".m4b":  extractMP4Audio,
+	".flac": extractFLAC,
+	".wav":  extractWAV,
+	".pdf":  extractPDF,
+	".epub": extractEPUB,
+}
+
+// extractorFor returns the extractor for a file name, or nil.
+func extractorFor(name string) extractor {
+	return extractors[strings.ToLower(filepath.Ext(name))]
+}
+
+func extractFile(fullPath string, size int64) (map[string]string, error) {
+	ex := extractorFor(fullPath)
+	if ex == nil {
+		return nil, nil
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fields, err := ex(f, size)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		if v = strings.TrimSpace(v); v == "" {
+			delete(fields, k)
+		} else {
+			fields[k] = v
+		}
+	}
+	return fields, nil
+}
+
+func formatDuration(seconds float64) map[string]string {
+	if seconds <= 0 {
+		return nil
+	}
+	return map[string]string{
+		"duration_seconds": fmt.Sprintf("%.1f", seconds),
+		"duration":         time.Duration(seconds * float64(time.Second)).Round(time.Second).String(),
+	}
+}
+
+func merge(dst, src map[string]string) map[string]string {
+	if dst == nil {
+		dst = make(map[string]string)
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+// extractImage reports the dimensions of any image the standard library
+// can decode and, for JPEGs, the camera fields from the EXIF block.
+func extractImage(f *os.File, size int64) (map[string]string, error) {
+	fields := make(map[string]string)
+	if cfg, _, err := image.DecodeConfig(f); err == nil {
+		fields["width"] = fmt.Sprint(cfg.Width)
+		fields["height"] = fmt.Sprint(cfg.Height)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	exif, err := readJPEGExif(f)
+	if err != nil || exif == nil {
+		return fields, nil
+	}
+	return merge(fields, parseExif(exif)), nil
+}
+
+// readJPEGExif returns the TIFF-structured payload of the APP1 Exif
+// segment, or nil if the file has none.
+func readJPEGExif(r io.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, err
+	}
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		if hdr[0] != 0xFF {
+			return nil, nil
+		}
+		marker := hdr[1]
+		// Start of scan: no more metadata segments
+		if marker == 0xDA || marker == 0xD9 {
+			return nil, nil
+		}
+		n := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if n < 0 {
+			return nil, nil
+		}
+		seg := make([]byte, n)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			return nil, err
+		}
+		if marker == 0xE1 && len(seg) > 6 && string(seg[:6]) == "Exif\x00\x00" {
+			return seg[6:], nil
+		}
+	}
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+var tiffTypeSize = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func (t *tiffReader) ifd(off uint32) map[uint16]ifdEntry {
+	entries := make(map[uint16]ifdEntry)
+	if int(off)+2 > len(t.data) {
+		return entries
+	}
+	n := int(t.order.Uint16(t.data[off:]))
+	for i := 0; i < n; i++ {
+		p := int(off) + 2 + i*12
+		if p+12 > len(t.data) {
+			break
+		}
+		tag := t.order.Uint16(t.data[p:])
+		typ := t.order.Uint16(t.data[p+2:])
+		count := t.order.Uint32(t.data[p+4:])
+		sz, ok := tiffTypeSize[typ]
+		if !ok || count > 1<<16 {
+			continue
+		}
+		total := sz * count
+		start := uint32(p + 8)
+		if total > 4 {
+			start = t.order.Uint32(t.data[p+8:])
+		}
+		if int64(start)+int64(total) > int64(len(t.data)) {
+			continue
+		}
+		entries[tag] = ifdEntry{typ: typ, count: count, value: t.data[start : start+total]}
+	}
+	return entries
+}
+
+func (t *tiffReader) str(e ifdEntry) string {
+	return strings.TrimRight(string(e.value), "\x00 ")
+}
+
+func (t *tiffReader) uint(e ifdEntry) (uint32, bool) {
+	switch {
+	case e.typ == 3 && len(e.value) >= 2:
+		return uint32(t.order.Uint16(e.value)), true
+	case (e.typ == 4 || e.typ == 9) && len(e.value) >= 4:
+		return t.order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+func (t *tiffReader) rational(e ifdEntry, i int) (float64, bool) {
+	if (e.typ != 5 && e.typ != 10) || len(e.value) < (i+1)*8 {
+		return 0, false
+	}
+	num := t.order.Uint32(e.value[i*8:])
+	den := t.order.Uint32(e.value[i*8+4:])
+	if den == 0 {
+		return 0, false
+	}
+	if e.typ == 10 {
+		return float64(int32(num)) / float64(int32(den)), true
+	}
+	return float64(num) / float64(den), true
+}
+
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920A
+	tagLensModel        = 0xA434
+)
+
+func parseExif(data []byte) map[string]string {
+	if len(data) < 8 {
+		return nil
+	}
+	t := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil
+	}
+	fields := make(map[string]string)
+	ifd0 := t.ifd(t.order.Uint32(data[4:]))
+
+	if e, ok := ifd0[tagMake]; ok {
+		fields["camera_make"] = t.str(e)
+	}
+	if e, ok := ifd0[tagModel]; ok {
+		fields["camera_model"] = t.str(e)
+	}
+	if e, ok := ifd0[tagOrientation]; ok {
+		if v, ok := t.uint(e); ok {
+			fields["orientation"] = fmt.Sprint(v)
+		}
+	}
+	if e, ok := ifd0[tagDateTime]; ok {
+		fields["taken_at"] = exifTime(t.str(e))
+	}
+
+	if e, ok := ifd0[tagExifIFD]; ok {
+		if off, ok := t.uint(e); ok {
+			sub := t.ifd(off)
+			if e, ok := sub[tagDateTimeOriginal]; ok {
+				fields["taken_at"] = exifTime(t.str(e))
+			}
+			if e, ok := sub[tagExposureTime]; ok {
+				if v, ok := t.rational(e, 0); ok && v > 0 {
+					if v < 1 {
+						fields["exposure_time"] = fmt.Sprintf("1/%.0f", 1/v)
+					} else {
+						fields["exposure_time"] = fmt.Sprintf("%g", v)
+					}
+				}
+			}
+			if e, ok := sub[tagFNumber]; ok {
+				if v, ok := t.rational(e, 0); ok {
+					fields["f_number"] = fmt.Sprintf("%.1f", v)
+				}
+			}
+			if e, ok := sub[tagISO]; ok {
+				if v, ok := t.uint(e); ok {
+					fields["iso"] = fmt.Sprint(v)
+				}
+			}
+			if e, ok := sub[tagFocalLength]; ok {
+				if v, ok := t.rational(e, 0); ok {
+					fields["focal_length"] = fmt.Sprintf("%gmm", v)
+				}
+			}
+			if e, ok := sub[tagLensModel]; ok {
+				fields["lens"] = t.str(e)
+			}
+		}
+	}
+
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		if off, ok := t.uint(e); ok {
+			gps := t.ifd(off)
+			if lat, ok := gpsCoord(t, gps[1], gps[2]); ok {
+				fields["gps_latitude"] = fmt.Sprintf("%.6f", lat)
+			}
+			if lon, ok := gpsCoord(t, gps[3], gps[4]); ok {
+				fields["gps_longitude"] = fmt.Sprintf("%.6f", lon)
+			}
+		}
+	}
+	return fields
+}
+
+// gpsCoord combines a degrees/minutes/seconds triple with its N/S or E/W
+// reference into signed decimal degrees.
+func gpsCoord(t *tiffReader, ref, dms ifdEntry) (float64, bool) {
+	d, ok1 := t.rational(dms, 0)
+	m, ok2 := t.rational(dms, 1)
+	s, ok3 := t.rational(dms, 2)
+	if !ok1 || !ok2 || !ok3 {
+		return 0, false
+	}
+	v := d + m/60 + s/3600
+	if r := t.str(ref); r == "S" || r == "W" {
+		v = -v
+	}
+	return v, true
+}
+
+// exifTime converts "2006:01:02 15:04:05" to RFC 3339, leaving values
+// that do not parse as they are.
+func exifTime(s string) string {
+	if ts, err := time.Parse("2006:01:02 15:04:05", s); err == nil {
+		return ts.Format("2006-01-02T15:04:05")
+	}
+	return s
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// ID3v2 frames worth keeping, by v2.3/v2.4 and v2.2 frame ID.
+var id3Frames = map[string]string{
+	"TIT2": "title", "TT2": "title",
+	"TPE1": "artist", "TP1": "artist",
+	"TPE2": "album_artist", "TP2": "album_artist",
+	"TALB": "album", "TAL": "album",
+	"TCOM": "composer", "TCM": "composer",
+	"TRCK": "track", "TRK": "track",
+	"TPOS": "disc", "TPA": "disc",
+	"TCON": "genre", "TCO": "genre",
+	"TYER": "year", "TYE": "year",
+	"TDRC": "year",
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
+
+// decodeID3Text decodes a text frame body: an encoding byte followed by
+// Latin-1, UTF-16 with BOM, UTF-16BE or UTF-8.
+func decodeID3Text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	enc, b := b[0], b[1:]
+	switch enc {
+	case 1, 2:
+		order := binary.ByteOrder(binary.BigEndian)
+		if enc == 1 && len(b) >= 2 {
+			if b[0] == 0xFF && b[1] == 0xFE {
+				order = binary.LittleEndian
+			}
+			b = b[2:]
+		}
+		u := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			c := order.Uint16(b[i:])
+			if c == 0 {
+				break
+			}
+			u = append(u, c)
+		}
+		return string(utf16.Decode(u))
+	case 3:
+		return strings.TrimRight(string(b), "\x00")
+	}
+	return latin1(bytes.TrimRight(b, "\x00"))
+}
+
+func latin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// readID3v2 parses the tag at the start of r and returns its fields and
+// total length, which is where the audio frames start.
+func readID3v2(r io.ReaderAt) (map[string]string, int64) {
+	var hdr [10]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil || string(hdr[:3]) != "ID3" {
+		return nil, 0
+	}
+	version := hdr[3]
+	tagSize := syncsafe(hdr[6:])
+	total := int64(10 + tagSize)
+	if hdr[5]&0x10 != 0 {
+		total += 10 // Footer
+	}
+	if tagSize > 64<<20 {
+		return nil, total
+	}
+	body := make([]byte, tagSize)
+	if _, err := r.ReadAt(body, 10); err != nil {
+		return nil, total
+	}
+	pos := 0
+	if hdr[5]&0x40 != 0 && len(body) >= 4 {
+		// Extended header; its size is syncsafe in v2.4 and excludes
+		// itself in v2.3
+		if version == 4 {
+			pos = syncsafe(body)
+		} else {
+			pos = int(binary.BigEndian.Uint32(body)) + 4
+		}
+	}
+
+	fields := make(map[string]string)
+	idLen, hdrLen := 4, 10
+	if version == 2 {
+		idLen, hdrLen = 3, 6
+	}
+	for pos+hdrLen <= len(body) {
+		id := string(body[pos : pos+idLen])
+		if id[0] == 0 {
+			break // Padding
+		}
+		var size int
+		switch version {
+		case 2:
+			size = int(body[pos+3])<<16 | int(body[pos+4])<<8 | int(body[pos+5])
+		case 4:
+			size = syncsafe(body[pos+4:])
+		default:
+			size = int(binary.BigEndian.Uint32(body[pos+4:]))
+		}
+		start := pos + hdrLen
+		if size < 0 || start+size > len(body) {
+			break
+		}
+		if key, ok := id3Frames[id]; ok {
+			if _, seen := fields[key]; !seen {
+				fields[key] = decodeID3Text(body[start : start+size])
+			}
+		}
+		pos = start + size
+	}
+	return fields, total
+}
+
+// readID3v1 reads the fixed 128-byte tag at the end of older MP3s.
+func readID3v1(r io.ReaderAt, size int64) map[string]string {
+	if size < 128 {
+		return nil
+	}
+	var tag [128]byte
+	if _, err := r.ReadAt(tag[:], size-128); err != nil || string(tag[:3]) != "TAG" {
+		return nil
+	}
+	field := func(b []byte) string { return latin1(bytes.TrimRight(b, "\x00 ")) }
+	return map[string]string{
+		"title":  field(tag[3:33]),
+		"artist": field(tag[33:63]),
+		"album":  field(tag[63:93]),
+		"year":   field(tag[93:97]),
+	}
+}
+
+var (
+	mp3BitratesV1 = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	mp3BitratesV2 = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+	mp3Rates      = [3]int{44100, 48000, 32000}
+)
+
+func extractMP3(f *os.File, size int64) (map[string]string, error) {
+	fields, audioStart := readID3v2(f)
+	audioEnd := size
+	if v1 := readID3v1(f, size); v1 != nil {
+		audioEnd -= 128
+		if fields == nil {
+			fields = v1
+		}
+	}
+	if fields == nil {
+		fields = make(map[string]string)
+	}
+
+	// Find the first MPEG audio frame; some encoders leave junk between
+	// the tag and the audio
+	buf := make([]byte, 64*1024)
+	n, _ := f.ReadAt(buf, audioStart)
+	buf = buf[:n]
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xFF || buf[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+		h := binary.BigEndian.Uint32(buf[i:])
+		versionBits := (h >> 19) & 3 // 0: 2.5, 2: 2, 3: 1
+		layer := (h >> 17) & 3       // 1: Layer III
+		brIndex := (h >> 12) & 0xF
+		srIndex := (h >> 10) & 3
+		if versionBits == 1 || layer != 1 || brIndex == 0 || brIndex == 15 || srIndex == 3 {
+			continue
+		}
+		mono := (h>>6)&3 == 3
+
+		rate := mp3Rates[srIndex]
+		bitrate := mp3BitratesV1[brIndex]
+		samplesPerFrame := 1152
+		sideInfo := 32
+		if mono {
+			sideInfo = 17
+		}
+		if versionBits != 3 {
+			rate /= 2
+			if versionBits == 0 {
+				rate /= 2
+			}
+			bitrate = mp3BitratesV2[brIndex]
+			samplesPerFrame = 576
+			sideInfo = 17
+			if mono {
+				sideInfo = 9
+			}
+		}
+
+		// A Xing/Info or VBRI header in the first frame carries the frame
+		// count for VBR files; without one assume constant bitrate
+		frames := 0
+		if x := i + 4 + sideInfo; x+12 <= len(buf) && (string(buf[x:x+4]) == "Xing" || string(buf[x:x+4]) == "Info") {
+			if binary.BigEndian.Uint32(buf[x+4:])&1 != 0 {
+				frames = int(binary.BigEndian.Uint32(buf[x+8:]))
+			}
+		} else if v := i + 4 + 32; v+18 <= len(buf) && string(buf[v:v+4]) == "VBRI" {
+			frames = int(binary.BigEndian.Uint32(buf[v+14:]))
+		}
+
+		var seconds float64
+		if frames > 0 {
+			seconds = float64(frames) * float64(samplesPerFrame) / float64(rate)
+			fields["bitrate"] = "vbr"
+		} else {
+			audio := audioEnd - audioStart - int64(i)
+			seconds = float64(audio) * 8 / float64(bitrate*1000)
+			fields["bitrate"] = fmt.Sprintf("%dkbps", bitrate)
+		}
+		fields["sample_rate"] = fmt.Sprint(rate)
+		return merge(fields, formatDuration(seconds)), nil
+	}
+	return fields, nil
+}
+
+// extractMP4Audio reads duration from the movie header and the iTunes
+// tags from moov/udta/meta/ilst, which is where M4B audiobooks keep their
+// title and author.
+func extractMP4Audio(f *os.File, size int64) (map[string]string, error) {
+	moov, ok := findAtom(f, 0, size, "moov")
+	if !ok {
+		return nil, fmt.Errorf("no moov atom")
+	}
+	if moov.size > 64<<20 {
+		return nil, fmt.Errorf("moov atom too large")
+	}
+	data := make([]byte, moov.size)
+	if _, err := f.ReadAt(data, moov.offset); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string)
+	if mvhd, ok := childAtom(data, "mvhd"); ok && len(mvhd) >= 20 {
+		var timescale, duration uint64
+		if mvhd[0] == 1 && len(mvhd) >= 32 {
+			timescale = uint64(binary.BigEndian.Uint32(mvhd[20:]))
+			duration = binary.BigEndian.Uint64(mvhd[24:])
+		} else {
+			timescale = uint64(binary.BigEndian.Uint32(mvhd[12:]))
+			duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+		}
+		if timescale > 0 {
+			fields = merge(fields, formatDuration(float64(duration)/float64(timescale)))
+		}
+	}
+
+	udta, ok := childAtom(data, "udta")
+	if !ok {
+		return fields, nil
+	}
+	meta, ok := childAtom(udta, "meta")
+	if !ok || len(meta) < 4 {
+		return fields, nil
+	}
+	ilst, ok := childAtom(meta[4:], "ilst")
+	if !ok {
+		return fields, nil
+	}
+	keys := map[string]string{
+		"\xa9nam": "title", "\xa9ART": "artist", "aART": "album_artist",
+		"\xa9alb": "album", "\xa9wrt": "composer", "\xa9day": "year",
+		"\xa9gen": "genre", "\xa9nrt": "narrator", "desc": "description",
+	}
+	walkAtoms(ilst, func(name string, body []byte) {
+		key, ok := keys[name]
+		if !ok {
+			return
+		}
+		if d, ok := childAtom(body, "data"); ok && len(d) > 8 {
+			fields[key] = string(d[8:])
+		}
+	})
+	return fields, nil
+}
+
+type atomRef struct {
+	offset, size int64 // Body, excluding the header
+}
+
+// findAtom scans the top-level atoms of a file for name.
+func findAtom(r io.ReaderAt, off, end int64, name string) (atomRef, bool) {
+	var hdr [16]byte
+	for off+8 <= end {
+		if _, err := r.ReadAt(hdr[:8], off); err != nil {
+			return atomRef{}, false
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		hdrLen := int64(8)
+		switch size {
+		case 0:
+			size = end - off
+		case 1:
+			if _, err := r.ReadAt(hdr[8:16], off+8); err != nil {
+				return atomRef{}, false
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			hdrLen = 16
+		}
+		if size < hdrLen {
+			return atomRef{}, false
+		}
+		if string(hdr[4:8]) == name {
+			return atomRef{offset: off + hdrLen, size: size - hdrLen}, true
+		}
+		off += size
+	}
+	return atomRef{}, false
+}
+
+func walkAtoms(data []byte, fn func(name string, body []byte)) {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			return
+		}
+		fn(string(data[4:8]), data[8:size])
+		data = data[size:]
+	}
+}
+
+func childAtom(data []byte, name string) ([]byte, bool) {
+	var found []byte
+	walkAtoms(data, func(n string, body []byte) {
+		if found == nil && n == name {
+			found = body
+		}
+	})
+	return found, found != nil
+}
+
+// extractFLAC reads duration from STREAMINFO and tags from the Vorbis
+// comment block.
+func extractFLAC(f *os.File, size int64) (map[string]string, error) {
+	var magic [4]byte
+	if _, err := f.ReadAt(magic[:], 0); err != nil || string(magic[:]) != "fLaC" {
+		return nil, fmt.Errorf("not a FLAC file")
+	}
+	fields := make(map[string]string)
+	off := int64(4)
+	for {
+		var hdr [4]byte
+		if _, err := f.ReadAt(hdr[:], off); err != nil {
+			return fields, nil
+		}
+		last := hdr[0]&0x80 != 0
+		typ := hdr[0] & 0x7F
+		n := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		off += 4
+
+		switch typ {
+		case 0: // STREAMINFO
+			var si [18]byte
+			if _, err := f.ReadAt(si[:], off); err == nil {
+				rate := int64(si[10])<<12 | int64(si[11])<<4 | int64(si[12])>>4
+				samples := int64(si[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(si[14:]))
+				if rate > 0 {
+					fields["sample_rate"] = fmt.Sprint(rate)
+					fields = merge(fields, formatDuration(float64(samples)/float64(rate)))
+				}
+			}
+		case 4: // VORBIS_COMMENT
+			if n < 1<<20 {
+				block := make([]byte, n)
+				if _, err := f.ReadAt(block, off); err == nil {
+					fields = merge(fields, parseVorbisComments(block))
+				}
+			}
+		}
+		if last {
+			return fields, nil
+		}
+		off += n
+	}
+}
+
+func parseVorbisComments(b []byte) map[string]string {
+	keys := map[string]string{
+		"TITLE": "title", "ARTIST": "artist", "ALBUM": "album", "ALBUMARTIST": "album_artist",
+		"COMPOSER": "composer", "TRACKNUMBER": "track", "DISCNUMBER": "disc", "GENRE": "genre", "DATE": "year",
+	}
+	fields := make(map[string]string)
+	if len(b) < 4 {
+		return fields
+	}
+	vendor := int(binary.LittleEndian.Uint32(b))
+	pos := 4 + vendor
+	if pos+4 > len(b) {
+		return fields
+	}
+	count := int(binary.LittleEndian.Uint32(b[pos:]))
+	pos += 4
+	for i := 0; i < count && pos+4 <= len(b); i++ {
+		n := int(binary.LittleEndian.Uint32(b[pos:]))
+		pos += 4
+		if n < 0 || pos+n > len(b) {
+			break
+		}
+		k, v, ok := strings.Cut(string(b[pos:pos+n]), "=")
+		pos += n
+		if key, known := keys[strings.ToUpper(k)]; ok && known {
+			if _, seen := fields[key]; !seen {
+				fields[key] = v
+			}
+		}
+	}
+	return fields
+}
+
+// extractWAV computes duration from the fmt chunk's byte rate and the size
+// of the data chunk.
+func extractWAV(f *os.File, size int64) (map[string]string, error) {
+	var hdr [12]byte
+	if _, err := f.ReadAt(hdr[:], 0); err != nil || string(hdr[:4]) != "RIFF" || string(hdr[8:]) != "WAVE" {
+		return nil, fmt.Errorf("not a WAV file")
+	}
+	var byteRate, sampleRate uint32
+	off := int64(12)
+	for off+8 <= size {
+		var ch [8]byte
+		if _, err := f.ReadAt(ch[:], off); err != nil {
+			break
+		}
+		n := int64(binary.LittleEndian.Uint32(ch[4:]))
+		switch string(ch[:4]) {
+		case "fmt ":
+			var fmtChunk [16]byte
+			if _, err := f.ReadAt(fmtChunk[:], off+8); err == nil {
+				sampleRate = binary.LittleEndian.Uint32(fmtChunk[4:])
+				byteRate = binary.LittleEndian.Uint32(fmtChunk[8:])
+			}
+		case "data":
+			if byteRate == 0 {
+				return nil, nil
+			}
+			fields := formatDuration(float64(n) / float64(byteRate))
+			if fields != nil {
+				fields["sample_rate"] = fmt.Sprint(sampleRate)
+			}
+			return fields, nil
+		}
+		off += 8 + n + n%2
+	}
+	return nil, nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// maxPDFSize bounds how much of a PDF is read to count pages, and
+// maxPDFInflated how much its streams may inflate to in total.
+const (
+	maxPDFSize     = 128 << 20
+	maxPDFInflated = 32 << 20
+)
+
+var (
+	pdfPagesCount = regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)|/Count\s+(\d+)[^>]*?/Type\s*/Pages\b`)
+	pdfPageObject = regexp.MustCompile(`/Type\s*/Page(?:[^s]|$)`)
+	pdfStream     = regexp.MustCompile(`(?s)stream\r?\n(.*?)endstream`)
+	pdfInfoString = regexp.MustCompile(`/(Title|Author|Subject)\s*(\(|<[0-9A-Fa-f\s]*>)`)
+	pdfInfoRef    = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+)
+
+// extractPDF reports the page count and the Title and Author from the
+// document info dictionary. Files using compressed object streams keep
+// their page tree inside a FlateDecode stream, so those are inflated and
+// searched when the plain text has no answer.
+func extractPDF(f *os.File, size int64) (map[string]string, error) {
+	if size > maxPDFSize {
+		return nil, fmt.Errorf("pdf larger than %d bytes", maxPDFSize)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF")) {
+		return nil, fmt.Errorf("not a PDF file")
+	}
+
+	var infoObj []byte
+	if m := pdfInfoRef.FindSubmatch(data); m != nil {
+		infoObj = []byte(fmt.Sprintf("%s %s obj", m[1], m[2]))
+	}
+	fields := pdfInfo(data, infoObj)
+	pages := pdfPageCount(data)
+	if pages == 0 || len(fields) == 0 && infoObj != nil {
+		var inflated bytes.Buffer
+		for _, m := range pdfStream.FindAllSubmatch(data, -1) {
+			if inflated.Len() >= maxPDFInflated {
+				break
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(m[1]))
+			if err != nil {
+				continue
+			}
+			io.Copy(&inflated, io.LimitReader(zr, int64(maxPDFInflated-inflated.Len())))
+			zr.Close()
+		}
+		if pages == 0 {
+			pages = pdfPageCount(inflated.Bytes())
+		}
+		if len(fields) == 0 {
+			fields = pdfInfo(inflated.Bytes(), infoObj)
+		}
+	}
+	if pages > 0 {
+		fields["pages"] = strconv.Itoa(pages)
+	}
+	return fields, nil
+}
+
+// pdfPageCount prefers the largest /Count of a /Pages node, which is the
+// root of the page tree, and falls back to counting /Page objects.
+func pdfPageCount(data []byte) int {
+	max := 0
+	for _, m := range pdfPagesCount.FindAllSubmatch(data, -1) {
+		s := m[1]
+		if len(s) == 0 {
+			s = m[2]
+		}
+		if n, err := strconv.Atoi(string(s)); err == nil && n > max {
+			max = n
+		}
+	}
+	if max > 0 {
+		return max
+	}
+	return len(pdfPageObject.FindAll(data, -1))
+}
+
+// pdfInfo reads the document info dictionary, the object the trailer's
+// /Info points at. Outline entries also have a /Title, so the search is
+// limited to that one object.
+func pdfInfo(data, objHeader []byte) map[string]string {
+	fields := make(map[string]string)
+	if objHeader == nil {
+		return fields
+	}
+	start := bytes.Index(data, objHeader)
+	if start < 0 || start > 0 && data[start-1] >= '0' && data[start-1] <= '9' {
+		return fields
+	}
+	data = data[start:]
+	if end := bytes.Index(data, []byte("endobj")); end >= 0 {
+		data = data[:end]
+	}
+	for _, loc := range pdfInfoString.FindAllSubmatchIndex(data, -1) {
+		key := strings.ToLower(string(data[loc[2]:loc[3]]))
+		if _, seen := fields[key]; seen {
+			continue
+		}
+		var raw []byte
+		if data[loc[4]] == '(' {
+			raw = pdfLiteral(data[loc[5]:])
+		} else {
+			hexStr := strings.Join(strings.Fields(string(data[loc[4]+1:loc[5]-1])), "")
+			if len(hexStr)%2 == 1 {
+				hexStr += "0"
+			}
+			raw, _ = hex.DecodeString(hexStr)
+		}
+		if s := pdfText(raw); s != "" {
+			fields[key] = s
+		}
+	}
+	if v, ok := fields["subject"]; ok {
+		delete(fields, "subject")
+		fields["description"] = v
+	}
+	return fields
+}
+
+// pdfLiteral reads a literal string up to its closing parenthesis,
+// handling nesting and backslash escapes.
+func pdfLiteral(b []byte) []byte {
+	var out []byte
+	depth := 0
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch c {
+		case '\\':
+			i++
+			if i >= len(b) {
+				return out
+			}
+			switch e := b[i]; e {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// Line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					j := i
+					for j < len(b) && j < i+3 && b[j] >= '0' && b[j] <= '7' {
+						j++
+					}
+					v, _ := strconv.ParseUint(string(b[i:j]), 8, 8)
+					out = append(out, byte(v))
+					i = j - 1
+				} else {
+					out = append(out, e)
+				}
+			}
+		case '(':
+			depth++
+			out = append(out, c)
+		case ')':
+			if depth == 0 {
+				return out
+			}
+			depth--
+			out = append(out, c)
+		default:
+			out = append(out, c)
+		}
+		if len(out) > 4096 {
+			return out
+		}
+	}
+	return out
+}
+
+// pdfText decodes a text string, which is either UTF-16BE with a byte
+// order mark or PDFDocEncoding (close enough to Latin-1 for titles).
+func pdfText(b []byte) string {
+	if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+		u := make([]uint16, 0, len(b)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+		return strings.TrimSpace(string(utf16.Decode(u)))
+	}
+	return strings.TrimSpace(latin1(b))
+}
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type epubPackage struct {
+	Metadata struct {
+		Titles      []string `xml:"title"`
+		Creators    []string `xml:"creator"`
+		Language    string   `xml:"language"`
+		Publisher   string   `xml:"publisher"`
+		Date        string   `xml:"date"`
+		Description string   `xml:"description"`
+		Meta        []struct {
+			Name    string `xml:"name,attr"`
+			Content string `xml:"content,attr"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+}
+
+// extractEPUB reads the Dublin Core fields from the package document the
+// container points at, plus Calibre's series tags when present.
+func extractEPUB(f *os.File, size int64) (map[string]string, error) {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return nil, err
+	}
+	readFile := func(name string) ([]byte, error) {
+		for _, zf := range zr.File {
+			if zf.Name != name {
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return io.ReadAll(io.LimitReader(rc, 4<<20))
+		}
+		return nil, fmt.Errorf("%s not found in epub", name)
+	}
+
+	data, err := readFile("META-INF/container.xml")
+	if err != nil {
+		return nil, err
+	}
+	var container epubContainer
+	if err := xml.Unmarshal(data, &container); err != nil {
+		return nil, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, fmt.Errorf("epub has no rootfile")
+	}
+	opf := path.Clean(container.Rootfiles[0].FullPath)
+	if data, err = readFile(opf); err != nil {
+		return nil, err
+	}
+	var pkg epubPackage
+	if err := xml.Unmarshal(data, &pkg); err != nil {
+		return nil, err
+	}
+
+	m := pkg.Metadata
+	fields := map[string]string{
+		"author":      strings.Join(m.Creators, "; "),
+		"language":    m.Language,
+		"publisher":   m.Publisher,
+		"date":        m.Date,
+		"description": m.Description,
+	}
+	if len(m.Titles) > 0 {
+		fields["title"] = m.Titles[0]
+	}
+	for _, meta := range m.Meta {
+		switch meta.Name {
+		case "calibre:series":
+			fields["series"] = meta.Content
+		case "calibre:series_index":
+			fields["series_index"] = meta.Content
+		}
+	}
+	if len(fields["description"]) > 1024 {
+		fields["description"] = fields["description"][:1024]
+	}
+	return fields, nil
+}
@@ -11,6 +11,8 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/holm/filesdk"
 )
 
 type FileMeta struct {
@@ -23,6 +25,12 @@ type FileMeta struct {
 	AccessTime time.Time `json:"access_time,omitempty"`
 	Checksum   string    `json:"checksum,omitempty"`
 	Mime       string    `json:"mime,omitempty"`
+
+	// From the sidecar DB: user tags and attributes, and fields read from
+	// the file itself (EXIF, ID3, page count, ...)
+	Tags       []string          `json:"tags,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Extracted  map[string]string `json:"extracted,omitempty"`
 }
 
 type MetaResponse struct {
@@ -31,13 +39,34 @@ type MetaResponse struct {
 	Error   string    `json:"error,omitempty"`
 }
 
-var storageRoot string
+var (
+	storageRoot string
+	stateDir    string
+	metaStore   *MetaStore
+	acl         *filesdk.ACL
+)
 
 func main() {
 	storageRoot = os.Getenv("STORAGE_ROOT")
 	if storageRoot == "" {
 		storageRoot = "/storage"
 	}
+	storageRoot = filepath.Clean(storageRoot)
+
+	stateDir = os.Getenv("META_STATE_DIR")
+	if stateDir == "" {
+		stateDir = "/state"
+	}
+	stateDir = filepath.Clean(stateDir)
+
+	acl = filesdk.NewACL()
+
+	var err error
+	metaStore, err = NewMetaStore(filepath.Join(stateDir, "meta.json"))
+	if err != nil {
+		log.Fatalf("Failed to load metadata store: %v", err)
+	}
+	go flushExtracted()
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -46,6 +75,12 @@ func main() {
 
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/api/v1/meta/", metaHandler)
+	http.HandleFunc("/api/v1/tags", tagListHandler)
+	http.HandleFunc("/api/v1/tags/", tagsHandler)
+	http.HandleFunc("/api/v1/bulk/tags", bulkTagsHandler)
+	http.HandleFunc("/api/v1/query", queryHandler)
+	http.HandleFunc("/api/v1/sidecar/move", sidecarMoveHandler)
+	http.HandleFunc("/api/v1/sidecar/forget", sidecarForgetHandler)
 
 	log.Printf("file-meta starting on :%s (root: %s)", port, storageRoot)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
@@ -75,17 +110,22 @@ func metaHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fullPath := filepath.Join(storageRoot, reqPath)
-
 	// Security: prevent path traversal
-	cleanPath := filepath.Clean(fullPath)
-	if !strings.HasPrefix(cleanPath, filepath.Clean(storageRoot)) {
+	fullPath, ok := resolvePath(reqPath)
+	if !ok {
 		respondJSON(w, http.StatusForbidden, MetaResponse{
 			Success: false,
 			Error:   "forbidden path",
 		})
 		return
 	}
+	if status, msg := acl.Authorize(r, reqPath, filesdk.RightRead); status != 0 {
+		respondJSON(w, status, MetaResponse{
+			Success: false,
+			Error:   msg,
+		})
+		return
+	}
 
 	info, err := os.Stat(fullPath)
 	if os.IsNotExist(err) {
@@ -124,12 +164,47 @@ func metaHandler(w http.ResponseWriter, r *http.Request) {
 		meta.Mime = getMimeType(info.Name())
 	}
 
+	entry := metaStore.Get(reqPath)
+	if !info.IsDir() && r.URL.Query().Get("extract") != "false" && extractorFor(info.Name()) != nil {
+		entry = refreshExtracted(reqPath, fullPath, info, entry)
+	}
+	if entry != nil {
+		meta.Tags = entry.Tags
+		meta.Attributes = entry.Attributes
+		meta.Extracted = entry.Extracted
+	}
+
 	respondJSON(w, http.StatusOK, MetaResponse{
 		Success: true,
 		Meta:    meta,
 	})
 }
 
+// refreshExtracted runs the extractor for a file unless the cached result
+// was taken from the same size and mod time.
+func refreshExtracted(reqPath, fullPath string, info os.FileInfo, entry *Entry) *Entry {
+	if entry != nil && entry.ExtractedSize == info.Size() && entry.ExtractedModTime.Equal(info.ModTime()) {
+		return entry
+	}
+	fields, err := extractFile(fullPath, info.Size())
+	if err != nil {
+		// Cache the failure too, so a damaged file is not re-read on
+		// every request
+		log.Printf("Extracting %s: %v", reqPath, err)
+	}
+	metaStore.SetExtracted(reqPath, fields, info.Size(), info.ModTime())
+	return metaStore.Get(reqPath)
+}
+
+// flushExtracted periodically saves extractor results cached by reads.
+func flushExtracted() {
+	for range time.Tick(30 * time.Second) {
+		if err := metaStore.Flush(); err != nil {
+			log.Printf("Failed to save metadata: %v", err)
+		}
+	}
+}
+
 func calculateChecksum(path string) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -153,7 +228,8 @@ func getMimeType(name string) string {
 		".gif": "image/gif", ".svg": "image/svg+xml", ".webp": "image/webp",
 		".mp4": "video/mp4", ".webm": "video/webm", ".mkv": "video/x-matroska",
 		".mp3": "audio/mpeg", ".wav": "audio/wav", ".flac": "audio/flac",
-		".pdf": "application/pdf", ".zip": "application/zip",
+		".m4a": "audio/mp4", ".m4b": "audio/mp4",
+		".pdf": "application/pdf", ".zip": "application/zip", ".epub": "application/epub+zip",
 		".go": "text/x-go", ".py": "text/x-python", ".rs": "text/x-rust",
 	}
 	if m, ok := mimes[ext]; ok {
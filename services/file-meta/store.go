@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is the sidecar record for one path: user tags and attributes, plus
+// whatever the extractors found the last time the file changed.
+type Entry struct {
+	Tags       []string          `json:"tags,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Extracted  map[string]string `json:"extracted,omitempty"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+
+	// Size and mod time of the file when Extracted was filled in
+	ExtractedSize    int64     `json:"extracted_size,omitempty"`
+	ExtractedModTime time.Time `json:"extracted_mod_time,omitempty"`
+}
+
+func (e *Entry) empty() bool {
+	return len(e.Tags) == 0 && len(e.Attributes) == 0 && len(e.Extracted) == 0
+}
+
+// TagChange is a set of edits applied to one or more paths.
+type TagChange struct {
+	Add    []string          `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Unset  []string          `json:"unset,omitempty"`
+}
+
+// Query selects entries by tag and attribute. Attribute filters match user
+// attributes first and fall back to extracted fields, so "artist=..." finds
+// audiobooks whether the narrator was typed in or read from the ID3 tag.
+type Query struct {
+	Tags   []string
+	Any    bool // Match any of Tags instead of all of them
+	Attrs  map[string]string
+	Prefix string
+}
+
+// QueryResult is one path matched by a Query.
+type QueryResult struct {
+	Path       string            `json:"path"`
+	Tags       []string          `json:"tags,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Extracted  map[string]string `json:"extracted,omitempty"`
+}
+
+// MetaStore keeps the sidecar DB in memory and writes it through to a
+// JSON file on every user change. Extractor results are only a cache, so
+// they are marked dirty and left for Flush rather than rewriting the file
+// on the read that found them stale.
+type MetaStore struct {
+	mu      sync.RWMutex
+	entries map[string]*Entry
+	file    string
+	dirty   bool
+}
+
+// normalizePath maps a client path onto the canonical "/a/b" form used
+// as the sidecar key.
+func normalizePath(p string) string {
+	return path.Clean("/" + filepath.ToSlash(p))
+}
+
+func underPrefix(p, prefix string) bool {
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// normalizeTag lower-cases a tag and trims spaces; tags are compared
+// case-insensitively so "Sci-Fi" and "sci-fi" are the same tag.
+func normalizeTag(t string) string {
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+func validateChange(c *TagChange) error {
+	for _, t := range append(append([]string{}, c.Add...), c.Remove...) {
+		t = normalizeTag(t)
+		if t == "" {
+			return fmt.Errorf("tags must not be empty")
+		}
+		if strings.ContainsAny(t, ",\n") {
+			return fmt.Errorf("tag %q must not contain commas or newlines", t)
+		}
+	}
+	for k := range c.Set {
+		if strings.TrimSpace(k) == "" || strings.ContainsAny(k, "=\n") {
+			return fmt.Errorf("invalid attribute name %q", k)
+		}
+	}
+	return nil
+}
+
+func NewMetaStore(file string) (*MetaStore, error) {
+	s := &MetaStore{entries: make(map[string]*Entry), file: file}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *MetaStore) saveLocked() error {
+	data, err := json.MarshalIndent(s.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0700); err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Flush saves changes SetExtracted left unsaved.
+func (s *MetaStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+// Get returns a copy of the entry for p, or nil if it has none.
+func (s *MetaStore) Get(p string) *Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.entries[normalizePath(p)]
+	if !ok {
+		return nil
+	}
+	return e.copy()
+}
+
+func (e *Entry) copy() *Entry {
+	c := *e
+	c.Tags = append([]string(nil), e.Tags...)
+	c.Attributes = copyMap(e.Attributes)
+	c.Extracted = copyMap(e.Extracted)
+	return &c
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func (s *MetaStore) entryLocked(p string) *Entry {
+	e, ok := s.entries[p]
+	if !ok {
+		e = &Entry{}
+		s.entries[p] = e
+	}
+	return e
+}
+
+func (s *MetaStore) applyLocked(p string, c *TagChange) {
+	e := s.entryLocked(p)
+
+	tags := make(map[string]bool, len(e.Tags))
+	for _, t := range e.Tags {
+		tags[t] = true
+	}
+	for _, t := range c.Add {
+		tags[normalizeTag(t)] = true
+	}
+	for _, t := range c.Remove {
+		delete(tags, normalizeTag(t))
+	}
+	e.Tags = e.Tags[:0]
+	for t := range tags {
+		e.Tags = append(e.Tags, t)
+	}
+	sort.Strings(e.Tags)
+
+	for k, v := range c.Set {
+		if e.Attributes == nil {
+			e.Attributes = make(map[string]string)
+		}
+		e.Attributes[strings.TrimSpace(k)] = v
+	}
+	for _, k := range c.Unset {
+		delete(e.Attributes, k)
+	}
+	if len(e.Attributes) == 0 {
+		e.Attributes = nil
+	}
+	e.UpdatedAt = time.Now().UTC()
+
+	if e.empty() {
+		delete(s.entries, p)
+	}
+}
+
+// Apply applies one change to every path and saves once.
+func (s *MetaStore) Apply(paths []string, c *TagChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range paths {
+		s.applyLocked(normalizePath(p), c)
+	}
+	return s.saveLocked()
+}
+
+// Replace sets the tags and attributes of p, keeping extracted fields.
+func (s *MetaStore) Replace(p string, tags []string, attrs map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p = normalizePath(p)
+	if e, ok := s.entries[p]; ok {
+		e.Tags = nil
+		e.Attributes = nil
+	}
+	s.applyLocked(p, &TagChange{Add: tags, Set: attrs})
+	return s.saveLocked()
+}
+
+// SetExtracted caches extractor output for p, stamped with the file's
+// size and mod time so it is refreshed when the file changes. It is saved
+// by the next Flush or user change.
+func (s *MetaStore) SetExtracted(p string, fields map[string]string, size int64, modTime time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p = normalizePath(p)
+	e := s.entryLocked(p)
+	e.Extracted = fields
+	e.ExtractedSize = size
+	e.ExtractedModTime = modTime
+	if e.UpdatedAt.IsZero() {
+		e.UpdatedAt = time.Now().UTC()
+	}
+	// Files with nothing to extract still get an entry so they are not
+	// re-read on every request.
+	s.dirty = true
+}
+
+// Forget drops p and everything under it, for paths that no longer exist.
+func (s *MetaStore) Forget(p string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p = normalizePath(p)
+	removed := false
+	for k := range s.entries {
+		if underPrefix(k, p) {
+			delete(s.entries, k)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+// Move rekeys p and everything under it to dst.
+func (s *MetaStore) Move(src, dst string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src, dst = normalizePath(src), normalizePath(dst)
+	moved := make(map[string]*Entry)
+	for k, e := range s.entries {
+		if underPrefix(k, src) {
+			delete(s.entries, k)
+			moved[dst+strings.TrimPrefix(k, src)] = e
+		}
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	for k, e := range moved {
+		s.entries[k] = e
+	}
+	return s.saveLocked()
+}
+
+func (e *Entry) lookup(key string) (string, bool) {
+	if v, ok := e.Attributes[key]; ok {
+		return v, true
+	}
+	v, ok := e.Extracted[key]
+	return v, ok
+}
+
+func (e *Entry) matches(q *Query) bool {
+	if len(q.Tags) > 0 {
+		has := make(map[string]bool, len(e.Tags))
+		for _, t := range e.Tags {
+			has[t] = true
+		}
+		hits := 0
+		for _, t := range q.Tags {
+			if has[normalizeTag(t)] {
+				hits++
+			}
+		}
+		if q.Any && hits == 0 || !q.Any && hits < len(q.Tags) {
+			return false
+		}
+	}
+	for k, want := range q.Attrs {
+		v, ok := e.lookup(k)
+		if !ok {
+			return false
+		}
+		if want != "" && !strings.EqualFold(v, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// Find returns the entries matching q, sorted by path.
+func (s *MetaStore) Find(q *Query) []QueryResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prefix := normalizePath(q.Prefix)
+
+	var out []QueryResult
+	for p, e := range s.entries {
+		if !underPrefix(p, prefix) || len(e.Tags) == 0 && len(q.Tags) > 0 {
+			continue
+		}
+		if !e.matches(q) {
+			continue
+		}
+		out = append(out, QueryResult{
+			Path:       p,
+			Tags:       append([]string(nil), e.Tags...),
+			Attributes: copyMap(e.Attributes),
+			Extracted:  copyMap(e.Extracted),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// TagCounts returns every tag in use under prefix and how many paths carry it.
+func (s *MetaStore) TagCounts(prefix string) map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prefix = normalizePath(prefix)
+	counts := make(map[string]int)
+	for p, e := range s.entries {
+		if !underPrefix(p, prefix) {
+			continue
+		}
+		for _, t := range e.Tags {
+			counts[t]++
+		}
+	}
+	return counts
+}
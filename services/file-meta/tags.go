@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/holm/filesdk"
+)
+
+type TagsResponse struct {
+	Success    bool              `json:"success"`
+	Path       string            `json:"path,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+type TagsRequest struct {
+	Tags       []string          `json:"tags"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+type BulkRequest struct {
+	TagChange
+	Paths []string `json:"paths"`
+	// Apply to every file under any directory in Paths instead of the
+	// directory itself
+	Recursive bool `json:"recursive"`
+}
+
+type BulkResponse struct {
+	Success bool     `json:"success"`
+	Updated int      `json:"updated"`
+	Missing []string `json:"missing,omitempty"`
+	// Files under a recursive path the caller may not write to
+	Denied []string `json:"denied,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+type QueryResponse struct {
+	Success bool          `json:"success"`
+	Results []QueryResult `json:"results"`
+	Count   int           `json:"count"`
+	Error   string        `json:"error,omitempty"`
+}
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// resolvePath maps a request path onto the storage root, rejecting
+// anything that escapes it.
+func resolvePath(reqPath string) (string, bool) {
+	fullPath := filepath.Clean(filepath.Join(storageRoot, reqPath))
+	root := filepath.Clean(storageRoot)
+	return fullPath, fullPath == root || strings.HasPrefix(fullPath, root+string(filepath.Separator))
+}
+
+// tagsHandler serves the tags and attributes of one path: GET reads them,
+// PUT replaces them, PATCH applies a TagChange and DELETE clears them.
+// Reading needs the read right on the path and changing it the write right.
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	reqPath := strings.TrimPrefix(r.URL.Path, "/api/v1/tags/")
+	if p := r.URL.Query().Get("path"); p != "" {
+		reqPath = p
+	}
+	if reqPath == "" {
+		respondJSON(w, http.StatusBadRequest, TagsResponse{Error: "path required"})
+		return
+	}
+	fullPath, ok := resolvePath(reqPath)
+	if !ok {
+		respondJSON(w, http.StatusForbidden, TagsResponse{Error: "forbidden path"})
+		return
+	}
+	right := filesdk.RightWrite
+	if r.Method == http.MethodGet {
+		right = filesdk.RightRead
+	}
+	if status, msg := acl.Authorize(r, reqPath, right); status != 0 {
+		respondJSON(w, status, TagsResponse{Error: msg})
+		return
+	}
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		respondJSON(w, http.StatusNotFound, TagsResponse{Error: "not found"})
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req TagsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondJSON(w, http.StatusBadRequest, TagsResponse{Error: "invalid request body"})
+			return
+		}
+		if err := validateChange(&TagChange{Add: req.Tags, Set: req.Attributes}); err != nil {
+			respondJSON(w, http.StatusBadRequest, TagsResponse{Error: err.Error()})
+			return
+		}
+		err = metaStore.Replace(reqPath, req.Tags, req.Attributes)
+	case http.MethodPatch, http.MethodPost:
+		var change TagChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			respondJSON(w, http.StatusBadRequest, TagsResponse{Error: "invalid request body"})
+			return
+		}
+		if err := validateChange(&change); err != nil {
+			respondJSON(w, http.StatusBadRequest, TagsResponse{Error: err.Error()})
+			return
+		}
+		err = metaStore.Apply([]string{reqPath}, &change)
+	case http.MethodDelete:
+		err = metaStore.Replace(reqPath, nil, nil)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, TagsResponse{Error: err.Error()})
+		return
+	}
+
+	resp := TagsResponse{Success: true, Path: reqPath}
+	if e := metaStore.Get(reqPath); e != nil {
+		resp.Tags = e.Tags
+		resp.Attributes = e.Attributes
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// bulkTagsHandler applies one TagChange to many paths, e.g. tagging a
+// whole audiobook series or photo album in one request. Every path needs
+// the write right; files found under a recursive path that the caller may
+// not write to are skipped and listed as denied.
+func bulkTagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req BulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusBadRequest, BulkResponse{Error: "invalid request body"})
+		return
+	}
+	if len(req.Paths) == 0 {
+		respondJSON(w, http.StatusBadRequest, BulkResponse{Error: "paths required"})
+		return
+	}
+	if err := validateChange(&req.TagChange); err != nil {
+		respondJSON(w, http.StatusBadRequest, BulkResponse{Error: err.Error()})
+		return
+	}
+
+	var targets, missing, denied []string
+	for _, p := range req.Paths {
+		fullPath, ok := resolvePath(p)
+		if !ok {
+			respondJSON(w, http.StatusForbidden, BulkResponse{Error: "forbidden path: " + p})
+			return
+		}
+		if status, msg := acl.Authorize(r, p, filesdk.RightWrite); status != 0 {
+			respondJSON(w, status, BulkResponse{Error: msg})
+			return
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			missing = append(missing, p)
+			continue
+		}
+		if !req.Recursive || !info.IsDir() {
+			targets = append(targets, p)
+			continue
+		}
+		// A file below may have stopped inheriting the directory's ACL
+		var status int
+		var msg string
+		filepath.WalkDir(fullPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() && path == stateDir {
+				return filepath.SkipDir
+			}
+			if d.IsDir() {
+				return nil
+			}
+			rel, _ := filepath.Rel(storageRoot, path)
+			switch status, msg = acl.Authorize(r, rel, filesdk.RightWrite); status {
+			case 0:
+				targets = append(targets, rel)
+			case http.StatusForbidden:
+				denied = append(denied, rel)
+				status = 0
+			default:
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		if status != 0 {
+			respondJSON(w, status, BulkResponse{Error: msg})
+			return
+		}
+	}
+
+	if len(targets) > 0 {
+		if err := metaStore.Apply(targets, &req.TagChange); err != nil {
+			respondJSON(w, http.StatusInternalServerError, BulkResponse{Error: err.Error()})
+			return
+		}
+	}
+	respondJSON(w, http.StatusOK, BulkResponse{Success: true, Updated: len(targets), Missing: missing, Denied: denied})
+}
+
+// queryHandler finds paths by tag and attribute. tag may be repeated or
+// comma-separated and must all match unless any=true; attr takes
+// "key=value", or a bare "key" to require only that it is set. This is
+// the API file-search calls for tag filters. Only paths the caller may
+// read are returned.
+func queryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+
+	q := &Query{Prefix: params.Get("path"), Any: params.Get("any") == "true", Attrs: make(map[string]string)}
+	for _, v := range params["tag"] {
+		for _, t := range strings.Split(v, ",") {
+			if t = normalizeTag(t); t != "" {
+				q.Tags = append(q.Tags, t)
+			}
+		}
+	}
+	for _, v := range params["attr"] {
+		k, val, _ := strings.Cut(v, "=")
+		q.Attrs[strings.TrimSpace(k)] = val
+	}
+	if len(q.Tags) == 0 && len(q.Attrs) == 0 {
+		respondJSON(w, http.StatusBadRequest, QueryResponse{Error: "tag or attr required"})
+		return
+	}
+	if _, ok := resolvePath(q.Prefix); !ok {
+		respondJSON(w, http.StatusForbidden, QueryResponse{Error: "forbidden path"})
+		return
+	}
+	limit := 100
+	if n, err := strconv.Atoi(params.Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+
+	// Entries for files removed behind our back are dropped as they are
+	// found
+	results := []QueryResult{}
+	for _, res := range metaStore.Find(q) {
+		fullPath, _ := resolvePath(res.Path)
+		if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+			if err := metaStore.Forget(res.Path); err != nil {
+				log.Printf("Failed to forget %s: %v", res.Path, err)
+			}
+			continue
+		}
+		switch status, msg := acl.Authorize(r, res.Path, filesdk.RightRead); status {
+		case 0:
+		case http.StatusForbidden:
+			continue
+		default:
+			respondJSON(w, status, QueryResponse{Error: msg})
+			return
+		}
+		results = append(results, res)
+		if len(results) == limit {
+			break
+		}
+	}
+	respondJSON(w, http.StatusOK, QueryResponse{Success: true, Results: results, Count: len(results)})
+}
+
+// tagListHandler lists every tag in use, most used first.
+func tagListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tags := []TagCount{}
+	for t, n := range metaStore.TagCounts(r.URL.Query().Get("path")) {
+		tags = append(tags, TagCount{Tag: t, Count: n})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true, "tags": tags})
+}
+
+// sidecarMoveHandler and sidecarForgetHandler are called by file-move and
+// file-delete so tags follow a file when it is renamed and are dropped
+// when it is deleted.
+func sidecarMoveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Source string `json:"source"`
+		Dest   string `json:"dest"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Source == "" || req.Dest == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{"success": false, "error": "source and dest required"})
+		return
+	}
+	if err := metaStore.Move(req.Source, req.Dest); err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{"success": false, "error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+func sidecarForgetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || normalizePath(req.Path) == "/" {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{"success": false, "error": "path required"})
+		return
+	}
+	if err := metaStore.Forget(req.Path); err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]interface{}{"success": false, "error": err.Error()})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
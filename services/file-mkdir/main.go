@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/holm/filesdk"
 )
 
 type MkdirResponse struct {
@@ -15,7 +17,10 @@ type MkdirResponse struct {
 	Error   string `json:"error,omitempty"`
 }
 
-var storageRoot string
+var (
+	storageRoot string
+	acl         *filesdk.ACL
+)
 
 func main() {
 	storageRoot = os.Getenv("STORAGE_ROOT")
@@ -23,6 +28,8 @@ func main() {
 		storageRoot = "/storage"
 	}
 
+	acl = filesdk.NewACL()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -71,6 +78,18 @@ func mkdirHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if status, msg := acl.Authorize(r, reqPath, filesdk.RightWrite); status != 0 {
+		respondJSON(w, status, MkdirResponse{
+			Success: false,
+			Error:   msg,
+		})
+		return
+	}
+
+	// Only a new directory belongs to whoever made it
+	_, statErr := os.Stat(fullPath)
+	created := os.IsNotExist(statErr)
+
 	// Create directory (with parents if needed)
 	if err := os.MkdirAll(fullPath, 0755); err != nil {
 		respondJSON(w, http.StatusInternalServerError, MkdirResponse{
@@ -80,6 +99,10 @@ func mkdirHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if created {
+		acl.Claimed(r, reqPath)
+	}
+
 	respondJSON(w, http.StatusCreated, MkdirResponse{
 		Success: true,
 		Path:    reqPath,
@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/holm/filesdk"
 )
 
 type MoveRequest struct {
@@ -21,7 +23,12 @@ type MoveResponse struct {
 	Error   string `json:"error,omitempty"`
 }
 
-var storageRoot string
+var (
+	storageRoot string
+	acl         *filesdk.ACL
+	quota       *filesdk.Quota
+	meta        *filesdk.Meta
+)
 
 func main() {
 	storageRoot = os.Getenv("STORAGE_ROOT")
@@ -29,6 +36,10 @@ func main() {
 		storageRoot = "/storage"
 	}
 
+	acl = filesdk.NewACL()
+	quota = filesdk.NewQuota()
+	meta = filesdk.NewMeta()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -93,6 +104,20 @@ func moveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Moving removes the source and creates the destination
+	for _, check := range []struct{ path, right string }{
+		{req.Source, filesdk.RightDelete},
+		{req.Dest, filesdk.RightWrite},
+	} {
+		if status, msg := acl.Authorize(r, check.path, check.right); status != 0 {
+			respondJSON(w, status, MoveResponse{
+				Success: false,
+				Error:   msg,
+			})
+			return
+		}
+	}
+
 	// Create destination parent directory if needed
 	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
 		respondJSON(w, http.StatusInternalServerError, MoveResponse{
@@ -111,6 +136,10 @@ func moveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	acl.Moved(r, req.Source, req.Dest)
+	quota.Record(r, filesdk.UsageChange{Op: "move", Path: req.Source, Dest: req.Dest})
+	meta.Moved(req.Source, req.Dest)
+
 	respondJSON(w, http.StatusOK, MoveResponse{
 		Success: true,
 		Source:  req.Source,
@@ -2,11 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
@@ -17,6 +20,7 @@ type FileResult struct {
 	Size    int64     `json:"size"`
 	IsDir   bool      `json:"is_dir"`
 	ModTime time.Time `json:"mod_time"`
+	Tags    []string  `json:"tags,omitempty"`
 }
 
 type SearchResponse struct {
@@ -27,7 +31,11 @@ type SearchResponse struct {
 	Error   string       `json:"error,omitempty"`
 }
 
-var storageRoot string
+var (
+	storageRoot string
+	metaURL     string
+	metaClient  = &http.Client{Timeout: 10 * time.Second}
+)
 
 func main() {
 	storageRoot = os.Getenv("STORAGE_ROOT")
@@ -35,6 +43,11 @@ func main() {
 		storageRoot = "/storage"
 	}
 
+	metaURL = strings.TrimSuffix(os.Getenv("META_URL"), "/")
+	if metaURL == "" {
+		metaURL = "http://file-meta.holm.svc.cluster.local:8080"
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -59,10 +72,12 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	query := r.URL.Query().Get("q")
-	if query == "" {
+	tags := r.URL.Query()["tag"]
+	attrs := r.URL.Query()["attr"]
+	if query == "" && len(tags) == 0 && len(attrs) == 0 {
 		respondJSON(w, http.StatusBadRequest, SearchResponse{
 			Success: false,
-			Error:   "query parameter 'q' required",
+			Error:   "query parameter 'q', 'tag' or 'attr' required",
 		})
 		return
 	}
@@ -94,6 +109,29 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	var results []FileResult
 	maxResults := 100
 
+	// Tag and attribute filters are answered by file-meta; a name query
+	// then narrows its matches
+	var tagged map[string][]string
+	if len(tags) > 0 || len(attrs) > 0 {
+		tagged, err = queryTags(r.URL.Query(), searchPath)
+		if err != nil {
+			respondJSON(w, http.StatusBadGateway, SearchResponse{
+				Success: false,
+				Error:   "tag query failed: " + err.Error(),
+			})
+			return
+		}
+		if query == "" {
+			results = taggedResults(tagged, maxResults)
+			respondJSON(w, http.StatusOK, SearchResponse{
+				Success: true,
+				Results: results,
+				Count:   len(results),
+			})
+			return
+		}
+	}
+
 	err = filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil // Skip errors
@@ -105,12 +143,20 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 
 		if pattern.MatchString(info.Name()) {
 			relPath, _ := filepath.Rel(storageRoot, path)
+			var fileTags []string
+			if tagged != nil {
+				var ok bool
+				if fileTags, ok = tagged[filepath.ToSlash(relPath)]; !ok {
+					return nil
+				}
+			}
 			results = append(results, FileResult{
 				Path:    relPath,
 				Name:    info.Name(),
 				Size:    info.Size(),
 				IsDir:   info.IsDir(),
 				ModTime: info.ModTime(),
+				Tags:    fileTags,
 			})
 		}
 
@@ -133,6 +179,74 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// queryTags asks file-meta for the paths matching the tag, attr and any
+// parameters under searchPath. Paths are returned relative to the storage
+// root, mapped to their tags.
+func queryTags(params url.Values, searchPath string) (map[string][]string, error) {
+	q := url.Values{"tag": params["tag"], "attr": params["attr"], "limit": {"10000"}}
+	if params.Get("any") == "true" {
+		q.Set("any", "true")
+	}
+	if searchPath != "" {
+		q.Set("path", searchPath)
+	}
+	resp, err := metaClient.Get(metaURL + "/api/v1/query?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Results []struct {
+			Path string   `json:"path"`
+			Tags []string `json:"tags"`
+		} `json:"results"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("file-meta: %s", result.Error)
+	}
+	tagged := make(map[string][]string, len(result.Results))
+	for _, r := range result.Results {
+		tagged[strings.TrimPrefix(r.Path, "/")] = r.Tags
+	}
+	return tagged, nil
+}
+
+// taggedResults stats the files file-meta matched, for a search with no
+// name query.
+func taggedResults(tagged map[string][]string, max int) []FileResult {
+	paths := make([]string, 0, len(tagged))
+	for p := range tagged {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	results := []FileResult{}
+	for _, p := range paths {
+		if len(results) >= max {
+			break
+		}
+		tags := tagged[p]
+		info, err := os.Stat(filepath.Join(storageRoot, filepath.FromSlash(p)))
+		if err != nil {
+			continue
+		}
+		results = append(results, FileResult{
+			Path:    p,
+			Name:    info.Name(),
+			Size:    info.Size(),
+			IsDir:   info.IsDir(),
+			ModTime: info.ModTime(),
+			Tags:    tags,
+		})
+	}
+	return results
+}
+
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
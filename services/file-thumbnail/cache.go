@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	cacheHits   uint64
+	cacheMisses uint64
+)
+
+// ThumbnailCache stores rendered thumbnails on disk. Entries are keyed by the
+// source path together with its mtime and size, so an edited file never
+// serves a stale preview. The total size is bounded by maxBytes and the
+// least recently used entries are evicted first.
+type ThumbnailCache struct {
+	dir      string
+	maxBytes int64
+
+	mu        sync.Mutex
+	evictions uint64
+
+	// Running totals for Stats, kept by Put and recounted by each eviction
+	// pass so the metrics endpoint never walks the directory
+	entries int64
+	bytes   int64
+}
+
+func NewThumbnailCache(dir string, maxBytes int64) (*ThumbnailCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &ThumbnailCache{dir: dir, maxBytes: maxBytes}
+	entries, total := c.Usage()
+	c.entries, c.bytes = int64(len(entries)), total
+	return c, nil
+}
+
+// Key builds the cache key for a rendered thumbnail of the given source file.
+func (c *ThumbnailCache) Key(path string, info os.FileInfo, size int, format string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%d|%d|%d|%s", path, info.ModTime().UnixNano(), info.Size(), size, format)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *ThumbnailCache) entryPath(key string) string {
+	// Shard by the first two hex characters to keep directories small
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// Get returns the cached bytes for key, or false on a miss.
+func (c *ThumbnailCache) Get(key string) ([]byte, bool) {
+	p := c.entryPath(key)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		atomic.AddUint64(&cacheMisses, 1)
+		return nil, false
+	}
+	// Touch the entry so eviction treats it as recently used
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	atomic.AddUint64(&cacheHits, 1)
+	return data, true
+}
+
+// Put writes data under key. The write goes through a temp file so that a
+// concurrent reader never sees a partially written thumbnail.
+func (c *ThumbnailCache) Put(key string, data []byte) error {
+	p := c.entryPath(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+
+	old, statErr := os.Stat(p)
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if statErr == nil {
+		atomic.AddInt64(&c.entries, -1)
+		atomic.AddInt64(&c.bytes, -old.Size())
+	}
+	atomic.AddInt64(&c.entries, 1)
+	atomic.AddInt64(&c.bytes, int64(len(data)))
+	return nil
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Usage walks the cache directory and returns its entries and total size.
+func (c *ThumbnailCache) Usage() ([]cacheEntry, int64) {
+	var entries []cacheEntry
+	var total int64
+	filepath.Walk(c.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		entries = append(entries, cacheEntry{path: p, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	return entries, total
+}
+
+// Evict removes the least recently used entries until the cache fits in
+// maxBytes.
+func (c *ThumbnailCache) Evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, total := c.Usage()
+	if total <= c.maxBytes {
+		c.recount(len(entries), total)
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+
+	removed := 0
+	for _, e := range entries {
+		if total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(e.path); err != nil {
+			continue
+		}
+		total -= e.size
+		removed++
+	}
+	c.recount(len(entries)-removed, total)
+	c.evictions += uint64(removed)
+	log.Printf("Thumbnail cache eviction: removed %d entries, %d bytes remaining", removed, total)
+}
+
+// recount replaces the running totals with the result of a walk.
+func (c *ThumbnailCache) recount(entries int, total int64) {
+	atomic.StoreInt64(&c.entries, int64(entries))
+	atomic.StoreInt64(&c.bytes, total)
+}
+
+// StartEvictionLoop periodically trims the cache in the background.
+func (c *ThumbnailCache) StartEvictionLoop(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.Evict()
+		}
+	}()
+}
+
+// Stats reports cache usage for the metrics endpoint.
+func (c *ThumbnailCache) Stats() map[string]interface{} {
+	c.mu.Lock()
+	evictions := c.evictions
+	c.mu.Unlock()
+	return map[string]interface{}{
+		"entries":   atomic.LoadInt64(&c.entries),
+		"bytes":     atomic.LoadInt64(&c.bytes),
+		"max_bytes": c.maxBytes,
+		"hits":      atomic.LoadUint64(&cacheHits),
+		"misses":    atomic.LoadUint64(&cacheMisses),
+		"evictions": evictions,
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// External renderers and encoders are optional; features that need a missing
+// tool are reported as unsupported instead of failing the request.
+var tools struct {
+	ffmpeg   bool
+	pdftoppm bool
+	webp     bool
+	avif     bool
+
+	avifEncoder string // libaom-av1 or libsvtav1, whichever ffmpeg has
+}
+
+func detectTools() {
+	if _, err := exec.LookPath("ffmpeg"); err == nil {
+		tools.ffmpeg = true
+		if out, err := runTool("ffmpeg", "-hide_banner", "-encoders"); err == nil {
+			tools.webp = strings.Contains(string(out), "libwebp")
+			for _, enc := range []string{"libaom-av1", "libsvtav1"} {
+				if strings.Contains(string(out), enc) {
+					tools.avifEncoder = enc
+					break
+				}
+			}
+			tools.avif = tools.avifEncoder != ""
+		}
+		if out, err := runTool("ffmpeg", "-hide_banner", "-muxers"); err == nil {
+			tools.avif = tools.avif && strings.Contains(string(out), "avif")
+		}
+	}
+	if _, err := exec.LookPath("pdftoppm"); err == nil {
+		tools.pdftoppm = true
+	}
+	log.Printf("Thumbnail tools: ffmpeg=%v pdftoppm=%v webp=%v avif=%v (%s)",
+		tools.ffmpeg, tools.pdftoppm, tools.webp, tools.avif, tools.avifEncoder)
+}
+
+var contentTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+	"avif": "image/avif",
+}
+
+// negotiateFormat picks the output format. An explicit format parameter wins,
+// then the best modern format the client accepts, then the natural format
+// for the source (PNG and GIF keep transparency, everything else is JPEG).
+func negotiateFormat(requested, accept, ext string) string {
+	switch requested {
+	case "jpeg", "jpg":
+		return "jpeg"
+	case "png", "gif":
+		return requested
+	case "webp":
+		if tools.webp {
+			return "webp"
+		}
+	case "avif":
+		if tools.avif {
+			return "avif"
+		}
+	}
+
+	if tools.avif && strings.Contains(accept, "image/avif") {
+		return "avif"
+	}
+	if tools.webp && strings.Contains(accept, "image/webp") {
+		return "webp"
+	}
+
+	switch ext {
+	case ".png":
+		return "png"
+	case ".gif":
+		return "gif"
+	}
+	return "jpeg"
+}
+
+func encodeThumbnail(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	case "webp":
+		return encodeWithFFmpeg(img, "libwebp", "webp")
+	case "avif":
+		return encodeWithFFmpeg(img, tools.avifEncoder, "avif")
+	default:
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	}
+	return buf.Bytes(), err
+}
+
+// encodeWithFFmpeg pipes a PNG through ffmpeg to produce formats the standard
+// library cannot encode.
+func encodeWithFFmpeg(img image.Image, codec, muxer string) ([]byte, error) {
+	var in bytes.Buffer
+	if err := png.Encode(&in, img); err != nil {
+		return nil, err
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error",
+		"-f", "png_pipe", "-i", "-", "-c:v", codec}
+	switch {
+	case codec == "libaom-av1":
+		args = append(args, "-still-picture", "1", "-crf", "32")
+	case muxer == "avif":
+		args = append(args, "-crf", "32")
+	default:
+		args = append(args, "-quality", "80")
+	}
+	args = append(args, "-f", muxer, "-")
+
+	ctx, cancel := context.WithTimeout(context.Background(), externalToolTimeout)
+	defer cancel()
+
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdin = &in
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("ffmpeg %s encode failed: %v: %s", muxer, err, stderr.String())
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -1,11 +1,8 @@
 package main
 
 import (
-	"bytes"
+	"encoding/json"
 	"image"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
 	"log"
 	"net/http"
 	"os"
@@ -25,13 +22,25 @@ var (
 
 const dataPath = "/data"
 
+// defaultSize is the thumbnail size when the request does not give one.
+const defaultSize = 200
+
+var thumbCache *ThumbnailCache
+
+func getEnv(key, defaultVal string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return defaultVal
+}
+
 func resizeImage(src image.Image, size int) image.Image {
 	srcBounds := src.Bounds()
 	srcWidth := srcBounds.Dx()
 	srcHeight := srcBounds.Dy()
 
 	if size == 0 {
-		size = 200
+		size = defaultSize
 	}
 
 	// Maintain aspect ratio - fit within size x size bounds
@@ -57,6 +66,29 @@ func resizeImage(src image.Image, size int) image.Image {
 	return dst
 }
 
+// sizePresets are the standard thumbnail sizes clients should prefer over
+// arbitrary pixel values, since every distinct size is a separate cache entry.
+var sizePresets = map[string]int{
+	"small":  128,
+	"medium": 256,
+	"large":  512,
+	"xlarge": 1024,
+}
+
+func parseSize(sizeStr string) (int, bool) {
+	if sizeStr == "" {
+		return defaultSize, true
+	}
+	if preset, ok := sizePresets[sizeStr]; ok {
+		return preset, true
+	}
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || size < 1 || size > 2000 {
+		return 0, false
+	}
+	return size, true
+}
+
 func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
 	atomic.AddUint64(&requestCount, 1)
 
@@ -65,7 +97,7 @@ func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// GET /thumbnail?path=/some/image.jpg&size=200
+	// GET /thumbnail?path=/some/image.jpg&size=medium&format=webp
 	path := r.URL.Query().Get("path")
 	sizeStr := r.URL.Query().Get("size")
 
@@ -74,14 +106,10 @@ func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	size := 200
-	if sizeStr != "" {
-		var err error
-		size, err = strconv.Atoi(sizeStr)
-		if err != nil || size < 1 || size > 2000 {
-			http.Error(w, "invalid size parameter (must be 1-2000)", http.StatusBadRequest)
-			return
-		}
+	size, ok := parseSize(sizeStr)
+	if !ok {
+		http.Error(w, "invalid size parameter (must be 1-2000 or small|medium|large|xlarge)", http.StatusBadRequest)
+		return
 	}
 
 	// Sanitize path
@@ -95,33 +123,40 @@ func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check file extension
 	ext := strings.ToLower(filepath.Ext(fullPath))
-	supportedFormats := map[string]bool{
-		".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
-	}
-	if !supportedFormats[ext] {
-		http.Error(w, "unsupported image format", http.StatusBadRequest)
+	if sourceKind(ext) == "" {
+		http.Error(w, "unsupported file format", http.StatusBadRequest)
 		return
 	}
 
-	file, err := os.Open(fullPath)
-	if err != nil {
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() {
 		http.Error(w, "file not found", http.StatusNotFound)
 		return
 	}
-	defer file.Close()
 
-	// Decode image
-	var img image.Image
-	switch ext {
-	case ".jpg", ".jpeg":
-		img, err = jpeg.Decode(file)
-	case ".png":
-		img, err = png.Decode(file)
-	case ".gif":
-		img, err = gif.Decode(file)
+	format := negotiateFormat(strings.ToLower(r.URL.Query().Get("format")), r.Header.Get("Accept"), ext)
+	key := thumbCache.Key(cleanPath, info, size, format)
+	etag := `"` + key[:32] + `"`
+
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
+	if data, ok := thumbCache.Get(key); ok {
+		writeThumbnail(w, data, format, "HIT")
+		return
+	}
+
+	img, err := loadSource(fullPath, ext, size)
+	if err == errUnsupported {
+		http.Error(w, "preview not available for this file type", http.StatusUnsupportedMediaType)
+		return
+	}
 	if err != nil {
+		log.Printf("Failed to render %s: %v", cleanPath, err)
 		http.Error(w, "failed to decode image", http.StatusInternalServerError)
 		return
 	}
@@ -129,30 +164,51 @@ func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
 	// Resize
 	thumbnail := resizeImage(img, size)
 
-	// Encode and write response
-	var buf bytes.Buffer
-	var contentType string
-
-	switch ext {
-	case ".png":
-		err = png.Encode(&buf, thumbnail)
-		contentType = "image/png"
-	case ".gif":
-		err = gif.Encode(&buf, thumbnail, nil)
-		contentType = "image/gif"
-	default:
-		err = jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 85})
-		contentType = "image/jpeg"
-	}
-
+	data, err := encodeThumbnail(thumbnail, format)
 	if err != nil {
 		http.Error(w, "failed to encode thumbnail", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", contentType)
+	if err := thumbCache.Put(key, data); err != nil {
+		log.Printf("Failed to cache thumbnail for %s: %v", cleanPath, err)
+	}
+
+	writeThumbnail(w, data, format, "MISS")
+}
+
+func writeThumbnail(w http.ResponseWriter, data []byte, format, cacheStatus string) {
+	w.Header().Set("Content-Type", contentTypes[format])
 	w.Header().Set("Cache-Control", "public, max-age=3600")
-	w.Write(buf.Bytes())
+	w.Header().Set("X-Cache", cacheStatus)
+	w.Write(data)
+}
+
+func presetsHandler(w http.ResponseWriter, r *http.Request) {
+	formats := []string{"jpeg", "png", "gif"}
+	if tools.webp {
+		formats = append(formats, "webp")
+	}
+	if tools.avif {
+		formats = append(formats, "avif")
+	}
+
+	sources := []string{"image"}
+	if tools.ffmpeg {
+		sources = append(sources, "video")
+	}
+	if tools.pdftoppm {
+		sources = append(sources, "pdf")
+	}
+	sources = append(sources, "epub")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"presets": sizePresets,
+		"default": defaultSize,
+		"formats": formats,
+		"sources": sources,
+	})
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -164,7 +220,12 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	uptime := time.Since(startTime).String()
 	requests := atomic.LoadUint64(&requestCount)
-	w.Write([]byte(`{"uptime":"` + uptime + `","requests":` + strconv.FormatUint(requests, 10) + `,"service":"file-thumbnail"}`))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uptime":   uptime,
+		"requests": requests,
+		"service":  "file-thumbnail",
+		"cache":    thumbCache.Stats(),
+	})
 }
 
 func main() {
@@ -172,7 +233,21 @@ func main() {
 		log.Printf("Warning: Could not create data directory: %v", err)
 	}
 
+	detectTools()
+
+	cacheMB, err := strconv.Atoi(getEnv("THUMB_CACHE_MAX_MB", "1024"))
+	if err != nil {
+		cacheMB = 1024
+	}
+	thumbCache, err = NewThumbnailCache(getEnv("THUMB_CACHE_DIR", "/cache"), int64(cacheMB)<<20)
+	if err != nil {
+		log.Fatalf("Failed to create thumbnail cache: %v", err)
+	}
+	thumbCache.Evict()
+	thumbCache.StartEvictionLoop(10 * time.Minute)
+
 	http.HandleFunc("/thumbnail", thumbnailHandler)
+	http.HandleFunc("/presets", presetsHandler)
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/metrics", metricsHandler)
 
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+const externalToolTimeout = 30 * time.Second
+
+var errUnsupported = errors.New("unsupported format")
+
+var imageExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+	".webp": true, ".bmp": true, ".tif": true, ".tiff": true,
+}
+
+var videoExts = map[string]bool{
+	".mp4": true, ".mkv": true, ".mov": true, ".avi": true,
+	".webm": true, ".m4v": true, ".wmv": true, ".flv": true,
+}
+
+// sourceKind classifies a file by extension into the renderer that handles it.
+func sourceKind(ext string) string {
+	switch {
+	case imageExts[ext]:
+		return "image"
+	case videoExts[ext]:
+		return "video"
+	case ext == ".pdf":
+		return "pdf"
+	case ext == ".epub":
+		return "epub"
+	}
+	return ""
+}
+
+// loadSource decodes a preview image for the file at fullPath. size is the
+// requested thumbnail size and lets external renderers avoid producing a
+// full resolution frame.
+func loadSource(fullPath, ext string, size int) (image.Image, error) {
+	switch sourceKind(ext) {
+	case "image":
+		return decodeImageFile(fullPath, ext)
+	case "video":
+		return videoKeyframe(fullPath)
+	case "pdf":
+		return pdfFirstPage(fullPath, size)
+	case "epub":
+		return epubCover(fullPath)
+	}
+	return nil, errUnsupported
+}
+
+func decodeImageFile(fullPath, ext string) (image.Image, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	switch ext {
+	case ".jpg", ".jpeg":
+		return jpeg.Decode(file)
+	case ".png":
+		return png.Decode(file)
+	case ".gif":
+		return gif.Decode(file)
+	}
+	img, _, err := image.Decode(file)
+	return img, err
+}
+
+func runTool(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), externalToolTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// videoKeyframe extracts the first keyframe of a video with ffmpeg.
+func videoKeyframe(fullPath string) (image.Image, error) {
+	if !tools.ffmpeg {
+		return nil, errUnsupported
+	}
+	out, err := runTool("ffmpeg", "-hide_banner", "-loglevel", "error",
+		"-skip_frame", "nokey", "-i", fullPath,
+		"-frames:v", "1", "-f", "image2pipe", "-vcodec", "png", "-")
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(out))
+}
+
+// pdfFirstPage renders page one of a PDF with pdftoppm.
+func pdfFirstPage(fullPath string, size int) (image.Image, error) {
+	if !tools.pdftoppm {
+		return nil, errUnsupported
+	}
+	// Render at twice the target so the downscale stays sharp
+	out, err := runTool("pdftoppm", "-png", "-f", "1", "-l", "1", "-singlefile",
+		"-scale-to", strconv.Itoa(size*2), fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(out))
+}
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type epubPackage struct {
+	Metadata struct {
+		Meta []struct {
+			Name    string `xml:"name,attr"`
+			Content string `xml:"content,attr"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+	Manifest struct {
+		Items []struct {
+			ID         string `xml:"id,attr"`
+			Href       string `xml:"href,attr"`
+			MediaType  string `xml:"media-type,attr"`
+			Properties string `xml:"properties,attr"`
+		} `xml:"item"`
+	} `xml:"manifest"`
+}
+
+// epubCover finds the cover image of an EPUB. It follows the EPUB 3
+// cover-image property first, then the EPUB 2 <meta name="cover"> reference,
+// and finally falls back to any image whose id or href mentions "cover".
+func epubCover(fullPath string) (image.Image, error) {
+	zr, err := zip.OpenReader(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var container epubContainer
+	if err := readZipXML(files["META-INF/container.xml"], &container); err != nil {
+		return nil, fmt.Errorf("epub container: %v", err)
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, errors.New("epub has no rootfile")
+	}
+	opfPath := container.Rootfiles[0].FullPath
+
+	var pkg epubPackage
+	if err := readZipXML(files[opfPath], &pkg); err != nil {
+		return nil, fmt.Errorf("epub package: %v", err)
+	}
+
+	coverID := ""
+	for _, m := range pkg.Metadata.Meta {
+		if m.Name == "cover" {
+			coverID = m.Content
+		}
+	}
+
+	href := ""
+	for _, item := range pkg.Manifest.Items {
+		if strings.Contains(item.Properties, "cover-image") {
+			href = item.Href
+			break
+		}
+	}
+	if href == "" && coverID != "" {
+		for _, item := range pkg.Manifest.Items {
+			if item.ID == coverID {
+				href = item.Href
+				break
+			}
+		}
+	}
+	if href == "" {
+		for _, item := range pkg.Manifest.Items {
+			if strings.HasPrefix(item.MediaType, "image/") &&
+				(strings.Contains(strings.ToLower(item.ID), "cover") || strings.Contains(strings.ToLower(item.Href), "cover")) {
+				href = item.Href
+				break
+			}
+		}
+	}
+	if href == "" {
+		return nil, errors.New("epub has no cover image")
+	}
+
+	// Manifest hrefs are relative to the OPF file
+	coverPath := path.Join(path.Dir(opfPath), href)
+	f := files[coverPath]
+	if f == nil {
+		return nil, fmt.Errorf("epub cover %s not found", coverPath)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	img, _, err := image.Decode(rc)
+	return img, err
+}
+
+func readZipXML(f *zip.File, v interface{}) error {
+	if f == nil {
+		return os.ErrNotExist
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, 4<<20))
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(data, v)
+}
@@ -1,3 +1,7 @@
 module github.com/holm/file-upload
 
 go 1.22
+
+require github.com/holm/filesdk v0.0.0
+
+replace github.com/holm/filesdk => ../filesdk
@@ -8,16 +8,23 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/holm/filesdk"
 )
 
 type UploadResponse struct {
-	Success bool   `json:"success"`
-	Path    string `json:"path"`
-	Size    int64  `json:"size"`
-	Error   string `json:"error,omitempty"`
+	Success bool                `json:"success"`
+	Path    string              `json:"path"`
+	Size    int64               `json:"size"`
+	Error   string              `json:"error,omitempty"`
+	Quota   *filesdk.QuotaCheck `json:"quota,omitempty"`
 }
 
-var storageRoot string
+var (
+	storageRoot string
+	acl         *filesdk.ACL
+	quota       *filesdk.Quota
+)
 
 func main() {
 	storageRoot = os.Getenv("STORAGE_ROOT")
@@ -25,6 +32,9 @@ func main() {
 		storageRoot = "/storage"
 	}
 
+	acl = filesdk.NewACL()
+	quota = filesdk.NewQuota()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -88,6 +98,24 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	relDest := filepath.Join(targetPath, filename)
+	if status, msg := acl.Authorize(r, relDest, filesdk.RightWrite); status != 0 {
+		respondJSON(w, status, UploadResponse{
+			Success: false,
+			Error:   msg,
+		})
+		return
+	}
+
+	if status, qc := quota.Check(r, relDest, header.Size); status != 0 {
+		respondJSON(w, status, UploadResponse{
+			Success: false,
+			Error:   qc.Error,
+			Quota:   qc,
+		})
+		return
+	}
+
 	// Create directory if needed
 	if err := os.MkdirAll(destDir, 0755); err != nil {
 		respondJSON(w, http.StatusInternalServerError, UploadResponse{
@@ -97,6 +125,10 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only a new file belongs to the uploader; overwriting leaves the owner
+	_, statErr := os.Stat(destPath)
+	created := os.IsNotExist(statErr)
+
 	// Create destination file
 	dst, err := os.Create(destPath)
 	if err != nil {
@@ -118,9 +150,14 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if created {
+		acl.Claimed(r, relDest)
+	}
+	quota.Record(r, filesdk.UsageChange{Op: "write", Path: relDest, Size: written})
+
 	respondJSON(w, http.StatusCreated, UploadResponse{
 		Success: true,
-		Path:    filepath.Join(targetPath, filename),
+		Path:    relDest,
 		Size:    written,
 	})
 }
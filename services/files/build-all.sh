@@ -7,6 +7,7 @@ SERVICES=(
     "file-compress"
     "file-decompress"
     "file-permissions"
+    "file-quota"
     "file-watch"
     "file-share-create"
     "file-share-validate"
@@ -17,6 +18,14 @@ for service in "${SERVICES[@]}"; do
     echo "Building $service..."
     echo "=========================================="
 
+    # Services using a shared module under services/ build from there
+    CONTEXT_PATH="/tmp/holm-services/files/${service}"
+    DOCKERFILE="Dockerfile"
+    if grep -q '^# Build from services so' "${service}/Dockerfile"; then
+        CONTEXT_PATH="/tmp/holm-services"
+        DOCKERFILE="files/${service}/Dockerfile"
+    fi
+
     kubectl run kaniko-${service} \
         --image=gcr.io/kaniko-project/executor:latest \
         --restart=Never \
@@ -26,7 +35,7 @@ for service in "${SERVICES[@]}"; do
                     "name": "kaniko-'${service}'",
                     "image": "gcr.io/kaniko-project/executor:latest",
                     "args": [
-                        "--dockerfile=Dockerfile",
+                        "--dockerfile='${DOCKERFILE}'",
                         "--context=dir:///workspace",
                         "--destination='${REGISTRY}'/holm/'${service}':v1",
                         "--insecure"
@@ -39,7 +48,7 @@ for service in "${SERVICES[@]}"; do
                 "volumes": [{
                     "name": "build-context",
                     "hostPath": {
-                        "path": "/tmp/holm-services/files/'${service}'",
+                        "path": "'${CONTEXT_PATH}'",
                         "type": "Directory"
                     }
                 }],
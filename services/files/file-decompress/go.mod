@@ -0,0 +1,7 @@
+module github.com/holm/file-decompress
+
+go 1.21
+
+require github.com/holm/filesdk v0.0.0
+
+replace github.com/holm/filesdk => ../../filesdk
@@ -12,6 +12,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/holm/filesdk"
 )
 
 type DecompressRequest struct {
@@ -20,12 +22,26 @@ type DecompressRequest struct {
 }
 
 type DecompressResponse struct {
-	Success        bool     `json:"success"`
-	ExtractedFiles []string `json:"extracted_files"`
-	Error          string   `json:"error,omitempty"`
+	Success        bool                `json:"success"`
+	ExtractedFiles []string            `json:"extracted_files"`
+	Error          string              `json:"error,omitempty"`
+	Quota          *filesdk.QuotaCheck `json:"quota,omitempty"`
 }
 
+// storageRoot is where the shared volume is mounted. Requests use absolute
+// paths; those under the root are charged against storage quotas.
+var (
+	storageRoot string
+	quota       *filesdk.Quota
+)
+
 func main() {
+	storageRoot = os.Getenv("STORAGE_ROOT")
+	if storageRoot == "" {
+		storageRoot = "/data"
+	}
+	quota = filesdk.NewQuota()
+
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/decompress", decompressHandler)
 
@@ -70,6 +86,25 @@ func decompressHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	outputRel, inStorage := storagePath(req.OutputDir)
+	if inStorage && quota.Enabled() {
+		size, err := archiveSize(req.ArchivePath)
+		if err != nil {
+			sendError(w, "Failed to read archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if status, qc := quota.Check(r, outputRel, size); status != 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(DecompressResponse{
+				Success: false,
+				Error:   qc.Error,
+				Quota:   qc,
+			})
+			return
+		}
+	}
+
 	// Ensure output directory exists
 	if err := os.MkdirAll(req.OutputDir, 0755); err != nil {
 		sendError(w, "Failed to create output directory: "+err.Error(), http.StatusInternalServerError)
@@ -94,6 +129,20 @@ func decompressHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if inStorage {
+		var changes []filesdk.UsageChange
+		for _, f := range extractedFiles {
+			info, err := os.Lstat(f)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if rel, ok := storagePath(f); ok {
+				changes = append(changes, filesdk.UsageChange{Op: "write", Path: rel, Size: info.Size()})
+			}
+		}
+		quota.Record(r, changes...)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(DecompressResponse{
 		Success:        true,
@@ -101,6 +150,65 @@ func decompressHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// storagePath returns p relative to the storage root, and false when p lies
+// outside it.
+func storagePath(p string) (string, bool) {
+	rel, err := filepath.Rel(storageRoot, filepath.Clean(p))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// archiveSize sums the uncompressed size of every entry, so the quota check
+// sees the full extracted size before anything is written. Gzipped tars
+// have no index and are read through once.
+func archiveSize(archivePath string) (int64, error) {
+	lowerPath := strings.ToLower(archivePath)
+	var total int64
+
+	if strings.HasSuffix(lowerPath, ".zip") {
+		reader, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return 0, err
+		}
+		defer reader.Close()
+		for _, file := range reader.File {
+			total += int64(file.UncompressedSize64)
+		}
+		return total, nil
+	}
+	if !strings.HasSuffix(lowerPath, ".tar.gz") && !strings.HasSuffix(lowerPath, ".tgz") {
+		// Unsupported formats are rejected by the handler
+		return 0, nil
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, err
+	}
+	defer gzReader.Close()
+
+	tarReader := tar.NewReader(gzReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if header.Typeflag == tar.TypeReg {
+			total += header.Size
+		}
+	}
+}
+
 func extractZip(archivePath, outputDir string) ([]string, error) {
 	var extractedFiles []string
 
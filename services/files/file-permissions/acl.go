@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/holm/filesdk"
+)
+
+// Rights that can be granted on a path. Rights on a directory apply to
+// everything below it unless a descendant ACL stops inheritance.
+const (
+	RightRead   = filesdk.RightRead
+	RightWrite  = filesdk.RightWrite
+	RightShare  = filesdk.RightShare
+	RightDelete = filesdk.RightDelete
+)
+
+var allRights = []string{RightRead, RightWrite, RightShare, RightDelete}
+
+// Principals are "user:<username>", "group:<role>" (auth-gateway roles act as
+// groups), "authenticated" for any logged-in user, or "everyone".
+const (
+	principalAuthenticated = "authenticated"
+	principalEveryone      = "everyone"
+)
+
+type ACLEntry struct {
+	Principal string   `json:"principal"`
+	Allow     []string `json:"allow,omitempty"`
+	Deny      []string `json:"deny,omitempty"`
+}
+
+type ACL struct {
+	Path      string     `json:"path"`
+	Owner     string     `json:"owner,omitempty"`
+	Entries   []ACLEntry `json:"entries"`
+	Inherit   bool       `json:"inherit"` // Merge entries from parent directories
+	UpdatedAt time.Time  `json:"updated_at"`
+	UpdatedBy string     `json:"updated_by,omitempty"`
+}
+
+// Identity is the caller as resolved by auth-gateway.
+type Identity = filesdk.Identity
+
+// principalMatches reports whether a principal applies to the identity.
+func principalMatches(id Identity, principal string) bool {
+	switch {
+	case principal == principalEveryone:
+		return true
+	case principal == principalAuthenticated:
+		return id.Authenticated()
+	case strings.HasPrefix(principal, "user:"):
+		return id.Authenticated() && principal[5:] == id.Username
+	case strings.HasPrefix(principal, "group:"):
+		return id.Role != "" && principal[6:] == id.Role
+	}
+	return false
+}
+
+// Effective is the outcome of evaluating every ACL that applies to a path.
+type Effective struct {
+	Path    string   `json:"path"`
+	User    string   `json:"user,omitempty"`
+	Role    string   `json:"role,omitempty"`
+	Owner   string   `json:"owner,omitempty"`
+	Rights  []string `json:"rights"`
+	Sources []string `json:"sources"` // ACL paths consulted, nearest first
+	Reason  string   `json:"reason"`
+}
+
+func (e *Effective) Has(right string) bool {
+	for _, r := range e.Rights {
+		if r == right {
+			return true
+		}
+	}
+	return false
+}
+
+// Administers reports whether the rights come from owning the path or being
+// an admin, which is what replacing its ACL takes.
+func (e *Effective) Administers() bool {
+	return e.Reason == "owner" || e.Reason == "admin"
+}
+
+// errNotAdministered refuses a change that would replace ACLs the caller
+// does not administer.
+var errNotAdministered = errors.New("destination has an ACL you do not administer")
+
+// compactAfter is how many journal records accumulate before the store is
+// rewritten as a snapshot.
+const compactAfter = 1000
+
+// ACLStore keeps ACLs in memory, in a snapshot file and a journal next to
+// it. Each change appends to the journal, so a claim costs one line rather
+// than a rewrite of every ACL.
+type ACLStore struct {
+	mu      sync.RWMutex
+	acls    map[string]*ACL
+	file    string
+	journal *os.File
+	logged  int
+}
+
+// journalRecord is one change: an ACL set, or the ACL at a path removed.
+type journalRecord struct {
+	Put    *ACL   `json:"put,omitempty"`
+	Delete string `json:"delete,omitempty"`
+}
+
+// normalizePath maps any client path onto the canonical "/a/b" form used as
+// the ACL key, independent of the storage root each service mounts.
+func normalizePath(p string) string {
+	return path.Clean("/" + filepath.ToSlash(p))
+}
+
+func validRight(r string) bool {
+	for _, known := range allRights {
+		if r == known {
+			return true
+		}
+	}
+	return false
+}
+
+func validateACL(acl *ACL) error {
+	for _, e := range acl.Entries {
+		if e.Principal == "" {
+			return fmt.Errorf("entry principal is required")
+		}
+		if !(e.Principal == principalEveryone || e.Principal == principalAuthenticated ||
+			strings.HasPrefix(e.Principal, "user:") || strings.HasPrefix(e.Principal, "group:")) {
+			return fmt.Errorf("invalid principal %q", e.Principal)
+		}
+		for _, r := range append(append([]string{}, e.Allow...), e.Deny...) {
+			if !validRight(r) {
+				return fmt.Errorf("invalid right %q", r)
+			}
+		}
+	}
+	return nil
+}
+
+func NewACLStore(file string) (*ACLStore, error) {
+	s := &ACLStore{acls: make(map[string]*ACL), file: file}
+
+	data, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var acls []*ACL
+		if err := json.Unmarshal(data, &acls); err != nil {
+			return nil, err
+		}
+		for _, acl := range acls {
+			s.acls[acl.Path] = acl
+		}
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	// Bootstrap a root ACL so a fresh install keeps today's behaviour for
+	// logged-in users while admins retain full control.
+	if _, ok := s.acls["/"]; !ok {
+		s.acls["/"] = &ACL{
+			Path:  "/",
+			Owner: "admin",
+			Entries: []ACLEntry{
+				{Principal: "group:admin", Allow: allRights},
+				{Principal: principalAuthenticated, Allow: []string{RightRead, RightWrite, RightDelete}},
+			},
+			UpdatedAt: time.Now().UTC(),
+			UpdatedBy: "bootstrap",
+		}
+	}
+	// Start from a fresh snapshot and an empty journal
+	if err := s.saveLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay applies the journal left by the last run on top of the snapshot.
+// A torn last line from a crash mid-append is ignored.
+func (s *ACLStore) replay() error {
+	f, err := os.Open(s.file + ".journal")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		switch {
+		case rec.Put != nil:
+			s.acls[rec.Put.Path] = rec.Put
+		case rec.Delete != "":
+			delete(s.acls, rec.Delete)
+		}
+	}
+	return scanner.Err()
+}
+
+// saveLocked writes every ACL to the snapshot and starts an empty journal.
+func (s *ACLStore) saveLocked() error {
+	acls := make([]*ACL, 0, len(s.acls))
+	for _, acl := range s.acls {
+		acls = append(acls, acl)
+	}
+	sort.Slice(acls, func(i, j int) bool { return acls[i].Path < acls[j].Path })
+
+	data, err := json.MarshalIndent(acls, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0700); err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		return err
+	}
+
+	if s.journal != nil {
+		s.journal.Close()
+	}
+	s.journal, err = os.OpenFile(s.file+".journal", os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		s.journal = nil
+		return err
+	}
+	s.logged = 0
+	return nil
+}
+
+// appendLocked journals changes, compacting once the journal is long.
+func (s *ACLStore) appendLocked(recs ...journalRecord) error {
+	if s.journal == nil {
+		return s.saveLocked()
+	}
+	var buf []byte
+	for _, rec := range recs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if _, err := s.journal.Write(buf); err != nil {
+		return err
+	}
+	s.logged += len(recs)
+	if s.logged >= compactAfter {
+		return s.saveLocked()
+	}
+	return nil
+}
+
+func (s *ACLStore) Get(p string) (*ACL, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	acl, ok := s.acls[normalizePath(p)]
+	if !ok {
+		return nil, false
+	}
+	c := *acl
+	return &c, true
+}
+
+func (s *ACLStore) Put(acl *ACL) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	acl.Path = normalizePath(acl.Path)
+	acl.UpdatedAt = time.Now().UTC()
+	s.acls[acl.Path] = acl
+	return s.appendLocked(journalRecord{Put: acl})
+}
+
+// Delete removes the ACL at p and, with recursive set, every ACL below it.
+// The root ACL can be replaced but never removed.
+func (s *ACLStore) Delete(p string, recursive bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p = normalizePath(p)
+
+	var recs []journalRecord
+	for key := range s.acls {
+		if key == "/" {
+			continue
+		}
+		if key == p || (recursive && strings.HasPrefix(key, strings.TrimSuffix(p, "/")+"/")) {
+			delete(s.acls, key)
+			recs = append(recs, journalRecord{Delete: key})
+		}
+	}
+	if len(recs) == 0 {
+		return 0, nil
+	}
+	return len(recs), s.appendLocked(recs...)
+}
+
+// Move re-keys the ACL at src and everything below it to dst, keeping ACLs
+// attached to files that file-move renames. It refuses to replace any ACL
+// at or below dst that id does not administer.
+func (s *ACLStore) Move(src, dst string, id Identity) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src, dst = normalizePath(src), normalizePath(dst)
+	if src == "/" {
+		return 0, fmt.Errorf("cannot move root ACL")
+	}
+	if dst == "/" {
+		return 0, fmt.Errorf("cannot move onto the root ACL")
+	}
+
+	for key := range s.acls {
+		if key != dst && !strings.HasPrefix(key, dst+"/") {
+			continue
+		}
+		if key == src || strings.HasPrefix(key, src+"/") {
+			continue // Moving with the source
+		}
+		if !s.evaluateLocked(key, id).Administers() {
+			return 0, fmt.Errorf("%w: %s", errNotAdministered, key)
+		}
+	}
+
+	// Collect first: dst may itself lie under src
+	renames := map[string]string{}
+	for key := range s.acls {
+		switch {
+		case key == src:
+			renames[key] = dst
+		case strings.HasPrefix(key, src+"/"):
+			renames[key] = dst + strings.TrimPrefix(key, src)
+		}
+	}
+	if len(renames) == 0 {
+		return 0, nil
+	}
+
+	moved := make(map[string]*ACL, len(renames))
+	var recs []journalRecord
+	for oldKey, newKey := range renames {
+		acl := s.acls[oldKey]
+		delete(s.acls, oldKey)
+		recs = append(recs, journalRecord{Delete: oldKey})
+		acl.Path = newKey
+		moved[newKey] = acl
+	}
+	for key, acl := range moved {
+		s.acls[key] = acl
+		recs = append(recs, journalRecord{Put: acl})
+	}
+	return len(moved), s.appendLocked(recs...)
+}
+
+// Claim records owner as the owner of p when p has no ACL of its own yet.
+// Upload, mkdir and copy call this so new paths belong to whoever created
+// them.
+func (s *ACLStore) Claim(p, owner string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p = normalizePath(p)
+	if _, exists := s.acls[p]; exists || owner == "" {
+		return false, nil
+	}
+	acl := &ACL{
+		Path:      p,
+		Owner:     owner,
+		Inherit:   true,
+		UpdatedAt: time.Now().UTC(),
+		UpdatedBy: owner,
+	}
+	s.acls[p] = acl
+	return true, s.appendLocked(journalRecord{Put: acl})
+}
+
+// List returns every ACL at or below prefix.
+func (s *ACLStore) List(prefix string) []*ACL {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prefix = normalizePath(prefix)
+
+	var out []*ACL
+	for key, acl := range s.acls {
+		if prefix == "/" || key == prefix || strings.HasPrefix(key, prefix+"/") {
+			c := *acl
+			out = append(out, &c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// Evaluate computes the effective rights of id on p. ACLs are collected from
+// p upwards until one has inherit=false (or the root is reached). Allows from
+// all collected ACLs are unioned and any matching deny removes the right.
+// The nearest owner and admins always hold every right.
+func (s *ACLStore) Evaluate(p string, id Identity) *Effective {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.evaluateLocked(normalizePath(p), id)
+}
+
+func (s *ACLStore) evaluateLocked(p string, id Identity) *Effective {
+	eff := &Effective{Path: p, User: id.Username, Role: id.Role, Rights: []string{}, Sources: []string{}}
+	allowed := map[string]bool{}
+	denied := map[string]bool{}
+
+	for cur := p; ; cur = path.Dir(cur) {
+		if acl, ok := s.acls[cur]; ok {
+			eff.Sources = append(eff.Sources, cur)
+			if eff.Owner == "" && acl.Owner != "" {
+				eff.Owner = acl.Owner
+			}
+			for _, e := range acl.Entries {
+				if !principalMatches(id, e.Principal) {
+					continue
+				}
+				for _, r := range e.Allow {
+					allowed[r] = true
+				}
+				for _, r := range e.Deny {
+					denied[r] = true
+				}
+			}
+			if !acl.Inherit {
+				break
+			}
+		}
+		if cur == "/" {
+			break
+		}
+	}
+
+	switch {
+	case id.IsAdmin():
+		eff.Rights = append(eff.Rights, allRights...)
+		eff.Reason = "admin"
+	case id.Authenticated() && eff.Owner == id.Username:
+		eff.Rights = append(eff.Rights, allRights...)
+		eff.Reason = "owner"
+	default:
+		for _, r := range allRights {
+			if allowed[r] && !denied[r] {
+				eff.Rights = append(eff.Rights, r)
+			}
+		}
+		eff.Reason = "acl"
+	}
+	return eff
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestStore(t *testing.T, acls ...*ACL) *ACLStore {
+	t.Helper()
+	s, err := NewACLStore(filepath.Join(t.TempDir(), "acls.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, acl := range acls {
+		if err := s.Put(acl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func paths(s *ACLStore) []string {
+	var out []string
+	for _, acl := range s.List("/") {
+		out = append(out, acl.Path)
+	}
+	return out
+}
+
+func TestMove(t *testing.T) {
+	alice := Identity{Username: "alice", Role: "user"}
+	admin := Identity{Username: "root", Role: "admin"}
+
+	tests := []struct {
+		name     string
+		id       Identity
+		src, dst string
+		moved    int
+		err      error
+		want     []string
+	}{
+		{
+			name: "rename within own directory",
+			id:   alice, src: "/alice/a.txt", dst: "/alice/c.txt",
+			moved: 1,
+			want:  []string{"/", "/alice", "/alice/c.txt", "/bob", "/bob/b.txt"},
+		},
+		{
+			name: "directory and everything below it",
+			id:   alice, src: "/alice", dst: "/archive/alice",
+			moved: 2,
+			want:  []string{"/", "/archive/alice", "/archive/alice/a.txt", "/bob", "/bob/b.txt"},
+		},
+		{
+			name: "onto an ACL someone else owns",
+			id:   alice, src: "/alice/a.txt", dst: "/bob/b.txt",
+			err:  errNotAdministered,
+			want: []string{"/", "/alice", "/alice/a.txt", "/bob", "/bob/b.txt"},
+		},
+		{
+			name: "into a directory holding an ACL someone else owns",
+			id:   alice, src: "/alice", dst: "/bob",
+			err:  errNotAdministered,
+			want: []string{"/", "/alice", "/alice/a.txt", "/bob", "/bob/b.txt"},
+		},
+		{
+			name: "admin onto someone else's ACL",
+			id:   admin, src: "/alice/a.txt", dst: "/bob/b.txt",
+			moved: 1,
+			want:  []string{"/", "/alice", "/bob", "/bob/b.txt"},
+		},
+		{
+			name: "path without an ACL",
+			id:   alice, src: "/alice/none.txt", dst: "/alice/other.txt",
+			want: []string{"/", "/alice", "/alice/a.txt", "/bob", "/bob/b.txt"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t,
+				&ACL{Path: "/alice", Owner: "alice", Inherit: true},
+				&ACL{Path: "/alice/a.txt", Owner: "alice", Inherit: true},
+				&ACL{Path: "/bob", Owner: "bob", Inherit: true},
+				&ACL{Path: "/bob/b.txt", Owner: "bob", Inherit: true},
+			)
+			moved, err := s.Move(tt.src, tt.dst, tt.id)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Move error = %v, want %v", err, tt.err)
+			}
+			if moved != tt.moved {
+				t.Errorf("moved = %d, want %d", moved, tt.moved)
+			}
+			if got := paths(s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ACLs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("root", func(t *testing.T) {
+		s := newTestStore(t)
+		if _, err := s.Move("/", "/elsewhere", admin); err == nil {
+			t.Error("moving the root ACL succeeded")
+		}
+		if _, err := s.Move("/a", "/", admin); err == nil {
+			t.Error("moving onto the root ACL succeeded")
+		}
+	})
+}
+
+func TestClaim(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		owner   string
+		claimed bool
+		want    string
+	}{
+		{name: "new path", path: "/uploads/new.txt", owner: "alice", claimed: true, want: "alice"},
+		{name: "path with an ACL", path: "/bob/b.txt", owner: "alice", want: "bob"},
+		{name: "nobody to claim for", path: "/uploads/anon.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t, &ACL{Path: "/bob/b.txt", Owner: "bob", Inherit: true})
+			claimed, err := s.Claim(tt.path, tt.owner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claimed != tt.claimed {
+				t.Errorf("claimed = %v, want %v", claimed, tt.claimed)
+			}
+			acl, found := s.Get(tt.path)
+			if found != (tt.want != "") || (found && acl.Owner != tt.want) {
+				t.Errorf("ACL = %+v, want owner %q", acl, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimOwner(t *testing.T) {
+	tests := []struct {
+		name      string
+		id        Identity
+		requested string
+		want      string
+		err       error
+	}{
+		{name: "file service for its user", id: Identity{Username: "alice", Service: true}, want: "alice"},
+		{name: "file service ignores requested owner", id: Identity{Username: "alice", Service: true}, requested: "bob", want: "alice"},
+		{name: "file service for anonymous upload", id: Identity{Service: true}},
+		{name: "admin for themselves", id: Identity{Username: "root", Role: "admin"}, want: "root"},
+		{name: "admin for another user", id: Identity{Username: "root", Role: "admin"}, requested: "bob", want: "bob"},
+		{name: "user directly", id: Identity{Username: "alice", Role: "user"}, err: errClaimForbidden},
+		{name: "user naming themselves", id: Identity{Username: "alice", Role: "user"}, requested: "alice", err: errClaimForbidden},
+		{name: "anonymous", id: Identity{}, err: errClaimForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := claimOwner(tt.id, tt.requested)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("owner = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreReplaysJournal(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acls.json")
+	s, err := NewACLStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Claim("/a", "alice")
+	s.Claim("/a/b", "alice")
+	s.Claim("/c", "carol")
+	s.Move("/a", "/moved", Identity{Username: "alice"})
+	s.Delete("/c", false)
+
+	reopened, err := NewACLStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/", "/moved", "/moved/b"}
+	if got := paths(reopened); !reflect.DeepEqual(got, want) {
+		t.Errorf("ACLs after reopening = %v, want %v", got, want)
+	}
+}
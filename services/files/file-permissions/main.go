@@ -2,21 +2,28 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/holm/filesdk"
 )
 
 var (
 	requestCount uint64
+	checkCount   uint64
+	deniedCount  uint64
 	startTime    = time.Now()
+	aclStore     *ACLStore
 )
 
 const dataPath = "/data"
@@ -51,6 +58,8 @@ type HealthResponse struct {
 type MetricsResponse struct {
 	Uptime   string `json:"uptime"`
 	Requests uint64 `json:"requests"`
+	Checks   uint64 `json:"acl_checks"`
+	Denied   uint64 `json:"acl_denied"`
 	Service  string `json:"service"`
 }
 
@@ -263,6 +272,396 @@ func setHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+type ACLRequest struct {
+	Path    string     `json:"path"`
+	Owner   string     `json:"owner,omitempty"`
+	Entries []ACLEntry `json:"entries"`
+	Inherit *bool      `json:"inherit,omitempty"` // Defaults to true
+}
+
+type CheckRequest struct {
+	Path  string `json:"path"`
+	Right string `json:"right"`
+}
+
+type CheckResponse struct {
+	Allowed   bool       `json:"allowed"`
+	Right     string     `json:"right"`
+	Effective *Effective `json:"effective,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type MoveACLRequest struct {
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// requireIdentity resolves the caller, writing a 401/502 and returning false
+// when that fails.
+func requireIdentity(w http.ResponseWriter, r *http.Request) (Identity, bool) {
+	id, err := filesdk.ResolveIdentity(r)
+	if err == filesdk.ErrInvalidToken {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return id, false
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return id, false
+	}
+	return id, true
+}
+
+// requireRight checks that the caller holds right on path.
+func requireRight(w http.ResponseWriter, id Identity, path, right string) bool {
+	if eff := aclStore.Evaluate(path, id); !eff.Has(right) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "missing " + right + " permission on " + eff.Path})
+		return false
+	}
+	return true
+}
+
+// aclHandler manages the ACL attached to a single path.
+// GET /acl?path=  PUT /acl  DELETE /acl?path=&recursive=true
+func aclHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCount, 1)
+
+	id, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "path is required"})
+			return
+		}
+		if !requireRight(w, id, path, RightRead) {
+			return
+		}
+		acl, found := aclStore.Get(path)
+		if !found {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{
+				"error":     "no ACL set on this path",
+				"effective": aclStore.Evaluate(path, id),
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, acl)
+
+	case http.MethodPut, http.MethodPost:
+		var req ACLRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid JSON: " + err.Error()})
+			return
+		}
+		if req.Path == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "path is required"})
+			return
+		}
+
+		// Sharing rights let a user edit entries; only the owner or an
+		// admin may hand the path to someone else.
+		eff := aclStore.Evaluate(req.Path, id)
+		if !eff.Has(RightShare) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "missing share permission on " + eff.Path})
+			return
+		}
+		// An ACL without an owner keeps the inherited one, so that a
+		// sharer cannot leave the path ownerless.
+		existing, found := aclStore.Get(req.Path)
+		owner := req.Owner
+		if found && owner == "" {
+			owner = existing.Owner
+		}
+		if owner == "" {
+			owner = eff.Owner
+		}
+		ownerOrAdmin := eff.Reason == "owner" || eff.Reason == "admin"
+		if owner != eff.Owner && !ownerOrAdmin {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "only the owner or an admin can change ownership"})
+			return
+		}
+		// Stopping inheritance cuts off the entries above, the owner's
+		// included
+		if req.Inherit != nil && !*req.Inherit && !(found && !existing.Inherit) && !ownerOrAdmin {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "only the owner or an admin can stop inheritance"})
+			return
+		}
+
+		acl := &ACL{
+			Path:      req.Path,
+			Owner:     owner,
+			Entries:   req.Entries,
+			Inherit:   req.Inherit == nil || *req.Inherit,
+			UpdatedBy: id.Username,
+		}
+		if acl.Entries == nil {
+			acl.Entries = []ACLEntry{}
+		}
+		if normalizePath(acl.Path) == "/" && !acl.Inherit {
+			acl.Inherit = true
+		}
+		if err := validateACL(acl); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := aclStore.Put(acl); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save ACL: " + err.Error()})
+			return
+		}
+		log.Printf("ACL updated on %s by %s", acl.Path, id.Username)
+		writeJSON(w, http.StatusOK, acl)
+
+	case http.MethodDelete:
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "path is required"})
+			return
+		}
+		if !requireRight(w, id, path, RightShare) {
+			return
+		}
+		removed, err := aclStore.Delete(path, r.URL.Query().Get("recursive") == "true")
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"path": normalizePath(path), "removed": removed})
+
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+	}
+}
+
+// aclListHandler lists ACLs below a prefix. Admin only.
+// GET /acls?prefix=/photos
+func aclListHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCount, 1)
+
+	id, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	if !id.IsAdmin() {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin role required"})
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		prefix = "/"
+	}
+	acls := aclStore.List(prefix)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"acls": acls, "count": len(acls)})
+}
+
+// checkHandler answers whether the caller may perform an operation. File
+// services forward the user's Authorization header and call this before
+// touching storage.
+// POST /acl/check {"path": "/photos/a.jpg", "right": "read"}
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCount, 1)
+	atomic.AddUint64(&checkCount, 1)
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, CheckResponse{Error: "Method not allowed"})
+		return
+	}
+
+	var req CheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, CheckResponse{Error: "Invalid JSON: " + err.Error()})
+		return
+	}
+	if req.Path == "" || !validRight(req.Right) {
+		writeJSON(w, http.StatusBadRequest, CheckResponse{Error: "path and a valid right (read, write, share, delete) are required"})
+		return
+	}
+
+	id, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	eff := aclStore.Evaluate(req.Path, id)
+	allowed := eff.Has(req.Right)
+	if !allowed {
+		atomic.AddUint64(&deniedCount, 1)
+		// Tell anonymous callers to log in rather than that they are forbidden
+		if !id.Authenticated() {
+			writeJSON(w, http.StatusUnauthorized, CheckResponse{Right: req.Right, Effective: eff, Error: "authentication required"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, CheckResponse{Allowed: allowed, Right: req.Right, Effective: eff})
+}
+
+// effectiveHandler reports effective permissions on a path. Callers see their
+// own rights; admins and users with share rights may query another user.
+// GET /acl/effective?path=/photos&user=alice&role=user
+func effectiveHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCount, 1)
+
+	id, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "path is required"})
+		return
+	}
+
+	subject := id
+	if user := r.URL.Query().Get("user"); user != "" && user != id.Username {
+		if !requireRight(w, id, path, RightShare) {
+			return
+		}
+		subject = Identity{Username: user, Role: r.URL.Query().Get("role")}
+	}
+
+	writeJSON(w, http.StatusOK, aclStore.Evaluate(path, subject))
+}
+
+// aclMoveHandler carries ACLs along when file-move renames a path.
+// POST /acl/move {"source": "/a", "dest": "/b"}
+func aclMoveHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCount, 1)
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+		return
+	}
+	var req MoveACLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Source == "" || req.Dest == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "source and dest are required"})
+		return
+	}
+
+	id, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	// Moving takes the source away and creates the destination
+	if !requireRight(w, id, req.Source, RightDelete) ||
+		!requireRight(w, id, path.Dir(normalizePath(req.Dest)), RightWrite) {
+		return
+	}
+
+	moved, err := aclStore.Move(req.Source, req.Dest, id)
+	if errors.Is(err, errNotAdministered) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"moved": moved})
+}
+
+// aclForgetHandler drops the ACLs of a path and its descendants after
+// file-delete removed it, so a later file at the same path starts clean.
+// POST /acl/forget {"path": "/old"}
+func aclForgetHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCount, 1)
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+		return
+	}
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "path is required"})
+		return
+	}
+
+	id, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	if !requireRight(w, id, req.Path, RightDelete) {
+		return
+	}
+
+	removed, err := aclStore.Delete(req.Path, true)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"removed": removed})
+}
+
+var errClaimForbidden = errors.New("paths are claimed by the file service that creates them")
+
+// claimOwner decides who a claim makes the owner. File services claim a
+// path they have just created for the user whose credentials they forward;
+// admins may claim for anyone. Users cannot claim directly, or they could
+// take over any path without an ACL of its own. An empty owner means there
+// is nobody to claim for.
+func claimOwner(id Identity, requested string) (string, error) {
+	switch {
+	case id.IsAdmin() && requested != "":
+		return requested, nil
+	case id.IsAdmin(), id.Service:
+		return id.Username, nil
+	}
+	return "", errClaimForbidden
+}
+
+// aclClaimHandler makes the creator the owner of a newly created path.
+// POST /acl/claim {"path": "/uploads/new.txt", "owner": "alice"}
+func aclClaimHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCount, 1)
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+		return
+	}
+	var req struct {
+		Path  string `json:"path"`
+		Owner string `json:"owner"` // Admins only
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "path is required"})
+		return
+	}
+
+	id, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	owner, err := claimOwner(id, req.Owner)
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	}
+	if owner == "" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"claimed": false})
+		return
+	}
+	if !requireRight(w, id, req.Path, RightWrite) {
+		return
+	}
+
+	claimed, err := aclStore.Claim(req.Path, owner)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"claimed": claimed, "owner": owner})
+}
+
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(HealthResponse{
@@ -277,17 +676,62 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(MetricsResponse{
 		Uptime:   time.Since(startTime).String(),
 		Requests: atomic.LoadUint64(&requestCount),
+		Checks:   atomic.LoadUint64(&checkCount),
+		Denied:   atomic.LoadUint64(&deniedCount),
 		Service:  "file-permissions",
 	})
 }
 
+// migrateLegacyACLs moves ACLs from where earlier versions kept them, on
+// the shared data volume where other file services could read them, to
+// aclFile.
+func migrateLegacyACLs(legacyDir, aclFile string) error {
+	data, err := os.ReadFile(filepath.Join(legacyDir, "acls.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(aclFile); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(aclFile), 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(aclFile, data, 0600); err != nil {
+			return err
+		}
+		log.Printf("Moved ACLs from %s to %s", legacyDir, aclFile)
+	}
+	return os.RemoveAll(legacyDir)
+}
+
 func main() {
 	if err := os.MkdirAll(dataPath, 0755); err != nil {
 		log.Printf("Warning: Could not create data directory: %v", err)
 	}
 
+	aclFile := os.Getenv("ACL_DB_PATH")
+	if aclFile == "" {
+		aclFile = "/state/acls.json"
+	}
+	if err := migrateLegacyACLs(filepath.Join(dataPath, ".acl"), aclFile); err != nil {
+		log.Fatalf("Failed to move ACLs off the data volume: %v", err)
+	}
+	var err error
+	aclStore, err = NewACLStore(aclFile)
+	if err != nil {
+		log.Fatalf("Failed to load ACL store: %v", err)
+	}
+
 	http.HandleFunc("/get", getHandler)
 	http.HandleFunc("/set", setHandler)
+	http.HandleFunc("/acl", aclHandler)
+	http.HandleFunc("/acls", aclListHandler)
+	http.HandleFunc("/acl/check", checkHandler)
+	http.HandleFunc("/acl/effective", effectiveHandler)
+	http.HandleFunc("/acl/move", aclMoveHandler)
+	http.HandleFunc("/acl/claim", aclClaimHandler)
+	http.HandleFunc("/acl/forget", aclForgetHandler)
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/metrics", metricsHandler)
 
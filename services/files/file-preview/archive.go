@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const maxArchiveEntries = 2000
+
+type ArchiveEntry struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	Compressed int64     `json:"compressed_size,omitempty"`
+	ModTime    time.Time `json:"mod_time"`
+	IsDir      bool      `json:"is_dir"`
+}
+
+type ArchiveListing struct {
+	Format    string         `json:"format"`
+	Entries   []ArchiveEntry `json:"entries"`
+	Total     int            `json:"total"`
+	TotalSize int64          `json:"total_size"`
+	Truncated bool           `json:"truncated"`
+}
+
+// archiveFormat returns the archive format for a path, or "" if it is not an
+// archive we can list.
+func archiveFormat(path string) string {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(lower, ".tar.bz2"), strings.HasSuffix(lower, ".tbz2"):
+		return "tar.bz2"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	case strings.HasSuffix(lower, ".zip"), strings.HasSuffix(lower, ".jar"),
+		strings.HasSuffix(lower, ".epub"), strings.HasSuffix(lower, ".apk"):
+		return "zip"
+	}
+	return ""
+}
+
+// listArchive reads the archive's table of contents without extracting it.
+// Listing stops after maxArchiveEntries but totals keep counting.
+func listArchive(fullPath, format string) (*ArchiveListing, error) {
+	listing := &ArchiveListing{Format: format, Entries: []ArchiveEntry{}}
+	add := func(e ArchiveEntry) {
+		listing.Total++
+		listing.TotalSize += e.Size
+		if len(listing.Entries) < maxArchiveEntries {
+			listing.Entries = append(listing.Entries, e)
+		} else {
+			listing.Truncated = true
+		}
+	}
+
+	if format == "zip" {
+		zr, err := zip.OpenReader(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			add(ArchiveEntry{
+				Name:       f.Name,
+				Size:       int64(f.UncompressedSize64),
+				Compressed: int64(f.CompressedSize64),
+				ModTime:    f.Modified,
+				IsDir:      f.FileInfo().IsDir(),
+			})
+		}
+		return listing, nil
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	switch format {
+	case "tar.gz":
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case "tar.bz2":
+		r = bzip2.NewReader(file)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return listing, err
+		}
+		add(ArchiveEntry{
+			Name:    hdr.Name,
+			Size:    hdr.Size,
+			ModTime: hdr.ModTime,
+			IsDir:   hdr.Typeflag == tar.TypeDir,
+		})
+	}
+	return listing, nil
+}
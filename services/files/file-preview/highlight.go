@@ -0,0 +1,259 @@
+package main
+
+import (
+	"html"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// languageSpec describes just enough of a language's lexical structure to
+// colour keywords, strings, comments and numbers.
+type languageSpec struct {
+	Name         string
+	Keywords     []string
+	LineComments []string
+	BlockComment [2]string
+	StringQuotes string
+}
+
+var (
+	cLikeKeywords = []string{"if", "else", "for", "while", "do", "switch", "case", "default", "break",
+		"continue", "return", "struct", "const", "static", "void", "int", "char", "float", "double",
+		"long", "short", "unsigned", "signed", "sizeof", "typedef", "enum", "union", "goto", "extern"}
+
+	languages = map[string]languageSpec{
+		"go": {Name: "go", LineComments: []string{"//"}, BlockComment: [2]string{"/*", "*/"}, StringQuotes: "\"'`",
+			Keywords: []string{"break", "case", "chan", "const", "continue", "default", "defer", "else",
+				"fallthrough", "for", "func", "go", "goto", "if", "import", "interface", "map", "package",
+				"range", "return", "select", "struct", "switch", "type", "var", "nil", "true", "false"}},
+		"python": {Name: "python", LineComments: []string{"#"}, StringQuotes: "\"'",
+			Keywords: []string{"and", "as", "assert", "async", "await", "break", "class", "continue", "def",
+				"del", "elif", "else", "except", "finally", "for", "from", "global", "if", "import", "in",
+				"is", "lambda", "nonlocal", "not", "or", "pass", "raise", "return", "try", "while", "with",
+				"yield", "None", "True", "False", "self"}},
+		"javascript": {Name: "javascript", LineComments: []string{"//"}, BlockComment: [2]string{"/*", "*/"}, StringQuotes: "\"'`",
+			Keywords: []string{"async", "await", "break", "case", "catch", "class", "const", "continue",
+				"default", "delete", "do", "else", "export", "extends", "finally", "for", "function", "if",
+				"import", "in", "instanceof", "let", "new", "return", "super", "switch", "this", "throw",
+				"try", "typeof", "var", "void", "while", "yield", "null", "undefined", "true", "false"}},
+		"typescript": {Name: "typescript", LineComments: []string{"//"}, BlockComment: [2]string{"/*", "*/"}, StringQuotes: "\"'`",
+			Keywords: []string{"abstract", "any", "as", "async", "await", "boolean", "break", "case", "catch",
+				"class", "const", "continue", "declare", "default", "do", "else", "enum", "export", "extends",
+				"finally", "for", "from", "function", "if", "implements", "import", "in", "interface", "let",
+				"new", "number", "private", "protected", "public", "readonly", "return", "string", "switch",
+				"this", "throw", "try", "type", "var", "while", "null", "undefined", "true", "false"}},
+		"java": {Name: "java", LineComments: []string{"//"}, BlockComment: [2]string{"/*", "*/"}, StringQuotes: "\"'",
+			Keywords: []string{"abstract", "boolean", "break", "byte", "case", "catch", "char", "class",
+				"continue", "default", "do", "double", "else", "enum", "extends", "final", "finally", "float",
+				"for", "if", "implements", "import", "instanceof", "int", "interface", "long", "new",
+				"package", "private", "protected", "public", "return", "short", "static", "super", "switch",
+				"this", "throw", "throws", "try", "void", "while", "null", "true", "false"}},
+		"c":   {Name: "c", LineComments: []string{"//"}, BlockComment: [2]string{"/*", "*/"}, StringQuotes: "\"'", Keywords: cLikeKeywords},
+		"cpp": {Name: "cpp", LineComments: []string{"//"}, BlockComment: [2]string{"/*", "*/"}, StringQuotes: "\"'", Keywords: append([]string{"class", "namespace", "template", "typename", "public", "private", "protected", "virtual", "new", "delete", "this", "auto", "nullptr", "true", "false", "using"}, cLikeKeywords...)},
+		"rust": {Name: "rust", LineComments: []string{"//"}, BlockComment: [2]string{"/*", "*/"}, StringQuotes: "\"",
+			Keywords: []string{"as", "async", "await", "break", "const", "continue", "crate", "else", "enum",
+				"extern", "false", "fn", "for", "if", "impl", "in", "let", "loop", "match", "mod", "move",
+				"mut", "pub", "ref", "return", "self", "Self", "static", "struct", "super", "trait", "true",
+				"type", "unsafe", "use", "where", "while"}},
+		"ruby": {Name: "ruby", LineComments: []string{"#"}, StringQuotes: "\"'",
+			Keywords: []string{"begin", "class", "def", "do", "else", "elsif", "end", "ensure", "false",
+				"for", "if", "in", "module", "next", "nil", "not", "or", "and", "redo", "require", "rescue",
+				"retry", "return", "self", "super", "then", "true", "unless", "until", "when", "while", "yield"}},
+		"shell": {Name: "shell", LineComments: []string{"#"}, StringQuotes: "\"'",
+			Keywords: []string{"if", "then", "else", "elif", "fi", "for", "in", "do", "done", "while",
+				"until", "case", "esac", "function", "return", "local", "export", "echo", "exit"}},
+		"yaml": {Name: "yaml", LineComments: []string{"#"}, StringQuotes: "\"'",
+			Keywords: []string{"true", "false", "null", "yes", "no"}},
+		"json": {Name: "json", StringQuotes: "\"", Keywords: []string{"true", "false", "null"}},
+		"sql": {Name: "sql", LineComments: []string{"--"}, BlockComment: [2]string{"/*", "*/"}, StringQuotes: "'",
+			Keywords: []string{"select", "from", "where", "insert", "into", "values", "update", "set",
+				"delete", "create", "table", "index", "drop", "alter", "join", "left", "right", "inner",
+				"outer", "on", "group", "by", "order", "having", "limit", "and", "or", "not", "null", "as",
+				"primary", "key", "references", "if", "exists", "distinct", "union"}},
+		"css":  {Name: "css", BlockComment: [2]string{"/*", "*/"}, StringQuotes: "\"'"},
+		"html": {Name: "html", BlockComment: [2]string{"<!--", "-->"}, StringQuotes: "\"'"},
+		"xml":  {Name: "xml", BlockComment: [2]string{"<!--", "-->"}, StringQuotes: "\"'"},
+		"dockerfile": {Name: "dockerfile", LineComments: []string{"#"}, StringQuotes: "\"'",
+			Keywords: []string{"FROM", "RUN", "CMD", "COPY", "ADD", "ENV", "ARG", "WORKDIR", "EXPOSE",
+				"ENTRYPOINT", "USER", "VOLUME", "LABEL", "AS", "HEALTHCHECK"}},
+	}
+
+	extLanguages = map[string]string{
+		".go": "go", ".py": "python", ".js": "javascript", ".mjs": "javascript", ".jsx": "javascript",
+		".ts": "typescript", ".tsx": "typescript", ".java": "java", ".c": "c", ".h": "c",
+		".cpp": "cpp", ".cc": "cpp", ".hpp": "cpp", ".rs": "rust", ".rb": "ruby", ".sh": "shell",
+		".bash": "shell", ".yaml": "yaml", ".yml": "yaml", ".json": "json", ".sql": "sql",
+		".css": "css", ".html": "html", ".htm": "html", ".xml": "xml",
+	}
+
+	shebangLanguages = map[string]string{
+		"python": "python", "python3": "python", "node": "javascript", "ruby": "ruby",
+		"sh": "shell", "bash": "shell", "zsh": "shell",
+	}
+)
+
+// detectLanguage identifies the source language from the file name, then a
+// shebang line, then a few content heuristics for extensionless files.
+func detectLanguage(path string, sample []byte) string {
+	base := filepath.Base(path)
+	if base == "Dockerfile" || strings.HasPrefix(base, "Dockerfile.") {
+		return "dockerfile"
+	}
+	if lang, ok := extLanguages[strings.ToLower(filepath.Ext(path))]; ok {
+		return lang
+	}
+
+	text := string(sample)
+	if strings.HasPrefix(text, "#!") {
+		firstLine := strings.SplitN(text, "\n", 2)[0]
+		fields := strings.Fields(strings.TrimPrefix(firstLine, "#!"))
+		if len(fields) > 0 {
+			interp := filepath.Base(fields[0])
+			if interp == "env" && len(fields) > 1 {
+				interp = fields[1]
+			}
+			if lang, ok := shebangLanguages[interp]; ok {
+				return lang
+			}
+		}
+	}
+
+	trimmed := strings.TrimSpace(text)
+	switch {
+	case strings.HasPrefix(trimmed, "package ") && strings.Contains(text, "func "):
+		return "go"
+	case strings.HasPrefix(trimmed, "<?xml"):
+		return "xml"
+	case strings.HasPrefix(strings.ToLower(trimmed), "<!doctype html"), strings.HasPrefix(trimmed, "<html"):
+		return "html"
+	case strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "["):
+		return "json"
+	case strings.Contains(text, "def ") && strings.Contains(text, ":\n"):
+		return "python"
+	}
+	return ""
+}
+
+// highlight renders source as HTML with <span class="tok-*"> wrappers. The
+// output is escaped, so it can be inserted directly into the preview pane.
+func highlight(src, lang string) string {
+	spec, ok := languages[lang]
+	if !ok {
+		return html.EscapeString(src)
+	}
+
+	keywords := make(map[string]bool, len(spec.Keywords))
+	for _, k := range spec.Keywords {
+		keywords[k] = true
+		if lang == "sql" || lang == "dockerfile" {
+			keywords[strings.ToLower(k)] = true
+			keywords[strings.ToUpper(k)] = true
+		}
+	}
+
+	var b strings.Builder
+	emit := func(class, text string) {
+		if class == "" {
+			b.WriteString(html.EscapeString(text))
+			return
+		}
+		b.WriteString(`<span class="tok-` + class + `">`)
+		b.WriteString(html.EscapeString(text))
+		b.WriteString(`</span>`)
+	}
+
+	i := 0
+	for i < len(src) {
+		rest := src[i:]
+
+		if spec.BlockComment[0] != "" && strings.HasPrefix(rest, spec.BlockComment[0]) {
+			end := strings.Index(rest[len(spec.BlockComment[0]):], spec.BlockComment[1])
+			n := len(rest)
+			if end >= 0 {
+				n = len(spec.BlockComment[0]) + end + len(spec.BlockComment[1])
+			}
+			emit("comment", rest[:n])
+			i += n
+			continue
+		}
+
+		matchedComment := false
+		for _, lc := range spec.LineComments {
+			if strings.HasPrefix(rest, lc) {
+				n := strings.IndexByte(rest, '\n')
+				if n < 0 {
+					n = len(rest)
+				}
+				emit("comment", rest[:n])
+				i += n
+				matchedComment = true
+				break
+			}
+		}
+		if matchedComment {
+			continue
+		}
+
+		c := src[i]
+		if strings.IndexByte(spec.StringQuotes, c) >= 0 {
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' && c != '`' {
+					j++
+				} else if src[j] == '\n' && c != '`' {
+					break
+				}
+				j++
+			}
+			if j < len(src) && src[j] == c {
+				j++
+			}
+			if j > len(src) {
+				j = len(src)
+			}
+			emit("string", src[i:j])
+			i = j
+			continue
+		}
+
+		if c >= '0' && c <= '9' {
+			j := i
+			for j < len(src) && (isIdentByte(src[j]) || src[j] == '.') {
+				j++
+			}
+			emit("number", src[i:j])
+			i = j
+			continue
+		}
+
+		if isIdentByte(c) {
+			j := i
+			for j < len(src) && isIdentByte(src[j]) {
+				j++
+			}
+			word := src[i:j]
+			if keywords[word] {
+				emit("keyword", word)
+			} else {
+				emit("", word)
+			}
+			i = j
+			continue
+		}
+
+		j := i + 1
+		for j < len(src) && !isIdentByte(src[j]) && strings.IndexByte(spec.StringQuotes, src[j]) < 0 &&
+			!(src[j] >= '0' && src[j] <= '9') && src[j] != '/' && src[j] != '#' && src[j] != '-' && src[j] != '<' {
+			j++
+		}
+		emit("", src[i:j])
+		i = j
+	}
+
+	return b.String()
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -20,23 +22,47 @@ var (
 )
 
 const (
-	dataPath      = "/data"
-	maxPreviewSize = 10 * 1024 * 1024 // 10MB max preview
+	dataPath          = "/data"
+	maxPreviewSize    = 10 * 1024 * 1024 // 10MB max inline image/PDF preview
+	defaultTextWindow = 64 * 1024        // 64KB per text page
+	maxTextWindow     = 1024 * 1024      // 1MB max text page
 )
 
 type PreviewRequest struct {
-	Path string `json:"path"`
-	Lines int   `json:"lines,omitempty"` // For text files, limit lines
+	Path     string `json:"path"`
+	Lines    int    `json:"lines,omitempty"` // For text files, limit lines
+	Offset   int64  `json:"offset,omitempty"`
+	Limit    int64  `json:"limit,omitempty"`
+	Tail     bool   `json:"tail,omitempty"`
+	Page     int    `json:"page,omitempty"`
+	PageSize int    `json:"page_size,omitempty"`
 }
 
 type PreviewResponse struct {
-	Path     string `json:"path"`
-	Type     string `json:"type"`
-	Size     int64  `json:"size"`
-	Content  string `json:"content,omitempty"`  // For text files
-	Base64   string `json:"base64,omitempty"`   // For binary files (images, PDFs)
-	MimeType string `json:"mime_type"`
-	Error    string `json:"error,omitempty"`
+	Path     string            `json:"path"`
+	Type     string            `json:"type"`     // text, image, pdf or binary
+	Renderer string            `json:"renderer"` // How the UI should show it, see getRenderer
+	Size     int64             `json:"size"`
+	Content  string            `json:"content,omitempty"`  // For text files
+	Base64   string            `json:"base64,omitempty"`   // For binary files (images, PDFs)
+	HTML     string            `json:"html,omitempty"`     // Highlighted code or rendered Markdown
+	Language string            `json:"language,omitempty"` // Detected source language
+	Window   *TextWindow       `json:"window,omitempty"`   // Byte range of Content within the file
+	Table    *TablePreview     `json:"table,omitempty"`    // For CSV/TSV files
+	Archive  *ArchiveListing   `json:"archive,omitempty"`  // For zip/tar files
+	Metadata map[string]string `json:"metadata,omitempty"` // EXIF / ID3 panel
+	MimeType string            `json:"mime_type"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// TextWindow describes which bytes of a text file were returned, so the UI
+// can page forwards and backwards without ever loading the whole file.
+type TextWindow struct {
+	Offset     int64 `json:"offset"`
+	Length     int64 `json:"length"`
+	NextOffset int64 `json:"next_offset"`
+	HasMore    bool  `json:"has_more"`
+	HasBefore  bool  `json:"has_before"`
 }
 
 type HealthResponse struct {
@@ -51,17 +77,48 @@ type MetricsResponse struct {
 	Service      string  `json:"service"`
 }
 
-func getFileType(path string) (string, string) {
+// getFileType is the type clients have always switched on. Every text
+// renderer is "text" and comes with Content; archives and audio are
+// "binary" and come with the first 1KB as Base64, as before they had
+// renderers of their own.
+func getFileType(renderer string) string {
+	switch renderer {
+	case "text", "code", "markdown", "table":
+		return "text"
+	case "image", "pdf":
+		return renderer
+	default:
+		return "binary"
+	}
+}
+
+// getRenderer picks the preview a file gets: text, code, markdown, table,
+// archive, image, audio, pdf or binary, and its MIME type.
+func getRenderer(path string) (string, string) {
 	ext := strings.ToLower(filepath.Ext(path))
 
+	if archiveFormat(path) != "" && ext != ".epub" {
+		return "archive", archiveMimes[archiveFormat(path)]
+	}
+
 	textExts := map[string]string{
-		".txt": "text/plain", ".md": "text/markdown", ".json": "application/json",
-		".xml": "application/xml", ".html": "text/html", ".css": "text/css",
-		".js": "application/javascript", ".go": "text/x-go", ".py": "text/x-python",
-		".yaml": "text/yaml", ".yml": "text/yaml", ".sh": "text/x-shellscript",
-		".log": "text/plain", ".csv": "text/csv", ".ts": "text/typescript",
-		".java": "text/x-java", ".c": "text/x-c", ".cpp": "text/x-c++",
-		".h": "text/x-c", ".rs": "text/x-rust", ".rb": "text/x-ruby",
+		".txt": "text/plain", ".log": "text/plain", ".out": "text/plain",
+		".ini": "text/plain", ".conf": "text/plain", ".env": "text/plain",
+	}
+
+	codeExts := map[string]string{
+		".json": "application/json", ".xml": "application/xml", ".html": "text/html",
+		".htm": "text/html", ".css": "text/css", ".js": "application/javascript",
+		".mjs": "application/javascript", ".jsx": "application/javascript",
+		".go": "text/x-go", ".py": "text/x-python", ".yaml": "text/yaml", ".yml": "text/yaml",
+		".sh": "text/x-shellscript", ".bash": "text/x-shellscript", ".ts": "text/typescript",
+		".tsx": "text/typescript", ".java": "text/x-java", ".c": "text/x-c", ".cpp": "text/x-c++",
+		".cc": "text/x-c++", ".hpp": "text/x-c++", ".h": "text/x-c", ".rs": "text/x-rust",
+		".rb": "text/x-ruby", ".sql": "application/sql",
+	}
+
+	tableExts := map[string]string{
+		".csv": "text/csv", ".tsv": "text/tab-separated-values", ".tab": "text/tab-separated-values",
 	}
 
 	imageExts := map[string]string{
@@ -70,12 +127,32 @@ func getFileType(path string) (string, string) {
 		".svg": "image/svg+xml", ".ico": "image/x-icon",
 	}
 
+	audioExts := map[string]string{
+		".mp3": "audio/mpeg", ".m4a": "audio/mp4", ".m4b": "audio/mp4",
+		".flac": "audio/flac", ".ogg": "audio/ogg", ".wav": "audio/wav",
+	}
+
+	if ext == ".md" || ext == ".markdown" {
+		return "markdown", "text/markdown"
+	}
 	if mime, ok := textExts[ext]; ok {
 		return "text", mime
 	}
+	if mime, ok := codeExts[ext]; ok {
+		return "code", mime
+	}
+	if base := filepath.Base(path); base == "Dockerfile" || base == "Makefile" {
+		return "code", "text/plain"
+	}
+	if mime, ok := tableExts[ext]; ok {
+		return "table", mime
+	}
 	if mime, ok := imageExts[ext]; ok {
 		return "image", mime
 	}
+	if mime, ok := audioExts[ext]; ok {
+		return "audio", mime
+	}
 	if ext == ".pdf" {
 		return "pdf", "application/pdf"
 	}
@@ -83,21 +160,97 @@ func getFileType(path string) (string, string) {
 	return "binary", "application/octet-stream"
 }
 
+var archiveMimes = map[string]string{
+	"zip":     "application/zip",
+	"tar":     "application/x-tar",
+	"tar.gz":  "application/gzip",
+	"tar.bz2": "application/x-bzip2",
+}
+
+func queryInt(r *http.Request, key string) int64 {
+	v, _ := strconv.ParseInt(r.URL.Query().Get(key), 10, 64)
+	return v
+}
+
+// readTextWindow reads at most limit bytes starting at offset and trims the
+// window to whole lines, so pages never split a line or a UTF-8 sequence.
+// With tail set the window ends at EOF instead, which is what log viewers want.
+func readTextWindow(file *os.File, size, offset, limit int64, tail bool) (string, *TextWindow, error) {
+	if limit <= 0 {
+		limit = defaultTextWindow
+	}
+	if limit > maxTextWindow {
+		limit = maxTextWindow
+	}
+	if tail {
+		offset = size - limit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > size {
+		offset = size
+	}
+
+	end := offset + limit
+	if end > size {
+		end = size
+	}
+
+	buf := make([]byte, end-offset)
+	n, err := file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	buf = buf[:n]
+
+	start := 0
+	if offset > 0 {
+		// Skip the partial line unless the window already begins on a boundary
+		prev := make([]byte, 1)
+		if _, err := file.ReadAt(prev, offset-1); err == nil && prev[0] != '\n' {
+			if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+				start = i + 1
+			}
+		}
+	}
+	stop := len(buf)
+	if end < size {
+		if i := bytes.LastIndexByte(buf, '\n'); i >= start {
+			stop = i + 1
+		}
+	}
+
+	window := &TextWindow{
+		Offset:     offset + int64(start),
+		Length:     int64(stop - start),
+		NextOffset: offset + int64(stop),
+		HasMore:    offset+int64(stop) < size,
+		HasBefore:  offset+int64(start) > 0,
+	}
+	return string(buf[start:stop]), window, nil
+}
+
+func writePreviewError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(PreviewResponse{Error: msg})
+}
+
 func previewHandler(w http.ResponseWriter, r *http.Request) {
 	atomic.AddUint64(&requestCount, 1)
 	w.Header().Set("Content-Type", "application/json")
 
 	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(PreviewResponse{Error: "Method not allowed, use GET"})
+		writePreviewError(w, http.StatusMethodNotAllowed, "Method not allowed, use GET")
 		return
 	}
 
 	// Get path from query parameter: GET /preview?path=/some/file.txt
+	// Text paging:  &offset=<bytes>&limit=<bytes> or &tail=true
+	// Table paging: &page=<n>&page_size=<rows>
 	path := r.URL.Query().Get("path")
 	if path == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(PreviewResponse{Error: "Missing 'path' query parameter"})
+		writePreviewError(w, http.StatusBadRequest, "Missing 'path' query parameter")
 		return
 	}
 
@@ -108,19 +261,20 @@ func previewHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Sscanf(linesParam, "%d", &lines)
 	}
 
-	req := PreviewRequest{Path: path, Lines: lines}
-
-	if req.Path == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(PreviewResponse{Error: "Path is required"})
-		return
+	req := PreviewRequest{
+		Path:     path,
+		Lines:    lines,
+		Offset:   queryInt(r, "offset"),
+		Limit:    queryInt(r, "limit"),
+		Tail:     r.URL.Query().Get("tail") == "true",
+		Page:     int(queryInt(r, "page")),
+		PageSize: int(queryInt(r, "page_size")),
 	}
 
 	// Sanitize path
 	cleanPath := filepath.Clean(req.Path)
 	if strings.Contains(cleanPath, "..") {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(PreviewResponse{Error: "Invalid path"})
+		writePreviewError(w, http.StatusBadRequest, "Invalid path")
 		return
 	}
 
@@ -128,49 +282,48 @@ func previewHandler(w http.ResponseWriter, r *http.Request) {
 
 	info, err := os.Stat(fullPath)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(PreviewResponse{Error: "File not found: " + err.Error()})
+		writePreviewError(w, http.StatusNotFound, "File not found: "+err.Error())
 		return
 	}
 
 	if info.IsDir() {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(PreviewResponse{Error: "Cannot preview directory"})
+		writePreviewError(w, http.StatusBadRequest, "Cannot preview directory")
 		return
 	}
 
-	if info.Size() > maxPreviewSize {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(PreviewResponse{Error: "File too large for preview"})
+	renderer, mimeType := getRenderer(fullPath)
+
+	// Inline binary previews are still capped; text, tables and archives
+	// are paged or streamed so they work at any size.
+	if (renderer == "image" || renderer == "pdf") && info.Size() > maxPreviewSize {
+		writePreviewError(w, http.StatusBadRequest, "File too large for preview")
 		return
 	}
 
-	fileType, mimeType := getFileType(fullPath)
-
 	response := PreviewResponse{
 		Path:     req.Path,
-		Type:     fileType,
+		Type:     getFileType(renderer),
+		Renderer: renderer,
 		Size:     info.Size(),
 		MimeType: mimeType,
 	}
 
 	file, err := os.Open(fullPath)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(PreviewResponse{Error: "Failed to open file: " + err.Error()})
+		writePreviewError(w, http.StatusInternalServerError, "Failed to open file: "+err.Error())
 		return
 	}
 	defer file.Close()
 
-	switch fileType {
-	case "text":
-		data, err := io.ReadAll(file)
+	ext := strings.ToLower(filepath.Ext(fullPath))
+
+	switch renderer {
+	case "text", "code", "markdown", "table":
+		content, window, err := readTextWindow(file, info.Size(), req.Offset, req.Limit, req.Tail)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(PreviewResponse{Error: "Failed to read file: " + err.Error()})
+			writePreviewError(w, http.StatusInternalServerError, "Failed to read file: "+err.Error())
 			return
 		}
-		content := string(data)
 
 		// Limit lines if requested
 		if req.Lines > 0 {
@@ -181,26 +334,77 @@ func previewHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		response.Content = content
+		response.Window = window
+
+		switch renderer {
+		case "code":
+			sample := []byte(content)
+			if len(sample) > 512 {
+				sample = sample[:512]
+			}
+			response.Language = detectLanguage(fullPath, sample)
+			response.HTML = highlight(content, response.Language)
+		case "markdown":
+			response.HTML = renderMarkdown(content)
+		case "table":
+			sample := make([]byte, 4096)
+			n, _ := file.ReadAt(sample, 0)
+
+			table, err := readTablePage(file, delimiterFor(fullPath, sample[:n]), req.Page, req.PageSize)
+			if err != nil {
+				writePreviewError(w, http.StatusUnprocessableEntity, "Failed to parse table: "+err.Error())
+				return
+			}
+			response.Table = table
+		default:
+			// Plain text without an extension may still be source code
+			if lang := detectLanguage(fullPath, []byte(content)); lang != "" {
+				response.Language = lang
+				response.HTML = highlight(content, lang)
+			}
+		}
+
+	case "archive":
+		listing, err := listArchive(fullPath, archiveFormat(fullPath))
+		if err != nil && listing == nil {
+			writePreviewError(w, http.StatusUnprocessableEntity, "Failed to read archive: "+err.Error())
+			return
+		}
+		if err != nil {
+			response.Error = "Archive listing incomplete: " + err.Error()
+		}
+		response.Archive = listing
+		response.Base64 = headBase64(file)
+
+	case "audio":
+		response.Metadata = extractMetadata(file, renderer, ext)
+		response.Base64 = headBase64(file)
 
 	case "image", "pdf":
+		if renderer == "image" {
+			response.Metadata = extractMetadata(file, renderer, ext)
+		}
 		data, err := io.ReadAll(file)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(PreviewResponse{Error: "Failed to read file: " + err.Error()})
+			writePreviewError(w, http.StatusInternalServerError, "Failed to read file: "+err.Error())
 			return
 		}
 		response.Base64 = base64.StdEncoding.EncodeToString(data)
 
 	default:
-		// For unknown binary files, return first 1KB as base64
-		data := make([]byte, 1024)
-		n, _ := file.Read(data)
-		response.Base64 = base64.StdEncoding.EncodeToString(data[:n])
+		response.Base64 = headBase64(file)
 	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
+// headBase64 returns the first 1KB of a binary file as base64.
+func headBase64(file *os.File) string {
+	data := make([]byte, 1024)
+	n, _ := file.ReadAt(data, 0)
+	return base64.StdEncoding.EncodeToString(data[:n])
+}
+
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(HealthResponse{
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	mdHeading     = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	mdOrderedItem = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	mdBulletItem  = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdRule        = regexp.MustCompile(`^\s*([-*_])(\s*[-*_]){2,}\s*$`)
+	mdTableSep    = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+
+	mdImage  = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+	mdLink   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdBold   = regexp.MustCompile(`(\*\*|__)(.+?)(\*\*|__)`)
+	mdItalic = regexp.MustCompile(`(^|[^*\w])[*_]([^*_]+)[*_]`)
+	mdStrike = regexp.MustCompile(`~~(.+?)~~`)
+)
+
+// renderMarkdown converts CommonMark-style Markdown to HTML. It covers the
+// constructs that show up in READMEs and notes: headings, paragraphs, lists,
+// blockquotes, fenced code (highlighted), tables, rules and inline markup.
+// Raw HTML in the source is escaped rather than passed through.
+func renderMarkdown(src string) string {
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	var out strings.Builder
+	var para []string
+	listType := ""
+
+	flushPara := func() {
+		if len(para) > 0 {
+			out.WriteString("<p>" + renderInline(strings.Join(para, " ")) + "</p>\n")
+			para = nil
+		}
+	}
+	closeList := func() {
+		if listType != "" {
+			out.WriteString("</" + listType + ">\n")
+			listType = ""
+		}
+	}
+	openList := func(t string) {
+		if listType != t {
+			closeList()
+			out.WriteString("<" + t + ">\n")
+			listType = t
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			flushPara()
+			closeList()
+			fence := trimmed[:3]
+			lang := strings.TrimSpace(trimmed[3:])
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			body := strings.Join(code, "\n")
+			if _, ok := languages[lang]; ok {
+				body = highlight(body, lang)
+			} else {
+				body = html.EscapeString(body)
+			}
+			class := ""
+			if lang != "" {
+				class = ` class="language-` + html.EscapeString(lang) + `"`
+			}
+			out.WriteString("<pre><code" + class + ">" + body + "</code></pre>\n")
+			continue
+		}
+
+		if trimmed == "" {
+			flushPara()
+			closeList()
+			continue
+		}
+
+		if m := mdHeading.FindStringSubmatch(trimmed); m != nil {
+			flushPara()
+			closeList()
+			level := string(rune('0' + len(m[1])))
+			out.WriteString("<h" + level + ">" + renderInline(m[2]) + "</h" + level + ">\n")
+			continue
+		}
+
+		if mdRule.MatchString(trimmed) {
+			flushPara()
+			closeList()
+			out.WriteString("<hr>\n")
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, ">") {
+			flushPara()
+			closeList()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">"), " "))
+			}
+			i--
+			out.WriteString("<blockquote>\n" + renderMarkdown(strings.Join(quote, "\n")) + "</blockquote>\n")
+			continue
+		}
+
+		if strings.Contains(trimmed, "|") && i+1 < len(lines) && mdTableSep.MatchString(lines[i+1]) {
+			flushPara()
+			closeList()
+			out.WriteString("<table>\n<thead><tr>")
+			for _, cell := range splitTableRow(trimmed) {
+				out.WriteString("<th>" + renderInline(cell) + "</th>")
+			}
+			out.WriteString("</tr></thead>\n<tbody>\n")
+			for i += 2; i < len(lines) && strings.Contains(lines[i], "|"); i++ {
+				out.WriteString("<tr>")
+				for _, cell := range splitTableRow(lines[i]) {
+					out.WriteString("<td>" + renderInline(cell) + "</td>")
+				}
+				out.WriteString("</tr>\n")
+			}
+			i--
+			out.WriteString("</tbody>\n</table>\n")
+			continue
+		}
+
+		if m := mdBulletItem.FindStringSubmatch(line); m != nil {
+			flushPara()
+			openList("ul")
+			out.WriteString("<li>" + renderTaskItem(m[1]) + "</li>\n")
+			continue
+		}
+		if m := mdOrderedItem.FindStringSubmatch(line); m != nil {
+			flushPara()
+			openList("ol")
+			out.WriteString("<li>" + renderInline(m[1]) + "</li>\n")
+			continue
+		}
+
+		if strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t") {
+			if len(para) == 0 && listType == "" {
+				var code []string
+				for ; i < len(lines) && (strings.HasPrefix(lines[i], "    ") || strings.HasPrefix(lines[i], "\t") || strings.TrimSpace(lines[i]) == ""); i++ {
+					code = append(code, strings.TrimPrefix(strings.TrimPrefix(lines[i], "    "), "\t"))
+				}
+				i--
+				out.WriteString("<pre><code>" + html.EscapeString(strings.TrimRight(strings.Join(code, "\n"), "\n")) + "</code></pre>\n")
+				continue
+			}
+		}
+
+		closeList()
+		para = append(para, trimmed)
+	}
+
+	flushPara()
+	closeList()
+	return out.String()
+}
+
+func renderTaskItem(text string) string {
+	switch {
+	case strings.HasPrefix(text, "[ ] "):
+		return `<input type="checkbox" disabled> ` + renderInline(text[4:])
+	case strings.HasPrefix(text, "[x] "), strings.HasPrefix(text, "[X] "):
+		return `<input type="checkbox" checked disabled> ` + renderInline(text[4:])
+	}
+	return renderInline(text)
+}
+
+func splitTableRow(row string) []string {
+	row = strings.TrimSpace(row)
+	row = strings.TrimPrefix(row, "|")
+	row = strings.TrimSuffix(row, "|")
+	cells := strings.Split(row, "|")
+	for i := range cells {
+		cells[i] = strings.TrimSpace(cells[i])
+	}
+	return cells
+}
+
+// renderInline handles code spans, links, images and emphasis within a
+// block. Code spans are cut out first so their contents are never
+// interpreted as markup.
+func renderInline(text string) string {
+	parts := strings.Split(text, "`")
+	var out strings.Builder
+	for i, part := range parts {
+		if i%2 == 1 && i < len(parts)-1 {
+			out.WriteString("<code>" + html.EscapeString(part) + "</code>")
+			continue
+		}
+		if i%2 == 1 {
+			out.WriteString("`")
+		}
+		s := html.EscapeString(part)
+		s = mdImage.ReplaceAllStringFunc(s, func(m string) string {
+			sub := mdImage.FindStringSubmatch(m)
+			return `<img src="` + safeURL(sub[2]) + `" alt="` + sub[1] + `">`
+		})
+		s = mdLink.ReplaceAllStringFunc(s, func(m string) string {
+			sub := mdLink.FindStringSubmatch(m)
+			return `<a href="` + safeURL(sub[2]) + `" rel="noopener noreferrer">` + sub[1] + `</a>`
+		})
+		s = mdBold.ReplaceAllString(s, "<strong>$2</strong>")
+		s = mdItalic.ReplaceAllString(s, "$1<em>$2</em>")
+		s = mdStrike.ReplaceAllString(s, "<del>$1</del>")
+		out.WriteString(s)
+	}
+	return out.String()
+}
+
+// safeURL drops javascript: and similar schemes from rendered links.
+func safeURL(u string) string {
+	lower := strings.ToLower(strings.TrimSpace(u))
+	if strings.HasPrefix(lower, "javascript:") || strings.HasPrefix(lower, "vbscript:") || strings.HasPrefix(lower, "data:") {
+		return "#"
+	}
+	return u
+}
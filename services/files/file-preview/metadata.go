@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// extractMetadata builds the metadata panel for images (dimensions and EXIF)
+// and audio files (ID3 tags). It returns nil when nothing was found.
+func extractMetadata(file *os.File, fileType, ext string) map[string]string {
+	meta := map[string]string{}
+
+	switch {
+	case fileType == "image":
+		if cfg, format, err := image.DecodeConfig(file); err == nil {
+			meta["width"] = strconv.Itoa(cfg.Width)
+			meta["height"] = strconv.Itoa(cfg.Height)
+			meta["format"] = format
+		}
+		if ext == ".jpg" || ext == ".jpeg" {
+			file.Seek(0, io.SeekStart)
+			for k, v := range parseJPEGExif(file) {
+				meta[k] = v
+			}
+		}
+	case fileType == "audio":
+		file.Seek(0, io.SeekStart)
+		for k, v := range parseID3(file) {
+			meta[k] = v
+		}
+	}
+
+	file.Seek(0, io.SeekStart)
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
+
+// ---- EXIF ----
+
+var exifTagNames = map[uint16]string{
+	0x010F: "camera_make",
+	0x0110: "camera_model",
+	0x0112: "orientation",
+	0x0131: "software",
+	0x0132: "date_time",
+	0x829A: "exposure_time",
+	0x829D: "f_number",
+	0x8827: "iso",
+	0x9003: "date_time_original",
+	0x9209: "flash",
+	0x920A: "focal_length",
+	0xA002: "pixel_width",
+	0xA003: "pixel_height",
+	0xA434: "lens_model",
+}
+
+const (
+	exifIFDPointer = 0x8769
+	gpsIFDPointer  = 0x8825
+)
+
+// parseJPEGExif walks the JPEG markers up to the APP1 Exif segment and decodes
+// the TIFF structure inside it.
+func parseJPEGExif(r io.Reader) map[string]string {
+	br := &byteReader{r: r}
+	if soi := br.read(2); !bytes.Equal(soi, []byte{0xFF, 0xD8}) {
+		return nil
+	}
+
+	for !br.failed {
+		marker := br.read(2)
+		if len(marker) < 2 || marker[0] != 0xFF {
+			return nil
+		}
+		// Start of scan means the headers are over
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return nil
+		}
+		lenBytes := br.read(2)
+		if len(lenBytes) < 2 {
+			return nil
+		}
+		segLen := int(binary.BigEndian.Uint16(lenBytes)) - 2
+		if segLen < 0 {
+			return nil
+		}
+		seg := br.read(segLen)
+		if marker[1] == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return parseTIFF(seg[6:])
+		}
+	}
+	return nil
+}
+
+type byteReader struct {
+	r      io.Reader
+	failed bool
+}
+
+func (b *byteReader) read(n int) []byte {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(b.r, buf); err != nil {
+		b.failed = true
+		return nil
+	}
+	return buf
+}
+
+func parseTIFF(data []byte) map[string]string {
+	if len(data) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+
+	out := map[string]string{}
+	gps := map[uint16]string{}
+	seen := map[uint32]bool{}
+
+	// IFD0 and the Exif sub-IFD share tag names; GPS tags live in their own
+	// numbering space and are collected separately.
+	var walk func(offset uint32, isGPS bool)
+	walk = func(offset uint32, isGPS bool) {
+		if seen[offset] || int(offset)+2 > len(data) {
+			return
+		}
+		seen[offset] = true
+		count := int(order.Uint16(data[offset:]))
+		for i := 0; i < count; i++ {
+			p := int(offset) + 2 + i*12
+			if p+12 > len(data) {
+				return
+			}
+			tag := order.Uint16(data[p:])
+			typ := order.Uint16(data[p+2:])
+			n := order.Uint32(data[p+4:])
+
+			if !isGPS && tag == exifIFDPointer {
+				walk(order.Uint32(data[p+8:]), false)
+				continue
+			}
+			if !isGPS && tag == gpsIFDPointer {
+				walk(order.Uint32(data[p+8:]), true)
+				continue
+			}
+
+			key := exifTagNames[tag]
+			if !isGPS && key == "" {
+				continue
+			}
+			val := exifValue(data, order, typ, n, data[p+8:p+12])
+			if val == "" {
+				continue
+			}
+			if isGPS {
+				gps[tag] = val
+			} else {
+				out[key] = val
+			}
+		}
+	}
+
+	walk(order.Uint32(data[4:]), false)
+
+	if lat, ok := gpsCoordinate(gps[2], gps[1]); ok {
+		out["gps_latitude"] = lat
+	}
+	if lon, ok := gpsCoordinate(gps[4], gps[3]); ok {
+		out["gps_longitude"] = lon
+	}
+	if alt := gps[6]; alt != "" {
+		out["gps_altitude"] = alt
+	}
+	return out
+}
+
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func exifValue(data []byte, order binary.ByteOrder, typ uint16, count uint32, inline []byte) string {
+	size, ok := exifTypeSizes[typ]
+	if !ok || count == 0 || count > 1<<16 {
+		return ""
+	}
+	total := size * int(count)
+	raw := inline
+	if total > 4 {
+		off := int(order.Uint32(inline))
+		if off+total > len(data) {
+			return ""
+		}
+		raw = data[off : off+total]
+	}
+
+	switch typ {
+	case 2:
+		return strings.TrimSpace(strings.TrimRight(string(raw[:total]), "\x00"))
+	case 3:
+		return strconv.Itoa(int(order.Uint16(raw)))
+	case 4:
+		return strconv.FormatUint(uint64(order.Uint32(raw)), 10)
+	case 9:
+		return strconv.FormatInt(int64(int32(order.Uint32(raw))), 10)
+	case 5, 10:
+		parts := make([]string, 0, count)
+		for i := 0; i < int(count); i++ {
+			num := order.Uint32(raw[i*8:])
+			den := order.Uint32(raw[i*8+4:])
+			if typ == 10 {
+				parts = append(parts, formatRational(float64(int32(num)), float64(int32(den))))
+			} else {
+				parts = append(parts, formatRational(float64(num), float64(den)))
+			}
+		}
+		return strings.Join(parts, ",")
+	}
+	return ""
+}
+
+func formatRational(num, den float64) string {
+	if den == 0 {
+		return "0"
+	}
+	if num < den && num != 0 && den/num == float64(int(den/num)) {
+		// Exposure times read better as 1/250 than 0.004
+		return fmt.Sprintf("1/%d", int(den/num))
+	}
+	return strconv.FormatFloat(num/den, 'f', -1, 64)
+}
+
+// gpsCoordinate converts EXIF degrees,minutes,seconds plus a N/S/E/W ref into
+// a signed decimal degree string.
+func gpsCoordinate(dms, ref string) (string, bool) {
+	parts := strings.Split(dms, ",")
+	if len(parts) != 3 {
+		return "", false
+	}
+	var vals [3]float64
+	for i, p := range parts {
+		if strings.HasPrefix(p, "1/") {
+			d, _ := strconv.ParseFloat(p[2:], 64)
+			if d != 0 {
+				vals[i] = 1 / d
+			}
+			continue
+		}
+		vals[i], _ = strconv.ParseFloat(p, 64)
+	}
+	deg := vals[0] + vals[1]/60 + vals[2]/3600
+	if ref == "S" || ref == "W" {
+		deg = -deg
+	}
+	return strconv.FormatFloat(deg, 'f', 6, 64), true
+}
+
+// ---- ID3 ----
+
+var id3FrameNames = map[string]string{
+	"TIT2": "title", "TT2": "title",
+	"TPE1": "artist", "TP1": "artist",
+	"TPE2": "album_artist", "TP2": "album_artist",
+	"TALB": "album", "TAL": "album",
+	"TRCK": "track", "TRK": "track",
+	"TPOS": "disc", "TPA": "disc",
+	"TYER": "year", "TYE": "year", "TDRC": "year",
+	"TCON": "genre", "TCO": "genre",
+	"TCOM": "composer", "TCM": "composer",
+	"TLEN": "duration_ms", "TLE": "duration_ms",
+}
+
+// parseID3 reads an ID3v2 tag at the start of the file, falling back to an
+// ID3v1 trailer when there is none.
+func parseID3(file *os.File) map[string]string {
+	out := map[string]string{}
+
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(file, header); err == nil && string(header[:3]) == "ID3" {
+		major := header[3]
+		size := syncsafe(header[6:10])
+		body := make([]byte, size)
+		if _, err := io.ReadFull(file, body); err == nil {
+			out["id3_version"] = fmt.Sprintf("2.%d", major)
+			parseID3v2Frames(body, major, out)
+		}
+	}
+
+	if len(out) == 0 {
+		if info, err := file.Stat(); err == nil && info.Size() > 128 {
+			tail := make([]byte, 128)
+			if _, err := file.ReadAt(tail, info.Size()-128); err == nil && string(tail[:3]) == "TAG" {
+				out["id3_version"] = "1"
+				setIfPresent(out, "title", latin1(tail[3:33]))
+				setIfPresent(out, "artist", latin1(tail[33:63]))
+				setIfPresent(out, "album", latin1(tail[63:93]))
+				setIfPresent(out, "year", latin1(tail[93:97]))
+			}
+		}
+	}
+
+	if ms, err := strconv.Atoi(out["duration_ms"]); err == nil {
+		out["duration"] = formatDuration(ms / 1000)
+	}
+	return out
+}
+
+func parseID3v2Frames(body []byte, major byte, out map[string]string) {
+	idLen, hdrLen := 4, 10
+	if major == 2 {
+		idLen, hdrLen = 3, 6
+	}
+
+	for p := 0; p+hdrLen <= len(body); {
+		id := string(body[p : p+idLen])
+		if id[0] == 0 {
+			break
+		}
+		var size int
+		switch major {
+		case 2:
+			size = int(body[p+3])<<16 | int(body[p+4])<<8 | int(body[p+5])
+		case 4:
+			size = syncsafe(body[p+4 : p+8])
+		default:
+			size = int(binary.BigEndian.Uint32(body[p+4 : p+8]))
+		}
+		start := p + hdrLen
+		end := start + size
+		if size <= 0 || end > len(body) {
+			break
+		}
+
+		if name, ok := id3FrameNames[id]; ok {
+			setIfPresent(out, name, decodeID3Text(body[start:end]))
+		} else if id == "APIC" || id == "PIC" {
+			out["has_cover"] = "true"
+		}
+		p = end
+	}
+}
+
+func decodeID3Text(frame []byte) string {
+	if len(frame) < 2 {
+		return ""
+	}
+	enc, data := frame[0], frame[1:]
+	var s string
+	switch enc {
+	case 1, 2:
+		u16 := make([]uint16, 0, len(data)/2)
+		bigEndian := enc == 2
+		if len(data) >= 2 && data[0] == 0xFF && data[1] == 0xFE {
+			data = data[2:]
+		} else if len(data) >= 2 && data[0] == 0xFE && data[1] == 0xFF {
+			bigEndian = true
+			data = data[2:]
+		}
+		for i := 0; i+1 < len(data); i += 2 {
+			if bigEndian {
+				u16 = append(u16, uint16(data[i])<<8|uint16(data[i+1]))
+			} else {
+				u16 = append(u16, uint16(data[i+1])<<8|uint16(data[i]))
+			}
+		}
+		s = string(utf16.Decode(u16))
+	case 3:
+		s = string(data)
+	default:
+		s = latin1(data)
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, 0, len(b))
+	for _, c := range b {
+		if c == 0 {
+			break
+		}
+		runes = append(runes, rune(c))
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+func setIfPresent(m map[string]string, key, val string) {
+	if val != "" {
+		m[key] = val
+	}
+}
+
+func formatDuration(seconds int) string {
+	h, m, s := seconds/3600, (seconds%3600)/60, seconds%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
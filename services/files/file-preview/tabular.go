@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+type TablePreview struct {
+	Delimiter string     `json:"delimiter"`
+	Headers   []string   `json:"headers"`
+	Rows      [][]string `json:"rows"`
+	Page      int        `json:"page"`
+	PageSize  int        `json:"page_size"`
+	HasMore   bool       `json:"has_more"`
+}
+
+// delimiterFor picks the separator from the extension, falling back to
+// whichever of comma, tab or semicolon dominates the first line.
+func delimiterFor(path string, sample []byte) rune {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".tsv", ".tab":
+		return '\t'
+	}
+	firstLine := strings.SplitN(string(sample), "\n", 2)[0]
+	best, bestCount := ',', strings.Count(firstLine, ",")
+	for _, d := range []rune{'\t', ';'} {
+		if n := strings.Count(firstLine, string(d)); n > bestCount {
+			best, bestCount = d, n
+		}
+	}
+	return best
+}
+
+// readTablePage streams the file and returns one page of rows. Earlier rows
+// are skipped without being kept, so paging deep into a large export only
+// costs a sequential read.
+func readTablePage(file *os.File, delim rune, page, pageSize int) (*TablePreview, error) {
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	reader := csv.NewReader(file)
+	reader.Comma = delim
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.ReuseRecord = false
+
+	headers, err := reader.Read()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	table := &TablePreview{
+		Delimiter: string(delim),
+		Headers:   headers,
+		Rows:      [][]string{},
+		Page:      page,
+		PageSize:  pageSize,
+	}
+
+	skip := (page - 1) * pageSize
+	for i := 0; ; i++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i < skip {
+			continue
+		}
+		if len(table.Rows) == pageSize {
+			table.HasMore = true
+			break
+		}
+		table.Rows = append(table.Rows, record)
+	}
+
+	return table, nil
+}
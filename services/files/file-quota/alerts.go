@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	notifyURL    = "http://notification-hub.holm.svc.cluster.local/api/notifications"
+	notifyClient = &http.Client{Timeout: 5 * time.Second}
+
+	alertsSent   uint64
+	alertsFailed uint64
+)
+
+// formatBytes renders a byte count for humans, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// sendAlert posts a threshold crossing to notification-hub. User quotas are
+// addressed to the user; directory quotas go to whoever watches the hub.
+func sendAlert(a Alert) {
+	st := a.Status
+	subject := strings.TrimPrefix(st.Scope, scopeDir)
+	recipient := ""
+	if strings.HasPrefix(st.Scope, scopeUser) {
+		recipient = strings.TrimPrefix(st.Scope, scopeUser)
+		subject = "Your storage"
+	}
+
+	n := map[string]interface{}{
+		"source":    "file-quota",
+		"type":      "warning",
+		"priority":  "normal",
+		"title":     fmt.Sprintf("%s is %d%% full", subject, a.Level),
+		"message":   fmt.Sprintf("%s of %s used (%.1f%%)", formatBytes(st.Used), formatBytes(maxInt64(st.Hard, st.Soft)), st.Percent),
+		"recipient": recipient,
+		"metadata": map[string]interface{}{
+			"scope":       st.Scope,
+			"level":       a.Level,
+			"used_bytes":  st.Used,
+			"soft_bytes":  st.Soft,
+			"hard_bytes":  st.Hard,
+			"default":     a.Default,
+			"quota_state": st.State,
+		},
+	}
+	if a.Level >= alertLevels[len(alertLevels)-1] {
+		n["type"] = "error"
+		n["priority"] = "high"
+	}
+
+	data, err := json.Marshal(n)
+	if err != nil {
+		return
+	}
+	resp, err := notifyClient.Post(notifyURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		atomic.AddUint64(&alertsFailed, 1)
+		log.Printf("Failed to send quota alert for %s: %v", st.Scope, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		atomic.AddUint64(&alertsFailed, 1)
+		log.Printf("notification-hub rejected quota alert for %s: status %d", st.Scope, resp.StatusCode)
+		return
+	}
+	atomic.AddUint64(&alertsSent, 1)
+	log.Printf("Quota alert sent: %s at %d%% (%.1f%%)", st.Scope, a.Level, st.Percent)
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
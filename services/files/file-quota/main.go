@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/holm/filesdk"
+)
+
+var (
+	requestCount uint64
+	checkCount   uint64
+	rejectCount  uint64
+	startTime    = time.Now()
+
+	usageIndex *UsageIndex
+	quotaStore *QuotaStore
+)
+
+// storagePath is where the file services mount the shared data volume, so
+// paths they report resolve to the same files the rescan walks.
+const storagePath = "/storage"
+
+type HealthResponse struct {
+	Status    string `json:"status"`
+	Service   string `json:"service"`
+	Timestamp string `json:"timestamp"`
+}
+
+type MetricsResponse struct {
+	Uptime       string `json:"uptime"`
+	Requests     uint64 `json:"requests"`
+	Checks       uint64 `json:"quota_checks"`
+	Rejected     uint64 `json:"quota_rejected"`
+	AlertsSent   uint64 `json:"alerts_sent"`
+	AlertsFailed uint64 `json:"alerts_failed"`
+	IndexedBytes int64  `json:"indexed_bytes"`
+	IndexedFiles int64  `json:"indexed_files"`
+	Service      string `json:"service"`
+}
+
+type CheckRequest struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// UsageChange is one change reported by a file service after it touched
+// storage. Op is "write" (Path now holds Size bytes), "delete" (Path and
+// everything below it are gone) or "move" (Path was renamed to Dest).
+type UsageChange struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	Size int64  `json:"size,omitempty"`
+	Dest string `json:"dest,omitempty"`
+}
+
+type RecordRequest struct {
+	Changes []UsageChange `json:"changes"`
+}
+
+func getEnv(key, defaultVal string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return defaultVal
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// requireIdentity resolves the caller, writing a 401/502 and returning false
+// when that fails.
+func requireIdentity(w http.ResponseWriter, r *http.Request) (Identity, bool) {
+	id, err := filesdk.ResolveIdentity(r)
+	if err == filesdk.ErrInvalidToken {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return id, false
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return id, false
+	}
+	return id, true
+}
+
+// checkHandler answers whether the caller may write bytes to path. File
+// services forward the user's credentials and call this before writing;
+// a disallowed write comes back as 507 with the quotas involved.
+// POST /api/v1/quota/check {"path": "/photos/a.jpg", "bytes": 1048576}
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCount, 1)
+	atomic.AddUint64(&checkCount, 1)
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, CheckResult{Error: "Method not allowed"})
+		return
+	}
+	var req CheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, CheckResult{Error: "Invalid JSON: " + err.Error()})
+		return
+	}
+	if req.Path == "" || req.Bytes < 0 {
+		writeJSON(w, http.StatusBadRequest, CheckResult{Error: "path and a non-negative bytes are required"})
+		return
+	}
+
+	id, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	res := quotaStore.Check(usageIndex, id.Username, req.Path, req.Bytes)
+	if !res.Allowed {
+		atomic.AddUint64(&rejectCount, 1)
+		res.Error = "quota exceeded"
+		log.Printf("Quota rejected %d bytes to %s by %q: %s", req.Bytes, res.Path, id.Username, strings.Join(res.Violations, "; "))
+		writeJSON(w, http.StatusInsufficientStorage, res)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// recordHandler applies changes reported by file services to the usage
+// index and raises alerts for any quota that crossed a threshold. Only file
+// services may report changes; writes are attributed to the user they
+// forwarded.
+// POST /api/v1/usage/record {"changes": [{"op": "write", "path": "/a.txt", "size": 42}]}
+func recordHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCount, 1)
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+		return
+	}
+	var req RecordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid JSON: " + err.Error()})
+		return
+	}
+	for _, c := range req.Changes {
+		if c.Path == "" || (c.Op == "move" && c.Dest == "") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "each change needs a path (and dest for move)"})
+			return
+		}
+		if c.Op != "write" && c.Op != "delete" && c.Op != "move" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid op " + c.Op})
+			return
+		}
+		if c.Size < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "size must not be negative"})
+			return
+		}
+	}
+
+	id, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	if !id.Service {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "usage may only be recorded by file services"})
+		return
+	}
+
+	touched := map[string]bool{}
+	for _, c := range req.Changes {
+		switch c.Op {
+		case "write":
+			usageIndex.Set(c.Path, c.Size, id.Username)
+			touched[normalizePath(c.Path)] = true
+		case "delete":
+			usageIndex.Remove(c.Path)
+			touched[normalizePath(c.Path)] = true
+		case "move":
+			usageIndex.Move(c.Path, c.Dest)
+			touched[normalizePath(c.Path)] = true
+			touched[normalizePath(c.Dest)] = true
+		}
+	}
+
+	for p := range touched {
+		for _, a := range quotaStore.UpdateAlerts(usageIndex, id.Username, p) {
+			go sendAlert(a)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"recorded": len(req.Changes)})
+}
+
+// usageHandler reports usage below a path, broken down by immediate child
+// directory and by file type, plus the quotas that apply there. Users see
+// their own files unless they are admins, who may pick any user or all.
+// GET /api/v1/usage?path=/photos&user=alice&all=true
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCount, 1)
+
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+		return
+	}
+	id, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	if !id.Authenticated() {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "authentication required"})
+		return
+	}
+
+	q := r.URL.Query()
+	p := q.Get("path")
+	if p == "" {
+		p = "/"
+	}
+	user := id.Username
+	all := false
+	if id.IsAdmin() {
+		if q.Get("all") == "true" {
+			user = ""
+			all = true
+		} else if u := q.Get("user"); u != "" {
+			user = u
+		}
+	} else if u := q.Get("user"); u != "" && u != id.Username {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin role required to view other users"})
+		return
+	}
+
+	rep := usageIndex.Report(p, user, all)
+	rep.Quotas = quotaStore.Applicable(usageIndex, user, rep.Path)
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// quotasHandler manages quota definitions. Anyone may list them with their
+// current usage; only admins may change them.
+// GET /api/v1/quotas  PUT /api/v1/quotas  DELETE /api/v1/quotas?scope=
+func quotasHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCount, 1)
+
+	id, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		quotas := quotaStore.List()
+		statuses := make([]QuotaStatus, 0, len(quotas))
+		for i := range quotas {
+			qt := &quotas[i]
+			var used int64
+			switch {
+			case qt.Scope == scopeDefaultUser:
+				// Not tied to one user's usage
+			case strings.HasPrefix(qt.Scope, scopeUser):
+				used = usageIndex.UserUsage(qt.Scope[len(scopeUser):]).Bytes
+			default:
+				used = usageIndex.DirUsage(qt.Scope[len(scopeDir):]).Bytes
+			}
+			statuses = append(statuses, newStatus(qt, used))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"quotas": statuses, "count": len(statuses)})
+
+	case http.MethodPut, http.MethodPost:
+		if !id.IsAdmin() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin role required"})
+			return
+		}
+		var qt Quota
+		if err := json.NewDecoder(r.Body).Decode(&qt); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid JSON: " + err.Error()})
+			return
+		}
+		if err := validateQuota(&qt); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		qt.UpdatedBy = id.Username
+		qt.AlertLevel = 0
+		if err := quotaStore.Put(&qt); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to save quota: " + err.Error()})
+			return
+		}
+		log.Printf("Quota %s set by %s: soft=%d hard=%d", qt.Scope, id.Username, qt.Soft, qt.Hard)
+		writeJSON(w, http.StatusOK, qt)
+
+	case http.MethodDelete:
+		if !id.IsAdmin() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin role required"})
+			return
+		}
+		scope := r.URL.Query().Get("scope")
+		if scope == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "scope is required"})
+			return
+		}
+		removed, err := quotaStore.Delete(scope)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"scope": scope, "removed": removed})
+
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+	}
+}
+
+// rescanHandler rebuilds the usage index from disk. Admin only.
+// POST /api/v1/rescan
+func rescanHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCount, 1)
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+		return
+	}
+	id, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	if !id.IsAdmin() {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin role required"})
+		return
+	}
+
+	start := time.Now()
+	if err := usageIndex.Rescan(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	total := usageIndex.DirUsage("/")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"bytes":    total.Bytes,
+		"files":    total.Files,
+		"duration": time.Since(start).String(),
+	})
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HealthResponse{
+		Status:    "healthy",
+		Service:   "file-quota",
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	total := usageIndex.DirUsage("/")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MetricsResponse{
+		Uptime:       time.Since(startTime).String(),
+		Requests:     atomic.LoadUint64(&requestCount),
+		Checks:       atomic.LoadUint64(&checkCount),
+		Rejected:     atomic.LoadUint64(&rejectCount),
+		AlertsSent:   atomic.LoadUint64(&alertsSent),
+		AlertsFailed: atomic.LoadUint64(&alertsFailed),
+		IndexedBytes: total.Bytes,
+		IndexedFiles: total.Files,
+		Service:      "file-quota",
+	})
+}
+
+// maintain periodically reconciles the index with disk and flushes owner
+// changes, which are batched to keep writes cheap on busy nodes.
+func maintain(rescanEvery time.Duration) {
+	flush := time.NewTicker(10 * time.Second)
+	rescan := time.NewTicker(rescanEvery)
+	for {
+		select {
+		case <-flush.C:
+			if err := usageIndex.SaveOwners(); err != nil {
+				log.Printf("Failed to save owners: %v", err)
+			}
+		case <-rescan.C:
+			if err := usageIndex.Rescan(); err != nil {
+				log.Printf("Rescan failed: %v", err)
+			}
+		}
+	}
+}
+
+func main() {
+	storageRoot := getEnv("STORAGE_ROOT", storagePath)
+	stateDir := getEnv("QUOTA_STATE_DIR", "/state")
+	notifyURL = getEnv("NOTIFY_URL", notifyURL)
+
+	rescanEvery, err := time.ParseDuration(getEnv("QUOTA_RESCAN_INTERVAL", "1h"))
+	if err != nil || rescanEvery <= 0 {
+		log.Fatalf("Invalid QUOTA_RESCAN_INTERVAL: %v", err)
+	}
+
+	quotaStore, err = NewQuotaStore(filepath.Join(stateDir, "quotas.json"))
+	if err != nil {
+		log.Fatalf("Failed to load quotas: %v", err)
+	}
+	usageIndex, err = NewUsageIndex(storageRoot, filepath.Join(stateDir, "owners.json"))
+	if err != nil {
+		log.Fatalf("Failed to load usage index: %v", err)
+	}
+
+	start := time.Now()
+	if err := usageIndex.Rescan(); err != nil {
+		log.Printf("Warning: initial scan of %s failed: %v", storageRoot, err)
+	}
+	total := usageIndex.DirUsage("/")
+	log.Printf("Indexed %d files (%s) under %s in %s", total.Files, formatBytes(total.Bytes), storageRoot, time.Since(start))
+
+	go maintain(rescanEvery)
+
+	http.HandleFunc("/api/v1/quota/check", checkHandler)
+	http.HandleFunc("/api/v1/usage", usageHandler)
+	http.HandleFunc("/api/v1/usage/record", recordHandler)
+	http.HandleFunc("/api/v1/quotas", quotasHandler)
+	http.HandleFunc("/api/v1/rescan", rescanHandler)
+	http.HandleFunc("/health", healthHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+
+	fmt.Println("file-quota service starting on :8080")
+	log.Fatal(http.ListenAndServe(":8080", nil))
+}
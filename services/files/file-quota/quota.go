@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/holm/filesdk"
+)
+
+// Quota scopes are "user:<username>", "user:*" for the default applied to
+// users without a quota of their own, or "dir:<path>" for a directory tree.
+const (
+	scopeUser        = "user:"
+	scopeDir         = "dir:"
+	scopeDefaultUser = "user:*"
+)
+
+// Alert thresholds as a percentage of the hard limit.
+var alertLevels = []int{80, 95}
+
+// Identity is the caller as resolved by auth-gateway.
+type Identity = filesdk.Identity
+
+// Quota limits the bytes stored in a scope. Writes that would push usage
+// past Soft are allowed but flagged; writes past Hard are refused. Either
+// limit may be 0 to leave it unset.
+type Quota struct {
+	Scope     string    `json:"scope"`
+	Soft      int64     `json:"soft_bytes"`
+	Hard      int64     `json:"hard_bytes"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+
+	// Highest alert level already sent, so each crossing notifies once.
+	// Reset when usage drops back below the lowest level.
+	AlertLevel int `json:"alert_level,omitempty"`
+}
+
+// limit is what usage percentages and alerts are measured against.
+func (q *Quota) limit() int64 {
+	if q.Hard > 0 {
+		return q.Hard
+	}
+	return q.Soft
+}
+
+// QuotaStatus is a quota together with the usage it currently covers.
+type QuotaStatus struct {
+	Scope     string  `json:"scope"`
+	Used      int64   `json:"used_bytes"`
+	Soft      int64   `json:"soft_bytes,omitempty"`
+	Hard      int64   `json:"hard_bytes,omitempty"`
+	Projected int64   `json:"projected_bytes,omitempty"`
+	Percent   float64 `json:"percent"`
+	State     string  `json:"state"` // ok, soft_exceeded, hard_exceeded
+}
+
+func newStatus(q *Quota, used int64) QuotaStatus {
+	s := QuotaStatus{Scope: q.Scope, Used: used, Soft: q.Soft, Hard: q.Hard}
+	if l := q.limit(); l > 0 {
+		s.Percent = float64(used) * 100 / float64(l)
+	}
+	s.classify(used)
+	return s
+}
+
+// classify sets State from current or projected usage.
+func (s *QuotaStatus) classify(projected int64) {
+	switch {
+	case s.Hard > 0 && projected > s.Hard:
+		s.State = "hard_exceeded"
+	case s.Soft > 0 && projected > s.Soft:
+		s.State = "soft_exceeded"
+	default:
+		s.State = "ok"
+	}
+}
+
+func validateQuota(q *Quota) error {
+	switch {
+	case q.Scope == scopeDefaultUser:
+	case strings.HasPrefix(q.Scope, scopeUser) && len(q.Scope) > len(scopeUser):
+	case strings.HasPrefix(q.Scope, scopeDir) && len(q.Scope) > len(scopeDir):
+		q.Scope = scopeDir + normalizePath(q.Scope[len(scopeDir):])
+	default:
+		return fmt.Errorf("scope must be user:<name>, user:* or dir:<path>")
+	}
+	if q.Soft < 0 || q.Hard < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if q.Soft == 0 && q.Hard == 0 {
+		return fmt.Errorf("soft_bytes or hard_bytes is required")
+	}
+	if q.Hard > 0 && q.Soft > q.Hard {
+		return fmt.Errorf("soft_bytes must not exceed hard_bytes")
+	}
+	return nil
+}
+
+type QuotaStore struct {
+	mu     sync.RWMutex
+	quotas map[string]*Quota
+	file   string
+
+	// Alert levels reached by users covered only by the user:* default.
+	// Kept in memory: after a restart a user already past a level is
+	// alerted once more.
+	defaultAlerts map[string]int
+}
+
+func NewQuotaStore(file string) (*QuotaStore, error) {
+	s := &QuotaStore{quotas: make(map[string]*Quota), file: file, defaultAlerts: make(map[string]int)}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var quotas []*Quota
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		return nil, err
+	}
+	for _, q := range quotas {
+		s.quotas[q.Scope] = q
+	}
+	return s, nil
+}
+
+func (s *QuotaStore) saveLocked() error {
+	quotas := make([]*Quota, 0, len(s.quotas))
+	for _, q := range s.quotas {
+		quotas = append(quotas, q)
+	}
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].Scope < quotas[j].Scope })
+
+	data, err := json.MarshalIndent(quotas, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0700); err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+func (s *QuotaStore) Put(q *Quota) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q.UpdatedAt = time.Now().UTC()
+	if old, ok := s.quotas[q.Scope]; ok {
+		q.AlertLevel = old.AlertLevel
+	}
+	s.quotas[q.Scope] = q
+	return s.saveLocked()
+}
+
+func (s *QuotaStore) Delete(scope string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.quotas[scope]; !ok {
+		return false, nil
+	}
+	delete(s.quotas, scope)
+	return true, s.saveLocked()
+}
+
+func (s *QuotaStore) List() []Quota {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]Quota, 0, len(s.quotas))
+	for _, q := range s.quotas {
+		out = append(out, *q)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Scope < out[j].Scope })
+	return out
+}
+
+// userQuota returns the quota for user, falling back to the user:* default.
+func (s *QuotaStore) userQuota(user string) (Quota, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if q, ok := s.quotas[scopeUser+user]; ok {
+		return *q, true
+	}
+	if q, ok := s.quotas[scopeDefaultUser]; ok {
+		c := *q
+		c.Scope = scopeUser + user
+		return c, true
+	}
+	return Quota{}, false
+}
+
+// dirQuotas returns the quotas on p and every directory above it.
+func (s *QuotaStore) dirQuotas(p string) []Quota {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []Quota
+	for cur := normalizePath(p); ; cur = path.Dir(cur) {
+		if q, ok := s.quotas[scopeDir+cur]; ok {
+			out = append(out, *q)
+		}
+		if cur == "/" {
+			break
+		}
+	}
+	return out
+}
+
+// Applicable returns the current status of every quota covering a write by
+// user to p.
+func (s *QuotaStore) Applicable(idx *UsageIndex, user, p string) []QuotaStatus {
+	var out []QuotaStatus
+	if user != "" {
+		if q, ok := s.userQuota(user); ok {
+			out = append(out, newStatus(&q, idx.UserUsage(user).Bytes))
+		}
+	}
+	for _, q := range s.dirQuotas(p) {
+		out = append(out, newStatus(&q, idx.DirUsage(q.Scope[len(scopeDir):]).Bytes))
+	}
+	return out
+}
+
+// CheckResult is returned by /api/v1/quota/check. Callers refuse the write
+// with 507 Insufficient Storage when Allowed is false.
+type CheckResult struct {
+	Allowed    bool          `json:"allowed"`
+	Path       string        `json:"path"`
+	User       string        `json:"user,omitempty"`
+	Bytes      int64         `json:"bytes"`
+	Quotas     []QuotaStatus `json:"quotas"`
+	Warnings   []string      `json:"warnings,omitempty"`
+	Violations []string      `json:"violations,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// Check projects usage after user writes bytes to p. When p already holds
+// a file, its current size is credited back since the write replaces it.
+func (s *QuotaStore) Check(idx *UsageIndex, user, p string, bytes int64) *CheckResult {
+	p = normalizePath(p)
+	delta := bytes - idx.SizeOf(p)
+
+	res := &CheckResult{Allowed: true, Path: p, User: user, Bytes: bytes, Quotas: []QuotaStatus{}}
+	for _, st := range s.Applicable(idx, user, p) {
+		st.Projected = st.Used + delta
+		st.classify(st.Projected)
+		switch st.State {
+		case "hard_exceeded":
+			res.Allowed = false
+			res.Violations = append(res.Violations, fmt.Sprintf("%s hard limit of %d bytes would be exceeded (%d used, %d requested)",
+				st.Scope, st.Hard, st.Used, bytes))
+		case "soft_exceeded":
+			res.Warnings = append(res.Warnings, fmt.Sprintf("%s soft limit of %d bytes exceeded", st.Scope, st.Soft))
+		}
+		res.Quotas = append(res.Quotas, st)
+	}
+	return res
+}
+
+// Alert describes a threshold crossing to report to notification-hub.
+type Alert struct {
+	Scope   string
+	Level   int
+	Status  QuotaStatus
+	Default bool // Raised against the user:* default quota
+}
+
+// UpdateAlerts compares each affected quota's usage with the alert levels
+// and returns the crossings that have not been reported yet. Per-user alert
+// state for the user:* default is tracked under the user's own scope.
+func (s *QuotaStore) UpdateAlerts(idx *UsageIndex, user, p string) []Alert {
+	var alerts []Alert
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	consider := func(q *Quota, used int64) {
+		st := newStatus(q, used)
+		level := 0
+		for _, l := range alertLevels {
+			if st.Percent >= float64(l) {
+				level = l
+			}
+		}
+		if level > q.AlertLevel {
+			alerts = append(alerts, Alert{Scope: q.Scope, Level: level, Status: st})
+		}
+		q.AlertLevel = level
+	}
+
+	if user != "" {
+		if q, ok := s.quotas[scopeUser+user]; ok {
+			consider(q, idx.UserUsage(user).Bytes)
+		} else if def, ok := s.quotas[scopeDefaultUser]; ok {
+			// Evaluate a per-user copy of the default so each user is
+			// alerted on their own usage
+			q := &Quota{Scope: scopeUser + user, Soft: def.Soft, Hard: def.Hard, AlertLevel: s.defaultAlerts[user]}
+			n := len(alerts)
+			consider(q, idx.UserUsage(user).Bytes)
+			if len(alerts) > n {
+				alerts[n].Default = true
+			}
+			if q.AlertLevel == 0 {
+				delete(s.defaultAlerts, user)
+			} else {
+				s.defaultAlerts[user] = q.AlertLevel
+			}
+		}
+	}
+	for cur := normalizePath(p); ; cur = path.Dir(cur) {
+		if q, ok := s.quotas[scopeDir+cur]; ok {
+			consider(q, idx.DirUsage(cur).Bytes)
+		}
+		if cur == "/" {
+			break
+		}
+	}
+
+	if err := s.saveLocked(); err != nil {
+		log.Printf("Failed to save alert state: %v", err)
+	}
+	return alerts
+}
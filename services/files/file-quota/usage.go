@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage is a byte and file count pair for one aggregate.
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+func (u *Usage) add(size int64, files int64) {
+	u.Bytes += size
+	u.Files += files
+}
+
+type fileEntry struct {
+	Size  int64
+	Owner string
+}
+
+// UsageIndex tracks the size and owner of every file under the storage root
+// and keeps per-user and per-directory totals up to date as file
+// services report changes. A periodic rescan reconciles anything written
+// behind the services' backs.
+type UsageIndex struct {
+	mu    sync.RWMutex
+	root  string
+	files map[string]*fileEntry
+	users map[string]*Usage
+	dirs  map[string]*Usage // Every ancestor directory, including "/"
+
+	ownersFile  string
+	ownersDirty bool
+	scannedAt   time.Time
+}
+
+// normalizePath maps a client path onto the canonical "/a/b" form, the same
+// keys file-permissions uses for ACLs.
+func normalizePath(p string) string {
+	return path.Clean("/" + filepath.ToSlash(p))
+}
+
+// fileType buckets a file by lower-cased extension.
+func fileType(p string) string {
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(p)), ".")
+	if ext == "" {
+		return "(none)"
+	}
+	return ext
+}
+
+func underPrefix(p, prefix string) bool {
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+func NewUsageIndex(root, ownersFile string) (*UsageIndex, error) {
+	idx := &UsageIndex{root: root, ownersFile: ownersFile}
+	idx.reset()
+
+	data, err := os.ReadFile(ownersFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var owners map[string]string
+		if err := json.Unmarshal(data, &owners); err != nil {
+			return nil, err
+		}
+		// Sizes are filled in by the first scan
+		for p, owner := range owners {
+			idx.files[p] = &fileEntry{Owner: owner}
+		}
+	}
+	return idx, nil
+}
+
+func (idx *UsageIndex) reset() {
+	idx.files = make(map[string]*fileEntry)
+	idx.users = make(map[string]*Usage)
+	idx.dirs = make(map[string]*Usage)
+}
+
+// applyLocked adds (sign=1) or removes (sign=-1) a file's contribution to
+// every aggregate it belongs to.
+func (idx *UsageIndex) applyLocked(p string, e *fileEntry, sign int64) {
+	bump := func(m map[string]*Usage, key string) {
+		u, ok := m[key]
+		if !ok {
+			u = &Usage{}
+			m[key] = u
+		}
+		u.add(sign*e.Size, sign)
+		if u.Files <= 0 {
+			delete(m, key)
+		}
+	}
+
+	if e.Owner != "" {
+		bump(idx.users, e.Owner)
+	}
+	for dir := path.Dir(p); ; dir = path.Dir(dir) {
+		bump(idx.dirs, dir)
+		if dir == "/" {
+			break
+		}
+	}
+}
+
+// Set records the current size of a file. An existing entry is replaced, so
+// overwrites only count the difference. The previous owner is kept when
+// owner is empty.
+func (idx *UsageIndex) Set(p string, size int64, owner string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	p = normalizePath(p)
+
+	if old, ok := idx.files[p]; ok {
+		idx.applyLocked(p, old, -1)
+		if owner == "" {
+			owner = old.Owner
+		}
+	}
+	e := &fileEntry{Size: size, Owner: owner}
+	idx.files[p] = e
+	idx.applyLocked(p, e, 1)
+	if owner != "" {
+		idx.ownersDirty = true
+	}
+}
+
+// Remove drops p and everything below it. It returns the bytes released.
+func (idx *UsageIndex) Remove(p string) int64 {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	p = normalizePath(p)
+
+	var freed int64
+	for key, e := range idx.files {
+		if underPrefix(key, p) {
+			idx.applyLocked(key, e, -1)
+			delete(idx.files, key)
+			freed += e.Size
+			if e.Owner != "" {
+				idx.ownersDirty = true
+			}
+		}
+	}
+	return freed
+}
+
+// Move re-keys p and everything below it to dst, keeping owners.
+func (idx *UsageIndex) Move(src, dst string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	src, dst = normalizePath(src), normalizePath(dst)
+
+	// Collect first: dst may lie under src
+	moved := map[string]*fileEntry{}
+	for key, e := range idx.files {
+		if underPrefix(key, src) {
+			idx.applyLocked(key, e, -1)
+			delete(idx.files, key)
+			moved[dst+strings.TrimPrefix(key, src)] = e
+		}
+	}
+	for key, e := range moved {
+		if old, ok := idx.files[key]; ok {
+			idx.applyLocked(key, old, -1)
+		}
+		idx.files[key] = e
+		idx.applyLocked(key, e, 1)
+	}
+	if len(moved) > 0 {
+		idx.ownersDirty = true
+	}
+}
+
+// SizeOf returns the indexed size of a single file, or 0 if unknown.
+func (idx *UsageIndex) SizeOf(p string) int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if e, ok := idx.files[normalizePath(p)]; ok {
+		return e.Size
+	}
+	return 0
+}
+
+func (idx *UsageIndex) UserUsage(user string) Usage {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if u, ok := idx.users[user]; ok {
+		return *u
+	}
+	return Usage{}
+}
+
+func (idx *UsageIndex) DirUsage(dir string) Usage {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	dir = normalizePath(dir)
+	if u, ok := idx.dirs[dir]; ok {
+		return *u
+	}
+	// A file path rather than a directory
+	if e, ok := idx.files[dir]; ok {
+		return Usage{Bytes: e.Size, Files: 1}
+	}
+	return Usage{}
+}
+
+// Rescan walks the storage root and rebuilds every aggregate from disk,
+// keeping known owners. Files that vanished are dropped; new files are
+// counted as unowned until a service reports who wrote them.
+func (idx *UsageIndex) Rescan() error {
+	sizes := make(map[string]int64)
+	err := filepath.WalkDir(idx.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable subtrees are skipped rather than aborting the scan
+			if d != nil && d.IsDir() && p != idx.root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			// Hidden directories (.meta, ...) are service state, not user data
+			if p != idx.root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(idx.root, p)
+		if err != nil {
+			return nil
+		}
+		sizes[normalizePath(rel)] = info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	old := idx.files
+	idx.reset()
+	for p, size := range sizes {
+		e := &fileEntry{Size: size}
+		if prev, ok := old[p]; ok {
+			e.Owner = prev.Owner
+		}
+		idx.files[p] = e
+		idx.applyLocked(p, e, 1)
+	}
+	if len(old) != len(idx.files) {
+		idx.ownersDirty = true
+	}
+	idx.scannedAt = time.Now().UTC()
+	return nil
+}
+
+// SaveOwners persists the path to owner map if it changed. Sizes are not
+// stored: they are recovered from disk by the startup scan.
+func (idx *UsageIndex) SaveOwners() error {
+	idx.mu.Lock()
+	if !idx.ownersDirty {
+		idx.mu.Unlock()
+		return nil
+	}
+	owners := make(map[string]string)
+	for p, e := range idx.files {
+		if e.Owner != "" {
+			owners[p] = e.Owner
+		}
+	}
+	idx.ownersDirty = false
+	idx.mu.Unlock()
+
+	data, err := json.Marshal(owners)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(idx.ownersFile), 0700); err != nil {
+		return err
+	}
+	tmp := idx.ownersFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, idx.ownersFile)
+}
+
+// Breakdown entries, largest first.
+type DirUsage struct {
+	Path string `json:"path"`
+	Usage
+}
+
+type TypeUsage struct {
+	Type string `json:"type"`
+	Usage
+}
+
+type UserUsage struct {
+	User string `json:"user"`
+	Usage
+}
+
+// UsageReport is the /api/v1/usage response.
+type UsageReport struct {
+	Path        string        `json:"path"`
+	User        string        `json:"user,omitempty"`
+	Total       Usage         `json:"total"`
+	ByDirectory []DirUsage    `json:"by_directory"`
+	ByType      []TypeUsage   `json:"by_type"`
+	ByUser      []UserUsage   `json:"by_user,omitempty"`
+	Quotas      []QuotaStatus `json:"quotas,omitempty"`
+	ScannedAt   time.Time     `json:"scanned_at"`
+}
+
+// Report breaks down usage below prefix by immediate child directory and by
+// file type, optionally restricted to files owned by user. Files sitting
+// directly in prefix are reported under prefix itself.
+func (idx *UsageIndex) Report(prefix, user string, withUsers bool) *UsageReport {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	prefix = normalizePath(prefix)
+
+	rep := &UsageReport{Path: prefix, User: user, ScannedAt: idx.scannedAt}
+	dirs := map[string]*Usage{}
+	types := map[string]*Usage{}
+	users := map[string]*Usage{}
+	bump := func(m map[string]*Usage, key string, size int64) {
+		u, ok := m[key]
+		if !ok {
+			u = &Usage{}
+			m[key] = u
+		}
+		u.add(size, 1)
+	}
+
+	for p, e := range idx.files {
+		if !underPrefix(p, prefix) || (user != "" && e.Owner != user) {
+			continue
+		}
+		rep.Total.add(e.Size, 1)
+
+		child := prefix
+		if rest := strings.TrimPrefix(strings.TrimPrefix(p, prefix), "/"); strings.Contains(rest, "/") {
+			child = path.Join(prefix, rest[:strings.Index(rest, "/")])
+		}
+		bump(dirs, child, e.Size)
+		bump(types, fileType(p), e.Size)
+		if withUsers {
+			owner := e.Owner
+			if owner == "" {
+				owner = "(unowned)"
+			}
+			bump(users, owner, e.Size)
+		}
+	}
+
+	for k, u := range dirs {
+		rep.ByDirectory = append(rep.ByDirectory, DirUsage{Path: k, Usage: *u})
+	}
+	for k, u := range types {
+		rep.ByType = append(rep.ByType, TypeUsage{Type: k, Usage: *u})
+	}
+	for k, u := range users {
+		rep.ByUser = append(rep.ByUser, UserUsage{User: k, Usage: *u})
+	}
+	sort.Slice(rep.ByDirectory, func(i, j int) bool { return rep.ByDirectory[i].Bytes > rep.ByDirectory[j].Bytes })
+	sort.Slice(rep.ByType, func(i, j int) bool { return rep.ByType[i].Bytes > rep.ByType[j].Bytes })
+	sort.Slice(rep.ByUser, func(i, j int) bool { return rep.ByUser[i].Bytes > rep.ByUser[j].Bytes })
+	if rep.ByDirectory == nil {
+		rep.ByDirectory = []DirUsage{}
+	}
+	if rep.ByType == nil {
+		rep.ByType = []TypeUsage{}
+	}
+	return rep
+}
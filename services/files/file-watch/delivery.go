@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/holm/eventsdk"
+)
+
+const (
+	deliveryWebhook = "webhook"
+	deliveryNATS    = "nats"
+
+	maxWebhookAttempts = 5
+	initialBackoff     = time.Second
+
+	defaultDeliveryWorkers = 8
+	defaultDeliveryQueue   = 1000
+)
+
+var (
+	events *eventsdk.Client
+
+	webhooksSent    uint64
+	webhooksFailed  uint64
+	webhookRetries  uint64
+	natsPublished   uint64
+	natsPublishFail uint64
+	droppedEvents   uint64
+
+	httpClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+func initNATS() {
+	natsURL := os.Getenv("NATS_URL")
+	if natsURL == "" {
+		natsURL = "nats://event-broker:4222"
+	}
+
+	var err error
+	events, err = eventsdk.Connect(natsURL, "file-watch")
+	if err != nil {
+		log.Printf("Warning: NATS unavailable at %s, nats delivery disabled: %v", natsURL, err)
+		events = nil
+		return
+	}
+	log.Printf("NATS connected: %s", natsURL)
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type delivery struct {
+	cfg     WatchConfig
+	payload WebhookPayload
+}
+
+// deliveries feeds a fixed pool of workers, so a slow or failing callback
+// retrying with backoff ties up a worker rather than a new goroutine per
+// event.
+var deliveries chan delivery
+
+// startDeliveryWorkers starts DELIVERY_WORKERS workers behind a queue of
+// DELIVERY_QUEUE events.
+func startDeliveryWorkers() {
+	workers := envInt("DELIVERY_WORKERS", defaultDeliveryWorkers)
+	deliveries = make(chan delivery, envInt("DELIVERY_QUEUE", defaultDeliveryQueue))
+	for i := 0; i < workers; i++ {
+		go func() {
+			for d := range deliveries {
+				deliver(d.cfg, d.payload)
+			}
+		}()
+	}
+	log.Printf("Delivering events with %d workers, queue of %d", workers, cap(deliveries))
+}
+
+func envInt(key string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// enqueue hands a payload to the delivery workers, dropping it when the
+// queue is full.
+func enqueue(cfg WatchConfig, payload WebhookPayload) {
+	select {
+	case deliveries <- delivery{cfg: cfg, payload: payload}:
+	default:
+		atomic.AddUint64(&droppedEvents, 1)
+		log.Printf("Delivery queue full, dropping %s event for %s", payload.Event, payload.Path)
+	}
+}
+
+// deliver routes a payload to the watch's configured destination.
+func deliver(cfg WatchConfig, payload WebhookPayload) {
+	if cfg.Delivery == deliveryNATS {
+		publishEvent(payload)
+		return
+	}
+	sendWebhook(cfg.CallbackURL, cfg.Secret, payload)
+}
+
+// publishEvent emits the payload as a files.<event> CloudEvent, so it is
+// stored in the EVENTS stream and can be replayed like any other event.
+func publishEvent(payload WebhookPayload) {
+	if events == nil {
+		atomic.AddUint64(&natsPublishFail, 1)
+		log.Printf("Dropping %s event for %s: NATS not connected", payload.Event, payload.Path)
+		return
+	}
+
+	if _, err := events.Emit(context.Background(), "files."+payload.Event, payload.Path, payload); err != nil {
+		atomic.AddUint64(&natsPublishFail, 1)
+		log.Printf("Failed to publish file event: %v", err)
+		return
+	}
+	atomic.AddUint64(&natsPublished, 1)
+}
+
+// signPayload returns the HMAC-SHA256 signature over "<timestamp>.<body>".
+// Including the timestamp lets receivers reject replayed deliveries.
+func signPayload(secret, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// sendWebhook POSTs the payload, retrying with exponential backoff on
+// network errors, 429 and 5xx responses. Other 4xx responses are treated as
+// permanent failures.
+func sendWebhook(callbackURL, secret string, payload WebhookPayload) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to marshal webhook payload: %v", err)
+		return
+	}
+
+	deliveryID := newDeliveryID()
+	backoff := initialBackoff
+
+	for attempt := 1; attempt <= maxWebhookAttempts; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(data))
+		if err != nil {
+			log.Printf("Invalid webhook URL %s: %v", callbackURL, err)
+			atomic.AddUint64(&webhooksFailed, 1)
+			return
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Holm-Delivery", deliveryID)
+		req.Header.Set("X-Holm-Event", payload.Event)
+		req.Header.Set("X-Holm-Attempt", strconv.Itoa(attempt))
+		req.Header.Set("X-Holm-Timestamp", timestamp)
+		if secret != "" {
+			req.Header.Set("X-Holm-Signature-256", signPayload(secret, timestamp, data))
+		}
+
+		resp, err := httpClient.Do(req)
+		retryable := true
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				atomic.AddUint64(&webhooksSent, 1)
+				log.Printf("Webhook sent to %s for event %s on %s, status: %d",
+					callbackURL, payload.Event, payload.Path, resp.StatusCode)
+				return
+			}
+			retryable = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+
+		if !retryable || attempt == maxWebhookAttempts {
+			atomic.AddUint64(&webhooksFailed, 1)
+			log.Printf("Failed to send webhook to %s after %d attempt(s): %v", callbackURL, attempt, err)
+			return
+		}
+
+		atomic.AddUint64(&webhookRetries, 1)
+		log.Printf("Webhook to %s failed (attempt %d/%d): %v, retrying in %s",
+			callbackURL, attempt, maxWebhookAttempts, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// PathFilter applies include/exclude globs to paths relative to a watch root.
+// Patterns use filepath.Match syntax plus "**" to span directories. A pattern
+// without a slash is matched against the base name only, so "*.tmp" excludes
+// temp files at any depth.
+type PathFilter struct {
+	include []globPattern
+	exclude []globPattern
+}
+
+type globPattern struct {
+	re       *regexp.Regexp
+	baseOnly bool
+}
+
+func (g globPattern) match(relPath string) bool {
+	if g.baseOnly {
+		return g.re.MatchString(filepath.Base(relPath))
+	}
+	return g.re.MatchString(relPath)
+}
+
+func NewPathFilter(include, exclude []string) (*PathFilter, error) {
+	f := &PathFilter{}
+	for _, p := range include {
+		g, err := compileGlob(p)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, g)
+	}
+	for _, p := range exclude {
+		g, err := compileGlob(p)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, g)
+	}
+	return f, nil
+}
+
+// Match reports whether relPath passes the filter. Excludes win over
+// includes; with no includes every path not excluded passes.
+func (f *PathFilter) Match(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	if f.Excluded(relPath) {
+		return false
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, g := range f.include {
+		if g.match(relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Excluded reports whether relPath matches an exclude pattern. Recursive
+// watches use it to skip whole directories such as node_modules or .git.
+func (f *PathFilter) Excluded(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	for _, g := range f.exclude {
+		if g.match(relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileGlob(pattern string) (globPattern, error) {
+	// Validate with the standard matcher first so syntax errors read the same
+	// as filepath.Match's
+	if _, err := filepath.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+		return globPattern{}, err
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					// "**/" matches zero or more directories
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(pattern[i:], ']')
+			if j < 0 {
+				b.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := pattern[i+1 : i+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += j
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return globPattern{}, err
+	}
+	return globPattern{re: re, baseOnly: !strings.Contains(pattern, "/")}, nil
+}
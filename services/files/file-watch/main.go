@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -9,6 +8,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -17,50 +17,110 @@ import (
 const dataPath = "/data"
 
 type WatchRequest struct {
-	Path        string `json:"path"`
-	CallbackURL string `json:"callback_url"`
+	Path        string   `json:"path"`
+	CallbackURL string   `json:"callback_url"`
+	Delivery    string   `json:"delivery,omitempty"`    // "webhook" (default) or "nats"
+	Secret      string   `json:"secret,omitempty"`      // HMAC key for webhook signatures
+	Recursive   bool     `json:"recursive,omitempty"`   // Also watch subdirectories
+	Include     []string `json:"include,omitempty"`     // Glob patterns to report
+	Exclude     []string `json:"exclude,omitempty"`     // Glob patterns to ignore
+	DebounceMs  int      `json:"debounce_ms,omitempty"` // Coalescing window, negative disables
+}
+
+// WatchConfig is a registered watch as persisted to the state file.
+type WatchConfig struct {
+	WatchRequest
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type WatchInfo struct {
 	Path        string    `json:"path"`
-	CallbackURL string    `json:"callback_url"`
+	CallbackURL string    `json:"callback_url,omitempty"`
+	Delivery    string    `json:"delivery"`
+	Signed      bool      `json:"signed"`
+	Recursive   bool      `json:"recursive"`
+	Include     []string  `json:"include,omitempty"`
+	Exclude     []string  `json:"exclude,omitempty"`
+	DebounceMs  int       `json:"debounce_ms"`
+	Directories int       `json:"directories"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
 type WebhookPayload struct {
-	Path      string `json:"path"`
-	Event     string `json:"event"`
-	FileName  string `json:"file_name"`
-	Timestamp string `json:"timestamp"`
+	Path      string   `json:"path"`
+	Event     string   `json:"event"`
+	FileName  string   `json:"file_name"`
+	Timestamp string   `json:"timestamp"`
+	WatchPath string   `json:"watch_path"`
+	IsDir     bool     `json:"is_dir,omitempty"`
+	Ops       []string `json:"ops,omitempty"`   // Raw operations coalesced into this event
+	Count     int      `json:"count,omitempty"` // Number of raw events coalesced
 }
 
+const defaultDebounce = 500 * time.Millisecond
+
 type WatchRegistry struct {
-	mu      sync.RWMutex
-	watches map[string]*WatchEntry
-	watcher *fsnotify.Watcher
+	mu        sync.RWMutex
+	watches   map[string]*WatchEntry
+	dirRefs   map[string]int // fsnotify watches shared between overlapping entries
+	watcher   *fsnotify.Watcher
+	statePath string
+	saveMu    sync.Mutex // Serializes persist, so the newest watch set is saved last
 }
 
 type WatchEntry struct {
-	Info WatchInfo
+	Config WatchConfig
+	root   string
+	filter *PathFilter
+	dirs   map[string]bool
+
+	mu       sync.Mutex
+	pending  map[string]*pendingEvent
+	order    []string
+	timer    *time.Timer
+	debounce time.Duration
+	stopped  bool // Removed or replaced; nothing more is delivered
+}
+
+type pendingEvent struct {
+	ops   []string
+	isDir bool
 }
 
 var registry *WatchRegistry
 
-func NewWatchRegistry() (*WatchRegistry, error) {
+func NewWatchRegistry(statePath string) (*WatchRegistry, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
 	}
 
 	r := &WatchRegistry{
-		watches: make(map[string]*WatchEntry),
-		watcher: watcher,
+		watches:   make(map[string]*WatchEntry),
+		dirRefs:   make(map[string]int),
+		watcher:   watcher,
+		statePath: statePath,
 	}
 
 	go r.eventLoop()
 	return r, nil
 }
 
+// Restore re-registers the watches saved by a previous run.
+func (r *WatchRegistry) Restore() {
+	configs, err := loadWatches(r.statePath)
+	if err != nil {
+		log.Printf("Warning: Could not load saved watches: %v", err)
+		return
+	}
+	for _, cfg := range configs {
+		if err := r.addWatch(cfg); err != nil {
+			log.Printf("Warning: Could not restore watch %s: %v", cfg.Path, err)
+		}
+	}
+	log.Printf("Restored %d of %d saved watches", len(r.ListWatches()), len(configs))
+}
+
 func (r *WatchRegistry) eventLoop() {
 	for {
 		select {
@@ -78,17 +138,201 @@ func (r *WatchRegistry) eventLoop() {
 	}
 }
 
+func isUnder(path, root string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
 func (r *WatchRegistry) handleEvent(event fsnotify.Event) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info, statErr := os.Stat(event.Name)
+	isDir := statErr == nil && info.IsDir()
+
+	// A removed or renamed directory takes its fsnotify watch with it
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		for _, entry := range r.watches {
+			for dir := range entry.dirs {
+				if dir != entry.root && isUnder(dir, event.Name) {
+					delete(entry.dirs, dir)
+					r.releaseDir(dir)
+				}
+			}
+		}
+	}
 
 	// Find matching watch entries
-	for watchPath, entry := range r.watches {
-		// Check if the event path is under the watched path
-		if strings.HasPrefix(event.Name, watchPath) || event.Name == watchPath {
-			go sendWebhook(entry.Info.CallbackURL, event, watchPath)
+	for _, entry := range r.watches {
+		if !isUnder(event.Name, entry.root) {
+			continue
+		}
+		// Non-recursive watches only see the directory's direct children
+		if !entry.Config.Recursive && event.Name != entry.root && filepath.Dir(event.Name) != entry.root {
+			continue
+		}
+
+		rel, _ := filepath.Rel(entry.root, event.Name)
+		if entry.Config.Recursive && isDir && event.Op&fsnotify.Create != 0 && !entry.filter.Excluded(rel) {
+			// Follow the new subdirectory, reporting anything that was
+			// created inside it before the watch was in place
+			r.addTree(entry, event.Name, true)
+		}
+
+		if event.Name != entry.root && !entry.filter.Match(rel) {
+			continue
+		}
+		entry.queue(event.Name, eventTypeString(event.Op), isDir)
+	}
+}
+
+// addTree registers fsnotify watches for dir and, for recursive entries, all
+// of its subdirectories. With announce set, entries found below dir are
+// queued as create events.
+func (r *WatchRegistry) addTree(entry *WatchEntry, dir string, announce bool) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The tree may change underneath us; skip what vanished
+			return nil
+		}
+		rel, _ := filepath.Rel(entry.root, p)
+		if p != entry.root && entry.filter.Excluded(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if announce && p != dir && entry.filter.Match(rel) {
+			entry.queue(p, "create", info.IsDir())
+		}
+		if !info.IsDir() {
+			return nil
 		}
+		if !entry.dirs[p] {
+			if err := r.retainDir(p); err != nil {
+				return err
+			}
+			entry.dirs[p] = true
+		}
+		if !entry.Config.Recursive && p == entry.root {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+func (r *WatchRegistry) retainDir(dir string) error {
+	if r.dirRefs[dir] == 0 {
+		if err := r.watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+	r.dirRefs[dir]++
+	return nil
+}
+
+func (r *WatchRegistry) releaseDir(dir string) {
+	r.dirRefs[dir]--
+	if r.dirRefs[dir] <= 0 {
+		r.watcher.Remove(dir)
+		delete(r.dirRefs, dir)
+	}
+}
+
+// queue records a raw event and schedules a flush once the debounce window
+// has passed. Bursts on the same path collapse into a single delivery.
+func (e *WatchEntry) queue(name, op string, isDir bool) {
+	if e.debounce <= 0 {
+		enqueue(e.Config, e.payload(name, []string{op}, isDir))
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	p, ok := e.pending[name]
+	if !ok {
+		p = &pendingEvent{}
+		e.pending[name] = p
+		e.order = append(e.order, name)
+	}
+	p.ops = append(p.ops, op)
+	p.isDir = p.isDir || isDir
+
+	if e.timer == nil {
+		e.timer = time.AfterFunc(e.debounce, e.flush)
+	}
+}
+
+func (e *WatchEntry) flush() {
+	e.mu.Lock()
+	if e.stopped {
+		e.mu.Unlock()
+		return
+	}
+	pending, order := e.pending, e.order
+	e.pending = make(map[string]*pendingEvent)
+	e.order = nil
+	e.timer = nil
+	cfg := e.Config
+	e.mu.Unlock()
+
+	for _, name := range order {
+		p := pending[name]
+		enqueue(cfg, e.payload(name, p.ops, p.isDir))
+	}
+}
+
+// stop cancels the debounce timer and returns the events it was holding.
+func (e *WatchEntry) stop() (map[string]*pendingEvent, []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	e.stopped = true
+	pending, order := e.pending, e.order
+	e.pending = make(map[string]*pendingEvent)
+	e.order = nil
+	return pending, order
+}
+
+func (e *WatchEntry) payload(name string, ops []string, isDir bool) WebhookPayload {
+	relPath, _ := filepath.Rel(dataPath, name)
+	payload := WebhookPayload{
+		Path:      relPath,
+		Event:     coalesceOps(ops),
+		FileName:  filepath.Base(name),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		WatchPath: e.Config.Path,
+		IsDir:     isDir,
+	}
+	if len(ops) > 1 {
+		payload.Ops = ops
+		payload.Count = len(ops)
 	}
+	return payload
+}
+
+// coalesceOps reduces a burst of operations on one path to the event that
+// describes its end state: a file created then written is a "create", and
+// anything that ends in a remove is a "remove".
+func coalesceOps(ops []string) string {
+	last := ops[len(ops)-1]
+	if last == "remove" || last == "rename" {
+		return last
+	}
+	for _, op := range ops {
+		if op == "create" {
+			return "create"
+		}
+	}
+	for _, op := range ops {
+		if op == "write" {
+			return "write"
+		}
+	}
+	return last
 }
 
 func eventTypeString(op fsnotify.Op) string {
@@ -108,49 +352,32 @@ func eventTypeString(op fsnotify.Op) string {
 	}
 }
 
-func sendWebhook(callbackURL string, event fsnotify.Event, watchPath string) {
-	relPath, _ := filepath.Rel(dataPath, event.Name)
-
-	payload := WebhookPayload{
-		Path:      relPath,
-		Event:     eventTypeString(event.Op),
-		FileName:  filepath.Base(event.Name),
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
-	}
-
-	data, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Failed to marshal webhook payload: %v", err)
-		return
-	}
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Post(callbackURL, "application/json", bytes.NewReader(data))
-	if err != nil {
-		log.Printf("Failed to send webhook to %s: %v", callbackURL, err)
-		return
+func (r *WatchRegistry) AddWatch(req WatchRequest) error {
+	if err := r.addWatch(WatchConfig{WatchRequest: req, CreatedAt: time.Now()}); err != nil {
+		return err
 	}
-	defer resp.Body.Close()
-
-	log.Printf("Webhook sent to %s for event %s on %s, status: %d",
-		callbackURL, payload.Event, payload.Path, resp.StatusCode)
+	r.persist()
+	return nil
 }
 
-func (r *WatchRegistry) AddWatch(path, callbackURL string) error {
+func (r *WatchRegistry) addWatch(cfg WatchConfig) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	// Sanitize and build full path
-	cleanPath := filepath.Clean(path)
+	cleanPath := filepath.Clean(cfg.Path)
 	if strings.Contains(cleanPath, "..") {
 		return os.ErrInvalid
 	}
 	fullPath := filepath.Join(dataPath, cleanPath)
 
-	if _, exists := r.watches[fullPath]; exists {
-		// Update callback URL if already watching
-		r.watches[fullPath].Info.CallbackURL = callbackURL
-		return nil
+	if cfg.Delivery == "" {
+		cfg.Delivery = deliveryWebhook
+	}
+
+	filter, err := NewPathFilter(cfg.Include, cfg.Exclude)
+	if err != nil {
+		return err
 	}
 
 	// Verify path exists
@@ -158,44 +385,116 @@ func (r *WatchRegistry) AddWatch(path, callbackURL string) error {
 		return err
 	}
 
-	if err := r.watcher.Add(fullPath); err != nil {
-		return err
+	var carried map[string]*pendingEvent
+	var carriedOrder []string
+	if existing, exists := r.watches[fullPath]; exists {
+		// Replace the existing watch with the new settings, handing the
+		// events it was still debouncing to the new one
+		carried, carriedOrder = existing.stop()
+		for dir := range existing.dirs {
+			r.releaseDir(dir)
+		}
+		cfg.CreatedAt = existing.Config.CreatedAt
+		delete(r.watches, fullPath)
 	}
 
-	r.watches[fullPath] = &WatchEntry{
-		Info: WatchInfo{
-			Path:        path,
-			CallbackURL: callbackURL,
-			CreatedAt:   time.Now(),
-		},
+	debounce := defaultDebounce
+	if cfg.DebounceMs > 0 {
+		debounce = time.Duration(cfg.DebounceMs) * time.Millisecond
+	} else if cfg.DebounceMs < 0 {
+		debounce = 0
 	}
 
-	log.Printf("Started watching: %s -> %s", path, callbackURL)
+	entry := &WatchEntry{
+		Config:   cfg,
+		root:     fullPath,
+		filter:   filter,
+		dirs:     make(map[string]bool),
+		pending:  make(map[string]*pendingEvent),
+		debounce: debounce,
+	}
+	if err := r.addTree(entry, fullPath, false); err != nil {
+		for dir := range entry.dirs {
+			r.releaseDir(dir)
+		}
+		return err
+	}
+	r.watches[fullPath] = entry
+	for _, name := range carriedOrder {
+		p := carried[name]
+		for _, op := range p.ops {
+			entry.queue(name, op, p.isDir)
+		}
+	}
+
+	log.Printf("Started watching: %s -> %s (recursive=%v, dirs=%d)",
+		cfg.Path, deliveryTarget(cfg), cfg.Recursive, len(entry.dirs))
 	return nil
 }
 
+func deliveryTarget(cfg WatchConfig) string {
+	if cfg.Delivery == deliveryNATS {
+		return "nats events.files.*"
+	}
+	return cfg.CallbackURL
+}
+
 func (r *WatchRegistry) RemoveWatch(path string) error {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 
 	cleanPath := filepath.Clean(path)
 	fullPath := filepath.Join(dataPath, cleanPath)
 
-	if _, exists := r.watches[fullPath]; exists {
-		r.watcher.Remove(fullPath)
+	if entry, exists := r.watches[fullPath]; exists {
+		entry.stop()
+		for dir := range entry.dirs {
+			r.releaseDir(dir)
+		}
 		delete(r.watches, fullPath)
 		log.Printf("Stopped watching: %s", path)
 	}
+	r.mu.Unlock()
+
+	r.persist()
 	return nil
 }
 
+// persist saves the current watch set so it survives a restart.
+func (r *WatchRegistry) persist() {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	r.mu.RLock()
+	configs := make([]WatchConfig, 0, len(r.watches))
+	for _, entry := range r.watches {
+		configs = append(configs, entry.Config)
+	}
+	r.mu.RUnlock()
+
+	if err := saveWatches(r.statePath, configs); err != nil {
+		log.Printf("Warning: Could not save watches: %v", err)
+	}
+}
+
 func (r *WatchRegistry) ListWatches() []WatchInfo {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
 	watches := make([]WatchInfo, 0, len(r.watches))
 	for _, entry := range r.watches {
-		watches = append(watches, entry.Info)
+		cfg := entry.Config
+		watches = append(watches, WatchInfo{
+			Path:        cfg.Path,
+			CallbackURL: cfg.CallbackURL,
+			Delivery:    cfg.Delivery,
+			Signed:      cfg.Secret != "",
+			Recursive:   cfg.Recursive,
+			Include:     cfg.Include,
+			Exclude:     cfg.Exclude,
+			DebounceMs:  int(entry.debounce / time.Millisecond),
+			Directories: len(entry.dirs),
+			CreatedAt:   cfg.CreatedAt,
+		})
 	}
 	return watches
 }
@@ -218,12 +517,29 @@ func handleAddWatch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Path == "" || req.CallbackURL == "" {
-		http.Error(w, "path and callback_url are required", http.StatusBadRequest)
+	if req.Path == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
 		return
 	}
 
-	if err := registry.AddWatch(req.Path, req.CallbackURL); err != nil {
+	switch req.Delivery {
+	case "", deliveryWebhook:
+		if req.CallbackURL == "" {
+			http.Error(w, "callback_url is required for webhook delivery", http.StatusBadRequest)
+			return
+		}
+	case deliveryNATS:
+	default:
+		http.Error(w, "delivery must be 'webhook' or 'nats'", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := NewPathFilter(req.Include, req.Exclude); err != nil {
+		http.Error(w, "Invalid filter pattern: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := registry.AddWatch(req); err != nil {
 		if os.IsNotExist(err) {
 			http.Error(w, "Path not found: "+req.Path, http.StatusNotFound)
 			return
@@ -290,20 +606,48 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"service":         "file-watch",
+		"watches":         len(registry.ListWatches()),
+		"webhooks_sent":   atomic.LoadUint64(&webhooksSent),
+		"webhooks_failed": atomic.LoadUint64(&webhooksFailed),
+		"webhook_retries": atomic.LoadUint64(&webhookRetries),
+		"nats_published":  atomic.LoadUint64(&natsPublished),
+		"nats_failed":     atomic.LoadUint64(&natsPublishFail),
+		"nats_connected":  events != nil && events.IsConnected(),
+		"queued":          len(deliveries),
+		"dropped":         atomic.LoadUint64(&droppedEvents),
+	})
+}
+
 func main() {
 	if err := os.MkdirAll(dataPath, 0755); err != nil {
 		log.Printf("Warning: Could not create data directory: %v", err)
 	}
 
+	initNATS()
+	startDeliveryWorkers()
+
+	// Watches carry webhook secrets, so they are kept off the shared
+	// data volume where other file services could read them
+	statePath := os.Getenv("WATCH_STATE_FILE")
+	if statePath == "" {
+		statePath = "/state/watches.json"
+	}
+
 	var err error
-	registry, err = NewWatchRegistry()
+	registry, err = NewWatchRegistry(statePath)
 	if err != nil {
 		log.Fatalf("Failed to create watch registry: %v", err)
 	}
+	registry.Restore()
 
 	http.HandleFunc("/watch", handleWatch)
 	http.HandleFunc("/watches", handleWatches)
 	http.HandleFunc("/health", handleHealth)
+	http.HandleFunc("/metrics", handleMetrics)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// loadWatches reads the persisted watch configs. A missing file is not an
+// error: it just means nothing has been registered yet.
+func loadWatches(path string) ([]WatchConfig, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var configs []WatchConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// saveWatches writes the configs via a temp file and rename so a crash
+// mid-write never leaves a truncated state file behind. The temp file name
+// is fixed, so callers must not save concurrently.
+func saveWatches(path string, configs []WatchConfig) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	// Secrets are stored here, so keep the file private
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,144 @@
+package filesdk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Rights checked with file-permissions.
+const (
+	RightRead   = "read"
+	RightWrite  = "write"
+	RightShare  = "share"
+	RightDelete = "delete"
+)
+
+// ACL enforces file-permissions' ACLs in a file service. ACL_MODE selects
+// "enforce" (deny on missing rights), "audit" (log but allow) or "off". It
+// defaults to enforce when PERMISSIONS_URL is set and off otherwise.
+type ACL struct {
+	url    string
+	mode   string
+	client *http.Client
+}
+
+// NewACL configures ACL checks from the environment.
+func NewACL() *ACL {
+	a := &ACL{
+		url:    strings.TrimSuffix(os.Getenv("PERMISSIONS_URL"), "/"),
+		mode:   os.Getenv("ACL_MODE"),
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+	if a.mode == "" {
+		a.mode = "off"
+		if a.url != "" {
+			a.mode = "enforce"
+		}
+	}
+	if a.mode != "off" && a.url == "" {
+		log.Printf("Warning: ACL_MODE=%s but PERMISSIONS_URL is not set, disabling ACL checks", a.mode)
+		a.mode = "off"
+	}
+	if a.mode != "off" && serviceToken == "" {
+		log.Printf("Warning: FILE_SERVICE_TOKEN is not set, new paths will not be given an owner")
+	}
+	log.Printf("ACL mode: %s", a.mode)
+	return a
+}
+
+func (a *ACL) request(r *http.Request, endpoint string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.url+endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	forward(r, req)
+	return a.client.Do(req)
+}
+
+// Authorize checks that the caller holds right on p. It returns 0 when the
+// operation may proceed, otherwise the HTTP status and message to send back.
+// When file-permissions cannot be reached, enforce mode fails closed.
+func (a *ACL) Authorize(r *http.Request, p, right string) (int, string) {
+	if a.mode == "off" {
+		return 0, ""
+	}
+
+	status, msg := a.check(r, CleanPath(p), right)
+	if status == 0 {
+		return 0, ""
+	}
+	if a.mode == "audit" {
+		log.Printf("ACL audit: would deny %s on %s: %s", right, CleanPath(p), msg)
+		return 0, ""
+	}
+	return status, msg
+}
+
+func (a *ACL) check(r *http.Request, p, right string) (int, string) {
+	resp, err := a.request(r, "/acl/check", map[string]string{"path": p, "right": right})
+	if err != nil {
+		log.Printf("ACL check failed: %v", err)
+		return http.StatusServiceUnavailable, "permission service unavailable"
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Allowed bool   `json:"allowed"`
+		Error   string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return http.StatusUnauthorized, "authentication required"
+	case resp.StatusCode != http.StatusOK:
+		return http.StatusServiceUnavailable, fmt.Sprintf("permission check failed: %s", result.Error)
+	case !result.Allowed:
+		return http.StatusForbidden, fmt.Sprintf("%s permission denied on %s", right, p)
+	}
+	return 0, ""
+}
+
+// Claimed makes the caller the owner of p, which the calling service has
+// just created.
+func (a *ACL) Claimed(r *http.Request, p string) {
+	a.notify(r, "/acl/claim", map[string]string{"path": CleanPath(p)})
+}
+
+// Moved carries the ACLs of src and everything below it over to dst.
+func (a *ACL) Moved(r *http.Request, src, dst string) {
+	a.notify(r, "/acl/move", map[string]string{"source": CleanPath(src), "dest": CleanPath(dst)})
+}
+
+// Deleted drops the ACLs of p and everything below it.
+func (a *ACL) Deleted(r *http.Request, p string) {
+	a.notify(r, "/acl/forget", map[string]string{"path": CleanPath(p)})
+}
+
+// notify tells file-permissions about a completed change. Failures are
+// logged only: the file operation already succeeded.
+func (a *ACL) notify(r *http.Request, endpoint string, body interface{}) {
+	if a.mode == "off" {
+		return
+	}
+	resp, err := a.request(r, endpoint, body)
+	if err != nil {
+		log.Printf("ACL update %s failed: %v", endpoint, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("ACL update %s returned status %d", endpoint, resp.StatusCode)
+	}
+}
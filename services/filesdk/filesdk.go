@@ -0,0 +1,49 @@
+// Package filesdk is what the file services share: checking rights with
+// file-permissions and quotas with file-quota, keeping file-meta's sidecar
+// in step, resolving callers through auth-gateway, and telling each other
+// which service is calling.
+package filesdk
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// ServiceTokenHeader carries FILE_SERVICE_TOKEN on calls between file
+// services. It marks a request as coming from a file service rather than
+// straight from a user, who only ever has their own credentials.
+const ServiceTokenHeader = "X-Holm-Service-Token"
+
+var serviceToken = os.Getenv("FILE_SERVICE_TOKEN")
+
+// CleanPath converts a storage-relative path into the "/a/b" form ACLs and
+// usage are keyed by, independent of where each service mounts storage.
+func CleanPath(p string) string {
+	return path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+}
+
+// forward copies the caller's credentials onto req, so the service called
+// sees the end user, and adds the service token.
+func forward(r, req *http.Request) {
+	if r != nil {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		if cookie, err := r.Cookie("holmos_token"); err == nil {
+			req.AddCookie(cookie)
+		}
+	}
+	if serviceToken != "" {
+		req.Header.Set(ServiceTokenHeader, serviceToken)
+	}
+}
+
+// FromService reports whether r carries this deployment's service token.
+func FromService(r *http.Request) bool {
+	got := r.Header.Get(ServiceTokenHeader)
+	return serviceToken != "" && got != "" &&
+		subtle.ConstantTimeCompare([]byte(got), []byte(serviceToken)) == 1
+}
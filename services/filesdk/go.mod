@@ -0,0 +1,3 @@
+module github.com/holm/filesdk
+
+go 1.21
@@ -0,0 +1,130 @@
+package filesdk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const identityCacheTTL = 60 * time.Second
+
+var (
+	authGatewayURL = "http://auth-gateway.holm.svc.cluster.local"
+	authClient     = &http.Client{Timeout: 5 * time.Second}
+
+	identityCache   = make(map[string]cachedIdentity)
+	identityCacheMu sync.Mutex
+)
+
+// ErrInvalidToken is returned for a token auth-gateway rejects.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Identity is the caller as resolved by auth-gateway. Service is set when
+// a file service made the call on the user's behalf.
+type Identity struct {
+	UserID   int    `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Role     string `json:"role,omitempty"`
+	Service  bool   `json:"service,omitempty"`
+}
+
+func (id Identity) Authenticated() bool { return id.Username != "" }
+
+func (id Identity) IsAdmin() bool { return id.Role == "admin" }
+
+type cachedIdentity struct {
+	identity Identity
+	expires  time.Time
+}
+
+func init() {
+	if u := os.Getenv("AUTH_GATEWAY_URL"); u != "" {
+		authGatewayURL = strings.TrimSuffix(u, "/")
+	}
+}
+
+func extractToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if cookie, err := r.Cookie("holmos_token"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// ResolveIdentity validates the caller's token with auth-gateway. Requests
+// without a token resolve to the anonymous identity. Results are cached
+// briefly because every file operation checks permissions.
+func ResolveIdentity(r *http.Request) (Identity, error) {
+	id, err := resolveUser(r)
+	id.Service = FromService(r)
+	return id, err
+}
+
+func resolveUser(r *http.Request) (Identity, error) {
+	token := extractToken(r)
+	if token == "" {
+		return Identity{}, nil
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	identityCacheMu.Lock()
+	if c, ok := identityCache[key]; ok && time.Now().Before(c.expires) {
+		identityCacheMu.Unlock()
+		return c.identity, nil
+	}
+	identityCacheMu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, authGatewayURL+"/api/validate", nil)
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := authClient.Do(req)
+	if err != nil {
+		return Identity{}, fmt.Errorf("auth-gateway unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var v struct {
+		Valid    bool   `json:"valid"`
+		UserID   int    `json:"user_id"`
+		Username string `json:"username"`
+		Role     string `json:"role"`
+		Error    string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return Identity{}, fmt.Errorf("invalid auth-gateway response: %w", err)
+	}
+	if !v.Valid {
+		return Identity{}, ErrInvalidToken
+	}
+
+	id := Identity{UserID: v.UserID, Username: v.Username, Role: v.Role}
+
+	identityCacheMu.Lock()
+	identityCache[key] = cachedIdentity{identity: id, expires: time.Now().Add(identityCacheTTL)}
+	// Keep the cache from growing without bound on a busy node
+	if len(identityCache) > 10000 {
+		for k, c := range identityCache {
+			if time.Now().After(c.expires) {
+				delete(identityCache, k)
+			}
+		}
+	}
+	identityCacheMu.Unlock()
+
+	return id, nil
+}
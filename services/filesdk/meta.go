@@ -0,0 +1,70 @@
+package filesdk
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Meta tells file-meta when files move or disappear. file-meta keeps tags
+// and attributes in a sidecar DB keyed by path, so it cannot see either
+// happen by itself. Disabled when META_URL is unset.
+type Meta struct {
+	url    string
+	client *http.Client
+}
+
+// NewMeta configures metadata updates from the environment.
+func NewMeta() *Meta {
+	m := &Meta{
+		url:    strings.TrimSuffix(os.Getenv("META_URL"), "/"),
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+	if m.url == "" {
+		log.Printf("Metadata updates disabled: META_URL is not set")
+	} else {
+		log.Printf("Metadata service: %s", m.url)
+	}
+	return m
+}
+
+// Moved reports that src was renamed to dst.
+func (m *Meta) Moved(src, dst string) {
+	m.notify("/api/v1/sidecar/move", map[string]string{"source": CleanPath(src), "dest": CleanPath(dst)})
+}
+
+// Deleted reports that p and everything below it are gone.
+func (m *Meta) Deleted(p string) {
+	m.notify("/api/v1/sidecar/forget", map[string]string{"path": CleanPath(p)})
+}
+
+// notify posts a completed change. Failures are logged only; file-meta
+// drops entries for missing files when it next sees them.
+func (m *Meta) notify(endpoint string, body interface{}) {
+	if m.url == "" {
+		return
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, m.url+endpoint, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	forward(nil, req)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		log.Printf("Metadata update %s failed: %v", endpoint, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Metadata update %s returned status %d", endpoint, resp.StatusCode)
+	}
+}
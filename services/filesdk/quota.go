@@ -0,0 +1,144 @@
+package filesdk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Quota checks writes with file-quota and reports what changed afterwards
+// so its usage index stays current. QUOTA_MODE selects "enforce" (reject
+// writes over a hard limit, and all writes while file-quota cannot be
+// reached), "open" (reject over a hard limit, allow while file-quota cannot
+// be reached) or "off". It defaults to enforce when QUOTA_URL is set and
+// off otherwise.
+type Quota struct {
+	url    string
+	mode   string
+	client *http.Client
+}
+
+// QuotaCheck is file-quota's verdict on a write, returned to the client
+// alongside the status Check gives.
+type QuotaCheck struct {
+	Allowed    bool              `json:"allowed"`
+	Path       string            `json:"path,omitempty"`
+	Bytes      int64             `json:"bytes,omitempty"`
+	Quotas     []json.RawMessage `json:"quotas,omitempty"`
+	Warnings   []string          `json:"warnings,omitempty"`
+	Violations []string          `json:"violations,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// UsageChange mirrors file-quota's record format: op is "write", "delete"
+// or "move".
+type UsageChange struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	Size int64  `json:"size,omitempty"`
+	Dest string `json:"dest,omitempty"`
+}
+
+// NewQuota configures quota checks from the environment.
+func NewQuota() *Quota {
+	q := &Quota{
+		url:    strings.TrimSuffix(os.Getenv("QUOTA_URL"), "/"),
+		mode:   os.Getenv("QUOTA_MODE"),
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+	if q.mode == "" {
+		q.mode = "off"
+		if q.url != "" {
+			q.mode = "enforce"
+		}
+	}
+	if q.mode != "off" && q.url == "" {
+		log.Printf("Warning: QUOTA_MODE=%s but QUOTA_URL is not set, disabling quota checks", q.mode)
+		q.mode = "off"
+	}
+	if q.mode != "off" && serviceToken == "" {
+		log.Printf("Warning: FILE_SERVICE_TOKEN is not set, file-quota will refuse usage reports")
+	}
+	log.Printf("Quota mode: %s", q.mode)
+	return q
+}
+
+// Enabled reports whether writes are checked at all, for callers that
+// would have to work out the size first.
+func (q *Quota) Enabled() bool { return q.mode != "off" }
+
+func (q *Quota) request(r *http.Request, endpoint string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, q.url+endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	forward(r, req)
+	return q.client.Do(req)
+}
+
+// Check asks whether the caller may write size bytes to p. It returns 0
+// when the write may proceed, otherwise the HTTP status to send back with
+// the check: 507 Insufficient Storage over a hard limit, or 503 when
+// file-quota cannot be reached in enforce mode.
+func (q *Quota) Check(r *http.Request, p string, size int64) (int, *QuotaCheck) {
+	if q.mode == "off" {
+		return 0, nil
+	}
+	resp, err := q.request(r, "/api/v1/quota/check", map[string]interface{}{"path": CleanPath(p), "bytes": size})
+	if err == nil && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusInsufficientStorage {
+		resp.Body.Close()
+		err = fmt.Errorf("file-quota returned status %d", resp.StatusCode)
+	}
+	if err != nil {
+		if q.mode == "open" {
+			log.Printf("Quota check failed, allowing write: %v", err)
+			return 0, nil
+		}
+		log.Printf("Quota check failed, refusing write: %v", err)
+		return http.StatusServiceUnavailable, &QuotaCheck{Path: CleanPath(p), Bytes: size, Error: "quota service unavailable"}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return 0, nil
+	}
+	var result QuotaCheck
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result.Error == "" {
+		result.Error = "storage quota exceeded"
+	}
+	return http.StatusInsufficientStorage, &result
+}
+
+// Record reports completed changes to file-quota. Failures are logged
+// only; the periodic rescan corrects any drift.
+func (q *Quota) Record(r *http.Request, changes ...UsageChange) {
+	if q.mode == "off" || len(changes) == 0 {
+		return
+	}
+	for i := range changes {
+		changes[i].Path = CleanPath(changes[i].Path)
+		if changes[i].Dest != "" {
+			changes[i].Dest = CleanPath(changes[i].Dest)
+		}
+	}
+	resp, err := q.request(r, "/api/v1/usage/record", map[string]interface{}{"changes": changes})
+	if err != nil {
+		log.Printf("Usage record failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Usage record returned status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BurnAlerter tells notification-hub when an objective's burn-rate rules
+// start firing, and again when they stop. One incident usually trips
+// several rules; each objective has one alert, for the most urgent.
+type BurnAlerter struct {
+	hubURL string
+	repeat time.Duration
+	client *http.Client
+
+	mu     sync.Mutex
+	firing map[string]firingAlert // By service|objective
+}
+
+type firingAlert struct {
+	rule     int // Index into burnRules
+	notified time.Time
+}
+
+func NewBurnAlerter() *BurnAlerter {
+	hubURL := os.Getenv("NOTIFICATION_HUB_URL")
+	if hubURL == "" {
+		hubURL = "http://notification-hub.holm.svc.cluster.local"
+	}
+	if hubURL == "off" {
+		hubURL = ""
+	}
+	repeat := 6 * time.Hour
+	if d, err := time.ParseDuration(os.Getenv("SLO_ALERT_REPEAT")); err == nil && d > 0 {
+		repeat = d
+	}
+	return &BurnAlerter{
+		hubURL: strings.TrimSuffix(hubURL, "/"),
+		repeat: repeat,
+		client: &http.Client{Timeout: 10 * time.Second},
+		firing: make(map[string]firingAlert),
+	}
+}
+
+// Check fires, repeats or resolves alerts for statuses.
+func (a *BurnAlerter) Check(statuses []*SLOStatus) {
+	if a.hubURL == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, st := range statuses {
+		// burnRules runs most urgent first
+		rule := -1
+		for i, r := range burnRules {
+			for _, name := range st.Alerts {
+				if rule < 0 && name == r.Name {
+					rule = i
+				}
+			}
+		}
+
+		key := st.Service + "|" + st.Objective
+		last, notified := a.firing[key]
+		switch {
+		case rule >= 0 && (!notified || rule < last.rule || time.Since(last.notified) >= a.repeat):
+			if a.notify("firing", st, burnRules[rule]) == nil {
+				a.firing[key] = firingAlert{rule: rule, notified: time.Now()}
+			}
+		case rule >= 0:
+			// Easing off to a less urgent rule is not news, but going back
+			// up again is
+			last.rule = rule
+			a.firing[key] = last
+		case rule < 0 && notified:
+			if a.notify("resolved", st, burnRules[last.rule]) == nil {
+				delete(a.firing, key)
+			}
+		}
+	}
+}
+
+func (a *BurnAlerter) notify(status string, st *SLOStatus, rule burnRule) error {
+	spec := sloSpecs[st.Service]
+	limit := rule.threshold(spec.window)
+	long, short := formatWindow(rule.Long), formatWindow(rule.Short)
+
+	title := fmt.Sprintf("%s burning its %s error budget", st.Service, st.Objective)
+	message := fmt.Sprintf("Burn rate %.1fx over %s and %.1fx over %s (alert above %.1fx). %.1f%% of the %s budget is left.",
+		st.BurnRates[long], long, st.BurnRates[short], short, limit, st.ErrorBudget.Remaining, st.Window)
+	notifType, priority := "warning", "normal"
+	if rule.Severity == "page" {
+		notifType, priority = "error", "high"
+	}
+	if status == "resolved" {
+		title = fmt.Sprintf("%s %s error budget burn has slowed", st.Service, st.Objective)
+		message = fmt.Sprintf("Burn rate %.1fx over %s. %.1f%% of the %s budget is left.",
+			st.BurnRates[long], long, st.ErrorBudget.Remaining, st.Window)
+		notifType, priority = "success", "normal"
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"source":   "health-agg",
+		"type":     notifType,
+		"title":    title,
+		"message":  message,
+		"priority": priority,
+		"metadata": map[string]interface{}{
+			"status":           status,
+			"service":          st.Service,
+			"objective":        st.Objective,
+			"rule":             rule.Name,
+			"severity":         rule.Severity,
+			"burn_rate_long":   st.BurnRates[long],
+			"burn_rate_short":  st.BurnRates[short],
+			"threshold":        limit,
+			"budget_remaining": st.ErrorBudget.Remaining,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Post(a.hubURL+"/api/notifications", "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("notification-hub returned %s", resp.Status)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to send SLO alert %q: %v", title, err)
+		return err
+	}
+	log.Printf("SLO alert %s: %s", status, title)
+	return nil
+}
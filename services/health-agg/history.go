@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Checks are counted in minute buckets for as long as the burn-rate
+// windows need, and in hour buckets for as long as SLO windows and the
+// status page go back.
+const (
+	minuteRetention = 73 * time.Hour
+	hourRetention   = 92 * 24 * time.Hour
+)
+
+// Bucket counts the checks of one service started in one minute or hour.
+// Good checks succeeded; fast ones succeeded within the service's latency
+// threshold.
+type Bucket struct {
+	Start int64 `json:"start"` // Unix seconds
+	Total int64 `json:"total"`
+	Good  int64 `json:"good"`
+	Fast  int64 `json:"fast"`
+}
+
+func (b *Bucket) add(o Bucket) {
+	b.Total += o.Total
+	b.Good += o.Good
+	b.Fast += o.Fast
+}
+
+type series struct {
+	Minutes []Bucket `json:"minutes"`
+	Hours   []Bucket `json:"hours"`
+}
+
+// History is the record of every check, which SLOs are computed from. It
+// lives in memory and is saved to a file, so that health-agg can report on
+// an outage of anything else, Postgres included.
+type History struct {
+	mu     sync.RWMutex
+	series map[string]*series
+	path   string
+}
+
+func NewHistory(path string) *History {
+	return &History{series: make(map[string]*series), path: path}
+}
+
+// Record counts one check of service.
+func (h *History) Record(service string, at time.Time, good, fast bool) {
+	c := Bucket{Total: 1}
+	if good {
+		c.Good = 1
+		if fast {
+			c.Fast = 1
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[service]
+	if s == nil {
+		s = &series{}
+		h.series[service] = s
+	}
+	s.Minutes = addTo(s.Minutes, at.Truncate(time.Minute).Unix(), c, at.Add(-minuteRetention).Unix())
+	s.Hours = addTo(s.Hours, at.Truncate(time.Hour).Unix(), c, at.Add(-hourRetention).Unix())
+}
+
+// addTo adds c to the bucket starting at start, appending it if it is new,
+// and drops buckets from before cutoff.
+func addTo(buckets []Bucket, start int64, c Bucket, cutoff int64) []Bucket {
+	if n := len(buckets); n > 0 && buckets[n-1].Start == start {
+		buckets[n-1].add(c)
+	} else {
+		c.Start = start
+		buckets = append(buckets, c)
+	}
+	return trim(buckets, cutoff)
+}
+
+// trim drops buckets from before cutoff.
+func trim(buckets []Bucket, cutoff int64) []Bucket {
+	drop := 0
+	for drop < len(buckets) && buckets[drop].Start < cutoff {
+		drop++
+	}
+	return buckets[drop:]
+}
+
+// Window totals the checks of service in the window ending now, from
+// minute buckets when they go back far enough and hour buckets otherwise.
+func (h *History) Window(service string, window time.Duration, now time.Time) Bucket {
+	from := now.Add(-window)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	s := h.series[service]
+	if s == nil {
+		return Bucket{}
+	}
+	if window <= minuteRetention {
+		return sum(s.Minutes, from.Truncate(time.Minute).Unix(), now.Unix())
+	}
+	return sum(s.Hours, from.Truncate(time.Hour).Unix(), now.Unix())
+}
+
+// Range totals the checks of service from hour buckets starting in
+// [from, to).
+func (h *History) Range(service string, from, to time.Time) Bucket {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	s := h.series[service]
+	if s == nil {
+		return Bucket{}
+	}
+	return sum(s.Hours, from.Unix(), to.Unix()-1)
+}
+
+func sum(buckets []Bucket, from, to int64) Bucket {
+	var total Bucket
+	for _, b := range buckets {
+		if b.Start >= from && b.Start <= to {
+			total.add(b)
+		}
+	}
+	return total
+}
+
+// Days totals the checks of service for each of the last n UTC days,
+// oldest first. Start is the day's midnight.
+func (h *History) Days(service string, n int, now time.Time) []Bucket {
+	today := now.UTC().Truncate(24 * time.Hour)
+	days := make([]Bucket, n)
+	for i := range days {
+		days[i].Start = today.AddDate(0, 0, i-n+1).Unix()
+	}
+	first := days[0].Start
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	s := h.series[service]
+	if s == nil {
+		return days
+	}
+	for _, b := range s.Hours {
+		if b.Start < first {
+			continue
+		}
+		if i := int((b.Start - first) / 86400); i < n {
+			days[i].add(Bucket{Total: b.Total, Good: b.Good, Fast: b.Fast})
+		}
+	}
+	return days
+}
+
+// Load reads the history saved at path, if there is any.
+func (h *History) Load() error {
+	if h.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(h.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved map[string]*series
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %w", h.path, err)
+	}
+
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, s := range saved {
+		s.Minutes = trim(s.Minutes, now.Add(-minuteRetention).Unix())
+		s.Hours = trim(s.Hours, now.Add(-hourRetention).Unix())
+		h.series[name] = s
+	}
+	return nil
+}
+
+// Save writes the history to its file, replacing it in one step so a crash
+// part way through leaves the last copy.
+func (h *History) Save() error {
+	if h.path == "" {
+		return nil
+	}
+	h.mu.RLock()
+	data, err := json.Marshal(h.series)
+	h.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(h.path), ".slo-history-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), h.path)
+}
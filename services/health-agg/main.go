@@ -6,12 +6,16 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
 var port = os.Getenv("PORT")
 
+const checkInterval = 30 * time.Second
+
 // Service represents a monitored service
 type Service struct {
 	Name     string `json:"name"`
@@ -47,6 +51,7 @@ type AggregatedHealth struct {
 
 // Services to monitor - matches Steve's endpoint list
 var services = []Service{
+	{Name: "Auth Gateway", URL: "http://192.168.8.197:30100/health", Critical: true},
 	{Name: "Nova Dashboard", URL: "http://192.168.8.197:30004/api/dashboard", Critical: true},
 	{Name: "Nova Nodes API", URL: "http://192.168.8.197:30004/api/nodes", Critical: false},
 	{Name: "Nova Pods API", URL: "http://192.168.8.197:30004/api/pods", Critical: false},
@@ -72,12 +77,14 @@ var services = []Service{
 }
 
 var (
-	cachedHealth     *AggregatedHealth
-	cacheMu          sync.RWMutex
-	healthHistory    []AggregatedHealth
-	historyMu        sync.RWMutex
-	uptimeStats      map[string][]bool
-	uptimeMu         sync.RWMutex
+	cachedHealth  *AggregatedHealth
+	cacheMu       sync.RWMutex
+	healthHistory []AggregatedHealth
+	historyMu     sync.RWMutex
+	uptimeStats   map[string][]bool
+	uptimeMu      sync.RWMutex
+	history       *History
+	alerter       *BurnAlerter
 )
 
 func init() {
@@ -308,14 +315,187 @@ func prometheusHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "\n# HELP holmos_uptime_percent Overall system uptime percentage\n")
 	fmt.Fprintf(w, "# TYPE holmos_uptime_percent gauge\n")
 	fmt.Fprintf(w, "holmos_uptime_percent %.2f\n", cached.Uptime)
+
+	statuses := allSLOs(history, time.Now())
+
+	fmt.Fprintf(w, "\n# HELP holmos_slo_target_percent SLO target\n")
+	fmt.Fprintf(w, "# TYPE holmos_slo_target_percent gauge\n")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "holmos_slo_target_percent{service=\"%s\",objective=\"%s\"} %g\n", st.Service, st.Objective, st.Target)
+	}
+
+	fmt.Fprintf(w, "\n# HELP holmos_slo_sli_percent Good checks over the SLO window\n")
+	fmt.Fprintf(w, "# TYPE holmos_slo_sli_percent gauge\n")
+	for _, st := range statuses {
+		if st.SLI != nil {
+			fmt.Fprintf(w, "holmos_slo_sli_percent{service=\"%s\",objective=\"%s\",window=\"%s\"} %.4f\n", st.Service, st.Objective, st.Window, *st.SLI)
+		}
+	}
+
+	fmt.Fprintf(w, "\n# HELP holmos_slo_error_budget_remaining_percent Error budget left over the SLO window\n")
+	fmt.Fprintf(w, "# TYPE holmos_slo_error_budget_remaining_percent gauge\n")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "holmos_slo_error_budget_remaining_percent{service=\"%s\",objective=\"%s\"} %.2f\n", st.Service, st.Objective, st.ErrorBudget.Remaining)
+	}
+
+	fmt.Fprintf(w, "\n# HELP holmos_slo_burn_rate Error budget burn rate (1 spends it exactly over the SLO window)\n")
+	fmt.Fprintf(w, "# TYPE holmos_slo_burn_rate gauge\n")
+	for _, st := range statuses {
+		for _, d := range burnWindows {
+			window := formatWindow(d)
+			fmt.Fprintf(w, "holmos_slo_burn_rate{service=\"%s\",objective=\"%s\",window=\"%s\"} %.3f\n", st.Service, st.Objective, window, st.BurnRates[window])
+		}
+	}
+
+	fmt.Fprintf(w, "\n# HELP holmos_slo_alert_firing Burn-rate alert state\n")
+	fmt.Fprintf(w, "# TYPE holmos_slo_alert_firing gauge\n")
+	for _, st := range statuses {
+		firing := map[string]bool{}
+		for _, name := range st.Alerts {
+			firing[name] = true
+		}
+		for _, rule := range burnRules {
+			value := 0
+			if firing[rule.Name] {
+				value = 1
+			}
+			fmt.Fprintf(w, "holmos_slo_alert_firing{service=\"%s\",objective=\"%s\",rule=\"%s\",severity=\"%s\"} %d\n", st.Service, st.Objective, rule.Name, rule.Severity, value)
+		}
+	}
+}
+
+// sloHandler reports every objective's SLI, error budget, burn rates and
+// firing alerts, for one service with ?service=.
+func sloHandler(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get("service")
+	if service != "" {
+		if _, ok := sloSpecs[service]; !ok {
+			http.Error(w, "Service not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	statuses := []*SLOStatus{}
+	for _, st := range allSLOs(history, time.Now()) {
+		if service == "" || st.Service == service {
+			statuses = append(statuses, st)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"slos":      statuses,
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+// sloReportHandler reports how services did over a calendar month
+// (?month=2026-01, default this one) or between ?from= and ?to= (dates or
+// RFC3339), for one service with ?service=.
+func sloReportHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := now
+
+	parse := func(s string) (time.Time, error) {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t, nil
+		}
+		return time.Parse("2006-01-02", s)
+	}
+	var err error
+	switch {
+	case q.Get("month") != "":
+		if from, err = time.Parse("2006-01", q.Get("month")); err != nil {
+			http.Error(w, "month must be YYYY-MM", http.StatusBadRequest)
+			return
+		}
+		to = from.AddDate(0, 1, 0)
+	case q.Get("from") != "":
+		if from, err = parse(q.Get("from")); err != nil {
+			http.Error(w, "Invalid from", http.StatusBadRequest)
+			return
+		}
+		if q.Get("to") != "" {
+			if to, err = parse(q.Get("to")); err != nil {
+				http.Error(w, "Invalid to", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if !to.After(from) {
+		http.Error(w, "to must be after from", http.StatusBadRequest)
+		return
+	}
+	if to.After(now) {
+		to = now
+	}
+
+	service := q.Get("service")
+	if service != "" {
+		if _, ok := sloSpecs[service]; !ok {
+			http.Error(w, "Service not found", http.StatusNotFound)
+			return
+		}
+	}
+	reports := []*SLOReport{}
+	for _, s := range services {
+		if service == "" || s.Name == service {
+			reports = append(reports, reportSLO(history, s.Name, from, to))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":    from.Format(time.RFC3339),
+		"to":      to.Format(time.RFC3339),
+		"partial": from.Before(now.Add(-hourRetention)),
+		"reports": reports,
+	})
+}
+
+// saveHistory saves the SLO history every few minutes, and once more on
+// the way out.
+func saveHistory() {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := history.Save(); err != nil {
+				log.Printf("Failed to save SLO history: %v", err)
+			}
+		case <-stop:
+			if err := history.Save(); err != nil {
+				log.Printf("Failed to save SLO history: %v", err)
+			}
+			os.Exit(0)
+		}
+	}
+}
+
+// recordSLOs counts results in the SLO history: a check succeeds with a
+// 2xx or 3xx, and is fast within the service's latency threshold. Only the
+// background checker records, so the history holds one check per service
+// per interval however often the API asks for a fresh one.
+func recordSLOs(results []HealthResult, now time.Time) {
+	for _, r := range results {
+		good := r.StatusCode >= 200 && r.StatusCode < 400
+		history.Record(r.Name, now, good, r.ResponseTime <= sloSpecs[r.Name].LatencyMs)
+	}
 }
 
 func backgroundChecker() {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(checkInterval)
 	defer ticker.Stop()
 
 	for {
 		health := checkAllServices()
+		recordSLOs(health.Services, time.Now())
 
 		cacheMu.Lock()
 		cachedHealth = health
@@ -332,6 +512,8 @@ func backgroundChecker() {
 			health.Status, health.HealthyCount, health.TotalServices,
 			health.AvgResponseTime, health.Uptime)
 
+		alerter.Check(allSLOs(history, time.Now()))
+
 		<-ticker.C
 	}
 }
@@ -344,14 +526,31 @@ func main() {
 	log.Println("Health Aggregation Service starting...")
 	log.Printf("Monitoring %d services", len(services))
 
+	if err := loadSLOConfig(os.Getenv("SLO_CONFIG")); err != nil {
+		log.Fatal(err)
+	}
+	historyFile := os.Getenv("SLO_HISTORY_FILE")
+	if historyFile == "" {
+		log.Println("SLO_HISTORY_FILE not set, SLO history will not survive restarts")
+	}
+	history = NewHistory(historyFile)
+	if err := history.Load(); err != nil {
+		log.Printf("Failed to load SLO history, starting afresh: %v", err)
+	}
+	alerter = NewBurnAlerter()
+
 	// Start background health checker
 	go backgroundChecker()
+	go saveHistory()
 
 	http.HandleFunc("/", statusHandler)
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/api/health", healthHandler)
 	http.HandleFunc("/api/health/refresh", refreshHandler)
 	http.HandleFunc("/api/health/history", historyHandler)
+	http.HandleFunc("/api/slo", sloHandler)
+	http.HandleFunc("/api/slo/report", sloReportHandler)
+	http.HandleFunc("/status", statusPageHandler)
 	http.HandleFunc("/metrics", prometheusHandler)
 
 	log.Printf("Listening on port %s", port)
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SLOSpec sets a service's objectives. Unset fields fall back to the
+// defaults: 99.5% availability for critical services and 99% for others,
+// and 95% of successful checks within 1000ms, over 30 days.
+type SLOSpec struct {
+	Window        string  `json:"window,omitempty"`         // Rolling window, e.g. 30d; at most 90d
+	Availability  float64 `json:"availability,omitempty"`   // Percent of checks that succeed
+	LatencyMs     float64 `json:"latency_ms,omitempty"`     // Threshold for a check to count as fast
+	LatencyTarget float64 `json:"latency_target,omitempty"` // Percent of successful checks that are fast
+
+	window time.Duration
+}
+
+// SLOConfig is SLO_CONFIG: defaults for every service, then per-service
+// overrides by name.
+type SLOConfig struct {
+	Defaults SLOSpec            `json:"defaults"`
+	Services map[string]SLOSpec `json:"services"`
+}
+
+// Objective kinds
+const (
+	ObjectiveAvailability = "availability"
+	ObjectiveLatency      = "latency"
+)
+
+// burnRule is one multi-window burn-rate alert: it fires when the error
+// budget is being spent fast enough to use Budget of it within Long, over
+// both Long and Short, so it neither fires on a blip nor keeps firing long
+// after recovery.
+type burnRule struct {
+	Name     string
+	Severity string // page or ticket
+	Long     time.Duration
+	Short    time.Duration
+	Budget   float64
+}
+
+var burnRules = []burnRule{
+	{Name: "fast-burn", Severity: "page", Long: time.Hour, Short: 5 * time.Minute, Budget: 0.02},
+	{Name: "medium-burn", Severity: "page", Long: 6 * time.Hour, Short: 30 * time.Minute, Budget: 0.05},
+	{Name: "slow-burn", Severity: "ticket", Long: 72 * time.Hour, Short: 6 * time.Hour, Budget: 0.10},
+}
+
+// burnWindows are the windows burn rates are reported for.
+var burnWindows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour, 72 * time.Hour}
+
+// minAlertChecks is how many checks the long window needs before a rule
+// can fire, so one failure just after a fresh start does not page.
+const minAlertChecks = 10
+
+// threshold is the burn rate that spends r.Budget of a window's budget in
+// r.Long: 14.4 for the fast rule over 30 days.
+func (r burnRule) threshold(window time.Duration) float64 {
+	return r.Budget * float64(window) / float64(r.Long)
+}
+
+// sloSpecs holds every service's resolved spec, by name.
+var sloSpecs map[string]SLOSpec
+
+// loadSLOConfig parses raw and resolves every service's spec.
+func loadSLOConfig(raw string) error {
+	var cfg SLOConfig
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+			return fmt.Errorf("invalid SLO config: %w", err)
+		}
+	}
+	known := map[string]bool{}
+	for _, s := range services {
+		known[s.Name] = true
+	}
+	for name := range cfg.Services {
+		if !known[name] {
+			return fmt.Errorf("SLO config names unknown service %q", name)
+		}
+	}
+
+	specs := map[string]SLOSpec{}
+	for _, s := range services {
+		spec := SLOSpec{Window: "30d", Availability: 99.0, LatencyMs: 1000, LatencyTarget: 95}
+		if s.Critical {
+			spec.Availability = 99.5
+		}
+		spec = spec.merge(cfg.Defaults).merge(cfg.Services[s.Name])
+		if err := spec.validate(); err != nil {
+			return fmt.Errorf("SLO for %s: %w", s.Name, err)
+		}
+		specs[s.Name] = spec
+	}
+	sloSpecs = specs
+	return nil
+}
+
+func (s SLOSpec) merge(o SLOSpec) SLOSpec {
+	if o.Window != "" {
+		s.Window = o.Window
+	}
+	if o.Availability != 0 {
+		s.Availability = o.Availability
+	}
+	if o.LatencyMs != 0 {
+		s.LatencyMs = o.LatencyMs
+	}
+	if o.LatencyTarget != 0 {
+		s.LatencyTarget = o.LatencyTarget
+	}
+	return s
+}
+
+func (s *SLOSpec) validate() error {
+	d, err := parseWindow(s.Window)
+	if err != nil {
+		return err
+	}
+	if d < time.Hour || d > 90*24*time.Hour {
+		return fmt.Errorf("window %s must be between 1h and 90d", s.Window)
+	}
+	s.window = d
+	for _, t := range []float64{s.Availability, s.LatencyTarget} {
+		if t <= 0 || t >= 100 {
+			return fmt.Errorf("target %g must be between 0 and 100", t)
+		}
+	}
+	if s.LatencyMs <= 0 {
+		return fmt.Errorf("latency_ms must be positive")
+	}
+	return nil
+}
+
+// parseWindow is time.ParseDuration with days, e.g. 30d.
+func parseWindow(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid window %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid window %q", s)
+	}
+	return d, nil
+}
+
+func formatWindow(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return fmt.Sprintf("%dm", d/time.Minute)
+}
+
+// SLOStatus is how one objective stands over its window.
+type SLOStatus struct {
+	Service     string   `json:"service"`
+	Objective   string   `json:"objective"`
+	Target      float64  `json:"target"`
+	ThresholdMs float64  `json:"threshold_ms,omitempty"`
+	Window      string   `json:"window"`
+	Total       int64    `json:"total"`
+	Good        int64    `json:"good"`
+	SLI         *float64 `json:"sli"` // Percent good; null without checks
+	Met         bool     `json:"met"`
+	ErrorBudget struct {
+		Allowed   float64 `json:"allowed"`   // Bad checks the target allows so far
+		Used      int64   `json:"used"`      // Bad checks so far
+		Remaining float64 `json:"remaining"` // Percent of the budget left; negative once overspent
+	} `json:"error_budget"`
+	BurnRates map[string]float64 `json:"burn_rates"` // By window; 1 spends the budget exactly over the SLO window
+	Alerts    []string           `json:"alerts"`     // Burn-rate rules firing
+}
+
+// counts picks the total and good checks for an objective out of b: every
+// check for availability, successful ones for latency.
+func counts(objective string, b Bucket) (total, good int64) {
+	if objective == ObjectiveLatency {
+		return b.Good, b.Fast
+	}
+	return b.Total, b.Good
+}
+
+func (s SLOSpec) target(objective string) float64 {
+	if objective == ObjectiveLatency {
+		return s.LatencyTarget
+	}
+	return s.Availability
+}
+
+// burnRate is how many times faster than the target allows the budget is
+// being spent.
+func burnRate(total, good int64, target float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	bad := float64(total-good) / float64(total)
+	return bad / (1 - target/100)
+}
+
+// evaluateSLO works out an objective's status from the history at now.
+func evaluateSLO(h *History, service, objective string, now time.Time) *SLOStatus {
+	spec := sloSpecs[service]
+	target := spec.target(objective)
+	st := &SLOStatus{
+		Service:   service,
+		Objective: objective,
+		Target:    target,
+		Window:    spec.Window,
+		BurnRates: map[string]float64{},
+		Alerts:    []string{},
+	}
+	if objective == ObjectiveLatency {
+		st.ThresholdMs = spec.LatencyMs
+	}
+
+	st.Total, st.Good = counts(objective, h.Window(service, spec.window, now))
+	st.Met = true
+	st.ErrorBudget.Remaining = 100
+	if st.Total > 0 {
+		sli := float64(st.Good) / float64(st.Total) * 100
+		st.SLI = &sli
+		st.Met = sli >= target
+		st.ErrorBudget.Allowed = float64(st.Total) * (1 - target/100)
+		st.ErrorBudget.Used = st.Total - st.Good
+		if st.ErrorBudget.Allowed > 0 {
+			st.ErrorBudget.Remaining = (1 - float64(st.ErrorBudget.Used)/st.ErrorBudget.Allowed) * 100
+		}
+	}
+
+	rates := map[time.Duration]float64{}
+	longTotals := map[time.Duration]int64{}
+	for _, w := range burnWindows {
+		total, good := counts(objective, h.Window(service, w, now))
+		rates[w] = burnRate(total, good, target)
+		longTotals[w] = total
+		st.BurnRates[formatWindow(w)] = rates[w]
+	}
+	for _, r := range burnRules {
+		// A rule looking further back than the SLO window says nothing
+		if r.Long > spec.window {
+			continue
+		}
+		limit := r.threshold(spec.window)
+		if longTotals[r.Long] >= minAlertChecks && rates[r.Long] > limit && rates[r.Short] > limit {
+			st.Alerts = append(st.Alerts, r.Name)
+		}
+	}
+	return st
+}
+
+// allSLOs evaluates every objective of every service, in service order.
+func allSLOs(h *History, now time.Time) []*SLOStatus {
+	var out []*SLOStatus
+	for _, s := range services {
+		out = append(out,
+			evaluateSLO(h, s.Name, ObjectiveAvailability, now),
+			evaluateSLO(h, s.Name, ObjectiveLatency, now))
+	}
+	return out
+}
+
+// SLOReport is how a service did over a fixed period, such as a month.
+type SLOReport struct {
+	Service            string   `json:"service"`
+	From               string   `json:"from"`
+	To                 string   `json:"to"`
+	Checks             int64    `json:"checks"`
+	Availability       *float64 `json:"availability"` // Percent of checks that succeeded
+	AvailabilityTarget float64  `json:"availability_target"`
+	Latency            *float64 `json:"latency"` // Percent of successful checks within the threshold
+	LatencyTarget      float64  `json:"latency_target"`
+	LatencyThresholdMs float64  `json:"latency_threshold_ms"`
+	Met                bool     `json:"met"`
+	Downtime           string   `json:"downtime"` // Failed checks times the check interval
+}
+
+func reportSLO(h *History, service string, from, to time.Time) *SLOReport {
+	spec := sloSpecs[service]
+	b := h.Range(service, from, to)
+	rep := &SLOReport{
+		Service:            service,
+		From:               from.UTC().Format(time.RFC3339),
+		To:                 to.UTC().Format(time.RFC3339),
+		Checks:             b.Total,
+		AvailabilityTarget: spec.Availability,
+		LatencyTarget:      spec.LatencyTarget,
+		LatencyThresholdMs: spec.LatencyMs,
+		Met:                true,
+		Downtime:           (time.Duration(b.Total-b.Good) * checkInterval).String(),
+	}
+	if b.Total > 0 {
+		avail := float64(b.Good) / float64(b.Total) * 100
+		rep.Availability = &avail
+		rep.Met = avail >= spec.Availability
+	}
+	if b.Good > 0 {
+		fast := float64(b.Fast) / float64(b.Good) * 100
+		rep.Latency = &fast
+		rep.Met = rep.Met && fast >= spec.LatencyTarget
+	}
+	return rep
+}
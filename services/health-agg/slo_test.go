@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBurnRate(t *testing.T) {
+	tests := []struct {
+		total, good int64
+		target      float64
+		want        float64
+	}{
+		{0, 0, 99, 0},
+		{100, 100, 99, 0},
+		{100, 99, 99, 1},
+		{100, 90, 99, 10},
+		{1000, 995, 99.5, 1},
+		{100, 0, 99, 100},
+	}
+	for _, tt := range tests {
+		if got := burnRate(tt.total, tt.good, tt.target); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("burnRate(%d, %d, %g) = %g, want %g", tt.total, tt.good, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateSLO(t *testing.T) {
+	saved := sloSpecs
+	defer func() { sloSpecs = saved }()
+	sloSpecs = map[string]SLOSpec{
+		"api": {Window: "30d", Availability: 99, LatencyMs: 1000, LatencyTarget: 95, window: 30 * 24 * time.Hour},
+	}
+
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	// span records a check every checkInterval from ago until until before now
+	type span struct {
+		ago, until time.Duration
+		good, fast bool
+	}
+
+	tests := []struct {
+		name      string
+		spans     []span
+		objective string
+		total     int64
+		met       bool
+		sli       float64 // Ignored without checks
+		alerts    []string
+	}{
+		{
+			name:      "no checks",
+			objective: ObjectiveAvailability,
+			met:       true,
+			alerts:    []string{},
+		},
+		{
+			name:      "all good",
+			spans:     []span{{2 * time.Hour, 0, true, true}},
+			objective: ObjectiveAvailability,
+			total:     240, met: true, sli: 100,
+			alerts: []string{},
+		},
+		{
+			name: "failing now burns every window",
+			spans: []span{
+				{2 * time.Hour, 30 * time.Minute, true, true},
+				{30 * time.Minute, 0, false, false},
+			},
+			objective: ObjectiveAvailability,
+			total:     240, met: false, sli: 75,
+			alerts: []string{"fast-burn", "medium-burn", "slow-burn"},
+		},
+		{
+			name: "recovered outage leaves only the slow burn",
+			spans: []span{
+				{3 * time.Hour, 2 * time.Hour, true, true},
+				{2 * time.Hour, 90 * time.Minute, false, false},
+				{90 * time.Minute, 0, true, true},
+			},
+			objective: ObjectiveAvailability,
+			total:     360, met: false, sli: 100 * 300.0 / 360,
+			alerts: []string{"slow-burn"},
+		},
+		{
+			name:      "too few checks to alert",
+			spans:     []span{{2 * time.Minute, 0, false, false}},
+			objective: ObjectiveAvailability,
+			total:     4, met: false, sli: 0,
+			alerts: []string{},
+		},
+		{
+			name: "latency counts successful checks only",
+			spans: []span{
+				{2 * time.Hour, time.Hour, true, true},
+				{time.Hour, 50 * time.Minute, true, false},
+				{50 * time.Minute, 40 * time.Minute, false, false},
+				{40 * time.Minute, 0, true, true},
+			},
+			objective: ObjectiveLatency,
+			total:     220, met: false, sli: 100 * 200.0 / 220,
+			alerts: []string{"slow-burn"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHistory("")
+			for _, s := range tt.spans {
+				for at := now.Add(-s.ago); at.Before(now.Add(-s.until)); at = at.Add(checkInterval) {
+					h.Record("api", at, s.good, s.fast)
+				}
+			}
+			st := evaluateSLO(h, "api", tt.objective, now)
+
+			if st.Total != tt.total {
+				t.Errorf("total = %d, want %d", st.Total, tt.total)
+			}
+			if st.Met != tt.met {
+				t.Errorf("met = %v, want %v", st.Met, tt.met)
+			}
+			switch {
+			case tt.total == 0 && st.SLI != nil:
+				t.Errorf("sli = %g, want null", *st.SLI)
+			case tt.total > 0 && (st.SLI == nil || math.Abs(*st.SLI-tt.sli) > 1e-9):
+				t.Errorf("sli = %v, want %g", st.SLI, tt.sli)
+			}
+			if !reflect.DeepEqual(st.Alerts, tt.alerts) {
+				t.Errorf("alerts = %v, want %v", st.Alerts, tt.alerts)
+			}
+		})
+	}
+}
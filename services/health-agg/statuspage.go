@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Catppuccin Mocha colors
+const (
+	ColorBase     = "#1e1e2e"
+	ColorMantle   = "#181825"
+	ColorSurface0 = "#313244"
+	ColorText     = "#cdd6f4"
+	ColorSubtext0 = "#a6adc8"
+	ColorGreen    = "#a6e3a1"
+	ColorRed      = "#f38ba8"
+	ColorPeach    = "#fab387"
+	ColorYellow   = "#f9e2af"
+	ColorLavender = "#b4befe"
+)
+
+// uptimeDays is how many daily bars the status page shows.
+const uptimeDays = 90
+
+// dayColor shades a day's bar by how its availability compares to target.
+func dayColor(b Bucket, target float64) string {
+	if b.Total == 0 {
+		return ColorSurface0
+	}
+	avail := float64(b.Good) / float64(b.Total) * 100
+	switch {
+	case avail >= target:
+		return ColorGreen
+	case avail >= target-1:
+		return ColorYellow
+	case avail >= 90:
+		return ColorPeach
+	}
+	return ColorRed
+}
+
+func formatPercent(p *float64) string {
+	if p == nil {
+		return "no data"
+	}
+	return fmt.Sprintf("%.3f%%", *p)
+}
+
+// statusPageHandler shows every service's SLOs, error budgets and daily
+// uptime.
+func statusPageHandler(w http.ResponseWriter, r *http.Request) {
+	cacheMu.RLock()
+	cached := cachedHealth
+	cacheMu.RUnlock()
+
+	current := map[string]string{}
+	overall := "unknown"
+	if cached != nil {
+		overall = cached.Status
+		for _, s := range cached.Services {
+			current[s.Name] = s.Status
+		}
+	}
+	overallText, overallColor := "Checking...", ColorSubtext0
+	switch overall {
+	case "healthy":
+		overallText, overallColor = "All Systems Operational", ColorGreen
+	case "degraded":
+		overallText, overallColor = "Degraded Performance", ColorYellow
+	case "unhealthy":
+		overallText, overallColor = "Critical Service Outage", ColorRed
+	}
+
+	now := time.Now()
+	statuses := map[string]*SLOStatus{}
+	for _, st := range allSLOs(history, now) {
+		statuses[st.Service+"|"+st.Objective] = st
+	}
+
+	var rows strings.Builder
+	for _, svc := range services {
+		spec := sloSpecs[svc.Name]
+		avail := statuses[svc.Name+"|"+ObjectiveAvailability]
+		latency := statuses[svc.Name+"|"+ObjectiveLatency]
+
+		dotColor := ColorSubtext0
+		switch current[svc.Name] {
+		case "healthy":
+			dotColor = ColorGreen
+		case "degraded":
+			dotColor = ColorYellow
+		case "unhealthy":
+			dotColor = ColorRed
+		}
+		budgetColor := ColorGreen
+		switch {
+		case avail.ErrorBudget.Remaining < 0:
+			budgetColor = ColorRed
+		case avail.ErrorBudget.Remaining < 25:
+			budgetColor = ColorYellow
+		}
+
+		var bars strings.Builder
+		for _, day := range history.Days(svc.Name, uptimeDays, now) {
+			label := time.Unix(day.Start, 0).UTC().Format("2006-01-02") + ": no data"
+			if day.Total > 0 {
+				label = fmt.Sprintf("%s: %.2f%% (%d checks)", time.Unix(day.Start, 0).UTC().Format("2006-01-02"),
+					float64(day.Good)/float64(day.Total)*100, day.Total)
+			}
+			fmt.Fprintf(&bars, `<span class="bar" style="background: %s" title="%s"></span>`, dayColor(day, spec.Availability), label)
+		}
+
+		alerts := ""
+		for _, st := range []*SLOStatus{avail, latency} {
+			for _, name := range st.Alerts {
+				alerts += fmt.Sprintf(`<span class="alert">%s %s</span>`, st.Objective, name)
+			}
+		}
+		critical := ""
+		if svc.Critical {
+			critical = `<span class="tag">critical</span>`
+		}
+
+		fmt.Fprintf(&rows, `
+		<div class="service">
+			<div class="head">
+				<div><span class="dot" style="background: %s"></span>%s %s %s</div>
+				<div class="budget" style="color: %s">%.1f%% budget left</div>
+			</div>
+			<div class="bars">%s</div>
+			<div class="sli">
+				Availability %s over %s (target %.2f%%) · %s within %.0fms (target %.1f%%) · burn %.1fx 1h, %.1fx 6h
+			</div>
+		</div>`,
+			dotColor, html.EscapeString(svc.Name), critical, alerts,
+			budgetColor, avail.ErrorBudget.Remaining,
+			bars.String(),
+			formatPercent(avail.SLI), spec.Window, spec.Availability,
+			formatPercent(latency.SLI), spec.LatencyMs, spec.LatencyTarget,
+			avail.BurnRates["1h"], avail.BurnRates["6h"])
+	}
+
+	page := fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+    <title>HolmOS Status</title>
+    <meta http-equiv="refresh" content="60">
+    <style>
+        body { background: %s; color: %s; font-family: 'JetBrains Mono', monospace; padding: 2rem; }
+        .container { max-width: 1000px; margin: 0 auto; }
+        h1 { color: %s; }
+        .overall { padding: 1.5rem; background: %s; border-radius: 8px; margin: 1rem 0; text-align: center; font-size: 1.2rem; font-weight: bold; color: %s; }
+        .service { background: %s; border-radius: 8px; padding: 1rem; margin: 0.75rem 0; }
+        .head { display: flex; justify-content: space-between; align-items: center; }
+        .dot { display: inline-block; width: 10px; height: 10px; border-radius: 50%%; margin-right: 0.5rem; }
+        .tag { font-size: 0.7rem; color: %s; border: 1px solid %s; border-radius: 4px; padding: 0 0.3rem; margin-left: 0.5rem; }
+        .alert { font-size: 0.7rem; color: %s; border: 1px solid %s; border-radius: 4px; padding: 0 0.3rem; margin-left: 0.5rem; }
+        .budget { font-size: 0.8rem; }
+        .bars { display: flex; gap: 2px; margin: 0.75rem 0 0.5rem; }
+        .bar { flex: 1; height: 28px; border-radius: 2px; }
+        .sli { color: %s; font-size: 0.75rem; }
+        .legend { color: %s; font-size: 0.75rem; display: flex; justify-content: space-between; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>HolmOS Status</h1>
+        <div class="overall">%s</div>
+        <div class="legend"><span>%d days ago</span><span>Today</span></div>
+        %s
+    </div>
+</body>
+</html>`, ColorBase, ColorText, ColorLavender, ColorMantle, overallColor, ColorMantle,
+		ColorSubtext0, ColorSubtext0, ColorRed, ColorRed, ColorSubtext0, ColorSubtext0,
+		overallText, uptimeDays, rows.String())
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(page))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshMargin renews access tokens this long before they expire, so a
+// long transfer does not start with a token about to lapse.
+const refreshMargin = time.Minute
+
+var (
+	httpClient = &http.Client{}
+	authMu     sync.Mutex
+)
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+func (p *Profile) storeTokens(t tokenResponse) {
+	p.AccessToken = t.AccessToken
+	if t.RefreshToken != "" {
+		p.RefreshToken = t.RefreshToken
+	}
+	p.ExpiresAt = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second).UTC()
+}
+
+// refreshToken trades the stored refresh token for a new access token via
+// auth-gateway's /api/refresh and saves it to the config.
+func refreshToken() error {
+	body, _ := json.Marshal(map[string]string{"refresh_token": profile.RefreshToken})
+	resp, err := httpClient.Post(profile.authURL()+"/api/refresh", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("session expired, run holm login (%s)", strings.TrimSpace(string(msg)))
+	}
+	var t tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return err
+	}
+	profile.storeTokens(t)
+	return config.save()
+}
+
+// bearerToken returns the credential for the active profile, refreshing a
+// login token that is about to expire. force skips the expiry check after
+// the server has rejected the current token.
+func bearerToken(force bool) (string, error) {
+	authMu.Lock()
+	defer authMu.Unlock()
+
+	if token := os.Getenv("HOLM_TOKEN"); token != "" {
+		return token, nil
+	}
+	if profile.APIKey != "" {
+		return profile.APIKey, nil
+	}
+	if profile.RefreshToken == "" {
+		return profile.AccessToken, nil
+	}
+	if force || time.Now().Add(refreshMargin).After(profile.ExpiresAt) {
+		if err := refreshToken(); err != nil {
+			return "", err
+		}
+	}
+	return profile.AccessToken, nil
+}
+
+// apiDo sends req with the profile's credentials. A 401 triggers one token
+// refresh and retry when the request body can be replayed.
+func apiDo(req *http.Request) (*http.Response, error) {
+	token, err := bearerToken(false)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || profile.RefreshToken == "" {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	if token, err = bearerToken(true); err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	return httpClient.Do(retry)
+}
+
+func apiGet(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return apiDo(req)
+}
+
+func apiPost(url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return apiDo(req)
+}
+
+// readPassword prompts on the terminal with echo turned off. Piped input
+// is read as-is so scripts can use --password-stdin.
+func readPassword(prompt string) (string, error) {
+	if isTerminal(os.Stdin) {
+		fmt.Fprint(os.Stderr, prompt)
+		stty := exec.Command("stty", "-echo")
+		stty.Stdin = os.Stdin
+		if stty.Run() == nil {
+			defer func() {
+				restore := exec.Command("stty", "echo")
+				restore.Stdin = os.Stdin
+				restore.Run()
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// LoginResult is printed by holm login.
+type LoginResult struct {
+	Profile   string    `json:"profile"`
+	Username  string    `json:"username,omitempty"`
+	Auth      string    `json:"auth"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+func cmdLogin(args []string) error {
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	username := fs.String("u", "", "username")
+	fs.StringVar(username, "username", "", "username")
+	url := fs.String("url", "", "API URL to store in the profile")
+	authURL := fs.String("auth-url", "", "auth-gateway URL to store in the profile")
+	apiKey := fs.String("api-key", "", "store an API key instead of logging in")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	name := activeProfileName()
+	p, ok := config.Profiles[name]
+	if !ok {
+		p = &Profile{}
+		config.Profiles[name] = p
+	}
+	if config.CurrentProfile == "" {
+		config.CurrentProfile = name
+	}
+	if *url != "" {
+		p.URL = *url
+	}
+	if *authURL != "" {
+		p.AuthURL = *authURL
+	}
+	profile = p
+
+	if *apiKey != "" {
+		p.APIKey = *apiKey
+		p.AccessToken, p.RefreshToken, p.ExpiresAt = "", "", time.Time{}
+		if err := config.save(); err != nil {
+			return err
+		}
+		result := LoginResult{Profile: name, Auth: "api-key"}
+		return emit(result, func() { fmt.Printf("Stored API key in profile %s\n", name) })
+	}
+
+	if *username == "" {
+		*username = p.Username
+	}
+	if *username == "" {
+		if !isTerminal(os.Stdin) {
+			return usageErrorf("usage: holm login -u <username> [--password-stdin]")
+		}
+		fmt.Fprint(os.Stderr, "Username: ")
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		*username = strings.TrimSpace(line)
+	}
+	if *passwordStdin && isTerminal(os.Stdin) {
+		return fmt.Errorf("--password-stdin needs the password piped in")
+	}
+	password, err := readPassword("Password: ")
+	if err != nil {
+		return err
+	}
+
+	body, _ := json.Marshal(map[string]string{"username": *username, "password": password})
+	resp, err := httpClient.Post(p.authURL()+"/api/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var t tokenResponse
+	json.NewDecoder(resp.Body).Decode(&t)
+	if resp.StatusCode != http.StatusOK || t.AccessToken == "" {
+		if t.Error == "" {
+			t.Error = resp.Status
+		}
+		return fmt.Errorf("login failed: %s", t.Error)
+	}
+
+	p.Username = *username
+	p.APIKey = ""
+	p.storeTokens(t)
+	if err := config.save(); err != nil {
+		return err
+	}
+
+	result := LoginResult{Profile: name, Username: p.Username, Auth: "token", ExpiresAt: p.ExpiresAt}
+	return emit(result, func() { fmt.Printf("Logged in as %s (profile %s)\n", p.Username, name) })
+}
+
+func cmdLogout(args []string) error {
+	name := activeProfileName()
+	p, ok := config.Profiles[name]
+	if !ok {
+		return fmt.Errorf("profile %q not found", name)
+	}
+
+	// Ending the server-side session is best effort; local tokens go anyway
+	if p.AccessToken != "" {
+		req, _ := http.NewRequest(http.MethodPost, p.authURL()+"/api/logout", nil)
+		req.Header.Set("Authorization", "Bearer "+p.AccessToken)
+		if resp, err := httpClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+	p.AccessToken, p.RefreshToken, p.ExpiresAt, p.APIKey = "", "", time.Time{}, ""
+	if err := config.save(); err != nil {
+		return err
+	}
+	return emit(map[string]string{"profile": name, "status": "logged out"}, func() {
+		fmt.Printf("Logged out of profile %s\n", name)
+	})
+}
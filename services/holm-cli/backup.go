@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Backup is a backup known to backup-dashboard.
+type Backup struct {
+	ID          string    `json:"id"`
+	SourcePath  string    `json:"source_path"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+	Description string    `json:"description"`
+	Status      string    `json:"status"`
+	Type        string    `json:"type"`
+	Encrypted   bool      `json:"encrypted"`
+}
+
+// RestoreJob tracks a restore started by holm backup restore.
+type RestoreJob struct {
+	ID          string     `json:"id"`
+	BackupID    string     `json:"backup_id"`
+	Status      string     `json:"status"`
+	StartedAt   time.Time  `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	Message     string     `json:"message,omitempty"`
+}
+
+func cmdBackup(args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch args[0] {
+	case "list", "ls":
+		return backupList(args[1:])
+	case "run":
+		return backupRun(args[1:])
+	case "restore":
+		return backupRestore(args[1:])
+	}
+	return usageErrorf("usage: holm backup [list|run|restore]")
+}
+
+func backupList(args []string) error {
+	fs := flag.NewFlagSet("backup list", flag.ContinueOnError)
+	typ := fs.String("type", "", "only backups of this type")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	path := "/api/backups"
+	if *typ != "" {
+		path += "?type=" + url.QueryEscape(*typ)
+	}
+	var resp struct {
+		Backups []Backup `json:"backups"`
+	}
+	if err := callService("backup", http.MethodGet, path, nil, &resp); err != nil {
+		return err
+	}
+	if resp.Backups == nil {
+		resp.Backups = []Backup{}
+	}
+
+	return emit(resp.Backups, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "ID\tNAME\tTYPE\tSIZE\tSTATUS\tCREATED\n")
+		for _, b := range resp.Backups {
+			name := b.Description
+			if b.Encrypted {
+				name += " (encrypted)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", b.ID, name, b.Type, formatSize(b.Size), b.Status,
+				b.CreatedAt.Local().Format("2006-01-02 15:04"))
+		}
+		w.Flush()
+	})
+}
+
+func backupRun(args []string) error {
+	fs := flag.NewFlagSet("backup run", flag.ContinueOnError)
+	typ := fs.String("type", "full", "backup type")
+	target := fs.String("target", "", "what to back up")
+	encrypt := fs.Bool("encrypt", false, "encrypt the backup through the vault")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return usageErrorf("usage: holm backup run <name> [--type T] [--target PATH] [--encrypt]")
+	}
+
+	req := map[string]interface{}{"name": args[0], "type": *typ, "target": *target, "encrypt": *encrypt}
+	var resp struct {
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		Status    string `json:"status"`
+		Encrypted bool   `json:"encrypted"`
+		Size      int64  `json:"size"`
+	}
+	if err := callService("backup", http.MethodPost, "/api/backup/manual", req, &resp); err != nil {
+		return err
+	}
+	if resp.Status != "completed" {
+		return failedErrorf("backup %s %s", resp.ID, resp.Status)
+	}
+
+	return emit(resp, func() {
+		fmt.Printf("Backup %s completed: %s (%s)\n", resp.ID, resp.Name, formatSize(resp.Size))
+	})
+}
+
+func backupRestore(args []string) error {
+	fs := flag.NewFlagSet("backup restore", flag.ContinueOnError)
+	target := fs.String("target", "", "restore to this path instead of the original")
+	overwrite := fs.Bool("overwrite", false, "replace existing files")
+	verify := fs.Bool("verify-only", false, "check the backup can be restored without writing it")
+	wait := fs.Bool("wait", false, "wait for the restore and exit non-zero if it fails")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return usageErrorf("usage: holm backup restore <backup-id> [--target PATH] [--overwrite] [--verify-only] [--wait]")
+	}
+
+	req := map[string]interface{}{
+		"backup_id":   args[0],
+		"target_path": *target,
+		"overwrite":   *overwrite,
+		"verify_only": *verify,
+	}
+	var resp struct {
+		JobID string `json:"job_id"`
+	}
+	if err := callService("backup", http.MethodPost, "/api/restore", req, &resp); err != nil {
+		return err
+	}
+
+	job := RestoreJob{ID: resp.JobID, BackupID: args[0], Status: "running"}
+	if *wait {
+		info("Restore job %s started, waiting...\n", job.ID)
+		for job.Status == "running" {
+			time.Sleep(2 * time.Second)
+			if err := callService("backup", http.MethodGet, "/api/restore/jobs/"+url.PathEscape(job.ID), nil, &job); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := emit(job, func() {
+		switch job.Status {
+		case "running":
+			fmt.Printf("Restore job %s started for backup %s\n", job.ID, job.BackupID)
+		default:
+			fmt.Printf("Restore job %s %s: %s\n", job.ID, job.Status, job.Message)
+		}
+	}); err != nil {
+		return err
+	}
+	if job.Status == "failed" || job.Status == "cancelled" {
+		return failedErrorf("restore %s %s", job.ID, job.Status)
+	}
+	return nil
+}
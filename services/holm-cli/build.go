@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Execution is one pipeline run in cicd-controller.
+type Execution struct {
+	ID           string    `json:"id"`
+	PipelineID   string    `json:"pipelineId"`
+	PipelineName string    `json:"pipelineName"`
+	BuildNumber  int       `json:"buildNumber"`
+	Branch       string    `json:"branch"`
+	Commit       string    `json:"commit"`
+	Status       string    `json:"status"`
+	StartedAt    time.Time `json:"startedAt"`
+	Duration     float64   `json:"duration"`
+}
+
+// BuildLogLine is a log line from a pipeline stage.
+type BuildLogLine struct {
+	Stage     string    `json:"stage"`
+	Timestamp time.Time `json:"timestamp"`
+	Level     string    `json:"level"`
+	Message   string    `json:"message"`
+}
+
+// buildStartTimeout bounds how long -f waits for a queued build to start.
+const buildStartTimeout = 10 * time.Minute
+
+func cmdBuild(args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch args[0] {
+	case "list", "ls":
+		return buildList(args[1:])
+	case "trigger", "run":
+		return buildTrigger(args[1:])
+	case "logs", "log":
+		return buildLogs(args[1:])
+	}
+	return usageErrorf("usage: holm build [list|trigger|logs]")
+}
+
+func buildList(args []string) error {
+	fs := flag.NewFlagSet("build list", flag.ContinueOnError)
+	pipeline := fs.String("pipeline", "", "only runs of this pipeline")
+	status := fs.String("status", "", "only runs with this status")
+	limit := fs.Int("limit", 20, "number of runs to show")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	q := url.Values{"limit": {strconv.Itoa(*limit)}}
+	if *pipeline != "" {
+		q.Set("pipeline", *pipeline)
+	}
+	if *status != "" {
+		q.Set("status", *status)
+	}
+	var resp struct {
+		Executions []Execution `json:"executions"`
+	}
+	if err := callService("cicd", http.MethodGet, "/api/executions?"+q.Encode(), nil, &resp); err != nil {
+		return err
+	}
+	if resp.Executions == nil {
+		resp.Executions = []Execution{}
+	}
+
+	return emit(resp.Executions, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "ID\tPIPELINE\t#\tBRANCH\tSTATUS\tSTARTED\tDURATION\n")
+		for _, e := range resp.Executions {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", e.ID, e.PipelineName, e.BuildNumber, e.Branch,
+				e.Status, e.StartedAt.Local().Format("2006-01-02 15:04"), time.Duration(e.Duration*float64(time.Second)).Round(time.Second))
+		}
+		w.Flush()
+	})
+}
+
+func buildTrigger(args []string) error {
+	fs := flag.NewFlagSet("build trigger", flag.ContinueOnError)
+	branch := fs.String("branch", "", "branch to build (default: the pipeline's)")
+	commit := fs.String("commit", "", "commit to build")
+	follow := fs.Bool("f", false, "follow the build log and exit non-zero if it fails")
+	fs.BoolVar(follow, "follow", false, "follow the build log and exit non-zero if it fails")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return usageErrorf("usage: holm build trigger <pipeline> [--branch B] [--commit SHA] [-f]")
+	}
+	pipelineID, err := resolvePipeline(args[0])
+	if err != nil {
+		return err
+	}
+
+	req := map[string]string{"branch": *branch, "commit": *commit}
+	var resp struct {
+		BuildID string `json:"buildId"`
+	}
+	if err := callService("cicd", http.MethodPost, "/api/pipelines/"+url.PathEscape(pipelineID)+"/trigger", req, &resp); err != nil {
+		return err
+	}
+
+	if !*follow {
+		return emit(map[string]string{"pipeline": args[0], "build_id": resp.BuildID, "status": "queued"}, func() {
+			fmt.Printf("Queued build %s of pipeline %s\n", resp.BuildID, args[0])
+		})
+	}
+	fmt.Fprintf(os.Stderr, "Queued build %s, waiting for it to start...\n", resp.BuildID)
+	exec, err := waitForExecution(resp.BuildID, buildStartTimeout)
+	if err != nil {
+		return err
+	}
+	return followBuild(exec.ID)
+}
+
+// resolvePipeline accepts a pipeline ID or name; IDs are generated hashes,
+// so names are what people remember.
+func resolvePipeline(nameOrID string) (string, error) {
+	var pipelines []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := callService("cicd", http.MethodGet, "/api/pipelines", nil, &pipelines); err != nil {
+		return "", err
+	}
+	for _, p := range pipelines {
+		if p.ID == nameOrID {
+			return p.ID, nil
+		}
+	}
+	for _, p := range pipelines {
+		if p.Name == nameOrID {
+			return p.ID, nil
+		}
+	}
+	return "", &cliError{code: exitNotFound, err: fmt.Errorf("cicd-controller: pipeline %s not found", nameOrID)}
+}
+
+// findExecution accepts an execution ID or the build ID returned by
+// trigger. errNotStarted means the build is known but still queued.
+var errNotStarted = errors.New("build has not started")
+
+func findExecution(id string) (*Execution, error) {
+	var exec Execution
+	err := callService("cicd", http.MethodGet, "/api/executions/"+url.PathEscape(id), nil, &exec)
+	if err == nil {
+		return &exec, nil
+	}
+	if exitCode(err) != exitNotFound {
+		return nil, err
+	}
+
+	var queue struct {
+		Builds []struct {
+			ID         string     `json:"id"`
+			PipelineID string     `json:"pipelineId"`
+			Status     string     `json:"status"`
+			StartedAt  *time.Time `json:"startedAt"`
+		} `json:"builds"`
+	}
+	if err := callService("cicd", http.MethodGet, "/api/builds", nil, &queue); err != nil {
+		return nil, err
+	}
+	for _, b := range queue.Builds {
+		if b.ID != id {
+			continue
+		}
+		if b.StartedAt == nil {
+			if b.Status == "failed" || b.Status == "cancelled" {
+				return nil, failedErrorf("build %s %s before it started", id, b.Status)
+			}
+			return nil, errNotStarted
+		}
+
+		// Executions do not record the build that started them; the
+		// pipeline's first execution since the build started is it
+		q := url.Values{}
+		q.Set("pipelineId", b.PipelineID)
+		q.Set("since", b.StartedAt.UTC().Truncate(time.Second).Format(time.RFC3339))
+		q.Set("order", "asc")
+		q.Set("limit", "1")
+		var resp struct {
+			Executions []Execution `json:"executions"`
+		}
+		if err := callService("cicd", http.MethodGet, "/api/executions?"+q.Encode(), nil, &resp); err != nil {
+			return nil, err
+		}
+		if len(resp.Executions) == 0 {
+			return nil, errNotStarted
+		}
+		return &resp.Executions[0], nil
+	}
+	return nil, &cliError{code: exitNotFound, err: fmt.Errorf("cicd-controller: build %s not found", id)}
+}
+
+func waitForExecution(id string, timeout time.Duration) (*Execution, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		exec, err := findExecution(id)
+		if !errors.Is(err, errNotStarted) {
+			return exec, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("build %s did not start within %s", id, timeout)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func buildLogs(args []string) error {
+	fs := flag.NewFlagSet("build logs", flag.ContinueOnError)
+	follow := fs.Bool("f", false, "stream the log until the build finishes")
+	fs.BoolVar(follow, "follow", false, "stream the log until the build finishes")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return usageErrorf("usage: holm build logs [-f] <execution-or-build-id>")
+	}
+
+	var exec *Execution
+	if *follow {
+		exec, err = waitForExecution(args[0], buildStartTimeout)
+	} else {
+		exec, err = findExecution(args[0])
+		if errors.Is(err, errNotStarted) {
+			err = fmt.Errorf("build %s is still queued", args[0])
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if *follow {
+		return followBuild(exec.ID)
+	}
+
+	var logs map[string]struct {
+		Stage     string         `json:"stage"`
+		CreatedAt time.Time      `json:"createdAt"`
+		Lines     []BuildLogLine `json:"lines"`
+	}
+	if err := callService("cicd", http.MethodGet, "/api/executions/"+url.PathEscape(exec.ID)+"/logs", nil, &logs); err != nil {
+		return err
+	}
+	stages := make([]string, 0, len(logs))
+	for id := range logs {
+		stages = append(stages, id)
+	}
+	sort.Slice(stages, func(i, j int) bool { return logs[stages[i]].CreatedAt.Before(logs[stages[j]].CreatedAt) })
+	lines := []BuildLogLine{}
+	for _, id := range stages {
+		for _, l := range logs[id].Lines {
+			l.Stage = logs[id].Stage
+			lines = append(lines, l)
+		}
+	}
+
+	result := struct {
+		Execution *Execution     `json:"execution"`
+		Lines     []BuildLogLine `json:"lines"`
+	}{exec, lines}
+	return emit(result, func() {
+		for _, l := range lines {
+			printBuildLine(l)
+		}
+		fmt.Printf("\nBuild %s: %s\n", exec.ID, exec.Status)
+	})
+}
+
+func printBuildLine(l BuildLogLine) {
+	fmt.Printf("%s [%s] %s\n", l.Timestamp.Local().Format("15:04:05"), l.Stage, l.Message)
+}
+
+// followBuild streams an execution's log. Lines are printed as they arrive;
+// json and yaml output print one object per line so they can be piped while
+// the build runs. A failed build returns exitFailed.
+func followBuild(execID string) error {
+	status := ""
+	err := streamService("cicd", "/api/logs-stream/"+url.PathEscape(execID), func(event, data string) (bool, error) {
+		switch event {
+		case "log":
+			var l BuildLogLine
+			if err := json.Unmarshal([]byte(data), &l); err != nil {
+				return false, nil
+			}
+			if outputFormat == "table" {
+				printBuildLine(l)
+				return false, nil
+			}
+			return false, emitLine(l)
+		case "complete":
+			var c struct {
+				Status string `json:"status"`
+			}
+			json.Unmarshal([]byte(data), &c)
+			status = c.Status
+			return true, nil
+		case "error":
+			var e struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal([]byte(data), &e)
+			return true, fmt.Errorf("cicd-controller: %s", e.Message)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	switch status {
+	case "":
+		return fmt.Errorf("log stream for %s ended before the build finished", execID)
+	case "success":
+		info("\nBuild %s succeeded\n", execID)
+		return nil
+	}
+	return failedErrorf("build %s %s", execID, status)
+}
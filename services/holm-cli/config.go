@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultProfile = "default"
+	defaultAuthURL = "http://localhost:30100"
+)
+
+// Profile is one named target: where the API lives, how to authenticate
+// and which namespace platform commands act on by default.
+type Profile struct {
+	URL       string `json:"url"`
+	AuthURL   string `json:"auth_url,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Username  string `json:"username,omitempty"`
+
+	// Platform service URLs by name (deploy, cicd, scribe, backup) for when
+	// they are not on their usual NodePorts next to URL.
+	Services map[string]string `json:"services,omitempty"`
+
+	// Either an API key, sent as a bearer token as-is, or the tokens from
+	// holm login, which are refreshed through auth-gateway when they expire.
+	APIKey       string    `json:"api_key,omitempty"`
+	AccessToken  string    `json:"access_token,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at,omitempty"`
+}
+
+func (p *Profile) authURL() string {
+	if p.AuthURL != "" {
+		return strings.TrimSuffix(p.AuthURL, "/")
+	}
+	return defaultAuthURL
+}
+
+func (p *Profile) namespace() string {
+	if p.Namespace != "" {
+		return p.Namespace
+	}
+	return "holm"
+}
+
+type Config struct {
+	CurrentProfile string              `json:"current_profile"`
+	Profiles       map[string]*Profile `json:"profiles"`
+
+	path string
+}
+
+var (
+	config      *Config
+	profileName string // Set by --profile or HOLM_PROFILE
+	profile     *Profile
+)
+
+// configPath is $HOLM_CONFIG or ~/.config/holm/config.json.
+func configPath() string {
+	if p := os.Getenv("HOLM_CONFIG"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "holm", "config.json")
+}
+
+func loadConfig() (*Config, error) {
+	c := &Config{Profiles: map[string]*Profile{}, path: configPath()}
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", c.path, err)
+	}
+	if c.Profiles == nil {
+		c.Profiles = map[string]*Profile{}
+	}
+	return c, nil
+}
+
+// save writes the config readable by the owner only, since it holds tokens.
+func (c *Config) save() error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// activeProfileName resolves --profile, then HOLM_PROFILE, then the
+// config's current profile.
+func activeProfileName() string {
+	if profileName != "" {
+		return profileName
+	}
+	if config.CurrentProfile != "" {
+		return config.CurrentProfile
+	}
+	return defaultProfile
+}
+
+// selectProfile loads the active profile. HOLM_URL still overrides the
+// profile URL so existing scripts keep working.
+func selectProfile() {
+	name := activeProfileName()
+	p, ok := config.Profiles[name]
+	if !ok {
+		p = &Profile{}
+		if profileName != "" {
+			fmt.Fprintf(os.Stderr, "Warning: profile %q not found, using defaults\n", name)
+		}
+	}
+	profile = p
+	if p.URL != "" {
+		baseURL = strings.TrimSuffix(p.URL, "/")
+	}
+	if url := os.Getenv("HOLM_URL"); url != "" {
+		baseURL = url
+	}
+}
+
+// ProfileView is a profile as shown by holm profile, without secrets.
+type ProfileView struct {
+	Name      string    `json:"name"`
+	Current   bool      `json:"current"`
+	URL       string    `json:"url"`
+	AuthURL   string    `json:"auth_url"`
+	Namespace string    `json:"namespace"`
+	Username  string    `json:"username,omitempty"`
+	Auth      string    `json:"auth"` // none, api-key, token
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+
+	Services map[string]string `json:"services"`
+}
+
+func viewProfile(name string, p *Profile) ProfileView {
+	v := ProfileView{
+		Name:      name,
+		Current:   name == activeProfileName(),
+		URL:       p.URL,
+		AuthURL:   p.authURL(),
+		Namespace: p.namespace(),
+		Username:  p.Username,
+		Auth:      "none",
+	}
+	if v.URL == "" {
+		v.URL = baseURL
+	}
+	v.Services = map[string]string{}
+	for svc := range platformServices {
+		v.Services[svc] = p.serviceURL(svc)
+	}
+	switch {
+	case p.APIKey != "":
+		v.Auth = "api-key"
+	case p.RefreshToken != "":
+		v.Auth = "token"
+		v.ExpiresAt = p.ExpiresAt
+	}
+	return v
+}
+
+// profileKeys are the settings holm profile set accepts.
+var profileKeys = map[string]func(p *Profile, v string){
+	"url":       func(p *Profile, v string) { p.URL = v },
+	"auth_url":  func(p *Profile, v string) { p.AuthURL = v },
+	"namespace": func(p *Profile, v string) { p.Namespace = v },
+	"username":  func(p *Profile, v string) { p.Username = v },
+	"api_key":   func(p *Profile, v string) { p.APIKey = v },
+}
+
+func init() {
+	for svc := range platformServices {
+		svc := svc
+		profileKeys[svc+"_url"] = func(p *Profile, v string) {
+			if p.Services == nil {
+				p.Services = map[string]string{}
+			}
+			if v == "" {
+				delete(p.Services, svc)
+				return
+			}
+			p.Services[svc] = v
+		}
+	}
+}
+
+func cmdProfile(args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	switch args[0] {
+	case "list", "ls":
+		names := make([]string, 0, len(config.Profiles))
+		for name := range config.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		views := make([]ProfileView, 0, len(names))
+		for _, name := range names {
+			views = append(views, viewProfile(name, config.Profiles[name]))
+		}
+		return emit(views, func() {
+			if len(views) == 0 {
+				fmt.Printf("No profiles configured (%s)\n", config.path)
+				return
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(w, "CURRENT\tNAME\tURL\tNAMESPACE\tAUTH\n")
+			for _, v := range views {
+				mark := ""
+				if v.Current {
+					mark = "*"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", mark, v.Name, v.URL, v.Namespace, v.Auth)
+			}
+			w.Flush()
+		})
+
+	case "show":
+		name := activeProfileName()
+		if len(args) > 1 {
+			name = args[1]
+		}
+		p, ok := config.Profiles[name]
+		if !ok {
+			return fmt.Errorf("profile %q not found", name)
+		}
+		v := viewProfile(name, p)
+		return emit(v, func() {
+			fmt.Printf("Profile:   %s\n", v.Name)
+			fmt.Printf("URL:       %s\n", v.URL)
+			fmt.Printf("Auth URL:  %s\n", v.AuthURL)
+			fmt.Printf("Namespace: %s\n", v.Namespace)
+			if v.Username != "" {
+				fmt.Printf("Username:  %s\n", v.Username)
+			}
+			fmt.Printf("Auth:      %s\n", v.Auth)
+			if !v.ExpiresAt.IsZero() {
+				fmt.Printf("Expires:   %s\n", v.ExpiresAt.Local().Format(time.RFC1123))
+			}
+			names := make([]string, 0, len(v.Services))
+			for svc := range v.Services {
+				names = append(names, svc)
+			}
+			sort.Strings(names)
+			for _, svc := range names {
+				fmt.Printf("%-10s %s\n", svc+":", v.Services[svc])
+			}
+		})
+
+	case "use":
+		if len(args) < 2 {
+			return usageErrorf("usage: holm profile use <name>")
+		}
+		if _, ok := config.Profiles[args[1]]; !ok {
+			return fmt.Errorf("profile %q not found", args[1])
+		}
+		config.CurrentProfile = args[1]
+		if err := config.save(); err != nil {
+			return err
+		}
+		info("Switched to profile %s\n", args[1])
+		return nil
+
+	case "set":
+		// holm profile set <key> <value>, applied to the active profile
+		if len(args) < 3 {
+			return usageErrorf("usage: holm profile set <url|auth_url|namespace|username|api_key|deploy_url|cicd_url|scribe_url|backup_url> <value>")
+		}
+		set, ok := profileKeys[args[1]]
+		if !ok {
+			return fmt.Errorf("unknown setting %q", args[1])
+		}
+		name := activeProfileName()
+		p, exists := config.Profiles[name]
+		if !exists {
+			p = &Profile{}
+			config.Profiles[name] = p
+		}
+		set(p, args[2])
+		if config.CurrentProfile == "" {
+			config.CurrentProfile = name
+		}
+		if err := config.save(); err != nil {
+			return err
+		}
+		info("Set %s on profile %s\n", args[1], name)
+		return nil
+
+	case "delete", "rm":
+		if len(args) < 2 {
+			return usageErrorf("usage: holm profile delete <name>")
+		}
+		if _, ok := config.Profiles[args[1]]; !ok {
+			return fmt.Errorf("profile %q not found", args[1])
+		}
+		delete(config.Profiles, args[1])
+		if config.CurrentProfile == args[1] {
+			config.CurrentProfile = ""
+		}
+		if err := config.save(); err != nil {
+			return err
+		}
+		info("Deleted profile %s\n", args[1])
+		return nil
+	}
+	return usageErrorf("usage: holm profile [list|show|use|set|delete]")
+}
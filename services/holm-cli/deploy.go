@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Deployment is one entry of deploy-controller's /api/deployments.
+type Deployment struct {
+	Name       string    `json:"name"`
+	Namespace  string    `json:"namespace"`
+	Image      string    `json:"image"`
+	Status     string    `json:"status"`
+	LastDeploy time.Time `json:"lastDeploy"`
+	AutoDeploy bool      `json:"autoDeploy"`
+	Replicas   int32     `json:"replicas"`
+	Ready      int32     `json:"ready"`
+}
+
+// DeployResult is printed by deploy, rollback and scale.
+type DeployResult struct {
+	Action     string `json:"action"`
+	Deployment string `json:"deployment"`
+	Namespace  string `json:"namespace"`
+	Image      string `json:"image,omitempty"`
+	FromImage  string `json:"from_image,omitempty"`
+	Version    int    `json:"version,omitempty"`
+	Replicas   *int32 `json:"replicas,omitempty"`
+}
+
+// holm deploy list | holm deploy <deployment> <image>
+func cmdDeploy(args []string) error {
+	fs := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	ns := namespaceFlag(fs)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 || args[0] == "list" || args[0] == "ls" {
+		return deployList(*ns)
+	}
+	if len(args) < 2 {
+		return usageErrorf("usage: holm deploy <deployment> <image>  |  holm deploy list")
+	}
+
+	req := map[string]string{"deployment": args[0], "namespace": *ns, "image": args[1]}
+	if err := callService("deploy", http.MethodPost, "/api/deploy", req, nil); err != nil {
+		return err
+	}
+
+	result := DeployResult{Action: "deployed", Deployment: args[0], Namespace: *ns, Image: args[1]}
+	return emit(result, func() {
+		fmt.Printf("Deploying %s to %s/%s\n", args[1], *ns, args[0])
+	})
+}
+
+func deployList(namespace string) error {
+	var deps []Deployment
+	if err := callService("deploy", http.MethodGet, "/api/deployments?namespace="+url.QueryEscape(namespace), nil, &deps); err != nil {
+		return err
+	}
+	// deploy-controller tracks every namespace it watches
+	list := make([]Deployment, 0, len(deps))
+	for _, d := range deps {
+		if d.Namespace == "" || d.Namespace == namespace {
+			list = append(list, d)
+		}
+	}
+
+	return emit(list, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "NAME\tREADY\tSTATUS\tIMAGE\n")
+		for _, d := range list {
+			fmt.Fprintf(w, "%s\t%d/%d\t%s\t%s\n", d.Name, d.Ready, d.Replicas, d.Status, d.Image)
+		}
+		w.Flush()
+	})
+}
+
+func cmdRollback(args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	ns := namespaceFlag(fs)
+	version := fs.Int("to-version", 0, "roll back to this history version")
+	image := fs.String("to-image", "", "roll back to this image")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return usageErrorf("usage: holm rollback <deployment> [--to-version N | --to-image IMAGE]")
+	}
+
+	req := map[string]interface{}{"deployment": args[0], "namespace": *ns}
+	if *version > 0 {
+		req["version"] = *version
+	}
+	if *image != "" {
+		req["toImage"] = *image
+	}
+
+	var resp struct {
+		FromImage       string `json:"fromImage"`
+		ToImage         string `json:"toImage"`
+		RollbackVersion int    `json:"rollbackVersion"`
+	}
+	if err := callService("deploy", http.MethodPost, "/api/rollback", req, &resp); err != nil {
+		return err
+	}
+
+	result := DeployResult{
+		Action:     "rolled back",
+		Deployment: args[0],
+		Namespace:  *ns,
+		Image:      resp.ToImage,
+		FromImage:  resp.FromImage,
+		Version:    resp.RollbackVersion,
+	}
+	return emit(result, func() {
+		fmt.Printf("Rolling back %s/%s: %s -> %s\n", *ns, args[0], resp.FromImage, resp.ToImage)
+	})
+}
+
+func cmdScale(args []string) error {
+	fs := flag.NewFlagSet("scale", flag.ContinueOnError)
+	ns := namespaceFlag(fs)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 2 {
+		return usageErrorf("usage: holm scale <deployment> <replicas>")
+	}
+	n, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil || n < 0 {
+		return usageErrorf("replicas must be a number >= 0, got %q", args[1])
+	}
+	replicas := int32(n)
+
+	req := map[string]interface{}{"deployment": args[0], "namespace": *ns, "replicas": replicas}
+	if err := callService("deploy", http.MethodPost, "/api/scale", req, nil); err != nil {
+		return err
+	}
+
+	result := DeployResult{Action: "scaled", Deployment: args[0], Namespace: *ns, Replicas: &replicas}
+	return emit(result, func() {
+		fmt.Printf("Scaled %s/%s to %d replicas\n", *ns, args[0], replicas)
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogEntry is a log line collected by scribe.
+type LogEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	Level     string    `json:"level"`
+	Message   string    `json:"message"`
+}
+
+type logFilter struct {
+	namespace *string
+	all       *bool
+	pod       *string
+	level     *string
+}
+
+func logFlags(fs *flag.FlagSet) logFilter {
+	f := logFilter{namespace: namespaceFlag(fs)}
+	f.all = fs.Bool("A", false, "all namespaces")
+	fs.BoolVar(f.all, "all-namespaces", false, "all namespaces")
+	f.pod = fs.String("pod", "", "only pods whose name contains this")
+	f.level = fs.String("level", "", "only this level (ERROR, WARN, INFO, DEBUG)")
+	return f
+}
+
+func (f logFilter) query() url.Values {
+	q := url.Values{}
+	if !*f.all && *f.namespace != "" {
+		q.Set("namespace", *f.namespace)
+	}
+	if *f.pod != "" {
+		q.Set("pod", *f.pod)
+	}
+	if *f.level != "" {
+		q.Set("level", strings.ToUpper(*f.level))
+	}
+	return q
+}
+
+func cmdLogs(args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("usage: holm logs [search|tail]")
+	}
+	switch args[0] {
+	case "search":
+		return logsSearch(args[1:])
+	case "tail":
+		return logsTail(args[1:])
+	}
+	return usageErrorf("usage: holm logs [search|tail]")
+}
+
+func logsSearch(args []string) error {
+	fs := flag.NewFlagSet("logs search", flag.ContinueOnError)
+	filter := logFlags(fs)
+	regex := fs.Bool("regex", false, "treat the query as a regular expression")
+	limit := fs.Int("limit", 100, "maximum number of entries")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return usageErrorf("usage: holm logs search <query> [--pod P] [--level L] [--regex] [--limit N]")
+	}
+
+	q := filter.query()
+	q.Set("q", strings.Join(args, " "))
+	q.Set("limit", strconv.Itoa(*limit))
+	if *regex {
+		q.Set("regex", "true")
+	}
+	return fetchLogs("/api/logs/search?"+q.Encode(), *limit)
+}
+
+func logsTail(args []string) error {
+	fs := flag.NewFlagSet("logs tail", flag.ContinueOnError)
+	filter := logFlags(fs)
+	lines := fs.Int("lines", 50, "number of recent entries to show")
+	follow := fs.Bool("f", false, "keep streaming new entries")
+	fs.BoolVar(follow, "follow", false, "keep streaming new entries")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	q := filter.query()
+	if !*follow {
+		q.Set("limit", strconv.Itoa(*lines))
+		return fetchLogs("/api/logs/tail?"+q.Encode(), *lines)
+	}
+
+	// The stream only carries new entries, so print the backlog first
+	if *lines > 0 {
+		backlog := filter.query()
+		backlog.Set("limit", strconv.Itoa(*lines))
+		entries, err := getLogs("/api/logs/tail?" + backlog.Encode())
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := printLogEntry(e); err != nil {
+				return err
+			}
+		}
+	}
+	return streamService("scribe", "/api/logs/stream?"+q.Encode(), func(event, data string) (bool, error) {
+		var e LogEntry
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return false, nil
+		}
+		return false, printLogEntry(e)
+	})
+}
+
+// getLogs returns entries oldest first; scribe sends the newest first.
+func getLogs(path string) ([]LogEntry, error) {
+	var resp struct {
+		Entries []LogEntry `json:"entries"`
+	}
+	if err := callService("scribe", http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	entries := resp.Entries
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if entries == nil {
+		entries = []LogEntry{}
+	}
+	return entries, nil
+}
+
+func fetchLogs(path string, limit int) error {
+	entries, err := getLogs(path)
+	if err != nil {
+		return err
+	}
+	return emit(entries, func() {
+		for _, e := range entries {
+			printLogEntry(e)
+		}
+		if len(entries) == limit {
+			fmt.Printf("(showing the latest %d entries)\n", limit)
+		}
+	})
+}
+
+func printLogEntry(e LogEntry) error {
+	if outputFormat != "table" {
+		return emitLine(e)
+	}
+	fmt.Printf("%s %-5s %s/%s  %s\n", e.Timestamp.Local().Format("2006-01-02 15:04:05"), e.Level, e.Namespace, e.Pod, e.Message)
+	return nil
+}
@@ -16,19 +16,36 @@ import (
 var baseURL = "http://localhost:30088"
 
 func main() {
-	if url := os.Getenv("HOLM_URL"); url != "" {
-		baseURL = url
+	outputFormat = os.Getenv("HOLM_OUTPUT")
+	profileName = os.Getenv("HOLM_PROFILE")
+
+	args, err := extractGlobalFlags(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	if outputFormat == "" {
+		outputFormat = "table"
+	}
+	if !validOutput(outputFormat) {
+		fmt.Fprintf(os.Stderr, "Error: unknown output format %q (json, yaml or table)\n", outputFormat)
+		os.Exit(exitUsage)
 	}
 
-	if len(os.Args) < 2 {
+	if config, err = loadConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	selectProfile()
+
+	if len(args) < 1 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	cmd := os.Args[1]
-	args := os.Args[2:]
+	cmd := args[0]
+	args = args[1:]
 
-	var err error
 	switch cmd {
 	case "ls", "list":
 		err = cmdList(args)
@@ -44,42 +61,154 @@ func main() {
 		err = cmdMove(args)
 	case "cp", "copy":
 		err = cmdCopy(args)
+	case "sync":
+		err = cmdSync(args)
+	case "mount":
+		err = cmdMount(args)
 	case "stat", "meta":
 		err = cmdMeta(args)
 	case "find", "search":
 		err = cmdSearch(args)
+	case "login":
+		err = cmdLogin(args)
+	case "logout":
+		err = cmdLogout(args)
+	case "profile", "profiles":
+		err = cmdProfile(args)
+	case "deploy":
+		err = cmdDeploy(args)
+	case "rollback":
+		err = cmdRollback(args)
+	case "scale":
+		err = cmdScale(args)
+	case "build", "builds":
+		err = cmdBuild(args)
+	case "logs":
+		err = cmdLogs(args)
+	case "backup", "backups":
+		err = cmdBackup(args)
 	case "help":
 		printUsage()
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", cmd)
 		printUsage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
+	}
+}
+
+// extractGlobalFlags removes --output/-o and --profile from anywhere in the
+// arguments, so they work before or after the command.
+func extractGlobalFlags(args []string) ([]string, error) {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		var target *string
+		switch {
+		case a == "-o" || a == "--output":
+			target = &outputFormat
+		case a == "--profile":
+			target = &profileName
+		case strings.HasPrefix(a, "--output="):
+			outputFormat = strings.TrimPrefix(a, "--output=")
+			continue
+		case strings.HasPrefix(a, "--profile="):
+			profileName = strings.TrimPrefix(a, "--profile=")
+			continue
+		default:
+			rest = append(rest, a)
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("%s needs a value", a)
+		}
+		i++
+		*target = args[i]
 	}
+	return rest, nil
 }
 
 func printUsage() {
-	fmt.Println(`Holm File Storage CLI
+	fmt.Println(`HolmOS CLI
 
 Usage: holm <command> [arguments]
 
 Commands:
   ls [path]              List files in directory
   get <path> [local]     Download file to local path
+  get -r <dir> [local]   Download a directory tree
   put <local> [path]     Upload local file to remote path
+  put -r <dir> [path]    Upload a directory tree
   rm <path>              Delete file or directory
   mkdir <path>           Create directory
   mv <src> <dst>         Move/rename file or directory
   cp <src> <dst>         Copy file
   stat <path>            Get file metadata
   find <query> [path]    Search for files
+  sync <local> holm:<remote>
+                         Make remote match local (reverse the arguments to
+                         make local match remote)
+  mount <dir> [remote]   Mount remote storage on a local directory (FUSE;
+                         --read-only, --attr-ttl 5s, --read-ahead KB)
+
+Transfer flags (sync, get -r, put -r):
+  -n, --dry-run          Show what would change without doing it
+  -j, --jobs N           Parallel transfers (default 4)
+  --exclude PATTERN      Skip matching files; repeatable
+  --exclude-from FILE    Read exclude patterns from FILE
+  --delete               sync only: remove target files missing on the source
+  -c, --checksum         sync only: compare SHA-256 when sizes match
+
+  Patterns in .holmignore at the local root are always excluded.
+
+Platform:
+  deploy list            List deployments in the namespace
+  deploy <name> <image>  Deploy an image
+  rollback <name>        Roll back to the previous good image
+                         (--to-version N or --to-image IMAGE to choose)
+  scale <name> <n>       Set the replica count
+  build list             Recent pipeline runs
+  build trigger <pipeline> [--branch B] [-f]
+                         Queue a pipeline run; -f follows its log
+  build logs [-f] <id>   Show or follow a run's log (run or build ID)
+  logs search <query>    Search collected logs (--pod, --level, --regex)
+  logs tail [-f]         Latest log entries; -f keeps streaming
+  backup list            List backups
+  backup run <name>      Take a manual backup (--type, --target, --encrypt)
+  backup restore <id>    Restore a backup (--target, --verify-only, --wait)
+
+  Platform commands act on the profile's namespace; -n/--namespace picks
+  another, and logs -A searches all of them.
+
+Account:
+  login [-u user]        Log in through auth-gateway and store tokens
+  login --api-key KEY    Store an API key in the profile instead
+  logout                 Forget the profile's credentials
+  profile [list]         List profiles
+  profile show [name]    Show a profile
+  profile use <name>     Make a profile current
+  profile set <key> <v>  Set url, auth_url, namespace, username, api_key or
+                         deploy_url, cicd_url, scribe_url, backup_url
+  profile delete <name>  Remove a profile
+
+Global flags:
+  -o, --output FORMAT    table (default), json or yaml
+  --profile NAME         Use a profile other than the current one
 
 Environment:
-  HOLM_URL               Base URL (default: http://localhost:30088)
+  HOLM_URL               Base URL, overrides the profile (default: http://localhost:30088)
+  HOLM_PROFILE           Profile to use
+  HOLM_OUTPUT            Default output format
+  HOLM_TOKEN             Bearer token, overrides the profile's credentials
+  HOLM_CONFIG            Config file (default: ~/.config/holm/config.json)
+
+Exit codes:
+  0 success, 1 error, 2 bad usage, 3 not found, 4 not authorized,
+  5 the operation failed (build, restore, backup, transfer)
 
 Examples:
   holm ls
@@ -87,7 +216,30 @@ Examples:
   holm put ./file.txt uploads/file.txt
   holm get uploads/file.txt ./downloaded.txt
   holm mkdir projects/new-project
-  holm find "*.go" src`)
+  holm find "*.go" src
+  holm --profile prod login -u admin --url http://gateway:30088
+  holm ls -o json | jq '.files[].name'
+  holm sync --delete ./project holm:backups/project
+  holm sync -n holm:backups/project ./restore
+  holm build trigger default -f && holm deploy api registry:31500/api:v2
+  holm logs search timeout --level error -o json`)
+}
+
+// FileEntry is one item of a directory listing or search result.
+type FileEntry struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	IsDir   bool   `json:"is_dir"`
+	ModTime string `json:"mod_time,omitempty"`
+}
+
+// Result is printed by commands that change a single path.
+type Result struct {
+	Action string `json:"action"`
+	Path   string `json:"path"`
+	Dest   string `json:"dest,omitempty"`
+	Size   int64  `json:"size,omitempty"`
 }
 
 func cmdList(args []string) error {
@@ -96,47 +248,48 @@ func cmdList(args []string) error {
 		path = args[0]
 	}
 
-	resp, err := http.Get(baseURL + "/api/v1/files/" + path)
+	resp, err := apiGet(baseURL + "/api/v1/files/" + path)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	var result struct {
-		Path  string `json:"path"`
-		Files []struct {
-			Name    string `json:"name"`
-			Path    string `json:"path"`
-			Size    int64  `json:"size"`
-			IsDir   bool   `json:"is_dir"`
-			ModTime string `json:"mod_time"`
-		} `json:"files"`
-		Count int `json:"count"`
+		Path  string      `json:"path"`
+		Files []FileEntry `json:"files"`
+		Count int         `json:"count"`
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return err
 	}
-
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintf(w, "TYPE\tSIZE\tNAME\n")
-	for _, f := range result.Files {
-		ftype := "file"
-		size := formatSize(f.Size)
-		if f.IsDir {
-			ftype = "dir"
-			size = "-"
+	if result.Files == nil {
+		result.Files = []FileEntry{}
+	}
+
+	return emit(result, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "TYPE\tSIZE\tNAME\n")
+		for _, f := range result.Files {
+			ftype := "file"
+			size := formatSize(f.Size)
+			if f.IsDir {
+				ftype = "dir"
+				size = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", ftype, size, f.Name)
 		}
-		fmt.Fprintf(w, "%s\t%s\t%s\n", ftype, size, f.Name)
-	}
-	w.Flush()
-	fmt.Printf("\nTotal: %d items\n", result.Count)
-	return nil
+		w.Flush()
+		fmt.Printf("\nTotal: %d items\n", result.Count)
+	})
 }
 
 func cmdDownload(args []string) error {
+	if hasRecursiveFlag(args) {
+		return cmdGetRecursive(args)
+	}
 	if len(args) < 1 {
-		return fmt.Errorf("usage: holm get <remote-path> [local-path]")
+		return usageErrorf("usage: holm get <remote-path> [local-path]")
 	}
 
 	remotePath := args[0]
@@ -145,7 +298,7 @@ func cmdDownload(args []string) error {
 		localPath = args[1]
 	}
 
-	resp, err := http.Get(baseURL + "/api/v1/download/" + remotePath)
+	resp, err := apiGet(baseURL + "/api/v1/download/" + remotePath)
 	if err != nil {
 		return err
 	}
@@ -167,13 +320,18 @@ func cmdDownload(args []string) error {
 		return err
 	}
 
-	fmt.Printf("Downloaded %s (%s)\n", localPath, formatSize(written))
-	return nil
+	result := Result{Action: "downloaded", Path: remotePath, Dest: localPath, Size: written}
+	return emit(result, func() {
+		fmt.Printf("Downloaded %s (%s)\n", localPath, formatSize(written))
+	})
 }
 
 func cmdUpload(args []string) error {
+	if hasRecursiveFlag(args) {
+		return cmdPutRecursive(args)
+	}
 	if len(args) < 1 {
-		return fmt.Errorf("usage: holm put <local-path> [remote-path]")
+		return usageErrorf("usage: holm put <local-path> [remote-path]")
 	}
 
 	localPath := args[0]
@@ -207,7 +365,7 @@ func cmdUpload(args []string) error {
 
 	writer.Close()
 
-	resp, err := http.Post(baseURL+"/api/v1/upload", writer.FormDataContentType(), &buf)
+	resp, err := apiPost(baseURL+"/api/v1/upload", writer.FormDataContentType(), bytes.NewReader(buf.Bytes()))
 	if err != nil {
 		return err
 	}
@@ -225,13 +383,14 @@ func cmdUpload(args []string) error {
 		return fmt.Errorf("upload failed: %s", result.Error)
 	}
 
-	fmt.Printf("Uploaded %s (%s)\n", result.Path, formatSize(result.Size))
-	return nil
+	return emit(Result{Action: "uploaded", Path: result.Path, Size: result.Size}, func() {
+		fmt.Printf("Uploaded %s (%s)\n", result.Path, formatSize(result.Size))
+	})
 }
 
 func cmdDelete(args []string) error {
 	if len(args) < 1 {
-		return fmt.Errorf("usage: holm rm <path>")
+		return usageErrorf("usage: holm rm <path>")
 	}
 
 	path := args[0]
@@ -243,7 +402,7 @@ func cmdDelete(args []string) error {
 	}
 
 	req, _ := http.NewRequest("DELETE", url, nil)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := apiDo(req)
 	if err != nil {
 		return err
 	}
@@ -259,16 +418,17 @@ func cmdDelete(args []string) error {
 		return fmt.Errorf("delete failed: %s", result.Error)
 	}
 
-	fmt.Printf("Deleted %s\n", path)
-	return nil
+	return emit(Result{Action: "deleted", Path: path}, func() {
+		fmt.Printf("Deleted %s\n", path)
+	})
 }
 
 func cmdMkdir(args []string) error {
 	if len(args) < 1 {
-		return fmt.Errorf("usage: holm mkdir <path>")
+		return usageErrorf("usage: holm mkdir <path>")
 	}
 
-	resp, err := http.Post(baseURL+"/api/v1/mkdir/"+args[0], "application/json", nil)
+	resp, err := apiPost(baseURL+"/api/v1/mkdir/"+args[0], "application/json", nil)
 	if err != nil {
 		return err
 	}
@@ -284,13 +444,14 @@ func cmdMkdir(args []string) error {
 		return fmt.Errorf("mkdir failed: %s", result.Error)
 	}
 
-	fmt.Printf("Created directory %s\n", args[0])
-	return nil
+	return emit(Result{Action: "created", Path: args[0]}, func() {
+		fmt.Printf("Created directory %s\n", args[0])
+	})
 }
 
 func cmdMove(args []string) error {
 	if len(args) < 2 {
-		return fmt.Errorf("usage: holm mv <source> <dest>")
+		return usageErrorf("usage: holm mv <source> <dest>")
 	}
 
 	body, _ := json.Marshal(map[string]string{
@@ -298,7 +459,7 @@ func cmdMove(args []string) error {
 		"dest":   args[1],
 	})
 
-	resp, err := http.Post(baseURL+"/api/v1/move", "application/json", bytes.NewReader(body))
+	resp, err := apiPost(baseURL+"/api/v1/move", "application/json", bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
@@ -314,13 +475,14 @@ func cmdMove(args []string) error {
 		return fmt.Errorf("move failed: %s", result.Error)
 	}
 
-	fmt.Printf("Moved %s -> %s\n", args[0], args[1])
-	return nil
+	return emit(Result{Action: "moved", Path: args[0], Dest: args[1]}, func() {
+		fmt.Printf("Moved %s -> %s\n", args[0], args[1])
+	})
 }
 
 func cmdCopy(args []string) error {
 	if len(args) < 2 {
-		return fmt.Errorf("usage: holm cp <source> <dest>")
+		return usageErrorf("usage: holm cp <source> <dest>")
 	}
 
 	body, _ := json.Marshal(map[string]string{
@@ -328,7 +490,7 @@ func cmdCopy(args []string) error {
 		"dest":   args[1],
 	})
 
-	resp, err := http.Post(baseURL+"/api/v1/copy", "application/json", bytes.NewReader(body))
+	resp, err := apiPost(baseURL+"/api/v1/copy", "application/json", bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
@@ -345,16 +507,17 @@ func cmdCopy(args []string) error {
 		return fmt.Errorf("copy failed: %s", result.Error)
 	}
 
-	fmt.Printf("Copied %s -> %s (%s)\n", args[0], args[1], formatSize(result.Size))
-	return nil
+	return emit(Result{Action: "copied", Path: args[0], Dest: args[1], Size: result.Size}, func() {
+		fmt.Printf("Copied %s -> %s (%s)\n", args[0], args[1], formatSize(result.Size))
+	})
 }
 
 func cmdMeta(args []string) error {
 	if len(args) < 1 {
-		return fmt.Errorf("usage: holm stat <path>")
+		return usageErrorf("usage: holm stat <path>")
 	}
 
-	resp, err := http.Get(baseURL + "/api/v1/meta/" + args[0] + "?checksum=true")
+	resp, err := apiGet(baseURL + "/api/v1/meta/" + args[0] + "?checksum=true")
 	if err != nil {
 		return err
 	}
@@ -369,8 +532,8 @@ func cmdMeta(args []string) error {
 			IsDir    bool   `json:"is_dir"`
 			Mode     string `json:"mode"`
 			ModTime  string `json:"mod_time"`
-			Checksum string `json:"checksum"`
-			Mime     string `json:"mime"`
+			Checksum string `json:"checksum,omitempty"`
+			Mime     string `json:"mime,omitempty"`
 		} `json:"meta"`
 		Error string `json:"error"`
 	}
@@ -381,24 +544,25 @@ func cmdMeta(args []string) error {
 	}
 
 	m := result.Meta
-	fmt.Printf("Path:     %s\n", m.Path)
-	fmt.Printf("Name:     %s\n", m.Name)
-	fmt.Printf("Size:     %s (%d bytes)\n", formatSize(m.Size), m.Size)
-	fmt.Printf("Type:     %s\n", map[bool]string{true: "directory", false: "file"}[m.IsDir])
-	fmt.Printf("Mode:     %s\n", m.Mode)
-	fmt.Printf("Modified: %s\n", m.ModTime)
-	if m.Mime != "" {
-		fmt.Printf("MIME:     %s\n", m.Mime)
-	}
-	if m.Checksum != "" {
-		fmt.Printf("SHA256:   %s\n", m.Checksum)
-	}
-	return nil
+	return emit(m, func() {
+		fmt.Printf("Path:     %s\n", m.Path)
+		fmt.Printf("Name:     %s\n", m.Name)
+		fmt.Printf("Size:     %s (%d bytes)\n", formatSize(m.Size), m.Size)
+		fmt.Printf("Type:     %s\n", map[bool]string{true: "directory", false: "file"}[m.IsDir])
+		fmt.Printf("Mode:     %s\n", m.Mode)
+		fmt.Printf("Modified: %s\n", m.ModTime)
+		if m.Mime != "" {
+			fmt.Printf("MIME:     %s\n", m.Mime)
+		}
+		if m.Checksum != "" {
+			fmt.Printf("SHA256:   %s\n", m.Checksum)
+		}
+	})
 }
 
 func cmdSearch(args []string) error {
 	if len(args) < 1 {
-		return fmt.Errorf("usage: holm find <query> [path]")
+		return usageErrorf("usage: holm find <query> [path]")
 	}
 
 	query := args[0]
@@ -412,43 +576,42 @@ func cmdSearch(args []string) error {
 		url += "&path=" + path
 	}
 
-	resp, err := http.Get(url)
+	resp, err := apiGet(url)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	var result struct {
-		Success bool `json:"success"`
-		Results []struct {
-			Path  string `json:"path"`
-			Name  string `json:"name"`
-			Size  int64  `json:"size"`
-			IsDir bool   `json:"is_dir"`
-		} `json:"results"`
-		Count int    `json:"count"`
-		Error string `json:"error"`
+		Success bool        `json:"success"`
+		Results []FileEntry `json:"results"`
+		Count   int         `json:"count"`
+		Error   string      `json:"error,omitempty"`
 	}
 	json.NewDecoder(resp.Body).Decode(&result)
 
 	if !result.Success {
 		return fmt.Errorf("search failed: %s", result.Error)
 	}
-
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintf(w, "TYPE\tSIZE\tPATH\n")
-	for _, f := range result.Results {
-		ftype := "file"
-		size := formatSize(f.Size)
-		if f.IsDir {
-			ftype = "dir"
-			size = "-"
+	if result.Results == nil {
+		result.Results = []FileEntry{}
+	}
+
+	return emit(result, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "TYPE\tSIZE\tPATH\n")
+		for _, f := range result.Results {
+			ftype := "file"
+			size := formatSize(f.Size)
+			if f.IsDir {
+				ftype = "dir"
+				size = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", ftype, size, f.Path)
 		}
-		fmt.Fprintf(w, "%s\t%s\t%s\n", ftype, size, f.Path)
-	}
-	w.Flush()
-	fmt.Printf("\nFound: %d results\n", result.Count)
-	return nil
+		w.Flush()
+		fmt.Printf("\nFound: %d results\n", result.Count)
+	})
 }
 
 func formatSize(bytes int64) string {
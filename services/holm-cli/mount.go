@@ -0,0 +1,636 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// holmFS maps a remote directory onto a FUSE mount. Directory listings are
+// cached for attrTTL and shared by lookups, getattr and readdir, so walking
+// a tree costs one listing per directory rather than one request per file.
+type holmFS struct {
+	root      string // Remote directory at the mount point
+	attrTTL   time.Duration
+	readAhead int64
+	readOnly  bool
+	uid, gid  uint32
+
+	mu   sync.Mutex
+	dirs map[string]*dirListing
+}
+
+type dirListing struct {
+	entries map[string]remoteEntry
+	names   []string
+	fetched time.Time
+}
+
+func (h *holmFS) remotePath(rel string) string {
+	return strings.Trim(path.Join(h.root, rel), "/")
+}
+
+// list returns a directory listing, fetching it when the cached copy is
+// older than attrTTL.
+func (h *holmFS) list(dir string) (*dirListing, error) {
+	h.mu.Lock()
+	l, ok := h.dirs[dir]
+	h.mu.Unlock()
+	if ok && time.Since(l.fetched) < h.attrTTL {
+		return l, nil
+	}
+
+	entries, err := listRemote(h.remotePath(dir))
+	if err != nil {
+		return nil, err
+	}
+	l = &dirListing{entries: make(map[string]remoteEntry, len(entries)), fetched: time.Now()}
+	for _, e := range entries {
+		l.entries[e.Name] = e
+		l.names = append(l.names, e.Name)
+	}
+	h.mu.Lock()
+	h.dirs[dir] = l
+	h.mu.Unlock()
+	return l, nil
+}
+
+// invalidate drops cached listings after a change so the next lookup sees
+// the server's view.
+func (h *holmFS) invalidate(dirs ...string) {
+	h.mu.Lock()
+	for _, d := range dirs {
+		delete(h.dirs, d)
+	}
+	h.mu.Unlock()
+}
+
+// parentDir is the listing key of rel's directory; the mount root is "".
+func parentDir(rel string) string {
+	dir, _ := path.Split(rel)
+	return strings.TrimSuffix(dir, "/")
+}
+
+// lookup finds one entry through its parent's listing.
+func (h *holmFS) lookup(rel string) (remoteEntry, error) {
+	l, err := h.list(parentDir(rel))
+	if err != nil {
+		return remoteEntry{}, err
+	}
+	e, ok := l.entries[path.Base(rel)]
+	if !ok {
+		return remoteEntry{}, os.ErrNotExist
+	}
+	return e, nil
+}
+
+func (h *holmFS) fillAttr(e remoteEntry, out *fuse.Attr) {
+	if e.IsDir {
+		out.Mode = syscall.S_IFDIR | 0755
+		out.Nlink = 2
+	} else {
+		out.Mode = syscall.S_IFREG | 0644
+		out.Nlink = 1
+		out.Size = uint64(e.Size)
+		out.Blocks = (out.Size + 511) / 512
+	}
+	if h.readOnly {
+		out.Mode &^= 0222
+	}
+	t := e.modTime()
+	out.SetTimes(&t, &t, &t)
+	out.Owner = fuse.Owner{Uid: h.uid, Gid: h.gid}
+}
+
+// toErrno maps client errors onto what the kernel expects.
+func toErrno(err error) syscall.Errno {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, os.ErrNotExist):
+		return syscall.ENOENT
+	case exitCode(err) == exitAuth:
+		return syscall.EACCES
+	}
+	fmt.Fprintf(os.Stderr, "holm mount: %v\n", err)
+	return syscall.EIO
+}
+
+// holmNode is a file or directory. Its remote path is derived from the
+// inode tree on each call, so renames need no bookkeeping here.
+type holmNode struct {
+	fs.Inode
+	h *holmFS
+
+	mu     sync.Mutex
+	writer *holmFile // Open handle with buffered writes, if any
+}
+
+var (
+	_ fs.NodeGetattrer = (*holmNode)(nil)
+	_ fs.NodeSetattrer = (*holmNode)(nil)
+	_ fs.NodeLookuper  = (*holmNode)(nil)
+	_ fs.NodeReaddirer = (*holmNode)(nil)
+	_ fs.NodeOpener    = (*holmNode)(nil)
+	_ fs.NodeCreater   = (*holmNode)(nil)
+	_ fs.NodeMkdirer   = (*holmNode)(nil)
+	_ fs.NodeUnlinker  = (*holmNode)(nil)
+	_ fs.NodeRmdirer   = (*holmNode)(nil)
+	_ fs.NodeRenamer   = (*holmNode)(nil)
+)
+
+func (n *holmNode) rel() string {
+	return n.Path(n.Root())
+}
+
+func (n *holmNode) child(name string) string {
+	return path.Join(n.rel(), name)
+}
+
+func (n *holmNode) newChild(ctx context.Context, e remoteEntry, out *fuse.EntryOut) *fs.Inode {
+	mode := uint32(syscall.S_IFREG)
+	if e.IsDir {
+		mode = syscall.S_IFDIR
+	}
+	n.h.fillAttr(e, &out.Attr)
+	out.SetEntryTimeout(n.h.attrTTL)
+	out.SetAttrTimeout(n.h.attrTTL)
+	return n.NewInode(ctx, &holmNode{h: n.h}, fs.StableAttr{Mode: mode})
+}
+
+func (n *holmNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.SetTimeout(n.h.attrTTL)
+	if n.IsRoot() {
+		n.h.fillAttr(remoteEntry{IsDir: true}, &out.Attr)
+		return 0
+	}
+	e, err := n.h.lookup(n.rel())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return toErrno(err)
+	}
+
+	// Buffered writes are not on the server yet; report the local size
+	n.mu.Lock()
+	w := n.writer
+	n.mu.Unlock()
+	if w != nil {
+		if size, ok := w.size(); ok {
+			e.Size = size
+			if e.ModTime == "" {
+				e.ModTime = time.Now().Format(time.RFC3339Nano)
+			}
+			err = nil
+		}
+	}
+	if err != nil {
+		return syscall.ENOENT
+	}
+	n.h.fillAttr(e, &out.Attr)
+	return 0
+}
+
+// Setattr supports truncation, which editors and shell redirection rely
+// on. Mode, owner and time changes are accepted and ignored because the
+// file services do not store them.
+func (n *holmNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		if n.h.readOnly {
+			return syscall.EROFS
+		}
+		hf, _ := f.(*holmFile)
+		if hf == nil {
+			n.mu.Lock()
+			hf = n.writer
+			n.mu.Unlock()
+		}
+		if hf != nil && hf.spool != nil {
+			if errno := hf.truncate(int64(size)); errno != 0 {
+				return errno
+			}
+		} else if err := n.truncateRemote(int64(size)); err != nil {
+			return toErrno(err)
+		}
+	}
+	return n.Getattr(ctx, f, out)
+}
+
+// truncateRemote resizes a file that is not open for writing by rewriting
+// it through a spool file.
+func (n *holmNode) truncateRemote(size int64) error {
+	spool, err := os.CreateTemp("", "holm-mount-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if size > 0 {
+		r, err := openRemote(n.h.remotePath(n.rel()), 0, size)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(spool, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := spool.Truncate(size); err != nil {
+		return err
+	}
+	if err := uploadFile(spool.Name(), n.h.remotePath(n.rel()), nil); err != nil {
+		return err
+	}
+	n.h.invalidate(parentDir(n.rel()))
+	return nil
+}
+
+func (n *holmNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	e, err := n.h.lookup(n.child(name))
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return n.newChild(ctx, e, out), 0
+}
+
+func (n *holmNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	l, err := n.h.list(n.rel())
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	entries := make([]fuse.DirEntry, 0, len(l.names))
+	for _, name := range l.names {
+		mode := uint32(syscall.S_IFREG)
+		if l.entries[name].IsDir {
+			mode = syscall.S_IFDIR
+		}
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: mode})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (n *holmNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if n.h.readOnly {
+		return nil, syscall.EROFS
+	}
+	if err := remoteMkdir(n.h.remotePath(n.child(name))); err != nil {
+		return nil, toErrno(err)
+	}
+	n.h.invalidate(n.rel())
+	e := remoteEntry{Name: name, IsDir: true, ModTime: time.Now().Format(time.RFC3339Nano)}
+	return n.newChild(ctx, e, out), 0
+}
+
+func (n *holmNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	if n.h.readOnly {
+		return syscall.EROFS
+	}
+	err := remoteDelete(n.h.remotePath(n.child(name)), false)
+	n.h.invalidate(n.rel())
+	return toErrno(err)
+}
+
+func (n *holmNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if n.h.readOnly {
+		return syscall.EROFS
+	}
+	l, err := n.h.list(n.child(name))
+	if err != nil {
+		return toErrno(err)
+	}
+	if len(l.names) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	err = remoteDelete(n.h.remotePath(n.child(name)), false)
+	n.h.invalidate(n.rel(), n.child(name))
+	return toErrno(err)
+}
+
+func (n *holmNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if n.h.readOnly {
+		return syscall.EROFS
+	}
+	if flags != 0 {
+		// RENAME_EXCHANGE and RENAME_NOREPLACE have no file-move equivalent
+		return syscall.EINVAL
+	}
+	dst := newParent.EmbeddedInode().Path(n.Root())
+	err := remoteMove(n.h.remotePath(n.child(name)), n.h.remotePath(path.Join(dst, newName)))
+	n.h.invalidate(n.rel(), dst, n.child(name))
+	return toErrno(err)
+}
+
+func (n *holmNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	write := flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0
+	if write && n.h.readOnly {
+		return nil, 0, syscall.EROFS
+	}
+	e, err := n.h.lookup(n.rel())
+	if err != nil {
+		return nil, 0, toErrno(err)
+	}
+
+	f := &holmFile{node: n, remoteSize: e.Size}
+	if !write {
+		return f, 0, 0
+	}
+	if errno := f.startWriting(flags&syscall.O_TRUNC == 0); errno != 0 {
+		return nil, 0, errno
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		f.dirty = true
+	}
+	return f, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (n *holmNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	if n.h.readOnly {
+		return nil, nil, 0, syscall.EROFS
+	}
+	e := remoteEntry{Name: name, ModTime: time.Now().Format(time.RFC3339Nano)}
+	inode := n.newChild(ctx, e, out)
+	child := inode.Operations().(*holmNode)
+
+	f := &holmFile{node: child}
+	if errno := f.startWriting(false); errno != 0 {
+		return nil, nil, 0, errno
+	}
+	// Even an empty new file has to reach the server
+	f.dirty = true
+	return inode, f, fuse.FOPEN_DIRECT_IO, 0
+}
+
+// holmFile is an open file. Reads go straight to file-download in
+// readAhead-sized ranges. Writes are buffered in a local spool file and
+// uploaded when the file is flushed (close or fsync), since the upload API
+// replaces whole files.
+type holmFile struct {
+	node       *holmNode
+	remoteSize int64
+
+	mu      sync.Mutex
+	buf     []byte // Read-ahead window
+	bufOff  int64
+	bufDone bool // The window reaches the end of the file
+	spool   *os.File
+	dirty   bool
+}
+
+var (
+	_ fs.FileReader   = (*holmFile)(nil)
+	_ fs.FileWriter   = (*holmFile)(nil)
+	_ fs.FileFlusher  = (*holmFile)(nil)
+	_ fs.FileFsyncer  = (*holmFile)(nil)
+	_ fs.FileReleaser = (*holmFile)(nil)
+)
+
+// startWriting creates the spool, copying the current contents in unless
+// the file is being truncated.
+func (f *holmFile) startWriting(keep bool) syscall.Errno {
+	spool, err := os.CreateTemp("", "holm-mount-*")
+	if err != nil {
+		return toErrno(err)
+	}
+	if keep && f.remoteSize > 0 {
+		r, err := openRemote(f.node.h.remotePath(f.node.rel()), 0, -1)
+		if err == nil {
+			_, err = io.Copy(spool, r)
+			r.Close()
+		}
+		if err != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+			return toErrno(err)
+		}
+	}
+	f.spool = spool
+
+	n := f.node
+	n.mu.Lock()
+	n.writer = f
+	n.mu.Unlock()
+	return 0
+}
+
+func (f *holmFile) size() (int64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.spool == nil {
+		return 0, false
+	}
+	info, err := f.spool.Stat()
+	if err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+func (f *holmFile) truncate(size int64) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.spool.Truncate(size); err != nil {
+		return toErrno(err)
+	}
+	f.dirty = true
+	return 0
+}
+
+func (f *holmFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.spool != nil {
+		n, err := f.spool.ReadAt(dest, off)
+		if err != nil && err != io.EOF {
+			return nil, toErrno(err)
+		}
+		return fuse.ReadResultData(dest[:n]), 0
+	}
+
+	end := off + int64(len(dest))
+	if off < f.bufOff || end > f.bufOff+int64(len(f.buf)) {
+		if off >= f.bufOff && f.bufDone {
+			// Everything past the window is beyond the end of the file
+		} else if errno := f.fill(off, int64(len(dest))); errno != 0 {
+			return nil, errno
+		}
+	}
+	start := off - f.bufOff
+	if start >= int64(len(f.buf)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	stop := start + int64(len(dest))
+	if stop > int64(len(f.buf)) {
+		stop = int64(len(f.buf))
+	}
+	return fuse.ReadResultData(f.buf[start:stop]), 0
+}
+
+// fill fetches the range starting at off, at least want bytes and at most
+// the read-ahead window, so sequential reads hit the cache.
+func (f *holmFile) fill(off, want int64) syscall.Errno {
+	n := f.node.h.readAhead
+	if want > n {
+		n = want
+	}
+	r, err := openRemote(f.node.h.remotePath(f.node.rel()), off, n)
+	if err != nil {
+		return toErrno(err)
+	}
+	defer r.Close()
+
+	buf := make([]byte, n)
+	got, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return toErrno(err)
+	}
+	f.buf, f.bufOff, f.bufDone = buf[:got], off, int64(got) < n
+	return 0
+}
+
+func (f *holmFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.spool == nil {
+		return 0, syscall.EBADF
+	}
+	n, err := f.spool.WriteAt(data, off)
+	if err != nil {
+		return uint32(n), toErrno(err)
+	}
+	f.dirty = true
+	return uint32(n), 0
+}
+
+// upload sends the spool to the server if it has unsaved changes.
+func (f *holmFile) upload() syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.spool == nil || !f.dirty {
+		return 0
+	}
+	rel := f.node.rel()
+	if err := uploadFile(f.spool.Name(), f.node.h.remotePath(rel), nil); err != nil {
+		return toErrno(err)
+	}
+	f.dirty = false
+	f.node.h.invalidate(parentDir(rel))
+	return 0
+}
+
+func (f *holmFile) Flush(ctx context.Context) syscall.Errno {
+	return f.upload()
+}
+
+func (f *holmFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return f.upload()
+}
+
+func (f *holmFile) Release(ctx context.Context) syscall.Errno {
+	errno := f.upload()
+
+	f.mu.Lock()
+	if f.spool != nil {
+		f.spool.Close()
+		os.Remove(f.spool.Name())
+		f.spool = nil
+	}
+	f.mu.Unlock()
+
+	n := f.node
+	n.mu.Lock()
+	if n.writer == f {
+		n.writer = nil
+	}
+	n.mu.Unlock()
+	return errno
+}
+
+func cmdMount(args []string) error {
+	flags := flag.NewFlagSet("mount", flag.ContinueOnError)
+	attrTTL := flags.Duration("attr-ttl", 5*time.Second, "how long listings and attributes are cached")
+	readAhead := flags.Int("read-ahead", 1024, "read-ahead window in KB")
+	readOnly := flags.Bool("read-only", false, "mount read-only")
+	allowOther := flags.Bool("allow-other", false, "let other users access the mount")
+	debug := flags.Bool("debug", false, "log FUSE requests")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return usageErrorf("usage: holm mount [flags] <mountpoint> [remote-dir]")
+	}
+	mountpoint := args[0]
+	remoteRoot := ""
+	if len(args) > 1 {
+		remoteRoot = cleanRemote(args[1])
+	}
+	if *readAhead < 4 {
+		*readAhead = 4
+	}
+
+	// Fail early on a bad URL or credentials instead of on first access
+	if _, err := listRemote(remoteRoot); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &cliError{code: exitNotFound, err: fmt.Errorf("remote directory %s not found", remoteRoot)}
+		}
+		return err
+	}
+
+	h := &holmFS{
+		root:      remoteRoot,
+		attrTTL:   *attrTTL,
+		readAhead: int64(*readAhead) * 1024,
+		readOnly:  *readOnly,
+		uid:       uint32(os.Getuid()),
+		gid:       uint32(os.Getgid()),
+		dirs:      map[string]*dirListing{},
+	}
+	opts := &fs.Options{
+		EntryTimeout:    attrTTL,
+		AttrTimeout:     attrTTL,
+		NegativeTimeout: attrTTL,
+		MountOptions: fuse.MountOptions{
+			FsName:       "holm:" + remoteRoot,
+			Name:         "holm",
+			AllowOther:   *allowOther,
+			Debug:        *debug,
+			MaxReadAhead: *readAhead * 1024,
+			DirectMount:  true, // Mount directly when root, else via fusermount
+		},
+	}
+	if *readOnly {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "ro")
+	}
+
+	server, err := fs.Mount(mountpoint, &holmNode{h: h}, opts)
+	if err != nil {
+		return fmt.Errorf("mount %s: %w", mountpoint, err)
+	}
+	info("Mounted %s on %s (Ctrl-C to unmount)\n", baseURL+"/"+remoteRoot, mountpoint)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		if err := server.Unmount(); err != nil {
+			fmt.Fprintf(os.Stderr, "unmount %s: %v (files still open?)\n", mountpoint, err)
+		}
+	}()
+	server.Wait()
+	return nil
+}
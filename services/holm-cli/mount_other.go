@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package main
+
+import "fmt"
+
+func cmdMount(args []string) error {
+	return fmt.Errorf("holm mount needs FUSE, which is only supported on Linux and macOS")
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// outputFormat is set by --output/-o or HOLM_OUTPUT. "table" is the human
+// format every command has always printed; json and yaml print the
+// command's result object on stdout so scripts can pipe it into jq.
+var outputFormat = "table"
+
+func validOutput(f string) bool {
+	return f == "table" || f == "json" || f == "yaml"
+}
+
+// emit prints v in the selected format, or calls table for human output.
+func emit(v interface{}, table func()) error {
+	switch outputFormat {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		return writeYAML(os.Stdout, v)
+	default:
+		table()
+		return nil
+	}
+}
+
+// emitLine prints one item of a stream in json or yaml output: compact JSON
+// per line, or one YAML document per item.
+func emitLine(v interface{}) error {
+	if outputFormat == "yaml" {
+		fmt.Println("---")
+		return writeYAML(os.Stdout, v)
+	}
+	return json.NewEncoder(os.Stdout).Encode(v)
+}
+
+// info prints progress chatter that only belongs in table output.
+func info(format string, args ...interface{}) {
+	if outputFormat == "table" {
+		fmt.Printf(format, args...)
+	}
+}
+
+// orderedMap keeps JSON object keys in the order the encoder wrote them, so
+// YAML output lists fields in the same order as the JSON output.
+type orderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// writeYAML renders v as YAML by way of its JSON encoding, which keeps the
+// field names and omitempty behaviour identical between the two formats.
+func writeYAML(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	tree, err := decodeOrdered(dec)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	writeYAMLValue(&buf, tree, 0, false)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '{' {
+			m := &orderedMap{values: map[string]interface{}{}}
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				key := keyTok.(string)
+				val, err := decodeOrdered(dec)
+				if err != nil {
+					return nil, err
+				}
+				m.keys = append(m.keys, key)
+				m.values[key] = val
+			}
+			_, err := dec.Token()
+			return m, err
+		}
+		var list []interface{}
+		for dec.More() {
+			val, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, val)
+		}
+		_, err := dec.Token()
+		if list == nil {
+			list = []interface{}{}
+		}
+		return list, err
+	default:
+		return t, nil
+	}
+}
+
+func writeYAMLValue(buf *bytes.Buffer, v interface{}, indent int, inList bool) {
+	pad := strings.Repeat("  ", indent)
+	switch val := v.(type) {
+	case *orderedMap:
+		if len(val.keys) == 0 {
+			buf.WriteString("{}\n")
+			return
+		}
+		for i, k := range val.keys {
+			// The first key of a list item shares the "- " line
+			if !(inList && i == 0) {
+				buf.WriteString(pad)
+			}
+			buf.WriteString(yamlScalar(k) + ":")
+			writeYAMLChild(buf, val.values[k], indent)
+		}
+	case []interface{}:
+		if len(val) == 0 {
+			buf.WriteString("[]\n")
+			return
+		}
+		for i, item := range val {
+			if !(inList && i == 0) {
+				buf.WriteString(pad)
+			}
+			buf.WriteString("- ")
+			switch item.(type) {
+			case *orderedMap, []interface{}:
+				writeYAMLValue(buf, item, indent+1, true)
+			default:
+				buf.WriteString(yamlScalar(item) + "\n")
+			}
+		}
+	default:
+		buf.WriteString(yamlScalar(val) + "\n")
+	}
+}
+
+func writeYAMLChild(buf *bytes.Buffer, v interface{}, indent int) {
+	switch v.(type) {
+	case *orderedMap, []interface{}:
+		if isEmptyCollection(v) {
+			buf.WriteString(" ")
+			writeYAMLValue(buf, v, indent+1, false)
+			return
+		}
+		buf.WriteString("\n")
+		writeYAMLValue(buf, v, indent+1, false)
+	default:
+		buf.WriteString(" " + yamlScalar(v) + "\n")
+	}
+}
+
+func isEmptyCollection(v interface{}) bool {
+	switch val := v.(type) {
+	case *orderedMap:
+		return len(val.keys) == 0
+	case []interface{}:
+		return len(val) == 0
+	}
+	return false
+}
+
+// yamlScalar quotes strings that YAML would otherwise read as another type
+// or that contain syntax characters.
+func yamlScalar(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(val)
+	case json.Number:
+		return val.String()
+	case string:
+		if val == "" || needsQuoting(val) {
+			return strconv.Quote(val)
+		}
+		return val
+	}
+	return fmt.Sprint(v)
+}
+
+func needsQuoting(s string) bool {
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "~":
+		return true
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return true
+	}
+	if strings.ContainsAny(s, ":#{}[],&*!|>'\"%@`\n\t") {
+		return true
+	}
+	return strings.HasPrefix(s, "-") || strings.HasPrefix(s, "?") ||
+		strings.HasPrefix(s, " ") || strings.HasSuffix(s, " ")
+}
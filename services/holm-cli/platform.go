@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Exit codes, so CI scripts can tell a typo from an outage from a failed
+// build without parsing messages.
+const (
+	exitError    = 1 // Anything not covered below
+	exitUsage    = 2 // Bad command line
+	exitNotFound = 3 // The API answered 404
+	exitAuth     = 4 // 401/403: log in again or check permissions
+	exitFailed   = 5 // The operation ran and failed: build, restore, ...
+)
+
+// cliError carries the exit code for an error up to main.
+type cliError struct {
+	code int
+	err  error
+}
+
+func (e *cliError) Error() string { return e.err.Error() }
+func (e *cliError) Unwrap() error { return e.err }
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &cliError{code: exitUsage, err: fmt.Errorf(format, args...)}
+}
+
+func failedErrorf(format string, args ...interface{}) error {
+	return &cliError{code: exitFailed, err: fmt.Errorf(format, args...)}
+}
+
+func exitCode(err error) int {
+	var ce *cliError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return exitError
+}
+
+// apiError turns a non-2xx response into an error with the server's
+// message. Services answer either {"error": "..."} or plain text from
+// http.Error, so both are handled.
+func apiError(service string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	msg := strings.TrimSpace(string(body))
+	var parsed struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &parsed) == nil {
+		if parsed.Error != "" {
+			msg = parsed.Error
+		} else if parsed.Message != "" {
+			msg = parsed.Message
+		}
+	}
+	if msg == "" {
+		msg = resp.Status
+	}
+
+	code := exitError
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		code = exitNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		code = exitAuth
+	}
+	return &cliError{code: code, err: fmt.Errorf("%s: %s", service, msg)}
+}
+
+// Platform services reached by the ops commands. Each defaults to its
+// NodePort on the same host as the profile URL and can be pointed elsewhere
+// with holm profile set <name>_url <url>.
+var platformServices = map[string]struct {
+	title    string
+	nodePort string
+}{
+	"deploy": {"deploy-controller", "30015"},
+	"cicd":   {"cicd-controller", "30020"},
+	"scribe": {"scribe", "30017"},
+	"backup": {"backup-dashboard", "30012"},
+}
+
+func (p *Profile) serviceURL(name string) string {
+	if u := p.Services[name]; u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	base := baseURL
+	if p.URL != "" && os.Getenv("HOLM_URL") == "" {
+		base = p.URL
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" {
+		return "http://localhost:" + platformServices[name].nodePort
+	}
+	return u.Scheme + "://" + u.Hostname() + ":" + platformServices[name].nodePort
+}
+
+// callService sends a JSON request to a platform service and decodes the
+// JSON reply into out, which may be nil.
+func callService(name, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, profile.serviceURL(name)+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := apiDo(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", platformServices[name].title, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return apiError(platformServices[name].title, resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s: invalid response: %w", platformServices[name].title, err)
+	}
+	return nil
+}
+
+// streamService opens a server-sent event stream and calls fn for each
+// event until fn returns done, the stream ends or fn fails.
+func streamService(name, path string, fn func(event, data string) (done bool, err error)) error {
+	req, err := http.NewRequest(http.MethodGet, profile.serviceURL(name)+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := apiDo(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", platformServices[name].title, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return apiError(platformServices[name].title, resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	event, data := "", ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data != "" {
+				done, err := fn(event, data)
+				if err != nil || done {
+					return err
+				}
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	return scanner.Err()
+}
+
+// namespaceFlag registers -n/--namespace, defaulting to the profile's
+// namespace.
+func namespaceFlag(fs *flag.FlagSet) *string {
+	ns := fs.String("namespace", profile.namespace(), "Kubernetes namespace")
+	fs.StringVar(ns, "n", profile.namespace(), "Kubernetes namespace")
+	return ns
+}
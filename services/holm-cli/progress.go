@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	barWidth     = 24
+	nameWidth    = 40
+	redrawPeriod = 150 * time.Millisecond
+)
+
+// progress draws a bar per active transfer plus a totals line on a
+// terminal. When output is redirected it prints one line per finished
+// transfer instead, which keeps logs from CI and cron readable.
+type progress struct {
+	mu     sync.Mutex
+	out    io.Writer
+	tty    bool
+	active []*transferBar
+	drawn  int // Lines drawn by the last redraw
+
+	totalFiles, doneFiles, failed int
+	totalBytes, doneBytes         int64
+	start                         time.Time
+	stop                          chan struct{}
+	wg                            sync.WaitGroup
+}
+
+type transferBar struct {
+	p    *progress
+	verb string
+	name string
+	size int64
+	done int64
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgress(totalFiles int, totalBytes int64) *progress {
+	p := &progress{
+		out:        os.Stderr,
+		tty:        isTerminal(os.Stderr),
+		totalFiles: totalFiles,
+		totalBytes: totalBytes,
+		start:      time.Now(),
+		stop:       make(chan struct{}),
+	}
+	if p.tty {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			ticker := time.NewTicker(redrawPeriod)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					p.mu.Lock()
+					p.redrawLocked()
+					p.mu.Unlock()
+				case <-p.stop:
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// Start registers a transfer; verb is the past tense printed when it ends.
+func (p *progress) Start(verb, name string, size int64) *transferBar {
+	b := &transferBar{p: p, verb: verb, name: name, size: size}
+	p.mu.Lock()
+	p.active = append(p.active, b)
+	p.mu.Unlock()
+	return b
+}
+
+func (b *transferBar) Add(n int64) {
+	b.p.mu.Lock()
+	b.done += n
+	b.p.doneBytes += n
+	b.p.mu.Unlock()
+}
+
+// Finish removes the bar and prints a permanent result line for it.
+func (b *transferBar) Finish(err error) {
+	p := b.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, a := range p.active {
+		if a == b {
+			p.active = append(p.active[:i], p.active[i+1:]...)
+			break
+		}
+	}
+	if err != nil {
+		p.doneBytes -= b.done
+		p.failed++
+		p.printLocked(fmt.Sprintf("FAILED %s: %v", b.name, err))
+		return
+	}
+	// Count the whole file even if the server reported fewer bytes
+	p.doneBytes += b.size - b.done
+	p.doneFiles++
+	p.printLocked(fmt.Sprintf("%s %s (%s)", b.verb, b.name, formatSize(b.size)))
+}
+
+// Println prints a line above the bars.
+func (p *progress) Println(line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.printLocked(line)
+}
+
+func (p *progress) printLocked(line string) {
+	p.clearLocked()
+	fmt.Fprintln(p.out, line)
+	p.redrawLocked()
+}
+
+func (p *progress) clearLocked() {
+	if !p.tty || p.drawn == 0 {
+		return
+	}
+	fmt.Fprintf(p.out, "\033[%dA", p.drawn)
+	for i := 0; i < p.drawn; i++ {
+		fmt.Fprint(p.out, "\033[2K\n")
+	}
+	fmt.Fprintf(p.out, "\033[%dA", p.drawn)
+	p.drawn = 0
+}
+
+func (p *progress) redrawLocked() {
+	if !p.tty {
+		return
+	}
+	p.clearLocked()
+	for _, b := range p.active {
+		fmt.Fprintf(p.out, "  %-*s %s %s\n", nameWidth, truncateName(b.name), bar(b.done, b.size), formatSize(b.done)+"/"+formatSize(b.size))
+	}
+	elapsed := time.Since(p.start).Seconds()
+	rate := int64(0)
+	if elapsed > 0 {
+		rate = int64(float64(p.doneBytes) / elapsed)
+	}
+	fmt.Fprintf(p.out, "  %d/%d files  %s/%s  %s/s\n", p.doneFiles+p.failed, p.totalFiles,
+		formatSize(p.doneBytes), formatSize(p.totalBytes), formatSize(rate))
+	p.drawn = len(p.active) + 1
+}
+
+// Close stops redrawing and removes the bars.
+func (p *progress) Close() {
+	close(p.stop)
+	p.wg.Wait()
+	p.mu.Lock()
+	p.clearLocked()
+	p.mu.Unlock()
+}
+
+func bar(done, size int64) string {
+	pct := 100
+	if size > 0 {
+		pct = int(done * 100 / size)
+	}
+	if pct > 100 {
+		pct = 100
+	}
+	filled := pct * barWidth / 100
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", filled), strings.Repeat(".", barWidth-filled), pct)
+}
+
+func truncateName(name string) string {
+	if len(name) <= nameWidth {
+		return name
+	}
+	return "..." + name[len(name)-nameWidth+3:]
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remotePrefix marks the remote side of a sync: holm sync ./src holm:backups/src
+const remotePrefix = "holm:"
+
+// ignoreFile is read from the local root when present.
+const ignoreFile = ".holmignore"
+
+// mtimeSlack absorbs filesystems that store coarse modification times.
+const mtimeSlack = 2 * time.Second
+
+type syncOptions struct {
+	push     bool // Local to remote; otherwise remote to local
+	delete   bool
+	dryRun   bool
+	checksum bool
+	always   bool // Transfer every file without comparing (get -r / put -r)
+	jobs     int
+	excludes *excludeRules
+}
+
+// treeEntry is one file or directory, keyed by slash-separated path relative
+// to the sync root.
+type treeEntry struct {
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+type syncAction struct {
+	Op     string `json:"op"` // upload, download, mkdir, delete
+	Path   string `json:"path"`
+	Size   int64  `json:"size,omitempty"`
+	IsDir  bool   `json:"is_dir,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// SyncResult is printed by sync, get -r and put -r in json and yaml output.
+// A dry run lists the planned actions instead of running them.
+type SyncResult struct {
+	DryRun      bool         `json:"dry_run"`
+	Transferred int          `json:"transferred"`
+	Bytes       int64        `json:"bytes"`
+	Deleted     int          `json:"deleted"`
+	Created     int          `json:"created"`
+	UpToDate    int          `json:"up_to_date"`
+	Failed      int          `json:"failed"`
+	Duration    string       `json:"duration,omitempty"`
+	Actions     []syncAction `json:"actions,omitempty"`
+}
+
+// stringList collects a repeatable flag.
+type stringList []string
+
+func (s *stringList) String() string     { return strings.Join(*s, ",") }
+func (s *stringList) Set(v string) error { *s = append(*s, v); return nil }
+
+// parseFlags parses flags wherever they appear among the arguments, so
+// "holm sync src dst --delete" works as well as "holm sync --delete src dst".
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, usageErrorf("%s: %v", fs.Name(), err)
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// excludeRules is a small subset of .gitignore: one glob per line, "#"
+// comments, a trailing "/" to match directories only, and patterns with a
+// "/" anchored to the sync root. Other patterns match any base name.
+type excludeRules struct {
+	patterns []string
+}
+
+func (e *excludeRules) add(pattern string) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return
+	}
+	e.patterns = append(e.patterns, pattern)
+}
+
+func (e *excludeRules) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e.add(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+func (e *excludeRules) match(rel string, isDir bool) bool {
+	for _, p := range e.patterns {
+		if strings.HasSuffix(p, "/") {
+			if !isDir {
+				continue
+			}
+			p = strings.TrimSuffix(p, "/")
+		}
+		target := path.Base(rel)
+		if strings.Contains(p, "/") {
+			p = strings.TrimPrefix(p, "/")
+			target = rel
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func walkLocal(root string, ex *excludeRules) (map[string]treeEntry, error) {
+	tree := make(map[string]treeEntry)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		rel = filepath.ToSlash(rel)
+		if ex.match(rel, d.IsDir()) || strings.HasSuffix(rel, ".holm-part") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		tree[rel] = treeEntry{Size: info.Size(), ModTime: info.ModTime(), IsDir: d.IsDir()}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return tree, nil
+	}
+	return tree, err
+}
+
+// walkRemote lists a remote tree one directory at a time.
+func walkRemote(root string, ex *excludeRules) (map[string]treeEntry, error) {
+	tree := make(map[string]treeEntry)
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		entries, err := listRemote(path.Join(root, rel))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			child := e.Name
+			if rel != "" {
+				child = rel + "/" + e.Name
+			}
+			if ex.match(child, e.IsDir) {
+				continue
+			}
+			tree[child] = treeEntry{Size: e.Size, ModTime: e.modTime(), IsDir: e.IsDir}
+			if e.IsDir {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err := walk("")
+	if errors.Is(err, os.ErrNotExist) {
+		return tree, nil
+	}
+	return tree, err
+}
+
+func localChecksum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// needsTransfer decides whether src must be copied over dst and why. Sizes
+// are compared first; with --checksum equal sizes are confirmed by SHA-256
+// (via file-meta on the remote side), otherwise a newer source wins.
+func needsTransfer(rel string, src, dst treeEntry, localRoot, remoteRoot string, opts syncOptions) (string, error) {
+	if src.Size != dst.Size {
+		return "size", nil
+	}
+	if opts.checksum {
+		local, err := localChecksum(filepath.Join(localRoot, filepath.FromSlash(rel)))
+		if err != nil {
+			return "", err
+		}
+		remote, err := remoteChecksum(path.Join(remoteRoot, rel))
+		if err != nil {
+			return "", err
+		}
+		if remote != "" {
+			if local != remote {
+				return "checksum", nil
+			}
+			return "", nil
+		}
+		// file-meta skips hashing very large files; fall back to mtime
+	}
+	if src.ModTime.After(dst.ModTime.Add(mtimeSlack)) {
+		return "mtime", nil
+	}
+	return "", nil
+}
+
+// planSync compares source and target trees and returns the actions that
+// make target match source, plus the number of files already up to date.
+func planSync(src, dst map[string]treeEntry, localRoot, remoteRoot string, opts syncOptions) ([]syncAction, int, error) {
+	var actions []syncAction
+	upToDate := 0
+	transferOp := "download"
+	if opts.push {
+		transferOp = "upload"
+	}
+
+	paths := make([]string, 0, len(src))
+	for p := range src {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		s := src[p]
+		d, exists := dst[p]
+		switch {
+		case s.IsDir:
+			if !exists {
+				actions = append(actions, syncAction{Op: "mkdir", Path: p, IsDir: true})
+			} else if !d.IsDir {
+				fmt.Fprintf(os.Stderr, "Warning: skipping %s: directory on source, file on target\n", p)
+			}
+		case !exists:
+			actions = append(actions, syncAction{Op: transferOp, Path: p, Size: s.Size, Reason: "new"})
+		case d.IsDir:
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s: file on source, directory on target\n", p)
+		case opts.always:
+			actions = append(actions, syncAction{Op: transferOp, Path: p, Size: s.Size, Reason: "replace"})
+		default:
+			reason, err := needsTransfer(p, s, d, localRoot, remoteRoot, opts)
+			if err != nil {
+				return nil, 0, fmt.Errorf("compare %s: %w", p, err)
+			}
+			if reason == "" {
+				upToDate++
+				continue
+			}
+			actions = append(actions, syncAction{Op: transferOp, Path: p, Size: s.Size, Reason: reason})
+		}
+	}
+
+	if opts.delete {
+		var extra []string
+		for p := range dst {
+			if _, ok := src[p]; !ok {
+				extra = append(extra, p)
+			}
+		}
+		sort.Strings(extra)
+		// A deleted directory takes its contents with it
+		var removedDir string
+		for _, p := range extra {
+			if removedDir != "" && strings.HasPrefix(p, removedDir+"/") {
+				continue
+			}
+			d := dst[p]
+			actions = append(actions, syncAction{Op: "delete", Path: p, Size: d.Size, IsDir: d.IsDir})
+			if d.IsDir {
+				removedDir = p
+			}
+		}
+	}
+	return actions, upToDate, nil
+}
+
+// runSync executes a plan: directories first, then transfers in parallel,
+// then deletions.
+func runSync(localRoot, remoteRoot string, src map[string]treeEntry, actions []syncAction, upToDate int, opts syncOptions) error {
+	var mkdirs, transfers, deletes []syncAction
+	var totalBytes int64
+	for _, a := range actions {
+		switch a.Op {
+		case "mkdir":
+			mkdirs = append(mkdirs, a)
+		case "delete":
+			deletes = append(deletes, a)
+		default:
+			transfers = append(transfers, a)
+			totalBytes += a.Size
+		}
+	}
+
+	if opts.dryRun {
+		result := SyncResult{DryRun: true, UpToDate: upToDate, Actions: actions}
+		return emit(result, func() {
+			printDryRun(actions, len(transfers), totalBytes, len(deletes), len(mkdirs))
+		})
+	}
+
+	start := time.Now()
+	prog := newProgress(len(transfers), totalBytes)
+	failed, created := 0, 0
+	for _, a := range mkdirs {
+		var err error
+		if opts.push {
+			err = remoteMkdir(path.Join(remoteRoot, a.Path))
+		} else {
+			err = os.MkdirAll(filepath.Join(localRoot, filepath.FromSlash(a.Path)), 0755)
+		}
+		if err != nil {
+			failed++
+			prog.Println(fmt.Sprintf("FAILED mkdir %s: %v", a.Path, err))
+			continue
+		}
+		created++
+	}
+
+	jobs := opts.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	queue := make(chan syncAction)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range queue {
+				local := filepath.Join(localRoot, filepath.FromSlash(a.Path))
+				remote := path.Join(remoteRoot, a.Path)
+				var err error
+				if a.Op == "upload" {
+					b := prog.Start("Uploaded", a.Path, a.Size)
+					err = uploadFile(local, remote, b.Add)
+					b.Finish(err)
+				} else {
+					b := prog.Start("Downloaded", a.Path, a.Size)
+					err = downloadFile(remote, local, src[a.Path].ModTime, b.Add)
+					b.Finish(err)
+				}
+				if err != nil {
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, a := range transfers {
+		queue <- a
+	}
+	close(queue)
+	wg.Wait()
+
+	// Deepest paths first so directories are empty by the time we reach them
+	sort.Slice(deletes, func(i, j int) bool { return deletes[i].Path > deletes[j].Path })
+	deleteFailures := 0
+	for _, a := range deletes {
+		var err error
+		if opts.push {
+			err = remoteDelete(path.Join(remoteRoot, a.Path), a.IsDir)
+		} else {
+			err = os.RemoveAll(filepath.Join(localRoot, filepath.FromSlash(a.Path)))
+		}
+		if err != nil {
+			failed++
+			deleteFailures++
+			prog.Println(fmt.Sprintf("FAILED delete %s: %v", a.Path, err))
+			continue
+		}
+		prog.Println("Deleted " + a.Path)
+	}
+	prog.Close()
+
+	result := SyncResult{
+		Transferred: prog.doneFiles,
+		Bytes:       prog.doneBytes,
+		Deleted:     len(deletes) - deleteFailures,
+		Created:     created,
+		UpToDate:    upToDate,
+		Failed:      failed,
+		Duration:    time.Since(start).Round(time.Millisecond).String(),
+	}
+	if err := emit(result, func() {
+		fmt.Printf("Transferred %d files (%s), deleted %d in %s\n",
+			result.Transferred, formatSize(result.Bytes), result.Deleted, result.Duration)
+	}); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return failedErrorf("%d of %d operations failed", failed, len(actions))
+	}
+	return nil
+}
+
+func printDryRun(actions []syncAction, transfers int, totalBytes int64, deletes, mkdirs int) {
+	for _, a := range actions {
+		switch {
+		case a.Op == "delete" && a.IsDir:
+			fmt.Printf("%-9s %s/\n", a.Op, a.Path)
+		case a.Op == "mkdir":
+			fmt.Printf("%-9s %s/\n", a.Op, a.Path)
+		case a.Op == "delete":
+			fmt.Printf("%-9s %s\n", a.Op, a.Path)
+		default:
+			fmt.Printf("%-9s %s (%s, %s)\n", a.Op, a.Path, formatSize(a.Size), a.Reason)
+		}
+	}
+	fmt.Printf("\nDry run: %d to transfer (%s), %d to delete, %d directories to create\n",
+		transfers, formatSize(totalBytes), deletes, mkdirs)
+}
+
+// syncFlags registers the flags shared by sync, get -r and put -r.
+func syncFlags(name string, opts *syncOptions, excludes *stringList, excludeFrom *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.BoolVar(&opts.dryRun, "n", false, "show what would be done without changing anything")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "show what would be done without changing anything")
+	fs.IntVar(&opts.jobs, "j", 4, "number of parallel transfers")
+	fs.IntVar(&opts.jobs, "jobs", 4, "number of parallel transfers")
+	fs.Var(excludes, "exclude", "exclude files matching pattern (repeatable)")
+	fs.StringVar(excludeFrom, "exclude-from", "", "read exclude patterns from file")
+	return fs
+}
+
+// loadExcludes combines --exclude, --exclude-from and the local root's
+// .holmignore.
+func loadExcludes(localRoot string, excludes stringList, excludeFrom string) (*excludeRules, error) {
+	ex := &excludeRules{}
+	for _, p := range excludes {
+		ex.add(p)
+	}
+	if excludeFrom != "" {
+		if err := ex.load(excludeFrom); err != nil {
+			return nil, err
+		}
+	}
+	if err := ex.load(filepath.Join(localRoot, ignoreFile)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ex.add(ignoreFile)
+	return ex, nil
+}
+
+func cleanRemote(p string) string {
+	return strings.Trim(strings.TrimPrefix(p, remotePrefix), "/")
+}
+
+// transferTree plans and runs a sync between localRoot and remoteRoot.
+func transferTree(localRoot, remoteRoot string, opts syncOptions) error {
+	var src, dst map[string]treeEntry
+	local, err := walkLocal(localRoot, opts.excludes)
+	if err != nil {
+		return err
+	}
+	remote, err := walkRemote(remoteRoot, opts.excludes)
+	if err != nil {
+		return err
+	}
+	if opts.push {
+		src, dst = local, remote
+		if info, err := os.Stat(localRoot); err != nil || !info.IsDir() {
+			return fmt.Errorf("%s is not a local directory", localRoot)
+		}
+	} else {
+		src, dst = remote, local
+		if len(remote) == 0 {
+			if _, err := listRemote(remoteRoot); errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("remote directory %s not found", remoteRoot)
+			}
+		}
+	}
+
+	actions, upToDate, err := planSync(src, dst, localRoot, remoteRoot, opts)
+	if err != nil {
+		return err
+	}
+	if len(actions) == 0 {
+		return emit(SyncResult{DryRun: opts.dryRun, UpToDate: upToDate}, func() {
+			fmt.Printf("Everything up to date (%d files)\n", upToDate)
+		})
+	}
+	if upToDate > 0 && !opts.dryRun {
+		info("%d files up to date\n", upToDate)
+	}
+	return runSync(localRoot, remoteRoot, src, actions, upToDate, opts)
+}
+
+func cmdSync(args []string) error {
+	var opts syncOptions
+	var excludes stringList
+	var excludeFrom string
+	fs := syncFlags("sync", &opts, &excludes, &excludeFrom)
+	fs.BoolVar(&opts.delete, "delete", false, "delete target files that are not on the source (mirror)")
+	fs.BoolVar(&opts.checksum, "c", false, "compare SHA-256 checksums when sizes match")
+	fs.BoolVar(&opts.checksum, "checksum", false, "compare SHA-256 checksums when sizes match")
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return usageErrorf("usage: holm sync [flags] <local> holm:<remote>  |  holm sync [flags] holm:<remote> <local>")
+	}
+
+	var localRoot, remoteRoot string
+	switch {
+	case strings.HasPrefix(args[0], remotePrefix) && strings.HasPrefix(args[1], remotePrefix):
+		return fmt.Errorf("one side of a sync must be local")
+	case strings.HasPrefix(args[0], remotePrefix):
+		remoteRoot, localRoot = cleanRemote(args[0]), args[1]
+	default:
+		// The remote prefix is optional on the destination
+		localRoot, remoteRoot = args[0], cleanRemote(args[1])
+		opts.push = true
+	}
+
+	if opts.excludes, err = loadExcludes(localRoot, excludes, excludeFrom); err != nil {
+		return err
+	}
+	return transferTree(localRoot, remoteRoot, opts)
+}
+
+// cmdGetRecursive downloads a whole remote directory: holm get -r <remote> [local]
+func cmdGetRecursive(args []string) error {
+	opts := syncOptions{always: true}
+	var excludes stringList
+	var excludeFrom string
+	fs := syncFlags("get", &opts, &excludes, &excludeFrom)
+	fs.Bool("r", true, "recursive")
+	fs.Bool("recursive", true, "recursive")
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return usageErrorf("usage: holm get -r <remote-dir> [local-dir]")
+	}
+	remoteRoot := cleanRemote(args[0])
+	localRoot := path.Base(remoteRoot)
+	if len(args) > 1 {
+		localRoot = args[1]
+	}
+
+	if opts.excludes, err = loadExcludes(localRoot, excludes, excludeFrom); err != nil {
+		return err
+	}
+	return transferTree(localRoot, remoteRoot, opts)
+}
+
+// cmdPutRecursive uploads a whole local directory: holm put -r <local> [remote]
+func cmdPutRecursive(args []string) error {
+	opts := syncOptions{always: true, push: true}
+	var excludes stringList
+	var excludeFrom string
+	fs := syncFlags("put", &opts, &excludes, &excludeFrom)
+	fs.Bool("r", true, "recursive")
+	fs.Bool("recursive", true, "recursive")
+
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return usageErrorf("usage: holm put -r <local-dir> [remote-dir]")
+	}
+	localRoot := args[0]
+	remoteRoot := filepath.Base(filepath.Clean(localRoot))
+	if len(args) > 1 {
+		remoteRoot = cleanRemote(args[1])
+	}
+
+	if opts.excludes, err = loadExcludes(localRoot, excludes, excludeFrom); err != nil {
+		return err
+	}
+	return transferTree(localRoot, remoteRoot, opts)
+}
+
+// hasRecursiveFlag reports whether -r appears among the arguments.
+func hasRecursiveFlag(args []string) bool {
+	for _, a := range args {
+		if a == "-r" || a == "--recursive" {
+			return true
+		}
+	}
+	return false
+}
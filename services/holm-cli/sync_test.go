@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPlanSync(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	file := func(size int64, age time.Duration) treeEntry {
+		return treeEntry{Size: size, ModTime: now.Add(-age)}
+	}
+	dir := treeEntry{IsDir: true}
+
+	tests := []struct {
+		name     string
+		src, dst map[string]treeEntry
+		opts     syncOptions
+		want     []syncAction
+		upToDate int
+	}{
+		{
+			name:     "identical trees",
+			src:      map[string]treeEntry{"a": file(1, time.Hour)},
+			dst:      map[string]treeEntry{"a": file(1, time.Hour)},
+			opts:     syncOptions{push: true},
+			upToDate: 1,
+		},
+		{
+			name: "new, resized and newer files",
+			src: map[string]treeEntry{
+				"new": file(1, 0), "resized": file(2, time.Hour), "newer": file(3, 0), "older": file(4, 2*time.Hour),
+			},
+			dst: map[string]treeEntry{
+				"resized": file(1, 0), "newer": file(3, time.Hour), "older": file(4, time.Hour),
+			},
+			opts: syncOptions{push: true},
+			want: []syncAction{
+				{Op: "upload", Path: "new", Size: 1, Reason: "new"},
+				{Op: "upload", Path: "newer", Size: 3, Reason: "mtime"},
+				{Op: "upload", Path: "resized", Size: 2, Reason: "size"},
+			},
+			upToDate: 1,
+		},
+		{
+			name: "mtimes within the slack are equal",
+			src:  map[string]treeEntry{"a": file(1, 0)},
+			dst:  map[string]treeEntry{"a": file(1, time.Second)},
+			opts: syncOptions{},
+			// Pulling, so the remote side is the source
+			upToDate: 1,
+		},
+		{
+			name: "always transfers existing files",
+			src:  map[string]treeEntry{"a": file(1, time.Hour)},
+			dst:  map[string]treeEntry{"a": file(1, time.Hour)},
+			opts: syncOptions{always: true},
+			want: []syncAction{{Op: "download", Path: "a", Size: 1, Reason: "replace"}},
+		},
+		{
+			name: "directories created and deleted whole",
+			src:  map[string]treeEntry{"d": dir, "d/a": file(1, 0)},
+			dst: map[string]treeEntry{
+				"old": dir, "old/a": file(1, 0), "old/b": dir, "old/b/c": file(1, 0), "gone": file(5, 0),
+			},
+			opts: syncOptions{push: true, delete: true},
+			want: []syncAction{
+				{Op: "mkdir", Path: "d", IsDir: true},
+				{Op: "upload", Path: "d/a", Size: 1, Reason: "new"},
+				{Op: "delete", Path: "gone", Size: 5},
+				{Op: "delete", Path: "old", IsDir: true},
+			},
+		},
+		{
+			name: "extra files kept without delete",
+			src:  map[string]treeEntry{},
+			dst:  map[string]treeEntry{"extra": file(1, 0)},
+			opts: syncOptions{push: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, upToDate, err := planSync(tt.src, tt.dst, "", "", tt.opts)
+			if err != nil {
+				t.Fatalf("planSync() error = %v", err)
+			}
+			if len(got) != len(tt.want) || len(got) > 0 && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("actions = %+v, want %+v", got, tt.want)
+			}
+			if upToDate != tt.upToDate {
+				t.Errorf("up to date = %d, want %d", upToDate, tt.upToDate)
+			}
+		})
+	}
+}
+
+// fakeFiles serves the file API endpoints sync uses from memory.
+type fakeFiles struct {
+	mu      sync.Mutex
+	files   map[string]string
+	mtimes  map[string]time.Time
+	dirs    map[string]bool
+	uploads []string
+}
+
+func newFakeFiles() *fakeFiles {
+	return &fakeFiles{files: map[string]string{}, mtimes: map[string]time.Time{}, dirs: map[string]bool{}}
+}
+
+func (f *fakeFiles) put(p, content string, modTime time.Time) {
+	f.files[p] = content
+	f.mtimes[p] = modTime
+	for d := path.Dir(p); d != "."; d = path.Dir(d) {
+		f.dirs[d] = true
+	}
+}
+
+func (f *fakeFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ok := func() { json.NewEncoder(w).Encode(map[string]interface{}{"success": true}) }
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/v1/files/"):
+		dir := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/files/"), "/")
+		if !f.dirs[dir] {
+			http.NotFound(w, r)
+			return
+		}
+		entries := []remoteEntry{}
+		for d := range f.dirs {
+			if path.Dir(d) == dir {
+				entries = append(entries, remoteEntry{Name: path.Base(d), Path: d, IsDir: true})
+			}
+		}
+		for p, content := range f.files {
+			if path.Dir(p) == dir {
+				entries = append(entries, remoteEntry{Name: path.Base(p), Path: p, Size: int64(len(content)),
+					ModTime: f.mtimes[p].Format(time.RFC3339Nano)})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"files": entries})
+
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/upload":
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		p := path.Join(r.FormValue("path"), r.FormValue("filename"))
+		f.put(p, string(data), time.Now())
+		f.uploads = append(f.uploads, p)
+		ok()
+
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/api/v1/mkdir/"):
+		f.dirs[strings.TrimPrefix(r.URL.Path, "/api/v1/mkdir/")] = true
+		ok()
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/api/v1/delete/"):
+		p := strings.TrimPrefix(r.URL.Path, "/api/v1/delete/")
+		for name := range f.files {
+			if name == p || strings.HasPrefix(name, p+"/") {
+				delete(f.files, name)
+			}
+		}
+		for d := range f.dirs {
+			if d == p || strings.HasPrefix(d, p+"/") {
+				delete(f.dirs, d)
+			}
+		}
+		ok()
+
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+r.URL.Path, http.StatusNotImplemented)
+	}
+}
+
+func TestTransferTreePush(t *testing.T) {
+	remote := newFakeFiles()
+	srv := httptest.NewServer(remote)
+	defer srv.Close()
+
+	savedURL, savedProfile, savedOutput := baseURL, profile, outputFormat
+	defer func() { baseURL, profile, outputFormat = savedURL, savedProfile, savedOutput }()
+	baseURL, profile, outputFormat = srv.URL, &Profile{}, "json"
+	t.Setenv("HOLM_TOKEN", "test")
+
+	now := time.Now()
+	remote.dirs["backup"] = true
+	remote.put("backup/same.txt", "same", now)
+	remote.put("backup/changed.txt", "old", now)
+	remote.put("backup/stale.txt", "stale", now)
+	remote.put("backup/olddir/f.txt", "f", now)
+
+	local := t.TempDir()
+	for name, content := range map[string]string{
+		"same.txt": "same", "changed.txt": "changed", "new.txt": "new", "sub/deep.txt": "deep", "skip.log": "log",
+	} {
+		p := filepath.Join(local, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		old := now.Add(-time.Hour)
+		os.Chtimes(p, old, old)
+	}
+
+	ex := &excludeRules{}
+	ex.add("*.log")
+	opts := syncOptions{push: true, delete: true, jobs: 2, excludes: ex}
+	if err := transferTree(local, "backup", opts); err != nil {
+		t.Fatalf("transferTree() error = %v", err)
+	}
+
+	want := map[string]string{
+		"backup/same.txt":     "same",
+		"backup/changed.txt":  "changed",
+		"backup/new.txt":      "new",
+		"backup/sub/deep.txt": "deep",
+	}
+	if !reflect.DeepEqual(remote.files, want) {
+		t.Errorf("remote files = %v, want %v", remote.files, want)
+	}
+	if len(remote.uploads) != 3 {
+		t.Errorf("uploads = %v, want changed.txt, new.txt and sub/deep.txt", remote.uploads)
+	}
+	if remote.dirs["backup/olddir"] {
+		t.Errorf("backup/olddir was not deleted")
+	}
+
+	// A second sync finds nothing to do
+	localTree, err := walkLocal(local, ex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteTree, err := walkRemote("backup", ex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions, _, err := planSync(localTree, remoteTree, local, "backup", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 0 {
+		t.Errorf("second sync actions = %+v, want none", actions)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// remoteEntry is one item of a remote directory listing.
+type remoteEntry struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	IsDir   bool   `json:"is_dir"`
+	ModTime string `json:"mod_time"`
+}
+
+func (e remoteEntry) modTime() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, e.ModTime)
+	return t
+}
+
+// escapePath escapes each segment of a remote path for use in a URL while
+// keeping the separators.
+func escapePath(p string) string {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	for i, s := range parts {
+		parts[i] = url.PathEscape(s)
+	}
+	return strings.Join(parts, "/")
+}
+
+// listRemote lists one remote directory. A missing directory is reported
+// with os.ErrNotExist so callers can treat it as empty.
+func listRemote(dir string) ([]remoteEntry, error) {
+	resp, err := apiGet(baseURL + "/api/v1/files/" + escapePath(dir))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("list %s failed: %s", dir, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		Files []remoteEntry `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Files, nil
+}
+
+// remoteChecksum returns file-meta's SHA-256 of a remote file. It is empty
+// for files file-meta does not hash (100MB and larger).
+func remoteChecksum(p string) (string, error) {
+	resp, err := apiGet(baseURL + "/api/v1/meta/" + escapePath(p) + "?checksum=true&extract=false")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool `json:"success"`
+		Meta    struct {
+			Checksum string `json:"checksum"`
+		} `json:"meta"`
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if !result.Success {
+		return "", fmt.Errorf("stat %s failed: %s", p, result.Error)
+	}
+	return result.Meta.Checksum, nil
+}
+
+// progressReader reports bytes as they pass through.
+type progressReader struct {
+	r  io.Reader
+	fn func(int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 && p.fn != nil {
+		p.fn(int64(n))
+	}
+	return n, err
+}
+
+// uploadFile streams a local file to remotePath. Unlike cmdUpload the body
+// is never held in memory, so large files are fine.
+func uploadFile(localPath, remotePath string, onProgress func(int64)) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		var err error
+		if dir := path.Dir(remotePath); dir != "." && dir != "/" {
+			err = writer.WriteField("path", dir)
+		}
+		if err == nil {
+			err = writer.WriteField("filename", path.Base(remotePath))
+		}
+		var part io.Writer
+		if err == nil {
+			part, err = writer.CreateFormFile("file", path.Base(remotePath))
+		}
+		if err == nil {
+			_, err = io.Copy(part, &progressReader{r: file, fn: onProgress})
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	resp, err := apiPost(baseURL+"/api/v1/upload", writer.FormDataContentType(), pr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if !result.Success {
+		if result.Error == "" {
+			result.Error = resp.Status
+		}
+		return fmt.Errorf("upload failed: %s", result.Error)
+	}
+	return nil
+}
+
+// downloadFile fetches remotePath into localPath via a temporary file and
+// stamps it with the remote modification time, so a later sync sees the
+// two sides as identical.
+func downloadFile(remotePath, localPath string, modTime time.Time, onProgress func(int64)) error {
+	resp, err := apiGet(baseURL + "/api/v1/download/" + escapePath(remotePath))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("download failed: %s", strings.TrimSpace(string(body)))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	tmp := localPath + ".holm-part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, &progressReader{r: resp.Body, fn: onProgress})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, localPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if !modTime.IsZero() {
+		os.Chtimes(localPath, modTime, modTime)
+	}
+	return nil
+}
+
+func remoteMkdir(p string) error {
+	resp, err := apiPost(baseURL+"/api/v1/mkdir/"+escapePath(p), "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if !result.Success {
+		return fmt.Errorf("mkdir failed: %s", result.Error)
+	}
+	return nil
+}
+
+func remoteDelete(p string, recursive bool) error {
+	u := baseURL + "/api/v1/delete/" + escapePath(p)
+	if recursive {
+		u += "?recursive=true"
+	}
+	req, _ := http.NewRequest("DELETE", u, nil)
+	resp, err := apiDo(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if !result.Success {
+		return fmt.Errorf("delete failed: %s", result.Error)
+	}
+	return nil
+}
+
+// openRemote streams n bytes of remotePath starting at off, or the rest of
+// the file when n < 0. file-download serves ranges, so mounts only fetch
+// the part being read.
+func openRemote(remotePath string, off, n int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/api/v1/download/"+escapePath(remotePath), nil)
+	if err != nil {
+		return nil, err
+	}
+	if off > 0 || n >= 0 {
+		if n >= 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+		}
+	}
+	resp, err := apiDo(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Reading at or past the end
+		resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	case http.StatusOK:
+		// The server ignored the range; skip to the offset ourselves
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil && err != io.EOF {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return nil, fmt.Errorf("download failed: %s", strings.TrimSpace(string(body)))
+}
+
+func remoteMove(src, dst string) error {
+	body, _ := json.Marshal(map[string]string{"source": src, "dest": dst})
+	resp, err := apiPost(baseURL+"/api/v1/move", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if !result.Success {
+		if resp.StatusCode == http.StatusNotFound {
+			return os.ErrNotExist
+		}
+		return fmt.Errorf("move failed: %s", result.Error)
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// scopeFromRequest reads the service from the path after prefix and the
+// environment from ?env=, answering 400 itself if either is invalid.
+func scopeFromRequest(w http.ResponseWriter, r *http.Request, prefix string) (string, string, bool) {
+	service, _, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/"), "/")
+	env := r.URL.Query().Get("env")
+	if err := validScope(service, env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	return service, env, true
+}
+
+// writeCommitError answers with the status a failed commit deserves.
+func writeCommitError(w http.ResponseWriter, err error) {
+	var schemaErr *SchemaError
+	switch {
+	case errors.As(err, &schemaErr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "schema validation failed", "problems": schemaErr.Problems})
+	case errors.Is(err, errVersionConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// configsHandler serves GET /configs, every scope with its latest version.
+func configsHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCounter, 1)
+	if db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	scopes, err := listScopes(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scopes)
+}
+
+// configWrite is the body of PUT, PATCH and rollback requests. PUT takes
+// keys and files as the scope's whole content; PATCH sets the keys in set,
+// deletes those in delete, and writes files, a null file deleting it.
+type configWrite struct {
+	Keys        map[string]json.RawMessage `json:"keys,omitempty"`
+	Files       map[string]*string         `json:"files,omitempty"`
+	Set         map[string]json.RawMessage `json:"set,omitempty"`
+	Delete      []string                   `json:"delete,omitempty"`
+	Version     int                        `json:"version,omitempty"` // Rollback target
+	BaseVersion int                        `json:"base_version,omitempty"`
+	Author      string                     `json:"author,omitempty"`
+	Message     string                     `json:"message,omitempty"`
+}
+
+// configHandler serves /configs/{service} and its history, diff and
+// rollback, for the scope picked by ?env=.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCounter, 1)
+	if db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return
+	}
+	service, env, ok := scopeFromRequest(w, r, "/configs/")
+	if !ok {
+		return
+	}
+	_, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/configs/"), "/"), "/")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		version, _ := strconv.Atoi(r.URL.Query().Get("version"))
+		v, err := getVersion(ctx, db, service, env, version)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if v == nil {
+			http.Error(w, "Config not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+
+	case action == "history" && r.Method == http.MethodGet:
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit <= 0 || limit > 500 {
+			limit = 50
+		}
+		versions, err := history(ctx, service, env, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(versions)
+
+	case action == "diff" && r.Method == http.MethodGet:
+		diffHandler(ctx, w, r, service, env)
+
+	case (action == "" && (r.Method == http.MethodPut || r.Method == http.MethodPatch)) ||
+		(action == "rollback" && r.Method == http.MethodPost):
+		var req configWrite
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxConfigSize)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		change := &ConfigChange{
+			Service:     service,
+			Environment: env,
+			BaseVersion: req.BaseVersion,
+			Author:      req.Author,
+			Message:     req.Message,
+		}
+		switch {
+		case action == "rollback":
+			target, err := getVersion(ctx, db, service, env, req.Version)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if req.Version <= 0 || target == nil {
+				http.Error(w, "Version not found", http.StatusNotFound)
+				return
+			}
+			if change.Message == "" {
+				change.Message = "Roll back to version " + strconv.Itoa(target.Version)
+			}
+			change.change = func(doc *ConfigDoc) error {
+				*doc = *target.Config.clone()
+				return nil
+			}
+		case r.Method == http.MethodPut:
+			change.change = func(doc *ConfigDoc) error {
+				*doc = *newConfigDoc()
+				applyWrite(doc, &req)
+				return nil
+			}
+		default:
+			change.change = func(doc *ConfigDoc) error {
+				applyWrite(doc, &req)
+				return nil
+			}
+		}
+
+		v, changed, err := commit(ctx, change)
+		if err != nil {
+			writeCommitError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"changed": changed, "version": v})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func applyWrite(doc *ConfigDoc, req *configWrite) {
+	for k, v := range req.Keys {
+		doc.Keys[k] = v
+	}
+	for k, v := range req.Set {
+		doc.Keys[k] = v
+	}
+	for _, k := range req.Delete {
+		delete(doc.Keys, k)
+	}
+	for name, content := range req.Files {
+		if content == nil {
+			delete(doc.Files, name)
+		} else {
+			doc.Files[name] = *content
+		}
+	}
+}
+
+// diffHandler answers GET /configs/{service}/diff?from=&to=. to defaults
+// to the latest version and from to the one before to.
+func diffHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, service, env string) {
+	to, _ := strconv.Atoi(r.URL.Query().Get("to"))
+	toVersion, err := getVersion(ctx, db, service, env, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if toVersion == nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	from, _ := strconv.Atoi(r.URL.Query().Get("from"))
+	if from == 0 {
+		from = toVersion.Version - 1
+	}
+	fromDoc := newConfigDoc()
+	if from > 0 {
+		fromVersion, err := getVersion(ctx, db, service, env, from)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if fromVersion == nil {
+			http.Error(w, "Version not found", http.StatusNotFound)
+			return
+		}
+		fromDoc = fromVersion.Config
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"service":     service,
+		"environment": env,
+		"from":        from,
+		"to":          toVersion.Version,
+		"diff":        diffConfigs(fromDoc, toVersion.Config),
+	})
+}
+
+// schemasHandler serves GET /schemas and GET, PUT and DELETE on
+// /schemas/{service}.
+func schemasHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCounter, 1)
+	if db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+
+	service := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schemas"), "/")
+	if service == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		schemas, err := listSchemas(ctx, db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(schemas)
+		return
+	}
+	if err := validScope(service, ""); err != nil || service == globalService {
+		http.Error(w, "Invalid service", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s, err := getSchema(ctx, db, service)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if s == nil {
+			http.Error(w, "Schema not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(s)
+	case http.MethodPut:
+		var s ConfigSchema
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := putSchema(ctx, service, &s); err != nil {
+			writeCommitError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(&s)
+	case http.MethodDelete:
+		if _, err := db.ExecContext(ctx, `DELETE FROM config_schemas WHERE service = $1`, service); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// maxDiffCells bounds the line diff of a file: past it the file is shown
+// as replaced rather than spend the memory on a finer diff.
+const maxDiffCells = 4_000_000
+
+// ConfigDiff is what changed between two versions of a scope.
+type ConfigDiff struct {
+	Added   map[string]json.RawMessage `json:"added"`
+	Removed map[string]json.RawMessage `json:"removed"`
+	Changed map[string]ValueChange     `json:"changed"`
+	Files   map[string]*FileDiff       `json:"files"`
+}
+
+type ValueChange struct {
+	From json.RawMessage `json:"from"`
+	To   json.RawMessage `json:"to"`
+}
+
+// FileDiff is a file's change: added, removed or changed, with the lines
+// that differ prefixed "+" or "-" and the ones around them " ".
+type FileDiff struct {
+	Status string   `json:"status"`
+	Lines  []string `json:"lines,omitempty"`
+}
+
+func diffConfigs(from, to *ConfigDoc) *ConfigDiff {
+	d := &ConfigDiff{
+		Added:   map[string]json.RawMessage{},
+		Removed: map[string]json.RawMessage{},
+		Changed: map[string]ValueChange{},
+		Files:   map[string]*FileDiff{},
+	}
+	for k, v := range to.Keys {
+		old, ok := from.Keys[k]
+		switch {
+		case !ok:
+			d.Added[k] = v
+		case !jsonEqual(old, v):
+			d.Changed[k] = ValueChange{From: old, To: v}
+		}
+	}
+	for k, v := range from.Keys {
+		if _, ok := to.Keys[k]; !ok {
+			d.Removed[k] = v
+		}
+	}
+
+	for name, content := range to.Files {
+		old, ok := from.Files[name]
+		switch {
+		case !ok:
+			d.Files[name] = &FileDiff{Status: "added", Lines: prefixLines("+", splitLines(content))}
+		case old != content:
+			d.Files[name] = &FileDiff{Status: "changed", Lines: diffLines(splitLines(old), splitLines(content), 3)}
+		}
+	}
+	for name, content := range from.Files {
+		if _, ok := to.Files[name]; !ok {
+			d.Files[name] = &FileDiff{Status: "removed", Lines: prefixLines("-", splitLines(content))}
+		}
+	}
+	return d
+}
+
+// changedNames lists the keys and files the diff touches.
+func (d *ConfigDiff) changedNames() (keys, files []string) {
+	keys = append(keys, sortedKeys(d.Added)...)
+	keys = append(keys, sortedKeys(d.Removed)...)
+	keys = append(keys, sortedKeys(d.Changed)...)
+	return keys, sortedKeys(d.Files)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+func prefixLines(prefix string, lines []string) []string {
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		out[i] = prefix + l
+	}
+	return out
+}
+
+// diffLines is a longest-common-subsequence line diff keeping context
+// unchanged lines around each change.
+func diffLines(a, b []string, context int) []string {
+	if len(a)*len(b) > maxDiffCells {
+		return append(prefixLines("-", a), prefixLines("+", b)...)
+	}
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var all []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			all = append(all, " "+a[i])
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			all = append(all, "+"+b[j])
+			j++
+		default:
+			all = append(all, "-"+a[i])
+			i++
+		}
+	}
+
+	// Keep only the unchanged lines within context of a change
+	keep := make([]bool, len(all))
+	for n, l := range all {
+		if l[0] == ' ' {
+			continue
+		}
+		for k := n - context; k <= n+context; k++ {
+			if k >= 0 && k < len(all) {
+				keep[k] = true
+			}
+		}
+	}
+	var out []string
+	skipped := false
+	for n, l := range all {
+		if !keep[n] {
+			skipped = true
+			continue
+		}
+		if skipped && len(out) > 0 {
+			out = append(out, "@@")
+		}
+		skipped = false
+		out = append(out, l)
+	}
+	return out
+}
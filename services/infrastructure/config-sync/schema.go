@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ConfigSchema describes the keys a service reads. It is checked against
+// what the service sees once its scopes are merged, whenever one of them
+// changes.
+type ConfigSchema struct {
+	Required   []string                  `json:"required,omitempty"`
+	Properties map[string]PropertySchema `json:"properties,omitempty"`
+	// Strict rejects keys the schema does not list
+	Strict bool `json:"strict,omitempty"`
+}
+
+// PropertySchema constrains one key.
+type PropertySchema struct {
+	Type    string        `json:"type"` // string, number, integer, boolean, object, array
+	Enum    []interface{} `json:"enum,omitempty"`
+	Pattern string        `json:"pattern,omitempty"` // For strings
+	Min     *float64      `json:"min,omitempty"`     // For numbers
+	Max     *float64      `json:"max,omitempty"`
+}
+
+var propertyTypes = map[string]bool{"string": true, "number": true, "integer": true, "boolean": true, "object": true, "array": true}
+
+func (s *ConfigSchema) compile() error {
+	for key, p := range s.Properties {
+		if !propertyTypes[p.Type] {
+			return fmt.Errorf("property %s: unknown type %q", key, p.Type)
+		}
+		if p.Pattern != "" {
+			if _, err := regexp.Compile(p.Pattern); err != nil {
+				return fmt.Errorf("property %s: invalid pattern: %w", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// check validates keys. Required keys are only enforced when complete is
+// set: a scope for every environment need not hold what each environment
+// sets for itself.
+func (s *ConfigSchema) check(keys map[string]json.RawMessage, complete bool) []string {
+	var problems []string
+	if complete {
+		for _, k := range s.Required {
+			if _, ok := keys[k]; !ok {
+				problems = append(problems, fmt.Sprintf("%s is required", k))
+			}
+		}
+	}
+	for _, k := range sortedKeys(keys) {
+		p, ok := s.Properties[k]
+		if !ok {
+			if s.Strict {
+				problems = append(problems, fmt.Sprintf("%s is not in the schema", k))
+			}
+			continue
+		}
+		if msg := p.check(keys[k]); msg != "" {
+			problems = append(problems, k+" "+msg)
+		}
+	}
+	return problems
+}
+
+func (p PropertySchema) check(raw json.RawMessage) string {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "is not valid JSON"
+	}
+
+	switch p.Type {
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return "must be a string"
+		}
+		if p.Pattern != "" && !regexp.MustCompile(p.Pattern).MatchString(str) {
+			return fmt.Sprintf("must match %s", p.Pattern)
+		}
+	case "number", "integer":
+		n, ok := v.(float64)
+		if !ok || (p.Type == "integer" && n != float64(int64(n))) {
+			return "must be a " + p.Type
+		}
+		if p.Min != nil && n < *p.Min {
+			return fmt.Sprintf("must be at least %v", *p.Min)
+		}
+		if p.Max != nil && n > *p.Max {
+			return fmt.Sprintf("must be at most %v", *p.Max)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return "must be a boolean"
+		}
+	case "object":
+		if _, ok := v.(map[string]interface{}); !ok {
+			return "must be an object"
+		}
+	case "array":
+		if _, ok := v.([]interface{}); !ok {
+			return "must be an array"
+		}
+	}
+
+	if len(p.Enum) > 0 {
+		for _, e := range p.Enum {
+			want, _ := json.Marshal(e)
+			if jsonEqual(raw, want) {
+				return ""
+			}
+		}
+		return "is not one of the allowed values"
+	}
+	return ""
+}
+
+// SchemaError lists what a change would break.
+type SchemaError struct {
+	Problems map[string][]string `json:"problems"` // Scope to problems
+}
+
+func (e *SchemaError) Error() string {
+	var parts []string
+	for _, scope := range sortedKeys(e.Problems) {
+		parts = append(parts, scope+": "+strings.Join(e.Problems[scope], ", "))
+	}
+	return "schema validation failed: " + strings.Join(parts, "; ")
+}
+
+func getSchema(ctx context.Context, q querier, service string) (*ConfigSchema, error) {
+	var raw []byte
+	err := q.QueryRowContext(ctx, `SELECT schema FROM config_schemas WHERE service = $1`, service).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s ConfigSchema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func listSchemas(ctx context.Context, q querier) (map[string]*ConfigSchema, error) {
+	rows, err := q.QueryContext(ctx, `SELECT service, schema FROM config_schemas`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schemas := map[string]*ConfigSchema{}
+	for rows.Next() {
+		var service string
+		var raw []byte
+		if err := rows.Scan(&service, &raw); err != nil {
+			return nil, err
+		}
+		var s ConfigSchema
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		schemas[service] = &s
+	}
+	return schemas, rows.Err()
+}
+
+// checkSchemas validates what every service a new version reaches would
+// see: one service for its own scopes, all of those with schemas for the
+// global ones. A base version reaches every environment the services have
+// config for, so each of them is checked.
+func checkSchemas(ctx context.Context, q querier, v *ConfigVersion) error {
+	schemas := map[string]*ConfigSchema{}
+	if v.Service == globalService {
+		all, err := listSchemas(ctx, q)
+		if err != nil {
+			return err
+		}
+		schemas = all
+	} else {
+		s, err := getSchema(ctx, q, v.Service)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			schemas[v.Service] = s
+		}
+	}
+
+	envs := map[string][]string{}
+	for service := range schemas {
+		if v.Environment != "" {
+			envs[service] = []string{v.Environment}
+			continue
+		}
+		all, err := environments(ctx, q, service)
+		if err != nil {
+			return err
+		}
+		envs[service] = all
+	}
+	return checkScopes(schemas, envs, func(service, env string) (*ResolvedConfig, error) {
+		return resolve(ctx, q, service, env, v)
+	})
+}
+
+// checkScopes checks each service's config in each of its environments
+// against its schema. Required keys are enforced in environments, and in
+// the base scope only when the service has no environments, since the base
+// scope is then all its config.
+func checkScopes(schemas map[string]*ConfigSchema, envs map[string][]string, lookup func(service, env string) (*ResolvedConfig, error)) error {
+	failed := &SchemaError{Problems: map[string][]string{}}
+	for _, service := range sortedKeys(schemas) {
+		baseOnly := len(envs[service]) == 1 && envs[service][0] == ""
+		for _, env := range envs[service] {
+			r, err := lookup(service, env)
+			if err != nil {
+				return err
+			}
+			if problems := schemas[service].check(r.Keys, env != "" || baseOnly); len(problems) > 0 {
+				failed.Problems[scopeName(service, env)] = problems
+			}
+		}
+	}
+	if len(failed.Problems) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// environments lists the environments service has config in, its own or
+// global, starting with "" for the base scope.
+func environments(ctx context.Context, q querier, service string) ([]string, error) {
+	envs := map[string]bool{"": true}
+	rows, err := q.QueryContext(ctx, `
+		SELECT DISTINCT environment FROM config_versions WHERE service = $1 OR service = $2`, service, globalService)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var env string
+		if err := rows.Scan(&env); err != nil {
+			return nil, err
+		}
+		envs[env] = true
+	}
+	return sortedKeys(envs), rows.Err()
+}
+
+// putSchema sets a service's schema after checking the service's config
+// in every environment it has one for already passes it.
+func putSchema(ctx context.Context, service string, s *ConfigSchema) error {
+	if err := s.compile(); err != nil {
+		return err
+	}
+	if s.Properties == nil {
+		s.Properties = map[string]PropertySchema{}
+	}
+
+	envs, err := environments(ctx, db, service)
+	if err != nil {
+		return err
+	}
+	err = checkScopes(map[string]*ConfigSchema{service: s}, map[string][]string{service: envs},
+		func(service, env string) (*ResolvedConfig, error) {
+			return resolve(ctx, db, service, env, nil)
+		})
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO config_schemas (service, schema, updated_at) VALUES ($1, $2, NOW())
+		ON CONFLICT (service) DO UPDATE SET schema = EXCLUDED.schema, updated_at = NOW()`, service, raw)
+	return err
+}
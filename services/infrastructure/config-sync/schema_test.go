@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCheckScopes(t *testing.T) {
+	schema := &ConfigSchema{
+		Required:   []string{"url"},
+		Properties: map[string]PropertySchema{"url": {Type: "string"}, "workers": {Type: "integer"}},
+	}
+	keys := func(kv ...string) map[string]json.RawMessage {
+		m := map[string]json.RawMessage{}
+		for i := 0; i < len(kv); i += 2 {
+			m[kv[i]] = json.RawMessage(kv[i+1])
+		}
+		return m
+	}
+
+	tests := []struct {
+		name   string
+		envs   []string
+		config map[string]map[string]json.RawMessage // Environment to resolved keys
+		want   map[string][]string
+	}{
+		{
+			name:   "base scope without environments holds required keys",
+			envs:   []string{""},
+			config: map[string]map[string]json.RawMessage{"": keys("workers", "4")},
+			want:   map[string][]string{"api": {"url is required"}},
+		},
+		{
+			name: "base scope with environments need not hold required keys",
+			envs: []string{"", "prod"},
+			config: map[string]map[string]json.RawMessage{
+				"":     keys("workers", "4"),
+				"prod": keys("workers", "4", "url", `"https://prod"`),
+			},
+		},
+		{
+			name: "base change checked in every environment",
+			envs: []string{"", "prod", "staging"},
+			config: map[string]map[string]json.RawMessage{
+				"":        keys("workers", "4"),
+				"prod":    keys("workers", "4", "url", `"https://prod"`),
+				"staging": keys("workers", "4"),
+			},
+			want: map[string][]string{"api/staging": {"url is required"}},
+		},
+		{
+			name: "types checked in the base scope too",
+			envs: []string{"", "prod"},
+			config: map[string]map[string]json.RawMessage{
+				"":     keys("workers", "1.5"),
+				"prod": keys("workers", "1.5", "url", `"https://prod"`),
+			},
+			want: map[string][]string{"api": {"workers must be a integer"}, "api/prod": {"workers must be a integer"}},
+		},
+		{
+			name: "valid everywhere",
+			envs: []string{"", "prod"},
+			config: map[string]map[string]json.RawMessage{
+				"":     keys("url", `"https://base"`),
+				"prod": keys("url", `"https://prod"`, "workers", "8"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkScopes(map[string]*ConfigSchema{"api": schema}, map[string][]string{"api": tt.envs},
+				func(service, env string) (*ResolvedConfig, error) {
+					return &ResolvedConfig{Service: service, Environment: env, Keys: tt.config[env]}, nil
+				})
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("checkScopes() = %v, want nil", err)
+				}
+				return
+			}
+			var failed *SchemaError
+			if !errors.As(err, &failed) {
+				t.Fatalf("checkScopes() = %v, want a SchemaError", err)
+			}
+			if !reflect.DeepEqual(failed.Problems, tt.want) {
+				t.Errorf("problems = %v, want %v", failed.Problems, tt.want)
+			}
+		})
+	}
+}
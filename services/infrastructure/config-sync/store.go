@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Configs live in scopes of a service and an environment. The "global"
+// service applies to every service and an empty environment to every
+// environment, so a service in an environment sees, each overriding the
+// one before:
+//
+//	global, global/<env>, <service>, <service>/<env>
+//
+// Every change to a scope stores a new version holding the whole scope,
+// so history, diff and rollback never have to replay anything.
+
+const (
+	globalService = "global"
+	maxConfigSize = 1 << 20
+)
+
+var scopeNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+const configSchema = `
+	CREATE TABLE IF NOT EXISTS config_versions (
+		id BIGSERIAL PRIMARY KEY,
+		service VARCHAR(64) NOT NULL,
+		environment VARCHAR(64) NOT NULL DEFAULT '',
+		version INT NOT NULL,
+		config JSONB NOT NULL,
+		author VARCHAR(255),
+		message TEXT,
+		created_at TIMESTAMPTZ DEFAULT NOW(),
+		UNIQUE (service, environment, version)
+	);
+
+	CREATE TABLE IF NOT EXISTS config_schemas (
+		service VARCHAR(64) PRIMARY KEY,
+		schema JSONB NOT NULL,
+		updated_at TIMESTAMPTZ DEFAULT NOW()
+	);
+`
+
+// ConfigDoc is the content of one scope: key/value settings and whole
+// files, e.g. a YAML file a service reads at startup.
+type ConfigDoc struct {
+	Keys  map[string]json.RawMessage `json:"keys"`
+	Files map[string]string          `json:"files"`
+}
+
+func newConfigDoc() *ConfigDoc {
+	return &ConfigDoc{Keys: map[string]json.RawMessage{}, Files: map[string]string{}}
+}
+
+func (d *ConfigDoc) clone() *ConfigDoc {
+	c := newConfigDoc()
+	for k, v := range d.Keys {
+		c.Keys[k] = v
+	}
+	for name, content := range d.Files {
+		c.Files[name] = content
+	}
+	return c
+}
+
+func (d *ConfigDoc) equal(o *ConfigDoc) bool {
+	if len(d.Keys) != len(o.Keys) || len(d.Files) != len(o.Files) {
+		return false
+	}
+	for k, v := range d.Keys {
+		if w, ok := o.Keys[k]; !ok || !jsonEqual(v, w) {
+			return false
+		}
+	}
+	for name, content := range d.Files {
+		if c, ok := o.Files[name]; !ok || c != content {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *ConfigDoc) validate() error {
+	for k, v := range d.Keys {
+		if k == "" || strings.ContainsAny(k, " \t\n") {
+			return fmt.Errorf("invalid key %q", k)
+		}
+		if !json.Valid(v) {
+			return fmt.Errorf("key %s is not valid JSON", k)
+		}
+	}
+	for name := range d.Files {
+		if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+	}
+	return nil
+}
+
+// ConfigVersion is one stored version of a scope. Revision numbers every
+// version of every scope, and commits are serialised so that no version
+// appears with a lower revision than one already visible. A watcher that
+// has seen a resolved config's revision, the highest of its scopes', has
+// therefore seen every change to those scopes up to it.
+type ConfigVersion struct {
+	Revision    int64      `json:"revision"`
+	Service     string     `json:"service"`
+	Environment string     `json:"environment,omitempty"`
+	Version     int        `json:"version"`
+	Author      string     `json:"author,omitempty"`
+	Message     string     `json:"message,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Config      *ConfigDoc `json:"config,omitempty"`
+}
+
+func (v *ConfigVersion) scope() string {
+	return scopeName(v.Service, v.Environment)
+}
+
+func scopeName(service, env string) string {
+	if env == "" {
+		return service
+	}
+	return service + "/" + env
+}
+
+func validScope(service, env string) error {
+	if !scopeNamePattern.MatchString(service) {
+		return fmt.Errorf("invalid service %q", service)
+	}
+	if env != "" && !scopeNamePattern.MatchString(env) {
+		return fmt.Errorf("invalid environment %q", env)
+	}
+	return nil
+}
+
+type querier interface {
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
+
+const versionColumns = `id, service, environment, version, COALESCE(author, ''), COALESCE(message, ''), created_at, config`
+
+func scanVersion(row interface{ Scan(...interface{}) error }) (*ConfigVersion, error) {
+	var v ConfigVersion
+	var raw []byte
+	if err := row.Scan(&v.Revision, &v.Service, &v.Environment, &v.Version, &v.Author, &v.Message, &v.CreatedAt, &raw); err != nil {
+		return nil, err
+	}
+	v.Config = newConfigDoc()
+	if err := json.Unmarshal(raw, v.Config); err != nil {
+		return nil, fmt.Errorf("corrupt config version %d: %w", v.Revision, err)
+	}
+	if v.Config.Keys == nil {
+		v.Config.Keys = map[string]json.RawMessage{}
+	}
+	if v.Config.Files == nil {
+		v.Config.Files = map[string]string{}
+	}
+	return &v, nil
+}
+
+// getVersion returns a version of a scope, the latest if version is 0, or
+// nil if there is none.
+func getVersion(ctx context.Context, q querier, service, env string, version int) (*ConfigVersion, error) {
+	query := `SELECT ` + versionColumns + ` FROM config_versions WHERE service = $1 AND environment = $2`
+	args := []interface{}{service, env}
+	if version > 0 {
+		query += ` AND version = $3`
+		args = append(args, version)
+	} else {
+		query += ` ORDER BY version DESC LIMIT 1`
+	}
+	v, err := scanVersion(q.QueryRowContext(ctx, query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return v, err
+}
+
+// history lists a scope's versions, newest first, without their content.
+func history(ctx context.Context, service, env string, limit int) ([]*ConfigVersion, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+versionColumns+` FROM config_versions
+		WHERE service = $1 AND environment = $2
+		ORDER BY version DESC LIMIT $3`, service, env, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []*ConfigVersion{}
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		v.Config = nil
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// ScopeSummary describes the latest version of a scope.
+type ScopeSummary struct {
+	Service     string    `json:"service"`
+	Environment string    `json:"environment,omitempty"`
+	Version     int       `json:"version"`
+	Revision    int64     `json:"revision"`
+	Keys        int       `json:"keys"`
+	Files       int       `json:"files"`
+	Author      string    `json:"author,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func listScopes(ctx context.Context) ([]ScopeSummary, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT DISTINCT ON (service, environment) `+versionColumns+`
+		FROM config_versions ORDER BY service, environment, version DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scopes := []ScopeSummary{}
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, ScopeSummary{
+			Service:     v.Service,
+			Environment: v.Environment,
+			Version:     v.Version,
+			Revision:    v.Revision,
+			Keys:        len(v.Config.Keys),
+			Files:       len(v.Config.Files),
+			Author:      v.Author,
+			UpdatedAt:   v.CreatedAt,
+		})
+	}
+	return scopes, rows.Err()
+}
+
+// ResolvedConfig is what a service in an environment sees: its scopes
+// merged, with where each key and file came from.
+type ResolvedConfig struct {
+	Service     string                     `json:"service"`
+	Environment string                     `json:"environment,omitempty"`
+	Revision    int64                      `json:"revision"`
+	Keys        map[string]json.RawMessage `json:"keys"`
+	Files       map[string]string          `json:"files"`
+	Sources     map[string]string          `json:"sources"` // Key or file:<name> to the scope it came from
+	Versions    map[string]int             `json:"versions"`
+}
+
+// overlayScopes are the scopes a service in env sees, weakest first.
+func overlayScopes(service, env string) [][2]string {
+	scopes := [][2]string{{globalService, ""}}
+	if env != "" {
+		scopes = append(scopes, [2]string{globalService, env})
+	}
+	if service != globalService {
+		scopes = append(scopes, [2]string{service, ""})
+		if env != "" {
+			scopes = append(scopes, [2]string{service, env})
+		}
+	}
+	return scopes
+}
+
+// resolve merges the latest versions of the scopes service sees in env.
+// With pending set, it stands in for the stored version of its scope, so
+// a change can be checked before it is committed.
+func resolve(ctx context.Context, q querier, service, env string, pending *ConfigVersion) (*ResolvedConfig, error) {
+	scopes := overlayScopes(service, env)
+	var conds []string
+	var args []interface{}
+	for _, s := range scopes {
+		args = append(args, s[0], s[1])
+		conds = append(conds, fmt.Sprintf("(service = $%d AND environment = $%d)", len(args)-1, len(args)))
+	}
+	rows, err := q.QueryContext(ctx, `
+		SELECT DISTINCT ON (service, environment) `+versionColumns+`
+		FROM config_versions WHERE `+strings.Join(conds, " OR ")+`
+		ORDER BY service, environment, version DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	latest := map[string]*ConfigVersion{}
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		latest[v.scope()] = v
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		latest[pending.scope()] = pending
+	}
+
+	r := &ResolvedConfig{
+		Service:     service,
+		Environment: env,
+		Keys:        map[string]json.RawMessage{},
+		Files:       map[string]string{},
+		Sources:     map[string]string{},
+		Versions:    map[string]int{},
+	}
+	for _, s := range scopes {
+		v, ok := latest[scopeName(s[0], s[1])]
+		if !ok {
+			continue
+		}
+		if v.Revision > r.Revision {
+			r.Revision = v.Revision
+		}
+		r.Versions[v.scope()] = v.Version
+		for k, val := range v.Config.Keys {
+			r.Keys[k] = val
+			r.Sources[k] = v.scope()
+		}
+		for name, content := range v.Config.Files {
+			r.Files[name] = content
+			r.Sources["file:"+name] = v.scope()
+		}
+	}
+	return r, nil
+}
+
+var errVersionConflict = errors.New("version conflict")
+
+// ConfigChange is a request to change a scope. change edits a copy of the
+// scope's latest content; baseVersion, if set, must be the latest version.
+type ConfigChange struct {
+	Service     string
+	Environment string
+	BaseVersion int
+	Author      string
+	Message     string
+	change      func(doc *ConfigDoc) error
+}
+
+// commit stores a new version of a scope if the change alters it, after
+// checking the result against the schemas of the services it reaches. It
+// returns the latest version and whether it is new.
+func commit(ctx context.Context, c *ConfigChange) (*ConfigVersion, bool, error) {
+	if err := validScope(c.Service, c.Environment); err != nil {
+		return nil, false, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// Serialise changes to every scope, so revisions become visible in the
+	// order they are numbered; readers never wait
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, "config:commit"); err != nil {
+		return nil, false, err
+	}
+
+	current, err := getVersion(ctx, tx, c.Service, c.Environment, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	currentVersion := 0
+	doc := newConfigDoc()
+	if current != nil {
+		currentVersion = current.Version
+		doc = current.Config.clone()
+	}
+	if c.BaseVersion > 0 && c.BaseVersion != currentVersion {
+		return nil, false, fmt.Errorf("%w: %s is at version %d, not %d", errVersionConflict, scopeName(c.Service, c.Environment), currentVersion, c.BaseVersion)
+	}
+
+	if err := c.change(doc); err != nil {
+		return nil, false, err
+	}
+	if err := doc.validate(); err != nil {
+		return nil, false, err
+	}
+	if current != nil && doc.equal(current.Config) {
+		return current, false, nil
+	}
+
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(raw) > maxConfigSize {
+		return nil, false, fmt.Errorf("config is %d bytes, the limit is %d", len(raw), maxConfigSize)
+	}
+
+	next := &ConfigVersion{
+		Service:     c.Service,
+		Environment: c.Environment,
+		Version:     currentVersion + 1,
+		Author:      c.Author,
+		Message:     c.Message,
+		Config:      doc,
+	}
+	if err := checkSchemas(ctx, tx, next); err != nil {
+		return nil, false, err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO config_versions (service, environment, version, config, author, message)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''))
+		RETURNING id, created_at`,
+		next.Service, next.Environment, next.Version, raw, next.Author, next.Message).Scan(&next.Revision, &next.CreatedAt)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	previous := newConfigDoc()
+	if current != nil {
+		previous = current.Config
+	}
+	announce(next, diffConfigs(previous, next.Config))
+	return next, true, nil
+}
+
+// announce wakes watchers and emits config.changed.<service>, which
+// services subscribe to for their own name and for "global".
+func announce(v *ConfigVersion, d *ConfigDiff) {
+	changes.broadcast()
+	atomic.AddUint64(&configChanges, 1)
+
+	logger.Log("info", "Config changed", map[string]interface{}{
+		"scope": v.scope(), "version": v.Version, "revision": v.Revision, "author": v.Author,
+	})
+
+	if eventBus == nil {
+		return
+	}
+	keys, files := d.changedNames()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := eventBus.Emit(ctx, "config.changed."+v.Service, v.scope(), map[string]interface{}{
+		"service":     v.Service,
+		"environment": v.Environment,
+		"version":     v.Version,
+		"revision":    v.Revision,
+		"author":      v.Author,
+		"message":     v.Message,
+		"keys":        keys,
+		"files":       files,
+	})
+	if err != nil {
+		logger.Log("warn", "Failed to emit config change", map[string]interface{}{"scope": v.scope(), "error": err.Error()})
+	}
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return string(a) == string(b)
+	}
+	xs, _ := json.Marshal(x)
+	ys, _ := json.Marshal(y)
+	return string(xs) == string(ys)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWait    = 30 * time.Second
+	maxWait        = 60 * time.Second
+	sseHeartbeat   = 25 * time.Second
+	resolveTimeout = 10 * time.Second
+)
+
+// changeNotifier wakes everyone waiting on a config change. Waiters
+// re-resolve their config and compare revisions, so it need not say what
+// changed. Changes made by other replicas arrive as config.changed events.
+type changeNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+var changes = &changeNotifier{ch: make(chan struct{})}
+
+func (n *changeNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+func (n *changeNotifier) broadcast() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
+
+// waitForChange resolves service's config in env once its revision is past
+// after, or returns nil when wait runs out first.
+func waitForChange(ctx context.Context, service, env string, after int64, wait time.Duration) (*ResolvedConfig, error) {
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		// Take the channel before resolving so a change in between is not missed
+		changed := changes.wait()
+
+		rctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+		r, err := resolve(rctx, db, service, env, nil)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if r.Revision > after {
+			return r, nil
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// resolveHandler serves GET /resolve/{service}?env=. Given revision, it
+// long-polls: the response waits up to wait (default 30s, at most 60s)
+// for a newer revision and is 304 Not Modified if none comes.
+func resolveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	service, env, ok := scopeFromRequest(w, r, "/resolve/")
+	if !ok {
+		return
+	}
+
+	var after int64 = -1
+	if v := r.URL.Query().Get("revision"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid revision", http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+	wait := defaultWait
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = d
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+
+	resolved, err := waitForChange(r.Context(), service, env, after, wait)
+	if err != nil {
+		if r.Context().Err() == nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if resolved == nil {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Config-Revision", strconv.FormatInt(resolved.Revision, 10))
+	json.NewEncoder(w).Encode(resolved)
+}
+
+// watchHandler serves GET /watch/{service}?env= as server-sent events: a
+// "config" event with the resolved config straight away and again each
+// time it changes.
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	service, env, ok := scopeFromRequest(w, r, "/watch/")
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var revision int64 = -1
+	if n, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		revision = n
+	}
+
+	watchers.Add(1)
+	defer watchers.Add(-1)
+
+	for {
+		resolved, err := waitForChange(r.Context(), service, env, revision, sseHeartbeat)
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %q\n\n", err.Error())
+			flusher.Flush()
+			select {
+			case <-time.After(5 * time.Second):
+				continue
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if resolved == nil {
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+			continue
+		}
+
+		data, _ := json.Marshal(resolved)
+		fmt.Fprintf(w, "id: %d\nevent: config\ndata: %s\n\n", resolved.Revision, data)
+		flusher.Flush()
+		revision = resolved.Revision
+	}
+}
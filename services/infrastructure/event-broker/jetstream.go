@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// JetStream keeps every event published on events.> on disk, so a
+// subscriber that is down picks up where it left off instead of losing
+// what was sent meanwhile. With CLUSTER_ROUTES set the broker runs as one
+// node of a cluster (a StatefulSet of three in deployment.yaml) and the
+// streams are replicated across it. With NATS_AUTH_FILE set, clients log
+// in as users or nkeys that belong to accounts; each account has its own
+// subjects and, if enabled, its own JetStream streams.
+
+// AccountConfig is one account in the auth file.
+type AccountConfig struct {
+	Name      string       `json:"name"`
+	JetStream bool         `json:"jetstream"`
+	Users     []UserConfig `json:"users"`
+	Nkeys     []string     `json:"nkeys"` // Public user nkeys (U...)
+}
+
+type UserConfig struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// AuthConfig is the JSON in NATS_AUTH_FILE, mounted from a Secret.
+type AuthConfig struct {
+	Accounts      []AccountConfig `json:"accounts"`
+	SystemAccount string          `json:"system_account,omitempty"`
+}
+
+// StreamSpec is a stream the broker creates and keeps in line with its
+// configured limits.
+type StreamSpec struct {
+	Name     string
+	Subjects []string
+	MaxAge   time.Duration
+	MaxBytes int64
+	MaxMsgs  int64
+	Replicas int
+}
+
+// brokerAccount is an account streams are created in, with the internal
+// user the broker connects as to do it.
+type brokerAccount struct {
+	name     string
+	user     string
+	password string
+}
+
+var (
+	authEnabled    bool
+	clustered      bool
+	streamSpecs    []StreamSpec
+	brokerAccounts []brokerAccount
+)
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvInt64(key string, defaultValue int64) int64 {
+	if n, err := strconv.ParseInt(os.Getenv(key), 10, 64); err == nil {
+		return n
+	}
+	return defaultValue
+}
+
+// parseDuration also accepts days, e.g. 7d.
+func parseDuration(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && strings.HasSuffix(s, "d") {
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// buildOptions turns the environment into server options.
+func buildOptions() (*server.Options, error) {
+	hostname, _ := os.Hostname()
+
+	opts := &server.Options{
+		Host:               "0.0.0.0",
+		Port:               int(getEnvInt64("NATS_PORT", 4222)),
+		ServerName:         getEnv("SERVER_NAME", hostname),
+		NoLog:              false,
+		NoSigs:             true,
+		MaxControlLine:     4096,
+		JetStream:          true,
+		StoreDir:           getEnv("JETSTREAM_STORE_DIR", "/data/jetstream"),
+		JetStreamMaxMemory: getEnvInt64("JETSTREAM_MAX_MEMORY_MB", 64) << 20,
+		JetStreamMaxStore:  getEnvInt64("JETSTREAM_MAX_STORE_MB", 4096) << 20,
+	}
+
+	// Every node lists all the routes, itself included; the server skips
+	// its own
+	replicas := 1
+	if routes := os.Getenv("CLUSTER_ROUTES"); routes != "" {
+		opts.Cluster = server.ClusterOpts{
+			Name:     getEnv("CLUSTER_NAME", "holm-events"),
+			Host:     "0.0.0.0",
+			Port:     int(getEnvInt64("CLUSTER_PORT", 6222)),
+			Username: os.Getenv("CLUSTER_USER"),
+			Password: os.Getenv("CLUSTER_PASSWORD"),
+		}
+		opts.Routes = server.RoutesFromStr(routes)
+		for _, u := range opts.Routes {
+			if opts.Cluster.Username != "" && u.User == nil {
+				u.User = url.UserPassword(opts.Cluster.Username, opts.Cluster.Password)
+			}
+		}
+		clustered = true
+		replicas = len(opts.Routes)
+		if replicas > 3 {
+			replicas = 3
+		}
+	}
+
+	maxAge, err := parseDuration(getEnv("EVENTS_MAX_AGE", "7d"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid EVENTS_MAX_AGE: %w", err)
+	}
+	if n := getEnvInt64("EVENTS_REPLICAS", 0); n > 0 {
+		replicas = int(n)
+	}
+	streamSpecs = []StreamSpec{{
+		Name:     getEnv("EVENTS_STREAM", "EVENTS"),
+		Subjects: []string{"events.>"},
+		MaxAge:   maxAge,
+		MaxBytes: getEnvInt64("EVENTS_MAX_BYTES_MB", 1024) << 20,
+		MaxMsgs:  getEnvInt64("EVENTS_MAX_MSGS", -1),
+		Replicas: replicas,
+	}}
+
+	if path := os.Getenv("NATS_AUTH_FILE"); path != "" {
+		if err := loadAuth(path, opts); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// loadAuth adds the accounts and users in the auth file to opts. A missing
+// file leaves the broker open, so the Secret can be added later.
+func loadAuth(path string, opts *server.Options) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Log("warn", "Auth file not found, running without auth", map[string]interface{}{"path": path})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read auth file: %w", err)
+	}
+	var cfg AuthConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("invalid auth file: %w", err)
+	}
+
+	for _, ac := range cfg.Accounts {
+		if ac.Name == "" {
+			return fmt.Errorf("invalid auth file: account without a name")
+		}
+		acc := server.NewAccount(ac.Name)
+		opts.Accounts = append(opts.Accounts, acc)
+		for _, u := range ac.Users {
+			opts.Users = append(opts.Users, &server.User{Username: u.User, Password: u.Password, Account: acc})
+		}
+		for _, nk := range ac.Nkeys {
+			opts.Nkeys = append(opts.Nkeys, &server.NkeyUser{Nkey: nk, Account: acc})
+		}
+		if ac.JetStream {
+			internal := brokerAccount{name: ac.Name, user: "event-broker-" + strings.ToLower(ac.Name), password: randomToken()}
+			opts.Users = append(opts.Users, &server.User{Username: internal.user, Password: internal.password, Account: acc})
+			brokerAccounts = append(brokerAccounts, internal)
+		}
+	}
+	if cfg.SystemAccount != "" {
+		opts.SystemAccount = cfg.SystemAccount
+	}
+	authEnabled = true
+
+	logger.Log("info", "Auth enabled", map[string]interface{}{
+		"accounts": len(cfg.Accounts),
+		"users":    len(opts.Users) - len(brokerAccounts),
+		"nkeys":    len(opts.Nkeys),
+	})
+	return nil
+}
+
+func randomToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// enableAccounts turns JetStream on for the accounts that asked for it.
+// Without an auth file the global account already has it.
+func enableAccounts() error {
+	for _, ba := range brokerAccounts {
+		acc, err := natsServer.LookupAccount(ba.name)
+		if err != nil {
+			return fmt.Errorf("account %s: %w", ba.name, err)
+		}
+		if err := acc.EnableJetStream(nil); err != nil {
+			return fmt.Errorf("failed to enable JetStream for account %s: %w", ba.name, err)
+		}
+	}
+	return nil
+}
+
+// ensureStreams creates or updates the streams in every JetStream account,
+// retrying until the cluster has elected a meta leader.
+func ensureStreams() {
+	accounts := brokerAccounts
+	if !authEnabled {
+		accounts = []brokerAccount{{name: server.DEFAULT_GLOBAL_ACCOUNT}}
+	} else if len(accounts) == 0 {
+		logger.Log("warn", "No account has JetStream enabled, events will not be stored", nil)
+	}
+	for _, ba := range accounts {
+		go func(ba brokerAccount) {
+			for attempt := 1; ; attempt++ {
+				err := ensureAccountStreams(ba)
+				if err == nil {
+					return
+				}
+				logger.Log("warn", "Failed to set up streams, retrying", map[string]interface{}{
+					"account": ba.name,
+					"attempt": attempt,
+					"error":   err.Error(),
+				})
+				time.Sleep(5 * time.Second)
+			}
+		}(ba)
+	}
+}
+
+func ensureAccountStreams(ba brokerAccount) error {
+	connOpts := []nats.Option{nats.InProcessServer(natsServer), nats.Name("event-broker")}
+	if ba.user != "" {
+		connOpts = append(connOpts, nats.UserInfo(ba.user, ba.password))
+	}
+	nc, err := nats.Connect("", connOpts...)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream(nats.MaxWait(10 * time.Second))
+	if err != nil {
+		return err
+	}
+
+	for _, spec := range streamSpecs {
+		cfg := &nats.StreamConfig{
+			Name:       spec.Name,
+			Subjects:   spec.Subjects,
+			Retention:  nats.LimitsPolicy,
+			Storage:    nats.FileStorage,
+			Discard:    nats.DiscardOld,
+			MaxAge:     spec.MaxAge,
+			MaxBytes:   spec.MaxBytes,
+			MaxMsgs:    spec.MaxMsgs,
+			Replicas:   spec.Replicas,
+			Duplicates: 2 * time.Minute,
+		}
+		action := "updated"
+		_, err := js.StreamInfo(spec.Name)
+		switch {
+		case errors.Is(err, nats.ErrStreamNotFound):
+			action = "created"
+			_, err = js.AddStream(cfg)
+		case err == nil:
+			_, err = js.UpdateStream(cfg)
+		}
+		if err != nil {
+			return fmt.Errorf("stream %s: %w", spec.Name, err)
+		}
+		logger.Log("info", "Stream "+action, map[string]interface{}{
+			"account":   ba.name,
+			"stream":    spec.Name,
+			"subjects":  strings.Join(spec.Subjects, ","),
+			"max_age":   spec.MaxAge.String(),
+			"max_bytes": spec.MaxBytes,
+			"replicas":  spec.Replicas,
+		})
+	}
+	return nil
+}
+
+// jetStreamStats reports the streams and consumers this node holds.
+func jetStreamStats() map[string]interface{} {
+	jsz, err := natsServer.Jsz(&server.JSzOptions{Accounts: true, Streams: true, Consumer: true, Config: true})
+	if err != nil {
+		return map[string]interface{}{"enabled": false, "error": err.Error()}
+	}
+	if jsz.Disabled {
+		return map[string]interface{}{"enabled": false}
+	}
+
+	streams := []map[string]interface{}{}
+	consumers := []map[string]interface{}{}
+	for _, acc := range jsz.AccountDetails {
+		for _, sd := range acc.Streams {
+			stream := map[string]interface{}{
+				"account":   acc.Name,
+				"name":      sd.Name,
+				"messages":  sd.State.Msgs,
+				"bytes":     sd.State.Bytes,
+				"first_seq": sd.State.FirstSeq,
+				"last_seq":  sd.State.LastSeq,
+				"consumers": sd.State.Consumers,
+				"created":   sd.Created,
+			}
+			if sd.Config != nil {
+				stream["subjects"] = sd.Config.Subjects
+				stream["max_age"] = sd.Config.MaxAge.String()
+				stream["max_bytes"] = sd.Config.MaxBytes
+				stream["max_msgs"] = sd.Config.MaxMsgs
+				stream["replicas"] = sd.Config.Replicas
+			}
+			if sd.Cluster != nil {
+				stream["leader"] = sd.Cluster.Leader
+			}
+			streams = append(streams, stream)
+
+			for _, ci := range sd.Consumer {
+				consumers = append(consumers, map[string]interface{}{
+					"account":         acc.Name,
+					"stream":          sd.Name,
+					"name":            ci.Name,
+					"num_pending":     ci.NumPending,
+					"num_ack_pending": ci.NumAckPending,
+					"num_redelivered": ci.NumRedelivered,
+					"num_waiting":     ci.NumWaiting,
+					"delivered_seq":   ci.Delivered.Stream,
+					"ack_floor_seq":   ci.AckFloor.Stream,
+				})
+			}
+		}
+	}
+
+	stats := map[string]interface{}{
+		"enabled":       true,
+		"store_dir":     jsz.Config.StoreDir,
+		"memory":        jsz.Memory,
+		"storage":       jsz.Store,
+		"max_memory":    jsz.Config.MaxMemory,
+		"max_storage":   jsz.Config.MaxStore,
+		"num_streams":   jsz.Streams,
+		"num_consumers": jsz.Consumers,
+		"messages":      jsz.Messages,
+		"bytes":         jsz.Bytes,
+		"api_total":     jsz.API.Total,
+		"api_errors":    jsz.API.Errors,
+		"streams":       streams,
+		"consumers":     consumers,
+	}
+	if jsz.Meta != nil {
+		stats["meta_leader"] = jsz.Meta.Leader
+		stats["cluster_size"] = jsz.Meta.Size
+	}
+	return stats
+}
+
+// clusterStats reports this node's routes to its peers.
+func clusterStats() map[string]interface{} {
+	name := natsServer.ClusterName()
+	routez, err := natsServer.Routez(nil)
+	if err != nil {
+		return map[string]interface{}{"name": name, "error": err.Error()}
+	}
+	peers := []map[string]interface{}{}
+	for _, r := range routez.Routes {
+		peers = append(peers, map[string]interface{}{
+			"name":     r.RemoteName,
+			"ip":       r.IP,
+			"port":     r.Port,
+			"rtt":      r.RTT,
+			"uptime":   r.Uptime,
+			"in_msgs":  r.InMsgs,
+			"out_msgs": r.OutMsgs,
+		})
+	}
+	return map[string]interface{}{
+		"name":        name,
+		"server_name": natsServer.Name(),
+		"num_routes":  routez.NumRoutes,
+		"routes":      peers,
+	}
+}
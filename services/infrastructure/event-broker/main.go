@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"sync"
@@ -70,6 +69,7 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	if natsServer != nil && natsServer.Running() {
 		status["nats"].(map[string]interface{})["connections"] = natsServer.NumClients()
 		status["nats"].(map[string]interface{})["subscriptions"] = natsServer.NumSubscriptions()
+		status["nats"].(map[string]interface{})["jetstream"] = natsServer.JetStreamEnabled()
 	} else {
 		status["status"] = "unhealthy"
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -87,10 +87,12 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	running := 0
 	clients := 0
 	subs := 0
+	var jsz *server.JSInfo
 	if natsServer != nil && natsServer.Running() {
 		running = 1
 		clients = natsServer.NumClients()
-		subs = natsServer.NumSubscriptions()
+		subs = int(natsServer.NumSubscriptions())
+		jsz, _ = natsServer.Jsz(&server.JSzOptions{Accounts: true, Streams: true, Consumer: true})
 	}
 
 	fmt.Fprintf(w, "# HELP event_broker_up Whether the event broker is up\n")
@@ -108,6 +110,31 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "# HELP event_broker_requests_total Total HTTP requests\n")
 	fmt.Fprintf(w, "# TYPE event_broker_requests_total counter\n")
 	fmt.Fprintf(w, "event_broker_requests_total %d\n", atomic.LoadUint64(&requestCounter))
+
+	if jsz == nil || jsz.Disabled {
+		return
+	}
+	fmt.Fprintf(w, "# HELP event_broker_jetstream_storage_bytes Bytes stored by JetStream on disk\n")
+	fmt.Fprintf(w, "# TYPE event_broker_jetstream_storage_bytes gauge\n")
+	fmt.Fprintf(w, "event_broker_jetstream_storage_bytes %d\n", jsz.Store)
+
+	fmt.Fprintf(w, "# HELP event_broker_stream_messages Messages held by a stream\n")
+	fmt.Fprintf(w, "# TYPE event_broker_stream_messages gauge\n")
+	for _, acc := range jsz.AccountDetails {
+		for _, sd := range acc.Streams {
+			fmt.Fprintf(w, "event_broker_stream_messages{account=%q,stream=%q} %d\n", acc.Name, sd.Name, sd.State.Msgs)
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP event_broker_consumer_pending Messages a consumer has yet to receive\n")
+	fmt.Fprintf(w, "# TYPE event_broker_consumer_pending gauge\n")
+	for _, acc := range jsz.AccountDetails {
+		for _, sd := range acc.Streams {
+			for _, ci := range sd.Consumer {
+				fmt.Fprintf(w, "event_broker_consumer_pending{account=%q,stream=%q,consumer=%q} %d\n", acc.Name, sd.Name, ci.Name, ci.NumPending)
+			}
+		}
+	}
 }
 
 func statsHandler(w http.ResponseWriter, r *http.Request) {
@@ -123,12 +150,19 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 		stats["subscriptions"] = natsServer.NumSubscriptions()
 		stats["routes"] = natsServer.NumRoutes()
 		stats["remotes"] = natsServer.NumRemotes()
-		stats["in_msgs"] = natsServer.Varz().InMsgs
-		stats["out_msgs"] = natsServer.Varz().OutMsgs
-		stats["in_bytes"] = natsServer.Varz().InBytes
-		stats["out_bytes"] = natsServer.Varz().OutBytes
-		stats["slow_consumers"] = natsServer.Varz().SlowConsumers
-		stats["uptime"] = natsServer.Varz().Now.Sub(natsServer.Varz().Start).String()
+		if varz, err := natsServer.Varz(nil); err == nil {
+			stats["in_msgs"] = varz.InMsgs
+			stats["out_msgs"] = varz.OutMsgs
+			stats["in_bytes"] = varz.InBytes
+			stats["out_bytes"] = varz.OutBytes
+			stats["slow_consumers"] = varz.SlowConsumers
+			stats["uptime"] = varz.Now.Sub(varz.Start).String()
+		}
+		stats["auth"] = authEnabled
+		stats["jetstream"] = jetStreamStats()
+		if clustered {
+			stats["cluster"] = clusterStats()
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -137,6 +171,12 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 
 func uiHandler(w http.ResponseWriter, r *http.Request) {
 	running := natsServer != nil && natsServer.Running()
+	streams, messages := 0, uint64(0)
+	if running {
+		if jsz, err := natsServer.Jsz(nil); err == nil {
+			streams, messages = jsz.Streams, jsz.Messages
+		}
+	}
 	statusColor := ColorGreen
 	statusText := "Running"
 	if !running {
@@ -168,27 +208,26 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
         <div class="metrics">
             <div class="metric"><span>Connections</span><span class="metric-value">%d</span></div>
             <div class="metric"><span>Subscriptions</span><span class="metric-value">%d</span></div>
+            <div class="metric"><span>Streams</span><span class="metric-value">%d</span></div>
+            <div class="metric"><span>Stored Events</span><span class="metric-value">%d</span></div>
         </div>
     </div>
 </body>
 </html>`, ColorBase, ColorText, ColorMauve, ColorMantle, statusColor, ColorCrust, ColorBlue, statusText,
 		func() int { if natsServer != nil { return natsServer.NumClients() }; return 0 }(),
-		func() int { if natsServer != nil { return natsServer.NumSubscriptions() }; return 0 }())
+		func() int { if natsServer != nil { return int(natsServer.NumSubscriptions()) }; return 0 }(),
+		streams, messages)
 
 	w.Header().Set("Content-Type", "text/html")
 	w.Write([]byte(html))
 }
 
 func startNATSServer() error {
-	opts := &server.Options{
-		Host:           "0.0.0.0",
-		Port:           4222,
-		NoLog:          false,
-		NoSigs:         true,
-		MaxControlLine: 4096,
+	opts, err := buildOptions()
+	if err != nil {
+		return err
 	}
 
-	var err error
 	natsServer, err = server.NewServer(opts)
 	if err != nil {
 		return fmt.Errorf("failed to create NATS server: %w", err)
@@ -200,9 +239,18 @@ func startNATSServer() error {
 		return fmt.Errorf("NATS server not ready for connections")
 	}
 
+	if err := enableAccounts(); err != nil {
+		return err
+	}
+	ensureStreams()
+
 	logger.Log("info", "NATS server started", map[string]interface{}{
-		"host": opts.Host,
-		"port": opts.Port,
+		"host":      opts.Host,
+		"port":      opts.Port,
+		"name":      opts.ServerName,
+		"store_dir": opts.StoreDir,
+		"cluster":   opts.Cluster.Name,
+		"routes":    len(opts.Routes),
 	})
 
 	return nil
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DepthAlerter tells notification-hub when open DLQ entries (new or
+// investigating) pile up, in total or in one group, and again when they
+// have been dealt with.
+type DepthAlerter struct {
+	hubURL         string
+	threshold      int
+	groupThreshold int
+	repeat         time.Duration
+	client         *http.Client
+
+	mu     sync.Mutex
+	firing map[string]time.Time // Alert key to when it last notified
+}
+
+func NewDepthAlerter() *DepthAlerter {
+	env := func(name string, def int) int {
+		if n, err := strconv.Atoi(os.Getenv(name)); err == nil {
+			return n
+		}
+		return def
+	}
+	hubURL := os.Getenv("NOTIFICATION_HUB_URL")
+	if hubURL == "" {
+		hubURL = "http://notification-hub.holm.svc.cluster.local"
+	}
+	if hubURL == "off" {
+		hubURL = ""
+	}
+	repeat := time.Hour
+	if d, err := time.ParseDuration(os.Getenv("DLQ_ALERT_REPEAT")); err == nil && d > 0 {
+		repeat = d
+	}
+	return &DepthAlerter{
+		hubURL:         strings.TrimSuffix(hubURL, "/"),
+		threshold:      env("DLQ_ALERT_THRESHOLD", 100),
+		groupThreshold: env("DLQ_ALERT_GROUP_THRESHOLD", 25),
+		repeat:         repeat,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		firing:         make(map[string]time.Time),
+	}
+}
+
+func (a *DepthAlerter) Run(ctx context.Context) {
+	if a.hubURL == "" || a.threshold <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if db != nil {
+				a.check(ctx)
+			}
+		}
+	}
+}
+
+func (a *DepthAlerter) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	open := &DLQFilter{Status: []string{StatusNew, StatusInvestigating}}
+	depth, err := countEntries(ctx, open)
+	if err != nil {
+		logger.Log("warn", "Failed to check DLQ depth", map[string]interface{}{"error": err.Error()})
+		return
+	}
+	groups, err := listGroups(ctx, open)
+	if err != nil {
+		logger.Log("warn", "Failed to check DLQ depth", map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.evaluate("depth", depth >= a.threshold, func(status string) (string, string, map[string]interface{}) {
+		top := groups
+		if len(top) > 5 {
+			top = top[:5]
+		}
+		var lines []string
+		for _, g := range top {
+			lines = append(lines, fmt.Sprintf("%d × %s: %s", g.Count, g.EventType, g.ErrorGroup))
+		}
+		title := fmt.Sprintf("DLQ has %d open events", depth)
+		message := fmt.Sprintf("%d events are waiting in the dead letter queue (threshold %d).", depth, a.threshold)
+		if status == "resolved" {
+			title = "DLQ back under threshold"
+			message = fmt.Sprintf("%d events left in the dead letter queue.", depth)
+		} else if len(lines) > 0 {
+			message += "\n" + strings.Join(lines, "\n")
+		}
+		return title, message, map[string]interface{}{"depth": depth, "threshold": a.threshold}
+	})
+
+	if a.groupThreshold <= 0 {
+		return
+	}
+	seen := map[string]bool{}
+	for _, g := range groups {
+		g := g
+		key := "group:" + g.EventType + "|" + g.ErrorGroup
+		seen[key] = true
+		a.evaluate(key, g.Count >= a.groupThreshold, func(status string) (string, string, map[string]interface{}) {
+			title := fmt.Sprintf("%d %s events failing", g.Count, g.EventType)
+			message := fmt.Sprintf("%s\nConsumers: %s", g.SampleError, strings.Join(g.Consumers, ", "))
+			if status == "resolved" {
+				title = fmt.Sprintf("%s failures dealt with", g.EventType)
+				message = g.ErrorGroup
+			}
+			return title, message, map[string]interface{}{
+				"event_type": g.EventType, "error_group": g.ErrorGroup, "count": g.Count, "threshold": a.groupThreshold,
+			}
+		})
+	}
+	// Groups with no open entries left are not listed at all. A full list
+	// may have left out groups that are still open, so wait for a shorter
+	// one before resolving.
+	if len(groups) >= maxGroups {
+		return
+	}
+	for key := range a.firing {
+		if strings.HasPrefix(key, "group:") && !seen[key] {
+			eventType, errorGroup, _ := strings.Cut(strings.TrimPrefix(key, "group:"), "|")
+			a.evaluate(key, false, func(string) (string, string, map[string]interface{}) {
+				return fmt.Sprintf("%s failures dealt with", eventType), errorGroup,
+					map[string]interface{}{"event_type": eventType, "error_group": errorGroup, "count": 0}
+			})
+		}
+	}
+}
+
+// evaluate fires, repeats or resolves the alert with key. Callers hold mu.
+func (a *DepthAlerter) evaluate(key string, over bool, render func(status string) (string, string, map[string]interface{})) {
+	last, firing := a.firing[key]
+	switch {
+	case over && (!firing || time.Since(last) >= a.repeat):
+		if err := a.notify("firing", render); err == nil {
+			a.firing[key] = time.Now()
+		}
+	case !over && firing:
+		if err := a.notify("resolved", render); err == nil {
+			delete(a.firing, key)
+		}
+	}
+}
+
+func (a *DepthAlerter) notify(status string, render func(status string) (string, string, map[string]interface{})) error {
+	title, message, metadata := render(status)
+	metadata["status"] = status
+
+	notifType, priority := "warning", "high"
+	if status == "resolved" {
+		notifType, priority = "success", "normal"
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"source":   "event-dlq",
+		"type":     notifType,
+		"title":    title,
+		"message":  message,
+		"priority": priority,
+		"metadata": metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Post(a.hubURL+"/api/notifications", "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("notification-hub returned %s", resp.Status)
+		}
+	}
+	if err != nil {
+		logger.Log("warn", "Failed to send DLQ alert", map[string]interface{}{"error": err.Error(), "title": title})
+		return err
+	}
+	logger.Log("info", "DLQ alert sent", map[string]interface{}{"title": title, "status": status})
+	return nil
+}
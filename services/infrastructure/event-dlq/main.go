@@ -7,12 +7,14 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/holm/eventsdk"
 	_ "github.com/lib/pq"
-	"github.com/nats-io/nats.go"
 )
 
 // Catppuccin Mocha colors
@@ -50,23 +52,15 @@ func (l *Logger) Log(level, msg string, fields map[string]interface{}) {
 }
 
 var (
-	logger          = &Logger{}
-	db              *sql.DB
-	nc              *nats.Conn
-	requestCounter  uint64
-	dlqReceived     uint64
-	dlqProcessed    uint64
+	logger         = &Logger{}
+	db             *sql.DB
+	eventBus       *eventsdk.Client
+	retryPolicies  eventsdk.RetryPolicies
+	requestCounter uint64
+	dlqReceived    uint64
+	dlqProcessed   uint64
 )
 
-type DLQEvent struct {
-	ID        string                 `json:"id"`
-	Type      string                 `json:"type"`
-	Source    string                 `json:"source"`
-	Data      map[string]interface{} `json:"data"`
-	Error     string                 `json:"error"`
-	Timestamp time.Time              `json:"timestamp"`
-}
-
 func initDB() error {
 	dsn := os.Getenv("DATABASE_URL")
 	if dsn == "" {
@@ -107,20 +101,19 @@ func initDB() error {
 		CREATE INDEX IF NOT EXISTS idx_dlq_processed ON dead_letter_queue(processed);
 		CREATE INDEX IF NOT EXISTS idx_dlq_event_type ON dead_letter_queue(event_type);
 
-		CREATE TABLE IF NOT EXISTS failed_events (
-			id VARCHAR(255) PRIMARY KEY,
-			type VARCHAR(255) NOT NULL,
-			source VARCHAR(255) NOT NULL,
-			data JSONB,
-			error TEXT,
-			retries INT DEFAULT 0,
-			created_at TIMESTAMPTZ DEFAULT NOW(),
-			last_retry TIMESTAMPTZ
-		);
-	`)
+		ALTER TABLE dead_letter_queue ADD COLUMN IF NOT EXISTS consumer VARCHAR(255);
+		ALTER TABLE dead_letter_queue ADD COLUMN IF NOT EXISTS attempts INT DEFAULT 0;
+		ALTER TABLE dead_letter_queue ADD COLUMN IF NOT EXISTS envelope JSONB;
+	`+triageSchema)
 	if err != nil {
 		return fmt.Errorf("failed to create tables: %w", err)
 	}
+	if err := eventsdk.InitRetrySchema(ctx, db); err != nil {
+		return fmt.Errorf("failed to create retry tables: %w", err)
+	}
+	if err := backfillErrorGroups(ctx); err != nil {
+		return fmt.Errorf("failed to group errors: %w", err)
+	}
 
 	logger.Log("info", "Database initialized", nil)
 	return nil
@@ -133,32 +126,27 @@ func initNATS() error {
 	}
 
 	var err error
-	nc, err = nats.Connect(natsURL,
-		nats.RetryOnFailedConnect(true),
-		nats.MaxReconnects(-1),
-		nats.ReconnectWait(2*time.Second),
-	)
+	eventBus, err = eventsdk.Connect(natsURL, "event-dlq")
 	if err != nil {
-		return fmt.Errorf("failed to connect to NATS: %w", err)
+		return err
 	}
 
-	// Subscribe to DLQ
-	_, err = nc.Subscribe("events.dlq", func(msg *nats.Msg) {
+	// Consume the DLQ
+	_, err = eventBus.Consume(context.Background(), eventsdk.ConsumerConfig{
+		Durable: "event-dlq",
+		Subject: eventsdk.DLQSubject,
+	}, func(ctx context.Context, event *eventsdk.Event) error {
 		atomic.AddUint64(&dlqReceived, 1)
 
-		var event DLQEvent
-		if err := json.Unmarshal(msg.Data, &event); err != nil {
-			logger.Log("error", "Failed to unmarshal DLQ event", map[string]interface{}{"error": err.Error()})
-			return
-		}
-
-		if err := storeDLQEvent(&event); err != nil {
+		dl := deadLetterOf(event)
+		if err := storeDeadLetter(dl); err != nil {
 			logger.Log("error", "Failed to store DLQ event", map[string]interface{}{"error": err.Error()})
-			return
+			return err
 		}
 
 		atomic.AddUint64(&dlqProcessed, 1)
-		logger.Log("info", "DLQ event stored", map[string]interface{}{"event_id": event.ID, "type": event.Type})
+		logger.Log("info", "DLQ event stored", map[string]interface{}{"event_id": dl.Event.ID, "type": dl.Event.Type, "consumer": dl.Consumer})
+		return nil
 	})
 
 	if err != nil {
@@ -169,32 +157,74 @@ func initNATS() error {
 	return nil
 }
 
-func storeDLQEvent(event *DLQEvent) error {
+// deadLetterOf unwraps a DLQ event. Publishers that predate the SDK sent
+// the failed event itself to events.dlq, so anything that does not carry a
+// dead letter is taken to be the failed event.
+func deadLetterOf(event *eventsdk.Event) *eventsdk.DeadLetter {
+	var dl eventsdk.DeadLetter
+	if event.Type == eventsdk.DLQType && event.DataAs(&dl) == nil && (dl.Event != nil || len(dl.Raw) > 0) {
+		if dl.Event == nil {
+			// The consumer could not parse the message, keep what it received
+			dl.Event = &eventsdk.Event{
+				SpecVersion:     eventsdk.SpecVersion,
+				ID:              event.ID,
+				Source:          "unknown",
+				Type:            strings.TrimPrefix(dl.Subject, eventsdk.SubjectPrefix),
+				Time:            dl.FailedAt,
+				DataContentType: eventsdk.ContentTypeJSON,
+				Data:            dl.Raw,
+			}
+		}
+		return &dl
+	}
+
+	var legacy struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(event.Data, &legacy)
+	if legacy.Error == "" {
+		legacy.Error = "unknown"
+	}
+
+	return &eventsdk.DeadLetter{
+		Event:    event,
+		Subject:  eventsdk.DLQSubject,
+		Consumer: event.Source,
+		Error:    legacy.Error,
+		Attempts: 1,
+		FailedAt: event.Time,
+	}
+}
+
+func storeDeadLetter(dl *eventsdk.DeadLetter) error {
+	if db == nil {
+		return fmt.Errorf("database not connected")
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	dataJSON, err := json.Marshal(event.Data)
+	event := dl.Event
+	dataJSON := []byte(event.Data)
+	if !json.Valid(dataJSON) {
+		dataJSON, _ = json.Marshal(string(event.Data))
+	}
+	envelope, err := json.Marshal(event)
 	if err != nil {
-		dataJSON = []byte("{}")
+		return err
 	}
 
 	_, err = db.ExecContext(ctx,
-		`INSERT INTO dead_letter_queue (event_id, event_type, source, data, error_message, original_timestamp)
-		 VALUES ($1, $2, $3, $4, $5, $6)`,
-		event.ID, event.Type, event.Source, dataJSON, event.Error, event.Timestamp)
+		`INSERT INTO dead_letter_queue (event_id, event_type, source, data, error_message, error_group, original_timestamp, consumer, attempts, envelope)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		event.ID, event.Type, event.Source, dataJSON, dl.Error, normalizeError(dl.Error), event.Time, dl.Consumer, dl.Attempts, envelope)
 
 	if err != nil {
 		return err
 	}
 
-	// Also add to failed_events for replay
-	_, err = db.ExecContext(ctx,
-		`INSERT INTO failed_events (id, type, source, data, error)
-		 VALUES ($1, $2, $3, $4, $5)
-		 ON CONFLICT (id) DO UPDATE SET retries = failed_events.retries + 1, last_retry = NOW()`,
-		event.ID, event.Type, event.Source, dataJSON, event.Error)
-
-	return err
+	// Schedule it for event-replay to retry
+	return retryPolicies.RecordFailure(ctx, db, event, dl.Error)
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -211,7 +241,7 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if nc != nil && nc.IsConnected() {
+	if eventBus != nil && eventBus.IsConnected() {
 		natsHealthy = true
 	}
 
@@ -246,7 +276,7 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	natsUp := 0
-	if nc != nil && nc.IsConnected() {
+	if eventBus != nil && eventBus.IsConnected() {
 		natsUp = 1
 	}
 
@@ -287,6 +317,27 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "# TYPE event_dlq_unprocessed gauge\n")
 	fmt.Fprintf(w, "event_dlq_unprocessed %d\n", unprocessedCount)
 
+	if db != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		byStatus := map[string]int{StatusNew: 0, StatusInvestigating: 0, StatusRetried: 0, StatusDiscarded: 0}
+		if rows, err := db.QueryContext(ctx, `SELECT status, COUNT(*) FROM dead_letter_queue GROUP BY status`); err == nil {
+			for rows.Next() {
+				var status string
+				var n int
+				if rows.Scan(&status, &n) == nil {
+					byStatus[status] = n
+				}
+			}
+			rows.Close()
+		}
+		fmt.Fprintf(w, "# HELP event_dlq_entries DLQ entries by triage status\n")
+		fmt.Fprintf(w, "# TYPE event_dlq_entries gauge\n")
+		for _, status := range []string{StatusNew, StatusInvestigating, StatusRetried, StatusDiscarded} {
+			fmt.Fprintf(w, "event_dlq_entries{status=%q} %d\n", status, byStatus[status])
+		}
+	}
+
 	fmt.Fprintf(w, "# HELP event_dlq_requests_total Total HTTP requests\n")
 	fmt.Fprintf(w, "# TYPE event_dlq_requests_total counter\n")
 	fmt.Fprintf(w, "event_dlq_requests_total %d\n", atomic.LoadUint64(&requestCounter))
@@ -298,7 +349,7 @@ func retryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if db == nil || nc == nil {
+	if db == nil || eventBus == nil {
 		http.Error(w, "Service not ready", http.StatusServiceUnavailable)
 		return
 	}
@@ -313,101 +364,65 @@ func retryHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Fetch the event from DLQ
-	var dbID int
-	var eventType, source sql.NullString
-	var data []byte
-	err := db.QueryRowContext(ctx,
-		`SELECT id, event_type, source, data FROM dead_letter_queue WHERE event_id = $1 AND processed = FALSE`,
-		eventID).Scan(&dbID, &eventType, &source, &data)
-
-	if err == sql.ErrNoRows {
-		http.Error(w, "Event not found or already processed", http.StatusNotFound)
-		return
-	}
+	// Fetch the latest open entry for the event
+	entries, err := listEntries(ctx, &DLQFilter{EventID: eventID, Status: []string{StatusNew, StatusInvestigating}}, 1)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	// Republish to the original topic
-	subject := fmt.Sprintf("events.%s", eventType.String)
-	eventPayload := map[string]interface{}{
-		"id":        eventID,
-		"type":      eventType.String,
-		"source":    source.String,
-		"data":      json.RawMessage(data),
-		"timestamp": time.Now().UTC(),
-		"retry":     true,
-	}
-
-	payload, _ := json.Marshal(eventPayload)
-	if err := nc.Publish(subject, payload); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to republish: %s", err.Error()), http.StatusInternalServerError)
+	if len(entries) == 0 {
+		http.Error(w, "Event not found or already processed", http.StatusNotFound)
 		return
 	}
+	entry := entries[0]
 
-	// Mark as processed
-	_, err = db.ExecContext(ctx,
-		`UPDATE dead_letter_queue SET processed = TRUE, processed_at = NOW() WHERE id = $1`,
-		dbID)
-	if err != nil {
-		logger.Log("warn", "Failed to mark DLQ event as processed", map[string]interface{}{"error": err.Error()})
+	if err := retryEntry(ctx, entry, "", ""); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	logger.Log("info", "DLQ event retried", map[string]interface{}{"event_id": eventID, "type": eventType.String})
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":   "retried",
 		"event_id": eventID,
-		"subject":  subject,
+		"subject":  entry.Event().NATSSubject(),
 	})
 }
 
+// listHandler answers GET /list and GET /entries: the latest entries,
+// filtered by event_id, event_type, error_group, status, consumer, source,
+// since and until.
 func listHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	if db == nil {
 		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
 		return
 	}
 
+	f, err := filterFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	rows, err := db.QueryContext(ctx, `
-		SELECT id, event_id, event_type, source, error_message, received_at, processed
-		FROM dead_letter_queue ORDER BY received_at DESC LIMIT 100
-	`)
+	entries, err := listEntries(ctx, f, limit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var events []map[string]interface{}
-	for rows.Next() {
-		var id int
-		var eventID, eventType, source, errorMsg sql.NullString
-		var receivedAt time.Time
-		var processed bool
-
-		if err := rows.Scan(&id, &eventID, &eventType, &source, &errorMsg, &receivedAt, &processed); err != nil {
-			continue
-		}
-
-		events = append(events, map[string]interface{}{
-			"id":         id,
-			"event_id":   eventID.String,
-			"event_type": eventType.String,
-			"source":     source.String,
-			"error":      errorMsg.String,
-			"received":   receivedAt,
-			"processed":  processed,
-		})
-	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(events)
+	json.NewEncoder(w).Encode(entries)
 }
 
 func uiHandler(w http.ResponseWriter, r *http.Request) {
@@ -424,7 +439,7 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 
 	natsStatus := "Disconnected"
 	natsColor := ColorRed
-	if nc != nil && nc.IsConnected() {
+	if eventBus != nil && eventBus.IsConnected() {
 		natsStatus = "Connected"
 		natsColor = ColorGreen
 	}
@@ -466,13 +481,13 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
             <div class="metric"><span>Total in Queue</span><span class="metric-value">%d</span></div>
             <div class="metric"><span>Unprocessed</span><span class="metric-value warning">%d</span></div>
         </div>
-        <p style="margin-top: 2rem; color: %s;">View events: <a href="/list" style="color: %s">/list</a></p>
+        <p style="margin-top: 2rem; color: %s;">View events: <a href="/list" style="color: %s">/list</a> &middot; Failure groups: <a href="/groups" style="color: %s">/groups</a></p>
     </div>
 </body>
 </html>`, ColorBase, ColorText, ColorMaroon, ColorMantle, ColorCrust, ColorBlue, ColorRed,
 		dbColor, dbStatus, natsColor, natsStatus,
 		atomic.LoadUint64(&dlqReceived), atomic.LoadUint64(&dlqProcessed), dlqCount, unprocessedCount,
-		ColorSubtext0, ColorMauve)
+		ColorSubtext0, ColorMauve, ColorMauve)
 
 	w.Header().Set("Content-Type", "text/html")
 	w.Write([]byte(html))
@@ -481,6 +496,12 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 func main() {
 	logger.Log("info", "Starting event-dlq service", nil)
 
+	var err error
+	if retryPolicies, err = eventsdk.LoadRetryPolicies(os.Getenv("EVENT_RETRY_POLICIES")); err != nil {
+		logger.Log("error", "Invalid retry policies", map[string]interface{}{"error": err.Error()})
+		os.Exit(1)
+	}
+
 	if err := initDB(); err != nil {
 		logger.Log("warn", "Database initialization failed, will retry", map[string]interface{}{"error": err.Error()})
 	}
@@ -489,10 +510,16 @@ func main() {
 		logger.Log("warn", "NATS initialization failed, will retry", map[string]interface{}{"error": err.Error()})
 	}
 
+	go NewDepthAlerter().Run(context.Background())
+
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/metrics", metricsHandler)
 	http.HandleFunc("/list", listHandler)
 	http.HandleFunc("/retry", retryHandler)
+	http.HandleFunc("/entries", entriesHandler)
+	http.HandleFunc("/entries/", entriesHandler)
+	http.HandleFunc("/groups", groupsHandler)
+	http.HandleFunc("/bulk", bulkHandler)
 	http.HandleFunc("/", uiHandler)
 
 	port := os.Getenv("HTTP_PORT")
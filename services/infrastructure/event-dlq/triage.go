@@ -0,0 +1,779 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/holm/eventsdk"
+	"github.com/lib/pq"
+)
+
+// Entries move new -> investigating -> retried or discarded. Retried and
+// discarded entries can be reopened for investigation; only a retry that
+// succeeded marks an entry retried.
+const (
+	StatusNew           = "new"
+	StatusInvestigating = "investigating"
+	StatusRetried       = "retried"
+	StatusDiscarded     = "discarded"
+)
+
+var statusTransitions = map[string][]string{
+	StatusNew:           {StatusInvestigating, StatusRetried, StatusDiscarded},
+	StatusInvestigating: {StatusNew, StatusRetried, StatusDiscarded},
+	StatusRetried:       {StatusInvestigating},
+	StatusDiscarded:     {StatusInvestigating},
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range statusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+const triageSchema = `
+	ALTER TABLE dead_letter_queue ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'new';
+	ALTER TABLE dead_letter_queue ADD COLUMN IF NOT EXISTS error_group TEXT;
+	ALTER TABLE dead_letter_queue ADD COLUMN IF NOT EXISTS edited_data JSONB;
+	ALTER TABLE dead_letter_queue ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS idx_dlq_status ON dead_letter_queue(status);
+	CREATE INDEX IF NOT EXISTS idx_dlq_group ON dead_letter_queue(event_type, error_group);
+	UPDATE dead_letter_queue SET status = 'retried' WHERE processed AND status = 'new';
+
+	CREATE TABLE IF NOT EXISTS dead_letter_notes (
+		id SERIAL PRIMARY KEY,
+		dlq_id INT NOT NULL REFERENCES dead_letter_queue(id) ON DELETE CASCADE,
+		author VARCHAR(255),
+		status VARCHAR(20),
+		note TEXT,
+		created_at TIMESTAMPTZ DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_dlq_notes_dlq ON dead_letter_notes(dlq_id);
+`
+
+var errorNormalizers = []struct {
+	re   *regexp.Regexp
+	with string
+}{
+	{regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`), "<uuid>"},
+	{regexp.MustCompile(`"[^"]*"|'[^']*'`), "<str>"},
+	{regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`), "<ip>"},
+	{regexp.MustCompile(`\b(0x)?[0-9a-fA-F]{8,}\b`), "<hex>"},
+	{regexp.MustCompile(`\b\d+(\.\d+)?(ns|us|µs|ms|s|m|h)?\b`), "<n>"},
+	{regexp.MustCompile(`\s+`), " "},
+}
+
+// normalizeError strips what varies between occurrences of the same
+// failure, IDs, addresses, quoted values and numbers, so they group.
+func normalizeError(msg string) string {
+	for _, n := range errorNormalizers {
+		msg = n.re.ReplaceAllString(msg, n.with)
+	}
+	msg = strings.TrimSpace(msg)
+	if len(msg) > 300 {
+		msg = msg[:300]
+	}
+	return msg
+}
+
+// backfillErrorGroups groups entries stored before grouping existed.
+func backfillErrorGroups(ctx context.Context) error {
+	for {
+		rows, err := db.QueryContext(ctx,
+			`SELECT id, COALESCE(error_message, '') FROM dead_letter_queue WHERE error_group IS NULL LIMIT 1000`)
+		if err != nil {
+			return err
+		}
+		groups := map[int]string{}
+		for rows.Next() {
+			var id int
+			var msg string
+			if err := rows.Scan(&id, &msg); err != nil {
+				rows.Close()
+				return err
+			}
+			groups[id] = normalizeError(msg)
+		}
+		rows.Close()
+		if len(groups) == 0 {
+			return nil
+		}
+		for id, group := range groups {
+			if _, err := db.ExecContext(ctx, `UPDATE dead_letter_queue SET error_group = $1 WHERE id = $2`, group, id); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// DLQEntry is one dead letter.
+type DLQEntry struct {
+	ID                int                     `json:"id"`
+	EventID           string                  `json:"event_id"`
+	EventType         string                  `json:"event_type"`
+	Source            string                  `json:"source"`
+	Consumer          string                  `json:"consumer,omitempty"`
+	Attempts          int                     `json:"attempts"`
+	Error             string                  `json:"error"`
+	ErrorGroup        string                  `json:"error_group"`
+	Status            string                  `json:"status"`
+	Data              json.RawMessage         `json:"data,omitempty"`
+	EditedData        json.RawMessage         `json:"edited_data,omitempty"` // Sent instead of data on retry
+	OriginalTimestamp *time.Time              `json:"original_timestamp,omitempty"`
+	ReceivedAt        time.Time               `json:"received_at"`
+	ProcessedAt       *time.Time              `json:"processed_at,omitempty"`
+	UpdatedAt         *time.Time              `json:"updated_at,omitempty"`
+	Notes             []DLQNote               `json:"notes,omitempty"`
+	RetryAttempts     []eventsdk.RetryAttempt `json:"retry_attempts,omitempty"`
+
+	envelope []byte
+}
+
+type DLQNote struct {
+	Author    string    `json:"author,omitempty"`
+	Status    string    `json:"status,omitempty"` // The status the entry moved to, if it changed
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const entryColumns = `id, COALESCE(event_id, ''), COALESCE(event_type, ''), COALESCE(source, ''), COALESCE(consumer, ''),
+	COALESCE(attempts, 0), COALESCE(error_message, ''), COALESCE(error_group, ''), status, data, edited_data,
+	original_timestamp, received_at, processed_at, updated_at, envelope`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEntry(row rowScanner) (*DLQEntry, error) {
+	var e DLQEntry
+	var data, edited []byte
+	var original, processed, updated sql.NullTime
+	err := row.Scan(&e.ID, &e.EventID, &e.EventType, &e.Source, &e.Consumer, &e.Attempts, &e.Error, &e.ErrorGroup,
+		&e.Status, &data, &edited, &original, &e.ReceivedAt, &processed, &updated, &e.envelope)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		e.Data = data
+	}
+	if len(edited) > 0 {
+		e.EditedData = edited
+	}
+	if original.Valid {
+		e.OriginalTimestamp = &original.Time
+	}
+	if processed.Valid {
+		e.ProcessedAt = &processed.Time
+	}
+	if updated.Valid {
+		e.UpdatedAt = &updated.Time
+	}
+	return &e, nil
+}
+
+// Event is the event a retry publishes: the stored envelope, or one built
+// from the columns for entries from before envelopes were kept, carrying
+// the edited payload if there is one.
+func (e *DLQEntry) Event() *eventsdk.Event {
+	event := &eventsdk.Event{}
+	if len(e.envelope) == 0 || json.Unmarshal(e.envelope, event) != nil {
+		event = &eventsdk.Event{
+			SpecVersion:     eventsdk.SpecVersion,
+			ID:              e.EventID,
+			Source:          e.Source,
+			Type:            e.EventType,
+			DataContentType: eventsdk.ContentTypeJSON,
+			Data:            e.Data,
+		}
+		if e.OriginalTimestamp != nil {
+			event.Time = *e.OriginalTimestamp
+		}
+	}
+	if len(e.EditedData) > 0 {
+		event.Data = e.EditedData
+	}
+	return event
+}
+
+func getEntry(ctx context.Context, id int) (*DLQEntry, error) {
+	e, err := scanEntry(db.QueryRowContext(ctx, `SELECT `+entryColumns+` FROM dead_letter_queue WHERE id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT COALESCE(author, ''), COALESCE(status, ''), COALESCE(note, ''), created_at
+		 FROM dead_letter_notes WHERE dlq_id = $1 ORDER BY created_at`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n DLQNote
+		if err := rows.Scan(&n.Author, &n.Status, &n.Note, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Notes = append(e.Notes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if e.RetryAttempts, err = eventsdk.RetryAttempts(ctx, db, e.EventID); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// setStatus moves an entry to status and records the change with note.
+func setStatus(ctx context.Context, e *DLQEntry, status, author, note string) error {
+	if status != e.Status && !canTransition(e.Status, status) {
+		return fmt.Errorf("cannot move a %s entry to %s", e.Status, status)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	done := status == StatusRetried || status == StatusDiscarded
+	_, err = tx.ExecContext(ctx, `
+		UPDATE dead_letter_queue SET status = $1, processed = $2, updated_at = NOW(),
+			processed_at = CASE WHEN $2 THEN COALESCE(processed_at, NOW()) ELSE NULL END
+		WHERE id = $3`, status, done, e.ID)
+	if err != nil {
+		return err
+	}
+	if status == StatusDiscarded {
+		// event-replay would otherwise keep retrying it
+		if err := eventsdk.SetRetryStatus(ctx, tx, e.EventID, eventsdk.RetryResolved); err != nil {
+			return err
+		}
+	}
+
+	changed := ""
+	if status != e.Status {
+		changed = status
+	}
+	if changed != "" || note != "" {
+		if err := addNote(ctx, tx, e.ID, author, changed, note); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	e.Status = status
+	return nil
+}
+
+func addNote(ctx context.Context, ex interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+}, id int, author, status, note string) error {
+	_, err := ex.ExecContext(ctx,
+		`INSERT INTO dead_letter_notes (dlq_id, author, status, note) VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''))`,
+		id, author, status, note)
+	return err
+}
+
+// retryEntry republishes an entry's event to its original subject.
+func retryEntry(ctx context.Context, e *DLQEntry, author, note string) error {
+	if eventBus == nil {
+		return fmt.Errorf("NATS not connected")
+	}
+	if !canTransition(e.Status, StatusRetried) {
+		return fmt.Errorf("cannot retry a %s entry", e.Status)
+	}
+
+	if err := publishRetry(ctx, e); err != nil {
+		return err
+	}
+	if err := setStatus(ctx, e, StatusRetried, author, note); err != nil {
+		return err
+	}
+	logger.Log("info", "DLQ event retried", map[string]interface{}{"event_id": e.EventID, "type": e.EventType, "edited": len(e.EditedData) > 0})
+	return nil
+}
+
+// publishRetry publishes an entry's event and records the attempt with
+// the rest of the event's retries. The event's retry row stays locked
+// while it is published, so event-replay cannot retry it at the same time.
+func publishRetry(ctx context.Context, e *DLQEntry) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	failed, err := eventsdk.LockFailedEvent(ctx, tx, e.EventID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	_, pubErr := eventBus.Retry(ctx, e.Event())
+	if failed != nil {
+		// Entries from before retries were recorded have no row
+		if err := eventsdk.RecordAttempt(ctx, tx, failed, retryPolicies.For(e.EventType), "event-dlq", pubErr); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	if pubErr != nil {
+		return fmt.Errorf("failed to republish: %w", pubErr)
+	}
+	return nil
+}
+
+// DLQFilter selects entries for listing and bulk actions.
+type DLQFilter struct {
+	IDs        []int     `json:"ids,omitempty"`
+	EventID    string    `json:"event_id,omitempty"`
+	EventType  string    `json:"event_type,omitempty"`
+	ErrorGroup string    `json:"error_group,omitempty"`
+	Status     []string  `json:"status,omitempty"`
+	Consumer   string    `json:"consumer,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Since      time.Time `json:"since,omitempty"`
+	Until      time.Time `json:"until,omitempty"`
+}
+
+func filterFromQuery(v url.Values) (*DLQFilter, error) {
+	f := &DLQFilter{
+		EventID:    v.Get("event_id"),
+		EventType:  v.Get("event_type"),
+		ErrorGroup: v.Get("error_group"),
+		Consumer:   v.Get("consumer"),
+		Source:     v.Get("source"),
+	}
+	for _, s := range v["status"] {
+		f.Status = append(f.Status, strings.Split(s, ",")...)
+	}
+	for _, key := range []string{"since", "until"} {
+		s := v.Get(key)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		if key == "since" {
+			f.Since = t
+		} else {
+			f.Until = t
+		}
+	}
+	return f, f.validate()
+}
+
+func (f *DLQFilter) validate() error {
+	for _, s := range f.Status {
+		if _, ok := statusTransitions[s]; !ok {
+			return fmt.Errorf("unknown status %q", s)
+		}
+	}
+	return nil
+}
+
+func (f *DLQFilter) empty() bool {
+	return len(f.IDs) == 0 && f.EventID == "" && f.EventType == "" && f.ErrorGroup == "" && len(f.Status) == 0 &&
+		f.Consumer == "" && f.Source == "" && f.Since.IsZero() && f.Until.IsZero()
+}
+
+func (f *DLQFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if len(f.IDs) > 0 {
+		ids := make([]int64, len(f.IDs))
+		for i, id := range f.IDs {
+			ids[i] = int64(id)
+		}
+		conds = append(conds, "id = ANY("+arg(pq.Array(ids))+")")
+	}
+	if f.EventID != "" {
+		conds = append(conds, "event_id = "+arg(f.EventID))
+	}
+	if f.EventType != "" {
+		conds = append(conds, "event_type = "+arg(f.EventType))
+	}
+	if f.ErrorGroup != "" {
+		conds = append(conds, "error_group = "+arg(f.ErrorGroup))
+	}
+	if len(f.Status) > 0 {
+		conds = append(conds, "status = ANY("+arg(pq.Array(f.Status))+")")
+	}
+	if f.Consumer != "" {
+		conds = append(conds, "consumer = "+arg(f.Consumer))
+	}
+	if f.Source != "" {
+		conds = append(conds, "source = "+arg(f.Source))
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "received_at >= "+arg(f.Since))
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "received_at < "+arg(f.Until))
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func listEntries(ctx context.Context, f *DLQFilter, limit int) ([]*DLQEntry, error) {
+	where, args := f.where()
+	args = append(args, limit)
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+entryColumns+` FROM dead_letter_queue`+where+
+			` ORDER BY received_at DESC LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*DLQEntry{}
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// DLQGroup is the entries of one event type failing the same way.
+type DLQGroup struct {
+	EventType   string         `json:"event_type"`
+	ErrorGroup  string         `json:"error_group"`
+	Count       int            `json:"count"`
+	ByStatus    map[string]int `json:"by_status"`
+	Consumers   []string       `json:"consumers"`
+	SampleError string         `json:"sample_error"` // The latest error as it was reported
+	FirstSeen   time.Time      `json:"first_seen"`
+	LastSeen    time.Time      `json:"last_seen"`
+}
+
+// maxGroups caps listGroups, largest groups first.
+const maxGroups = 200
+
+func listGroups(ctx context.Context, f *DLQFilter) ([]DLQGroup, error) {
+	where, args := f.where()
+	rows, err := db.QueryContext(ctx, `
+		SELECT COALESCE(event_type, ''), COALESCE(error_group, ''), COUNT(*),
+			COUNT(*) FILTER (WHERE status = 'new'),
+			COUNT(*) FILTER (WHERE status = 'investigating'),
+			COUNT(*) FILTER (WHERE status = 'retried'),
+			COUNT(*) FILTER (WHERE status = 'discarded'),
+			ARRAY_REMOVE(ARRAY_AGG(DISTINCT consumer), NULL),
+			(ARRAY_AGG(COALESCE(error_message, '') ORDER BY received_at DESC))[1],
+			MIN(received_at), MAX(received_at)
+		FROM dead_letter_queue`+where+`
+		GROUP BY 1, 2
+		ORDER BY 3 DESC, 11 DESC
+		LIMIT `+strconv.Itoa(maxGroups), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []DLQGroup{}
+	for rows.Next() {
+		var g DLQGroup
+		var n, i, r, d int
+		var consumers pq.StringArray
+		if err := rows.Scan(&g.EventType, &g.ErrorGroup, &g.Count, &n, &i, &r, &d, &consumers,
+			&g.SampleError, &g.FirstSeen, &g.LastSeen); err != nil {
+			return nil, err
+		}
+		g.ByStatus = map[string]int{StatusNew: n, StatusInvestigating: i, StatusRetried: r, StatusDiscarded: d}
+		g.Consumers = []string(consumers)
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+func countEntries(ctx context.Context, f *DLQFilter) (int, error) {
+	where, args := f.where()
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM dead_letter_queue`+where, args...).Scan(&n)
+	return n, err
+}
+
+// groupsHandler answers GET /groups. Without a status filter it shows the
+// open entries, new and investigating.
+func groupsHandler(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	f, err := filterFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(f.Status) == 0 {
+		f.Status = []string{StatusNew, StatusInvestigating}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	groups, err := listGroups(ctx, f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+type entryUpdate struct {
+	Status string          `json:"status,omitempty"`
+	Note   string          `json:"note,omitempty"`
+	Author string          `json:"author,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"` // Replaces the payload sent on retry; null clears the edit
+}
+
+// entriesHandler serves /entries, /entries/{id} and
+// /entries/{id}/{notes,retry,discard}.
+func entriesHandler(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/entries"), "/"), "/")
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+
+	if parts[0] == "" {
+		listHandler(w, r)
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid entry id", http.StatusBadRequest)
+		return
+	}
+	entry, err := getEntry(ctx, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	var update entryUpdate
+	if r.Method == http.MethodPost || r.Method == http.MethodPatch {
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+
+	case action == "" && r.Method == http.MethodPatch:
+		if update.Data != nil {
+			if err := editPayload(ctx, entry, update.Data, update.Author); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		status := update.Status
+		if status == "" {
+			status = entry.Status
+		}
+		if status == StatusRetried {
+			http.Error(w, "Use POST /entries/{id}/retry to retry an entry", http.StatusBadRequest)
+			return
+		}
+		if _, ok := statusTransitions[status]; !ok {
+			http.Error(w, fmt.Sprintf("unknown status %q", status), http.StatusBadRequest)
+			return
+		}
+		if err := setStatus(ctx, entry, status, update.Author, update.Note); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+	case action == "notes" && r.Method == http.MethodPost:
+		if update.Note == "" {
+			http.Error(w, "Note is required", http.StatusBadRequest)
+			return
+		}
+		if err := addNote(ctx, db, entry.ID, update.Author, "", update.Note); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	case action == "retry" && r.Method == http.MethodPost:
+		if err := retryEntry(ctx, entry, update.Author, update.Note); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+	case action == "discard" && r.Method == http.MethodPost:
+		if err := setStatus(ctx, entry, StatusDiscarded, update.Author, update.Note); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entry, err = getEntry(ctx, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(entry)
+}
+
+// editPayload replaces the data an entry is retried with. The original
+// stays in data; JSON null drops the edit.
+func editPayload(ctx context.Context, e *DLQEntry, data json.RawMessage, author string) error {
+	if string(data) == "null" {
+		if _, err := db.ExecContext(ctx, `UPDATE dead_letter_queue SET edited_data = NULL, updated_at = NOW() WHERE id = $1`, e.ID); err != nil {
+			return err
+		}
+		e.EditedData = nil
+		return addNote(ctx, db, e.ID, author, "", "payload edit reverted")
+	}
+
+	edited := *e
+	edited.EditedData = data
+	if err := edited.Event().Validate(); err != nil {
+		return fmt.Errorf("edited payload is invalid: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE dead_letter_queue SET edited_data = $1, updated_at = NOW() WHERE id = $2`, []byte(data), e.ID); err != nil {
+		return err
+	}
+	e.EditedData = data
+	return addNote(ctx, db, e.ID, author, "", "payload edited")
+}
+
+type bulkRequest struct {
+	Action string    `json:"action"` // retry, discard or investigate
+	Filter DLQFilter `json:"filter"`
+	Limit  int       `json:"limit,omitempty"`
+	Note   string    `json:"note,omitempty"`
+	Author string    `json:"author,omitempty"`
+}
+
+// bulkHandler answers POST /bulk: apply an action to every entry matching
+// a filter, e.g. discard a whole group once its cause is understood.
+// Entries the action does not apply to, like retrying a discarded one, are
+// skipped.
+func bulkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req bulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	target := map[string]string{
+		"retry":       StatusRetried,
+		"discard":     StatusDiscarded,
+		"investigate": StatusInvestigating,
+	}[req.Action]
+	if target == "" {
+		http.Error(w, "Action must be retry, discard or investigate", http.StatusBadRequest)
+		return
+	}
+	if err := req.Filter.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Filter.empty() {
+		http.Error(w, "A filter is required for bulk actions", http.StatusBadRequest)
+		return
+	}
+	if req.Limit <= 0 || req.Limit > 1000 {
+		req.Limit = 500
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+
+	entries, err := listEntries(ctx, &req.Filter, req.Limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := map[string]interface{}{"action": req.Action, "matched": len(entries)}
+	applied, skipped := 0, 0
+	var failures []map[string]interface{}
+	for _, e := range entries {
+		if !canTransition(e.Status, target) {
+			skipped++
+			continue
+		}
+		if target == StatusRetried {
+			err = retryEntry(ctx, e, req.Author, req.Note)
+		} else {
+			err = setStatus(ctx, e, target, req.Author, req.Note)
+		}
+		if err != nil {
+			failures = append(failures, map[string]interface{}{"id": e.ID, "error": err.Error()})
+			continue
+		}
+		applied++
+	}
+	result["applied"] = applied
+	result["skipped"] = skipped
+	if len(failures) > 0 {
+		result["failed"] = failures
+	}
+
+	logger.Log("info", "DLQ bulk action", map[string]interface{}{
+		"action": req.Action, "matched": len(entries), "applied": applied, "skipped": skipped, "failed": len(failures),
+	})
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Replays republish events to every consumer, so starting or cancelling
+// one takes an auth-gateway admin. Queries stay open to the cluster as
+// before.
+
+var (
+	authGatewayURL = "http://auth-gateway.holm.svc.cluster.local"
+	authClient     = &http.Client{Timeout: 5 * time.Second}
+)
+
+func init() {
+	if u := os.Getenv("AUTH_GATEWAY_URL"); u != "" {
+		authGatewayURL = strings.TrimRight(u, "/")
+	}
+}
+
+// requireAdmin checks the caller's bearer token with auth-gateway, writing
+// 401, 403 or 502 and returning "" unless it belongs to an admin.
+func requireAdmin(w http.ResponseWriter, r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return ""
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, authGatewayURL+"/api/validate", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return ""
+	}
+	req.Header.Set("Authorization", auth)
+	resp, err := authClient.Do(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("auth-gateway unavailable: %v", err), http.StatusBadGateway)
+		return ""
+	}
+	defer resp.Body.Close()
+
+	var v struct {
+		Valid    bool   `json:"valid"`
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		http.Error(w, fmt.Sprintf("auth-gateway returned status %d", resp.StatusCode), http.StatusBadGateway)
+		return ""
+	}
+	if json.NewDecoder(resp.Body).Decode(&v) != nil || !v.Valid || v.Username == "" {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return ""
+	}
+	if v.Role != "admin" {
+		http.Error(w, "Admin role required", http.StatusForbidden)
+		return ""
+	}
+	return v.Username
+}
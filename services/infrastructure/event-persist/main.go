@@ -5,15 +5,14 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/holm/eventsdk"
 	_ "github.com/lib/pq"
-	"github.com/nats-io/nats.go"
 )
 
 // Catppuccin Mocha colors
@@ -51,23 +50,15 @@ func (l *Logger) Log(level, msg string, fields map[string]interface{}) {
 }
 
 var (
-	logger           = &Logger{}
-	db               *sql.DB
-	nc               *nats.Conn
-	requestCounter   uint64
-	eventsProcessed  uint64
-	eventsFailed     uint64
-	healthy          = true
+	logger          = &Logger{}
+	db              *sql.DB
+	eventBus        *eventsdk.Client
+	requestCounter  uint64
+	eventsProcessed uint64
+	eventsFailed    uint64
+	healthy         = true
 )
 
-type Event struct {
-	ID        string                 `json:"id"`
-	Type      string                 `json:"type"`
-	Source    string                 `json:"source"`
-	Data      map[string]interface{} `json:"data"`
-	Timestamp time.Time              `json:"timestamp"`
-}
-
 func initDB() error {
 	dsn := os.Getenv("DATABASE_URL")
 	if dsn == "" {
@@ -91,21 +82,21 @@ func initDB() error {
 		return fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	// Create events table if not exists
+	// Partitioning an existing table moves every row, so give it time
+	migrateCtx, migrateCancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer migrateCancel()
+	if err := initEventsTable(migrateCtx); err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+
 	_, err = db.ExecContext(ctx, `
-		CREATE TABLE IF NOT EXISTS events (
-			id VARCHAR(255) PRIMARY KEY,
-			type VARCHAR(255) NOT NULL,
-			source VARCHAR(255) NOT NULL,
-			data JSONB,
-			timestamp TIMESTAMPTZ NOT NULL,
-			created_at TIMESTAMPTZ DEFAULT NOW()
-		);
 		CREATE INDEX IF NOT EXISTS idx_events_type ON events(type);
 		CREATE INDEX IF NOT EXISTS idx_events_timestamp ON events(timestamp);
+		CREATE INDEX IF NOT EXISTS idx_events_timestamp_id ON events(timestamp, id);
+		CREATE INDEX IF NOT EXISTS idx_events_data ON events USING GIN (data jsonb_path_ops);
 	`)
 	if err != nil {
-		return fmt.Errorf("failed to create table: %w", err)
+		return fmt.Errorf("failed to create indexes: %w", err)
 	}
 
 	logger.Log("info", "Database initialized", nil)
@@ -119,37 +110,24 @@ func initNATS() error {
 	}
 
 	var err error
-	nc, err = nats.Connect(natsURL,
-		nats.RetryOnFailedConnect(true),
-		nats.MaxReconnects(-1),
-		nats.ReconnectWait(2*time.Second),
-	)
+	eventBus, err = eventsdk.Connect(natsURL, "event-persist")
 	if err != nil {
-		return fmt.Errorf("failed to connect to NATS: %w", err)
+		return err
 	}
 
-	// Subscribe to all events
-	_, err = nc.Subscribe("events.>", func(msg *nats.Msg) {
-		var event Event
-		if err := json.Unmarshal(msg.Data, &event); err != nil {
-			logger.Log("error", "Failed to unmarshal event", map[string]interface{}{"error": err.Error()})
-			atomic.AddUint64(&eventsFailed, 1)
-			return
-		}
-
-		if err := persistEvent(&event); err != nil {
-			logger.Log("error", "Failed to persist event", map[string]interface{}{"error": err.Error(), "event_id": event.ID})
-			atomic.AddUint64(&eventsFailed, 1)
-			// Publish to DLQ
-			if nc != nil {
-				nc.Publish("events.dlq", msg.Data)
+	// Consume every event; ones that keep failing to persist go to the DLQ
+	_, err = eventBus.Consume(context.Background(), eventsdk.ConsumerConfig{Durable: "event-persist"},
+		func(ctx context.Context, event *eventsdk.Event) error {
+			if err := persistEvent(event); err != nil {
+				logger.Log("error", "Failed to persist event", map[string]interface{}{"error": err.Error(), "event_id": event.ID})
+				atomic.AddUint64(&eventsFailed, 1)
+				return err
 			}
-			return
-		}
 
-		atomic.AddUint64(&eventsProcessed, 1)
-		logger.Log("info", "Event persisted", map[string]interface{}{"event_id": event.ID, "type": event.Type})
-	})
+			atomic.AddUint64(&eventsProcessed, 1)
+			logger.Log("info", "Event persisted", map[string]interface{}{"event_id": event.ID, "type": event.Type})
+			return nil
+		})
 
 	if err != nil {
 		return fmt.Errorf("failed to subscribe: %w", err)
@@ -159,21 +137,61 @@ func initNATS() error {
 	return nil
 }
 
-func persistEvent(event *Event) error {
+func persistEvent(event *eventsdk.Event) error {
+	if db == nil {
+		return fmt.Errorf("database not connected")
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	dataJSON, err := json.Marshal(event.Data)
+	// The data column is JSONB, so anything that is not JSON is kept as a string
+	var data interface{} = event.Data
+	if len(event.Data) == 0 {
+		data = nil
+	} else if !json.Valid(event.Data) {
+		data, _ = json.Marshal(string(event.Data))
+	}
+
+	class := retention.ClassFor(event.Type)
+	err := upsertEvent(ctx, event, data, class)
+	if isMissingPartition(err) {
+		if err := ensurePartition(ctx, db, class, event.Time); err != nil {
+			return err
+		}
+		err = upsertEvent(ctx, event, data, class)
+	}
+	return err
+}
+
+// upsertEvent stores event once per id. The primary key has to include the
+// partition keys, so Postgres cannot keep ids unique across partitions;
+// writes of one id are serialized with an advisory lock instead, and a
+// redelivery updates the data of the row already stored.
+func upsertEvent(ctx context.Context, event *eventsdk.Event, data interface{}, class string) error {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	_, err = db.ExecContext(ctx,
-		`INSERT INTO events (id, type, source, data, timestamp) VALUES ($1, $2, $3, $4, $5)
-		 ON CONFLICT (id) DO UPDATE SET data = $4, timestamp = $5`,
-		event.ID, event.Type, event.Source, dataJSON, event.Timestamp)
-
-	return err
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, hashtext($2))`, eventIDLockSpace, event.ID); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE events SET data = $2 WHERE id = $1`, event.ID, data)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO events (id, type, source, subject, datacontenttype, data, timestamp, retention_class)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			event.ID, event.Type, event.Source, event.Subject, event.DataContentType, data, event.Time, class)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -190,7 +208,7 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if nc != nil && nc.IsConnected() {
+	if eventBus != nil && eventBus.IsConnected() {
 		natsHealthy = true
 	}
 
@@ -226,7 +244,7 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	natsUp := 0
-	if nc != nil && nc.IsConnected() {
+	if eventBus != nil && eventBus.IsConnected() {
 		natsUp = 1
 	}
 
@@ -250,73 +268,15 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "# TYPE event_persist_events_failed_total counter\n")
 	fmt.Fprintf(w, "event_persist_events_failed_total %d\n", atomic.LoadUint64(&eventsFailed))
 
+	writePartitionMetrics(w)
+
 	fmt.Fprintf(w, "# HELP event_persist_requests_total Total HTTP requests\n")
 	fmt.Fprintf(w, "# TYPE event_persist_requests_total counter\n")
 	fmt.Fprintf(w, "event_persist_requests_total %d\n", atomic.LoadUint64(&requestCounter))
 }
 
-func eventsHandler(w http.ResponseWriter, r *http.Request) {
-	if db == nil {
-		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Parse query parameters
-	eventType := r.URL.Query().Get("type")
-	limit := r.URL.Query().Get("limit")
-	if limit == "" {
-		limit = "100"
-	}
-
-	var rows *sql.Rows
-	var err error
-
-	if eventType != "" {
-		rows, err = db.QueryContext(ctx,
-			`SELECT id, type, source, data, timestamp, created_at FROM events WHERE type = $1 ORDER BY timestamp DESC LIMIT $2`,
-			eventType, limit)
-	} else {
-		rows, err = db.QueryContext(ctx,
-			`SELECT id, type, source, data, timestamp, created_at FROM events ORDER BY timestamp DESC LIMIT $1`,
-			limit)
-	}
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var events []map[string]interface{}
-	for rows.Next() {
-		var id, eventType, source string
-		var data []byte
-		var timestamp, createdAt time.Time
-
-		if err := rows.Scan(&id, &eventType, &source, &data, &timestamp, &createdAt); err != nil {
-			continue
-		}
-
-		var dataMap map[string]interface{}
-		json.Unmarshal(data, &dataMap)
-
-		events = append(events, map[string]interface{}{
-			"id":         id,
-			"type":       eventType,
-			"source":     source,
-			"data":       dataMap,
-			"timestamp":  timestamp,
-			"created_at": createdAt,
-		})
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(events)
-}
-
+// eventHandler answers GET /event?id= in its original shape, and
+// /v2/event?id= as a CloudEvent.
 func eventHandler(w http.ResponseWriter, r *http.Request) {
 	if db == nil {
 		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
@@ -333,13 +293,9 @@ func eventHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var id, eventType, source string
-	var data []byte
-	var timestamp, createdAt time.Time
-
-	err := db.QueryRowContext(ctx,
-		`SELECT id, type, source, data, timestamp, created_at FROM events WHERE id = $1`,
-		eventID).Scan(&id, &eventType, &source, &data, &timestamp, &createdAt)
+	event, err := scanEvent(db.QueryRowContext(ctx,
+		`SELECT id, type, source, subject, datacontenttype, data, timestamp, created_at FROM events WHERE id = $1`,
+		eventID))
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "Event not found", http.StatusNotFound)
@@ -350,20 +306,12 @@ func eventHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var dataMap map[string]interface{}
-	json.Unmarshal(data, &dataMap)
-
-	event := map[string]interface{}{
-		"id":         id,
-		"type":       eventType,
-		"source":     source,
-		"data":       dataMap,
-		"timestamp":  timestamp,
-		"created_at": createdAt,
-	}
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(event)
+	if r.URL.Path == "/v2/event" {
+		json.NewEncoder(w).Encode(event)
+		return
+	}
+	json.NewEncoder(w).Encode(event.legacy())
 }
 
 func uiHandler(w http.ResponseWriter, r *http.Request) {
@@ -380,7 +328,7 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 
 	natsStatus := "Disconnected"
 	natsColor := ColorRed
-	if nc != nil && nc.IsConnected() {
+	if eventBus != nil && eventBus.IsConnected() {
 		natsStatus = "Connected"
 		natsColor = ColorGreen
 	}
@@ -423,9 +371,16 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 func main() {
 	logger.Log("info", "Starting event-persist service", nil)
 
+	var err error
+	if retention, err = loadRetention(); err != nil {
+		logger.Log("error", "Invalid retention policies", map[string]interface{}{"error": err.Error()})
+		os.Exit(1)
+	}
+
 	if err := initDB(); err != nil {
 		logger.Log("warn", "Database initialization failed, will retry", map[string]interface{}{"error": err.Error()})
 	}
+	startPartitionMaintenance()
 
 	if err := initNATS(); err != nil {
 		logger.Log("warn", "NATS initialization failed, will retry", map[string]interface{}{"error": err.Error()})
@@ -434,7 +389,13 @@ func main() {
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/metrics", metricsHandler)
 	http.HandleFunc("/events", eventsHandler)
+	http.HandleFunc("/events/export", exportHandler)
+	http.HandleFunc("/events/replay", replayHandler)
+	http.HandleFunc("/events/replay/", replayHandler)
+	http.HandleFunc("/partitions", partitionsHandler)
 	http.HandleFunc("/event", eventHandler)
+	http.HandleFunc("/v2/events", eventsV2Handler)
+	http.HandleFunc("/v2/event", eventHandler)
 	http.HandleFunc("/", uiHandler)
 
 	port := os.Getenv("HTTP_PORT")
@@ -0,0 +1,805 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The events table is partitioned twice: by LIST on retention_class, the
+// name of the retention policy an event's type falls under, and each class
+// by RANGE on timestamp into daily or monthly leaves named
+// events_<class>_pYYYYMMDD or events_<class>_pYYYYMM. Retention then only
+// ever drops whole leaves, and a long-lived type never holds a short-lived
+// one's partitions open. Expiry is opt-in: a policy without a retention
+// keeps its events, as the default does unless configured otherwise.
+
+const (
+	defaultRetentionClass = "default"
+	maintenanceLockKey    = 0x65766e74 // "evnt", for pg_try_advisory_lock
+	eventIDLockSpace      = 0x65766964 // "evid", with hashtext(id) for pg_advisory_xact_lock
+)
+
+var classNamePattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// RetentionPolicy says how long events of some types are kept. Types are
+// the same patterns GET /events takes; the first policy that matches an
+// event's type wins, and the "default" policy takes everything else.
+type RetentionPolicy struct {
+	Name      string   `json:"name"`
+	Types     []string `json:"types,omitempty"`
+	Retention string   `json:"retention,omitempty"` // e.g. 30d, 12h; empty keeps events forever
+	Interval  string   `json:"interval,omitempty"`  // daily or monthly
+	Archive   bool     `json:"archive,omitempty"`   // Hand expired partitions to backup-storage first
+
+	keep     time.Duration
+	patterns []*regexp.Regexp
+}
+
+type RetentionConfig struct {
+	Policies []*RetentionPolicy
+}
+
+var (
+	retention *RetentionConfig
+
+	partitionsCreated  uint64
+	partitionsDropped  uint64
+	partitionsArchived uint64
+	maintenanceMu      sync.Mutex
+	statusMu           sync.RWMutex
+	lastMaintenance    time.Time
+	lastMaintenanceErr string
+)
+
+// loadRetention reads policies from EVENT_RETENTION_POLICIES, a JSON list
+// of RetentionPolicy.
+func loadRetention() (*RetentionConfig, error) {
+	cfg := &RetentionConfig{}
+	if raw := os.Getenv("EVENT_RETENTION_POLICIES"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &cfg.Policies); err != nil {
+			return nil, fmt.Errorf("invalid EVENT_RETENTION_POLICIES: %w", err)
+		}
+	}
+
+	hasDefault := false
+	seen := map[string]bool{}
+	for _, p := range cfg.Policies {
+		if !classNamePattern.MatchString(p.Name) {
+			return nil, fmt.Errorf("invalid retention policy name %q", p.Name)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("duplicate retention policy %q", p.Name)
+		}
+		seen[p.Name] = true
+		if p.Name == defaultRetentionClass {
+			hasDefault = true
+		}
+		if err := p.compile(); err != nil {
+			return nil, err
+		}
+	}
+	if !hasDefault {
+		p := &RetentionPolicy{Name: defaultRetentionClass, Interval: "monthly"}
+		p.compile()
+		cfg.Policies = append(cfg.Policies, p)
+	}
+
+	// The default policy takes whatever the others do not, so it goes last
+	sort.SliceStable(cfg.Policies, func(i, j int) bool {
+		return cfg.Policies[j].Name == defaultRetentionClass && cfg.Policies[i].Name != defaultRetentionClass
+	})
+	return cfg, nil
+}
+
+func (p *RetentionPolicy) compile() error {
+	p.keep = 0
+	if p.Retention != "" {
+		keep, err := parseRetention(p.Retention)
+		if err != nil {
+			return fmt.Errorf("retention policy %s: %w", p.Name, err)
+		}
+		p.keep = keep
+	}
+	if p.Archive && p.keep > 0 && os.Getenv("EVENT_ARCHIVE_DIR") == "" {
+		return fmt.Errorf("retention policy %s archives, which needs EVENT_ARCHIVE_DIR", p.Name)
+	}
+
+	if p.Interval == "" {
+		p.Interval = "daily"
+	}
+	if p.Interval != "daily" && p.Interval != "monthly" {
+		return fmt.Errorf("retention policy %s: interval must be daily or monthly", p.Name)
+	}
+
+	p.patterns = nil
+	for _, t := range p.Types {
+		expr, err := typeRegexp(t)
+		if err != nil {
+			return fmt.Errorf("retention policy %s: %w", p.Name, err)
+		}
+		p.patterns = append(p.patterns, regexp.MustCompile(expr))
+	}
+	return nil
+}
+
+func (p *RetentionPolicy) matches(eventType string) bool {
+	for _, re := range p.patterns {
+		if re.MatchString(eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetention is time.ParseDuration plus d for days.
+func parseRetention(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid retention %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid retention %q", s)
+	}
+	return d, nil
+}
+
+// ClassFor returns the retention class events of eventType are stored in.
+func (c *RetentionConfig) ClassFor(eventType string) string {
+	for _, p := range c.Policies {
+		if p.Name != defaultRetentionClass && p.matches(eventType) {
+			return p.Name
+		}
+	}
+	return defaultRetentionClass
+}
+
+// Policy returns the named policy. Classes whose policy has been removed
+// from the config fall back to the default one.
+func (c *RetentionConfig) Policy(class string) *RetentionPolicy {
+	var def *RetentionPolicy
+	for _, p := range c.Policies {
+		if p.Name == class {
+			return p
+		}
+		if p.Name == defaultRetentionClass {
+			def = p
+		}
+	}
+	return def
+}
+
+// classSQL is a CASE expression giving the retention class of a row's type.
+func (c *RetentionConfig) classSQL() (string, []interface{}) {
+	var b strings.Builder
+	var args []interface{}
+	b.WriteString("CASE")
+	for _, p := range c.Policies {
+		for _, re := range p.patterns {
+			if p.Name == defaultRetentionClass {
+				continue
+			}
+			args = append(args, re.String(), p.Name)
+			fmt.Fprintf(&b, " WHEN type ~ $%d THEN $%d", len(args)-1, len(args))
+		}
+	}
+	b.WriteString(" ELSE '" + defaultRetentionClass + "' END")
+	return b.String(), args
+}
+
+// partitionRange is the leaf of class holding t.
+func partitionRange(class, interval string, t time.Time) (name string, from, to time.Time) {
+	t = t.UTC()
+	if interval == "monthly" {
+		from = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return fmt.Sprintf("events_%s_p%s", class, from.Format("200601")), from, from.AddDate(0, 1, 0)
+	}
+	from = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return fmt.Sprintf("events_%s_p%s", class, from.Format("20060102")), from, from.AddDate(0, 0, 1)
+}
+
+// parsePartitionName is the inverse of partitionRange.
+func parsePartitionName(name string) (class string, from, to time.Time, ok bool) {
+	i := strings.LastIndex(name, "_p")
+	if !strings.HasPrefix(name, "events_") || i < len("events_") {
+		return "", time.Time{}, time.Time{}, false
+	}
+	class, suffix := name[len("events_"):i], name[i+2:]
+
+	var err error
+	switch len(suffix) {
+	case 8:
+		from, err = time.Parse("20060102", suffix)
+		to = from.AddDate(0, 0, 1)
+	case 6:
+		from, err = time.Parse("200601", suffix)
+		to = from.AddDate(0, 1, 0)
+	default:
+		return "", time.Time{}, time.Time{}, false
+	}
+	return class, from, to, err == nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// ensurePartition creates the class partition and the leaf that holds t
+// if they do not exist. A leaf of either interval already holding t is
+// kept, since the class's interval may have changed since it was created.
+func ensurePartition(ctx context.Context, ex execer, class string, t time.Time) error {
+	policy := retention.Policy(class)
+	parent := "events_" + class
+	_, err := ex.ExecContext(ctx, fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s PARTITION OF events FOR VALUES IN (%s) PARTITION BY RANGE (timestamp)`,
+		pq.QuoteIdentifier(parent), pq.QuoteLiteral(class)))
+	if err != nil {
+		return fmt.Errorf("failed to create partition %s: %w", parent, err)
+	}
+
+	covered, err := leafCovers(ctx, ex, parent, t)
+	if err != nil || covered {
+		return err
+	}
+
+	name, from, to := partitionRange(class, policy.Interval, t)
+	err = createLeaf(ctx, ex, parent, name, from, to)
+	if err != nil && policy.Interval == "monthly" {
+		// The interval was daily once and some days of the month already
+		// have leaves; a daily leaf always fits between them
+		name, from, to = partitionRange(class, "daily", t)
+		err = createLeaf(ctx, ex, parent, name, from, to)
+	}
+	return err
+}
+
+// leafCovers reports whether a leaf of parent already holds t.
+func leafCovers(ctx context.Context, ex execer, parent string, t time.Time) (bool, error) {
+	var leaves pq.StringArray
+	err := ex.QueryRowContext(ctx, `
+		SELECT COALESCE(array_agg(c.relname::text), '{}')
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = to_regclass($1)
+	`, parent).Scan(&leaves)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range leaves {
+		if _, from, to, ok := parsePartitionName(name); ok && !t.Before(from) && t.Before(to) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func createLeaf(ctx context.Context, ex execer, parent, name string, from, to time.Time) error {
+	var exists bool
+	if err := ex.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, name).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	_, err := ex.ExecContext(ctx, fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM (%s) TO (%s)`,
+		pq.QuoteIdentifier(name), pq.QuoteIdentifier(parent),
+		pq.QuoteLiteral(from.Format(time.RFC3339)), pq.QuoteLiteral(to.Format(time.RFC3339))))
+	if err != nil {
+		return fmt.Errorf("failed to create partition %s: %w", name, err)
+	}
+	atomic.AddUint64(&partitionsCreated, 1)
+	logger.Log("info", "Partition created", map[string]interface{}{"partition": name})
+	return nil
+}
+
+// isMissingPartition reports whether err is Postgres finding no partition
+// for a row.
+func isMissingPartition(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23514" && strings.Contains(pqErr.Message, "no partition")
+}
+
+const eventsTableSchema = `
+	CREATE TABLE events (
+		id VARCHAR(255) NOT NULL,
+		type VARCHAR(255) NOT NULL,
+		source VARCHAR(255) NOT NULL,
+		subject TEXT,
+		datacontenttype VARCHAR(255),
+		data JSONB,
+		timestamp TIMESTAMPTZ NOT NULL,
+		retention_class VARCHAR(63) NOT NULL DEFAULT 'default',
+		created_at TIMESTAMPTZ DEFAULT NOW(),
+		PRIMARY KEY (id, timestamp, retention_class)
+	) PARTITION BY LIST (retention_class)`
+
+// initEventsTable creates the partitioned events table, moving the rows of
+// an unpartitioned one from before partitioning into it.
+func initEventsTable(ctx context.Context) error {
+	var kind sql.NullString
+	err := db.QueryRowContext(ctx,
+		`SELECT relkind::text FROM pg_class WHERE oid = to_regclass('events')`).Scan(&kind)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	switch kind.String {
+	case "p":
+		return nil
+	case "":
+		_, err := db.ExecContext(ctx, eventsTableSchema)
+		return err
+	}
+
+	logger.Log("info", "Partitioning events table", nil)
+	start := time.Now()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		ALTER TABLE events ADD COLUMN IF NOT EXISTS subject TEXT;
+		ALTER TABLE events ADD COLUMN IF NOT EXISTS datacontenttype VARCHAR(255);
+		ALTER TABLE events RENAME TO events_unpartitioned;
+		ALTER TABLE events_unpartitioned RENAME CONSTRAINT events_pkey TO events_unpartitioned_pkey;
+		DROP INDEX IF EXISTS idx_events_type;
+		DROP INDEX IF EXISTS idx_events_timestamp;
+		DROP INDEX IF EXISTS idx_events_timestamp_id;
+		DROP INDEX IF EXISTS idx_events_data;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to set aside events table: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, eventsTableSchema); err != nil {
+		return fmt.Errorf("failed to create partitioned events table: %w", err)
+	}
+
+	// Every leaf the old rows need
+	rows, err := tx.QueryContext(ctx,
+		`SELECT DISTINCT type, date_trunc('day', timestamp AT TIME ZONE 'UTC') FROM events_unpartitioned`)
+	if err != nil {
+		return err
+	}
+	type leaf struct {
+		class string
+		day   time.Time
+	}
+	leaves := map[leaf]bool{}
+	for rows.Next() {
+		var eventType string
+		var day time.Time
+		if err := rows.Scan(&eventType, &day); err != nil {
+			rows.Close()
+			return err
+		}
+		class := retention.ClassFor(eventType)
+		_, from, _ := partitionRange(class, retention.Policy(class).Interval, day)
+		leaves[leaf{class, from}] = true
+	}
+	rows.Close()
+	for l := range leaves {
+		if err := ensurePartition(ctx, tx, l.class, l.day); err != nil {
+			return err
+		}
+	}
+
+	classExpr, args := retention.classSQL()
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO events (id, type, source, subject, datacontenttype, data, timestamp, retention_class, created_at)
+		SELECT id, type, source, subject, datacontenttype, data, timestamp, `+classExpr+`, created_at
+		FROM events_unpartitioned`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to move events: %w", err)
+	}
+	moved, _ := res.RowsAffected()
+
+	if _, err := tx.ExecContext(ctx, `DROP TABLE events_unpartitioned`); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	logger.Log("info", "Events table partitioned", map[string]interface{}{
+		"events": moved, "partitions": len(leaves), "duration": time.Since(start).String(),
+	})
+	return nil
+}
+
+// Partition is a leaf of the events table.
+type Partition struct {
+	Name      string     `json:"name"`
+	Class     string     `json:"class"`
+	From      time.Time  `json:"from"`
+	To        time.Time  `json:"to"`
+	Bytes     int64      `json:"bytes"`
+	Rows      int64      `json:"rows"`                 // Estimate from table statistics
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Unset when the class keeps events forever
+}
+
+func listPartitions(ctx context.Context) ([]Partition, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.relname, pg_total_relation_size(c.oid), COALESCE(s.n_live_tup, 0)
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_inherits ci ON ci.inhrelid = i.inhparent
+		LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid
+		WHERE ci.inhparent = to_regclass('events') AND c.relkind = 'r'
+		ORDER BY c.relname
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var partitions []Partition
+	for rows.Next() {
+		var p Partition
+		if err := rows.Scan(&p.Name, &p.Bytes, &p.Rows); err != nil {
+			return nil, err
+		}
+		var ok bool
+		if p.Class, p.From, p.To, ok = parsePartitionName(p.Name); !ok {
+			continue
+		}
+		if keep := retention.Policy(p.Class).keep; keep > 0 {
+			expires := p.To.Add(keep)
+			p.ExpiresAt = &expires
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions, rows.Err()
+}
+
+// maintainPartitions creates the leaves each class needs for now and the
+// next interval, and archives and drops the ones past their retention.
+// Only one replica does it at a time.
+func maintainPartitions(ctx context.Context) error {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, maintenanceLockKey).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, maintenanceLockKey)
+
+	err = runMaintenance(ctx)
+
+	statusMu.Lock()
+	lastMaintenance = time.Now().UTC()
+	lastMaintenanceErr = ""
+	if err != nil {
+		lastMaintenanceErr = err.Error()
+	}
+	statusMu.Unlock()
+	return err
+}
+
+func runMaintenance(ctx context.Context) error {
+	now := time.Now().UTC()
+
+	// A leaf that cannot be created must not keep expired ones around
+	var errs []string
+	for _, p := range retention.Policies {
+		_, _, next := partitionRange(p.Name, p.Interval, now)
+		for _, t := range []time.Time{now, next} {
+			if err := ensurePartition(ctx, db, p.Name, t); err != nil {
+				logger.Log("error", "Failed to create partition", map[string]interface{}{"class": p.Name, "error": err.Error()})
+				errs = append(errs, p.Name+": "+err.Error())
+			}
+		}
+	}
+
+	partitions, err := listPartitions(ctx)
+	if err != nil {
+		errs = append(errs, err.Error())
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	for _, p := range partitions {
+		if p.ExpiresAt == nil || p.ExpiresAt.After(now) {
+			continue
+		}
+		if err := dropPartition(ctx, p); err != nil {
+			logger.Log("error", "Failed to expire partition", map[string]interface{}{"partition": p.Name, "error": err.Error()})
+			errs = append(errs, p.Name+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func dropPartition(ctx context.Context, p Partition) error {
+	policy := retention.Policy(p.Class)
+	if policy.Archive {
+		if err := archivePartition(ctx, p); err != nil {
+			return fmt.Errorf("archive failed, keeping partition: %w", err)
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, `DROP TABLE IF EXISTS `+pq.QuoteIdentifier(p.Name)); err != nil {
+		return err
+	}
+	atomic.AddUint64(&partitionsDropped, 1)
+	logger.Log("info", "Partition expired", map[string]interface{}{
+		"partition": p.Name, "class": p.Class, "rows": p.Rows, "bytes": p.Bytes, "archived": policy.Archive,
+	})
+	return nil
+}
+
+// archivePartition writes the partition as gzipped NDJSON to
+// EVENT_ARCHIVE_DIR and hands it to backup-storage. With
+// BACKUP_STORAGE_URL=off the file stays there instead, so the directory
+// must be on a volume that outlives the pod.
+func archivePartition(ctx context.Context, p Partition) error {
+	dir := os.Getenv("EVENT_ARCHIVE_DIR")
+	if dir == "" {
+		return fmt.Errorf("EVENT_ARCHIVE_DIR is not set")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	name := p.Name + ".ndjson.gz"
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	n, err := writePartition(ctx, f, p.Name)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	backupURL := os.Getenv("BACKUP_STORAGE_URL")
+	if backupURL == "" {
+		backupURL = "http://backup-storage.holm.svc.cluster.local"
+	}
+	if backupURL != "off" {
+		if err := uploadArchive(ctx, backupURL, name, path); err != nil {
+			os.Remove(path)
+			return err
+		}
+		os.Remove(path)
+	}
+
+	atomic.AddUint64(&partitionsArchived, 1)
+	logger.Log("info", "Partition archived", map[string]interface{}{"partition": p.Name, "events": n, "file": name})
+	return nil
+}
+
+func writePartition(ctx context.Context, w io.Writer, partition string) (int, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, type, source, subject, datacontenttype, data, timestamp, created_at FROM `+
+			pq.QuoteIdentifier(partition)+` ORDER BY timestamp, id`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	n := 0
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return n, err
+		}
+		if err := enc.Encode(e); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	return n, gz.Close()
+}
+
+// uploadArchive posts the file to backup-storage, streaming it into the
+// base64 data field so the archive is never held in memory.
+func uploadArchive(ctx context.Context, backupURL, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		header, _ := json.Marshal(map[string]string{"name": name, "type": "events-archive"})
+		// Reopen the object to append the data field
+		io.WriteString(pw, string(header[:len(header)-1])+`,"data":"`)
+		enc := base64.NewEncoder(base64.StdEncoding, pw)
+		_, err := io.Copy(enc, f)
+		if err == nil {
+			err = enc.Close()
+		}
+		if err == nil {
+			_, err = io.WriteString(pw, `"}`)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(backupURL, "/")+"/backups", pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("backup-storage: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("backup-storage returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func startPartitionMaintenance() {
+	interval := time.Hour
+	if s := os.Getenv("PARTITION_MAINTENANCE_INTERVAL"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			interval = d
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if db != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+				if err := maintainPartitions(ctx); err != nil {
+					logger.Log("error", "Partition maintenance failed", map[string]interface{}{"error": err.Error()})
+				}
+				cancel()
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// writePartitionMetrics adds per-partition gauges to /metrics.
+func writePartitionMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP event_persist_partitions_created_total Partitions created\n")
+	fmt.Fprintf(w, "# TYPE event_persist_partitions_created_total counter\n")
+	fmt.Fprintf(w, "event_persist_partitions_created_total %d\n", atomic.LoadUint64(&partitionsCreated))
+
+	fmt.Fprintf(w, "# HELP event_persist_partitions_dropped_total Partitions dropped by retention\n")
+	fmt.Fprintf(w, "# TYPE event_persist_partitions_dropped_total counter\n")
+	fmt.Fprintf(w, "event_persist_partitions_dropped_total %d\n", atomic.LoadUint64(&partitionsDropped))
+
+	fmt.Fprintf(w, "# HELP event_persist_partitions_archived_total Partitions archived to backup-storage\n")
+	fmt.Fprintf(w, "# TYPE event_persist_partitions_archived_total counter\n")
+	fmt.Fprintf(w, "event_persist_partitions_archived_total %d\n", atomic.LoadUint64(&partitionsArchived))
+
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	partitions, err := listPartitions(ctx)
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP event_persist_partition_bytes Size of each events partition including indexes\n")
+	fmt.Fprintf(w, "# TYPE event_persist_partition_bytes gauge\n")
+	for _, p := range partitions {
+		fmt.Fprintf(w, "event_persist_partition_bytes{partition=%q,class=%q} %d\n", p.Name, p.Class, p.Bytes)
+	}
+
+	fmt.Fprintf(w, "# HELP event_persist_partition_rows Estimated rows in each events partition\n")
+	fmt.Fprintf(w, "# TYPE event_persist_partition_rows gauge\n")
+	for _, p := range partitions {
+		fmt.Fprintf(w, "event_persist_partition_rows{partition=%q,class=%q} %d\n", p.Name, p.Class, p.Rows)
+	}
+
+	fmt.Fprintf(w, "# HELP event_persist_partition_expires_timestamp_seconds When each events partition is dropped\n")
+	fmt.Fprintf(w, "# TYPE event_persist_partition_expires_timestamp_seconds gauge\n")
+	for _, p := range partitions {
+		if p.ExpiresAt != nil {
+			fmt.Fprintf(w, "event_persist_partition_expires_timestamp_seconds{partition=%q,class=%q} %d\n", p.Name, p.Class, p.ExpiresAt.Unix())
+		}
+	}
+}
+
+// partitionsHandler serves GET /partitions, the retention policies and
+// every partition, and POST /partitions to run maintenance now.
+func partitionsHandler(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Minute)
+		err := maintainPartitions(ctx)
+		cancel()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	partitions, err := listPartitions(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"policies":   retention.Policies,
+		"partitions": partitions,
+	}
+	statusMu.RLock()
+	if !lastMaintenance.IsZero() {
+		resp["last_maintenance"] = lastMaintenance
+	}
+	if lastMaintenanceErr != "" {
+		resp["last_maintenance_error"] = lastMaintenanceErr
+	}
+	statusMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/holm/eventsdk"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+	exportBatchSize   = 500
+)
+
+var (
+	typeTokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	// path op value, or just a path to test that it exists
+	predicatePattern = regexp.MustCompile(`^(!?)([A-Za-z0-9_-]+(?:\.[A-Za-z0-9_-]+)*)\s*(?:(==|=|!=|>=|<=|>|<)\s*(.*))?$`)
+)
+
+// eventQuery selects stored events. Types are NATS-style patterns, so
+// "files.*" matches files.created and "files.>" matches everything under
+// files. Where predicates test the event data, e.g. "size>1024",
+// "owner.name=tim" or "!deleted".
+type eventQuery struct {
+	Types   []string  `json:"types,omitempty"`
+	Sources []string  `json:"sources,omitempty"`
+	Subject string    `json:"subject,omitempty"`
+	Since   time.Time `json:"since,omitempty"`
+	Until   time.Time `json:"until,omitempty"`
+	Where   []string  `json:"where,omitempty"`
+	Order   string    `json:"order"`
+	Limit   int       `json:"limit,omitempty"`
+
+	typePatterns []string
+	excludeTypes []string
+	jsonPaths    []string
+	notPaths     []bool
+	after        *eventCursor
+}
+
+// storedEvent is an event as event-persist returns it from /v2.
+type storedEvent struct {
+	eventsdk.Event
+	PersistedAt time.Time `json:"persisted_at"`
+}
+
+// legacyEvent is the shape /events and /event have always returned, kept
+// for the clients that read them.
+type legacyEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Source    string          `json:"source"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp time.Time       `json:"timestamp"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func (e *storedEvent) legacy() legacyEvent {
+	return legacyEvent{
+		ID:        e.ID,
+		Type:      e.Type,
+		Source:    e.Source,
+		Data:      e.Data,
+		Timestamp: e.Time,
+		CreatedAt: e.PersistedAt,
+	}
+}
+
+type eventCursor struct {
+	Timestamp time.Time
+	ID        string
+}
+
+func (c eventCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Timestamp.Format(time.RFC3339Nano) + "|" + c.ID))
+}
+
+func parseCursor(s string) (*eventCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &eventCursor{Timestamp: t, ID: id}, nil
+}
+
+// parseEventQuery reads a query from request parameters: type and source
+// (repeated or comma-separated), subject, since and until (RFC3339, or a
+// duration ago such as 24h), where (repeated), order (asc or desc),
+// cursor and limit.
+func parseEventQuery(v url.Values, defaultOrder string) (*eventQuery, error) {
+	q := &eventQuery{
+		Types:   splitValues(v["type"]),
+		Sources: splitValues(v["source"]),
+		Subject: v.Get("subject"),
+		Where:   v["where"],
+		Order:   v.Get("order"),
+	}
+	if q.Order == "" {
+		q.Order = defaultOrder
+	}
+
+	var err error
+	if q.Since, err = parseTime(v.Get("since")); err != nil {
+		return nil, fmt.Errorf("invalid since: %w", err)
+	}
+	if q.Until, err = parseTime(v.Get("until")); err != nil {
+		return nil, fmt.Errorf("invalid until: %w", err)
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			return nil, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	if s := v.Get("cursor"); s != "" {
+		if q.after, err = parseCursor(s); err != nil {
+			return nil, err
+		}
+	}
+	return q, q.compile()
+}
+
+func (q *eventQuery) compile() error {
+	if q.Order != "asc" && q.Order != "desc" {
+		return fmt.Errorf("order must be asc or desc")
+	}
+	if !q.Since.IsZero() && !q.Until.IsZero() && !q.Until.After(q.Since) {
+		return fmt.Errorf("until must be after since")
+	}
+
+	q.typePatterns = nil
+	for _, t := range q.Types {
+		pattern, err := typeRegexp(t)
+		if err != nil {
+			return err
+		}
+		q.typePatterns = append(q.typePatterns, pattern)
+	}
+
+	q.jsonPaths, q.notPaths = nil, nil
+	for _, w := range q.Where {
+		path, not, err := predicatePath(w)
+		if err != nil {
+			return err
+		}
+		q.jsonPaths = append(q.jsonPaths, path)
+		q.notPaths = append(q.notPaths, not)
+	}
+	return nil
+}
+
+// typeRegexp turns a type pattern into an anchored Postgres regular
+// expression: * matches one token and > the rest of the type.
+func typeRegexp(pattern string) (string, error) {
+	tokens := strings.Split(pattern, ".")
+	parts := make([]string, len(tokens))
+	for i, tok := range tokens {
+		switch {
+		case tok == "*":
+			parts[i] = `[^.]+`
+		case tok == ">" && i == len(tokens)-1:
+			parts[i] = `.+`
+		case typeTokenPattern.MatchString(tok):
+			parts[i] = tok
+		default:
+			return "", fmt.Errorf("invalid type pattern %q", pattern)
+		}
+	}
+	return "^" + strings.Join(parts, `\.`) + "$", nil
+}
+
+// predicatePath turns a where predicate into a SQL/JSON path for the @?
+// operator. The value is a JSON literal, or taken as a string if it is not
+// one, so "count=3" compares numbers and "name=tim" strings.
+func predicatePath(predicate string) (string, bool, error) {
+	m := predicatePattern.FindStringSubmatch(strings.TrimSpace(predicate))
+	if m == nil {
+		return "", false, fmt.Errorf("invalid where predicate %q", predicate)
+	}
+	not, field, op, value := m[1] == "!", m[2], m[3], strings.TrimSpace(m[4])
+
+	segments := strings.Split(strings.TrimPrefix(field, "data."), ".")
+	for i, s := range segments {
+		segments[i] = strconv.Quote(s)
+	}
+	path := "$." + strings.Join(segments, ".")
+
+	if op == "" {
+		return path, not, nil
+	}
+	if not {
+		return "", false, fmt.Errorf("invalid where predicate %q: ! only applies to a bare field", predicate)
+	}
+
+	var literal interface{}
+	if json.Unmarshal([]byte(value), &literal) != nil {
+		literal = value
+	}
+	switch literal.(type) {
+	case map[string]interface{}, []interface{}:
+		return "", false, fmt.Errorf("invalid where predicate %q: compare against a scalar", predicate)
+	}
+	if op == "=" {
+		op = "=="
+	}
+	lit, _ := json.Marshal(literal)
+	return fmt.Sprintf("%s ? (@ %s %s)", path, op, lit), false, nil
+}
+
+// where builds the WHERE clause and its arguments, leaving room for
+// arguments the caller adds after them.
+func (q *eventQuery) where(after *eventCursor) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if len(q.typePatterns) > 0 {
+		var or []string
+		for i, pattern := range q.typePatterns {
+			if !strings.ContainsAny(q.Types[i], "*>") {
+				or = append(or, "type = "+arg(q.Types[i]))
+			} else {
+				or = append(or, "type ~ "+arg(pattern))
+			}
+		}
+		conds = append(conds, "("+strings.Join(or, " OR ")+")")
+	}
+	if len(q.excludeTypes) > 0 {
+		conds = append(conds, "type <> ALL("+arg(pq.Array(q.excludeTypes))+")")
+	}
+	if len(q.Sources) > 0 {
+		conds = append(conds, "source = ANY("+arg(pq.Array(q.Sources))+")")
+	}
+	if q.Subject != "" {
+		conds = append(conds, "subject = "+arg(q.Subject))
+	}
+	if !q.Since.IsZero() {
+		conds = append(conds, "timestamp >= "+arg(q.Since))
+	}
+	if !q.Until.IsZero() {
+		conds = append(conds, "timestamp < "+arg(q.Until))
+	}
+	for i, path := range q.jsonPaths {
+		cond := "data @? " + arg(path) + "::jsonpath"
+		if q.notPaths[i] {
+			cond = "NOT COALESCE(" + cond + ", FALSE)"
+		}
+		conds = append(conds, cond)
+	}
+	if after != nil {
+		cmp := "<"
+		if q.Order == "asc" {
+			cmp = ">"
+		}
+		conds = append(conds, fmt.Sprintf("(timestamp, id) %s (%s, %s)", cmp, arg(after.Timestamp), arg(after.ID)))
+	}
+
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// page returns up to limit events after the cursor, and the cursor of the
+// next page if there is one.
+func (q *eventQuery) page(ctx context.Context, after *eventCursor, limit int) ([]storedEvent, *eventCursor, error) {
+	where, args := q.where(after)
+	order := "DESC"
+	if q.Order == "asc" {
+		order = "ASC"
+	}
+	args = append(args, limit+1)
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, type, source, subject, datacontenttype, data, timestamp, created_at FROM events`+where+
+			` ORDER BY timestamp `+order+`, id `+order+` LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	events := []storedEvent{}
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		events = append(events, *e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(events) <= limit {
+		return events, nil, nil
+	}
+	events = events[:limit]
+	last := events[limit-1]
+	return events, &eventCursor{Timestamp: last.Time, ID: last.ID}, nil
+}
+
+// each calls fn for every matching event in batches, stopping after
+// q.Limit events if it is set.
+func (q *eventQuery) each(ctx context.Context, fn func(*storedEvent) error) error {
+	after, seen := q.after, 0
+	for {
+		batch := exportBatchSize
+		if q.Limit > 0 && q.Limit-seen < batch {
+			batch = q.Limit - seen
+		}
+		if batch <= 0 {
+			return nil
+		}
+
+		events, next, err := q.page(ctx, after, batch)
+		if err != nil {
+			return err
+		}
+		for i := range events {
+			if err := fn(&events[i]); err != nil {
+				return err
+			}
+		}
+		seen += len(events)
+		if next == nil {
+			return nil
+		}
+		after = next
+	}
+}
+
+// count returns how many events match, up to q.Limit if it is set.
+func (q *eventQuery) count(ctx context.Context) (int, error) {
+	where, args := q.where(q.after)
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM events`+where, args...).Scan(&n)
+	if q.Limit > 0 && n > q.Limit {
+		n = q.Limit
+	}
+	return n, err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEvent(row rowScanner) (*storedEvent, error) {
+	var e storedEvent
+	var subject, contentType sql.NullString
+	var data []byte
+	if err := row.Scan(&e.ID, &e.Type, &e.Source, &subject, &contentType, &data, &e.Time, &e.PersistedAt); err != nil {
+		return nil, err
+	}
+	e.SpecVersion = eventsdk.SpecVersion
+	e.Subject = subject.String
+	e.DataContentType = contentType.String
+	if len(data) > 0 && string(data) != "null" {
+		e.Data = json.RawMessage(data)
+	}
+	return &e, nil
+}
+
+func splitValues(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// queryPage runs the query in r's parameters for GET /events and
+// /v2/events, writing the error and returning false if it fails.
+func queryPage(w http.ResponseWriter, r *http.Request) ([]storedEvent, *eventCursor, bool) {
+	if db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return nil, nil, false
+	}
+
+	q, err := parseEventQuery(r.URL.Query(), "desc")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	limit := q.Limit
+	if limit == 0 {
+		limit = defaultQueryLimit
+	}
+	if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	events, next, err := q.page(ctx, q.after, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return events, next, true
+}
+
+// eventsHandler answers GET /events: matching events newest first, as the
+// plain array it has always returned. Use /v2/events to page through more.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	events, _, ok := queryPage(w, r)
+	if !ok {
+		return
+	}
+	var out []legacyEvent
+	for i := range events {
+		out = append(out, events[i].legacy())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// eventsV2Handler answers GET /v2/events: matching events newest first as
+// CloudEvents, a page at a time. Pass next_cursor back as cursor for the
+// next page.
+func eventsV2Handler(w http.ResponseWriter, r *http.Request) {
+	events, next, ok := queryPage(w, r)
+	if !ok {
+		return
+	}
+
+	resp := map[string]interface{}{
+		"events": events,
+		"count":  len(events),
+	}
+	if next != nil {
+		resp["next_cursor"] = next.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// exportHandler answers GET /events/export: every matching event as
+// newline-delimited JSON, oldest first unless order=desc.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	q, err := parseEventQuery(r.URL.Query(), "asc")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=events-%s.ndjson", time.Now().UTC().Format("20060102-150405")))
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	n := 0
+	err = q.each(r.Context(), func(e *storedEvent) error {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		if n++; n%exportBatchSize == 0 && flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// Headers are gone, so all we can do is cut the stream short
+		logger.Log("error", "Export failed", map[string]interface{}{"error": err.Error(), "exported": n})
+		return
+	}
+	logger.Log("info", "Events exported", map[string]interface{}{"exported": n})
+}
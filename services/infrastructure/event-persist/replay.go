@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/holm/eventsdk"
+)
+
+const (
+	defaultReplayRate = 100
+	maxReplayRate     = 2000
+	maxReplayJobs     = 50
+)
+
+var subjectPrefixPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// ReplayRequest is the body of POST /events/replay. The filters are those
+// of GET /events. With no target_prefix events go back out on their own
+// subjects, through JetStream, so every consumer sees them again; with one
+// they are sent to <target_prefix>.<type> only, for rebuilding a
+// projection without touching anyone else. Dead-letter events are left out
+// of a replay to the original subjects unless include_dlq is set, since
+// event-dlq would take each one in as a new failure.
+type ReplayRequest struct {
+	Type         []string `json:"type,omitempty"`
+	Source       []string `json:"source,omitempty"`
+	Subject      string   `json:"subject,omitempty"`
+	Since        string   `json:"since,omitempty"`
+	Until        string   `json:"until,omitempty"`
+	Where        []string `json:"where,omitempty"`
+	Limit        int      `json:"limit,omitempty"`
+	TargetPrefix string   `json:"target_prefix,omitempty"`
+	IncludeDLQ   bool     `json:"include_dlq,omitempty"`
+	Rate         int      `json:"rate,omitempty"` // Events per second
+}
+
+func (r *ReplayRequest) query() (*eventQuery, error) {
+	v := url.Values{
+		"type":   r.Type,
+		"source": r.Source,
+		"where":  r.Where,
+	}
+	v.Set("subject", r.Subject)
+	v.Set("since", r.Since)
+	v.Set("until", r.Until)
+	if r.Limit > 0 {
+		v.Set("limit", strconv.Itoa(r.Limit))
+	}
+	q, err := parseEventQuery(v, "asc")
+	if err != nil {
+		return nil, err
+	}
+	if r.TargetPrefix == "" && !r.IncludeDLQ {
+		q.excludeTypes = []string{eventsdk.DLQType}
+	}
+	return q, nil
+}
+
+// ReplayJob is a replay running or run.
+type ReplayJob struct {
+	ID          string         `json:"id"`
+	Request     *ReplayRequest `json:"request"`
+	Status      string         `json:"status"` // running, completed, failed, cancelled
+	StartedBy   string         `json:"started_by"`
+	Total       int            `json:"total"`
+	Published   int            `json:"published"`
+	Failed      int            `json:"failed"`
+	LastEventID string         `json:"last_event_id,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	StartedAt   time.Time      `json:"started_at"`
+	FinishedAt  *time.Time     `json:"finished_at,omitempty"`
+
+	query  *eventQuery
+	cancel context.CancelFunc
+}
+
+// ReplayManager runs replays and remembers the most recent ones.
+type ReplayManager struct {
+	mu   sync.RWMutex
+	jobs map[string]*ReplayJob
+}
+
+var replays = &ReplayManager{jobs: make(map[string]*ReplayJob)}
+
+func (m *ReplayManager) Start(req *ReplayRequest, user string) (*ReplayJob, error) {
+	if db == nil || eventBus == nil {
+		return nil, fmt.Errorf("service not ready")
+	}
+
+	q, err := req.query()
+	if err != nil {
+		return nil, err
+	}
+	if q.Since.IsZero() {
+		return nil, fmt.Errorf("since is required, replaying all history is rarely what you want")
+	}
+	if req.TargetPrefix != "" {
+		if !subjectPrefixPattern.MatchString(req.TargetPrefix) {
+			return nil, fmt.Errorf("invalid target_prefix %q", req.TargetPrefix)
+		}
+		if req.TargetPrefix == "events" || strings.HasPrefix(req.TargetPrefix, "events.") {
+			return nil, fmt.Errorf("target_prefix must be outside events.>, omit it to replay to the original subjects")
+		}
+	}
+	if req.Rate <= 0 {
+		req.Rate = defaultReplayRate
+	}
+	if req.Rate > maxReplayRate {
+		req.Rate = maxReplayRate
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	total, err := q.count(ctx)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to count events: %w", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	job := &ReplayJob{
+		ID:        eventsdk.NewID(),
+		Request:   req,
+		Status:    "running",
+		StartedBy: user,
+		Total:     total,
+		StartedAt: time.Now().UTC(),
+		query:     q,
+		cancel:    cancel,
+	}
+
+	m.mu.Lock()
+	m.jobs[job.ID] = job
+	m.prune()
+	m.mu.Unlock()
+
+	go m.run(ctx, job)
+
+	logger.Log("info", "Replay started", map[string]interface{}{
+		"replay_id": job.ID, "total": total, "target_prefix": req.TargetPrefix, "rate": req.Rate, "user": user,
+	})
+	return m.Get(job.ID), nil
+}
+
+func (m *ReplayManager) run(ctx context.Context, job *ReplayJob) {
+	tick := time.NewTicker(time.Second / time.Duration(job.Request.Rate))
+	defer tick.Stop()
+
+	err := job.query.each(ctx, func(e *storedEvent) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+
+		event := e.Event
+		pubCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		var err error
+		if prefix := job.Request.TargetPrefix; prefix == "" {
+			_, err = eventBus.Retry(pubCtx, &event)
+		} else {
+			err = eventBus.PublishTo(pubCtx, prefix+"."+event.Type, &event)
+		}
+		cancel()
+
+		m.mu.Lock()
+		if err != nil {
+			job.Failed++
+		} else {
+			job.Published++
+			job.LastEventID = event.ID
+		}
+		m.mu.Unlock()
+
+		if err != nil {
+			logger.Log("warn", "Failed to replay event", map[string]interface{}{
+				"replay_id": job.ID, "event_id": event.ID, "error": err.Error(),
+			})
+		}
+		return nil
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	switch {
+	case ctx.Err() != nil:
+		job.Status = "cancelled"
+	case err != nil:
+		job.Status = "failed"
+		job.Error = err.Error()
+	default:
+		job.Status = "completed"
+	}
+	job.cancel()
+
+	logger.Log("info", "Replay finished", map[string]interface{}{
+		"replay_id": job.ID, "status": job.Status, "published": job.Published, "failed": job.Failed,
+	})
+}
+
+func (m *ReplayManager) Cancel(id string) bool {
+	m.mu.RLock()
+	job, ok := m.jobs[id]
+	m.mu.RUnlock()
+	if ok {
+		job.cancel()
+	}
+	return ok
+}
+
+func (m *ReplayManager) Get(id string) *ReplayJob {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil
+	}
+	snapshot := *job
+	return &snapshot
+}
+
+func (m *ReplayManager) List() []*ReplayJob {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	jobs := make([]*ReplayJob, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		snapshot := *job
+		jobs = append(jobs, &snapshot)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].StartedAt.After(jobs[j].StartedAt) })
+	return jobs
+}
+
+// prune drops the oldest finished jobs beyond maxReplayJobs. Callers hold
+// the lock.
+func (m *ReplayManager) prune() {
+	if len(m.jobs) <= maxReplayJobs {
+		return
+	}
+	var finished []*ReplayJob
+	for _, job := range m.jobs {
+		if job.FinishedAt != nil {
+			finished = append(finished, job)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].StartedAt.Before(finished[j].StartedAt) })
+	for _, job := range finished {
+		if len(m.jobs) <= maxReplayJobs {
+			break
+		}
+		delete(m.jobs, job.ID)
+	}
+}
+
+// replayHandler serves /events/replay and /events/replay/{id}.
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/events/replay"), "/")
+	w.Header().Set("Content-Type", "application/json")
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(replays.List())
+		case http.MethodPost:
+			user := requireAdmin(w, r)
+			if user == "" {
+				return
+			}
+			var req ReplayRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			job, err := replays.Start(&req, user)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(job)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		job := replays.Get(id)
+		if job == nil {
+			http.Error(w, "Replay not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(job)
+	case http.MethodDelete:
+		if requireAdmin(w, r) == "" {
+			return
+		}
+		if !replays.Cancel(id) {
+			http.Error(w, "Replay not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(replays.Get(id))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
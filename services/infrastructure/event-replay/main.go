@@ -11,8 +11,8 @@ import (
 	"sync/atomic"
 	"time"
 
-	_ "github.com/lib/pq"
-	"github.com/nats-io/nats.go"
+	"github.com/holm/eventsdk"
+	"github.com/lib/pq"
 )
 
 // Catppuccin Mocha colors
@@ -50,24 +50,14 @@ func (l *Logger) Log(level, msg string, fields map[string]interface{}) {
 }
 
 var (
-	logger          = &Logger{}
-	db              *sql.DB
-	nc              *nats.Conn
-	requestCounter  uint64
-	eventsReplayed  uint64
-	replaysFailed   uint64
+	logger         = &Logger{}
+	db             *sql.DB
+	eventBus       *eventsdk.Client
+	requestCounter uint64
+	eventsReplayed uint64
+	replaysFailed  uint64
 )
 
-type FailedEvent struct {
-	ID        string          `json:"id"`
-	Type      string          `json:"type"`
-	Source    string          `json:"source"`
-	Data      json.RawMessage `json:"data"`
-	Error     string          `json:"error"`
-	Retries   int             `json:"retries"`
-	CreatedAt time.Time       `json:"created_at"`
-}
-
 func initDB() error {
 	dsn := os.Getenv("DATABASE_URL")
 	if dsn == "" {
@@ -91,22 +81,8 @@ func initDB() error {
 		return fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	// Create failed_events table
-	_, err = db.ExecContext(ctx, `
-		CREATE TABLE IF NOT EXISTS failed_events (
-			id VARCHAR(255) PRIMARY KEY,
-			type VARCHAR(255) NOT NULL,
-			source VARCHAR(255) NOT NULL,
-			data JSONB,
-			error TEXT,
-			retries INT DEFAULT 0,
-			created_at TIMESTAMPTZ DEFAULT NOW(),
-			last_retry TIMESTAMPTZ
-		);
-		CREATE INDEX IF NOT EXISTS idx_failed_events_retries ON failed_events(retries);
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to create table: %w", err)
+	if err := eventsdk.InitRetrySchema(ctx, db); err != nil {
+		return fmt.Errorf("failed to create tables: %w", err)
 	}
 
 	logger.Log("info", "Database initialized", nil)
@@ -120,74 +96,29 @@ func initNATS() error {
 	}
 
 	var err error
-	nc, err = nats.Connect(natsURL,
-		nats.RetryOnFailedConnect(true),
-		nats.MaxReconnects(-1),
-		nats.ReconnectWait(2*time.Second),
-	)
+	eventBus, err = eventsdk.Connect(natsURL, "event-replay")
 	if err != nil {
-		return fmt.Errorf("failed to connect to NATS: %w", err)
+		return err
 	}
 
 	logger.Log("info", "NATS connected", map[string]interface{}{"url": natsURL})
 	return nil
 }
 
-func replayEvents() {
-	if db == nil || nc == nil {
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	rows, err := db.QueryContext(ctx, `
-		SELECT id, type, source, data FROM failed_events
-		WHERE retries < 5 AND (last_retry IS NULL OR last_retry < NOW() - INTERVAL '5 minutes')
-		ORDER BY created_at ASC LIMIT 100
-	`)
-	if err != nil {
-		logger.Log("error", "Failed to query failed events", map[string]interface{}{"error": err.Error()})
-		return
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var event FailedEvent
-		if err := rows.Scan(&event.ID, &event.Type, &event.Source, &event.Data); err != nil {
-			continue
-		}
-
-		eventData, _ := json.Marshal(map[string]interface{}{
-			"id":        event.ID,
-			"type":      event.Type,
-			"source":    event.Source,
-			"data":      event.Data,
-			"timestamp": time.Now().UTC(),
-		})
-
-		subject := fmt.Sprintf("events.%s", event.Type)
-		if err := nc.Publish(subject, eventData); err != nil {
-			atomic.AddUint64(&replaysFailed, 1)
-			logger.Log("error", "Failed to replay event", map[string]interface{}{"error": err.Error(), "event_id": event.ID})
-
-			db.ExecContext(ctx, `UPDATE failed_events SET retries = retries + 1, last_retry = NOW() WHERE id = $1`, event.ID)
-		} else {
-			atomic.AddUint64(&eventsReplayed, 1)
-			logger.Log("info", "Event replayed", map[string]interface{}{"event_id": event.ID, "type": event.Type})
-
-			db.ExecContext(ctx, `DELETE FROM failed_events WHERE id = $1`, event.ID)
-		}
-	}
-}
-
 func startReplayWorker() {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(10 * time.Second)
 	go func() {
 		for range ticker.C {
 			replayEvents()
 		}
 	}()
+
+	prune := time.NewTicker(time.Hour)
+	go func() {
+		for range prune.C {
+			pruneSettled()
+		}
+	}()
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -204,7 +135,7 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if nc != nil && nc.IsConnected() {
+	if eventBus != nil && eventBus.IsConnected() {
 		natsHealthy = true
 	}
 
@@ -239,15 +170,24 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	natsUp := 0
-	if nc != nil && nc.IsConnected() {
+	if eventBus != nil && eventBus.IsConnected() {
 		natsUp = 1
 	}
 
-	pendingCount := 0
+	byStatus := map[string]int{}
 	if db != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
-		db.QueryRowContext(ctx, `SELECT COUNT(*) FROM failed_events WHERE retries < 5`).Scan(&pendingCount)
+		if rows, err := db.QueryContext(ctx, `SELECT status, COUNT(*) FROM failed_events GROUP BY status`); err == nil {
+			for rows.Next() {
+				var status string
+				var n int
+				if rows.Scan(&status, &n) == nil {
+					byStatus[status] = n
+				}
+			}
+			rows.Close()
+		}
 	}
 
 	fmt.Fprintf(w, "# HELP event_replay_up Whether the service is up\n")
@@ -270,15 +210,80 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "# TYPE event_replay_replays_failed_total counter\n")
 	fmt.Fprintf(w, "event_replay_replays_failed_total %d\n", atomic.LoadUint64(&replaysFailed))
 
+	fmt.Fprintf(w, "# HELP event_replay_events_given_up_total Total events given up on after exhausting their retry policy\n")
+	fmt.Fprintf(w, "# TYPE event_replay_events_given_up_total counter\n")
+	fmt.Fprintf(w, "event_replay_events_given_up_total %d\n", atomic.LoadUint64(&eventsGivenUp))
+
 	fmt.Fprintf(w, "# HELP event_replay_pending_events Number of pending events\n")
 	fmt.Fprintf(w, "# TYPE event_replay_pending_events gauge\n")
-	fmt.Fprintf(w, "event_replay_pending_events %d\n", pendingCount)
+	fmt.Fprintf(w, "event_replay_pending_events %d\n", byStatus[eventsdk.RetryPending])
+
+	fmt.Fprintf(w, "# HELP event_replay_failed_events Failed events by retry status\n")
+	fmt.Fprintf(w, "# TYPE event_replay_failed_events gauge\n")
+	for _, status := range []string{eventsdk.RetryPending, eventsdk.RetryPublished, eventsdk.RetryGaveUp, eventsdk.RetryResolved} {
+		fmt.Fprintf(w, "event_replay_failed_events{status=\"%s\"} %d\n", status, byStatus[status])
+	}
 
 	fmt.Fprintf(w, "# HELP event_replay_requests_total Total HTTP requests\n")
 	fmt.Fprintf(w, "# TYPE event_replay_requests_total counter\n")
 	fmt.Fprintf(w, "event_replay_requests_total %d\n", atomic.LoadUint64(&requestCounter))
 }
 
+// legacyFailedEvent is the shape /events has always returned, kept for the
+// clients that read it.
+type legacyFailedEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Source    string          `json:"source"`
+	Data      json.RawMessage `json:"data"`
+	Error     string          `json:"error"`
+	Retries   int             `json:"retries"`
+	CreatedAt time.Time       `json:"created_at"`
+	LastRetry *time.Time      `json:"last_retry,omitempty"`
+}
+
+func legacyFailed(f *eventsdk.FailedEvent) legacyFailedEvent {
+	return legacyFailedEvent{
+		ID:        f.ID,
+		Type:      f.Type,
+		Source:    f.Source,
+		Data:      f.Data,
+		Error:     f.Error,
+		Retries:   f.Attempts,
+		CreatedAt: f.CreatedAt,
+		LastRetry: f.LastAttemptAt,
+	}
+}
+
+// listFailed returns the latest 100 failed events in one of statuses, or
+// in any status if none are given.
+func listFailed(ctx context.Context, statuses ...string) ([]*eventsdk.FailedEvent, error) {
+	query := `SELECT ` + eventsdk.FailedEventColumns + ` FROM failed_events`
+	var args []interface{}
+	if len(statuses) > 0 {
+		query += ` WHERE status = ANY($1)`
+		args = append(args, pq.Array(statuses))
+	}
+	rows, err := db.QueryContext(ctx, query+` ORDER BY created_at DESC LIMIT 100`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*eventsdk.FailedEvent{}
+	for rows.Next() {
+		event, err := eventsdk.ScanFailedEvent(rows)
+		if err != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// eventsHandler serves GET /events in its original shape. Events that were
+// published again or resolved used to leave the table, so they are left
+// out unless status asks for them.
 func eventsHandler(w http.ResponseWriter, r *http.Request) {
 	if db == nil {
 		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
@@ -288,40 +293,43 @@ func eventsHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	rows, err := db.QueryContext(ctx, `
-		SELECT id, type, source, data, error, retries, created_at, last_retry
-		FROM failed_events
-		ORDER BY created_at DESC LIMIT 100
-	`)
+	statuses := []string{eventsdk.RetryPending, eventsdk.RetryGaveUp}
+	if status := r.URL.Query().Get("status"); status != "" {
+		statuses = []string{status}
+	}
+	events, err := listFailed(ctx, statuses...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var events []map[string]interface{}
-	for rows.Next() {
-		var event FailedEvent
-		var lastRetry sql.NullTime
+	var out []legacyFailedEvent
+	for _, event := range events {
+		out = append(out, legacyFailed(event))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
 
-		if err := rows.Scan(&event.ID, &event.Type, &event.Source, &event.Data, &event.Error, &event.Retries, &event.CreatedAt, &lastRetry); err != nil {
-			continue
-		}
+// eventsV2Handler serves GET /v2/events?status=: failed events in every
+// status with their retry state.
+func eventsV2Handler(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return
+	}
 
-		eventMap := map[string]interface{}{
-			"id":         event.ID,
-			"type":       event.Type,
-			"source":     event.Source,
-			"data":       event.Data,
-			"error":      event.Error,
-			"retries":    event.Retries,
-			"created_at": event.CreatedAt,
-		}
-		if lastRetry.Valid {
-			eventMap["last_retry"] = lastRetry.Time
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-		events = append(events, eventMap)
+	var statuses []string
+	if status := r.URL.Query().Get("status"); status != "" {
+		statuses = []string{status}
+	}
+	events, err := listFailed(ctx, statuses...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -354,7 +362,7 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 
 	natsStatus := "Disconnected"
 	natsColor := ColorRed
-	if nc != nil && nc.IsConnected() {
+	if eventBus != nil && eventBus.IsConnected() {
 		natsStatus = "Connected"
 		natsColor = ColorGreen
 	}
@@ -363,7 +371,7 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 	if db != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
-		db.QueryRowContext(ctx, `SELECT COUNT(*) FROM failed_events WHERE retries < 5`).Scan(&pendingCount)
+		db.QueryRowContext(ctx, `SELECT COUNT(*) FROM failed_events WHERE status = 'pending'`).Scan(&pendingCount)
 	}
 
 	html := fmt.Sprintf(`<!DOCTYPE html>
@@ -410,6 +418,12 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 func main() {
 	logger.Log("info", "Starting event-replay service", nil)
 
+	var err error
+	if retryPolicies, err = eventsdk.LoadRetryPolicies(os.Getenv("EVENT_RETRY_POLICIES")); err != nil {
+		logger.Log("error", "Invalid retry policies", map[string]interface{}{"error": err.Error()})
+		os.Exit(1)
+	}
+
 	if err := initDB(); err != nil {
 		logger.Log("warn", "Database initialization failed, will retry", map[string]interface{}{"error": err.Error()})
 	}
@@ -423,6 +437,10 @@ func main() {
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/metrics", metricsHandler)
 	http.HandleFunc("/events", eventsHandler)
+	http.HandleFunc("/events/", eventHandler)
+	http.HandleFunc("/v2/events", eventsV2Handler)
+	http.HandleFunc("/v2/events/", eventHandler)
+	http.HandleFunc("/policies", policiesHandler)
 	http.HandleFunc("/replay", replayHandler)
 	http.HandleFunc("/", uiHandler)
 
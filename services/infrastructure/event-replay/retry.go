@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/holm/eventsdk"
+)
+
+const (
+	retryBatch   = 100
+	workerSource = "event-replay"
+)
+
+var (
+	retryPolicies eventsdk.RetryPolicies
+	eventsGivenUp uint64
+	workerID      = workerSource
+	// settledRetention is how long published, given up and resolved
+	// events are kept, from EVENT_RETRY_RETENTION
+	settledRetention = 30 * 24 * time.Hour
+)
+
+func init() {
+	if host, err := os.Hostname(); err == nil {
+		workerID = workerSource + "/" + host
+	}
+	if d, err := time.ParseDuration(os.Getenv("EVENT_RETRY_RETENTION")); err == nil && d > 0 {
+		settledRetention = d
+	}
+}
+
+// pruneSettled deletes settled events past settledRetention. Published
+// ones are kept that long in case they come back.
+func pruneSettled() {
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	n, err := eventsdk.PruneSettled(ctx, db, settledRetention)
+	if err != nil {
+		logger.Log("error", "Failed to prune settled events", map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if n > 0 {
+		logger.Log("info", "Pruned settled events", map[string]interface{}{"deleted": n, "retention": settledRetention.String()})
+	}
+}
+
+// replayEvents retries the events that are due, up to retryBatch of them.
+// Each is claimed, published and recorded in its own transaction, so other
+// replicas skip it while it is in flight and pick up the rest.
+func replayEvents() {
+	if db == nil || eventBus == nil {
+		return
+	}
+
+	for i := 0; i < retryBatch; i++ {
+		ok, err := replayNext()
+		if err != nil {
+			logger.Log("error", "Failed to retry event", map[string]interface{}{"error": err.Error()})
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// replayNext handles the next due event, reporting false if none was due.
+func replayNext() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	failed, err := eventsdk.ClaimDue(ctx, tx)
+	if err != nil || failed == nil {
+		return false, err
+	}
+	policy := retryPolicies.For(failed.Type)
+
+	if policy.Exhausted(failed.Attempts) {
+		sendErr := giveUp(ctx, failed, policy)
+		if err := eventsdk.SetRetryStatus(ctx, tx, failed.ID, eventsdk.RetryGaveUp); err != nil {
+			return false, fmt.Errorf("failed to give up on %s: %w", failed.ID, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return false, err
+		}
+		atomic.AddUint64(&eventsGivenUp, 1)
+		fields := map[string]interface{}{
+			"event_id": failed.ID, "type": failed.Type, "attempts": failed.Attempts, "policy": policy.Name, "destination": policy.GiveUp,
+		}
+		if sendErr != nil {
+			fields["error"] = sendErr.Error()
+		}
+		logger.Log("warn", "Gave up retrying event", fields)
+		settleDLQEntry(failed, policy, sendErr)
+		return true, nil
+	}
+
+	pubCtx, pubCancel := context.WithTimeout(ctx, 10*time.Second)
+	_, pubErr := eventBus.Retry(pubCtx, failed.Event())
+	pubCancel()
+
+	if err := eventsdk.RecordAttempt(ctx, tx, failed, policy, workerID, pubErr); err != nil {
+		return false, fmt.Errorf("failed to record attempt at %s: %w", failed.ID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	if pubErr != nil {
+		atomic.AddUint64(&replaysFailed, 1)
+		logger.Log("error", "Failed to replay event", map[string]interface{}{
+			"error": pubErr.Error(), "event_id": failed.ID, "attempt": failed.Attempts, "next_attempt_at": failed.NextAttemptAt,
+		})
+	} else {
+		atomic.AddUint64(&eventsReplayed, 1)
+		logger.Log("info", "Event replayed", map[string]interface{}{
+			"event_id": failed.ID, "type": failed.Type, "attempt": failed.Attempts, "policy": policy.Name,
+		})
+	}
+	return true, nil
+}
+
+// giveUp sends an exhausted event to its policy's give-up subject, if it
+// has one, as a dead letter. The subject must be stored by a stream: the
+// event-dlq entry is only discarded once JetStream has acknowledged it. The
+// dlq and discard destinations are settled in event-dlq alone.
+func giveUp(ctx context.Context, failed *eventsdk.FailedEvent, policy *eventsdk.RetryPolicy) error {
+	if policy.GiveUp == eventsdk.GiveUpDLQ || policy.GiveUp == eventsdk.GiveUpDiscard {
+		return nil
+	}
+	event := failed.Event()
+	dl, err := eventsdk.New(workerSource, eventsdk.DLQType, event.Type, eventsdk.DeadLetter{
+		Event:    event,
+		Subject:  event.NATSSubject(),
+		Consumer: workerSource,
+		Error:    failed.Error,
+		Attempts: failed.Attempts,
+		FailedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	pubCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, err = eventBus.StoreTo(pubCtx, policy.GiveUp, dl)
+	return err
+}
+
+// settleDLQEntry leaves a note on the event's open event-dlq entries, and
+// discards them if the policy says so and the event reached its give-up
+// subject. An event that could not be sent on stays open for triage.
+// event-dlq may not be deployed, so failing here only warns.
+func settleDLQEntry(failed *eventsdk.FailedEvent, policy *eventsdk.RetryPolicy, sendErr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	note := fmt.Sprintf("Gave up after %d attempts under retry policy %s", failed.Attempts, policy.Name)
+	status := ""
+	switch {
+	case policy.GiveUp == eventsdk.GiveUpDLQ:
+	case policy.GiveUp == eventsdk.GiveUpDiscard:
+		status = "discarded"
+	case sendErr != nil:
+		note += fmt.Sprintf(", could not be stored on %s: %v", policy.GiveUp, sendErr)
+	default:
+		note += ", sent to " + policy.GiveUp
+		status = "discarded"
+	}
+
+	_, err := db.ExecContext(ctx, `
+		WITH open AS (
+			UPDATE dead_letter_queue SET
+				status = COALESCE(NULLIF($2, ''), status),
+				processed = processed OR $2 <> '',
+				processed_at = CASE WHEN $2 <> '' THEN COALESCE(processed_at, NOW()) ELSE processed_at END,
+				updated_at = NOW()
+			WHERE event_id = $1 AND status IN ('new', 'investigating')
+			RETURNING id
+		)
+		INSERT INTO dead_letter_notes (dlq_id, author, status, note)
+		SELECT id, $3, NULLIF($2, ''), $4 FROM open`,
+		failed.ID, status, workerSource, note)
+	if err != nil {
+		logger.Log("warn", "Failed to update DLQ entry", map[string]interface{}{"event_id": failed.ID, "error": err.Error()})
+	}
+}
+
+// policiesHandler serves GET /policies, the retry policies in the order
+// they are matched.
+func policiesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(retryPolicies)
+}
+
+// eventHandler serves GET /events/{id} and /v2/events/{id}: a failed event
+// with every attempt made at it.
+func eventHandler(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v2"), "/events/"), "/")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	failed, err := eventsdk.ScanFailedEvent(db.QueryRowContext(ctx,
+		`SELECT `+eventsdk.FailedEventColumns+` FROM failed_events WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	attempts, err := eventsdk.RetryAttempts(ctx, db, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*eventsdk.FailedEvent
+		Attempts []eventsdk.RetryAttempt `json:"attempt_log"`
+	}{failed, attempts})
+}
@@ -0,0 +1,293 @@
+package eventsdk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// DLQSubject is where consumers send events they give up on.
+const DLQSubject = SubjectPrefix + DLQType
+
+// Client publishes and consumes events through the event-broker.
+type Client struct {
+	nc     *nats.Conn
+	js     nats.JetStreamContext
+	source string
+}
+
+// Connect connects to the broker at url. source is the CloudEvents source
+// of the events the client emits, normally the service name. The
+// connection retries in the background, so services can start before the
+// broker does.
+func Connect(url, source string, opts ...nats.Option) (*Client, error) {
+	opts = append([]nats.Option{
+		nats.Name(source),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2 * time.Second),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("eventsdk: disconnected from NATS: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Printf("eventsdk: reconnected to NATS at %s", nc.ConnectedUrl())
+		}),
+	}, opts...)
+
+	nc, err := nats.Connect(url, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
+	}
+	return &Client{nc: nc, js: js, source: source}, nil
+}
+
+// Conn is the underlying NATS connection.
+func (c *Client) Conn() *nats.Conn { return c.nc }
+
+// IsConnected reports whether the client is connected to the broker.
+func (c *Client) IsConnected() bool { return c.nc.IsConnected() }
+
+// Close drains subscriptions and closes the connection.
+func (c *Client) Close() {
+	if err := c.nc.Drain(); err != nil {
+		c.nc.Close()
+	}
+}
+
+// Publish validates e and publishes it, returning once JetStream has
+// stored it. The event ID is the JetStream message ID, so publishing the
+// same event twice within the stream's duplicate window stores it once.
+func (c *Client) Publish(ctx context.Context, e *Event) (*nats.PubAck, error) {
+	if e.Source == "" {
+		e.Source = c.source
+	}
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	return c.publish(ctx, e.NATSSubject(), e, e.ID)
+}
+
+// Emit builds an event of eventType from data and publishes it.
+func (c *Client) Emit(ctx context.Context, eventType, subject string, data interface{}) (*Event, error) {
+	e, err := New(c.source, eventType, subject, data)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Publish(ctx, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Retry publishes e again. Unlike Publish it is not deduplicated against
+// the earlier publish, so consumers see the event a second time with its
+// original ID.
+func (c *Client) Retry(ctx context.Context, e *Event) (*nats.PubAck, error) {
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	return c.publish(ctx, e.NATSSubject(), e, NewID())
+}
+
+// PublishTo sends e on subject over core NATS and waits for the broker to
+// have received it. Nothing stores the event unless a stream covers the
+// subject, so it suits subjects outside events.>, e.g. sandbox replays.
+func (c *Client) PublishTo(ctx context.Context, subject string, e *Event) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = payload
+	msg.Header.Set("Content-Type", "application/cloudevents+json")
+	if err := c.nc.PublishMsg(msg); err != nil {
+		return fmt.Errorf("failed to publish %s: %w", e.Type, err)
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+	return c.nc.FlushWithContext(ctx)
+}
+
+// StoreTo publishes e on subject through JetStream and returns once a
+// stream has stored it. Unlike PublishTo, a subject no stream covers is an
+// error rather than an event nobody may receive.
+func (c *Client) StoreTo(ctx context.Context, subject string, e *Event) (*nats.PubAck, error) {
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	return c.publish(ctx, subject, e, e.ID)
+}
+
+func (c *Client) publish(ctx context.Context, subject string, e *Event, msgID string) (*nats.PubAck, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = payload
+	msg.Header.Set("Content-Type", "application/cloudevents+json")
+	msg.Header.Set(nats.MsgIdHdr, msgID)
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+	ack, err := c.js.PublishMsg(msg, nats.Context(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish %s: %w", e.Type, err)
+	}
+	return ack, nil
+}
+
+// Handler processes one event. Returning an error redelivers the event,
+// and once MaxDeliver attempts have failed it goes to the DLQ.
+type Handler func(ctx context.Context, e *Event) error
+
+// ConsumerConfig configures Consume.
+type ConsumerConfig struct {
+	// Durable names the consumer. Replicas of a service share it, so each
+	// event is handled by one of them.
+	Durable string
+	// Subject filters the events consumed. Defaults to "events.>".
+	Subject string
+	// MaxDeliver is how many times an event is attempted. Defaults to 5.
+	MaxDeliver int
+	// Backoff is the delay before each redelivery, the last value repeating.
+	// Defaults to 1s, 5s, 30s.
+	Backoff []time.Duration
+	// AckWait is how long a handler may take. Defaults to 30s.
+	AckWait time.Duration
+}
+
+func (cfg *ConsumerConfig) defaults() {
+	if cfg.Subject == "" {
+		cfg.Subject = SubjectPrefix + ">"
+	}
+	if cfg.MaxDeliver <= 0 {
+		cfg.MaxDeliver = 5
+	}
+	if len(cfg.Backoff) == 0 {
+		cfg.Backoff = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+	}
+	if cfg.AckWait <= 0 {
+		cfg.AckWait = 30 * time.Second
+	}
+}
+
+func (cfg *ConsumerConfig) backoff(attempt int) time.Duration {
+	if attempt > len(cfg.Backoff) {
+		attempt = len(cfg.Backoff)
+	}
+	return cfg.Backoff[attempt-1]
+}
+
+// Consume delivers the events matching cfg.Subject to handler. Events that
+// cannot be parsed or fail validation go straight to the DLQ; events the
+// handler fails are retried with backoff and sent to the DLQ after
+// cfg.MaxDeliver attempts.
+func (c *Client) Consume(ctx context.Context, cfg ConsumerConfig, handler Handler) (*nats.Subscription, error) {
+	if cfg.Durable == "" {
+		return nil, errors.New("consumer needs a durable name")
+	}
+	cfg.defaults()
+
+	return c.js.QueueSubscribe(cfg.Subject, cfg.Durable, func(msg *nats.Msg) {
+		c.handle(ctx, &cfg, msg, handler)
+	},
+		nats.Durable(cfg.Durable),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.DeliverAll(),
+		nats.MaxDeliver(cfg.MaxDeliver+1), // One spare delivery in case the DLQ publish fails
+		nats.AckWait(cfg.AckWait),
+	)
+}
+
+func (c *Client) handle(ctx context.Context, cfg *ConsumerConfig, msg *nats.Msg, handler Handler) {
+	attempts := 1
+	if meta, err := msg.Metadata(); err == nil {
+		attempts = int(meta.NumDelivered)
+	}
+
+	e, err := ParseMsg(msg)
+	if err == nil {
+		err = e.Validate()
+	}
+	if err != nil {
+		c.deadLetter(ctx, cfg, msg, e, err, attempts)
+		return
+	}
+
+	if err := handler(ctx, e); err != nil {
+		if attempts < cfg.MaxDeliver {
+			msg.NakWithDelay(cfg.backoff(attempts))
+			return
+		}
+		c.deadLetter(ctx, cfg, msg, e, err, attempts)
+		return
+	}
+	msg.Ack()
+}
+
+func (c *Client) deadLetter(ctx context.Context, cfg *ConsumerConfig, msg *nats.Msg, e *Event, cause error, attempts int) {
+	// A DLQ event that cannot be handled has nowhere left to go
+	if msg.Subject == DLQSubject {
+		log.Printf("eventsdk: %s dropping dead letter after %d attempts: %v", cfg.Durable, attempts, cause)
+		msg.Term()
+		return
+	}
+
+	dl := DeadLetter{
+		Event:    e,
+		Subject:  msg.Subject,
+		Consumer: cfg.Durable,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now().UTC(),
+	}
+	if e == nil {
+		if json.Valid(msg.Data) {
+			dl.Raw = json.RawMessage(msg.Data)
+		} else {
+			raw, _ := json.Marshal(string(msg.Data))
+			dl.Raw = raw
+		}
+	}
+
+	subject := ""
+	if e != nil {
+		subject = e.Type
+	}
+	dlq, err := New(c.source, DLQType, subject, dl)
+	if err == nil {
+		_, err = c.Publish(ctx, dlq)
+	}
+	if err != nil {
+		log.Printf("eventsdk: %s failed to dead-letter message on %s: %v", cfg.Durable, msg.Subject, err)
+		msg.NakWithDelay(cfg.backoff(attempts))
+		return
+	}
+	msg.Ack()
+}
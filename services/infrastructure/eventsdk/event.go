@@ -0,0 +1,191 @@
+// Package eventsdk is how HolmOS services publish and consume events. Every
+// event travels as a CloudEvents 1.0 envelope in structured JSON mode on
+// the NATS subject "events.<type>", which the event-broker's EVENTS stream
+// keeps. Publishing waits for JetStream to confirm the event is stored, and
+// consumers that fail an event too many times hand it to the dead letter
+// queue on events.dlq instead of dropping it.
+package eventsdk
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	SpecVersion     = "1.0"
+	ContentTypeJSON = "application/json"
+
+	// SubjectPrefix is prepended to an event's type to get its NATS subject.
+	SubjectPrefix = "events."
+
+	// DLQType is the type of the events the dead letter queue receives.
+	DLQType = "dlq"
+)
+
+// Types are dot-separated lowercase tokens, e.g. files.created, so they can
+// be used as NATS subjects.
+var typePattern = regexp.MustCompile(`^[a-z0-9_-]+(\.[a-z0-9_-]+)*$`)
+
+// Event is a CloudEvents 1.0 envelope.
+type Event struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	DataSchema      string          `json:"dataschema,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+}
+
+// DeadLetter is the data of a DLQType event: the event a consumer gave up
+// on and why.
+type DeadLetter struct {
+	Event    *Event          `json:"event,omitempty"` // Nil if the message could not be parsed
+	Raw      json.RawMessage `json:"raw,omitempty"`   // The message, when Event is nil
+	Subject  string          `json:"subject"`         // NATS subject it arrived on
+	Consumer string          `json:"consumer"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	FailedAt time.Time       `json:"failed_at"`
+}
+
+// New builds an event of eventType from source, with data marshalled to
+// JSON. subject is the CloudEvents subject, e.g. a file path or pod name,
+// and may be empty.
+func New(source, eventType, subject string, data interface{}) (*Event, error) {
+	e := &Event{
+		SpecVersion:     SpecVersion,
+		ID:              NewID(),
+		Source:          source,
+		Type:            eventType,
+		Subject:         subject,
+		Time:            time.Now().UTC(),
+		DataContentType: ContentTypeJSON,
+	}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal data: %w", err)
+		}
+		e.Data = raw
+	}
+	return e, e.Validate()
+}
+
+// NewID returns a random UUID.
+func NewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// NATSSubject is the subject the event is published on.
+func (e *Event) NATSSubject() string {
+	return SubjectPrefix + e.Type
+}
+
+// Validate checks the required attributes and, if one is registered, the
+// data against the schema for the event's type.
+func (e *Event) Validate() error {
+	var missing []string
+	if e.SpecVersion == "" {
+		missing = append(missing, "specversion")
+	}
+	if e.ID == "" {
+		missing = append(missing, "id")
+	}
+	if e.Source == "" {
+		missing = append(missing, "source")
+	}
+	if e.Type == "" {
+		missing = append(missing, "type")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("event is missing %s", strings.Join(missing, ", "))
+	}
+	if e.SpecVersion != SpecVersion {
+		return fmt.Errorf("unsupported specversion %q", e.SpecVersion)
+	}
+	if !typePattern.MatchString(e.Type) {
+		return fmt.Errorf("invalid event type %q", e.Type)
+	}
+	return validateData(e)
+}
+
+// DataAs unmarshals the event's data into v.
+func (e *Event) DataAs(v interface{}) error {
+	if len(e.Data) == 0 {
+		return errors.New("event has no data")
+	}
+	return json.Unmarshal(e.Data, v)
+}
+
+// Parse reads an event from a NATS message. Messages from publishers that
+// predate the envelope ({"id", "type", "source", "data", "timestamp"}, or
+// any other JSON) are wrapped in one, taking the type from the subject
+// when they do not carry it.
+func Parse(subject string, payload []byte) (*Event, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return nil, fmt.Errorf("event is not a JSON object: %w", err)
+	}
+
+	if _, ok := probe["specversion"]; ok {
+		var e Event
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return nil, fmt.Errorf("invalid event: %w", err)
+		}
+		return &e, nil
+	}
+
+	var legacy struct {
+		ID        string          `json:"id"`
+		Type      string          `json:"type"`
+		Source    string          `json:"source"`
+		Data      json.RawMessage `json:"data"`
+		Timestamp time.Time       `json:"timestamp"`
+	}
+	json.Unmarshal(payload, &legacy)
+
+	e := &Event{
+		SpecVersion:     SpecVersion,
+		ID:              legacy.ID,
+		Source:          legacy.Source,
+		Type:            legacy.Type,
+		Time:            legacy.Timestamp,
+		DataContentType: ContentTypeJSON,
+		Data:            legacy.Data,
+	}
+	if e.ID == "" {
+		e.ID = NewID()
+	}
+	if e.Source == "" {
+		e.Source = "unknown"
+	}
+	if e.Type == "" {
+		e.Type = strings.TrimPrefix(subject, SubjectPrefix)
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if len(e.Data) == 0 {
+		e.Data = json.RawMessage(payload)
+	}
+	return e, nil
+}
+
+// ParseMsg is Parse for a received message.
+func ParseMsg(msg *nats.Msg) (*Event, error) {
+	return Parse(msg.Subject, msg.Data)
+}
@@ -0,0 +1,487 @@
+package eventsdk
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Events that reach the DLQ are retried from the failed_events table:
+// event-dlq records each failure there and event-replay works through the
+// rows that are due, publishing each event again under the retry policy
+// for its type. Rows are claimed with FOR UPDATE SKIP LOCKED, so any number
+// of replay replicas can run without publishing an event twice, and every
+// attempt's outcome goes into failed_event_attempts.
+
+// Retry statuses. A published retry waits to see whether its consumers
+// fail it again, in which case event-dlq makes it pending once more.
+const (
+	RetryPending   = "pending"
+	RetryPublished = "published"
+	RetryGaveUp    = "gave_up"
+	RetryResolved  = "resolved" // Settled by hand in event-dlq
+)
+
+// Attempt outcomes.
+const (
+	OutcomePublished     = "published"      // Published; nothing has come back yet
+	OutcomePublishFailed = "publish_failed" // Could not reach the broker
+	OutcomeFailed        = "failed"         // Published, then dead-lettered again
+)
+
+// Give-up destinations other than a subject.
+const (
+	GiveUpDLQ     = "dlq"     // Leave it in event-dlq for triage
+	GiveUpDiscard = "discard" // Discard the DLQ entry
+)
+
+// DefaultRetryPolicy is the policy named "default", which applies to types
+// no other policy matches unless the config sets its own.
+const DefaultRetryPolicy = "default"
+
+// RetryPolicy says how events of some types are retried. Types are NATS
+// patterns over the event type, e.g. "payments.>"; the first policy that
+// matches wins. The delay before attempt n+1 is Backoff * Multiplier^n,
+// capped at MaxBackoff and spread by ±Jitter of itself.
+type RetryPolicy struct {
+	Name        string   `json:"name"`
+	Types       []string `json:"types,omitempty"`
+	MaxAttempts int      `json:"max_attempts"`
+	Backoff     string   `json:"backoff"`
+	MaxBackoff  string   `json:"max_backoff,omitempty"`
+	Multiplier  float64  `json:"multiplier,omitempty"`
+	Jitter      float64  `json:"jitter,omitempty"`  // Fraction of the delay, 0 to 1
+	GiveUp      string   `json:"give_up,omitempty"` // dlq, discard, or a subject to send the dead letter to
+
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// RetryPolicies are the policies in the order they are matched, the
+// default one last.
+type RetryPolicies []*RetryPolicy
+
+// LoadRetryPolicies parses a JSON list of RetryPolicy, as services read it
+// from EVENT_RETRY_POLICIES. An empty string gives just the default policy:
+// 5 attempts from 30s doubling to 1h with 20% jitter, then left in the DLQ.
+func LoadRetryPolicies(raw string) (RetryPolicies, error) {
+	var policies RetryPolicies
+	if strings.TrimSpace(raw) != "" {
+		if err := json.Unmarshal([]byte(raw), &policies); err != nil {
+			return nil, fmt.Errorf("invalid retry policies: %w", err)
+		}
+	}
+
+	var def *RetryPolicy
+	seen := map[string]bool{}
+	out := make(RetryPolicies, 0, len(policies)+1)
+	for _, p := range policies {
+		if p.Name == "" || seen[p.Name] {
+			return nil, fmt.Errorf("retry policies need unique names, got %q", p.Name)
+		}
+		seen[p.Name] = true
+		if err := p.compile(); err != nil {
+			return nil, fmt.Errorf("retry policy %s: %w", p.Name, err)
+		}
+		if p.Name == DefaultRetryPolicy {
+			def = p
+			continue
+		}
+		if len(p.Types) == 0 {
+			return nil, fmt.Errorf("retry policy %s: types are required", p.Name)
+		}
+		out = append(out, p)
+	}
+	if def == nil {
+		def = &RetryPolicy{Name: DefaultRetryPolicy, MaxAttempts: 5, Backoff: "30s", MaxBackoff: "1h", Multiplier: 2, Jitter: 0.2}
+		def.compile()
+	}
+	return append(out, def), nil
+}
+
+func (p *RetryPolicy) compile() error {
+	if p.MaxAttempts <= 0 {
+		return errors.New("max_attempts must be positive")
+	}
+	if p.Backoff == "" {
+		p.Backoff = "30s"
+	}
+	d, err := time.ParseDuration(p.Backoff)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid backoff %q", p.Backoff)
+	}
+	p.backoff = d
+
+	p.maxBackoff = 0
+	if p.MaxBackoff != "" {
+		d, err := time.ParseDuration(p.MaxBackoff)
+		if err != nil || d < p.backoff {
+			return fmt.Errorf("invalid max_backoff %q", p.MaxBackoff)
+		}
+		p.maxBackoff = d
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = 2
+	}
+	if p.Multiplier < 1 {
+		return errors.New("multiplier must be at least 1")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("jitter must be between 0 and 1")
+	}
+
+	switch p.GiveUp {
+	case "":
+		p.GiveUp = GiveUpDLQ
+	case GiveUpDLQ, GiveUpDiscard:
+	default:
+		// Anything under events.> would come straight back round
+		if !typePattern.MatchString(p.GiveUp) || strings.HasPrefix(p.GiveUp, SubjectPrefix) {
+			return fmt.Errorf("give_up must be dlq, discard or a subject outside %s>, got %q", SubjectPrefix, p.GiveUp)
+		}
+	}
+	for _, t := range p.Types {
+		if !patternValid(t) {
+			return fmt.Errorf("invalid type pattern %q", t)
+		}
+	}
+	return nil
+}
+
+// For returns the policy for eventType.
+func (ps RetryPolicies) For(eventType string) *RetryPolicy {
+	for _, p := range ps {
+		for _, t := range p.Types {
+			if patternMatches(t, eventType) {
+				return p
+			}
+		}
+	}
+	return ps[len(ps)-1]
+}
+
+// Delay is how long to wait after the given number of attempts before the
+// next one.
+func (p *RetryPolicy) Delay(attempts int) time.Duration {
+	d := float64(p.backoff) * math.Pow(p.Multiplier, float64(attempts))
+	if p.maxBackoff > 0 && d > float64(p.maxBackoff) {
+		d = float64(p.maxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if d > float64(math.MaxInt64) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// Exhausted reports whether an event that has been attempted attempts
+// times should be given up on.
+func (p *RetryPolicy) Exhausted(attempts int) bool {
+	return attempts >= p.MaxAttempts
+}
+
+// patternValid and patternMatches treat pattern as a NATS subject: "*"
+// matches one token and a trailing ">" one or more.
+func patternValid(pattern string) bool {
+	tokens := strings.Split(pattern, ".")
+	for i, t := range tokens {
+		if t == "" || (t == ">" && i != len(tokens)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+func patternMatches(pattern, eventType string) bool {
+	pt := strings.Split(pattern, ".")
+	et := strings.Split(eventType, ".")
+	for i, t := range pt {
+		if t == ">" {
+			return len(et) > i
+		}
+		if i >= len(et) || (t != "*" && t != et[i]) {
+			return false
+		}
+	}
+	return len(pt) == len(et)
+}
+
+// RetrySchema creates the retry tables, or brings a failed_events table
+// from before retry policies up to date. retries counts attempts.
+const RetrySchema = `
+	CREATE TABLE IF NOT EXISTS failed_events (
+		id VARCHAR(255) PRIMARY KEY,
+		type VARCHAR(255) NOT NULL,
+		source VARCHAR(255) NOT NULL,
+		data JSONB,
+		error TEXT,
+		retries INT DEFAULT 0,
+		created_at TIMESTAMPTZ DEFAULT NOW(),
+		last_retry TIMESTAMPTZ
+	);
+	ALTER TABLE failed_events ADD COLUMN IF NOT EXISTS envelope JSONB;
+	ALTER TABLE failed_events ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'pending';
+	ALTER TABLE failed_events ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+	ALTER TABLE failed_events ADD COLUMN IF NOT EXISTS policy VARCHAR(64);
+	ALTER TABLE failed_events ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+	DROP INDEX IF EXISTS idx_failed_events_retries;
+	CREATE INDEX IF NOT EXISTS idx_failed_events_due ON failed_events(next_attempt_at) WHERE status = 'pending';
+
+	CREATE TABLE IF NOT EXISTS failed_event_attempts (
+		id BIGSERIAL PRIMARY KEY,
+		event_id VARCHAR(255) NOT NULL REFERENCES failed_events(id) ON DELETE CASCADE,
+		attempt INT NOT NULL,
+		worker VARCHAR(255),
+		outcome VARCHAR(20) NOT NULL,
+		error TEXT,
+		attempted_at TIMESTAMPTZ DEFAULT NOW(),
+		settled_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS idx_failed_event_attempts_event ON failed_event_attempts(event_id, id);
+`
+
+// InitRetrySchema applies RetrySchema. Both services run it at startup;
+// every statement in it is safe to repeat.
+func InitRetrySchema(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, RetrySchema)
+	return err
+}
+
+// FailedEvent is a row of failed_events.
+type FailedEvent struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	Source        string          `json:"source"`
+	Data          json.RawMessage `json:"data,omitempty"`
+	Error         string          `json:"error"`
+	Attempts      int             `json:"attempts"`
+	Status        string          `json:"status"`
+	Policy        string          `json:"policy,omitempty"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	LastAttemptAt *time.Time      `json:"last_attempt_at,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Envelope      []byte          `json:"-"`
+}
+
+// RetryAttempt is a row of failed_event_attempts.
+type RetryAttempt struct {
+	Attempt     int        `json:"attempt"`
+	Worker      string     `json:"worker,omitempty"`
+	Outcome     string     `json:"outcome"`
+	Error       string     `json:"error,omitempty"`
+	AttemptedAt time.Time  `json:"attempted_at"`
+	SettledAt   *time.Time `json:"settled_at,omitempty"`
+}
+
+// FailedEventColumns are the columns ScanFailedEvent reads, in order.
+const FailedEventColumns = `id, type, source, data, COALESCE(error, ''), COALESCE(retries, 0), status, COALESCE(policy, ''),
+	next_attempt_at, last_retry, created_at, envelope`
+
+// ScanFailedEvent scans a row selected with FailedEventColumns.
+func ScanFailedEvent(row interface{ Scan(...interface{}) error }) (*FailedEvent, error) {
+	var f FailedEvent
+	var data []byte
+	var last sql.NullTime
+	err := row.Scan(&f.ID, &f.Type, &f.Source, &data, &f.Error, &f.Attempts, &f.Status, &f.Policy,
+		&f.NextAttemptAt, &last, &f.CreatedAt, &f.Envelope)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		f.Data = data
+	}
+	if last.Valid {
+		f.LastAttemptAt = &last.Time
+	}
+	return &f, nil
+}
+
+// Event is the event to publish: the envelope the DLQ stored, or one built
+// from the row for events that failed before the DLQ kept envelopes.
+func (f *FailedEvent) Event() *Event {
+	var event Event
+	if len(f.Envelope) > 0 && json.Unmarshal(f.Envelope, &event) == nil {
+		return &event
+	}
+	return &Event{
+		SpecVersion:     SpecVersion,
+		ID:              f.ID,
+		Source:          f.Source,
+		Type:            f.Type,
+		Time:            f.CreatedAt,
+		DataContentType: ContentTypeJSON,
+		Data:            f.Data,
+	}
+}
+
+// RecordFailure records that e was dead-lettered with errMsg. A new event
+// is scheduled for its first retry. One that was already being retried has
+// its last attempt marked failed and is scheduled for the next, or for
+// giving up straight away if its policy is exhausted; one that had been
+// given up on or resolved starts over.
+func (ps RetryPolicies) RecordFailure(ctx context.Context, db *sql.DB, e *Event, errMsg string) error {
+	data := []byte(e.Data)
+	if !json.Valid(data) {
+		data, _ = json.Marshal(string(e.Data))
+	}
+	envelope, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	policy := ps.For(e.Type)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var attempts int
+	var status string
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(retries, 0), status FROM failed_events WHERE id = $1 FOR UPDATE`, e.ID).
+		Scan(&attempts, &status)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO failed_events (id, type, source, data, error, envelope, status, policy, next_attempt_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, 'pending', $7, $8, NOW())
+			ON CONFLICT (id) DO NOTHING`,
+			e.ID, e.Type, e.Source, data, errMsg, envelope, policy.Name, time.Now().Add(policy.Delay(0)))
+	case err == nil:
+		if status == RetryGaveUp || status == RetryResolved {
+			attempts = 0
+		}
+		if status == RetryPublished {
+			_, err = tx.ExecContext(ctx, `
+				UPDATE failed_event_attempts SET outcome = $2, error = $3, settled_at = NOW()
+				WHERE id = (SELECT MAX(id) FROM failed_event_attempts WHERE event_id = $1) AND outcome = $4`,
+				e.ID, OutcomeFailed, errMsg, OutcomePublished)
+			if err != nil {
+				return err
+			}
+		}
+		next := time.Now()
+		if !policy.Exhausted(attempts) {
+			next = next.Add(policy.Delay(attempts))
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE failed_events SET error = $2, envelope = $3, data = $4, retries = $5, status = 'pending',
+				policy = $6, next_attempt_at = $7, updated_at = NOW()
+			WHERE id = $1`,
+			e.ID, errMsg, envelope, data, attempts, policy.Name, next)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClaimDue locks the pending event that has been due longest, skipping
+// any another worker holds. It returns nil when nothing is due. The lock
+// lasts until tx ends, so callers publish and record the outcome in tx.
+func ClaimDue(ctx context.Context, tx *sql.Tx) (*FailedEvent, error) {
+	f, err := ScanFailedEvent(tx.QueryRowContext(ctx, `
+		SELECT `+FailedEventColumns+` FROM failed_events
+		WHERE status = 'pending' AND next_attempt_at <= NOW()
+		ORDER BY next_attempt_at LIMIT 1
+		FOR UPDATE SKIP LOCKED`))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return f, err
+}
+
+// LockFailedEvent locks the row for id whatever its status, waiting for a
+// worker that holds it. It returns sql.ErrNoRows if there is none.
+func LockFailedEvent(ctx context.Context, tx *sql.Tx, id string) (*FailedEvent, error) {
+	return ScanFailedEvent(tx.QueryRowContext(ctx,
+		`SELECT `+FailedEventColumns+` FROM failed_events WHERE id = $1 FOR UPDATE`, id))
+}
+
+// RecordAttempt records an attempt to publish f made by worker, which
+// failed if publishErr is set. A failed publish is rescheduled under
+// policy; a successful one waits to see if it comes back.
+func RecordAttempt(ctx context.Context, tx *sql.Tx, f *FailedEvent, policy *RetryPolicy, worker string, publishErr error) error {
+	f.Attempts++
+	outcome, errMsg, settled := OutcomePublished, "", interface{}(nil)
+	f.Status = RetryPublished
+	if publishErr != nil {
+		outcome, errMsg, settled = OutcomePublishFailed, publishErr.Error(), time.Now()
+		f.Status = RetryPending
+		f.NextAttemptAt = time.Now()
+		if !policy.Exhausted(f.Attempts) {
+			f.NextAttemptAt = f.NextAttemptAt.Add(policy.Delay(f.Attempts))
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO failed_event_attempts (event_id, attempt, worker, outcome, error, settled_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)`,
+		f.ID, f.Attempts, worker, outcome, errMsg, settled)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE failed_events SET retries = $2, status = $3, next_attempt_at = $4, policy = $5,
+			last_retry = NOW(), updated_at = NOW()
+		WHERE id = $1`,
+		f.ID, f.Attempts, f.Status, f.NextAttemptAt, policy.Name)
+	return err
+}
+
+// SetRetryStatus moves the row for id to status, e.g. RetryGaveUp once a
+// worker has sent it to its give-up destination or RetryResolved when it
+// is settled by hand.
+func SetRetryStatus(ctx context.Context, ex interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+}, id, status string) error {
+	_, err := ex.ExecContext(ctx, `UPDATE failed_events SET status = $2, updated_at = NOW() WHERE id = $1`, id, status)
+	return err
+}
+
+// PruneSettled deletes the events that were published, given up on or
+// resolved more than age ago, with their attempts, and returns how many it
+// deleted. An event dead-lettered again after that starts over.
+func PruneSettled(ctx context.Context, db *sql.DB, age time.Duration) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM failed_events
+		WHERE status <> $1 AND COALESCE(updated_at, created_at) < $2`,
+		RetryPending, time.Now().Add(-age))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// RetryAttempts returns the attempts made at the event id, oldest first.
+func RetryAttempts(ctx context.Context, db *sql.DB, id string) ([]RetryAttempt, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT attempt, COALESCE(worker, ''), outcome, COALESCE(error, ''), attempted_at, settled_at
+		FROM failed_event_attempts WHERE event_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []RetryAttempt{}
+	for rows.Next() {
+		var a RetryAttempt
+		var settled sql.NullTime
+		if err := rows.Scan(&a.Attempt, &a.Worker, &a.Outcome, &a.Error, &a.AttemptedAt, &settled); err != nil {
+			return nil, err
+		}
+		if settled.Valid {
+			a.SettledAt = &settled.Time
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
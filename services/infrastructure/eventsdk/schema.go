@@ -0,0 +1,113 @@
+package eventsdk
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Schema describes the data of one event type: the fields it must have
+// and the JSON type of each field it may have. It covers what our events
+// need from JSON Schema and no more.
+type Schema struct {
+	Required   []string          `json:"required,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"` // string, number, integer, boolean, object, array
+}
+
+var (
+	schemasMu sync.RWMutex
+	schemas   = map[string]Schema{
+		DLQType: {
+			Required: []string{"subject", "consumer", "error", "attempts"},
+			Properties: map[string]string{
+				"event":     "object",
+				"subject":   "string",
+				"consumer":  "string",
+				"error":     "string",
+				"attempts":  "integer",
+				"failed_at": "string",
+			},
+		},
+	}
+)
+
+// RegisterSchema sets the schema events of eventType are validated against
+// when they are published and consumed.
+func RegisterSchema(eventType string, s Schema) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	schemas[eventType] = s
+}
+
+// Schemas returns the registered schemas by event type.
+func Schemas() map[string]Schema {
+	schemasMu.RLock()
+	defer schemasMu.RUnlock()
+
+	out := make(map[string]Schema, len(schemas))
+	for t, s := range schemas {
+		out[t] = s
+	}
+	return out
+}
+
+func validateData(e *Event) error {
+	schemasMu.RLock()
+	s, ok := schemas[e.Type]
+	schemasMu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	var data map[string]interface{}
+	if len(e.Data) == 0 || json.Unmarshal(e.Data, &data) != nil || data == nil {
+		return fmt.Errorf("%s event data must be a JSON object", e.Type)
+	}
+	for _, field := range s.Required {
+		if _, ok := data[field]; !ok {
+			return fmt.Errorf("%s event data is missing %q", e.Type, field)
+		}
+	}
+
+	fields := make([]string, 0, len(s.Properties))
+	for field := range s.Properties {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		v, ok := data[field]
+		if !ok || v == nil {
+			continue
+		}
+		if want := s.Properties[field]; !isJSONType(v, want) {
+			return fmt.Errorf("%s event field %q must be %s", e.Type, field, want)
+		}
+	}
+	return nil
+}
+
+func isJSONType(v interface{}, want string) bool {
+	switch want {
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == float64(int64(f))
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	default:
+		return true
+	}
+}
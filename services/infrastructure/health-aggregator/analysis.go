@@ -0,0 +1,192 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Roles of a failing component
+const (
+	RoleRootCause = "root_cause"
+	RoleSymptom   = "symptom"
+)
+
+// RootCause is a failing component none of whose dependencies are failing,
+// with what is failing because of it.
+type RootCause struct {
+	Component string   `json:"component"`
+	Status    string   `json:"status"`
+	Message   string   `json:"message,omitempty"`
+	Impacted  []string `json:"impacted"`
+	// Chains run from an impacted component down to this one, e.g.
+	// gateway, auth-gateway, postgres
+	Chains [][]string `json:"chains,omitempty"`
+}
+
+// OverallStatus is the aggregate view: one status, and why.
+type OverallStatus struct {
+	Status     string         `json:"status"`
+	Summary    string         `json:"summary"`
+	RootCauses []*RootCause   `json:"root_causes"`
+	Counts     map[string]int `json:"counts"`
+	CheckedAt  time.Time      `json:"checked_at"`
+}
+
+func failing(h *ServiceHealth) bool {
+	return h != nil && (h.Status == StatusDegraded || h.Status == StatusUnhealthy)
+}
+
+// analyze marks each failing component in results as a root cause or a
+// symptom and works out the overall status. Components missing from results
+// have not been checked yet and count as unknown.
+func analyze(t *Topology, results map[string]*ServiceHealth) *OverallStatus {
+	// failingDeps lists the dependencies of name that are failing
+	failingDeps := func(name string) []string {
+		var out []string
+		for _, dep := range t.component(name).DependsOn {
+			if failing(results[dep]) {
+				out = append(out, dep)
+			}
+		}
+		return out
+	}
+
+	overall := &OverallStatus{
+		Status:     StatusHealthy,
+		RootCauses: []*RootCause{},
+		Counts:     map[string]int{},
+		CheckedAt:  time.Now(),
+	}
+	roots := map[string]*RootCause{}
+
+	for _, c := range t.Components {
+		h := results[c.Name]
+		if h == nil {
+			overall.Counts[StatusUnknown]++
+			continue
+		}
+		overall.Counts[h.Status]++
+		h.Role, h.CausedBy, h.Chain = "", nil, nil
+		if !failing(h) {
+			continue
+		}
+
+		switch {
+		case c.Critical && h.Status == StatusUnhealthy:
+			overall.Status = StatusUnhealthy
+		default:
+			overall.Status = worse(overall.Status, StatusDegraded)
+		}
+
+		if len(failingDeps(c.Name)) == 0 {
+			h.Role = RoleRootCause
+			roots[c.Name] = &RootCause{Component: c.Name, Status: h.Status, Message: h.Message, Impacted: []string{}}
+			continue
+		}
+		h.Role = RoleSymptom
+	}
+
+	// Walk each symptom's failing dependencies breadth first: the failing
+	// components with no failing dependencies of their own are its causes,
+	// and the first one reached gives the shortest chain.
+	for _, c := range t.Components {
+		h := results[c.Name]
+		if h == nil || h.Role != RoleSymptom {
+			continue
+		}
+		parent := map[string]string{c.Name: ""}
+		queue := []string{c.Name}
+		for len(queue) > 0 {
+			name := queue[0]
+			queue = queue[1:]
+			for _, dep := range failingDeps(name) {
+				if _, seen := parent[dep]; seen {
+					continue
+				}
+				parent[dep] = name
+				queue = append(queue, dep)
+				if root := roots[dep]; root != nil {
+					chain := chainTo(parent, dep)
+					if h.Chain == nil {
+						h.Chain = chain
+					}
+					h.CausedBy = append(h.CausedBy, dep)
+					root.Impacted = append(root.Impacted, c.Name)
+					root.Chains = append(root.Chains, chain)
+				}
+			}
+		}
+		sort.Strings(h.CausedBy)
+	}
+
+	for _, c := range t.Components {
+		root := roots[c.Name]
+		if root == nil {
+			continue
+		}
+		sort.Strings(root.Impacted)
+		root.Chains = longestChains(root.Chains)
+		overall.RootCauses = append(overall.RootCauses, root)
+	}
+	overall.Summary = summarize(overall)
+	return overall
+}
+
+// chainTo follows parent links back from name to where the walk started,
+// giving the path from there to name.
+func chainTo(parent map[string]string, name string) []string {
+	var chain []string
+	for ; name != ""; name = parent[name] {
+		chain = append([]string{name}, chain...)
+	}
+	return chain
+}
+
+// longestChains drops chains that are the tail of a longer one:
+// auth-gateway, postgres says nothing gateway, auth-gateway, postgres
+// doesn't.
+func longestChains(chains [][]string) [][]string {
+	var out [][]string
+	for i, c := range chains {
+		covered := false
+		for j, other := range chains {
+			if i != j && len(other) > len(c) && isSuffix(c, other) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.Join(out[i], " ") < strings.Join(out[j], " ")
+	})
+	return out
+}
+
+func isSuffix(short, long []string) bool {
+	offset := len(long) - len(short)
+	for i := range short {
+		if short[i] != long[offset+i] {
+			return false
+		}
+	}
+	return true
+}
+
+func summarize(o *OverallStatus) string {
+	if len(o.RootCauses) == 0 {
+		return "All systems operational"
+	}
+	var parts []string
+	for _, rc := range o.RootCauses {
+		part := rc.Component + " " + rc.Status
+		if n := len(rc.Impacted); n > 0 {
+			part += ", affecting " + strings.Join(rc.Impacted, ", ")
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "; ")
+}
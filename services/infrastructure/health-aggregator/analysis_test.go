@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	topo := &Topology{Components: []*Component{
+		{Name: "postgres", Critical: true},
+		{Name: "event-broker", Critical: true},
+		{Name: "auth-gateway", Critical: true, DependsOn: []string{"postgres"}},
+		{Name: "gateway", Critical: true, DependsOn: []string{"auth-gateway"}},
+		{Name: "event-persist", DependsOn: []string{"event-broker", "postgres"}},
+	}}
+
+	type symptom struct {
+		causedBy []string
+		chain    []string
+	}
+	tests := []struct {
+		name     string
+		statuses map[string]string // Missing components have not been checked
+		status   string
+		summary  string
+		roots    map[string][][]string // Root cause to its chains
+		symptoms map[string]symptom
+		unknown  int
+	}{
+		{
+			name: "all healthy",
+			statuses: map[string]string{
+				"postgres": StatusHealthy, "event-broker": StatusHealthy, "auth-gateway": StatusHealthy,
+				"gateway": StatusHealthy, "event-persist": StatusHealthy,
+			},
+			status:  StatusHealthy,
+			summary: "All systems operational",
+		},
+		{
+			name: "failure travels up a chain",
+			statuses: map[string]string{
+				"postgres": StatusUnhealthy, "event-broker": StatusHealthy, "auth-gateway": StatusUnhealthy,
+				"gateway": StatusUnhealthy, "event-persist": StatusDegraded,
+			},
+			status:  StatusUnhealthy,
+			summary: "postgres unhealthy, affecting auth-gateway, event-persist, gateway",
+			roots: map[string][][]string{
+				"postgres": {{"event-persist", "postgres"}, {"gateway", "auth-gateway", "postgres"}},
+			},
+			symptoms: map[string]symptom{
+				"auth-gateway":  {[]string{"postgres"}, []string{"auth-gateway", "postgres"}},
+				"gateway":       {[]string{"postgres"}, []string{"gateway", "auth-gateway", "postgres"}},
+				"event-persist": {[]string{"postgres"}, []string{"event-persist", "postgres"}},
+			},
+		},
+		{
+			name: "non-critical failure only degrades",
+			statuses: map[string]string{
+				"postgres": StatusHealthy, "event-broker": StatusHealthy, "auth-gateway": StatusHealthy,
+				"gateway": StatusHealthy, "event-persist": StatusUnhealthy,
+			},
+			status:  StatusDegraded,
+			summary: "event-persist unhealthy",
+			roots:   map[string][][]string{"event-persist": nil},
+		},
+		{
+			name: "symptom of two causes",
+			statuses: map[string]string{
+				"postgres": StatusUnhealthy, "event-broker": StatusDegraded, "auth-gateway": StatusHealthy,
+				"gateway": StatusHealthy, "event-persist": StatusUnhealthy,
+			},
+			status:  StatusUnhealthy,
+			summary: "postgres unhealthy, affecting event-persist; event-broker degraded, affecting event-persist",
+			roots: map[string][][]string{
+				"postgres":     {{"event-persist", "postgres"}},
+				"event-broker": {{"event-persist", "event-broker"}},
+			},
+			symptoms: map[string]symptom{
+				"event-persist": {[]string{"event-broker", "postgres"}, []string{"event-persist", "event-broker"}},
+			},
+		},
+		{
+			name: "unchecked components are unknown",
+			statuses: map[string]string{
+				"postgres": StatusHealthy, "event-broker": StatusHealthy,
+			},
+			status:  StatusHealthy,
+			summary: "All systems operational",
+			unknown: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := map[string]*ServiceHealth{}
+			for name, status := range tt.statuses {
+				results[name] = &ServiceHealth{Name: name, Status: status}
+			}
+			got := analyze(topo, results)
+
+			if got.Status != tt.status {
+				t.Errorf("status = %s, want %s", got.Status, tt.status)
+			}
+			if got.Summary != tt.summary {
+				t.Errorf("summary = %q, want %q", got.Summary, tt.summary)
+			}
+			if got.Counts[StatusUnknown] != tt.unknown {
+				t.Errorf("unknown = %d, want %d", got.Counts[StatusUnknown], tt.unknown)
+			}
+			roots := map[string][][]string{}
+			for _, rc := range got.RootCauses {
+				roots[rc.Component] = rc.Chains
+				if results[rc.Component].Role != RoleRootCause {
+					t.Errorf("%s role = %q, want %s", rc.Component, results[rc.Component].Role, RoleRootCause)
+				}
+			}
+			if len(roots) != len(tt.roots) || (len(roots) > 0 && !reflect.DeepEqual(roots, tt.roots)) {
+				t.Errorf("root causes = %v, want %v", roots, tt.roots)
+			}
+			for name, want := range tt.symptoms {
+				h := results[name]
+				if h.Role != RoleSymptom || !reflect.DeepEqual(h.CausedBy, want.causedBy) || !reflect.DeepEqual(h.Chain, want.chain) {
+					t.Errorf("%s = %s caused by %v via %v, want symptom caused by %v via %v",
+						name, h.Role, h.CausedBy, h.Chain, want.causedBy, want.chain)
+				}
+			}
+		})
+	}
+}
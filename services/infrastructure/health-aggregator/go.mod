@@ -1,3 +1,16 @@
 module health-aggregator
 
 go 1.22
+
+require (
+	github.com/lib/pq v1.10.9
+	github.com/nats-io/nats.go v1.33.1
+)
+
+require (
+	github.com/klauspost/compress v1.17.2 // indirect
+	github.com/nats-io/nkeys v0.4.7 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	golang.org/x/crypto v0.18.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+)
@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"html"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -46,11 +48,21 @@ func (l *Logger) Log(level, msg string, fields map[string]interface{}) {
 	json.NewEncoder(os.Stdout).Encode(entry)
 }
 
+// ServiceHealth is the last check of a component. URL and Details are the
+// first probe's target and JSON body, as reported before components had
+// several probes.
 type ServiceHealth struct {
 	Name      string                 `json:"name"`
 	URL       string                 `json:"url"`
 	Status    string                 `json:"status"`
 	Healthy   bool                   `json:"healthy"`
+	Message   string                 `json:"message,omitempty"`
+	Critical  bool                   `json:"critical"`
+	DependsOn []string               `json:"depends_on,omitempty"`
+	Role      string                 `json:"role,omitempty"`      // root_cause or symptom when failing
+	CausedBy  []string               `json:"caused_by,omitempty"` // Root causes of a symptom
+	Chain     []string               `json:"chain,omitempty"`     // Shortest path from here to one
+	Probes    []*ProbeResult         `json:"probes"`
 	Details   map[string]interface{} `json:"details,omitempty"`
 	LastCheck time.Time              `json:"last_check"`
 	Latency   time.Duration          `json:"latency_ms"`
@@ -60,66 +72,40 @@ var (
 	logger         = &Logger{}
 	requestCounter uint64
 	healthChecks   uint64
-	services       = []struct {
-		Name string
-		URL  string
-	}{
-		{"event-broker", "http://event-broker:8080/health"},
-		{"event-persist", "http://event-persist:8080/health"},
-		{"event-replay", "http://event-replay:8080/health"},
-		{"event-dlq", "http://event-dlq:8080/health"},
-		{"config-sync", "http://config-sync:8080/health"},
-	}
-	healthCache   = make(map[string]*ServiceHealth)
-	healthCacheMu sync.RWMutex
-	httpClient    = &http.Client{Timeout: 5 * time.Second}
+	topology       *Topology
+	healthCache    = make(map[string]*ServiceHealth)
+	overall        = &OverallStatus{Status: StatusUnknown, RootCauses: []*RootCause{}}
+	healthCacheMu  sync.RWMutex
+	// Probes set their own deadlines
+	httpClient = &http.Client{}
 )
 
-func checkService(name, url string) *ServiceHealth {
+// checkComponent runs a component's probes in turn. Its status is the
+// worst of theirs.
+func checkComponent(c *Component) *ServiceHealth {
 	health := &ServiceHealth{
-		Name:      name,
-		URL:       url,
-		Status:    "unknown",
-		Healthy:   false,
+		Name:      c.Name,
+		URL:       c.Probes[0].target(),
+		Status:    StatusHealthy,
+		Critical:  c.Critical,
+		DependsOn: c.DependsOn,
 		LastCheck: time.Now(),
 	}
 
 	start := time.Now()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		health.Status = "error"
-		health.Details = map[string]interface{}{"error": err.Error()}
-		return health
+	for _, p := range c.Probes {
+		result := p.run(context.Background())
+		health.Probes = append(health.Probes, result)
+		if health.Details == nil && p.Type == "http" {
+			health.Details = result.Details
+		}
+		if result.Status != StatusHealthy && health.Message == "" {
+			health.Message = fmt.Sprintf("%s %s: %s", result.Type, result.Target, result.Message)
+		}
+		health.Status = worse(health.Status, result.Status)
 	}
-
-	resp, err := httpClient.Do(req)
 	health.Latency = time.Since(start)
-
-	if err != nil {
-		health.Status = "unreachable"
-		health.Details = map[string]interface{}{"error": err.Error()}
-		return health
-	}
-	defer resp.Body.Close()
-
-	atomic.AddUint64(&healthChecks, 1)
-
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		health.Status = "healthy"
-		health.Healthy = true
-	} else if resp.StatusCode >= 500 {
-		health.Status = "unhealthy"
-	} else {
-		health.Status = "degraded"
-	}
-
-	var details map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&details); err == nil {
-		health.Details = details
-	}
+	health.Healthy = health.Status == StatusHealthy
 
 	return health
 }
@@ -129,47 +115,65 @@ func checkAllServices() map[string]*ServiceHealth {
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 
-	for _, svc := range services {
+	for _, c := range topology.Components {
 		wg.Add(1)
-		go func(name, url string) {
+		go func(c *Component) {
 			defer wg.Done()
-			health := checkService(name, url)
+			health := checkComponent(c)
 			mu.Lock()
-			results[name] = health
+			results[c.Name] = health
 			mu.Unlock()
-		}(svc.Name, svc.URL)
+		}(c)
 	}
 
 	wg.Wait()
 	return results
 }
 
+// storeResults analyzes results and makes them the cached view. results
+// must not be shared with the current cache, which readers use unlocked.
+func storeResults(results map[string]*ServiceHealth) *OverallStatus {
+	status := analyze(topology, results)
+	healthCacheMu.Lock()
+	healthCache = results
+	overall = status
+	healthCacheMu.Unlock()
+	return status
+}
+
+// mergeResult puts one component's result into the current cache and
+// re-analyzes. The lock is held throughout so a full check stored
+// meanwhile is not overwritten with the older results.
+func mergeResult(health *ServiceHealth) {
+	healthCacheMu.Lock()
+	defer healthCacheMu.Unlock()
+	results := make(map[string]*ServiceHealth, len(healthCache)+1)
+	for name, h := range healthCache {
+		copied := *h
+		results[name] = &copied
+	}
+	results[health.Name] = health
+	overall = analyze(topology, results)
+	healthCache = results
+}
+
 func startHealthChecker() {
 	go func() {
 		ticker := time.NewTicker(15 * time.Second)
 		defer ticker.Stop()
 
 		// Initial check
-		results := checkAllServices()
-		healthCacheMu.Lock()
-		healthCache = results
-		healthCacheMu.Unlock()
+		storeResults(checkAllServices())
 
 		for range ticker.C {
-			results := checkAllServices()
-			healthCacheMu.Lock()
-			healthCache = results
-			healthCacheMu.Unlock()
-
-			unhealthyCount := 0
-			for _, h := range results {
-				if !h.Healthy {
-					unhealthyCount++
-				}
-			}
-
-			if unhealthyCount > 0 {
-				logger.Log("warn", "Unhealthy services detected", map[string]interface{}{"count": unhealthyCount})
+			status := storeResults(checkAllServices())
+
+			if status.Status != StatusHealthy {
+				logger.Log("warn", "Unhealthy services detected", map[string]interface{}{
+					"status":      status.Status,
+					"summary":     status.Summary,
+					"root_causes": len(status.RootCauses),
+				})
 			}
 		}
 	}()
@@ -180,6 +184,7 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 
 	healthCacheMu.RLock()
 	cache := healthCache
+	current := overall
 	healthCacheMu.RUnlock()
 
 	allHealthy := true
@@ -194,6 +199,7 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		"service":        "health-aggregator",
 		"status":         "healthy",
 		"all_healthy":    allHealthy,
+		"overall_status": current.Status,
 		"services_count": len(cache),
 		"timestamp":      time.Now().UTC().Format(time.RFC3339),
 	}
@@ -213,6 +219,7 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 
 	healthCacheMu.RLock()
 	cache := healthCache
+	current := overall
 	healthCacheMu.RUnlock()
 
 	healthyCount := 0
@@ -229,6 +236,17 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "# TYPE health_aggregator_up gauge\n")
 	fmt.Fprintf(w, "health_aggregator_up 1\n")
 
+	fmt.Fprintf(w, "# HELP health_aggregator_overall_status Overall status: 0 healthy, 1 degraded, 2 unhealthy\n")
+	fmt.Fprintf(w, "# TYPE health_aggregator_overall_status gauge\n")
+	overallValue := 0
+	switch current.Status {
+	case StatusDegraded:
+		overallValue = 1
+	case StatusUnhealthy:
+		overallValue = 2
+	}
+	fmt.Fprintf(w, "health_aggregator_overall_status %d\n", overallValue)
+
 	fmt.Fprintf(w, "# HELP health_aggregator_services_total Total monitored services\n")
 	fmt.Fprintf(w, "# TYPE health_aggregator_services_total gauge\n")
 	fmt.Fprintf(w, "health_aggregator_services_total %d\n", len(cache))
@@ -265,6 +283,38 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	for name, h := range cache {
 		fmt.Fprintf(w, "health_aggregator_service_latency_ms{service=\"%s\"} %d\n", name, h.Latency.Milliseconds())
 	}
+
+	fmt.Fprintf(w, "# HELP health_aggregator_service_root_cause Whether the service is failing on its own account rather than a dependency's\n")
+	fmt.Fprintf(w, "# TYPE health_aggregator_service_root_cause gauge\n")
+	for name, h := range cache {
+		rootCause := 0
+		if h.Role == RoleRootCause {
+			rootCause = 1
+		}
+		fmt.Fprintf(w, "health_aggregator_service_root_cause{service=\"%s\"} %d\n", name, rootCause)
+	}
+
+	fmt.Fprintf(w, "# HELP health_aggregator_probe_healthy Probe status\n")
+	fmt.Fprintf(w, "# TYPE health_aggregator_probe_healthy gauge\n")
+	for name, h := range cache {
+		for _, p := range h.Probes {
+			healthy := 0
+			if p.Status == StatusHealthy {
+				healthy = 1
+			}
+			fmt.Fprintf(w, "health_aggregator_probe_healthy{service=\"%s\",type=\"%s\",target=\"%s\"} %d\n", name, p.Type, p.Target, healthy)
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP health_aggregator_tls_expiry_days Days until a probed certificate expires\n")
+	fmt.Fprintf(w, "# TYPE health_aggregator_tls_expiry_days gauge\n")
+	for name, h := range cache {
+		for _, p := range h.Probes {
+			if days, ok := p.Details["days_left"].(int); ok && p.Type == "tls" {
+				fmt.Fprintf(w, "health_aggregator_tls_expiry_days{service=\"%s\",target=\"%s\"} %d\n", name, p.Target, days)
+			}
+		}
+	}
 }
 
 func allHealthHandler(w http.ResponseWriter, r *http.Request) {
@@ -283,27 +333,18 @@ func checkHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Find the service URL
-	var serviceURL string
-	for _, svc := range services {
-		if svc.Name == serviceName {
-			serviceURL = svc.URL
-			break
-		}
-	}
-
-	if serviceURL == "" {
+	c := topology.component(serviceName)
+	if c == nil {
 		http.Error(w, "Service not found", http.StatusNotFound)
 		return
 	}
 
 	// Perform the health check
-	health := checkService(serviceName, serviceURL)
+	health := checkComponent(c)
 
-	// Update the cache
-	healthCacheMu.Lock()
-	healthCache[serviceName] = health
-	healthCacheMu.Unlock()
+	// Update the cache, re-analyzing since this may change what is a
+	// symptom of what
+	mergeResult(health)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(health)
@@ -316,17 +357,69 @@ func refreshHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	results := checkAllServices()
-	healthCacheMu.Lock()
-	healthCache = results
-	healthCacheMu.Unlock()
+	storeResults(results)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(results)
 }
 
+// statusHandler reports the overall status with the root causes of any
+// failures and the chains of dependencies they travelled along.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCounter, 1)
+
+	healthCacheMu.RLock()
+	current := overall
+	healthCacheMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if current.Status == StatusUnhealthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(current)
+}
+
+// topologyHandler describes the components checked and their dependencies.
+// Probe URLs may carry credentials, so only their targets are shown.
+func topologyHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCounter, 1)
+
+	type probeView struct {
+		Type     string `json:"type"`
+		Target   string `json:"target"`
+		Severity string `json:"severity"`
+	}
+	type componentView struct {
+		Name       string      `json:"name"`
+		Critical   bool        `json:"critical"`
+		DependsOn  []string    `json:"depends_on"`
+		Dependents []string    `json:"dependents"`
+		Probes     []probeView `json:"probes"`
+	}
+
+	dependents := topology.dependents()
+	views := []componentView{}
+	for _, c := range topology.Components {
+		v := componentView{
+			Name:       c.Name,
+			Critical:   c.Critical,
+			DependsOn:  append([]string{}, c.DependsOn...),
+			Dependents: append([]string{}, dependents[c.Name]...),
+		}
+		for _, p := range c.Probes {
+			v.Probes = append(v.Probes, probeView{Type: p.Type, Target: p.target(), Severity: p.Severity})
+		}
+		views = append(views, v)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"components": views})
+}
+
 func uiHandler(w http.ResponseWriter, r *http.Request) {
 	healthCacheMu.RLock()
 	cache := healthCache
+	current := overall
 	healthCacheMu.RUnlock()
 
 	healthyCount := 0
@@ -341,21 +434,36 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 
 	overallStatus := "All Systems Operational"
 	overallColor := ColorGreen
-	if unhealthyCount > 0 {
-		overallStatus = fmt.Sprintf("%d Service(s) Degraded", unhealthyCount)
+	switch current.Status {
+	case StatusDegraded:
 		overallColor = ColorYellow
-	}
-	if unhealthyCount == len(cache) {
-		overallStatus = "All Systems Down"
+	case StatusUnhealthy:
 		overallColor = ColorRed
+	case StatusUnknown:
+		overallStatus = "Checking..."
+		overallColor = ColorSubtext0
+	}
+	if len(current.RootCauses) > 0 {
+		overallStatus = fmt.Sprintf("%d Root Cause(s), %d Service(s) Failing", len(current.RootCauses), unhealthyCount)
+	}
+	causesHTML := ""
+	for _, rc := range current.RootCauses {
+		chains := ""
+		for _, chain := range rc.Chains {
+			chains += "<div>" + html.EscapeString(strings.Join(chain, " → ")) + "</div>"
+		}
+		causesHTML += fmt.Sprintf(`
+			<div class="cause"><strong>%s</strong> %s<div class="note">%s</div>%s</div>`,
+			html.EscapeString(rc.Component), rc.Status, html.EscapeString(rc.Message), chains)
 	}
 
 	servicesHTML := ""
-	for _, svc := range services {
+	for _, svc := range topology.Components {
 		h, exists := cache[svc.Name]
 		statusColor := ColorSubtext0
 		statusText := "Unknown"
 		latency := int64(0)
+		note := ""
 
 		if exists {
 			latency = h.Latency.Milliseconds()
@@ -375,20 +483,29 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 			default:
 				statusText = h.Status
 			}
+			switch h.Role {
+			case RoleRootCause:
+				note = "Root cause: " + h.Message
+			case RoleSymptom:
+				note = "Caused by " + strings.Join(h.CausedBy, ", ") + " (" + strings.Join(h.Chain, " → ") + ")"
+			}
 		}
 
 		servicesHTML += fmt.Sprintf(`
 			<div class="service">
-				<div class="service-name">%s</div>
+				<div>
+					<div class="service-name">%s</div>
+					<div class="note">%s</div>
+				</div>
 				<div class="service-status">
 					<span class="status-indicator" style="background: %s"></span>
 					%s
 					<span class="latency">%dms</span>
 				</div>
-			</div>`, svc.Name, statusColor, statusText, latency)
+			</div>`, svc.Name, html.EscapeString(note), statusColor, statusText, latency)
 	}
 
-	html := fmt.Sprintf(`<!DOCTYPE html>
+	page := fmt.Sprintf(`<!DOCTYPE html>
 <html>
 <head>
     <title>Health Aggregator</title>
@@ -411,6 +528,8 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
         .summary-label { color: %s; font-size: 0.8rem; }
         .btn { background: %s; color: %s; border: none; padding: 0.75rem 1.5rem; border-radius: 4px; cursor: pointer; margin-top: 1rem; }
         .btn:hover { opacity: 0.8; }
+        .note { color: %s; font-size: 0.8rem; margin-top: 0.25rem; }
+        .cause { text-align: left; margin-top: 1rem; }
     </style>
 </head>
 <body>
@@ -418,6 +537,7 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
         <h1>Health Aggregator</h1>
         <div class="overall">
             <div class="overall-status">%s</div>
+            %s
         </div>
         <div class="summary">
             <div class="summary-item">
@@ -443,16 +563,24 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
     </div>
 </body>
 </html>`, ColorBase, ColorText, ColorLavender, ColorMantle, overallColor, ColorCrust, ColorBlue, ColorSubtext0,
-		ColorMantle, ColorMauve, ColorSubtext0, ColorMauve, ColorBase, overallStatus,
+		ColorMantle, ColorMauve, ColorSubtext0, ColorMauve, ColorBase, ColorSubtext0, overallStatus, causesHTML,
 		ColorGreen, healthyCount, ColorRed, unhealthyCount, len(cache), ColorSubtext0, servicesHTML)
 
 	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
+	w.Write([]byte(page))
 }
 
 func main() {
 	logger.Log("info", "Starting health-aggregator service", nil)
 
+	var err error
+	topology, err = loadTopology(os.Getenv("HEALTH_TOPOLOGY"))
+	if err != nil {
+		logger.Log("error", "Invalid topology", map[string]interface{}{"error": err.Error()})
+		os.Exit(1)
+	}
+	logger.Log("info", "Topology loaded", map[string]interface{}{"components": len(topology.Components)})
+
 	startHealthChecker()
 
 	http.HandleFunc("/health", healthHandler)
@@ -460,6 +588,8 @@ func main() {
 	http.HandleFunc("/all", allHealthHandler)
 	http.HandleFunc("/check", checkHandler)
 	http.HandleFunc("/refresh", refreshHandler)
+	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc("/topology", topologyHandler)
 	http.HandleFunc("/", uiHandler)
 
 	port := os.Getenv("HTTP_PORT")
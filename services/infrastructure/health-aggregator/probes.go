@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/nats-io/nats.go"
+)
+
+// maxProbeBody caps how much of an HTTP response a probe reads.
+const maxProbeBody = 1 << 20
+
+// ProbeResult is the outcome of one probe.
+type ProbeResult struct {
+	Type      string                 `json:"type"`
+	Target    string                 `json:"target"`
+	Status    string                 `json:"status"`
+	Message   string                 `json:"message,omitempty"`
+	LatencyMs int64                  `json:"latency_ms"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// run probes once. A failure leaves the probe's severity as the status and
+// says why in Message.
+func (p *Probe) run(ctx context.Context) *ProbeResult {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	result := &ProbeResult{Type: p.Type, Target: p.target(), Status: StatusHealthy}
+	start := time.Now()
+	var err error
+	switch p.Type {
+	case "http":
+		err = p.probeHTTP(ctx, result)
+	case "tcp":
+		err = p.probeTCP(ctx)
+	case "tls":
+		err = p.probeTLS(ctx, result)
+	case "postgres":
+		err = p.probePostgres(ctx)
+	case "nats":
+		err = p.probeNATS(ctx)
+	}
+	result.LatencyMs = time.Since(start).Milliseconds()
+	atomic.AddUint64(&healthChecks, 1)
+
+	if err != nil {
+		if result.Status == StatusHealthy {
+			result.Status = p.Severity
+		}
+		result.Message = err.Error()
+	}
+	return result
+}
+
+func (p *Probe) probeHTTP(ctx context.Context, result *ProbeResult) error {
+	url, err := p.url()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+	if err != nil {
+		return fmt.Errorf("reading body: %w", err)
+	}
+
+	var decoded interface{}
+	if json.Unmarshal(body, &decoded) == nil {
+		if m, ok := decoded.(map[string]interface{}); ok {
+			result.Details = m
+		}
+	}
+
+	if p.ExpectStatus != 0 {
+		if resp.StatusCode != p.ExpectStatus {
+			return fmt.Errorf("status %d, want %d", resp.StatusCode, p.ExpectStatus)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// As before, a 4xx is taken to mean the service is up but unhappy
+		if resp.StatusCode < 500 {
+			result.Status = StatusDegraded
+		}
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if p.BodyContains != "" && !bytes.Contains(body, []byte(p.BodyContains)) {
+		return fmt.Errorf("body does not contain %q", p.BodyContains)
+	}
+	for _, path := range sortedKeys(p.JSON) {
+		got, ok := jsonPath(decoded, path)
+		if !ok {
+			return fmt.Errorf("%s missing from body", path)
+		}
+		if !reflect.DeepEqual(got, p.JSON[path]) {
+			return fmt.Errorf("%s is %v, want %v", path, got, p.JSON[path])
+		}
+	}
+	return nil
+}
+
+// jsonPath looks up a dotted path such as checks.database in decoded JSON.
+func jsonPath(v interface{}, path string) (interface{}, bool) {
+	for _, part := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func (p *Probe) probeTCP(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return fmt.Errorf("unreachable: %w", err)
+	}
+	return conn.Close()
+}
+
+// probeTLS connects and checks the certificate chain verifies and the leaf
+// certificate is not close to expiry.
+func (p *Probe) probeTLS(ctx context.Context, result *ProbeResult) error {
+	host, _, err := net.SplitHostPort(p.Address)
+	if err != nil {
+		return err
+	}
+	d := &tls.Dialer{Config: &tls.Config{ServerName: host, InsecureSkipVerify: p.Insecure}}
+	conn, err := d.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate")
+	}
+	leaf := certs[0]
+	daysLeft := int(time.Until(leaf.NotAfter).Hours() / 24)
+	result.Details = map[string]interface{}{
+		"subject":    leaf.Subject.CommonName,
+		"issuer":     leaf.Issuer.CommonName,
+		"expires_at": leaf.NotAfter.UTC().Format(time.RFC3339),
+		"days_left":  daysLeft,
+	}
+
+	switch {
+	case time.Now().After(leaf.NotAfter):
+		result.Status = StatusUnhealthy
+		return fmt.Errorf("certificate expired %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+	case daysLeft < p.WarnDays:
+		result.Status = StatusDegraded
+		return fmt.Errorf("certificate expires in %d days", daysLeft)
+	}
+	return nil
+}
+
+// Postgres pools by DSN, so probes reuse connections
+var (
+	pgPools   = map[string]*sql.DB{}
+	pgPoolsMu sync.Mutex
+)
+
+func pgPool(dsn string) (*sql.DB, error) {
+	pgPoolsMu.Lock()
+	defer pgPoolsMu.Unlock()
+	if db, ok := pgPools[dsn]; ok {
+		return db, nil
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(2)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(5 * time.Minute)
+	pgPools[dsn] = db
+	return db, nil
+}
+
+func (p *Probe) probePostgres(ctx context.Context) error {
+	dsn, err := p.url()
+	if err != nil {
+		return err
+	}
+	db, err := pgPool(dsn)
+	if err != nil {
+		return err
+	}
+	rows, err := db.QueryContext(ctx, p.Query)
+	if err != nil {
+		return fmt.Errorf("query failed: %w", err)
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		cols, _ := rows.Columns()
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		if ok, isBool := values[0].(bool); isBool && !ok {
+			return fmt.Errorf("query returned false")
+		}
+	}
+	return rows.Err()
+}
+
+// probeNATS connects, then sends a message to itself and waits for it,
+// which takes the broker routing messages rather than just accepting
+// connections.
+func (p *Probe) probeNATS(ctx context.Context) error {
+	url, err := p.url()
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	nc, err := nats.Connect(url,
+		nats.Name("health-aggregator"),
+		nats.Timeout(time.Until(deadline)),
+		nats.NoReconnect(),
+	)
+	if err != nil {
+		return fmt.Errorf("connect failed: %w", err)
+	}
+	defer nc.Close()
+
+	subject := nats.NewInbox()
+	sub, err := nc.SubscribeSync(subject)
+	if err != nil {
+		return err
+	}
+	if err := nc.Publish(subject, []byte("ping")); err != nil {
+		return err
+	}
+	if _, err := sub.NextMsgWithContext(ctx); err != nil {
+		return fmt.Errorf("round trip failed: %w", err)
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
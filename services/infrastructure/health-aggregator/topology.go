@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Component statuses, best to worst
+const (
+	StatusHealthy   = "healthy"
+	StatusDegraded  = "degraded"
+	StatusUnhealthy = "unhealthy"
+	StatusUnknown   = "unknown"
+)
+
+var statusRank = map[string]int{StatusHealthy: 0, StatusUnknown: 1, StatusDegraded: 2, StatusUnhealthy: 3}
+
+func worse(a, b string) string {
+	if statusRank[b] > statusRank[a] {
+		return b
+	}
+	return a
+}
+
+// Topology is what the aggregator checks: components, how to probe each,
+// and what each depends on. A failing component whose dependencies are
+// failing too is reported as their symptom rather than a cause.
+type Topology struct {
+	Components []*Component `json:"components"`
+}
+
+type Component struct {
+	Name      string   `json:"name"`
+	DependsOn []string `json:"depends_on,omitempty"`
+	// Critical components being unhealthy makes the overall status
+	// unhealthy; other failures only degrade it
+	Critical bool     `json:"critical,omitempty"`
+	Probes   []*Probe `json:"probes"`
+}
+
+// Probe is one check of a component. Type is http, tcp, tls, postgres or
+// nats.
+type Probe struct {
+	Type string `json:"type"`
+	// URL for http and nats, a DSN for postgres; URLEnv names an
+	// environment variable to read it from instead, for ones with
+	// credentials
+	URL     string `json:"url,omitempty"`
+	URLEnv  string `json:"url_env,omitempty"`
+	Address string `json:"address,omitempty"` // host:port for tcp and tls
+
+	// http
+	ExpectStatus int                    `json:"expect_status,omitempty"` // Default any 2xx
+	BodyContains string                 `json:"body_contains,omitempty"`
+	JSON         map[string]interface{} `json:"json,omitempty"` // Dotted path to expected value
+
+	// postgres: a first column of false fails the probe
+	Query string `json:"query,omitempty"`
+
+	// tls: degraded this many days before the certificate expires
+	WarnDays int  `json:"warn_days,omitempty"`
+	Insecure bool `json:"insecure,omitempty"` // Check expiry without verifying the chain
+
+	Timeout string `json:"timeout,omitempty"` // Default 5s
+	// Severity is the component's status when the probe fails: unhealthy
+	// (default) or degraded
+	Severity string `json:"severity,omitempty"`
+
+	timeout time.Duration
+}
+
+// target is what the probe checks, for reports. Credentials in URLs from
+// the environment stay out of it.
+func (p *Probe) target() string {
+	switch {
+	case p.Address != "":
+		return p.Address
+	case p.URLEnv != "":
+		return "$" + p.URLEnv
+	}
+	return p.URL
+}
+
+// url is what the probe connects to: URLEnv's value, else URL. A probe
+// with neither fails rather than guessing credentials.
+func (p *Probe) url() (string, error) {
+	if p.URLEnv != "" {
+		if v := os.Getenv(p.URLEnv); v != "" {
+			return v, nil
+		}
+		if p.URL == "" {
+			return "", fmt.Errorf("%s is not set", p.URLEnv)
+		}
+	}
+	return p.URL, nil
+}
+
+func (p *Probe) validate() error {
+	switch p.Type {
+	case "http", "nats", "postgres":
+		if p.URL == "" && p.URLEnv == "" {
+			return fmt.Errorf("%s probe needs url or url_env", p.Type)
+		}
+	case "tcp", "tls":
+		if p.Address == "" {
+			return fmt.Errorf("%s probe needs address", p.Type)
+		}
+	default:
+		return fmt.Errorf("unknown probe type %q", p.Type)
+	}
+	switch p.Severity {
+	case "":
+		p.Severity = StatusUnhealthy
+	case StatusUnhealthy, StatusDegraded:
+	default:
+		return fmt.Errorf("severity must be unhealthy or degraded, not %q", p.Severity)
+	}
+	p.timeout = 5 * time.Second
+	if p.Timeout != "" {
+		d, err := time.ParseDuration(p.Timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q", p.Timeout)
+		}
+		p.timeout = d
+	}
+	if p.Type == "tls" && p.WarnDays == 0 {
+		p.WarnDays = 14
+	}
+	if p.Type == "postgres" && p.Query == "" {
+		p.Query = "SELECT 1"
+	}
+	return nil
+}
+
+// defaultTopology covers the infrastructure services and what they stand
+// on. HEALTH_TOPOLOGY replaces it.
+const defaultTopology = `{
+	"components": [
+		{"name": "postgres", "critical": true, "probes": [
+			{"type": "postgres", "url_env": "DATABASE_URL"}
+		]},
+		{"name": "event-broker", "critical": true, "probes": [
+			{"type": "nats", "url_env": "NATS_URL", "url": "nats://event-broker:4222"},
+			{"type": "http", "url": "http://event-broker:8080/health", "severity": "degraded"}
+		]},
+		{"name": "auth-gateway", "critical": true, "depends_on": ["postgres"], "probes": [
+			{"type": "http", "url": "http://auth-gateway.holm.svc.cluster.local/ready", "body_contains": "Ready"}
+		]},
+		{"name": "gateway", "critical": true, "depends_on": ["auth-gateway"], "probes": [
+			{"type": "http", "url": "http://gateway.holm.svc.cluster.local/health"}
+		]},
+		{"name": "secret-store", "depends_on": ["postgres", "auth-gateway"], "probes": [
+			{"type": "http", "url": "http://secret-store:8080/health", "json": {"database": true}}
+		]},
+		{"name": "event-persist", "depends_on": ["event-broker", "postgres"], "probes": [
+			{"type": "http", "url": "http://event-persist:8080/health", "json": {"status": "healthy"}, "severity": "degraded"}
+		]},
+		{"name": "event-dlq", "depends_on": ["event-broker", "postgres"], "probes": [
+			{"type": "http", "url": "http://event-dlq:8080/health", "json": {"status": "healthy"}, "severity": "degraded"}
+		]},
+		{"name": "event-replay", "depends_on": ["event-broker", "postgres"], "probes": [
+			{"type": "http", "url": "http://event-replay:8080/health", "json": {"status": "healthy"}, "severity": "degraded"}
+		]},
+		{"name": "config-sync", "depends_on": ["event-broker", "postgres"], "probes": [
+			{"type": "http", "url": "http://config-sync:8080/health", "json": {"status": "healthy"}, "severity": "degraded"}
+		]}
+	]
+}`
+
+// loadTopology parses raw, or the default topology when it is empty, and
+// checks every dependency exists and none loops back on itself.
+func loadTopology(raw string) (*Topology, error) {
+	if raw == "" {
+		raw = defaultTopology
+	}
+	var t Topology
+	if err := json.Unmarshal([]byte(raw), &t); err != nil {
+		return nil, fmt.Errorf("invalid topology: %w", err)
+	}
+	if len(t.Components) == 0 {
+		return nil, errors.New("topology has no components")
+	}
+
+	byName := map[string]*Component{}
+	for _, c := range t.Components {
+		if c.Name == "" {
+			return nil, errors.New("component without a name")
+		}
+		if byName[c.Name] != nil {
+			return nil, fmt.Errorf("component %s listed twice", c.Name)
+		}
+		byName[c.Name] = c
+		if len(c.Probes) == 0 {
+			return nil, fmt.Errorf("component %s has no probes", c.Name)
+		}
+		for _, p := range c.Probes {
+			if err := p.validate(); err != nil {
+				return nil, fmt.Errorf("component %s: %w", c.Name, err)
+			}
+		}
+	}
+	for _, c := range t.Components {
+		for _, dep := range c.DependsOn {
+			if byName[dep] == nil {
+				return nil, fmt.Errorf("component %s depends on unknown %s", c.Name, dep)
+			}
+		}
+	}
+
+	// Depth-first search for a cycle
+	const (
+		visiting = iota + 1
+		done
+	)
+	state := map[string]int{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %v", append(path, name))
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		path = append(append([]string(nil), path...), name)
+		for _, dep := range byName[name].DependsOn {
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		return nil
+	}
+	for _, c := range t.Components {
+		if err := visit(c.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+func (t *Topology) component(name string) *Component {
+	for _, c := range t.Components {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// dependents maps each component to those depending on it directly.
+func (t *Topology) dependents() map[string][]string {
+	out := map[string][]string{}
+	for _, c := range t.Components {
+		for _, dep := range c.DependsOn {
+			out[dep] = append(out[dep], c.Name)
+		}
+	}
+	for _, names := range out {
+		sort.Strings(names)
+	}
+	return out
+}
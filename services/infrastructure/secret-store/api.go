@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// guard identifies the caller and checks it may take perm on path, ""
+// being the store itself, auditing a refusal as action. When it returns
+// nil it has answered the request.
+func guard(w http.ResponseWriter, r *http.Request, perm, action, path string) *Identity {
+	atomic.AddUint64(&requestCounter, 1)
+	if db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return nil
+	}
+
+	id, err := auth.identify(r.Context(), r)
+	if err != nil {
+		writeAuthError(w, err)
+		return nil
+	}
+
+	ok, err := authorize(r.Context(), id, perm, path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if !ok {
+		audit(r.Context(), auditFor(r, id, action, path, nil, false, "no policy grants "+perm))
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return nil
+	}
+	return id
+}
+
+// writeAuthError answers a request whose caller could not be identified.
+func writeAuthError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnauthenticated) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
+func auditFor(r *http.Request, id *Identity, action, path string, version *int, allowed bool, detail string) *AuditEntry {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	return &AuditEntry{
+		Actor:      id.Username,
+		Role:       id.Role,
+		Action:     action,
+		Path:       path,
+		Version:    version,
+		Allowed:    allowed,
+		Detail:     detail,
+		RemoteAddr: remote,
+	}
+}
+
+// writeStoreError answers with the status a failed store call deserves.
+func writeStoreError(w http.ResponseWriter, err error) {
+	var invalid invalidError
+	switch {
+	case errors.Is(err, errNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errDestroyed):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.As(err, &invalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// secretPath reads the secret path after prefix, answering 400 itself if
+// it is invalid.
+func secretPath(w http.ResponseWriter, r *http.Request, prefix string) (string, bool) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if err := validPath(path); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return path, true
+}
+
+// whoamiHandler serves GET /whoami, the caller's identity.
+func whoamiHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&requestCounter, 1)
+	id, err := auth.identify(r.Context(), r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(id)
+}
+
+// secretsHandler serves GET /secrets?prefix=, the metadata of the secrets
+// the caller may read.
+func secretsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	atomic.AddUint64(&requestCounter, 1)
+	id, err := auth.identify(r.Context(), r)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	if db == nil {
+		http.Error(w, "Database not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	all, err := listSecrets(ctx, r.URL.Query().Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	visible := []*Secret{}
+	for _, s := range all {
+		ok, err := authorize(ctx, id, "read", s.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			visible = append(visible, s)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visible)
+}
+
+// secretWrite is the body of PUT /secrets/{path} and POST /rotate/{path}.
+// Without a value, the secret's generator makes one.
+type secretWrite struct {
+	Value string `json:"value,omitempty"`
+	SecretSettings
+}
+
+// secretHandler serves /secrets/{path}: GET reads the value (?version=
+// for an older one), PUT writes a new version and DELETE removes the
+// secret, or with ?version= destroys that version alone.
+func secretHandler(w http.ResponseWriter, r *http.Request) {
+	path, ok := secretPath(w, r, "/secrets/")
+	if !ok {
+		return
+	}
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		version = n
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		id := guard(w, r, "read", "read", path)
+		if id == nil {
+			return
+		}
+		value, v, err := readVersion(ctx, path, version)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		audit(ctx, auditFor(r, id, "read", path, &v.Version, true, ""))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"path":       path,
+			"version":    v.Version,
+			"value":      value,
+			"created_at": v.CreatedAt,
+		})
+
+	case http.MethodPut:
+		id := guard(w, r, "write", "write", path)
+		if id == nil {
+			return
+		}
+		var req secretWrite
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxValueSize)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		v, err := writeVersion(ctx, &VersionWrite{Path: path, Value: req.Value, Settings: &req.SecretSettings, Actor: id.Username})
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		audit(ctx, auditFor(r, id, "write", path, &v.Version, true, ""))
+		json.NewEncoder(w).Encode(v)
+
+	case http.MethodDelete:
+		id := guard(w, r, "delete", "delete", path)
+		if id == nil {
+			return
+		}
+		var err error
+		if version > 0 {
+			err = destroyVersion(ctx, path, version)
+		} else {
+			err = deleteSecret(ctx, path)
+		}
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if version > 0 {
+			audit(ctx, auditFor(r, id, "destroy", path, &version, true, ""))
+			json.NewEncoder(w).Encode(map[string]string{"status": "destroyed"})
+		} else {
+			audit(ctx, auditFor(r, id, "delete", path, nil, true, ""))
+			json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// metadataHandler serves /metadata/{path}: GET returns the secret's
+// settings and versions, PATCH changes its settings.
+func metadataHandler(w http.ResponseWriter, r *http.Request) {
+	path, ok := secretPath(w, r, "/metadata/")
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		if guard(w, r, "read", "metadata", path) == nil {
+			return
+		}
+		s, err := getSecret(ctx, path)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(s)
+
+	case http.MethodPatch:
+		id := guard(w, r, "write", "settings", path)
+		if id == nil {
+			return
+		}
+		var settings SecretSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := updateSettings(ctx, path, &settings); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		audit(ctx, auditFor(r, id, "settings", path, nil, true, ""))
+		s, err := getSecret(ctx, path)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(s)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// rotateHandler serves POST /rotate/{path}: a new version from the body's
+// value or, without one, the secret's generator.
+func rotateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path, ok := secretPath(w, r, "/rotate/")
+	if !ok {
+		return
+	}
+	id := guard(w, r, "write", "rotate", path)
+	if id == nil {
+		return
+	}
+
+	// The body is optional for secrets with a generator
+	var req secretWrite
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxValueSize)).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	// Rotation only moves an existing secret on
+	if _, err := getSecret(ctx, path); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	v, err := writeVersion(ctx, &VersionWrite{Path: path, Value: req.Value, Settings: &req.SecretSettings, Actor: id.Username})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	rotations.Add(1)
+	audit(ctx, auditFor(r, id, "rotate", path, &v.Version, true, ""))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// policiesHandler serves GET /policies and GET, PUT and DELETE on
+// /policies/{name}. Only admins manage policies.
+func policiesHandler(w http.ResponseWriter, r *http.Request) {
+	id := guard(w, r, "admin", "policy", "")
+	if id == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/policies"), "/")
+	policies, err := listPolicies(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if name == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		json.NewEncoder(w).Encode(policies)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		for _, p := range policies {
+			if p.Name == name {
+				json.NewEncoder(w).Encode(p)
+				return
+			}
+		}
+		http.Error(w, "Policy not found", http.StatusNotFound)
+
+	case http.MethodPut:
+		var p Policy
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		p.Name = name
+		if err := p.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := putPolicy(ctx, &p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(ctx, auditFor(r, id, "policy", "", nil, true, "put "+name))
+		json.NewEncoder(w).Encode(&p)
+
+	case http.MethodDelete:
+		res, err := db.ExecContext(ctx, `DELETE FROM secret_policies WHERE name = $1`, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Policy not found", http.StatusNotFound)
+			return
+		}
+		audit(ctx, auditFor(r, id, "policy", "", nil, true, "delete "+name))
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// auditHandler serves GET /audit?path=&actor=&action=&denied=&since=&before=&limit=,
+// newest first. before pages back by entry id.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if guard(w, r, "admin", "audit", "") == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	q := &AuditQuery{
+		Path:   query.Get("path"),
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Denied: query.Get("denied") == "true",
+	}
+	if v := query.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		q.Since = t
+	}
+	q.BeforeID, _ = strconv.ParseInt(query.Get("before"), 10, 64)
+	q.Limit, _ = strconv.Atoi(query.Get("limit"))
+	if q.Limit <= 0 || q.Limit > 1000 {
+		q.Limit = 100
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	entries, err := queryAudit(ctx, q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// rewrapHandler serves POST /rewrap: after the master key is rotated, it
+// moves every data key onto the new one so the old can be retired.
+func rewrapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := guard(w, r, "admin", "rewrap", "")
+	if id == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+
+	n, err := rewrapAll(ctx)
+	detail := "rewrapped " + strconv.Itoa(n) + " to " + keys.current.id
+	if err != nil {
+		audit(ctx, auditFor(r, id, "rewrap", "", nil, true, detail+": "+err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(ctx, auditFor(r, id, "rewrap", "", nil, true, detail))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"rewrapped": n, "key_id": keys.current.id})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditEntry records one request against the store, allowed or not.
+// Values never reach the log.
+type AuditEntry struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	Role       string    `json:"role,omitempty"`
+	Action     string    `json:"action"`
+	Path       string    `json:"path,omitempty"`
+	Version    *int      `json:"version,omitempty"`
+	Allowed    bool      `json:"allowed"`
+	Detail     string    `json:"detail,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+}
+
+// audit writes e to the audit log and to stdout, which keeps it if the
+// database write fails.
+func audit(ctx context.Context, e *AuditEntry) {
+	if e.Allowed {
+		auditAllowed.Add(1)
+	} else {
+		auditDenied.Add(1)
+	}
+	fields := map[string]interface{}{
+		"audit":   true,
+		"actor":   e.Actor,
+		"action":  e.Action,
+		"path":    e.Path,
+		"allowed": e.Allowed,
+	}
+	if e.Version != nil {
+		fields["version"] = *e.Version
+	}
+	if e.Detail != "" {
+		fields["detail"] = e.Detail
+	}
+	logger.Log("info", "Secret access", fields)
+
+	if db == nil {
+		return
+	}
+	// The request may already be cancelled; the record should still land
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	var version sql.NullInt64
+	if e.Version != nil {
+		version = sql.NullInt64{Int64: int64(*e.Version), Valid: true}
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO secret_audit (actor, role, action, path, version, allowed, detail, remote_addr)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		e.Actor, e.Role, e.Action, e.Path, version, e.Allowed, e.Detail, e.RemoteAddr)
+	if err != nil {
+		logger.Log("error", "Failed to write audit entry", map[string]interface{}{"error": err.Error()})
+	}
+}
+
+// AuditQuery filters the audit log; path ending in "/" matches a prefix.
+type AuditQuery struct {
+	Path     string
+	Actor    string
+	Action   string
+	Denied   bool
+	Since    time.Time
+	BeforeID int64
+	Limit    int
+}
+
+func queryAudit(ctx context.Context, q *AuditQuery) ([]*AuditEntry, error) {
+	where := []string{"TRUE"}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if q.Path != "" {
+		if strings.HasSuffix(q.Path, "/") {
+			where = append(where, "starts_with(path, "+arg(q.Path)+")")
+		} else {
+			where = append(where, "path = "+arg(q.Path))
+		}
+	}
+	if q.Actor != "" {
+		where = append(where, "actor = "+arg(q.Actor))
+	}
+	if q.Action != "" {
+		where = append(where, "action = "+arg(q.Action))
+	}
+	if q.Denied {
+		where = append(where, "NOT allowed")
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "time >= "+arg(q.Since))
+	}
+	if q.BeforeID > 0 {
+		where = append(where, "id < "+arg(q.BeforeID))
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, time, actor, role, action, path, version, allowed, detail, remote_addr
+		FROM secret_audit WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY id DESC LIMIT `+arg(q.Limit), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var version sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.Time, &e.Actor, &e.Role, &e.Action, &e.Path, &version,
+			&e.Allowed, &e.Detail, &e.RemoteAddr); err != nil {
+			return nil, err
+		}
+		if version.Valid {
+			v := int(version.Int64)
+			e.Version = &v
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Secrets are envelope encrypted: each version's value is sealed with a
+// data key of its own, and the data key is sealed with the master key.
+// Rotating the master key only rewraps data keys.
+
+const keySize = 32
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// keyring holds the current master key, which wraps new data keys, and
+// those it replaced, which still unwrap data keys not yet rewrapped.
+type keyring struct {
+	current *masterKey
+	keys    map[string]*masterKey
+}
+
+// sealed is a value encrypted under a data key wrapped by master key KeyID.
+type sealed struct {
+	Ciphertext []byte
+	WrappedKey []byte
+	KeyID      string
+}
+
+// keyID names a master key by its hash so the key itself is never stored.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readKeyFile reads a master key file holding 32 bytes, raw or base64.
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == keySize {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("%s: master key must be %d bytes, raw or base64", path, keySize)
+	}
+	return key, nil
+}
+
+// generateKeyFile writes a new random master key to path. It never
+// replaces a file: if another replica got there first, its key is used.
+func generateKeyFile(path string) ([]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return readKeyFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		return nil, err
+	}
+	return key, f.Sync()
+}
+
+// loadKeyring reads the current master key from current, generating it
+// first if it is missing and generate is set, and the previous master keys
+// from the files in previous.
+func loadKeyring(current string, previous []string, generate bool) (*keyring, error) {
+	key, err := readKeyFile(current)
+	if errors.Is(err, fs.ErrNotExist) && generate {
+		key, err = generateKeyFile(current)
+		if err == nil {
+			logger.Log("warn", "Generated a new master key", map[string]interface{}{"file": current, "key_id": keyID(key)})
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load master key: %w", err)
+	}
+
+	k := &keyring{keys: map[string]*masterKey{}}
+	add := func(key []byte) (*masterKey, error) {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		mk := &masterKey{id: keyID(key), aead: aead}
+		k.keys[mk.id] = mk
+		return mk, nil
+	}
+	if k.current, err = add(key); err != nil {
+		return nil, err
+	}
+	for _, path := range previous {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		key, err := readKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load previous master key: %w", err)
+		}
+		if _, err := add(key); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// versionAAD binds a sealed value to its secret and version, so a row
+// copied onto another secret fails to decrypt rather than leak.
+func versionAAD(path string, version int) []byte {
+	return []byte(path + "\x00" + strconv.Itoa(version))
+}
+
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(aead cipher.AEAD, data, aad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
+
+func (k *keyring) encrypt(plaintext, aad []byte) (*sealed, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := seal(aead, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(k.current.aead, dataKey, aad)
+	if err != nil {
+		return nil, err
+	}
+	return &sealed{Ciphertext: ciphertext, WrappedKey: wrapped, KeyID: k.current.id}, nil
+}
+
+func (k *keyring) unwrap(s *sealed, aad []byte) ([]byte, error) {
+	mk, ok := k.keys[s.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %s is not loaded", s.KeyID)
+	}
+	dataKey, err := open(mk.aead, s.WrappedKey, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+func (k *keyring) decrypt(s *sealed, aad []byte) ([]byte, error) {
+	dataKey, err := k.unwrap(s, aad)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := open(aead, s.Ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+// rewrap wraps s's data key with the current master key. The value itself
+// is left as it is.
+func (k *keyring) rewrap(s *sealed, aad []byte) (*sealed, error) {
+	dataKey, err := k.unwrap(s, aad)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(k.current.aead, dataKey, aad)
+	if err != nil {
+		return nil, err
+	}
+	return &sealed{Ciphertext: s.Ciphertext, WrappedKey: wrapped, KeyID: k.current.id}, nil
+}
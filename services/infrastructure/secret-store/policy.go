@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Callers are auth-gateway identities: a token is checked with
+// auth-gateway's /api/validate, which gives its username and role. Anyone
+// can register an auth-gateway username, so policies grant those callers
+// by role, which only an admin assigns. Services use tokens listed in
+// SECRETS_TOKENS_FILE instead, which are accepted without auth-gateway and
+// also serve for running locally.
+
+const identityCacheTTL = 30 * time.Second
+
+// Roles from auth-gateway
+const adminRole = "admin"
+
+type Identity struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Source   string `json:"source"` // auth-gateway or tokens-file
+}
+
+// subjects are the names policies can grant to id by. Only tokens-file
+// identities are named, as services.
+func (id *Identity) subjects() []string {
+	subjects := []string{"*"}
+	if id.Role != "" {
+		subjects = append(subjects, "role:"+id.Role)
+	}
+	if id.Source == "tokens-file" {
+		subjects = append(subjects, "service:"+id.Username)
+	}
+	return subjects
+}
+
+var (
+	errUnauthenticated = errors.New("authentication required")
+	errForbidden       = errors.New("permission denied")
+)
+
+type cachedIdentity struct {
+	identity *Identity
+	expires  time.Time
+}
+
+type authenticator struct {
+	gatewayURL string
+	tokens     map[string]*Identity // By SHA-256 hex of the token
+	client     *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedIdentity
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAuthenticator reads tokensFile, a JSON object of SHA-256 token hashes
+// to identities, if it is set and exists.
+func newAuthenticator(gatewayURL, tokensFile string) (*authenticator, error) {
+	a := &authenticator{
+		gatewayURL: strings.TrimRight(gatewayURL, "/"),
+		tokens:     map[string]*Identity{},
+		client:     &http.Client{Timeout: 5 * time.Second},
+		cache:      map[string]cachedIdentity{},
+	}
+	if tokensFile == "" {
+		return a, nil
+	}
+
+	data, err := os.ReadFile(tokensFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tokens file: %w", err)
+	}
+	var tokens map[string]*Identity
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid tokens file: %w", err)
+	}
+	for hash, id := range tokens {
+		if len(hash) != sha256.Size*2 || id == nil || id.Username == "" {
+			return nil, fmt.Errorf("invalid tokens file entry %q: want a SHA-256 hex hash and a username", hash)
+		}
+		id.Source = "tokens-file"
+		a.tokens[strings.ToLower(hash)] = id
+	}
+	return a, nil
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
+
+// identify returns who r comes from.
+func (a *authenticator) identify(ctx context.Context, r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, errUnauthenticated
+	}
+	hash := hashToken(token)
+	if id, ok := a.tokens[hash]; ok {
+		return id, nil
+	}
+	if a.gatewayURL == "" {
+		return nil, errUnauthenticated
+	}
+
+	a.mu.Lock()
+	cached, ok := a.cache[hash]
+	a.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.identity, nil
+	}
+
+	id, err := a.validate(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	now := time.Now()
+	for k, c := range a.cache {
+		if now.After(c.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[hash] = cachedIdentity{identity: id, expires: now.Add(identityCacheTTL)}
+	a.mu.Unlock()
+	return id, nil
+}
+
+func (a *authenticator) validate(ctx context.Context, token string) (*Identity, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.gatewayURL+"/api/validate", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("auth-gateway unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errUnauthenticated
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth-gateway returned status %d", resp.StatusCode)
+	}
+	var v struct {
+		Valid    bool   `json:"valid"`
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid auth-gateway response: %w", err)
+	}
+	if !v.Valid || v.Username == "" {
+		return nil, errUnauthenticated
+	}
+	return &Identity{Username: v.Username, Role: v.Role, Source: "auth-gateway"}, nil
+}
+
+// Actions a policy grants. admin covers the others and the store itself:
+// policies, the audit log and rewrapping.
+var policyActions = map[string]bool{"read": true, "write": true, "delete": true, "admin": true}
+
+// Policy grants its subjects ("service:<name>" for a tokens-file identity,
+// "role:<role>" or "*" for any caller) actions on the secrets matching its
+// paths. In a path pattern "*" matches one segment and a trailing "**" one
+// or more.
+type Policy struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Subjects    []string  `json:"subjects"`
+	Paths       []string  `json:"paths"`
+	Actions     []string  `json:"actions"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+var policyName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func (p *Policy) validate() error {
+	if !policyName.MatchString(p.Name) {
+		return errors.New("invalid policy name")
+	}
+	if len(p.Subjects) == 0 || len(p.Paths) == 0 || len(p.Actions) == 0 {
+		return errors.New("subjects, paths and actions are required")
+	}
+	for _, s := range p.Subjects {
+		if s != "*" && !strings.HasPrefix(s, "service:") && !strings.HasPrefix(s, "role:") {
+			return fmt.Errorf("invalid subject %q: want service:<name>, role:<role> or *", s)
+		}
+	}
+	for _, pattern := range p.Paths {
+		segs := strings.Split(pattern, "/")
+		for i, seg := range segs {
+			if seg == "**" && i != len(segs)-1 {
+				return fmt.Errorf("invalid path %q: ** must come last", pattern)
+			}
+			if seg != "*" && seg != "**" && !pathSegment.MatchString(seg) {
+				return fmt.Errorf("invalid path %q", pattern)
+			}
+		}
+	}
+	for _, a := range p.Actions {
+		if !policyActions[a] {
+			return fmt.Errorf("unknown action %q", a)
+		}
+	}
+	return nil
+}
+
+// pathMatches reports whether path matches pattern. The empty path, which
+// stands for the store itself, only matches "**".
+func pathMatches(pattern, path string) bool {
+	if pattern == "**" {
+		return true
+	}
+	if path == "" {
+		return false
+	}
+	pats, segs := strings.Split(pattern, "/"), strings.Split(path, "/")
+	for i, p := range pats {
+		if p == "**" {
+			return len(segs) > i
+		}
+		if i >= len(segs) || (p != "*" && p != segs[i]) {
+			return false
+		}
+	}
+	return len(pats) == len(segs)
+}
+
+func (p *Policy) grants(id *Identity, action, path string) bool {
+	subject := false
+	for _, want := range p.Subjects {
+		for _, have := range id.subjects() {
+			if want == have {
+				subject = true
+			}
+		}
+	}
+	if !subject {
+		return false
+	}
+	act := false
+	for _, a := range p.Actions {
+		if a == action || a == "admin" {
+			act = true
+		}
+	}
+	if !act {
+		return false
+	}
+	for _, pattern := range p.Paths {
+		if pathMatches(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize reports whether id may take action on path, "" being the store
+// itself. Admins may do anything.
+func authorize(ctx context.Context, id *Identity, action, path string) (bool, error) {
+	if id.Role == adminRole {
+		return true, nil
+	}
+	policies, err := listPolicies(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range policies {
+		if p.grants(id, action, path) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func listPolicies(ctx context.Context) ([]*Policy, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT name, description, subjects, paths, actions, created_at, updated_at
+		FROM secret_policies ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []*Policy{}
+	for rows.Next() {
+		var p Policy
+		var subjects, paths, actions []byte
+		if err := rows.Scan(&p.Name, &p.Description, &subjects, &paths, &actions, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(subjects, &p.Subjects)
+		json.Unmarshal(paths, &p.Paths)
+		json.Unmarshal(actions, &p.Actions)
+		policies = append(policies, &p)
+	}
+	return policies, rows.Err()
+}
+
+func putPolicy(ctx context.Context, p *Policy) error {
+	subjects, _ := json.Marshal(p.Subjects)
+	paths, _ := json.Marshal(p.Paths)
+	actions, _ := json.Marshal(p.Actions)
+	return db.QueryRowContext(ctx, `
+		INSERT INTO secret_policies (name, description, subjects, paths, actions)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (name) DO UPDATE SET
+			description = EXCLUDED.description, subjects = EXCLUDED.subjects,
+			paths = EXCLUDED.paths, actions = EXCLUDED.actions, updated_at = NOW()
+		RETURNING created_at, updated_at`,
+		p.Name, p.Description, subjects, paths, actions).Scan(&p.CreatedAt, &p.UpdatedAt)
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestPathMatches(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"backup-dashboard/encryption-key", "backup-dashboard/encryption-key", true},
+		{"backup-dashboard/encryption-key", "backup-dashboard/other", false},
+		{"backup-dashboard/encryption-key", "backup-dashboard", false},
+		{"backup-dashboard/*", "backup-dashboard/encryption-key", true},
+		{"backup-dashboard/*", "backup-dashboard/db/password", false},
+		{"backup-dashboard/*", "backup-dashboard", false},
+		{"*/encryption-key", "backup-dashboard/encryption-key", true},
+		{"*/encryption-key", "backup-dashboard/db/encryption-key", false},
+		{"backup-dashboard/**", "backup-dashboard/encryption-key", true},
+		{"backup-dashboard/**", "backup-dashboard/db/password", true},
+		{"backup-dashboard/**", "backup-dashboard", false},
+		{"backup-dashboard/**", "backup-dashboard-old/key", false},
+		{"**", "backup-dashboard/encryption-key", true},
+		{"**", "", true},
+		{"*", "", false},
+		{"backup-dashboard/**", "", false},
+	}
+	for _, tt := range tests {
+		if got := pathMatches(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("pathMatches(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestGrantsBySubject(t *testing.T) {
+	p := &Policy{
+		Subjects: []string{"service:backup-dashboard", "role:operator"},
+		Paths:    []string{"backup-dashboard/**"},
+		Actions:  []string{"read"},
+	}
+	tests := []struct {
+		name string
+		id   *Identity
+		want bool
+	}{
+		{"service token", &Identity{Username: "backup-dashboard", Source: "tokens-file"}, true},
+		{"auth-gateway user with the service's name", &Identity{Username: "backup-dashboard", Role: "user", Source: "auth-gateway"}, false},
+		{"assigned role", &Identity{Username: "alice", Role: "operator", Source: "auth-gateway"}, true},
+		{"other service token", &Identity{Username: "file-web", Source: "tokens-file"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.grants(tt.id, "read", "backup-dashboard/encryption-key"); got != tt.want {
+				t.Errorf("grants() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
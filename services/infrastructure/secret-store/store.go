@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const secretSchema = `
+	CREATE TABLE IF NOT EXISTS secrets (
+		path TEXT PRIMARY KEY,
+		description TEXT NOT NULL DEFAULT '',
+		current_version INTEGER NOT NULL DEFAULT 0,
+		generator JSONB,
+		rotate_every_seconds BIGINT NOT NULL DEFAULT 0,
+		max_versions INTEGER NOT NULL DEFAULT 10,
+		rotated_at TIMESTAMPTZ,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+
+	-- ciphertext and wrapped_key are NULL once a version is destroyed
+	CREATE TABLE IF NOT EXISTS secret_versions (
+		path TEXT NOT NULL REFERENCES secrets(path) ON DELETE CASCADE,
+		version INTEGER NOT NULL,
+		ciphertext BYTEA,
+		wrapped_key BYTEA,
+		key_id TEXT NOT NULL,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		destroyed_at TIMESTAMPTZ,
+		PRIMARY KEY (path, version)
+	);
+	CREATE INDEX IF NOT EXISTS idx_secret_versions_key ON secret_versions(key_id) WHERE ciphertext IS NOT NULL;
+
+	CREATE TABLE IF NOT EXISTS secret_policies (
+		name TEXT PRIMARY KEY,
+		description TEXT NOT NULL DEFAULT '',
+		subjects JSONB NOT NULL,
+		paths JSONB NOT NULL,
+		actions JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS secret_audit (
+		id BIGSERIAL PRIMARY KEY,
+		time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		actor TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT '',
+		action TEXT NOT NULL,
+		path TEXT NOT NULL DEFAULT '',
+		version INTEGER,
+		allowed BOOLEAN NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		remote_addr TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS idx_secret_audit_path ON secret_audit(path, time DESC);
+	CREATE INDEX IF NOT EXISTS idx_secret_audit_actor ON secret_audit(actor, time DESC);
+`
+
+const (
+	defaultMaxVersions = 10
+	maxValueSize       = 64 << 10
+)
+
+var (
+	errNotFound  = errors.New("secret not found")
+	errDestroyed = errors.New("secret version destroyed")
+	errNoValue   = invalidError{errors.New("value is required for a secret without a generator")}
+
+	pathSegment = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+// invalidError is a request the store turns down as malformed.
+type invalidError struct{ error }
+
+// validPath checks a secret path: slash-separated segments such as
+// backup-dashboard/encryption-key.
+func validPath(path string) error {
+	if path == "" || len(path) > 256 {
+		return errors.New("path must be 1-256 characters")
+	}
+	for _, seg := range strings.Split(path, "/") {
+		if !pathSegment.MatchString(seg) || seg == "." || seg == ".." {
+			return fmt.Errorf("invalid path segment %q", seg)
+		}
+	}
+	return nil
+}
+
+// Generator makes a secret's values, so the store can rotate it alone.
+type Generator struct {
+	Length   int    `json:"length"`   // Bytes, or characters for alphanumeric
+	Encoding string `json:"encoding"` // base64, hex or alphanumeric
+}
+
+const alphanumeric = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+func (g *Generator) validate() error {
+	if g.Length == 0 {
+		g.Length = 32
+	}
+	if g.Encoding == "" {
+		g.Encoding = "base64"
+	}
+	if g.Length < 8 || g.Length > 1024 {
+		return errors.New("generator length must be 8-1024")
+	}
+	switch g.Encoding {
+	case "base64", "hex", "alphanumeric":
+		return nil
+	}
+	return fmt.Errorf("unknown generator encoding %q", g.Encoding)
+}
+
+func (g *Generator) generate() (string, error) {
+	if g.Encoding == "alphanumeric" {
+		out := make([]byte, g.Length)
+		max := big.NewInt(int64(len(alphanumeric)))
+		for i := range out {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return "", err
+			}
+			out[i] = alphanumeric[n.Int64()]
+		}
+		return string(out), nil
+	}
+
+	buf := make([]byte, g.Length)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	if g.Encoding == "hex" {
+		return hex.EncodeToString(buf), nil
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// Secret is a secret's metadata. Values are only returned by readVersion.
+type Secret struct {
+	Path           string          `json:"path"`
+	Description    string          `json:"description,omitempty"`
+	CurrentVersion int             `json:"current_version"`
+	Generator      *Generator      `json:"generator,omitempty"`
+	RotateEvery    string          `json:"rotate_every,omitempty"`
+	MaxVersions    int             `json:"max_versions"`
+	RotatedAt      *time.Time      `json:"rotated_at,omitempty"`
+	CreatedBy      string          `json:"created_by"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	Versions       []SecretVersion `json:"versions,omitempty"`
+}
+
+type SecretVersion struct {
+	Version   int        `json:"version"`
+	KeyID     string     `json:"key_id"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	Destroyed *time.Time `json:"destroyed_at,omitempty"`
+}
+
+// SecretSettings changes a secret's metadata; unset fields are kept. An
+// empty rotate_every turns automatic rotation off.
+type SecretSettings struct {
+	Description *string    `json:"description,omitempty"`
+	Generator   *Generator `json:"generator,omitempty"`
+	RotateEvery *string    `json:"rotate_every,omitempty"`
+	MaxVersions *int       `json:"max_versions,omitempty"`
+}
+
+const secretColumns = `path, description, current_version, generator, rotate_every_seconds, max_versions, rotated_at, created_by, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSecret(row rowScanner) (*Secret, error) {
+	var s Secret
+	var generator []byte
+	var rotateEvery int64
+	var rotatedAt sql.NullTime
+	if err := row.Scan(&s.Path, &s.Description, &s.CurrentVersion, &generator, &rotateEvery,
+		&s.MaxVersions, &rotatedAt, &s.CreatedBy, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if len(generator) > 0 {
+		s.Generator = &Generator{}
+		if err := json.Unmarshal(generator, s.Generator); err != nil {
+			return nil, err
+		}
+	}
+	if rotateEvery > 0 {
+		s.RotateEvery = (time.Duration(rotateEvery) * time.Second).String()
+	}
+	if rotatedAt.Valid {
+		s.RotatedAt = &rotatedAt.Time
+	}
+	return &s, nil
+}
+
+// apply sets what settings changes on s.
+func (s *Secret) apply(settings *SecretSettings) error {
+	if settings == nil {
+		return nil
+	}
+	if settings.Description != nil {
+		s.Description = *settings.Description
+	}
+	if settings.Generator != nil {
+		if err := settings.Generator.validate(); err != nil {
+			return err
+		}
+		s.Generator = settings.Generator
+	}
+	if settings.RotateEvery != nil {
+		s.RotateEvery = ""
+		if *settings.RotateEvery != "" {
+			d, err := time.ParseDuration(*settings.RotateEvery)
+			if err != nil || d < time.Minute {
+				return errors.New("rotate_every must be a duration of at least 1m")
+			}
+			s.RotateEvery = d.String()
+		}
+	}
+	if settings.MaxVersions != nil {
+		if *settings.MaxVersions < 1 || *settings.MaxVersions > 100 {
+			return errors.New("max_versions must be 1-100")
+		}
+		s.MaxVersions = *settings.MaxVersions
+	}
+	if s.RotateEvery != "" && s.Generator == nil {
+		return errors.New("rotate_every needs a generator")
+	}
+	return nil
+}
+
+func (s *Secret) rotateEverySeconds() int64 {
+	d, _ := time.ParseDuration(s.RotateEvery)
+	return int64(d / time.Second)
+}
+
+// save writes s's settings back.
+func (s *Secret) save(ctx context.Context, tx *sql.Tx) error {
+	var generator []byte
+	if s.Generator != nil {
+		generator, _ = json.Marshal(s.Generator)
+	}
+	_, err := tx.ExecContext(ctx, `
+		UPDATE secrets
+		SET description = $2, generator = $3, rotate_every_seconds = $4, max_versions = $5, updated_at = NOW()
+		WHERE path = $1`,
+		s.Path, s.Description, generator, s.rotateEverySeconds(), s.MaxVersions)
+	return err
+}
+
+func getSecret(ctx context.Context, path string) (*Secret, error) {
+	s, err := scanSecret(db.QueryRowContext(ctx, `SELECT `+secretColumns+` FROM secrets WHERE path = $1`, path))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT version, key_id, created_by, created_at, destroyed_at
+		FROM secret_versions WHERE path = $1 ORDER BY version DESC`, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v SecretVersion
+		var destroyed sql.NullTime
+		if err := rows.Scan(&v.Version, &v.KeyID, &v.CreatedBy, &v.CreatedAt, &destroyed); err != nil {
+			return nil, err
+		}
+		if destroyed.Valid {
+			v.Destroyed = &destroyed.Time
+		}
+		s.Versions = append(s.Versions, v)
+	}
+	return s, rows.Err()
+}
+
+func listSecrets(ctx context.Context, prefix string) ([]*Secret, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+secretColumns+` FROM secrets
+		WHERE starts_with(path, $1) ORDER BY path`, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	secrets := []*Secret{}
+	for rows.Next() {
+		s, err := scanSecret(rows)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, s)
+	}
+	return secrets, rows.Err()
+}
+
+// VersionWrite adds a version to a secret, creating the secret if needed.
+// An empty value is made by the secret's generator.
+type VersionWrite struct {
+	Path     string
+	Value    string
+	Settings *SecretSettings
+	Actor    string
+	// IfDue skips the write unless the secret is due for rotation, so
+	// replicas rotating together add one version between them.
+	IfDue bool
+}
+
+// writeVersion stores a new version and destroys those past the secret's
+// max_versions. It returns nil when IfDue found nothing due.
+func writeVersion(ctx context.Context, w *VersionWrite) (*SecretVersion, error) {
+	if len(w.Value) > maxValueSize {
+		return nil, invalidError{fmt.Errorf("value exceeds %d bytes", maxValueSize)}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if !w.IfDue {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO secrets (path, max_versions, created_by) VALUES ($1, $2, $3)
+			ON CONFLICT (path) DO NOTHING`, w.Path, defaultMaxVersions, w.Actor)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s, err := scanSecret(tx.QueryRowContext(ctx, `SELECT `+secretColumns+` FROM secrets WHERE path = $1 FOR UPDATE`, w.Path))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if w.IfDue && !s.due(time.Now()) {
+		return nil, nil
+	}
+	if err := s.apply(w.Settings); err != nil {
+		return nil, invalidError{err}
+	}
+	if err := s.save(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	value := w.Value
+	if value == "" {
+		if s.Generator == nil {
+			return nil, errNoValue
+		}
+		if value, err = s.Generator.generate(); err != nil {
+			return nil, err
+		}
+	}
+
+	v := &SecretVersion{Version: s.CurrentVersion + 1, CreatedBy: w.Actor}
+	enc, err := keys.encrypt([]byte(value), versionAAD(s.Path, v.Version))
+	if err != nil {
+		return nil, err
+	}
+	v.KeyID = enc.KeyID
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO secret_versions (path, version, ciphertext, wrapped_key, key_id, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at`,
+		s.Path, v.Version, enc.Ciphertext, enc.WrappedKey, enc.KeyID, w.Actor).Scan(&v.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE secrets SET current_version = $2, rotated_at = NOW(), updated_at = NOW() WHERE path = $1`,
+		s.Path, v.Version)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE secret_versions SET ciphertext = NULL, wrapped_key = NULL, destroyed_at = NOW()
+		WHERE path = $1 AND version <= $2 AND ciphertext IS NOT NULL`,
+		s.Path, v.Version-s.MaxVersions)
+	if err != nil {
+		return nil, err
+	}
+	return v, tx.Commit()
+}
+
+// due reports whether s rotates itself and its current version is older
+// than rotate_every.
+func (s *Secret) due(now time.Time) bool {
+	every := s.rotateEverySeconds()
+	if s.Generator == nil || every <= 0 {
+		return false
+	}
+	return s.RotatedAt == nil || !now.Before(s.RotatedAt.Add(time.Duration(every)*time.Second))
+}
+
+// updateSettings changes a secret's metadata without a new version.
+func updateSettings(ctx context.Context, path string, settings *SecretSettings) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	s, err := scanSecret(tx.QueryRowContext(ctx, `SELECT `+secretColumns+` FROM secrets WHERE path = $1 FOR UPDATE`, path))
+	if errors.Is(err, sql.ErrNoRows) {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.apply(settings); err != nil {
+		return invalidError{err}
+	}
+	if err := s.save(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// readVersion decrypts a version of path, the current one for version 0.
+func readVersion(ctx context.Context, path string, version int) (string, *SecretVersion, error) {
+	query := `
+		SELECT v.version, v.ciphertext, v.wrapped_key, v.key_id, v.created_by, v.created_at, v.destroyed_at
+		FROM secret_versions v JOIN secrets s ON s.path = v.path
+		WHERE v.path = $1 AND v.version = $2`
+	args := []interface{}{path, version}
+	if version == 0 {
+		query = `
+		SELECT v.version, v.ciphertext, v.wrapped_key, v.key_id, v.created_by, v.created_at, v.destroyed_at
+		FROM secret_versions v JOIN secrets s ON s.path = v.path AND v.version = s.current_version
+		WHERE v.path = $1`
+		args = args[:1]
+	}
+
+	var v SecretVersion
+	var enc sealed
+	var destroyed sql.NullTime
+	err := db.QueryRowContext(ctx, query, args...).Scan(&v.Version, &enc.Ciphertext, &enc.WrappedKey,
+		&enc.KeyID, &v.CreatedBy, &v.CreatedAt, &destroyed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, errNotFound
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	v.KeyID = enc.KeyID
+	if destroyed.Valid {
+		v.Destroyed = &destroyed.Time
+		return "", &v, errDestroyed
+	}
+
+	value, err := keys.decrypt(&enc, versionAAD(path, v.Version))
+	if err != nil {
+		return "", nil, err
+	}
+	return string(value), &v, nil
+}
+
+// destroyVersion drops one version's ciphertext; its metadata stays for
+// the record.
+func destroyVersion(ctx context.Context, path string, version int) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE secret_versions SET ciphertext = NULL, wrapped_key = NULL, destroyed_at = NOW()
+		WHERE path = $1 AND version = $2 AND ciphertext IS NOT NULL`, path, version)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func deleteSecret(ctx context.Context, path string) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM secrets WHERE path = $1`, path)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// rotateDue rotates the secrets with generators whose rotate_every has
+// passed.
+func rotateDue(ctx context.Context) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT path FROM secrets
+		WHERE generator IS NOT NULL AND rotate_every_seconds > 0
+		  AND (rotated_at IS NULL OR rotated_at + rotate_every_seconds * INTERVAL '1 second' <= NOW())
+		ORDER BY rotated_at NULLS FIRST
+		LIMIT 100`)
+	if err != nil {
+		logger.Log("error", "Failed to find secrets due for rotation", map[string]interface{}{"error": err.Error()})
+		return
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if rows.Scan(&path) == nil {
+			paths = append(paths, path)
+		}
+	}
+	rows.Close()
+
+	for _, path := range paths {
+		v, err := writeVersion(ctx, &VersionWrite{Path: path, Actor: "secret-store", IfDue: true})
+		if err != nil {
+			logger.Log("error", "Failed to rotate secret", map[string]interface{}{"path": path, "error": err.Error()})
+			continue
+		}
+		if v == nil {
+			continue
+		}
+		rotations.Add(1)
+		audit(ctx, &AuditEntry{Actor: "secret-store", Action: "rotate", Path: path, Version: &v.Version, Allowed: true, Detail: "scheduled"})
+		logger.Log("info", "Rotated secret", map[string]interface{}{"path": path, "version": v.Version})
+	}
+}
+
+// rewrapAll moves data keys wrapped by previous master keys onto the
+// current one, a batch at a time. It returns how many it rewrapped.
+func rewrapAll(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		rows, err := db.QueryContext(ctx, `
+			SELECT path, version, ciphertext, wrapped_key, key_id FROM secret_versions
+			WHERE key_id <> $1 AND ciphertext IS NOT NULL
+			LIMIT 100`, keys.current.id)
+		if err != nil {
+			return total, err
+		}
+		type row struct {
+			path    string
+			version int
+			enc     sealed
+		}
+		var batch []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.path, &r.version, &r.enc.Ciphertext, &r.enc.WrappedKey, &r.enc.KeyID); err != nil {
+				rows.Close()
+				return total, err
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if len(batch) == 0 {
+			return total, nil
+		}
+
+		for _, r := range batch {
+			enc, err := keys.rewrap(&r.enc, versionAAD(r.path, r.version))
+			if err != nil {
+				return total, fmt.Errorf("%s version %d: %w", r.path, r.version, err)
+			}
+			_, err = db.ExecContext(ctx, `
+				UPDATE secret_versions SET wrapped_key = $3, key_id = $4
+				WHERE path = $1 AND version = $2 AND key_id = $5`,
+				r.path, r.version, enc.WrappedKey, enc.KeyID, r.enc.KeyID)
+			if err != nil {
+				return total, err
+			}
+			total++
+		}
+	}
+}
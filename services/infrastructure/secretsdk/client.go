@@ -0,0 +1,318 @@
+// Package secretsdk reads secrets from secret-store. Services normally call
+// ResolveEnv at startup, which swaps environment variables set to
+// secret://<path> for the secrets' values.
+package secretsdk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultURL is secret-store inside the cluster.
+	DefaultURL = "http://secret-store.holm-system.svc.cluster.local:8080"
+	// DefaultAuthGatewayURL is where clients with a username sign in.
+	DefaultAuthGatewayURL = "http://auth-gateway.holm.svc.cluster.local"
+	// RefPrefix marks an environment variable ResolveEnv replaces.
+	RefPrefix = "secret://"
+)
+
+var (
+	ErrNotFound        = errors.New("secretsdk: secret not found")
+	ErrDestroyed       = errors.New("secretsdk: secret version destroyed")
+	ErrForbidden       = errors.New("secretsdk: permission denied")
+	ErrUnauthenticated = errors.New("secretsdk: authentication failed")
+)
+
+// Secret is one version of a secret.
+type Secret struct {
+	Path      string    `json:"path"`
+	Version   int       `json:"version"`
+	Value     string    `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Config says where secret-store is and who the client is: a static token,
+// or an auth-gateway user the client signs in as.
+type Config struct {
+	URL            string
+	Token          string
+	Username       string
+	Password       string
+	AuthGatewayURL string
+	HTTPClient     *http.Client
+}
+
+// Client reads secrets as one identity.
+type Client struct {
+	cfg  Config
+	http *http.Client
+
+	mu      sync.Mutex
+	session string // Token from signing in
+}
+
+// New returns a client for cfg.
+func New(cfg Config) (*Client, error) {
+	if cfg.URL == "" {
+		cfg.URL = DefaultURL
+	}
+	if cfg.AuthGatewayURL == "" {
+		cfg.AuthGatewayURL = DefaultAuthGatewayURL
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	cfg.AuthGatewayURL = strings.TrimRight(cfg.AuthGatewayURL, "/")
+	if cfg.Token == "" && (cfg.Username == "" || cfg.Password == "") {
+		return nil, errors.New("secretsdk: a token or a username and password is required")
+	}
+	c := &Client{cfg: cfg, http: cfg.HTTPClient}
+	if c.http == nil {
+		c.http = &http.Client{Timeout: 10 * time.Second}
+	}
+	return c, nil
+}
+
+// FromEnv configures a client from SECRETS_URL, SECRETS_TOKEN (or
+// SECRETS_TOKEN_FILE), SECRETS_USERNAME, SECRETS_PASSWORD (or
+// SECRETS_PASSWORD_FILE) and AUTH_GATEWAY_URL.
+func FromEnv() (*Client, error) {
+	token, err := envOrFile("SECRETS_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	password, err := envOrFile("SECRETS_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	return New(Config{
+		URL:            os.Getenv("SECRETS_URL"),
+		Token:          token,
+		Username:       os.Getenv("SECRETS_USERNAME"),
+		Password:       password,
+		AuthGatewayURL: os.Getenv("AUTH_GATEWAY_URL"),
+	})
+}
+
+// envOrFile reads name, or the file named by name_FILE, which is how
+// Kubernetes Secrets are usually mounted.
+func envOrFile(name string) (string, error) {
+	if v := os.Getenv(name); v != "" {
+		return v, nil
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("secretsdk: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Get reads the current version of path.
+func (c *Client) Get(ctx context.Context, path string) (*Secret, error) {
+	return c.GetVersion(ctx, path, 0)
+}
+
+// GetVersion reads a version of path, the current one for version 0. While
+// secret-store is unreachable or failing it retries until ctx is done, so
+// services starting alongside it wait rather than fail.
+func (c *Client) GetVersion(ctx context.Context, path string, version int) (*Secret, error) {
+	u := c.cfg.URL + "/secrets/" + escapePath(path)
+	if version > 0 {
+		u += "?version=" + strconv.Itoa(version)
+	}
+
+	backoff := time.Second
+	for {
+		s, err := c.get(ctx, u)
+		if !retryable(err) {
+			return s, err
+		}
+		log.Printf("secretsdk: reading %s: %v, retrying in %s", path, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("secretsdk: reading %s: %w", path, err)
+		}
+		if backoff *= 2; backoff > 15*time.Second {
+			backoff = 15 * time.Second
+		}
+	}
+}
+
+// Value reads the current value of path.
+func (c *Client) Value(ctx context.Context, path string) (string, error) {
+	s, err := c.Get(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	return s.Value, nil
+}
+
+// unavailableError is a failure worth retrying.
+type unavailableError struct{ error }
+
+func retryable(err error) bool {
+	var u unavailableError
+	return errors.As(err, &u)
+}
+
+func (c *Client) get(ctx context.Context, u string) (*Secret, error) {
+	resp, err := c.do(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// A session token may have expired: sign in again once
+	if resp.StatusCode == http.StatusUnauthorized && c.cfg.Token == "" {
+		resp.Body.Close()
+		c.mu.Lock()
+		c.session = ""
+		c.mu.Unlock()
+		if resp, err = c.do(ctx, u); err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		var s Secret
+		if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+			return nil, fmt.Errorf("secretsdk: invalid response: %w", err)
+		}
+		return &s, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound
+	case resp.StatusCode == http.StatusGone:
+		return nil, ErrDestroyed
+	case resp.StatusCode == http.StatusForbidden:
+		return nil, ErrForbidden
+	case resp.StatusCode == http.StatusUnauthorized:
+		return nil, ErrUnauthenticated
+	case resp.StatusCode >= 500:
+		return nil, unavailableError{fmt.Errorf("secret-store returned %s: %s", resp.Status, readError(resp))}
+	default:
+		return nil, fmt.Errorf("secretsdk: secret-store returned %s: %s", resp.Status, readError(resp))
+	}
+}
+
+func (c *Client) do(ctx context.Context, u string) (*http.Response, error) {
+	token, err := c.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, unavailableError{err}
+	}
+	return resp, nil
+}
+
+// token is the static token, or a session from signing in to auth-gateway.
+func (c *Client) token(ctx context.Context) (string, error) {
+	if c.cfg.Token != "" {
+		return c.cfg.Token, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session != "" {
+		return c.session, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"username": c.cfg.Username, "password": c.cfg.Password})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.AuthGatewayURL+"/api/login", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", unavailableError{fmt.Errorf("auth-gateway: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return "", ErrUnauthenticated
+	case resp.StatusCode >= 500:
+		return "", unavailableError{fmt.Errorf("auth-gateway returned %s", resp.Status)}
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("secretsdk: auth-gateway returned %s", resp.Status)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil || tok.AccessToken == "" {
+		return "", errors.New("secretsdk: auth-gateway returned no token")
+	}
+	c.session = tok.AccessToken
+	return c.session, nil
+}
+
+func escapePath(path string) string {
+	segs := strings.Split(path, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return strings.Join(segs, "/")
+}
+
+func readError(resp *http.Response) string {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return strings.TrimSpace(string(msg))
+}
+
+// ResolveEnv replaces every environment variable set to secret://<path>
+// with the value of that secret, returning the names it replaced. With no
+// such variables it does nothing, so services need no configuration for
+// secret-store until they use it.
+func ResolveEnv(ctx context.Context) ([]string, error) {
+	refs := map[string]string{}
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(value, RefPrefix) {
+			refs[name] = strings.TrimPrefix(value, RefPrefix)
+		}
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	c, err := FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	var resolved []string
+	for name, path := range refs {
+		value, err := c.Value(ctx, path)
+		if err != nil {
+			return resolved, fmt.Errorf("%s: %w", name, err)
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return resolved, err
+		}
+		resolved = append(resolved, name)
+	}
+	return resolved, nil
+}
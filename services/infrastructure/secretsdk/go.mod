@@ -0,0 +1,3 @@
+module github.com/holm/secretsdk
+
+go 1.21
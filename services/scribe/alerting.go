@@ -0,0 +1,862 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ==================== ALERT NOTIFICATIONS ====================
+//
+// CheckEntry splits each alert's matches into groups by the alert's
+// GroupBy labels and marks a group firing when it reaches the threshold.
+// The dispatcher evaluates every group on a tick (and as soon as one starts
+// firing): groups whose window has drained resolve, and firing groups are
+// notified once and then again every RepeatMins. The groups that change
+// together are sent as one notification per alert and status, to
+// notification-hub (which fans out to Echo and email) and to
+// notification-webhook. Silences match on the alert's labels and hold
+// back notifications until they end; every change is kept in the history.
+
+const (
+	defaultRepeatMins  = 240
+	alertEvalInterval  = 15 * time.Second
+	alertGroupWait     = 5 * time.Second // Lets a burst land in one notification
+	maxAlertHistory    = 1000
+	silenceKeepExpired = 7 * 24 * time.Hour
+)
+
+var alertReceivers = map[string]bool{"hub": true, "webhook": true}
+
+const defaultTitleTemplate = `[{{upper .Status}}] {{.AlertName}}`
+
+const defaultMessageTemplate = `{{if eq .Status "resolved"}}Resolved{{else}}{{.Description}}{{end}}
+{{range .Groups}}- {{with labels .Labels}}{{.}}: {{end}}{{.MatchCount}} matches in {{$.WindowMins}}m{{with .Sample}} - {{.Message}}{{end}}
+{{end}}`
+
+var templateFuncs = template.FuncMap{
+	"upper":  strings.ToUpper,
+	"labels": func(l map[string]string) string { return formatLabels(l) },
+}
+
+// AlertGroup is the part of an alert's matches that share the values of
+// its GroupBy labels. Each group fires, notifies and resolves on its own.
+type AlertGroup struct {
+	Labels       map[string]string `json:"labels,omitempty"`
+	MatchCount   int               `json:"match_count"`
+	Firing       bool              `json:"firing"`
+	StartsAt     time.Time         `json:"starts_at,omitempty"`
+	LastNotified time.Time         `json:"last_notified,omitempty"`
+	SilencedBy   string            `json:"silenced_by,omitempty"`
+	Sample       *LogEntry         `json:"sample,omitempty"` // Latest matching entry
+
+	times     []time.Time
+	announced bool // This firing has been notified or recorded as silenced
+}
+
+// AlertNotification is one state change of one or more groups of an
+// alert. It is what the title and message templates are executed on.
+type AlertNotification struct {
+	AlertID     string       `json:"alert_id"`
+	AlertName   string       `json:"alert_name"`
+	Description string       `json:"description,omitempty"`
+	Severity    string       `json:"severity"`
+	Status      string       `json:"status"` // firing, resolved
+	Repeat      bool         `json:"repeat,omitempty"`
+	Threshold   int          `json:"threshold"`
+	WindowMins  int          `json:"window_mins"`
+	Groups      []AlertGroup `json:"groups"`
+	Title       string       `json:"title"`
+	Message     string       `json:"message"`
+	Time        time.Time    `json:"time"`
+
+	alert      Alert
+	silencedBy string
+}
+
+// AlertHistoryEntry records one state change of one group.
+type AlertHistoryEntry struct {
+	Time       time.Time         `json:"time"`
+	AlertID    string            `json:"alert_id"`
+	AlertName  string            `json:"alert_name"`
+	Severity   string            `json:"severity"`
+	Status     string            `json:"status"`
+	Repeat     bool              `json:"repeat,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	MatchCount int               `json:"match_count"`
+	Notified   []string          `json:"notified,omitempty"` // Receivers that accepted it
+	SilencedBy string            `json:"silenced_by,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// AlertHistory keeps the latest state changes in memory.
+type AlertHistory struct {
+	mu      sync.RWMutex
+	entries []AlertHistoryEntry
+}
+
+// Silence holds back notifications for the alerts its matchers select,
+// between StartsAt and EndsAt.
+type Silence struct {
+	ID        string    `json:"id"`
+	Matchers  string    `json:"matchers"` // Stream selector, e.g. {alertname="OOM Detection", namespace=~"media.*"}
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	State     string    `json:"state,omitempty"` // pending, active or expired when listed
+
+	matchers []labelMatcher
+}
+
+// SilenceStore manages silences, saved next to the logs when there is a
+// data directory.
+type SilenceStore struct {
+	mu       sync.RWMutex
+	silences map[string]*Silence
+	path     string
+}
+
+// Notifier sends notifications to notification-hub and notification-webhook.
+type Notifier struct {
+	hubURL     string
+	webhookURL string
+	client     *http.Client
+}
+
+// ==================== ALERT GROUPS ====================
+
+// group returns the group an entry falls in, creating it if needed.
+func (s *AlertState) group(alert *Alert, entry LogEntry) *AlertGroup {
+	var labels map[string]string
+	if len(alert.GroupBy) > 0 {
+		stream := streamLabels(entry)
+		labels = make(map[string]string, len(alert.GroupBy))
+		for _, name := range alert.GroupBy {
+			v, ok := stream[name]
+			if !ok {
+				v = entry.Fields[name]
+			}
+			labels[name] = v
+		}
+	}
+	key := labelKey(labels)
+	g, ok := s.groups[key]
+	if !ok {
+		g = &AlertGroup{Labels: labels}
+		s.groups[key] = g
+	}
+	return g
+}
+
+func (g *AlertGroup) record(entry LogEntry, windowStart time.Time) {
+	g.times = append(g.times, entry.Timestamp)
+	g.Sample = &entry
+	g.prune(windowStart)
+}
+
+func (g *AlertGroup) prune(windowStart time.Time) {
+	recent := g.times[:0]
+	for _, t := range g.times {
+		if t.After(windowStart) {
+			recent = append(recent, t)
+		}
+	}
+	g.times = recent
+	g.MatchCount = len(recent)
+}
+
+// describe is the group's labels for log lines, empty for an ungrouped alert.
+func (g *AlertGroup) describe() string {
+	if len(g.Labels) == 0 {
+		return ""
+	}
+	return " " + labelKey(g.Labels)
+}
+
+func (s *AlertState) updateTriggered() {
+	firing := false
+	for _, g := range s.groups {
+		if g.Firing {
+			firing = true
+			break
+		}
+	}
+	if firing && !s.Triggered {
+		s.TriggeredAt = time.Now()
+	}
+	s.Triggered = firing
+}
+
+// snapshot copies the state with its groups for the API.
+func (s *AlertState) snapshot() AlertState {
+	out := *s
+	out.groups = nil
+	out.Groups = make([]AlertGroup, 0, len(s.groups))
+	for _, g := range s.groups {
+		c := *g
+		c.times = nil
+		out.Groups = append(out.Groups, c)
+	}
+	sort.Slice(out.Groups, func(i, j int) bool {
+		return labelKey(out.Groups[i].Labels) < labelKey(out.Groups[j].Labels)
+	})
+	return out
+}
+
+// alertLabels are what silences match on: the alert's name, ID and
+// severity plus the group's labels.
+func alertLabels(alert *Alert, g *AlertGroup) map[string]string {
+	labels := map[string]string{
+		"alertname": alert.Name,
+		"alert_id":  alert.ID,
+		"severity":  alert.Severity,
+	}
+	if alert.Namespace != "" {
+		labels["namespace"] = alert.Namespace
+	}
+	for k, v := range g.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// Evaluate slides every group's window forward and returns the
+// notifications that are due. Resolved groups that were never announced,
+// and idle groups, are dropped.
+func (as *AlertStore) Evaluate(now time.Time) []*AlertNotification {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	var notes []*AlertNotification
+	for id, alert := range as.alerts {
+		state := as.states[id]
+		windowStart := now.Add(-time.Duration(alert.WindowMins) * time.Minute)
+		repeat := time.Duration(alert.RepeatMins) * time.Minute
+		if repeat <= 0 {
+			repeat = defaultRepeatMins * time.Minute
+		}
+
+		// One notification per status (and silence) for the whole alert
+		batches := make(map[string]*AlertNotification)
+		add := func(status string, isRepeat bool, silencedBy string, g *AlertGroup) {
+			key := status + "/" + silencedBy
+			note, ok := batches[key]
+			if !ok {
+				note = &AlertNotification{
+					AlertID:     alert.ID,
+					AlertName:   alert.Name,
+					Description: alert.Description,
+					Severity:    alert.Severity,
+					Status:      status,
+					Threshold:   alert.Threshold,
+					WindowMins:  alert.WindowMins,
+					Time:        now,
+					alert:       *alert,
+					silencedBy:  silencedBy,
+				}
+				batches[key] = note
+				notes = append(notes, note)
+			}
+			note.Repeat = note.Repeat || isRepeat
+			c := *g
+			c.times = nil
+			note.Groups = append(note.Groups, c)
+		}
+
+		recent := state.Matches[:0]
+		for _, m := range state.Matches {
+			if m.Timestamp.After(windowStart) {
+				recent = append(recent, m)
+			}
+		}
+		state.Matches = recent
+		state.MatchCount = len(recent)
+
+		for key, g := range state.groups {
+			if !alert.Enabled {
+				g.times = nil
+			}
+			g.prune(windowStart)
+
+			switch {
+			case g.Firing && g.MatchCount < alert.Threshold:
+				g.Firing = false
+				if g.announced {
+					// A silenced group still resolves in the history
+					add("resolved", false, silenceStore.Match(alertLabels(alert, g), now), g)
+				}
+				g.announced = false
+				g.LastNotified = time.Time{}
+				g.SilencedBy = ""
+			case g.Firing:
+				g.SilencedBy = silenceStore.Match(alertLabels(alert, g), now)
+				if g.SilencedBy != "" {
+					if !g.announced {
+						add("firing", false, g.SilencedBy, g)
+						g.announced = true
+					}
+				} else if g.LastNotified.IsZero() || now.Sub(g.LastNotified) >= repeat {
+					// LastNotified is set by markNotified once the send
+					// succeeds, so a failed one is retried next evaluation
+					add("firing", !g.LastNotified.IsZero(), "", g)
+				}
+			}
+			if !g.Firing && g.MatchCount == 0 {
+				delete(state.groups, key)
+			}
+		}
+		state.updateTriggered()
+	}
+
+	for _, note := range notes {
+		sort.Slice(note.Groups, func(i, j int) bool {
+			return labelKey(note.Groups[i].Labels) < labelKey(note.Groups[j].Labels)
+		})
+	}
+	return notes
+}
+
+// dispatch evaluates alerts until ctx is done, sending what is due.
+func (as *AlertStore) dispatch(ctx context.Context, notifier *Notifier) {
+	ticker := time.NewTicker(alertEvalInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-as.wake:
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(alertGroupWait):
+			}
+		}
+		for _, note := range as.Evaluate(time.Now()) {
+			if notifier.Send(note) && note.Status == "firing" && note.silencedBy == "" {
+				as.markNotified(note)
+			}
+		}
+	}
+}
+
+// markNotified records that a firing note's groups were delivered, so they
+// are not notified again until the repeat interval has passed.
+func (as *AlertStore) markNotified(note *AlertNotification) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	state, ok := as.states[note.AlertID]
+	if !ok {
+		return
+	}
+	for _, c := range note.Groups {
+		if g, ok := state.groups[labelKey(c.Labels)]; ok && g.Firing {
+			g.LastNotified = note.Time
+			g.announced = true
+		}
+	}
+}
+
+// ==================== NOTIFIER ====================
+
+// NewNotifier reads the receiver URLs from the environment; "off"
+// disables one.
+func NewNotifier() *Notifier {
+	url := func(name, def string) string {
+		v := os.Getenv(name)
+		if v == "" {
+			v = def
+		}
+		if v == "off" {
+			return ""
+		}
+		return strings.TrimSuffix(v, "/")
+	}
+	return &Notifier{
+		hubURL:     url("NOTIFICATION_HUB_URL", "http://notification-hub.holm.svc.cluster.local"),
+		webhookURL: url("NOTIFICATION_WEBHOOK_URL", "http://notification-webhook.holm.svc.cluster.local"),
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Send renders a notification, delivers it unless it is silenced and
+// records it in the history. It reports false when every receiver failed.
+func (n *Notifier) Send(note *AlertNotification) bool {
+	note.render()
+
+	var notified, errs []string
+	if note.silencedBy == "" {
+		for _, receiver := range note.receivers() {
+			var err error
+			switch receiver {
+			case "hub":
+				if n.hubURL == "" {
+					continue
+				}
+				err = n.sendToHub(note)
+			case "webhook":
+				if n.webhookURL == "" {
+					continue
+				}
+				err = n.sendToWebhook(note)
+			}
+			if err != nil {
+				log.Printf("Failed to notify %s of alert %s: %v", receiver, note.AlertName, err)
+				errs = append(errs, receiver+": "+err.Error())
+				continue
+			}
+			notified = append(notified, receiver)
+		}
+		log.Printf("Alert %s %s for %d group(s), notified %v", note.AlertName, note.Status, len(note.Groups), notified)
+	}
+
+	for _, g := range note.Groups {
+		alertHistory.Add(AlertHistoryEntry{
+			Time:       note.Time,
+			AlertID:    note.AlertID,
+			AlertName:  note.AlertName,
+			Severity:   note.Severity,
+			Status:     note.Status,
+			Repeat:     note.Repeat,
+			Labels:     g.Labels,
+			MatchCount: g.MatchCount,
+			Notified:   notified,
+			SilencedBy: note.silencedBy,
+			Error:      strings.Join(errs, "; "),
+		})
+	}
+	return len(notified) > 0 || len(errs) == 0
+}
+
+func (note *AlertNotification) receivers() []string {
+	if len(note.alert.Receivers) == 0 {
+		return []string{"hub", "webhook"}
+	}
+	return note.alert.Receivers
+}
+
+// render fills in the title and message from the alert's templates,
+// falling back to the defaults if one fails.
+func (note *AlertNotification) render() {
+	exec := func(name, custom, def string) string {
+		if custom != "" {
+			out, err := executeTemplate(name, custom, note)
+			if err == nil {
+				return out
+			}
+			log.Printf("Alert %s: %s template failed, using the default: %v", note.AlertName, name, err)
+		}
+		out, _ := executeTemplate(name, def, note)
+		return out
+	}
+	note.Title = exec("title", note.alert.TitleTemplate, defaultTitleTemplate)
+	note.Message = exec("message", note.alert.MessageTemplate, defaultMessageTemplate)
+}
+
+func executeTemplate(name, text string, data interface{}) (string, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// formatLabels renders labels as "k=v, k=v" for messages.
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + labels[k]
+	}
+	return strings.Join(parts, ", ")
+}
+
+// sendToHub posts a UnifiedNotification to notification-hub, which hands
+// it to SendNotification.
+func (n *Notifier) sendToHub(note *AlertNotification) error {
+	notifType, priority := "info", "normal"
+	switch {
+	case note.Status == "resolved":
+		notifType = "success"
+	case note.Severity == "critical":
+		notifType, priority = "error", "high"
+	case note.Severity == "warning":
+		notifType = "warning"
+	}
+	groups := make([]map[string]string, len(note.Groups))
+	for i, g := range note.Groups {
+		groups[i] = g.Labels
+	}
+	return n.post(n.hubURL+"/api/notifications", map[string]interface{}{
+		"source":   "scribe",
+		"type":     notifType,
+		"title":    note.Title,
+		"message":  note.Message,
+		"priority": priority,
+		"metadata": map[string]interface{}{
+			"alert_id": note.AlertID,
+			"status":   note.Status,
+			"severity": note.Severity,
+			"repeat":   note.Repeat,
+			"groups":   groups,
+		},
+	})
+}
+
+// sendToWebhook posts the whole notification to notification-webhook as a
+// scribe.alert.firing or scribe.alert.resolved event.
+func (n *Notifier) sendToWebhook(note *AlertNotification) error {
+	return n.post(n.webhookURL+"/send", map[string]interface{}{
+		"event":   "scribe.alert." + note.Status,
+		"payload": note,
+	})
+}
+
+func (n *Notifier) post(url string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// validate checks the notification settings of an alert from the API.
+func (alert *Alert) validate() error {
+	for _, r := range alert.Receivers {
+		if !alertReceivers[r] {
+			return fmt.Errorf("unknown receiver %q (want hub or webhook)", r)
+		}
+	}
+	for name, text := range map[string]string{"title": alert.TitleTemplate, "message": alert.MessageTemplate} {
+		if text == "" {
+			continue
+		}
+		if _, err := template.New(name).Funcs(templateFuncs).Parse(text); err != nil {
+			return fmt.Errorf("invalid %s template: %v", name, err)
+		}
+	}
+	if alert.RepeatMins < 0 {
+		return fmt.Errorf("repeat_mins must not be negative")
+	}
+	return nil
+}
+
+// ==================== HISTORY ====================
+
+func NewAlertHistory() *AlertHistory {
+	return &AlertHistory{}
+}
+
+func (ah *AlertHistory) Add(entry AlertHistoryEntry) {
+	ah.mu.Lock()
+	defer ah.mu.Unlock()
+
+	ah.entries = append(ah.entries, entry)
+	if len(ah.entries) > maxAlertHistory {
+		ah.entries = ah.entries[len(ah.entries)-maxAlertHistory:]
+	}
+}
+
+// List returns the newest entries first, optionally for one alert.
+func (ah *AlertHistory) List(alertID string, limit int) []AlertHistoryEntry {
+	ah.mu.RLock()
+	defer ah.mu.RUnlock()
+
+	entries := []AlertHistoryEntry{}
+	for i := len(ah.entries) - 1; i >= 0 && len(entries) < limit; i-- {
+		if alertID == "" || ah.entries[i].AlertID == alertID {
+			entries = append(entries, ah.entries[i])
+		}
+	}
+	return entries
+}
+
+// ==================== SILENCES ====================
+
+func (s *Silence) compile() error {
+	q, err := ParseLogQL(s.Matchers)
+	if err != nil {
+		return fmt.Errorf("invalid matchers: %v", err)
+	}
+	if q.Log == nil || len(q.Log.stages) > 0 || len(q.Log.matchers) == 0 {
+		return fmt.Errorf("matchers must be a selector like {alertname=\"OOM Detection\"}")
+	}
+	s.matchers = q.Log.matchers
+	return nil
+}
+
+func (s *Silence) state(now time.Time) string {
+	switch {
+	case now.Before(s.StartsAt):
+		return "pending"
+	case now.Before(s.EndsAt):
+		return "active"
+	default:
+		return "expired"
+	}
+}
+
+func (s *Silence) matches(labels map[string]string) bool {
+	for _, m := range s.matchers {
+		if !m.matches(labels[m.name]) {
+			return false
+		}
+	}
+	return true
+}
+
+func NewSilenceStore(dataDir string) *SilenceStore {
+	ss := &SilenceStore{silences: make(map[string]*Silence)}
+	if dataDir == "" {
+		return ss
+	}
+	ss.path = filepath.Join(dataDir, "silences.json")
+
+	data, err := os.ReadFile(ss.path)
+	if err != nil {
+		return ss
+	}
+	var silences []Silence
+	if err := json.Unmarshal(data, &silences); err != nil {
+		log.Printf("Ignoring unreadable silences: %v", err)
+		return ss
+	}
+	for i := range silences {
+		if err := silences[i].compile(); err != nil {
+			log.Printf("Skipping silence %s: %v", silences[i].ID, err)
+			continue
+		}
+		ss.silences[silences[i].ID] = &silences[i]
+	}
+	return ss
+}
+
+// saveLocked drops long-expired silences and writes the rest out, if the
+// store has a file.
+func (ss *SilenceStore) saveLocked() error {
+	for id, s := range ss.silences {
+		if time.Since(s.EndsAt) > silenceKeepExpired {
+			delete(ss.silences, id)
+		}
+	}
+	if ss.path == "" {
+		return nil
+	}
+	silences := make([]*Silence, 0, len(ss.silences))
+	for _, s := range ss.silences {
+		silences = append(silences, s)
+	}
+	data, err := json.MarshalIndent(silences, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ss.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ss.path)
+}
+
+// Add takes a compiled silence; the error is from saving it.
+func (ss *SilenceStore) Add(s Silence) (Silence, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if s.ID == "" {
+		s.ID = fmt.Sprintf("silence-%d", time.Now().UnixNano())
+	}
+	s.CreatedAt = time.Now()
+	ss.silences[s.ID] = &s
+	return s, ss.saveLocked()
+}
+
+func (ss *SilenceStore) List() []Silence {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+
+	now := time.Now()
+	silences := make([]Silence, 0, len(ss.silences))
+	for _, s := range ss.silences {
+		c := *s
+		c.State = s.state(now)
+		silences = append(silences, c)
+	}
+	sort.Slice(silences, func(i, j int) bool {
+		return silences[i].EndsAt.After(silences[j].EndsAt)
+	})
+	return silences
+}
+
+// Expire ends a silence now. Silences that have not started are removed.
+func (ss *SilenceStore) Expire(id string) (bool, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	s, exists := ss.silences[id]
+	if !exists {
+		return false, nil
+	}
+	now := time.Now()
+	switch s.state(now) {
+	case "pending":
+		delete(ss.silences, id)
+	case "active":
+		s.EndsAt = now
+	}
+	return true, ss.saveLocked()
+}
+
+// Match returns the ID of an active silence covering labels, or "".
+func (ss *SilenceStore) Match(labels map[string]string, now time.Time) string {
+	if ss == nil {
+		return ""
+	}
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+
+	for id, s := range ss.silences {
+		if s.state(now) == "active" && s.matches(labels) {
+			return id
+		}
+	}
+	return ""
+}
+
+// ==================== SILENCE AND HISTORY HANDLERS ====================
+
+func handleSilences(w http.ResponseWriter, r *http.Request, silenceID string) {
+	switch r.Method {
+	case http.MethodGet:
+		silences := silenceStore.List()
+		if state := r.URL.Query().Get("state"); state != "" {
+			filtered := []Silence{}
+			for _, s := range silences {
+				if s.State == state {
+					filtered = append(filtered, s)
+				}
+			}
+			silences = filtered
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"silences": silences,
+			"count":    len(silences),
+			"message":  fmt.Sprintf("%d silences in the chronicles", len(silences)),
+		})
+
+	case http.MethodPost:
+		var req struct {
+			Silence
+			Duration string `json:"duration,omitempty"` // e.g. 2h, instead of ends_at
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		s := req.Silence
+		s.ID = ""
+		if s.StartsAt.IsZero() {
+			s.StartsAt = time.Now()
+		}
+		if req.Duration != "" {
+			d, err := parseLogQLDuration(req.Duration)
+			if err != nil || d <= 0 {
+				http.Error(w, "Invalid duration: "+req.Duration, http.StatusBadRequest)
+				return
+			}
+			s.EndsAt = s.StartsAt.Add(d)
+		}
+		if s.EndsAt.IsZero() {
+			http.Error(w, "ends_at or duration is required", http.StatusBadRequest)
+			return
+		}
+		if !s.EndsAt.After(s.StartsAt) || !s.EndsAt.After(time.Now()) {
+			http.Error(w, "ends_at must be in the future and after starts_at", http.StatusBadRequest)
+			return
+		}
+		if err := s.compile(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		created, err := silenceStore.Add(s)
+		if err != nil {
+			http.Error(w, "Failed to save silences: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		created.State = created.state(time.Now())
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"silence": created,
+			"message": fmt.Sprintf("Alerts matching %s silenced until %s", created.Matchers, created.EndsAt.Format(time.RFC3339)),
+		})
+
+	case http.MethodDelete:
+		if silenceID == "" {
+			http.Error(w, "Silence ID required", http.StatusBadRequest)
+			return
+		}
+		found, err := silenceStore.Expire(silenceID)
+		if err != nil {
+			http.Error(w, "Failed to save silences: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Silence not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Silence expired",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleAlertHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 100
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	entries := alertHistory.List(r.URL.Query().Get("alert_id"), limit)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"history": entries,
+		"count":   len(entries),
+		"message": fmt.Sprintf("%d alert events recalled", len(entries)),
+	})
+}
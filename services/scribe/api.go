@@ -218,11 +218,8 @@ func handleLogsClear(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get current count before clearing
-	store.mu.Lock()
-	clearedCount := len(store.entries)
-	store.entries = make([]LogEntry, 0, defaultMaxLogEntries)
-	store.mu.Unlock()
+	// Clears memory and disk alike
+	clearedCount := store.Clear()
 
 	// Reset volume statistics
 	store.statsMu.Lock()
@@ -298,31 +295,18 @@ func handleLogsBetween(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Get all entries and filter by time range
-	store.mu.RLock()
+	// Filter by time range across memory and disk; segments outside the
+	// range are never read
 	var results []LogEntry
-	for i := len(store.entries) - 1; i >= 0 && len(results) < limit; i-- {
-		entry := store.entries[i]
-
-		// Time filter
-		if entry.Timestamp.Before(startTime) || entry.Timestamp.After(endTime) {
-			continue
-		}
-
-		// Apply other filters
-		if namespace != "" && entry.Namespace != namespace {
-			continue
-		}
-		if level != "" && entry.Level != level {
-			continue
-		}
+	filter := logFilter{Namespace: namespace, Level: level, Pod: pod, Start: startTime, End: endTime}
+	store.scan(filter, true, func(entry LogEntry) bool {
+		// Pod matches exactly here
 		if pod != "" && entry.Pod != pod {
-			continue
+			return true
 		}
-
 		results = append(results, entry)
-	}
-	store.mu.RUnlock()
+		return len(results) < limit
+	})
 
 	duration := endTime.Sub(startTime)
 	scribeSays := ""
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== FIELD EXTRACTION ====================
+//
+// Lines are parsed as they are ingested. JSON objects (what our services'
+// Logger.Log helpers write) and logfmt lines are split into fields, and
+// user-defined rules can pull more fields out of plain text with a regex
+// or grok pattern. Fields are kept on the entry, so they persist with it,
+// and can be filtered, faceted and grouped on like the stream labels.
+
+const (
+	maxEntryFields = 64
+	maxFieldValue  = 1024
+)
+
+// Keys a structured line may use for its level
+var levelFields = []string{"level", "lvl", "severity", "loglevel"}
+
+// ExtractionRule pulls named fields out of matching lines.
+type ExtractionRule struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Namespace   string    `json:"namespace,omitempty"` // Apply to specific namespace, empty = all
+	Type        string    `json:"type"`                // regex or grok
+	Pattern     string    `json:"pattern"`
+	Enabled     bool      `json:"enabled"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	re *regexp.Regexp
+}
+
+// ExtractionRuleStore manages extraction rules. Rules are saved to the
+// log data directory when there is one.
+type ExtractionRuleStore struct {
+	mu    sync.RWMutex
+	rules map[string]*ExtractionRule
+	path  string
+}
+
+// Grok patterns, each usable as %{NAME} or %{NAME:field}
+var grokPatterns = map[string]string{
+	"WORD":              `\b\w+\b`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"INT":               `[+-]?\d+`,
+	"NUMBER":            `[+-]?(?:\d+(?:\.\d+)?|\.\d+)`,
+	"BASE16NUM":         `(?:0[xX])?[0-9A-Fa-f]+`,
+	"UUID":              `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"IPV4":              `(?:\d{1,3}\.){3}\d{1,3}`,
+	"IPV6":              `[0-9A-Fa-f:]*:[0-9A-Fa-f:]+`,
+	"IP":                `(?:(?:\d{1,3}\.){3}\d{1,3}|[0-9A-Fa-f:]*:[0-9A-Fa-f:]+)`,
+	"HOSTNAME":          `\b[0-9A-Za-z][0-9A-Za-z-]{0,62}(?:\.[0-9A-Za-z][0-9A-Za-z-]{0,62})*\.?\b`,
+	"PATH":              `(?:/[^\s?#]*)+`,
+	"URIPATHPARAM":      `/[^\s]*`,
+	"HTTPMETHOD":        `\b(?:GET|HEAD|POST|PUT|PATCH|DELETE|OPTIONS|CONNECT|TRACE)\b`,
+	"LOGLEVEL":          `(?i:trace|debug|info|notice|warn(?:ing)?|err(?:or)?|crit(?:ical)?|fatal|panic)`,
+	"DURATION":          `[+-]?(?:\d+(?:\.\d+)?(?:ns|us|µs|ms|s|m|h))+`,
+	"TIMESTAMP_ISO8601": `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}(?::?\d{2}(?:\.\d+)?)?(?:Z|[+-]\d{2}:?\d{2})?`,
+	"QUOTEDSTRING":      `"(?:[^"\\]|\\.)*"`,
+}
+
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::(\w+))?\}`)
+
+// grokToRegex expands grok references into a regular expression with
+// named groups.
+func grokToRegex(pattern string) (string, error) {
+	var err error
+	re := grokReference.ReplaceAllStringFunc(pattern, func(ref string) string {
+		m := grokReference.FindStringSubmatch(ref)
+		p, ok := grokPatterns[m[1]]
+		if !ok {
+			err = fmt.Errorf("unknown grok pattern %s", m[1])
+			return ref
+		}
+		if m[2] == "" {
+			return "(?:" + p + ")"
+		}
+		return "(?P<" + m[2] + ">" + p + ")"
+	})
+	return re, err
+}
+
+// compile checks a rule and prepares its regular expression.
+func (rule *ExtractionRule) compile() error {
+	if rule.Type == "" {
+		rule.Type = "regex"
+	}
+	pattern := rule.Pattern
+	switch rule.Type {
+	case "regex":
+	case "grok":
+		var err error
+		if pattern, err = grokToRegex(pattern); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("type must be regex or grok")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	named := false
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			named = true
+		}
+	}
+	if !named {
+		return fmt.Errorf("pattern has no named fields")
+	}
+	rule.re = re
+	return nil
+}
+
+func NewExtractionRuleStore(dataDir string) *ExtractionRuleStore {
+	ers := &ExtractionRuleStore{rules: make(map[string]*ExtractionRule)}
+	if dataDir == "" {
+		return ers
+	}
+	ers.path = filepath.Join(dataDir, "extraction-rules.json")
+
+	data, err := os.ReadFile(ers.path)
+	if err != nil {
+		return ers
+	}
+	var rules []ExtractionRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		log.Printf("Ignoring unreadable extraction rules: %v", err)
+		return ers
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			log.Printf("Skipping extraction rule %s: %v", rules[i].ID, err)
+			continue
+		}
+		ers.rules[rules[i].ID] = &rules[i]
+	}
+	return ers
+}
+
+// saveLocked writes the rules out, if the store has a file.
+func (ers *ExtractionRuleStore) saveLocked() error {
+	if ers.path == "" {
+		return nil
+	}
+	rules := make([]*ExtractionRule, 0, len(ers.rules))
+	for _, rule := range ers.rules {
+		rules = append(rules, rule)
+	}
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ers.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ers.path)
+}
+
+// Add and Update take rules that have been compiled; the error is from
+// saving them.
+func (ers *ExtractionRuleStore) Add(rule ExtractionRule) (ExtractionRule, error) {
+	ers.mu.Lock()
+	defer ers.mu.Unlock()
+
+	if rule.ID == "" {
+		rule.ID = fmt.Sprintf("rule-%d", time.Now().UnixNano())
+	}
+	rule.CreatedAt = time.Now()
+	ers.rules[rule.ID] = &rule
+	return rule, ers.saveLocked()
+}
+
+func (ers *ExtractionRuleStore) Get(id string) (*ExtractionRule, bool) {
+	ers.mu.RLock()
+	defer ers.mu.RUnlock()
+	rule, ok := ers.rules[id]
+	return rule, ok
+}
+
+func (ers *ExtractionRuleStore) List() []ExtractionRule {
+	ers.mu.RLock()
+	defer ers.mu.RUnlock()
+
+	rules := make([]ExtractionRule, 0, len(ers.rules))
+	for _, rule := range ers.rules {
+		rules = append(rules, *rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].CreatedAt.Before(rules[j].CreatedAt)
+	})
+	return rules
+}
+
+func (ers *ExtractionRuleStore) Update(rule ExtractionRule) (bool, error) {
+	ers.mu.Lock()
+	defer ers.mu.Unlock()
+
+	existing, exists := ers.rules[rule.ID]
+	if !exists {
+		return false, nil
+	}
+	rule.CreatedAt = existing.CreatedAt
+	ers.rules[rule.ID] = &rule
+	return true, ers.saveLocked()
+}
+
+func (ers *ExtractionRuleStore) Delete(id string) (bool, error) {
+	ers.mu.Lock()
+	defer ers.mu.Unlock()
+
+	if _, exists := ers.rules[id]; !exists {
+		return false, nil
+	}
+	delete(ers.rules, id)
+	return true, ers.saveLocked()
+}
+
+// Extract fills in an entry's fields from its message. A level field in a
+// structured line replaces the level guessed from keywords.
+func (ers *ExtractionRuleStore) Extract(entry *LogEntry) {
+	fields := parseStructured(entry.Message)
+
+	ers.mu.RLock()
+	for _, rule := range ers.rules {
+		if !rule.Enabled || (rule.Namespace != "" && rule.Namespace != entry.Namespace) {
+			continue
+		}
+		m := rule.re.FindStringSubmatch(entry.Message)
+		if m == nil {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]string)
+		}
+		for i, name := range rule.re.SubexpNames() {
+			if name != "" && m[i] != "" {
+				fields[name] = m[i]
+			}
+		}
+	}
+	ers.mu.RUnlock()
+
+	// Fields the sender attached explicitly win over parsed ones
+	if len(entry.Fields) > 0 && fields == nil {
+		fields = make(map[string]string)
+	}
+	for k, v := range entry.Fields {
+		fields[k] = v
+	}
+	if len(fields) == 0 {
+		return
+	}
+	for _, key := range levelFields {
+		if level := normalizeLevel(fields[key]); level != "" {
+			entry.Level = level
+			break
+		}
+	}
+
+	entry.Fields = make(map[string]string, len(fields))
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if len(entry.Fields) == maxEntryFields {
+			break
+		}
+		v := fields[k]
+		if len(v) > maxFieldValue {
+			v = v[:maxFieldValue]
+		}
+		entry.Fields[k] = v
+	}
+}
+
+// parseStructured returns the fields of a JSON or logfmt line, or nil for
+// anything else.
+func parseStructured(message string) map[string]string {
+	trimmed := strings.TrimSpace(message)
+	if strings.HasPrefix(trimmed, "{") && strings.HasSuffix(trimmed, "}") {
+		if fields, err := parseJSONFields(trimmed); err == nil {
+			return fields
+		}
+		return nil
+	}
+	if strings.Count(trimmed, "=") < 2 {
+		return nil
+	}
+	if fields, strict := parseLogfmtFields(trimmed); strict && len(fields) >= 2 {
+		return fields
+	}
+	return nil
+}
+
+// normalizeLevel maps the level names applications use onto scribe's
+// four levels, or returns "" for values it does not recognise.
+func normalizeLevel(level string) string {
+	switch strings.ToUpper(strings.TrimSpace(level)) {
+	case "ERROR", "ERR", "FATAL", "CRITICAL", "CRIT", "PANIC", "ALERT", "EMERG", "EMERGENCY":
+		return "ERROR"
+	case "WARN", "WARNING":
+		return "WARN"
+	case "INFO", "NOTICE", "INFORMATION":
+		return "INFO"
+	case "DEBUG", "TRACE":
+		return "DEBUG"
+	}
+	return ""
+}
+
+// ==================== EXTRACTION RULES HANDLER ====================
+
+func handleExtractionRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check for specific rule ID in path
+	path := strings.TrimPrefix(r.URL.Path, "/api/extraction/rules")
+	ruleID := strings.TrimPrefix(path, "/")
+
+	switch r.Method {
+	case http.MethodGet:
+		if ruleID == "" {
+			rules := extractionStore.List()
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"rules":   rules,
+				"count":   len(rules),
+				"message": fmt.Sprintf("%d extraction rules configured", len(rules)),
+			})
+		} else {
+			rule, exists := extractionStore.Get(ruleID)
+			if !exists {
+				http.Error(w, "Rule not found", http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(rule)
+		}
+
+	case http.MethodPost:
+		var rule ExtractionRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if rule.Pattern == "" {
+			http.Error(w, "pattern is required", http.StatusBadRequest)
+			return
+		}
+		if rule.Name == "" {
+			rule.Name = "Unnamed Rule"
+		}
+		rule.Enabled = true
+		if err := rule.compile(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		created, err := extractionStore.Add(rule)
+		if err != nil {
+			http.Error(w, "Failed to save rules: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rule":    created,
+			"message": fmt.Sprintf("Extraction rule '%s' created; it applies to new entries", created.Name),
+		})
+
+	case http.MethodPut:
+		if ruleID == "" {
+			http.Error(w, "Rule ID required", http.StatusBadRequest)
+			return
+		}
+
+		var rule ExtractionRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rule.ID = ruleID
+
+		if err := rule.compile(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updated, err := extractionStore.Update(rule)
+		if err != nil {
+			http.Error(w, "Failed to save rules: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !updated {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rule":    rule,
+			"message": "Extraction rule updated",
+		})
+
+	case http.MethodDelete:
+		if ruleID == "" {
+			http.Error(w, "Rule ID required", http.StatusBadRequest)
+			return
+		}
+
+		deleted, err := extractionStore.Delete(ruleID)
+		if err != nil {
+			http.Error(w, "Failed to save rules: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Extraction rule removed",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
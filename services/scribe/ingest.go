@@ -0,0 +1,852 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== PUSH INGESTION ====================
+//
+// Besides the pod logs scribe pulls, sources outside the cluster push logs
+// in: the HTTP push API (which also accepts the JSON form of Loki's push
+// format), syslog over UDP and TCP, and OTLP/HTTP with JSON encoding.
+// Everything goes through one bounded queue drained into LogStore.Add.
+// Each sending host has a token bucket; HTTP senders are told to back off
+// with 429 when theirs is empty or the queue stays full, TCP syslog
+// senders block, and UDP datagrams are dropped and counted.
+
+const (
+	defaultIngestQueue = 10000
+	defaultIngestRate  = 1000 // Lines per second per source
+	defaultIngestBurst = 2000
+	defaultSyslogPort  = "5514"
+	maxPushBody        = 10 << 20
+
+	// How long an HTTP batch may wait for the queue to drain before the
+	// sender is told to retry
+	pushWait = 5 * time.Second
+
+	// Senders tracked at once, and how long an idle one is remembered
+	maxIngestSources = 1000
+	sourceIdleTTL    = time.Hour
+)
+
+var (
+	errRateLimited = errors.New("rate limit exceeded")
+	errQueueFull   = errors.New("ingest queue full")
+)
+
+// SourceStats counts what one source has sent.
+type SourceStats struct {
+	Source   string    `json:"source"`
+	Accepted int64     `json:"accepted"`
+	Rejected int64     `json:"rejected"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Ingester queues pushed entries and rate limits their sources.
+type Ingester struct {
+	queue chan LogEntry
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	stats   map[string]*SourceStats
+}
+
+func NewIngester(queueSize int, rate, burst float64) *Ingester {
+	return &Ingester{
+		queue:   make(chan LogEntry, queueSize),
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+		stats:   make(map[string]*SourceStats),
+	}
+}
+
+// Run drains the queue into the store.
+func (in *Ingester) Run() {
+	for entry := range in.queue {
+		store.Add(entry)
+	}
+}
+
+// Expire periodically forgets idle senders, so hosts that come and go do
+// not grow the bucket and stats maps without bound.
+func (in *Ingester) Expire() {
+	for range time.Tick(time.Minute) {
+		in.mu.Lock()
+		in.pruneLocked(time.Now())
+		in.mu.Unlock()
+	}
+}
+
+// pruneLocked drops buckets that have refilled, which behave the same as
+// a new one, and stats for senders idle longer than sourceIdleTTL.
+func (in *Ingester) pruneLocked(now time.Time) {
+	refill := time.Duration(in.burst / in.rate * float64(time.Second))
+	for source, b := range in.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(in.buckets, source)
+		}
+	}
+	for source, s := range in.stats {
+		if now.Sub(s.LastSeen) > sourceIdleTTL {
+			delete(in.stats, source)
+		}
+	}
+}
+
+// admit takes n tokens from a source's bucket. A batch larger than the
+// bucket is let through once the bucket is full and leaves it in debt, so
+// big batches are slowed down rather than refused forever.
+func (in *Ingester) admit(source string, n int) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	now := time.Now()
+	b, ok := in.buckets[source]
+	if !ok {
+		if len(in.buckets) >= maxIngestSources {
+			in.pruneLocked(now)
+		}
+		b = &tokenBucket{tokens: in.burst, last: now}
+		in.buckets[source] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * in.rate
+	if b.tokens > in.burst {
+		b.tokens = in.burst
+	}
+	b.last = now
+
+	if b.tokens < float64(n) && b.tokens < in.burst {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+func (in *Ingester) record(source string, accepted, rejected int) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	s, ok := in.stats[source]
+	if !ok {
+		if len(in.stats) >= maxIngestSources {
+			in.pruneLocked(time.Now())
+		}
+		if len(in.stats) >= maxIngestSources {
+			// Still full of active senders: count the rest together
+			source = "other"
+			if s, ok = in.stats[source]; !ok {
+				s = &SourceStats{Source: source}
+				in.stats[source] = s
+			}
+		} else {
+			s = &SourceStats{Source: source}
+			in.stats[source] = s
+		}
+	}
+	s.Accepted += int64(accepted)
+	s.Rejected += int64(rejected)
+	s.LastSeen = time.Now()
+}
+
+// Push queues a batch from source. The whole batch is refused if the
+// source is over its rate. Otherwise entries are queued as room frees up,
+// waiting up to wait in total, so a batch larger than the queue goes in as
+// the store drains it rather than being refused every time. Entries still
+// unqueued when wait runs out are dropped and errQueueFull returned. The
+// number queued is returned either way, since those are not to be resent.
+func (in *Ingester) Push(source string, entries []LogEntry, wait time.Duration) (int, error) {
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	if !in.admit(source, len(entries)) {
+		in.record(source, 0, len(entries))
+		return 0, errRateLimited
+	}
+	var deadline <-chan time.Time
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		deadline = t.C
+	}
+	for i, e := range entries {
+		select {
+		case in.queue <- e:
+			continue
+		default:
+		}
+		if deadline == nil {
+			in.record(source, i, len(entries)-i)
+			return i, errQueueFull
+		}
+		select {
+		case in.queue <- e:
+		case <-deadline:
+			in.record(source, i, len(entries)-i)
+			return i, errQueueFull
+		}
+	}
+	in.record(source, len(entries), 0)
+	return len(entries), nil
+}
+
+// PushBlocking queues entries for senders that can be slowed down, like a
+// TCP stream, waiting for both the rate limit and queue space.
+func (in *Ingester) PushBlocking(source string, entry LogEntry) {
+	for !in.admit(source, 1) {
+		time.Sleep(time.Second / time.Duration(in.rate+1))
+	}
+	in.queue <- entry
+	in.record(source, 1, 0)
+}
+
+func (in *Ingester) Stats() []SourceStats {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	stats := make([]SourceStats, 0, len(in.stats))
+	for _, s := range in.stats {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Source < stats[j].Source })
+	return stats
+}
+
+// newPushedEntry builds an entry from labels. namespace, pod, container
+// and level map onto the entry, anything else becomes a field.
+func newPushedEntry(ts time.Time, line string, labels map[string]string, defaultNamespace string) LogEntry {
+	entry := LogEntry{
+		Timestamp: ts,
+		Namespace: defaultNamespace,
+		Message:   line,
+	}
+	for k, v := range labels {
+		switch k {
+		case "namespace":
+			entry.Namespace = v
+		case "pod", "host", "hostname":
+			if entry.Pod == "" || k == "pod" {
+				entry.Pod = v
+			}
+		case "container", "app", "job":
+			if entry.Container == "" || k == "container" {
+				entry.Container = v
+			}
+		case "level":
+			entry.Level = normalizeLevel(v)
+		default:
+			if entry.Fields == nil {
+				entry.Fields = make(map[string]string)
+			}
+			entry.Fields[k] = v
+		}
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	if entry.Level == "" {
+		entry.Level = detectLogLevel(line)
+	}
+	return entry
+}
+
+// peerHost names a sender for rate limiting by the address it connected
+// from. Labels and forwarding headers are chosen by the sender, so keying
+// on them would let one sender claim a fresh bucket per request.
+func peerHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// pushBody returns the request body, decompressed if the sender gzipped
+// it, limited to maxPushBody.
+func pushBody(r *http.Request) (io.Reader, error) {
+	body := io.Reader(r.Body)
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = zr
+	}
+	return io.LimitReader(body, maxPushBody), nil
+}
+
+// respondIngest reports a queueing error the way HTTP senders expect. A
+// batch that was partly queued succeeds with the counts instead, because
+// a sender retrying the whole batch would store the queued part twice.
+func respondIngest(w http.ResponseWriter, err error, accepted, total int) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil && accepted == 0 {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if total == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	resp := map[string]interface{}{"accepted": accepted}
+	if err != nil {
+		resp["rejected"] = total - accepted
+		resp["error"] = err.Error()
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// PushRequest is a batch of streams, each a set of labels and its lines.
+// The JSON form of Loki's push format ("stream" and "values" of
+// [nanoseconds, line]) is accepted as well. The protobuf form, which
+// promtail always sends, is not; senders need a JSON encoding option,
+// such as Vector's loki sink with encoding json.
+type PushRequest struct {
+	Streams []PushStream `json:"streams"`
+}
+
+type PushStream struct {
+	Labels  map[string]string `json:"labels"`
+	Entries []PushEntry       `json:"entries"`
+
+	Stream map[string]string `json:"stream"`
+	Values [][]string        `json:"values"`
+}
+
+type PushEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Line      string    `json:"line"`
+}
+
+func handlePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/json") {
+		http.Error(w, "Only JSON push requests are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := pushBody(r)
+	if err != nil {
+		http.Error(w, "Invalid gzip body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req PushRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var entries []LogEntry
+	for _, s := range req.Streams {
+		labels := s.Labels
+		if labels == nil {
+			labels = s.Stream
+		}
+		for _, e := range s.Entries {
+			if e.Line != "" {
+				entries = append(entries, newPushedEntry(e.Timestamp, e.Line, labels, "external"))
+			}
+		}
+		for _, v := range s.Values {
+			if len(v) < 2 || v[1] == "" {
+				continue
+			}
+			var ts time.Time
+			if ns, err := strconv.ParseInt(v[0], 10, 64); err == nil {
+				ts = time.Unix(0, ns)
+			}
+			entries = append(entries, newPushedEntry(ts, v[1], labels, "external"))
+		}
+	}
+
+	queued, err := ingester.Push(peerHost(r.RemoteAddr), entries, pushWait)
+	respondIngest(w, err, queued, len(entries))
+}
+
+func handleIngestStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"queued":         len(ingester.queue),
+		"queue_capacity": cap(ingester.queue),
+		"rate_per_sec":   ingester.rate,
+		"burst":          ingester.burst,
+		"sources":        ingester.Stats(),
+	})
+}
+
+// ==================== SYSLOG ====================
+
+// Syslog severities 0-7 mapped onto scribe levels
+var syslogLevels = []string{"ERROR", "ERROR", "ERROR", "ERROR", "WARN", "INFO", "INFO", "DEBUG"}
+
+var syslogFacilities = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+
+// parseSyslog reads an RFC 5424 message, falling back to the older BSD
+// format (RFC 3164) that many devices still send.
+func parseSyslog(msg string, namespace string) (LogEntry, error) {
+	msg = strings.TrimRight(msg, "\r\n\x00")
+	if !strings.HasPrefix(msg, "<") {
+		return LogEntry{}, fmt.Errorf("missing priority")
+	}
+	end := strings.IndexByte(msg, '>')
+	if end < 2 || end > 4 {
+		return LogEntry{}, fmt.Errorf("invalid priority")
+	}
+	pri, err := strconv.Atoi(msg[1:end])
+	if err != nil || pri > 191 {
+		return LogEntry{}, fmt.Errorf("invalid priority")
+	}
+	rest := msg[end+1:]
+
+	entry := LogEntry{
+		Namespace: namespace,
+		Level:     syslogLevels[pri%8],
+		Fields:    map[string]string{"facility": syslogFacilities[pri/8]},
+	}
+
+	if strings.HasPrefix(rest, "1 ") {
+		parseSyslog5424(rest[2:], &entry)
+	} else {
+		parseSyslog3164(rest, &entry)
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	return entry, nil
+}
+
+// parseSyslog5424 reads TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+// STRUCTURED-DATA MSG, where "-" marks an empty field.
+func parseSyslog5424(rest string, entry *LogEntry) {
+	header := strings.SplitN(rest, " ", 6)
+	for len(header) < 6 {
+		header = append(header, "-")
+	}
+	field := func(v string) string {
+		if v == "-" {
+			return ""
+		}
+		return v
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, header[0]); err == nil {
+		entry.Timestamp = ts
+	}
+	entry.Pod = field(header[1])
+	entry.Container = field(header[2])
+	if v := field(header[3]); v != "" {
+		entry.Fields["procid"] = v
+	}
+	if v := field(header[4]); v != "" {
+		entry.Fields["msgid"] = v
+	}
+
+	body := header[5]
+	if strings.HasPrefix(body, "-") {
+		body = strings.TrimPrefix(strings.TrimPrefix(body, "-"), " ")
+	} else {
+		body = parseStructuredData(body, entry.Fields)
+	}
+	// A UTF-8 byte order mark may precede the message
+	entry.Message = strings.TrimPrefix(body, "\ufeff")
+}
+
+// parseStructuredData reads [id key="value" ...] elements into fields
+// named id.key and returns the message after them.
+func parseStructuredData(s string, fields map[string]string) string {
+	for strings.HasPrefix(s, "[") {
+		i := 1
+		for i < len(s) && s[i] != ' ' && s[i] != ']' {
+			i++
+		}
+		id := s[1:i]
+		for i < len(s) && s[i] != ']' {
+			for i < len(s) && s[i] == ' ' {
+				i++
+			}
+			start := i
+			for i < len(s) && s[i] != '=' && s[i] != ']' {
+				i++
+			}
+			name := s[start:i]
+			if i >= len(s) || s[i] != '=' || i+1 >= len(s) || s[i+1] != '"' {
+				break
+			}
+			i += 2
+			var value strings.Builder
+			for i < len(s) && s[i] != '"' {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+				i++
+			}
+			i++
+			fields[sanitizeLabel(id+"."+name)] = value.String()
+		}
+		if i >= len(s) {
+			return ""
+		}
+		s = s[i+1:]
+	}
+	return strings.TrimPrefix(s, " ")
+}
+
+// parseSyslog3164 reads "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG". The
+// timestamp has no year or zone, so the current year and local time are
+// assumed.
+func parseSyslog3164(rest string, entry *LogEntry) {
+	if len(rest) >= 16 && rest[15] == ' ' {
+		if ts, err := time.ParseInLocation(time.Stamp, rest[:15], time.Local); err == nil {
+			now := time.Now()
+			ts = ts.AddDate(now.Year(), 0, 0)
+			// Late December messages read in early January
+			if ts.After(now.Add(24 * time.Hour)) {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			entry.Timestamp = ts
+			rest = rest[16:]
+			if host, after, ok := strings.Cut(rest, " "); ok {
+				entry.Pod = host
+				rest = after
+			}
+		}
+	}
+
+	if tag, after, ok := strings.Cut(rest, ": "); ok && !strings.ContainsAny(tag, " ") {
+		if name, pid, ok := strings.Cut(tag, "["); ok {
+			tag = name
+			entry.Fields["procid"] = strings.TrimSuffix(pid, "]")
+		}
+		entry.Container = tag
+		rest = after
+	}
+	entry.Message = rest
+}
+
+// syslogSource names a syslog sender for rate limiting by its address;
+// the hostname in the message is whatever the sender wrote there.
+func syslogSource(addr net.Addr) string {
+	return "syslog/" + peerHost(addr.String())
+}
+
+// startSyslog listens for syslog on UDP and TCP on the same port.
+func startSyslog(port, namespace string) error {
+	pc, err := net.ListenPacket("udp", ":"+port)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	go serveSyslogUDP(pc, namespace)
+	go serveSyslogTCP(ln, namespace)
+	log.Printf("Syslog listening on port %s (udp, tcp)", port)
+	return nil
+}
+
+func serveSyslogUDP(pc net.PacketConn, namespace string) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Syslog UDP read failed: %v", err)
+			return
+		}
+		entry, err := parseSyslog(string(buf[:n]), namespace)
+		if err != nil {
+			continue
+		}
+		// Datagrams cannot be slowed down, only dropped
+		ingester.Push(syslogSource(addr), []LogEntry{entry}, 0)
+	}
+}
+
+func serveSyslogTCP(ln net.Listener, namespace string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Syslog TCP accept failed: %v", err)
+			return
+		}
+		go handleSyslogConn(conn, namespace)
+	}
+}
+
+// handleSyslogConn reads one TCP stream, framed either by octet counting
+// (RFC 6587 "LEN MSG") or by newlines.
+func handleSyslogConn(conn net.Conn, namespace string) {
+	defer conn.Close()
+	r := bufio.NewReaderSize(conn, 64*1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
+		first, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+
+		var msg string
+		if first[0] >= '1' && first[0] <= '9' {
+			lenStr, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(lenStr))
+			if err != nil || n <= 0 || n > 1<<20 {
+				return
+			}
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			msg = string(buf)
+		} else {
+			line, err := r.ReadString('\n')
+			if err != nil && line == "" {
+				return
+			}
+			msg = line
+		}
+
+		entry, err := parseSyslog(msg, namespace)
+		if err != nil {
+			continue
+		}
+		// Blocking here applies backpressure through TCP flow control
+		ingester.PushBlocking(syslogSource(conn.RemoteAddr()), entry)
+	}
+}
+
+// ==================== OTLP ====================
+
+// OTLP/HTTP logs in the JSON encoding, optionally gzipped. Only the
+// fields scribe uses are declared.
+type otlpLogsRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			LogRecords []otlpLogRecord `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string         `json:"timeUnixNano"`
+	ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+	TraceID              string         `json:"traceId"`
+	SpanID               string         `json:"spanId"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string          `json:"stringValue,omitempty"`
+	BoolValue   *bool            `json:"boolValue,omitempty"`
+	IntValue    json.RawMessage  `json:"intValue,omitempty"` // A string or number in OTLP JSON
+	DoubleValue *float64         `json:"doubleValue,omitempty"`
+	ArrayValue  *json.RawMessage `json:"arrayValue,omitempty"`
+	KvlistValue *json.RawMessage `json:"kvlistValue,omitempty"`
+}
+
+func (v otlpAnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case len(v.IntValue) > 0:
+		return strings.Trim(string(v.IntValue), `"`)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'f', -1, 64)
+	case v.ArrayValue != nil:
+		return string(*v.ArrayValue)
+	case v.KvlistValue != nil:
+		return string(*v.KvlistValue)
+	}
+	return ""
+}
+
+// otlpLevel maps an OTLP severity onto scribe levels.
+func otlpLevel(rec otlpLogRecord) string {
+	switch n := rec.SeverityNumber; {
+	case n >= 17:
+		return "ERROR"
+	case n >= 13:
+		return "WARN"
+	case n >= 9:
+		return "INFO"
+	case n >= 1:
+		return "DEBUG"
+	}
+	return normalizeLevel(rec.SeverityText)
+}
+
+func otlpTime(nanos string) time.Time {
+	if n, err := strconv.ParseInt(nanos, 10, 64); err == nil && n > 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+// handleOTLPLogs receives OTLP/HTTP log exports. Kubernetes resource
+// attributes become the namespace, pod and container; other attributes
+// become fields.
+func handleOTLPLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/json") {
+		http.Error(w, "Only the OTLP JSON encoding is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := pushBody(r)
+	if err != nil {
+		http.Error(w, "Invalid gzip body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req otlpLogsRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var entries []LogEntry
+	for _, rl := range req.ResourceLogs {
+		resource := make(map[string]string)
+		for _, kv := range rl.Resource.Attributes {
+			resource[kv.Key] = kv.Value.String()
+		}
+
+		base := LogEntry{Namespace: "otlp"}
+		for _, k := range []string{"service.namespace", "k8s.namespace.name"} {
+			if v := resource[k]; v != "" {
+				base.Namespace = v
+			}
+		}
+		for _, k := range []string{"service.name", "host.name", "k8s.pod.name"} {
+			if v := resource[k]; v != "" {
+				base.Pod = v
+			}
+		}
+		for _, k := range []string{"service.name", "k8s.container.name"} {
+			if v := resource[k]; v != "" {
+				base.Container = v
+			}
+		}
+
+		for _, sl := range rl.ScopeLogs {
+			for _, rec := range sl.LogRecords {
+				entry := base
+				entry.Message = rec.Body.String()
+				if entry.Message == "" {
+					continue
+				}
+				entry.Timestamp = otlpTime(rec.TimeUnixNano)
+				if entry.Timestamp.IsZero() {
+					entry.Timestamp = otlpTime(rec.ObservedTimeUnixNano)
+				}
+				if entry.Timestamp.IsZero() {
+					entry.Timestamp = time.Now()
+				}
+				if entry.Level = otlpLevel(rec); entry.Level == "" {
+					entry.Level = detectLogLevel(entry.Message)
+				}
+
+				entry.Fields = make(map[string]string)
+				for _, kv := range rec.Attributes {
+					entry.Fields[sanitizeLabel(kv.Key)] = kv.Value.String()
+				}
+				if rec.TraceID != "" {
+					entry.Fields["trace_id"] = rec.TraceID
+				}
+				if rec.SpanID != "" {
+					entry.Fields["span_id"] = rec.SpanID
+				}
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	queued, err := ingester.Push("otlp/"+peerHost(r.RemoteAddr), entries, pushWait)
+	if err != nil && queued == 0 {
+		respondIngest(w, err, 0, len(entries))
+		return
+	}
+	// An empty partialSuccess means everything was accepted
+	partial := map[string]interface{}{}
+	if err != nil {
+		partial["rejectedLogRecords"] = strconv.Itoa(len(entries) - queued)
+		partial["errorMessage"] = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"partialSuccess": partial})
+}
+
+// initIngest starts the ingest queue and the syslog receiver.
+func initIngest() {
+	queueSize := envInt("INGEST_QUEUE", defaultIngestQueue)
+	rate := envInt("INGEST_RATE", defaultIngestRate)
+	burst := envInt("INGEST_BURST", defaultIngestBurst)
+	ingester = NewIngester(queueSize, float64(rate), float64(burst))
+	go ingester.Run()
+	go ingester.Expire()
+
+	port := os.Getenv("SYSLOG_PORT")
+	if port == "" {
+		port = defaultSyslogPort
+	}
+	if port == "off" {
+		return
+	}
+	namespace := os.Getenv("SYSLOG_NAMESPACE")
+	if namespace == "" {
+		namespace = "syslog"
+	}
+	if err := startSyslog(port, namespace); err != nil {
+		log.Printf("Failed to start syslog receiver: %v", err)
+	}
+}
+
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
@@ -0,0 +1,1038 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ==================== LOGQL ====================
+//
+// A subset of Loki's LogQL. A log query selects streams by label and then
+// runs each line through a pipeline:
+//
+//	{namespace="holm", level="ERROR"} != "healthz" | json | latency_ms > 500
+//
+// Stream labels are namespace, pod, container and level. Line filters are
+// |= (contains), != (does not contain), |~ and !~ (regex). The json and
+// logfmt stages extract fields from the line as extra labels, and a label
+// filter compares labels against strings (=, !=, =~, !~), numbers or
+// durations (==, !=, >, >=, <, <=), combined with "and", "or" or commas.
+//
+// A metric query wraps a log query in a range function and optionally an
+// aggregation:
+//
+//	sum by (namespace) (rate({level="ERROR"}[5m]))
+//
+// Range functions are rate, count_over_time, bytes_rate and
+// bytes_over_time; aggregations are sum, count, avg, min and max, grouped
+// by or without labels.
+
+// Maximum points per series in a metric query
+const maxMetricSteps = 11000
+
+var (
+	rangeFunctions = map[string]bool{"rate": true, "count_over_time": true, "bytes_rate": true, "bytes_over_time": true}
+	aggregations   = map[string]bool{"sum": true, "count": true, "avg": true, "min": true, "max": true}
+)
+
+// LogQLQuery is a parsed query: exactly one of Log and Metric is set.
+type LogQLQuery struct {
+	Log    *LogQuery
+	Metric *MetricQuery
+}
+
+// LogQuery is a stream selector and its pipeline.
+type LogQuery struct {
+	matchers []labelMatcher
+	stages   []logStage
+}
+
+// MetricQuery counts the lines a log query matches over a sliding range.
+type MetricQuery struct {
+	Func    string
+	Range   time.Duration
+	Log     *LogQuery
+	Agg     string // Empty for a bare range function
+	By      []string
+	Without bool
+}
+
+// MetricSeries is one labelled series of a metric query result.
+type MetricSeries struct {
+	Labels map[string]string `json:"labels"`
+	Points []MetricPoint     `json:"points"`
+}
+
+type MetricPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+type lineFilter struct {
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+// A logStage is a line filter, a parser or a label filter.
+type logStage struct {
+	filter *lineFilter
+	parser string
+	fields *fieldExpr
+}
+
+type fieldKind int
+
+const (
+	fieldString fieldKind = iota
+	fieldNumber
+	fieldDuration
+)
+
+// fieldExpr is a tree of label comparisons joined by "and" and "or".
+type fieldExpr struct {
+	op          string // and, or, or empty for a comparison
+	left, right *fieldExpr
+
+	name string
+	cmp  string
+	kind fieldKind
+	str  string
+	num  float64
+	dur  time.Duration
+	re   *regexp.Regexp
+}
+
+// ParseLogQL parses a log or metric query.
+func ParseLogQL(s string) (*LogQLQuery, error) {
+	toks, err := lexLogQL(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &logqlParser{toks: toks}
+
+	q := &LogQLQuery{}
+	if t := p.peek(); t.kind == tokIdent && (rangeFunctions[t.val] || aggregations[t.val]) {
+		q.Metric, err = p.parseMetric()
+	} else {
+		q.Log, err = p.parseLog()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.val, t.pos)
+	}
+	return q, nil
+}
+
+// ==================== LEXER ====================
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokDuration
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	val  string
+	pos  int
+}
+
+// Longest operators first so "|=" is not read as "|"
+var logqlOperators = []string{"|=", "|~", "!=", "!~", "==", "=~", ">=", "<=", "{", "}", "(", ")", "[", "]", ",", "|", "=", ">", "<"}
+
+func lexLogQL(s string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '`':
+			end := i + 1
+			for end < len(s) && s[end] != c {
+				if c == '"' && s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			val := s[i+1 : end]
+			if c == '"' {
+				var err error
+				if val, err = strconv.Unquote(s[i : end+1]); err != nil {
+					return nil, fmt.Errorf("invalid string at position %d", i)
+				}
+			}
+			toks = append(toks, token{tokString, val, i})
+			i = end + 1
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9' || c == '.':
+			end := i + 1
+			hasLetter := false
+			for end < len(s) && (s[end] == '.' || s[end] >= '0' && s[end] <= '9' || unicode.IsLetter(rune(s[end]))) {
+				if unicode.IsLetter(rune(s[end])) {
+					hasLetter = true
+				}
+				end++
+			}
+			kind := tokNumber
+			if hasLetter {
+				if _, err := parseLogQLDuration(s[i:end]); err != nil {
+					return nil, fmt.Errorf("invalid duration %q at position %d", s[i:end], i)
+				}
+				kind = tokDuration
+			} else if _, err := strconv.ParseFloat(s[i:end], 64); err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", s[i:end], i)
+			}
+			toks = append(toks, token{kind, s[i:end], i})
+			i = end
+		case c == '_' || unicode.IsLetter(rune(c)):
+			end := i + 1
+			for end < len(s) && (s[end] == '_' || s[end] == '.' || s[end] >= '0' && s[end] <= '9' || unicode.IsLetter(rune(s[end]))) {
+				end++
+			}
+			toks = append(toks, token{tokIdent, s[i:end], i})
+			i = end
+		default:
+			matched := false
+			for _, op := range logqlOperators {
+				if strings.HasPrefix(s[i:], op) {
+					toks = append(toks, token{tokOp, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+		}
+	}
+	return append(toks, token{tokEOF, "", len(s)}), nil
+}
+
+// parseLogQLDuration accepts Go durations plus d and w suffixes.
+func parseLogQLDuration(s string) (time.Duration, error) {
+	for _, unit := range []struct {
+		suffix string
+		d      time.Duration
+	}{{"d", 24 * time.Hour}, {"w", 7 * 24 * time.Hour}} {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, unit.suffix)); err == nil && strings.HasSuffix(s, unit.suffix) {
+			return time.Duration(n) * unit.d, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// ==================== PARSER ====================
+
+type logqlParser struct {
+	toks []token
+	pos  int
+}
+
+func (p *logqlParser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *logqlParser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *logqlParser) expect(op string) error {
+	if t := p.next(); t.kind != tokOp || t.val != op {
+		return p.unexpected(t, op)
+	}
+	return nil
+}
+
+func (p *logqlParser) unexpected(t token, want string) error {
+	if t.kind == tokEOF {
+		return fmt.Errorf("expected %s at end of query", want)
+	}
+	return fmt.Errorf("expected %s at position %d, got %q", want, t.pos, t.val)
+}
+
+func (p *logqlParser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.val == op
+}
+
+func (p *logqlParser) parseMetric() (*MetricQuery, error) {
+	name := p.next().val
+	if rangeFunctions[name] {
+		return p.parseRange(name)
+	}
+
+	m := &MetricQuery{Agg: name}
+	if err := p.parseGrouping(m); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	t := p.next()
+	if t.kind != tokIdent || !rangeFunctions[t.val] {
+		return nil, p.unexpected(t, "range function")
+	}
+	inner, err := p.parseRange(t.val)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if m.By == nil {
+		if err := p.parseGrouping(m); err != nil {
+			return nil, err
+		}
+	}
+	m.Func, m.Range, m.Log = inner.Func, inner.Range, inner.Log
+	return m, nil
+}
+
+// parseGrouping reads an optional "by (a, b)" or "without (a, b)".
+func (p *logqlParser) parseGrouping(m *MetricQuery) error {
+	t := p.peek()
+	if t.kind != tokIdent || (t.val != "by" && t.val != "without") {
+		return nil
+	}
+	p.next()
+	m.Without = t.val == "without"
+	m.By = []string{}
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !p.isOp(")") {
+		l := p.next()
+		if l.kind != tokIdent {
+			return p.unexpected(l, "label name")
+		}
+		m.By = append(m.By, l.val)
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	return p.expect(")")
+}
+
+func (p *logqlParser) parseRange(name string) (*MetricQuery, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	log, err := p.parseLog()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	t := p.next()
+	if t.kind != tokDuration {
+		return nil, p.unexpected(t, "range duration")
+	}
+	d, _ := parseLogQLDuration(t.val)
+	if d <= 0 {
+		return nil, fmt.Errorf("range must be positive")
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return &MetricQuery{Func: name, Range: d, Log: log}, nil
+}
+
+func (p *logqlParser) parseLog() (*LogQuery, error) {
+	q := &LogQuery{}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for !p.isOp("}") {
+		m, err := p.parseMatcher()
+		if err != nil {
+			return nil, err
+		}
+		q.matchers = append(q.matchers, m)
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokOp {
+			break
+		}
+		switch t.val {
+		case "|=", "!=", "|~", "!~":
+			p.next()
+			v := p.next()
+			if v.kind != tokString {
+				return nil, p.unexpected(v, "string")
+			}
+			f := &lineFilter{op: t.val, value: v.val}
+			if t.val == "|~" || t.val == "!~" {
+				re, err := regexp.Compile(v.val)
+				if err != nil {
+					return nil, fmt.Errorf("invalid regex %q: %v", v.val, err)
+				}
+				f.re = re
+			}
+			q.stages = append(q.stages, logStage{filter: f})
+		case "|":
+			p.next()
+			if t := p.peek(); t.kind == tokIdent && (t.val == "json" || t.val == "logfmt") {
+				p.next()
+				q.stages = append(q.stages, logStage{parser: t.val})
+				continue
+			}
+			expr, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			q.stages = append(q.stages, logStage{fields: expr})
+		default:
+			return q, nil
+		}
+	}
+	return q, nil
+}
+
+func (p *logqlParser) parseMatcher() (labelMatcher, error) {
+	name := p.next()
+	if name.kind != tokIdent {
+		return labelMatcher{}, p.unexpected(name, "label name")
+	}
+	op := p.next()
+	if op.kind != tokOp || (op.val != "=" && op.val != "!=" && op.val != "=~" && op.val != "!~") {
+		return labelMatcher{}, p.unexpected(op, "=, !=, =~ or !~")
+	}
+	v := p.next()
+	if v.kind != tokString {
+		return labelMatcher{}, p.unexpected(v, "string")
+	}
+
+	m := labelMatcher{name: name.val, op: op.val, value: v.val}
+	// Levels are stored upper case, whatever the application logged
+	if m.name == "level" && (m.op == "=" || m.op == "!=") {
+		m.value = strings.ToUpper(m.value)
+	}
+	if m.op == "=~" || m.op == "!~" {
+		re, err := regexp.Compile("^(?:" + v.val + ")$")
+		if err != nil {
+			return labelMatcher{}, fmt.Errorf("invalid regex %q: %v", v.val, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+func (p *logqlParser) parseOr() (*fieldExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == tokIdent && t.val == "or"; t = p.peek() {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &fieldExpr{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *logqlParser) parseAnd() (*fieldExpr, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == tokIdent && t.val == "and" || p.isOp(","); t = p.peek() {
+		p.next()
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		left = &fieldExpr{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *logqlParser) parseComparison() (*fieldExpr, error) {
+	if p.isOp("(") {
+		p.next()
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	}
+
+	name := p.next()
+	if name.kind != tokIdent {
+		return nil, p.unexpected(name, "label name")
+	}
+	op := p.next()
+	if op.kind != tokOp {
+		return nil, p.unexpected(op, "comparison")
+	}
+	v := p.next()
+	e := &fieldExpr{name: name.val, cmp: op.val}
+
+	switch v.kind {
+	case tokString:
+		e.kind, e.str = fieldString, v.val
+		switch op.val {
+		case "=", "==", "!=":
+		case "=~", "!~":
+			re, err := regexp.Compile("^(?:" + v.val + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %q: %v", v.val, err)
+			}
+			e.re = re
+		default:
+			return nil, fmt.Errorf("operator %s cannot compare strings", op.val)
+		}
+	case tokNumber, tokDuration:
+		switch op.val {
+		case "=", "==", "!=", ">", ">=", "<", "<=":
+		default:
+			return nil, fmt.Errorf("operator %s cannot compare numbers", op.val)
+		}
+		if v.kind == tokNumber {
+			e.kind = fieldNumber
+			e.num, _ = strconv.ParseFloat(v.val, 64)
+		} else {
+			e.kind = fieldDuration
+			e.dur, _ = parseLogQLDuration(v.val)
+		}
+	default:
+		return nil, p.unexpected(v, "value")
+	}
+	return e, nil
+}
+
+// ==================== EVALUATION ====================
+
+// streamLabels are the labels every entry carries.
+func streamLabels(e LogEntry) map[string]string {
+	return map[string]string{
+		"namespace": e.Namespace,
+		"pod":       e.Pod,
+		"container": e.Container,
+		"level":     e.Level,
+	}
+}
+
+func (m labelMatcher) matches(v string) bool {
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	default:
+		return !m.re.MatchString(v)
+	}
+}
+
+func (f *lineFilter) matches(line string) bool {
+	switch f.op {
+	case "|=":
+		return strings.Contains(line, f.value)
+	case "!=":
+		return !strings.Contains(line, f.value)
+	case "|~":
+		return f.re.MatchString(line)
+	default:
+		return !f.re.MatchString(line)
+	}
+}
+
+func (e *fieldExpr) eval(labels map[string]string) bool {
+	switch e.op {
+	case "and":
+		return e.left.eval(labels) && e.right.eval(labels)
+	case "or":
+		return e.left.eval(labels) || e.right.eval(labels)
+	}
+
+	v := labels[e.name]
+	var diff float64
+	switch e.kind {
+	case fieldString:
+		switch e.cmp {
+		case "=~":
+			return e.re.MatchString(v)
+		case "!~":
+			return !e.re.MatchString(v)
+		case "!=":
+			return v != e.str
+		default:
+			return v == e.str
+		}
+	case fieldNumber:
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return false
+		}
+		diff = n - e.num
+	case fieldDuration:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return false
+		}
+		diff = float64(d - e.dur)
+	}
+	switch e.cmp {
+	case "=", "==":
+		return diff == 0
+	case "!=":
+		return diff != 0
+	case ">":
+		return diff > 0
+	case ">=":
+		return diff >= 0
+	case "<":
+		return diff < 0
+	default:
+		return diff <= 0
+	}
+}
+
+// Process runs an entry through the selector and pipeline. It returns the
+// entry's labels, including any extracted by parser stages, and whether
+// the entry is kept.
+func (q *LogQuery) Process(e LogEntry) (map[string]string, bool) {
+	labels := streamLabels(e)
+	for _, m := range q.matchers {
+		if !m.matches(labels[m.name]) {
+			return nil, false
+		}
+	}
+	// Fields extracted at ingest need no parser stage
+	for k, v := range e.Fields {
+		setExtracted(labels, k, v)
+	}
+
+	for _, s := range q.stages {
+		switch {
+		case s.filter != nil:
+			if !s.filter.matches(e.Message) {
+				return nil, false
+			}
+		case s.parser == "json":
+			fields, err := parseJSONFields(e.Message)
+			if err != nil {
+				labels["__error__"] = "JSONParserErr"
+			}
+			for k, v := range fields {
+				setExtracted(labels, k, v)
+			}
+		case s.parser == "logfmt":
+			fields, _ := parseLogfmtFields(e.Message)
+			for k, v := range fields {
+				setExtracted(labels, k, v)
+			}
+		case s.fields != nil:
+			if !s.fields.eval(labels) {
+				return nil, false
+			}
+		}
+	}
+	return labels, true
+}
+
+// filtersQuery builds the log query equivalent to the filters of the older
+// search APIs: namespace and level match exactly, pod by substring, and
+// any other key is an extracted field that must match exactly.
+func filtersQuery(filters map[string]string) *LogQuery {
+	q := &LogQuery{}
+	keys := make([]string, 0, len(filters))
+	for k := range filters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := filters[k]
+		switch k {
+		case "namespace", "level":
+			q.matchers = append(q.matchers, labelMatcher{name: k, op: "=", value: v})
+		case "pod":
+			q.matchers = append(q.matchers, labelMatcher{
+				name: "pod",
+				op:   "=~",
+				re:   regexp.MustCompile("^(?:.*" + regexp.QuoteMeta(v) + ".*)$"),
+			})
+		default:
+			q.stages = append(q.stages, logStage{fields: &fieldExpr{name: k, cmp: "=", kind: fieldString, str: v}})
+		}
+	}
+	return q
+}
+
+// extracts reports whether the pipeline adds labels parsed from the line.
+func (q *LogQuery) extracts() bool {
+	for _, s := range q.stages {
+		if s.parser != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the part of the selector the store can use to skip
+// segments without reading them.
+func (q *LogQuery) filter() logFilter {
+	var f logFilter
+	for _, m := range q.matchers {
+		if m.op != "=" {
+			continue
+		}
+		switch m.name {
+		case "namespace":
+			f.Namespace = m.value
+		case "level":
+			f.Level = m.value
+		case "pod":
+			f.Pod = m.value
+		case "container":
+			f.Container = m.value
+		}
+	}
+	return f
+}
+
+// highlights returns the parts of a line the line filters matched.
+func (q *LogQuery) highlights(line string) []string {
+	var out []string
+	for _, s := range q.stages {
+		if s.filter == nil {
+			continue
+		}
+		switch s.filter.op {
+		case "|=":
+			out = append(out, s.filter.value)
+		case "|~":
+			out = append(out, s.filter.re.FindAllString(line, -1)...)
+		}
+	}
+	return out
+}
+
+// parseJSONFields flattens a JSON object into fields, joining nested keys
+// with underscores.
+func parseJSONFields(line string) (map[string]string, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &obj); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string)
+	var flatten func(prefix string, v interface{})
+	flatten = func(prefix string, v interface{}) {
+		key := strings.TrimSuffix(prefix, "_")
+		switch val := v.(type) {
+		case map[string]interface{}:
+			for k, child := range val {
+				flatten(prefix+sanitizeLabel(k)+"_", child)
+			}
+		case string:
+			fields[key] = val
+		case float64:
+			fields[key] = strconv.FormatFloat(val, 'f', -1, 64)
+		case bool:
+			fields[key] = strconv.FormatBool(val)
+		case nil:
+		default:
+			// Arrays are kept as their JSON text
+			data, _ := json.Marshal(val)
+			fields[key] = string(data)
+		}
+	}
+	flatten("", obj)
+	return fields, nil
+}
+
+// parseLogfmtFields reads key=value pairs, where values may be quoted. It
+// also reports whether every word of the line was a pair, which is how
+// ingest tells logfmt lines from prose that happens to contain "=".
+func parseLogfmtFields(line string) (map[string]string, bool) {
+	fields := make(map[string]string)
+	strict := true
+	i := 0
+	for i < len(line) {
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' {
+			i++
+		}
+		key := line[start:i]
+		if i >= len(line) || line[i] != '=' {
+			if key != "" {
+				fields[sanitizeLabel(key)] = ""
+				strict = false
+			}
+			continue
+		}
+		i++
+
+		var value string
+		if i < len(line) && line[i] == '"' {
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				end = len(line) - 1
+			}
+			if v, err := strconv.Unquote(line[i : end+1]); err == nil {
+				value = v
+			} else {
+				value = strings.Trim(line[i:end+1], `"`)
+			}
+			i = end + 1
+		} else {
+			start := i
+			for i < len(line) && line[i] != ' ' {
+				i++
+			}
+			value = line[start:i]
+		}
+		if key == "" {
+			strict = false
+			continue
+		}
+		fields[sanitizeLabel(key)] = value
+	}
+	return fields, strict
+}
+
+// setExtracted adds a parsed field, renaming it when it would replace a
+// stream label, as Loki does.
+func setExtracted(labels map[string]string, key, value string) {
+	switch key {
+	case "namespace", "pod", "container", "level":
+		key += "_extracted"
+	}
+	labels[key] = value
+}
+
+func sanitizeLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// EvalMetric evaluates a metric query at each step back from end to start.
+// Series carry the stream labels plus any extracted labels named in the
+// grouping; a step is left out of a series when its window had no lines.
+func (ls *LogStore) EvalMetric(m *MetricQuery, start, end time.Time, step time.Duration) ([]MetricSeries, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	steps := int(end.Sub(start)/step) + 1
+	if steps > maxMetricSteps {
+		return nil, fmt.Errorf("query would return %d points per series; use a larger step", steps)
+	}
+	// Steps end exactly at end so the newest point covers the newest lines
+	start = end.Add(-time.Duration(steps-1) * step)
+
+	extracted := make(map[string]bool)
+	for _, l := range m.By {
+		extracted[l] = true
+	}
+
+	type series struct {
+		labels map[string]string
+		values []float64
+		seen   []bool
+	}
+	inner := make(map[string]*series)
+
+	f := m.Log.filter()
+	f.Start, f.End = start.Add(-m.Range), end
+	ls.scan(f, false, func(e LogEntry) bool {
+		labels, ok := m.Log.Process(e)
+		if !ok {
+			return true
+		}
+		// Steps whose window (t-range, t] holds the entry
+		lo := int(math.Ceil(float64(e.Timestamp.Sub(start)) / float64(step)))
+		hi := int(math.Ceil(float64(e.Timestamp.Add(m.Range).Sub(start))/float64(step))) - 1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi >= steps {
+			hi = steps - 1
+		}
+		if lo > hi {
+			return true
+		}
+
+		key := streamLabels(e)
+		for l := range extracted {
+			if v, ok := labels[l]; ok {
+				key[l] = v
+			}
+		}
+		id := labelKey(key)
+		s, ok := inner[id]
+		if !ok {
+			s = &series{labels: key, values: make([]float64, steps), seen: make([]bool, steps)}
+			inner[id] = s
+		}
+		v := 1.0
+		if m.Func == "bytes_rate" || m.Func == "bytes_over_time" {
+			v = float64(e.Size)
+		}
+		for i := lo; i <= hi; i++ {
+			s.values[i] += v
+			s.seen[i] = true
+		}
+		return true
+	})
+
+	if m.Func == "rate" || m.Func == "bytes_rate" {
+		for _, s := range inner {
+			for i := range s.values {
+				s.values[i] /= m.Range.Seconds()
+			}
+		}
+	}
+
+	// Combine series sharing the grouping labels
+	out := inner
+	if m.Agg != "" {
+		out = make(map[string]*series)
+		counts := make(map[string][]int)
+		for _, s := range inner {
+			key := make(map[string]string)
+			if m.Without {
+				for k, v := range s.labels {
+					key[k] = v
+				}
+				for _, l := range m.By {
+					delete(key, l)
+				}
+			} else {
+				for _, l := range m.By {
+					if v, ok := s.labels[l]; ok {
+						key[l] = v
+					}
+				}
+			}
+			id := labelKey(key)
+			g, ok := out[id]
+			if !ok {
+				g = &series{labels: key, values: make([]float64, steps), seen: make([]bool, steps)}
+				out[id] = g
+				counts[id] = make([]int, steps)
+			}
+			for i, seen := range s.seen {
+				if !seen {
+					continue
+				}
+				v := s.values[i]
+				switch {
+				case !g.seen[i]:
+					if m.Agg == "count" {
+						v = 1
+					}
+					g.values[i] = v
+				case m.Agg == "sum" || m.Agg == "avg":
+					g.values[i] += v
+				case m.Agg == "count":
+					g.values[i]++
+				case m.Agg == "min":
+					g.values[i] = math.Min(g.values[i], v)
+				case m.Agg == "max":
+					g.values[i] = math.Max(g.values[i], v)
+				}
+				g.seen[i] = true
+				counts[id][i]++
+			}
+		}
+		if m.Agg == "avg" {
+			for id, g := range out {
+				for i, n := range counts[id] {
+					if n > 0 {
+						g.values[i] /= float64(n)
+					}
+				}
+			}
+		}
+	}
+
+	result := make([]MetricSeries, 0, len(out))
+	for _, s := range out {
+		ms := MetricSeries{Labels: s.labels, Points: []MetricPoint{}}
+		for i, seen := range s.seen {
+			if seen {
+				ms.Points = append(ms.Points, MetricPoint{Time: start.Add(time.Duration(i) * step), Value: s.values[i]})
+			}
+		}
+		result = append(result, ms)
+	}
+	sort.Slice(result, func(i, j int) bool { return labelKey(result[i].Labels) < labelKey(result[j].Labels) })
+	return result, nil
+}
+
+// labelKey renders labels in a stable order, e.g. {level="ERROR", pod="x"}.
+func labelKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%q", k, labels[k])
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
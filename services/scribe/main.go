@@ -10,11 +10,13 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -31,13 +33,16 @@ const (
 )
 
 type LogEntry struct {
-	Timestamp time.Time `json:"timestamp"`
-	Namespace string    `json:"namespace"`
-	Pod       string    `json:"pod"`
-	Container string    `json:"container"`
-	Message   string    `json:"message"`
-	Level     string    `json:"level"`
-	Size      int       `json:"size"` // bytes
+	Timestamp time.Time         `json:"timestamp"`
+	Namespace string            `json:"namespace"`
+	Pod       string            `json:"pod"`
+	Container string            `json:"container"`
+	Message   string            `json:"message"`
+	Level     string            `json:"level"`
+	Size      int               `json:"size"`             // bytes
+	Fields    map[string]string `json:"fields,omitempty"` // Parsed from structured lines and extraction rules
+
+	seq uint64 // Position in the store, shared by both tiers
 }
 
 type LogStore struct {
@@ -57,6 +62,14 @@ type LogStore struct {
 	bytesPerPod    map[string]int64
 	bytesPerNs     map[string]int64
 	entriesPerHour map[string]int // key: "2006-01-02-15"
+
+	// Disk tier, nil when logs are kept in memory only
+	segments     *SegmentStore
+	maxDiskBytes int64
+	nextSeq      uint64 // Last sequence number assigned
+	flushedSeq   uint64 // Last sequence number written to a segment
+	lastFlush    time.Time
+	flushMu      sync.Mutex
 }
 
 type StatsResponse struct {
@@ -68,6 +81,7 @@ type StatsResponse struct {
 	Levels          map[string]int  `json:"levels"`
 	VolumeStats     VolumeStats     `json:"volume_stats"`
 	RetentionConfig RetentionConfig `json:"retention_config"`
+	Storage         StorageStats    `json:"storage"`
 }
 
 type VolumeStats struct {
@@ -120,6 +134,13 @@ type Alert struct {
 	Enabled     bool      `json:"enabled"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Notification settings; see alerting.go
+	GroupBy         []string `json:"group_by,omitempty"`         // Labels or fields that split the alert into groups
+	RepeatMins      int      `json:"repeat_mins,omitempty"`      // Re-notify interval while firing (default 240)
+	Receivers       []string `json:"receivers,omitempty"`        // hub, webhook (default both)
+	TitleTemplate   string   `json:"title_template,omitempty"`   // text/template over AlertNotification
+	MessageTemplate string   `json:"message_template,omitempty"` // text/template over AlertNotification
 }
 
 // AlertMatch represents a single match for an alert
@@ -137,6 +158,9 @@ type AlertState struct {
 	TriggeredAt time.Time    `json:"triggered_at,omitempty"`
 	LastChecked time.Time    `json:"last_checked"`
 	MatchCount  int          `json:"match_count"`
+	Groups      []AlertGroup `json:"groups,omitempty"`
+
+	groups map[string]*AlertGroup
 }
 
 // AlertStore manages alerts
@@ -144,6 +168,7 @@ type AlertStore struct {
 	mu     sync.RWMutex
 	alerts map[string]*Alert
 	states map[string]*AlertState
+	wake   chan struct{} // Nudges the dispatcher when a group starts firing
 }
 
 // AlertResponse for API responses
@@ -159,29 +184,36 @@ type AlertResponse struct {
 
 // SearchRequest for advanced search
 type SearchRequest struct {
-	Query        string    `json:"query"`
-	Regex        bool      `json:"regex"`
-	Namespace    string    `json:"namespace,omitempty"`
-	Level        string    `json:"level,omitempty"`
-	Pod          string    `json:"pod,omitempty"`
-	Container    string    `json:"container,omitempty"`
-	StartTime    time.Time `json:"start_time,omitempty"`
-	EndTime      time.Time `json:"end_time,omitempty"`
-	Limit        int       `json:"limit,omitempty"`
-	Offset       int       `json:"offset,omitempty"`
-	SortOrder    string    `json:"sort_order,omitempty"` // asc or desc
-	Highlight    bool      `json:"highlight"`
-	ContextLines int       `json:"context_lines,omitempty"` // lines before/after match
+	Query        string            `json:"query"`
+	Regex        bool              `json:"regex"`
+	Namespace    string            `json:"namespace,omitempty"`
+	Level        string            `json:"level,omitempty"`
+	Pod          string            `json:"pod,omitempty"`
+	Container    string            `json:"container,omitempty"`
+	StartTime    time.Time         `json:"start_time,omitempty"`
+	EndTime      time.Time         `json:"end_time,omitempty"`
+	Limit        int               `json:"limit,omitempty"`
+	Offset       int               `json:"offset,omitempty"`
+	SortOrder    string            `json:"sort_order,omitempty"` // asc or desc
+	Highlight    bool              `json:"highlight"`
+	ContextLines int               `json:"context_lines,omitempty"` // lines before/after match
+	LogQL        string            `json:"logql,omitempty"`         // replaces query and the label filters
+	Fields       map[string]string `json:"fields,omitempty"`        // extracted fields that must match exactly
+	FacetFields  []string          `json:"facet_fields,omitempty"`  // extracted fields to count values of
+	Step         string            `json:"step,omitempty"`          // resolution of LogQL metric queries
+
+	pipeline *LogQuery // Parsed LogQL log query
 }
 
 // SearchResult with metadata
 type SearchResult struct {
-	Entry         LogEntry   `json:"entry"`
-	Score         float64    `json:"score,omitempty"`
-	Highlights    []string   `json:"highlights,omitempty"`
-	LineNumber    int        `json:"line_number,omitempty"`
-	ContextBefore []LogEntry `json:"context_before,omitempty"`
-	ContextAfter  []LogEntry `json:"context_after,omitempty"`
+	Entry         LogEntry          `json:"entry"`
+	Score         float64           `json:"score,omitempty"`
+	Highlights    []string          `json:"highlights,omitempty"`
+	LineNumber    int               `json:"line_number,omitempty"`
+	ContextBefore []LogEntry        `json:"context_before,omitempty"`
+	ContextAfter  []LogEntry        `json:"context_after,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"` // Fields extracted by LogQL parsers
 }
 
 // SearchResponse for search results
@@ -193,26 +225,30 @@ type SearchResponse struct {
 	Took          string         `json:"took"`
 	ScribeSays    string         `json:"scribe_says,omitempty"`
 	Facets        *SearchFacets  `json:"facets,omitempty"`
+	ResultType    string         `json:"result_type,omitempty"` // streams or matrix for LogQL
+	Series        []MetricSeries `json:"series,omitempty"`
 }
 
 // SearchFacets for filtering options
 type SearchFacets struct {
-	Namespaces map[string]int `json:"namespaces"`
-	Levels     map[string]int `json:"levels"`
-	Pods       map[string]int `json:"pods"`
-	TimeRanges map[string]int `json:"time_ranges"`
+	Namespaces map[string]int            `json:"namespaces"`
+	Levels     map[string]int            `json:"levels"`
+	Pods       map[string]int            `json:"pods"`
+	TimeRanges map[string]int            `json:"time_ranges"`
+	Fields     map[string]map[string]int `json:"fields,omitempty"`
 }
 
 // ==================== AGGREGATION TYPES ====================
 
 // AggregationRequest for log aggregation
 type AggregationRequest struct {
-	GroupBy   []string          `json:"group_by"` // level, namespace, pod, container, hour, day
-	Metrics   []string          `json:"metrics"`  // count, bytes, avg_size
-	Filters   map[string]string `json:"filters,omitempty"`
+	GroupBy   []string          `json:"group_by"`          // level, namespace, pod, container, hour, day or an extracted field
+	Metrics   []string          `json:"metrics"`           // count, bytes, avg_size
+	Filters   map[string]string `json:"filters,omitempty"` // namespace, level, pod or an extracted field
 	StartTime time.Time         `json:"start_time,omitempty"`
 	EndTime   time.Time         `json:"end_time,omitempty"`
 	TopN      int               `json:"top_n,omitempty"` // Return top N results
+	Query     string            `json:"query,omitempty"` // LogQL log query, replaces filters
 }
 
 // AggregationBucket for grouped results
@@ -273,12 +309,16 @@ type ExportRequest struct {
 }
 
 var (
-	store          *LogStore
-	alertStore     *AlertStore
-	retentionStore *RetentionPolicyStore
-	clientset      *kubernetes.Clientset
-	podLastSeen    map[string]time.Time
-	podMu          sync.RWMutex
+	store           *LogStore
+	alertStore      *AlertStore
+	retentionStore  *RetentionPolicyStore
+	extractionStore *ExtractionRuleStore
+	silenceStore    *SilenceStore
+	alertHistory    *AlertHistory
+	ingester        *Ingester
+	clientset       *kubernetes.Clientset
+	podLastSeen     map[string]time.Time
+	podMu           sync.RWMutex
 )
 
 func NewLogStore() *LogStore {
@@ -293,37 +333,35 @@ func NewLogStore() *LogStore {
 	}
 }
 
-func (ls *LogStore) Add(entry LogEntry) {
+// Add stores an entry and returns it as stored, with its size, fields and
+// level filled in.
+func (ls *LogStore) Add(entry LogEntry) LogEntry {
 	entry.Size = len(entry.Message)
+	if extractionStore != nil {
+		extractionStore.Extract(&entry)
+	}
 
 	ls.mu.Lock()
+	ls.nextSeq++
+	entry.seq = ls.nextSeq
 	ls.entries = append(ls.entries, entry)
 
-	// Apply retention by max entries
+	// Apply retention to the in-memory tail
 	ls.retentionMu.RLock()
 	maxEntries := ls.maxEntries
 	retentionHours := ls.retentionHours
 	ls.retentionMu.RUnlock()
+	ls.trimLocked(maxEntries, retentionHours)
+	flush := ls.segments != nil && ls.nextSeq-ls.flushedSeq >= defaultSegmentEntries
+	ls.mu.Unlock()
 
-	if len(ls.entries) > maxEntries {
-		ls.entries = ls.entries[len(ls.entries)-maxEntries:]
-	}
-
-	// Apply retention by time
-	if retentionHours > 0 {
-		cutoff := time.Now().Add(-time.Duration(retentionHours) * time.Hour)
-		idx := 0
-		for i, e := range ls.entries {
-			if e.Timestamp.After(cutoff) {
-				idx = i
-				break
+	if flush {
+		go func() {
+			if err := ls.Flush(); err != nil {
+				log.Printf("Failed to flush logs to disk: %v", err)
 			}
-		}
-		if idx > 0 {
-			ls.entries = ls.entries[idx:]
-		}
+		}()
 	}
-	ls.mu.Unlock()
 
 	// Update volume stats
 	ls.statsMu.Lock()
@@ -348,6 +386,8 @@ func (ls *LogStore) Add(entry LogEntry) {
 		}
 	}
 	ls.subMu.RUnlock()
+
+	return entry
 }
 
 func (ls *LogStore) Subscribe() chan LogEntry {
@@ -379,9 +419,6 @@ func (ls *LogStore) GetAll() []LogEntry {
 }
 
 func (ls *LogStore) Search(query, namespace, level, pod string, limit int, useRegex bool) []LogEntry {
-	ls.mu.RLock()
-	defer ls.mu.RUnlock()
-
 	var results []LogEntry
 	var regex *regexp.Regexp
 	var err error
@@ -396,36 +433,25 @@ func (ls *LogStore) Search(query, namespace, level, pod string, limit int, useRe
 
 	queryLower := strings.ToLower(query)
 
-	for i := len(ls.entries) - 1; i >= 0 && (limit == 0 || len(results) < limit); i-- {
-		entry := ls.entries[i]
-
-		if namespace != "" && entry.Namespace != namespace {
-			continue
-		}
-		if level != "" && entry.Level != level {
-			continue
-		}
-		if pod != "" && !strings.Contains(entry.Pod, pod) {
-			continue
-		}
-
+	ls.scan(logFilter{Namespace: namespace, Level: level, Pod: pod}, true, func(entry LogEntry) bool {
 		if query != "" {
 			if regex != nil {
 				// Regex search
 				if !regex.MatchString(entry.Message) && !regex.MatchString(entry.Pod) {
-					continue
+					return true
 				}
 			} else {
 				// Standard case-insensitive search
 				if !strings.Contains(strings.ToLower(entry.Message), queryLower) &&
 					!strings.Contains(strings.ToLower(entry.Pod), queryLower) {
-					continue
+					return true
 				}
 			}
 		}
 
 		results = append(results, entry)
-	}
+		return limit == 0 || len(results) < limit
+	})
 
 	return results
 }
@@ -444,6 +470,20 @@ func (ls *LogStore) Stats() StatsResponse {
 		levels[entry.Level]++
 	}
 
+	// Entries on disk are counted from the segment indexes
+	storage := ls.storageStatsLocked()
+	for _, seg := range ls.coldSegmentsLocked() {
+		for ns, n := range seg.Labels["namespace"] {
+			namespaces[ns] += n
+		}
+		for pod, n := range seg.Labels["pod"] {
+			pods[pod] += n
+		}
+		for level, n := range seg.Labels["level"] {
+			levels[level] += n
+		}
+	}
+
 	ls.statsMu.RLock()
 	volumeStats := VolumeStats{
 		TotalBytes:     ls.totalBytes,
@@ -467,12 +507,13 @@ func (ls *LogStore) Stats() StatsResponse {
 	return StatsResponse{
 		Agent:           "Scribe",
 		Tagline:         scribeTagline,
-		TotalEntries:    len(ls.entries),
+		TotalEntries:    storage.HotEntries + storage.ColdEntries,
 		Namespaces:      namespaces,
 		Pods:            pods,
 		Levels:          levels,
 		VolumeStats:     volumeStats,
 		RetentionConfig: retentionConfig,
+		Storage:         storage,
 	}
 }
 
@@ -520,32 +561,34 @@ func (ls *LogStore) applyRetention() {
 	retentionHours := ls.retentionHours
 	ls.retentionMu.RUnlock()
 
-	// Apply max entries
+	ls.trimLocked(maxEntries, retentionHours)
+}
+
+// trimLocked applies max entries and time-based retention to the
+// in-memory tail. With a disk tier, entries only leave memory once they
+// are in a segment, and what remains on disk is governed by the retention
+// policies instead.
+func (ls *LogStore) trimLocked(maxEntries, retentionHours int) {
+	cut := 0
 	if len(ls.entries) > maxEntries {
-		ls.entries = ls.entries[len(ls.entries)-maxEntries:]
+		cut = len(ls.entries) - maxEntries
 	}
-
-	// Apply time-based retention
 	if retentionHours > 0 {
 		cutoff := time.Now().Add(-time.Duration(retentionHours) * time.Hour)
-		idx := 0
-		for i, e := range ls.entries {
-			if e.Timestamp.After(cutoff) {
-				idx = i
+		for i := cut; i < len(ls.entries); i++ {
+			if ls.entries[i].Timestamp.After(cutoff) {
+				cut = i
 				break
 			}
 		}
-		if idx > 0 {
-			ls.entries = ls.entries[idx:]
-		}
+	}
+	if cut = ls.alignCutLocked(cut); cut > 0 {
+		ls.entries = ls.entries[cut:]
 	}
 }
 
 // AdvancedSearch performs full-text search with advanced options
 func (ls *LogStore) AdvancedSearch(req SearchRequest) ([]SearchResult, int, *SearchFacets) {
-	ls.mu.RLock()
-	defer ls.mu.RUnlock()
-
 	var results []SearchResult
 	var regex *regexp.Regexp
 	var err error
@@ -566,6 +609,9 @@ func (ls *LogStore) AdvancedSearch(req SearchRequest) ([]SearchResult, int, *Sea
 		Pods:       make(map[string]int),
 		TimeRanges: make(map[string]int),
 	}
+	if len(req.FacetFields) > 0 {
+		facets.Fields = make(map[string]map[string]int)
+	}
 
 	totalMatches := 0
 	limit := req.Limit
@@ -573,47 +619,80 @@ func (ls *LogStore) AdvancedSearch(req SearchRequest) ([]SearchResult, int, *Sea
 		limit = 500
 	}
 	offset := req.Offset
+	newestFirst := req.SortOrder != "asc"
 
-	// Determine iteration order
-	var indices []int
-	if req.SortOrder == "asc" {
-		for i := 0; i < len(ls.entries); i++ {
-			indices = append(indices, i)
-		}
-	} else {
-		for i := len(ls.entries) - 1; i >= 0; i-- {
-			indices = append(indices, i)
-		}
+	filter := logFilter{
+		Namespace: req.Namespace,
+		Level:     req.Level,
+		Pod:       req.Pod,
+		Container: req.Container,
+		Start:     req.StartTime,
+		End:       req.EndTime,
+	}
+	if req.pipeline != nil {
+		filter = req.pipeline.filter()
+		filter.Start, filter.End = req.StartTime, req.EndTime
+	}
+	// Context lines are unfiltered neighbours, so the scan itself cannot
+	// skip anything when they are wanted
+	scanFilter := filter
+	if req.ContextLines > 0 {
+		scanFilter = logFilter{}
 	}
 
-	for _, i := range indices {
-		entry := ls.entries[i]
+	// window holds the entries visited just before the current one;
+	// pending are results still collecting the entries visited after
+	var window []LogEntry
+	var pending []int
 
-		// Apply filters
-		if req.Namespace != "" && entry.Namespace != req.Namespace {
-			continue
-		}
-		if req.Level != "" && entry.Level != req.Level {
-			continue
-		}
-		if req.Pod != "" && !strings.Contains(entry.Pod, req.Pod) {
-			continue
-		}
-		if req.Container != "" && !strings.Contains(entry.Container, req.Container) {
-			continue
+	ls.scan(scanFilter, newestFirst, func(entry LogEntry) bool {
+		if req.ContextLines > 0 {
+			kept := pending[:0]
+			for _, ri := range pending {
+				r := &results[ri]
+				var n int
+				if newestFirst {
+					r.ContextBefore = append(r.ContextBefore, entry)
+					n = len(r.ContextBefore)
+				} else {
+					r.ContextAfter = append(r.ContextAfter, entry)
+					n = len(r.ContextAfter)
+				}
+				if n < req.ContextLines {
+					kept = append(kept, ri)
+				}
+			}
+			pending = kept
+
+			defer func() {
+				window = append(window, entry)
+				if len(window) > req.ContextLines {
+					window = window[1:]
+				}
+			}()
 		}
-		if !req.StartTime.IsZero() && entry.Timestamp.Before(req.StartTime) {
-			continue
+
+		// Apply filters
+		if !filter.matches(entry) {
+			return true
 		}
-		if !req.EndTime.IsZero() && entry.Timestamp.After(req.EndTime) {
-			continue
+		for k, v := range req.Fields {
+			if entry.Fields[k] != v {
+				return true
+			}
 		}
 
 		// Apply query
 		matched := false
 		var highlights []string
+		var labels map[string]string
 
-		if req.Query == "" {
+		if req.pipeline != nil {
+			labels, matched = req.pipeline.Process(entry)
+			if matched && req.Highlight {
+				highlights = req.pipeline.highlights(entry.Message)
+			}
+		} else if req.Query == "" {
 			matched = true
 		} else if regex != nil {
 			if regex.MatchString(entry.Message) {
@@ -633,7 +712,7 @@ func (ls *LogStore) AdvancedSearch(req SearchRequest) ([]SearchResult, int, *Sea
 		}
 
 		if !matched {
-			continue
+			return true
 		}
 
 		totalMatches++
@@ -644,91 +723,101 @@ func (ls *LogStore) AdvancedSearch(req SearchRequest) ([]SearchResult, int, *Sea
 		facets.Pods[entry.Pod]++
 		hourKey := entry.Timestamp.Format("2006-01-02 15:00")
 		facets.TimeRanges[hourKey]++
+		for _, f := range req.FacetFields {
+			if v, ok := entry.Fields[f]; ok {
+				if facets.Fields[f] == nil {
+					facets.Fields[f] = make(map[string]int)
+				}
+				facets.Fields[f][v]++
+			}
+		}
 
 		// Apply pagination
 		if totalMatches <= offset {
-			continue
+			return true
 		}
 		if len(results) >= limit {
-			continue
+			return true
 		}
 
 		result := SearchResult{
 			Entry:      entry,
 			Highlights: highlights,
-			LineNumber: i + 1,
+			LineNumber: int(entry.seq),
+		}
+		if req.pipeline != nil && req.pipeline.extracts() {
+			result.Labels = labels
 		}
 
-		// Add context lines if requested
+		// Add context lines if requested; the window is in visiting
+		// order, so newest-first it holds the following lines reversed
 		if req.ContextLines > 0 {
-			// Context before
-			start := i - req.ContextLines
-			if start < 0 {
-				start = 0
-			}
-			for j := start; j < i; j++ {
-				result.ContextBefore = append(result.ContextBefore, ls.entries[j])
-			}
-
-			// Context after
-			end := i + req.ContextLines + 1
-			if end > len(ls.entries) {
-				end = len(ls.entries)
-			}
-			for j := i + 1; j < end; j++ {
-				result.ContextAfter = append(result.ContextAfter, ls.entries[j])
+			for i := range window {
+				if newestFirst {
+					result.ContextAfter = append(result.ContextAfter, window[len(window)-1-i])
+				} else {
+					result.ContextBefore = append(result.ContextBefore, window[i])
+				}
 			}
+			pending = append(pending, len(results))
 		}
 
 		results = append(results, result)
+		return true
+	})
+
+	// Context before was collected walking backwards
+	if newestFirst {
+		for i := range results {
+			before := results[i].ContextBefore
+			for l, r := 0, len(before)-1; l < r; l, r = l+1, r-1 {
+				before[l], before[r] = before[r], before[l]
+			}
+		}
 	}
 
 	return results, totalMatches, facets
 }
 
 // Aggregate performs log aggregation
-func (ls *LogStore) Aggregate(req AggregationRequest) []AggregationBucket {
-	ls.mu.RLock()
-	defer ls.mu.RUnlock()
-
+// The entries are selected by a LogQL log query, built from the filters
+// when none is given, so buckets can also be grouped by extracted fields.
+func (ls *LogStore) Aggregate(req AggregationRequest) ([]AggregationBucket, error) {
 	buckets := make(map[string]*AggregationBucket)
 
-	for _, entry := range ls.entries {
-		// Apply time filters
-		if !req.StartTime.IsZero() && entry.Timestamp.Before(req.StartTime) {
-			continue
+	var q *LogQuery
+	if req.Query != "" {
+		parsed, err := ParseLogQL(req.Query)
+		if err != nil {
+			return nil, err
 		}
-		if !req.EndTime.IsZero() && entry.Timestamp.After(req.EndTime) {
-			continue
+		if parsed.Log == nil {
+			return nil, fmt.Errorf("aggregations take a log query, not a metric query")
 		}
+		q = parsed.Log
+	} else {
+		q = filtersQuery(req.Filters)
+	}
 
-		// Apply filters
-		if ns, ok := req.Filters["namespace"]; ok && entry.Namespace != ns {
-			continue
-		}
-		if lvl, ok := req.Filters["level"]; ok && entry.Level != lvl {
-			continue
-		}
-		if pod, ok := req.Filters["pod"]; ok && !strings.Contains(entry.Pod, pod) {
-			continue
+	filter := q.filter()
+	filter.Start, filter.End = req.StartTime, req.EndTime
+	ls.scan(filter, false, func(entry LogEntry) bool {
+		labels, ok := q.Process(entry)
+		if !ok {
+			return true
 		}
 
 		// Build bucket key
 		keyParts := make(map[string]string)
 		for _, groupBy := range req.GroupBy {
 			switch groupBy {
-			case "level":
-				keyParts["level"] = entry.Level
-			case "namespace":
-				keyParts["namespace"] = entry.Namespace
-			case "pod":
-				keyParts["pod"] = entry.Pod
-			case "container":
-				keyParts["container"] = entry.Container
 			case "hour":
 				keyParts["hour"] = entry.Timestamp.Format("2006-01-02 15:00")
 			case "day":
 				keyParts["day"] = entry.Timestamp.Format("2006-01-02")
+			default:
+				// Stream labels and fields extracted by the query
+				keyParts[groupBy] = labels[groupBy]
 			}
 		}
 
@@ -756,7 +845,8 @@ func (ls *LogStore) Aggregate(req AggregationRequest) []AggregationBucket {
 		if entry.Timestamp.After(bucket.LastSeen) {
 			bucket.LastSeen = entry.Timestamp
 		}
-	}
+		return true
+	})
 
 	// Calculate averages and error rates
 	var result []AggregationBucket
@@ -777,7 +867,7 @@ func (ls *LogStore) Aggregate(req AggregationRequest) []AggregationBucket {
 		result = result[:req.TopN]
 	}
 
-	return result
+	return result, nil
 }
 
 // ==================== ALERT STORE METHODS ====================
@@ -786,6 +876,7 @@ func NewAlertStore() *AlertStore {
 	return &AlertStore{
 		alerts: make(map[string]*Alert),
 		states: make(map[string]*AlertState),
+		wake:   make(chan struct{}, 1),
 	}
 }
 
@@ -804,6 +895,7 @@ func (as *AlertStore) Add(alert Alert) {
 		Alert:       alert,
 		Matches:     []AlertMatch{},
 		LastChecked: time.Now(),
+		groups:      make(map[string]*AlertGroup),
 	}
 }
 
@@ -841,9 +933,16 @@ func (as *AlertStore) Update(alert Alert) bool {
 	as.mu.Lock()
 	defer as.mu.Unlock()
 
-	if _, exists := as.alerts[alert.ID]; exists {
+	if existing, exists := as.alerts[alert.ID]; exists {
+		alert.CreatedAt = existing.CreatedAt
 		alert.UpdatedAt = time.Now()
 		as.alerts[alert.ID] = &alert
+		state := as.states[alert.ID]
+		state.Alert = alert
+		// Groups keyed by the old labels can never resolve
+		if strings.Join(existing.GroupBy, ",") != strings.Join(alert.GroupBy, ",") {
+			state.groups = make(map[string]*AlertGroup)
+		}
 		return true
 	}
 	return false
@@ -855,7 +954,7 @@ func (as *AlertStore) GetStates() []AlertState {
 
 	states := make([]AlertState, 0, len(as.states))
 	for _, state := range as.states {
-		states = append(states, *state)
+		states = append(states, state.snapshot())
 	}
 	return states
 }
@@ -867,7 +966,7 @@ func (as *AlertStore) GetTriggered() []AlertState {
 	var triggered []AlertState
 	for _, state := range as.states {
 		if state.Triggered {
-			triggered = append(triggered, *state)
+			triggered = append(triggered, state.snapshot())
 		}
 	}
 	return triggered
@@ -925,16 +1024,20 @@ func (as *AlertStore) CheckEntry(entry LogEntry) {
 		state.MatchCount = len(recentMatches)
 		state.LastChecked = time.Now()
 
-		// Check if threshold exceeded
-		if state.MatchCount >= alert.Threshold && !state.Triggered {
-			state.Triggered = true
-			state.TriggeredAt = time.Now()
-			log.Printf("ALERT TRIGGERED: %s - %d matches in %d minutes",
-				alert.Name, state.MatchCount, alert.WindowMins)
-		} else if state.MatchCount < alert.Threshold && state.Triggered {
-			// Reset if below threshold
-			state.Triggered = false
+		// Thresholds apply to each group on its own
+		group := state.group(alert, entry)
+		group.record(entry, windowStart)
+		if group.MatchCount >= alert.Threshold && !group.Firing {
+			group.Firing = true
+			group.StartsAt = time.Now()
+			log.Printf("ALERT TRIGGERED: %s%s - %d matches in %d minutes",
+				alert.Name, group.describe(), group.MatchCount, alert.WindowMins)
+			select {
+			case as.wake <- struct{}{}:
+			default:
+			}
 		}
+		state.updateTriggered()
 	}
 }
 
@@ -1002,45 +1105,38 @@ func (rps *RetentionPolicyStore) Update(policy RetentionPolicy) bool {
 	return false
 }
 
-// ApplyPolicies applies retention policies to entries
-func (rps *RetentionPolicyStore) ApplyPolicies(entries []LogEntry) []LogEntry {
-	rps.mu.RLock()
+// ApplyPolicies enforces the retention policies on the disk tier. Whole
+// segments are deleted once every namespace and level they hold is past
+// the policies covering it, by age or by the number of newer entries;
+// anything no policy covers falls back to defaultHours. It returns how
+// many segments were removed and the bytes freed.
+func (rps *RetentionPolicyStore) ApplyPolicies(segments *SegmentStore, defaultHours int) (int, int64) {
+	if segments == nil {
+		return 0, 0
+	}
 	policies := rps.List()
-	rps.mu.RUnlock()
 
 	now := time.Now()
-	var retained []LogEntry
-
-	for _, entry := range entries {
-		keep := true
+	all := segments.Segments()
+	newer := make(map[string]int)
+	expired := make(map[string]bool)
 
+	for i := len(all) - 1; i >= 0; i-- {
+		seg := all[i]
+		if segmentExpired(seg, policies, defaultHours, newer, now) {
+			expired[seg.ID] = true
+		}
 		for _, policy := range policies {
-			if !policy.Enabled {
-				continue
-			}
-
-			// Check if policy applies to this entry
-			if policy.Namespace != "" && entry.Namespace != policy.Namespace {
-				continue
-			}
-			if policy.Level != "" && entry.Level != policy.Level {
-				continue
+			if policy.Enabled && policy.MaxEntries > 0 {
+				newer[policy.ID] += policyMatches(seg, policy)
 			}
-
-			// Check age
-			age := now.Sub(entry.Timestamp)
-			if policy.MaxAge > 0 && age > time.Duration(policy.MaxAge)*time.Hour {
-				keep = false
-				break
-			}
-		}
-
-		if keep {
-			retained = append(retained, entry)
 		}
 	}
 
-	return retained
+	if len(expired) == 0 {
+		return 0, 0
+	}
+	return segments.Delete(expired)
 }
 
 func copyInt64Map(m map[string]int64) map[string]int64 {
@@ -1298,7 +1394,7 @@ func handleLogs(w http.ResponseWriter, r *http.Request) {
 			Level:     strings.ToUpper(req.Level),
 		}
 
-		store.Add(entry)
+		entry = store.Add(entry)
 
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -1567,6 +1663,19 @@ func handleSearch(w http.ResponseWriter, r *http.Request) {
 		req.Container = r.URL.Query().Get("container")
 		req.Highlight = r.URL.Query().Get("highlight") == "true"
 		req.SortOrder = r.URL.Query().Get("sort")
+		req.LogQL = r.URL.Query().Get("logql")
+		for _, f := range r.URL.Query()["field"] {
+			if k, v, ok := strings.Cut(f, "="); ok {
+				if req.Fields == nil {
+					req.Fields = make(map[string]string)
+				}
+				req.Fields[k] = v
+			}
+		}
+		if ff := r.URL.Query().Get("facet_fields"); ff != "" {
+			req.FacetFields = strings.Split(ff, ",")
+		}
+		req.Step = r.URL.Query().Get("step")
 
 		if l := r.URL.Query().Get("limit"); l != "" {
 			if n, err := strconv.Atoi(l); err == nil {
@@ -1597,6 +1706,19 @@ func handleSearch(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if req.LogQL != "" {
+		q, err := ParseLogQL(req.LogQL)
+		if err != nil {
+			http.Error(w, "Invalid LogQL: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if q.Metric != nil {
+			handleMetricQuery(w, req, q.Metric, startTime)
+			return
+		}
+		req.pipeline = q.Log
+	}
+
 	results, totalMatches, facets := store.AdvancedSearch(req)
 
 	took := time.Since(startTime)
@@ -1622,10 +1744,61 @@ func handleSearch(w http.ResponseWriter, r *http.Request) {
 		ScribeSays:    scribeSays,
 		Facets:        facets,
 	}
+	if req.pipeline != nil {
+		response.Query = req.LogQL
+		response.ResultType = "streams"
+	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
+// handleMetricQuery evaluates a LogQL metric query over the search time
+// range, the last hour by default.
+func handleMetricQuery(w http.ResponseWriter, req SearchRequest, m *MetricQuery, startTime time.Time) {
+	end := req.EndTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	start := req.StartTime
+	if start.IsZero() {
+		start = end.Add(-time.Hour)
+	}
+
+	// Default to about 100 points, never finer than a second
+	step := end.Sub(start) / 100
+	if req.Step != "" {
+		d, err := parseLogQLDuration(req.Step)
+		if err != nil {
+			http.Error(w, "Invalid step: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		step = d
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+
+	series, err := store.EvalMetric(m, start, end, step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	took := time.Since(startTime)
+	scribeSays := fmt.Sprintf("Charted %d series across %s in %s.", len(series), end.Sub(start).Round(time.Second), took.Round(time.Millisecond))
+	if len(series) == 0 {
+		scribeSays = "The chronicles hold no records to measure in this period."
+	}
+
+	json.NewEncoder(w).Encode(SearchResponse{
+		Query:      req.LogQL,
+		ResultType: "matrix",
+		Series:     series,
+		Took:       took.String(),
+		ScribeSays: scribeSays,
+	})
+}
+
 // ==================== ALERTS HANDLER ====================
 
 func handleAlerts(w http.ResponseWriter, r *http.Request) {
@@ -1635,6 +1808,15 @@ func handleAlerts(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/alerts")
 	alertID := strings.TrimPrefix(path, "/")
 
+	if alertID == "silences" || strings.HasPrefix(alertID, "silences/") {
+		handleSilences(w, r, strings.TrimPrefix(strings.TrimPrefix(alertID, "silences"), "/"))
+		return
+	}
+	if alertID == "history" {
+		handleAlertHistory(w, r)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		if alertID == "" {
@@ -1692,6 +1874,10 @@ func handleAlerts(w http.ResponseWriter, r *http.Request) {
 			alert.Severity = "warning"
 		}
 		alert.Enabled = true
+		if err := alert.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		alertStore.Add(alert)
 
@@ -1713,6 +1899,10 @@ func handleAlerts(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		alert.ID = alertID
+		if err := alert.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		if !alertStore.Update(alert) {
 			http.Error(w, "Alert not found", http.StatusNotFound)
@@ -1779,6 +1969,12 @@ func handleAggregations(w http.ResponseWriter, r *http.Request) {
 		if pod := r.URL.Query().Get("pod"); pod != "" {
 			req.Filters["pod"] = pod
 		}
+		for _, f := range r.URL.Query()["field"] {
+			if k, v, ok := strings.Cut(f, "="); ok {
+				req.Filters[k] = v
+			}
+		}
+		req.Query = r.URL.Query().Get("query")
 
 		// Parse time range
 		if st := r.URL.Query().Get("start_time"); st != "" {
@@ -1798,7 +1994,11 @@ func handleAggregations(w http.ResponseWriter, r *http.Request) {
 		req.GroupBy = []string{"level"}
 	}
 
-	buckets := store.Aggregate(req)
+	buckets, err := store.Aggregate(req)
+	if err != nil {
+		http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	took := time.Since(startTime)
 
@@ -3275,8 +3475,25 @@ func main() {
 	store = NewLogStore()
 	alertStore = NewAlertStore()
 	retentionStore = NewRetentionPolicyStore()
+	extractionStore = NewExtractionRuleStore(os.Getenv("LOG_DATA_DIR"))
+	silenceStore = NewSilenceStore(os.Getenv("LOG_DATA_DIR"))
+	alertHistory = NewAlertHistory()
 	podLastSeen = make(map[string]time.Time)
 
+	// Logs leaving memory are kept on disk when a data directory is set
+	if dataDir := os.Getenv("LOG_DATA_DIR"); dataDir != "" {
+		segments, err := OpenSegmentStore(dataDir)
+		if err != nil {
+			log.Fatalf("Failed to open log data directory: %v", err)
+		}
+		var maxDiskBytes int64
+		if mb, err := strconv.ParseInt(os.Getenv("LOG_MAX_DISK_MB"), 10, 64); err == nil && mb > 0 {
+			maxDiskBytes = mb << 20
+		}
+		store.EnableSegments(segments, maxDiskBytes)
+		log.Printf("Persisting logs to %s (%d segments on disk)", dataDir, len(segments.Segments()))
+	}
+
 	// Add some default alerts
 	alertStore.Add(Alert{
 		Name:        "Error Rate Spike",
@@ -3330,6 +3547,22 @@ func main() {
 	defer cancel()
 
 	go collectPodLogs(ctx)
+	go alertStore.dispatch(ctx, NewNotifier())
+	initIngest()
+	if store.segments != nil {
+		go maintainSegments(ctx)
+
+		// Write the in-memory tail out before the pod stops
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
+		go func() {
+			<-sigCh
+			if err := store.Flush(); err != nil {
+				log.Printf("Failed to flush logs on shutdown: %v", err)
+			}
+			os.Exit(0)
+		}()
+	}
 
 	// Also do an initial collection
 	go collectAllPodLogs()
@@ -3358,6 +3591,13 @@ func main() {
 	http.HandleFunc("/api/export", handleExport)                         // Enhanced export
 	http.HandleFunc("/api/retention/policies", handleRetentionPolicies)  // Retention policies
 	http.HandleFunc("/api/retention/policies/", handleRetentionPolicies) // Retention policies with ID
+	http.HandleFunc("/api/extraction/rules", handleExtractionRules)      // Field extraction rules
+	http.HandleFunc("/api/extraction/rules/", handleExtractionRules)     // Field extraction rules with ID
+	http.HandleFunc("/api/push", handlePush)                             // Batched push from outside the cluster
+	http.HandleFunc("/loki/api/v1/push", handlePush)                     // Same, for Loki clients
+	http.HandleFunc("/v1/logs", handleOTLPLogs)                          // OTLP/HTTP logs (JSON)
+	http.HandleFunc("/api/ingest/stats", handleIngestStats)              // Per-source ingest counters
+	RegisterAPIRoutes()
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,779 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== SEGMENT STORE ====================
+//
+// Logs that leave the in-memory tail are kept on disk in segments: gzipped
+// NDJSON chunks of consecutive entries, written into one directory per
+// day. Each segment has a small index next to it recording its sequence
+// and time range and how many entries it holds per namespace, pod,
+// container and level, so queries can skip segments that cannot match and
+// stats can be answered without decompressing anything. Retention only
+// ever deletes whole segments.
+
+const (
+	defaultSegmentEntries = 5000
+	defaultSegmentMaxAge  = 5 * time.Minute
+	segmentCacheSize      = 8
+)
+
+// Label dimensions kept in each segment index
+var segmentLabels = []string{"namespace", "pod", "container", "level"}
+
+// SegmentInfo is the index of one segment.
+type SegmentInfo struct {
+	ID             string                    `json:"id"`
+	File           string                    `json:"file"` // Relative to the data directory
+	MinSeq         uint64                    `json:"min_seq"`
+	MaxSeq         uint64                    `json:"max_seq"`
+	MinTime        time.Time                 `json:"min_time"`
+	MaxTime        time.Time                 `json:"max_time"`
+	Entries        int                       `json:"entries"`
+	Bytes          int64                     `json:"bytes"`
+	CompressedSize int64                     `json:"compressed_bytes"`
+	Labels         map[string]map[string]int `json:"labels"`
+	CreatedAt      time.Time                 `json:"created_at"`
+}
+
+// segmentRecord is one line of a segment file.
+type segmentRecord struct {
+	Seq uint64 `json:"seq"`
+	LogEntry
+}
+
+// StorageStats describes both storage tiers.
+type StorageStats struct {
+	Persistent      bool      `json:"persistent"`
+	DataDir         string    `json:"data_dir,omitempty"`
+	HotEntries      int       `json:"hot_entries"`
+	Segments        int       `json:"segments"`
+	ColdEntries     int       `json:"cold_entries"`
+	ColdBytes       int64     `json:"cold_bytes"`
+	CompressedBytes int64     `json:"compressed_bytes"`
+	CompressedHR    string    `json:"compressed_hr"`
+	Oldest          time.Time `json:"oldest,omitempty"`
+}
+
+// logFilter narrows a scan across both tiers. Namespace and level match
+// exactly, pod and container by substring, as in the search handlers.
+type logFilter struct {
+	Namespace string
+	Level     string
+	Pod       string
+	Container string
+	Start     time.Time
+	End       time.Time
+}
+
+func (f logFilter) matches(e LogEntry) bool {
+	if f.Namespace != "" && e.Namespace != f.Namespace {
+		return false
+	}
+	if f.Level != "" && e.Level != f.Level {
+		return false
+	}
+	if f.Pod != "" && !strings.Contains(e.Pod, f.Pod) {
+		return false
+	}
+	if f.Container != "" && !strings.Contains(e.Container, f.Container) {
+		return false
+	}
+	if !f.Start.IsZero() && e.Timestamp.Before(f.Start) {
+		return false
+	}
+	if !f.End.IsZero() && e.Timestamp.After(f.End) {
+		return false
+	}
+	return true
+}
+
+// mayMatch reports whether a segment can hold entries matching f, using
+// only its index.
+func (s *SegmentInfo) mayMatch(f logFilter) bool {
+	if !f.Start.IsZero() && s.MaxTime.Before(f.Start) {
+		return false
+	}
+	if !f.End.IsZero() && s.MinTime.After(f.End) {
+		return false
+	}
+	if f.Namespace != "" && s.Labels["namespace"][f.Namespace] == 0 {
+		return false
+	}
+	if f.Level != "" && s.Labels["level"][f.Level] == 0 {
+		return false
+	}
+	return s.hasLabelContaining("pod", f.Pod) && s.hasLabelContaining("container", f.Container)
+}
+
+func (s *SegmentInfo) hasLabelContaining(label, sub string) bool {
+	if sub == "" {
+		return true
+	}
+	for v := range s.Labels[label] {
+		if strings.Contains(v, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// SegmentStore manages the segments under one data directory.
+type SegmentStore struct {
+	dir string
+
+	mu       sync.RWMutex
+	segments []*SegmentInfo // Ordered by sequence
+	flushMu  sync.Mutex     // Serialises writers
+
+	cacheMu sync.Mutex
+	cache   map[string][]segmentRecord
+	lru     []string
+}
+
+// OpenSegmentStore loads the indexes under dir, rebuilding any that are
+// missing because scribe stopped between writing a segment and its index.
+func OpenSegmentStore(dir string) (*SegmentStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ss := &SegmentStore{dir: dir, cache: make(map[string][]segmentRecord)}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(path, ".idx.json"):
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			var seg SegmentInfo
+			if err := json.Unmarshal(data, &seg); err != nil {
+				log.Printf("Skipping unreadable segment index %s: %v", path, err)
+				return nil
+			}
+			ss.segments = append(ss.segments, &seg)
+		case strings.HasSuffix(path, ".log.gz"):
+			if _, err := os.Stat(strings.TrimSuffix(path, ".log.gz") + ".idx.json"); err == nil {
+				return nil
+			}
+			rel, _ := filepath.Rel(dir, path)
+			seg, err := ss.rebuildIndex(rel)
+			if err != nil {
+				log.Printf("Discarding unreadable segment %s: %v", path, err)
+				os.Remove(path)
+				return nil
+			}
+			ss.segments = append(ss.segments, seg)
+		case strings.HasSuffix(path, ".tmp"):
+			os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ss.segments, func(i, j int) bool { return ss.segments[i].MinSeq < ss.segments[j].MinSeq })
+	return ss, nil
+}
+
+func (ss *SegmentStore) rebuildIndex(rel string) (*SegmentInfo, error) {
+	records, err := ss.readFile(rel)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("empty segment")
+	}
+	seg := newSegmentInfo(records)
+	seg.File = rel
+	seg.ID = segmentID(rel)
+	if info, err := os.Stat(filepath.Join(ss.dir, rel)); err == nil {
+		seg.CompressedSize = info.Size()
+		seg.CreatedAt = info.ModTime()
+	}
+	return seg, ss.writeIndex(seg)
+}
+
+func segmentID(rel string) string {
+	return strings.TrimSuffix(filepath.Base(rel), ".log.gz")
+}
+
+func newSegmentInfo(records []segmentRecord) *SegmentInfo {
+	seg := &SegmentInfo{
+		MinSeq:  records[0].Seq,
+		MaxSeq:  records[len(records)-1].Seq,
+		MinTime: records[0].Timestamp,
+		MaxTime: records[0].Timestamp,
+		Entries: len(records),
+		Labels:  make(map[string]map[string]int),
+	}
+	for _, l := range segmentLabels {
+		seg.Labels[l] = make(map[string]int)
+	}
+	for _, r := range records {
+		if r.Timestamp.Before(seg.MinTime) {
+			seg.MinTime = r.Timestamp
+		}
+		if r.Timestamp.After(seg.MaxTime) {
+			seg.MaxTime = r.Timestamp
+		}
+		seg.Bytes += int64(r.Size)
+		seg.Labels["namespace"][r.Namespace]++
+		seg.Labels["pod"][r.Pod]++
+		seg.Labels["container"][r.Container]++
+		seg.Labels["level"][r.Level]++
+	}
+	return seg
+}
+
+// Write stores records, which must be consecutive by sequence, as a new
+// segment.
+func (ss *SegmentStore) Write(records []segmentRecord) (*SegmentInfo, error) {
+	if len(records) == 0 {
+		return nil, nil
+	}
+	ss.flushMu.Lock()
+	defer ss.flushMu.Unlock()
+
+	seg := newSegmentInfo(records)
+	seg.CreatedAt = time.Now().UTC()
+	seg.ID = fmt.Sprintf("%016d", seg.MinSeq)
+	seg.File = filepath.Join(seg.CreatedAt.Format("2006-01-02"), seg.ID+".log.gz")
+
+	path := filepath.Join(ss.dir, seg.File)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(path); err == nil {
+		seg.CompressedSize = info.Size()
+	}
+	if err := ss.writeIndex(seg); err != nil {
+		return nil, err
+	}
+
+	ss.mu.Lock()
+	ss.segments = append(ss.segments, seg)
+	ss.mu.Unlock()
+	return seg, nil
+}
+
+func (ss *SegmentStore) writeIndex(seg *SegmentInfo) error {
+	data, err := json.Marshal(seg)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(ss.dir, strings.TrimSuffix(seg.File, ".log.gz")+".idx.json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Segments returns a snapshot of the segment indexes, oldest first.
+func (ss *SegmentStore) Segments() []*SegmentInfo {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return append([]*SegmentInfo(nil), ss.segments...)
+}
+
+// LastSeq is the highest sequence number on disk.
+func (ss *SegmentStore) LastSeq() uint64 {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	if len(ss.segments) == 0 {
+		return 0
+	}
+	return ss.segments[len(ss.segments)-1].MaxSeq
+}
+
+// BoundaryAfter returns the last sequence number of the segment holding
+// seq, or false if seq has not been written yet.
+func (ss *SegmentStore) BoundaryAfter(seq uint64) (uint64, bool) {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	i := sort.Search(len(ss.segments), func(i int) bool { return ss.segments[i].MaxSeq >= seq })
+	if i == len(ss.segments) {
+		return 0, false
+	}
+	return ss.segments[i].MaxSeq, true
+}
+
+// Delete removes segments by ID and returns how many compressed bytes
+// were freed.
+func (ss *SegmentStore) Delete(ids map[string]bool) (int, int64) {
+	ss.mu.Lock()
+	var kept, removed []*SegmentInfo
+	for _, seg := range ss.segments {
+		if ids[seg.ID] {
+			removed = append(removed, seg)
+		} else {
+			kept = append(kept, seg)
+		}
+	}
+	ss.segments = kept
+	ss.mu.Unlock()
+
+	var freed int64
+	for _, seg := range removed {
+		path := filepath.Join(ss.dir, seg.File)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to delete segment %s: %v", seg.ID, err)
+		}
+		os.Remove(strings.TrimSuffix(path, ".log.gz") + ".idx.json")
+		// Drop the day directory once it is empty
+		os.Remove(filepath.Dir(path))
+		freed += seg.CompressedSize
+
+		ss.cacheMu.Lock()
+		delete(ss.cache, seg.File)
+		ss.cacheMu.Unlock()
+	}
+	return len(removed), freed
+}
+
+// DeleteAll removes every segment.
+func (ss *SegmentStore) DeleteAll() int {
+	ids := make(map[string]bool)
+	for _, seg := range ss.Segments() {
+		ids[seg.ID] = true
+	}
+	n, _ := ss.Delete(ids)
+	return n
+}
+
+// Read returns a segment's records, oldest first. Recently read segments
+// are cached since searches tend to revisit the newest ones.
+func (ss *SegmentStore) Read(seg *SegmentInfo) ([]segmentRecord, error) {
+	ss.cacheMu.Lock()
+	if records, ok := ss.cache[seg.File]; ok {
+		ss.touchLocked(seg.File)
+		ss.cacheMu.Unlock()
+		return records, nil
+	}
+	ss.cacheMu.Unlock()
+
+	records, err := ss.readFile(seg.File)
+	if err != nil {
+		return nil, err
+	}
+
+	ss.cacheMu.Lock()
+	ss.cache[seg.File] = records
+	ss.touchLocked(seg.File)
+	for len(ss.lru) > segmentCacheSize {
+		delete(ss.cache, ss.lru[0])
+		ss.lru = ss.lru[1:]
+	}
+	ss.cacheMu.Unlock()
+	return records, nil
+}
+
+func (ss *SegmentStore) touchLocked(file string) {
+	for i, f := range ss.lru {
+		if f == file {
+			ss.lru = append(ss.lru[:i], ss.lru[i+1:]...)
+			break
+		}
+	}
+	ss.lru = append(ss.lru, file)
+}
+
+func (ss *SegmentStore) readFile(rel string) ([]segmentRecord, error) {
+	f, err := os.Open(filepath.Join(ss.dir, rel))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var records []segmentRecord
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var r segmentRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil && err != io.ErrUnexpectedEOF {
+		return records, err
+	}
+	return records, nil
+}
+
+// ==================== RETENTION ====================
+
+// segmentExpired decides whether every entry in a segment is past
+// retention. Each namespace/level combination in the segment is checked
+// against the policies that cover it; combinations no policy covers fall
+// back to the store-wide retention hours. newer holds, per policy, how
+// many matching entries are in segments newer than this one.
+func segmentExpired(seg *SegmentInfo, policies []RetentionPolicy, defaultHours int, newer map[string]int, now time.Time) bool {
+	age := now.Sub(seg.MaxTime)
+	for ns := range seg.Labels["namespace"] {
+		for level := range seg.Labels["level"] {
+			covered, expired := false, false
+			for _, p := range policies {
+				if !p.Enabled || (p.Namespace != "" && p.Namespace != ns) || (p.Level != "" && p.Level != level) {
+					continue
+				}
+				covered = true
+				if p.MaxAge > 0 && age > time.Duration(p.MaxAge)*time.Hour {
+					expired = true
+				}
+				if p.MaxEntries > 0 && newer[p.ID] >= p.MaxEntries {
+					expired = true
+				}
+			}
+			if !covered {
+				expired = defaultHours > 0 && age > time.Duration(defaultHours)*time.Hour
+			}
+			if !expired {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// policyMatches estimates how many entries of a segment a policy covers.
+// The index keeps namespaces and levels separately, so a policy on both
+// counts the smaller of the two.
+func policyMatches(seg *SegmentInfo, p RetentionPolicy) int {
+	n := seg.Entries
+	if p.Namespace != "" && seg.Labels["namespace"][p.Namespace] < n {
+		n = seg.Labels["namespace"][p.Namespace]
+	}
+	if p.Level != "" && seg.Labels["level"][p.Level] < n {
+		n = seg.Labels["level"][p.Level]
+	}
+	return n
+}
+
+// enforceDiskLimit deletes the oldest segments until the store fits in
+// maxBytes of compressed data.
+func (ss *SegmentStore) enforceDiskLimit(maxBytes int64) (int, int64) {
+	if maxBytes <= 0 {
+		return 0, 0
+	}
+	segments := ss.Segments()
+	var total int64
+	for _, seg := range segments {
+		total += seg.CompressedSize
+	}
+	ids := make(map[string]bool)
+	for _, seg := range segments {
+		if total <= maxBytes {
+			break
+		}
+		ids[seg.ID] = true
+		total -= seg.CompressedSize
+	}
+	if len(ids) == 0 {
+		return 0, 0
+	}
+	return ss.Delete(ids)
+}
+
+// ==================== TIERED LOG STORE ====================
+
+// EnableSegments attaches a disk tier to the store. Entries keep their
+// sequence numbers across restarts so the tiers never overlap.
+func (ls *LogStore) EnableSegments(ss *SegmentStore, maxDiskBytes int64) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.segments = ss
+	ls.maxDiskBytes = maxDiskBytes
+	ls.nextSeq = ss.LastSeq()
+	ls.flushedSeq = ls.nextSeq
+	ls.lastFlush = time.Now()
+}
+
+// hotFloorLocked is the lowest sequence number held in memory; anything
+// below it is only on disk.
+func (ls *LogStore) hotFloorLocked() uint64 {
+	if len(ls.entries) > 0 {
+		return ls.entries[0].seq
+	}
+	return ls.nextSeq + 1
+}
+
+// alignCutLocked adjusts a trim of the hot tail so it never drops entries
+// that are not on disk yet and always ends on a segment boundary, keeping
+// the two tiers disjoint.
+func (ls *LogStore) alignCutLocked(cut int) int {
+	if ls.segments == nil || cut <= 0 {
+		return cut
+	}
+	last := ls.entries[cut-1].seq
+	if last > ls.flushedSeq {
+		last = ls.flushedSeq
+	}
+	if last < ls.entries[0].seq {
+		return 0
+	}
+	boundary, ok := ls.segments.BoundaryAfter(last)
+	if !ok {
+		return 0
+	}
+	return sort.Search(len(ls.entries), func(i int) bool { return ls.entries[i].seq > boundary })
+}
+
+// flushDueLocked reports whether the unflushed part of the tail should be
+// written out: it is large enough, old enough, or the hour has turned so
+// segments stay within one hour.
+func (ls *LogStore) flushDueLocked(now time.Time) bool {
+	if ls.segments == nil || ls.nextSeq == ls.flushedSeq {
+		return false
+	}
+	return ls.nextSeq-ls.flushedSeq >= defaultSegmentEntries ||
+		now.Sub(ls.lastFlush) >= defaultSegmentMaxAge ||
+		now.Truncate(time.Hour) != ls.lastFlush.Truncate(time.Hour)
+}
+
+// Flush writes every entry not yet on disk as a new segment. Concurrent
+// calls return immediately while a flush is running.
+func (ls *LogStore) Flush() error {
+	if ls.segments == nil || !ls.flushMu.TryLock() {
+		return nil
+	}
+	defer ls.flushMu.Unlock()
+
+	ls.mu.RLock()
+	start := sort.Search(len(ls.entries), func(i int) bool { return ls.entries[i].seq > ls.flushedSeq })
+	records := make([]segmentRecord, 0, len(ls.entries)-start)
+	for _, e := range ls.entries[start:] {
+		records = append(records, segmentRecord{Seq: e.seq, LogEntry: e})
+	}
+	ls.mu.RUnlock()
+	if len(records) == 0 {
+		return nil
+	}
+
+	if _, err := ls.segments.Write(records); err != nil {
+		return err
+	}
+	ls.mu.Lock()
+	ls.flushedSeq = records[len(records)-1].Seq
+	ls.lastFlush = time.Now()
+	ls.mu.Unlock()
+	return nil
+}
+
+// maintainSegments flushes the tail when due and enforces retention on
+// the disk tier.
+func maintainSegments(ctx context.Context) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	lastRetention := time.Time{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			store.mu.RLock()
+			due := store.flushDueLocked(now)
+			store.mu.RUnlock()
+			if due {
+				if err := store.Flush(); err != nil {
+					log.Printf("Failed to flush logs to disk: %v", err)
+				}
+			}
+
+			if now.Sub(lastRetention) < 5*time.Minute {
+				continue
+			}
+			lastRetention = now
+			store.retentionMu.RLock()
+			hours := store.retentionHours
+			store.retentionMu.RUnlock()
+			if n, freed := retentionStore.ApplyPolicies(store.segments, hours); n > 0 {
+				log.Printf("Retention removed %d segments (%s)", n, formatBytes(freed))
+			}
+			if n, freed := store.segments.enforceDiskLimit(store.maxDiskBytes); n > 0 {
+				log.Printf("Disk limit removed %d oldest segments (%s)", n, formatBytes(freed))
+			}
+		}
+	}
+}
+
+// scan visits entries across both tiers, newest or oldest first, until fn
+// returns false. Segments whose index rules out the filter are never
+// decompressed.
+func (ls *LogStore) scan(f logFilter, newestFirst bool, fn func(LogEntry) bool) {
+	ls.mu.RLock()
+	// Entries inside this slice are never modified in place; Add appends
+	// past its end and trims by reslicing
+	hot := ls.entries
+	floor := ls.hotFloorLocked()
+	ls.mu.RUnlock()
+
+	var cold []*SegmentInfo
+	if ls.segments != nil {
+		for _, seg := range ls.segments.Segments() {
+			if seg.MinSeq < floor && seg.mayMatch(f) {
+				cold = append(cold, seg)
+			}
+		}
+	}
+
+	visit := func(e LogEntry) bool {
+		if !f.matches(e) {
+			return true
+		}
+		return fn(e)
+	}
+	visitSegment := func(seg *SegmentInfo) bool {
+		records, err := ls.segments.Read(seg)
+		if err != nil {
+			log.Printf("Failed to read segment %s: %v", seg.ID, err)
+			return true
+		}
+		for i := range records {
+			if newestFirst {
+				i = len(records) - 1 - i
+			}
+			if records[i].Seq >= floor {
+				continue
+			}
+			e := records[i].LogEntry
+			e.seq = records[i].Seq
+			if !visit(e) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if newestFirst {
+		for i := len(hot) - 1; i >= 0; i-- {
+			if !visit(hot[i]) {
+				return
+			}
+		}
+		for i := len(cold) - 1; i >= 0; i-- {
+			if !visitSegment(cold[i]) {
+				return
+			}
+		}
+		return
+	}
+	for _, seg := range cold {
+		if !visitSegment(seg) {
+			return
+		}
+	}
+	for _, e := range hot {
+		if !visit(e) {
+			return
+		}
+	}
+}
+
+// coldSegmentsLocked returns the segments holding only entries that have
+// left memory.
+func (ls *LogStore) coldSegmentsLocked() []*SegmentInfo {
+	if ls.segments == nil {
+		return nil
+	}
+	floor := ls.hotFloorLocked()
+	var cold []*SegmentInfo
+	for _, seg := range ls.segments.Segments() {
+		if seg.MaxSeq < floor {
+			cold = append(cold, seg)
+		}
+	}
+	return cold
+}
+
+func (ls *LogStore) storageStatsLocked() StorageStats {
+	stats := StorageStats{HotEntries: len(ls.entries)}
+	if len(ls.entries) > 0 {
+		stats.Oldest = ls.entries[0].Timestamp
+	}
+	if ls.segments == nil {
+		return stats
+	}
+	stats.Persistent = true
+	stats.DataDir = ls.segments.dir
+	for _, seg := range ls.segments.Segments() {
+		stats.Segments++
+		stats.CompressedBytes += seg.CompressedSize
+		if stats.Oldest.IsZero() || seg.MinTime.Before(stats.Oldest) {
+			stats.Oldest = seg.MinTime
+		}
+	}
+	for _, seg := range ls.coldSegmentsLocked() {
+		stats.ColdEntries += seg.Entries
+		stats.ColdBytes += seg.Bytes
+	}
+	stats.CompressedHR = formatBytes(stats.CompressedBytes)
+	return stats
+}
+
+// Clear drops every entry from both tiers and returns how many there were.
+func (ls *LogStore) Clear() int {
+	ls.mu.Lock()
+	cleared := len(ls.entries)
+	for _, seg := range ls.coldSegmentsLocked() {
+		cleared += seg.Entries
+	}
+	ls.entries = make([]LogEntry, 0, defaultMaxLogEntries)
+	ls.flushedSeq = ls.nextSeq
+	ls.mu.Unlock()
+
+	if ls.segments != nil {
+		ls.segments.DeleteAll()
+	}
+	return cleared
+}